@@ -11,6 +11,7 @@ import (
 
 	"github.com/Nelbert442/dero-golang-pool/pool"
 	"github.com/Nelbert442/dero-golang-pool/stratum"
+	"github.com/Nelbert442/dero-golang-pool/util"
 	"github.com/Nelbert442/dero-golang-pool/website"
 )
 
@@ -19,18 +20,18 @@ var cfg pool.Config
 var MainInfoLogger = logFileOutMain("INFO")
 var MainErrorLogger = logFileOutMain("ERROR")
 
-func startStratum() {
+func startStratum(configFile string) {
 	if cfg.Threads > 0 {
 		runtime.GOMAXPROCS(cfg.Threads)
-		log.Printf("[Main] Running with %v threads", cfg.Threads)
 		MainInfoLogger.Printf("[Main] Running with %v threads", cfg.Threads)
 	} else {
 		n := runtime.NumCPU()
 		runtime.GOMAXPROCS(n)
-		log.Printf("[Main] Running with default %v threads", n)
+		MainInfoLogger.Printf("[Main] Running with default %v threads", n)
 	}
 
 	s := stratum.NewStratum(&cfg)
+	s.SetConfigFile(configFile)
 
 	// If EventsConfig is enabled, start event configuration service/listeners
 	if cfg.EventsConfig.Enabled {
@@ -56,7 +57,7 @@ func startStratum() {
 
 	// If payments enabled, start payment processes / go routines
 	if cfg.PaymentsConfig.Enabled {
-		payments := stratum.NewPayoutsProcessor(&cfg.PaymentsConfig, s)
+		payments := stratum.NewPayoutsProcessor(s)
 		payments.Start(s)
 	}
 
@@ -69,13 +70,31 @@ func startStratum() {
 	s.Listen()
 }
 
-func readConfig(cfg *pool.Config) {
+// Starts only the api [and website] backed by the shared storage, for scaling the frontend separately from the pool
+func startStatsOnly() {
+	if !cfg.API.Enabled {
+		MainErrorLogger.Printf("[Main] Stats-only mode requires the api to be enabled")
+		log.Fatal("[Main] Stats-only mode requires the api to be enabled")
+	}
+
+	s := stratum.NewStatsServer(&cfg)
+
+	// If website enabled, start website service/listeners
+	if cfg.Website.Enabled {
+		go website.NewWebsite(&cfg.Website)
+	}
+
+	// Charts are not started as they write to storage, the pool process keeps them updated
+	a := stratum.NewApiServer(&cfg.API, s, &cfg.EventsConfig)
+	a.Start()
+}
+
+func readConfig(cfg *pool.Config) string {
 	configFileName := "config.json"
 	if len(os.Args) > 1 {
 		configFileName = os.Args[1]
 	}
 	configFileName, _ = filepath.Abs(configFileName)
-	log.Printf("[Main] Loading config: %v", configFileName)
 	MainInfoLogger.Printf("[Main] Loading config: %v", configFileName)
 
 	configFile, err := os.Open(configFileName)
@@ -89,15 +108,11 @@ func readConfig(cfg *pool.Config) {
 		MainErrorLogger.Printf("[Main] Config error: %v", err.Error())
 		log.Fatal("[Main] Config error: ", err.Error())
 	}
+	return configFileName
 }
 
-func logFileOutMain(lType string) *log.Logger {
-	var logFileName string
-	if lType == "ERROR" {
-		logFileName = "logs/mainError.log"
-	} else {
-		logFileName = "logs/main.log"
-	}
+func logFileOutMain(lType string) *util.Logger {
+	logFileName := util.LogFileName("main", lType)
 	os.Mkdir("logs", 0705)
 	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0705)
 	if err != nil {
@@ -106,14 +121,24 @@ func logFileOutMain(lType string) *log.Logger {
 
 	logType := lType + ": "
 	l := log.New(f, logType, log.LstdFlags|log.Lmicroseconds)
-	return l
+	return util.NewLogger("main", lType, l)
 }
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	rand.Seed(time.Now().UTC().UnixNano())
 
-	readConfig(&cfg)
+	MainInfoLogger.Printf("[Main] Starting dero-golang-pool version %s, commit %s", stratum.Version, stratum.Commit)
 
-	startStratum()
+	configFile := readConfig(&cfg)
+	if err := util.ConfigureLogging(cfg.Logging.Format, cfg.Logging.Level, cfg.Logging.Modules); err != nil {
+		MainErrorLogger.Printf("[Main] Config error: %v", err)
+		log.Fatal("[Main] Config error: ", err)
+	}
+
+	if cfg.StatsOnly {
+		startStatsOnly()
+	} else {
+		startStratum(configFile)
+	}
 }
@@ -1,60 +1,224 @@
 package pool
 
 type Config struct {
-	PoolHost                string           `json:"poolHost"`
-	BlockchainExplorer      string           `json:"blockchainExplorer"`
-	TransactionExploer      string           `json:"transactionExplorer"`
-	Address                 string           `json:"address"`
-	DonationAddress         string           `json:"donationAddress"`
-	DonationDescription     string           `json:"donationDescription"`
-	BypassShareValidation   bool             `json:"bypassShareValidation"`
-	Threads                 int              `json:"threads"`
-	Algo                    string           `json:"algo"`
-	Coin                    string           `json:"coin"`
-	CoinUnits               int64            `json:"coinUnits"`
-	CoinDecimalPlaces       int64            `json:"coinDecimalPlaces"`
-	CoinDifficultyTarget    int              `json:"coinDifficultyTarget"`
-	TrustedSharesCount      int64            `json:"trustedSharesCount"`
-	BlockRefreshInterval    string           `json:"blockRefreshInterval"`
-	HashrateExpiration      string           `json:"hashrateExpiration"`
-	StoreMinerStatsInterval string           `json:"storeMinerStatsInterval"`
-	GravitonMaxSnapshots    uint64           `json:"gravitonMaxSnapshots"`
-	GravitonMigrateWait     string           `json:"gravitonMigrateWait"`
-	UpstreamCheckInterval   string           `json:"upstreamCheckInterval"`
-	Upstream                []Upstream       `json:"upstream"`
-	Stratum                 Stratum          `json:"stratum"`
-	API                     APIConfig        `json:"api"`
-	UnlockerConfig          UnlockerConfig   `json:"unlocker"`
-	PaymentsConfig          PaymentsConfig   `json:"payments"`
-	Website                 Website          `json:"website"`
-	PoolCharts              PoolChartsConfig `json:"poolcharts"`
-	SoloCharts              SoloChartsConfig `json:"solocharts"`
-	EventsConfig            EventsConfig     `json:"events"`
+	PoolHost              string     `json:"poolHost"`
+	BlockchainExplorer    string     `json:"blockchainExplorer"`
+	TransactionExploer    string     `json:"transactionExplorer"`
+	Address               string     `json:"address"`
+	DonationAddress       string     `json:"donationAddress"`
+	DonationDescription   string     `json:"donationDescription"`
+	BypassShareValidation bool       `json:"bypassShareValidation"`
+	Threads               int        `json:"threads"`
+	StatsOnly             bool       `json:"statsOnly"`
+	Algo                  string     `json:"algo"`
+	AlgoForks             []AlgoFork `json:"algoForks"`
+	Coin                  string     `json:"coin"`
+	CoinUnits             int64      `json:"coinUnits"`
+	CoinDecimalPlaces     int64      `json:"coinDecimalPlaces"`
+	CoinDifficultyTarget  int        `json:"coinDifficultyTarget"`
+	TrustedSharesCount    int64      `json:"trustedSharesCount"`
+	TrustedSharesPercent  float64    `json:"trustedSharesPercent"`
+	BlockRefreshInterval  string     `json:"blockRefreshInterval"`
+	BlockTemplateMaxAge   string     `json:"blockTemplateMaxAge"`
+	// Templates with a difficulty more than this factor above or below the median of the recent heights are not broadcast, 0 disables the check
+	BlockTemplateMaxDiffChange float64             `json:"blockTemplateMaxDiffChange"`
+	HashrateExpiration         string              `json:"hashrateExpiration"`
+	StoreMinerStatsInterval    string              `json:"storeMinerStatsInterval"`
+	RoundSharesJournal         string              `json:"roundSharesJournal"`
+	ShareWriteBatching         ShareWriteBatching  `json:"shareWriteBatching"`
+	StartupChecks              bool                `json:"startupChecks"`
+	GravitonMaxSnapshots       uint64              `json:"gravitonMaxSnapshots"`
+	GravitonMigrateWait        string              `json:"gravitonMigrateWait"`
+	StorageBackend             string              `json:"storageBackend"`
+	Redis                      RedisConfig         `json:"redis"`
+	UpstreamCheckInterval      string              `json:"upstreamCheckInterval"`
+	UpstreamMaxHeightLag       int64               `json:"upstreamMaxHeightLag"`
+	UpstreamMaxLatency         string              `json:"upstreamMaxLatency"`
+	Upstream                   []Upstream          `json:"upstream"`
+	DaemonNotify               DaemonNotifyConfig  `json:"daemonNotify"`
+	ProxyMode                  ProxyModeConfig     `json:"proxyMode"`
+	Stratum                    Stratum             `json:"stratum"`
+	API                        APIConfig           `json:"api"`
+	UnlockerConfig             UnlockerConfig      `json:"unlocker"`
+	PaymentsConfig             PaymentsConfig      `json:"payments"`
+	Website                    Website             `json:"website"`
+	PoolCharts                 PoolChartsConfig    `json:"poolcharts"`
+	SoloCharts                 SoloChartsConfig    `json:"solocharts"`
+	EventsConfig               EventsConfig        `json:"events"`
+	Webhooks                   WebhooksConfig      `json:"webhooks"`
+	Notifications              NotificationsConfig `json:"notifications"`
+	Telegram                   TelegramConfig      `json:"telegram"`
+	Banning                    BanningConfig       `json:"banning"`
+	Withholding                WithholdingConfig   `json:"withholding"`
+	RejectAlarms               RejectAlarmsConfig  `json:"rejectAlarms"`
+	GeoIP                      GeoIPConfig         `json:"geoip"`
+	Retention                  RetentionConfig     `json:"retention"`
+	MinerEviction              MinerEvictionConfig `json:"minerEviction"`
+	Logging                    LoggingConfig       `json:"logging"`
+}
+
+type LoggingConfig struct {
+	Format  string            `json:"format"`
+	Level   string            `json:"level"`
+	Modules map[string]string `json:"modules"`
+}
+
+type RedisConfig struct {
+	Endpoint string `json:"endpoint"`
+	Password string `json:"password"`
+	Database int64  `json:"database"`
+	PoolSize int    `json:"poolSize"`
+	Prefix   string `json:"prefix"`
+}
+
+type AlgoFork struct {
+	Height uint64 `json:"height"`
+	Algo   string `json:"algo"`
+}
+
+type DaemonNotifyConfig struct {
+	Enabled           bool   `json:"enabled"`
+	Websocket         string `json:"websocket"`
+	SubscribeMethod   string `json:"subscribeMethod"`
+	ReconnectInterval string `json:"reconnectInterval"`
+	Listen            string `json:"listen"`
+	Token             string `json:"token"`
 }
 
 type Upstream struct {
-	Name    string `json:"name"`
-	Host    string `json:"host"`
-	Port    int    `json:"port"`
-	Timeout string `json:"timeout"`
-	Enabled bool   `json:"enabled"`
+	Name     string `json:"name"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Url      string `json:"url"`
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	Timeout  string `json:"timeout"`
+	Enabled  bool   `json:"enabled"`
+}
+
+// Proxy mode: the pool mines the jobs of an upstream pool [logged in as a single miner] instead of daemon block templates, relaying the shares of its miners
+type ProxyModeConfig struct {
+	Enabled           bool   `json:"enabled"`
+	Url               string `json:"url"`
+	TLS               bool   `json:"tls"`
+	Login             string `json:"login"`
+	Password          string `json:"password"`
+	Timeout           string `json:"timeout"`
+	KeepAliveInterval string `json:"keepAliveInterval"`
+	ReconnectInterval string `json:"reconnectInterval"`
 }
 
 type Stratum struct {
-	PaymentID     PaymentID     `json:"paymentId"`
-	FixedDiff     FixedDiff     `json:"fixedDiff"`
-	WorkerID      WorkerID      `json:"workerID"`
-	DonatePercent DonatePercent `json:"donatePercent"`
-	SoloMining    SoloMining    `json:"soloMining"`
-	Timeout       string        `json:"timeout"`
-	MaxFails      int64         `json:"maxFails"`
-	HealthCheck   bool          `json:"healthCheck"`
-	Ports         []Port        `json:"listen"`
-	VarDiff       VarDiffConfig `json:"varDiff"`
+	PaymentID      PaymentID      `json:"paymentId"`
+	FixedDiff      FixedDiff      `json:"fixedDiff"`
+	WorkerID       WorkerID       `json:"workerID"`
+	DonatePercent  DonatePercent  `json:"donatePercent"`
+	SoloMining     SoloMining     `json:"soloMining"`
+	PayoutSettings PayoutSettings `json:"payoutSettings"`
+	Timeout        string         `json:"timeout"`
+	MaxFails       int64          `json:"maxFails"`
+	HealthCheck    bool           `json:"healthCheck"`
+	Ports          []Port         `json:"listen"`
+	VarDiff        VarDiffConfig  `json:"varDiff"`
+
+	// Named difficulty presets ports refer to with profile, e.g. "low", "mid", "high" or "nicehash"
+	DiffProfiles map[string]DiffProfile `json:"diffProfiles"`
+
+	SupportedMethods         []string `json:"supportedMethods"`
+	UnknownMethodLogInterval string   `json:"unknownMethodLogInterval"`
+	WorkerOfflineThreshold   string   `json:"workerOfflineThreshold"`
+	TargetEncoding           string   `json:"targetEncoding"`
+	Maintenance              bool     `json:"maintenance"`
+	MaintenanceMessage       string   `json:"maintenanceMessage"`
+	MaintenancePauseJobs     bool     `json:"maintenancePauseJobs"`
+	WriteQueueSize           int      `json:"writeQueueSize"`
+	WriteTimeout             string   `json:"writeTimeout"`
+	JobCache                 bool     `json:"jobCache"`
+	CompactJobs              bool     `json:"compactJobs"`
+	MaxJobSubmissions        int      `json:"maxJobSubmissions"`
+	JobBacklog               int      `json:"jobBacklog"`
+	RetargetKeepJob          bool     `json:"retargetKeepJob"`
+	JobExpireTemplates       int      `json:"jobExpireTemplates"`
+	ShutdownGracePeriod      string   `json:"shutdownGracePeriod"`
+	MaxConnections           int      `json:"maxConnections"`
+	MaxMinerConnections      int      `json:"maxMinerConnections"`
+	CollapseDuplicates       bool     `json:"collapseDuplicates"`
+	ShareFeedback            bool     `json:"shareFeedback"`
+	StaleGracePeriod         string   `json:"staleGracePeriod"`
+	StaleGraceCredit         float64  `json:"staleGraceCredit"`
+	ShareCacheTTL            string   `json:"shareCacheTtl"`
+	ErrorHelpURL             string   `json:"errorHelpUrl"`
+
+	WelcomeMessage WelcomeMessage `json:"welcomeMessage"`
+	BlockNotify    BlockNotify    `json:"blockNotify"`
+	RateLimit      RateLimit      `json:"rateLimit"`
+	ShareVerifier  ShareVerifier  `json:"shareVerifier"`
+	AddressLists   AddressLists   `json:"addressLists"`
+	Getwork        GetworkConfig  `json:"getwork"`
+	MessageLimits  MessageLimits  `json:"messageLimits"`
+}
+
+type MessageLimits struct {
+	MaxMessageSize int  `json:"maxMessageSize"`
+	MaxDepth       int  `json:"maxDepth"`
+	MaxLogin       int  `json:"maxLogin"`
+	MaxPass        int  `json:"maxPass"`
+	MaxAgent       int  `json:"maxAgent"`
+	MaxJobId       int  `json:"maxJobId"`
+	MaxField       int  `json:"maxField"`
+	Ban            bool `json:"ban"`
+}
+
+type GetworkConfig struct {
+	Enabled          bool     `json:"enabled"`
+	Listen           string   `json:"listen"`
+	Difficulty       int64    `json:"diff"`
+	MaxSessions      int      `json:"maxSessions"`
+	MaxSessionsPerIp int      `json:"maxSessionsPerIp"`
+	SessionTimeout   string   `json:"sessionTimeout"`
+	LongPollTimeout  string   `json:"longPollTimeout"`
+	CorsOrigins      []string `json:"corsOrigins"`
+}
+
+type AddressLists struct {
+	Blacklist     []string `json:"blacklist"`
+	BlacklistFile string   `json:"blacklistFile"`
+	Whitelist     []string `json:"whitelist"`
+	WhitelistFile string   `json:"whitelistFile"`
+	WhitelistOnly bool     `json:"whitelistOnly"`
+}
+
+type WelcomeMessage struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+	Method  string `json:"method"`
+}
+
+type BlockNotify struct {
+	Enabled     bool   `json:"enabled"`
+	AllSessions bool   `json:"allSessions"`
+	Method      string `json:"method"`
+}
+
+type RateLimit struct {
+	Enabled      bool    `json:"enabled"`
+	Login        float64 `json:"login"`
+	GetJob       float64 `json:"getjob"`
+	Submit       float64 `json:"submit"`
+	Burst        int     `json:"burst"`
+	Action       string  `json:"action"`
+	MuteDuration string  `json:"muteDuration"`
+}
+
+type ShareVerifier struct {
+	Workers      int    `json:"workers"`
+	QueueSize    int    `json:"queueSize"`
+	QueueTimeout string `json:"queueTimeout"`
 }
 
 type PaymentID struct {
-	AddressSeparator string `json:"addressSeparator"`
+	AddressSeparator string   `json:"addressSeparator"`
+	ServiceAddresses []string `json:"serviceAddresses"`
 }
 
 type FixedDiff struct {
@@ -74,13 +238,61 @@ type SoloMining struct {
 	AddressSeparator string `json:"addressSeparator"`
 }
 
+type PayoutSettings struct {
+	AddressSeparator string `json:"addressSeparator"`
+}
+
 type Port struct {
 	Difficulty int64  `json:"diff"`
 	MinDiff    int64  `json:"minDiff"`
+	DiffFloor  int64  `json:"diffFloor"`
 	Host       string `json:"host"`
 	Port       int    `json:"port"`
-	MaxConn    int    `json:"maxConn"`
-	Desc       string `json:"desc"`
+	// Max connections of the port, new connections beyond it are rejected. maxConn is the older name of maxConnections, used if maxConnections is not set. 0 is unlimited
+	MaxConnections int    `json:"maxConnections"`
+	MaxConn        int    `json:"maxConn"`
+	Desc           string `json:"desc"`
+	PoolMode       string `json:"poolMode"`
+
+	TLS             bool     `json:"tls"`
+	CertFile        string   `json:"certFile"`
+	KeyFile         string   `json:"keyFile"`
+	TLSMinVersion   string   `json:"tlsMinVersion"`
+	TLSCipherSuites []string `json:"tlsCipherSuites"`
+
+	ProxyProtocol bool `json:"proxyProtocol"`
+
+	NiceHash        bool  `json:"nicehash"`
+	NiceHashMinDiff int64 `json:"nicehashMinDiff"`
+
+	// Bytes of the template reserved space left to each connection of the port to iterate, e.g. by proxies aggregating workers. 0 leaves none
+	ExtraNonceSize int `json:"extraNonceSize"`
+
+	// Farm port: logins need a farm token [POST /api/admin/farms] as password, farm sessions mine at the port diff without vardiff and are exempt from banning,
+	// rateLimit, maxMinerConnections and collapseDuplicates
+	Farm bool `json:"farm"`
+
+	// Pool fee percent of the shares and solo blocks found on the port, unset uses the unlocker poolFee
+	Fee *float64 `json:"fee"`
+
+	// Name of the stratum diffProfiles preset of the port, its settings fill those the port leaves unset
+	Profile string `json:"profile"`
+	// Vardiff bounds of the sessions of the port, 0 uses the varDiff minDiff and maxDiff
+	VarDiffMin int64 `json:"varDiffMin"`
+	VarDiffMax int64 `json:"varDiffMax"`
+}
+
+// Difficulty preset of stratum ports, same settings as the port ones
+type DiffProfile struct {
+	Difficulty      int64  `json:"diff"`
+	MinDiff         int64  `json:"minDiff"`
+	DiffFloor       int64  `json:"diffFloor"`
+	VarDiffMin      int64  `json:"varDiffMin"`
+	VarDiffMax      int64  `json:"varDiffMax"`
+	MaxConnections  int    `json:"maxConnections"`
+	Desc            string `json:"desc"`
+	NiceHash        bool   `json:"nicehash"`
+	NiceHashMinDiff int64  `json:"nicehashMinDiff"`
 }
 
 type VarDiffConfig struct {
@@ -91,6 +303,9 @@ type VarDiffConfig struct {
 	RetargetTime    int64   `json:"retargetTime"`
 	VariancePercent float64 `json:"variancePercent"`
 	MaxJump         float64 `json:"maxJump"`
+	MaxStepUp       float64 `json:"maxStepUp"`
+	MaxStepDown     float64 `json:"maxStepDown"`
+	RestoreDiff     bool    `json:"restoreDiff"`
 }
 
 type APIConfig struct {
@@ -100,10 +315,19 @@ type APIConfig struct {
 	HashrateWindow       string `json:"hashrateWindow"`
 	Payments             int64  `json:"payments"`
 	Blocks               int64  `json:"blocks"`
+	EffortBlocks         int    `json:"effortBlocks"`
 	SSL                  bool   `json:"ssl"`
 	SSLListen            string `json:"sslListen"`
 	CertFile             string `json:"certFile"`
 	KeyFile              string `json:"keyFile"`
+	AdminToken           string `json:"adminToken"`
+	AdminHMACSecret      string `json:"adminHmacSecret"`
+	LiveStats            bool   `json:"liveStats"`
+	LiveMaxClients       int    `json:"liveMaxClients"`
+	// Origins allowed to use the api from a browser [CORS], all if empty or "*"
+	CorsOrigins []string `json:"corsOrigins"`
+	Gzip        bool     `json:"gzip"`
+	ETags       bool     `json:"etags"`
 }
 
 type UnlockerConfig struct {
@@ -112,16 +336,60 @@ type UnlockerConfig struct {
 	Depth          int64   `json:"depth"`
 	Interval       string  `json:"interval"`
 	PoolFeeAddress string  `json:"poolFeeAddress"`
+
+	OrphanCheckDepth    int64 `json:"orphanCheckDepth"`
+	RestoreOrphanShares bool  `json:"restoreOrphanShares"`
+
+	Donations []Donation `json:"donations"`
+}
+
+type Donation struct {
+	Address string  `json:"address"`
+	Percent float64 `json:"percent"`
 }
 
 type PaymentsConfig struct {
-	Enabled      bool   `json:"enabled"`
-	Interval     string `json:"interval"`
-	Mixin        uint64 `json:"mixin"`
-	MaxAddresses uint64 `json:"maxAddresses"`
-	Threshold    uint64 `json:"minPayment"`
-	WalletHost   string `json:"walletHost"`
-	WalletPort   string `json:"walletPort"`
+	Enabled        bool   `json:"enabled"`
+	Interval       string `json:"interval"`
+	Mixin          uint64 `json:"mixin"`
+	MaxAddresses   uint64 `json:"maxAddresses"`
+	Threshold      uint64 `json:"minPayment"`
+	WalletHost     string `json:"walletHost"`
+	WalletPort     string `json:"walletPort"`
+	WalletUrl      string `json:"walletUrl"`
+	WalletLogin    string `json:"walletLogin"`
+	WalletPassword string `json:"walletPassword"`
+	WalletTimeout  string `json:"walletTimeout"`
+
+	ConfirmTracking bool   `json:"confirmTracking"`
+	Confirmations   int64  `json:"confirmations"`
+	ConfirmInterval string `json:"confirmInterval"`
+	ConfirmTimeout  string `json:"confirmTimeout"`
+
+	DryRun bool `json:"dryRun"`
+
+	TxFeePayer   string `json:"txFeePayer"`
+	TxFeeReserve uint64 `json:"txFeeReserve"`
+
+	RetryAttempts   int    `json:"retryAttempts"`
+	RetryBackoff    string `json:"retryBackoff"`
+	RetryMaxBackoff string `json:"retryMaxBackoff"`
+
+	WalletCheckInterval string `json:"walletCheckInterval"`
+	HotWalletBuffer     uint64 `json:"hotWalletBuffer"`
+	ColdWalletAddress   string `json:"coldWalletAddress"`
+
+	Scheme      string  `json:"scheme"`
+	PPLNSWindow float64 `json:"pplnsWindow"`
+
+	MinerSettings    bool   `json:"minerSettings"`
+	MinerMaxPayment  uint64 `json:"minerMaxPayment"`
+	MinerMaxInterval string `json:"minerMaxInterval"`
+
+	MinerSettingsIPAuth       bool   `json:"minerSettingsIpAuth"`
+	MinerSettingsCodeAmount   uint64 `json:"minerSettingsCodeAmount"`
+	MinerSettingsCodeInterval string `json:"minerSettingsCodeInterval"`
+	MinerSettingsCodeLimit    int    `json:"minerSettingsCodeLimit"`
 }
 
 type Website struct {
@@ -139,13 +407,17 @@ type PoolChartsConfig struct {
 	Miners     ChartDataConfig `json:"miners"`
 	Workers    ChartDataConfig `json:"workers"`
 	Difficulty ChartDataConfig `json:"difficulty"`
+	// Hashrate history of each miner address, read with /api/charts?chart=minerhashrate&address=<address>
+	MinerHashrate ChartDataConfig  `json:"minerHashrate"`
+	Retention     []ChartRetention `json:"retention"`
 }
 
 type SoloChartsConfig struct {
-	Interval int64           `json:"interval"`
-	Hashrate ChartDataConfig `json:"hashrate"`
-	Miners   ChartDataConfig `json:"miners"`
-	Workers  ChartDataConfig `json:"workers"`
+	Interval  int64            `json:"interval"`
+	Hashrate  ChartDataConfig  `json:"hashrate"`
+	Miners    ChartDataConfig  `json:"miners"`
+	Workers   ChartDataConfig  `json:"workers"`
+	Retention []ChartRetention `json:"retention"`
 }
 
 type ChartDataConfig struct {
@@ -153,6 +425,12 @@ type ChartDataConfig struct {
 	MaximumPeriod int64 `json:"maximumPeriod"`
 }
 
+// Downsampled tier of chart data, in seconds. Values aging out of maximumPeriod [or the previous tier] are averaged into one value per resolution and kept for period
+type ChartRetention struct {
+	Resolution int64 `json:"resolution"`
+	Period     int64 `json:"period"`
+}
+
 type EventsConfig struct {
 	Enabled                 bool                    `json:"enabled"`
 	RandomRewardEventConfig RandomRewardEventConfig `json:"randomrewardevent"`
@@ -167,3 +445,102 @@ type RandomRewardEventConfig struct {
 	MinerPercentCriteria  float64 `json:"minerPercentCriteria"`
 	Bonus1hrDayEventDate  string  `json:"bonus1hrDayEventDate"`
 }
+
+type GeoIPConfig struct {
+	Enabled     bool   `json:"enabled"`
+	Database    string `json:"database"`
+	ASNDatabase string `json:"asnDatabase"`
+}
+
+type WithholdingConfig struct {
+	Enabled           bool    `json:"enabled"`
+	Interval          string  `json:"interval"`
+	Window            string  `json:"window"`
+	MinExpectedBlocks float64 `json:"minExpectedBlocks"`
+	Probability       float64 `json:"probability"`
+}
+
+type RejectAlarmsConfig struct {
+	Enabled  bool             `json:"enabled"`
+	Interval string           `json:"interval"`
+	Window   string           `json:"window"`
+	Pool     RejectThresholds `json:"pool"`
+	Port     RejectThresholds `json:"port"`
+	Miner    RejectThresholds `json:"miner"`
+	Worker   RejectThresholds `json:"worker"`
+}
+
+type RejectThresholds struct {
+	RejectRate float64 `json:"rejectRate"`
+	StaleRate  float64 `json:"staleRate"`
+	MinShares  int64   `json:"minShares"`
+}
+
+type RetentionConfig struct {
+	Enabled     bool   `json:"enabled"`
+	Interval    string `json:"interval"`
+	RoundDays   int64  `json:"roundDays"`
+	ChartDays   int64  `json:"chartDays"`
+	MaxBlocks   int    `json:"maxBlocks"`
+	MaxPayments int    `json:"maxPayments"`
+	ArchiveDir  string `json:"archiveDir"`
+	Compact     bool   `json:"compact"`
+}
+
+type MinerEvictionConfig struct {
+	Enabled      bool   `json:"enabled"`
+	Interval     string `json:"interval"`
+	OfflineAfter string `json:"offlineAfter"`
+}
+
+type ShareWriteBatching struct {
+	Enabled       bool   `json:"enabled"`
+	FlushInterval string `json:"flushInterval"`
+	MaxEntries    int    `json:"maxEntries"`
+}
+
+type WebhooksConfig struct {
+	Enabled            bool   `json:"enabled"`
+	MinerConnectURL    string `json:"minerConnectUrl"`
+	MinerDisconnectURL string `json:"minerDisconnectUrl"`
+	BlockFoundURL      string `json:"blockFoundUrl"`
+	WorkerOfflineURL   string `json:"workerOfflineUrl"`
+	WithholdingURL     string `json:"withholdingUrl"`
+	WalletAlertURL     string `json:"walletAlertUrl"`
+	RejectAlarmURL     string `json:"rejectAlarmUrl"`
+	Timeout            string `json:"timeout"`
+	Retries            int    `json:"retries"`
+	RetryInterval      string `json:"retryInterval"`
+	QueueSize          int    `json:"queueSize"`
+}
+
+type NotificationsConfig struct {
+	Enabled       bool   `json:"enabled"`
+	SMTPHost      string `json:"smtpHost"`
+	SMTPPort      int    `json:"smtpPort"`
+	SMTPUsername  string `json:"smtpUsername"`
+	SMTPPassword  string `json:"smtpPassword"`
+	EmailFrom     string `json:"emailFrom"`
+	AllowWebhooks bool   `json:"allowWebhooks"`
+	Timeout       string `json:"timeout"`
+	QueueSize     int    `json:"queueSize"`
+}
+
+type TelegramConfig struct {
+	Enabled      bool   `json:"enabled"`
+	BotToken     string `json:"botToken"`
+	BotName      string `json:"botName"`
+	OperatorChat string `json:"operatorChat"`
+	AnnounceChat string `json:"announceChat"`
+	Timeout      string `json:"timeout"`
+	QueueSize    int    `json:"queueSize"`
+}
+
+type BanningConfig struct {
+	Enabled        bool    `json:"enabled"`
+	CheckWindow    string  `json:"checkWindow"`
+	MinShares      int64   `json:"minShares"`
+	InvalidPercent float64 `json:"invalidPercent"`
+	BanDuration    string  `json:"banDuration"`
+	BanSubnet      bool    `json:"banSubnet"`
+}
@@ -21,6 +21,7 @@ type RPCClient struct {
 	Accepts          int64
 	Rejects          int64
 	LastSubmissionAt int64
+	LastLatency      int64
 	FailsCount       int64
 	Url              *url.URL
 	login            string
@@ -75,6 +76,20 @@ type GetBalanceReply struct {
 	UnlockedBalance uint64 `json:"unlocked_balance"`
 }
 
+type GetTransferByTxidReply struct {
+	Transfer Transfer_Entry `json:"transfer"`
+}
+
+type Transfer_Entry struct {
+	Height     uint64 `json:"height"`
+	Topoheight int64  `json:"topoheight"`
+	BlockHash  string `json:"blockhash"`
+	TXID       string `json:"txid"`
+	Amount     uint64 `json:"amount"`
+	Fees       uint64 `json:"fees"`
+	Status     byte   `json:"status"`
+}
+
 type (
 	Destinations struct {
 		Amount  uint64 `json:"amount"`
@@ -129,13 +144,26 @@ type JSONRpcResp struct {
 	Error  map[string]interface{} `json:"error"`
 }
 
+// Error replied by the rpc server, the request was received and rejected
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
 func NewRPCClient(cfg *pool.Upstream) (*RPCClient, error) {
-	rawUrl := fmt.Sprintf("http://%s:%v/json_rpc", cfg.Host, cfg.Port)
+	// Full url takes precedence over host and port, i.e. for https or reverse proxied endpoints
+	rawUrl := cfg.Url
+	if rawUrl == "" {
+		rawUrl = fmt.Sprintf("http://%s:%v/json_rpc", cfg.Host, cfg.Port)
+	}
 	url, err := url.Parse(rawUrl)
 	if err != nil {
 		return nil, err
 	}
-	rpcClient := &RPCClient{Name: cfg.Name, Url: url}
+	rpcClient := &RPCClient{Name: cfg.Name, Url: url, login: cfg.Login, password: cfg.Password}
 	timeout, _ := time.ParseDuration(cfg.Timeout)
 	rpcClient.client = &http.Client{
 		Timeout: timeout,
@@ -224,6 +252,19 @@ func (r *RPCClient) SendTransaction(url string, transferParams Transfer_Params)
 	return reply, err
 }
 
+func (r *RPCClient) GetTransferByTxid(url string, txid string) (*GetTransferByTxidReply, error) {
+	rpcResp, err := r.doPost(url, "get_transfer_by_txid", map[string]interface{}{"txid": txid})
+	if err != nil {
+		return nil, err
+	}
+	var reply *GetTransferByTxidReply
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, err
+}
+
 func (r *RPCClient) SubmitBlock(blocktemplate_blob string, blockhashing_blob string) (*JSONRpcResp, error) {
 	return r.doPost(r.Url.String(), "submitblock", []string{blocktemplate_blob, blockhashing_blob})
 }
@@ -236,7 +277,9 @@ func (r *RPCClient) doPost(url, method string, params interface{}) (*JSONRpcResp
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 	req.SetBasicAuth(r.login, r.password)
+	start := time.Now()
 	resp, err := r.client.Do(req)
+	atomic.StoreInt64(&r.LastLatency, int64(time.Since(start)))
 	if err != nil {
 		r.markSick()
 		return nil, err
@@ -255,7 +298,7 @@ func (r *RPCClient) doPost(url, method string, params interface{}) (*JSONRpcResp
 	}
 	if rpcResp.Error != nil {
 		r.markSick()
-		return nil, errors.New(rpcResp.Error["message"].(string))
+		return nil, &RPCError{Message: rpcResp.Error["message"].(string)}
 	}
 	return rpcResp, err
 }
@@ -268,7 +311,9 @@ func (r *RPCClient) doPostNoParams(url, method string) (*JSONRpcResp, error) {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 	req.SetBasicAuth(r.login, r.password)
+	start := time.Now()
 	resp, err := r.client.Do(req)
+	atomic.StoreInt64(&r.LastLatency, int64(time.Since(start)))
 	if err != nil {
 		r.markSick()
 		return nil, err
@@ -287,7 +332,7 @@ func (r *RPCClient) doPostNoParams(url, method string) (*JSONRpcResp, error) {
 	}
 	if rpcResp.Error != nil {
 		r.markSick()
-		return nil, errors.New(rpcResp.Error["message"].(string))
+		return nil, &RPCError{Message: rpcResp.Error["message"].(string)}
 	}
 	return rpcResp, err
 }
@@ -0,0 +1,239 @@
+package stratum
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// Addresses refused at login [blacklist: known abusive or sanctioned addresses] and, with whitelistOnly for private pools, the only addresses allowed to log in.
+// Each list is the addresses of the config and of its file [one address per line, # starts a comment], re-read on config reload. Admin changes are written to the file.
+// Addresses are matched by their public key, so listing an address also covers its integrated addresses
+type AddressLists struct {
+	mu            sync.RWMutex
+	fileMu        sync.Mutex
+	poolAddress   string
+	blacklist     map[string]string
+	whitelist     map[string]string
+	whitelistOnly bool
+}
+
+func NewAddressLists() *AddressLists {
+	return &AddressLists{blacklist: make(map[string]string), whitelist: make(map[string]string)}
+}
+
+// Reads the lines of a list file, a missing file has none [admin additions create it]
+func readAddressFileLines(file string) ([]string, error) {
+	if file == "" {
+		return nil, nil
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// Returns the address of a list file line, "" for empty and comment lines
+func addressFileLine(line string) string {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+func readAddressFile(file string) ([]string, error) {
+	lines, err := readAddressFileLines(file)
+	var addresses []string
+	for _, line := range lines {
+		if address := addressFileLine(line); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses, err
+}
+
+// Returns the key address is listed and checked under, the public key of the address or the address itself if it does not parse
+func addressListKey(address, poolAddress string) string {
+	address = strings.TrimSpace(address)
+	if info, err := util.ParseAddress(address, poolAddress); err == nil {
+		return info.PublicKey
+	}
+	return address
+}
+
+// Returns the set of listed keys and the listed address of each key
+func addressSet(config []string, file string, poolAddress string) (map[string]string, error) {
+	set := make(map[string]string)
+	for _, address := range config {
+		set[addressListKey(address, poolAddress)] = strings.TrimSpace(address)
+	}
+	addresses, err := readAddressFile(file)
+	for _, address := range addresses {
+		set[addressListKey(address, poolAddress)] = address
+	}
+	return set, err
+}
+
+// Swaps in the lists of cfg. A list whose file can not be read keeps its previous addresses
+func (l *AddressLists) load(cfg *pool.AddressLists, poolAddress string) error {
+	blacklist, blacklistErr := addressSet(cfg.Blacklist, cfg.BlacklistFile, poolAddress)
+	whitelist, whitelistErr := addressSet(cfg.Whitelist, cfg.WhitelistFile, poolAddress)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.poolAddress = poolAddress
+	if blacklistErr == nil {
+		l.blacklist = blacklist
+	}
+	if whitelistErr == nil {
+		l.whitelist = whitelist
+	}
+	l.whitelistOnly = cfg.WhitelistOnly
+
+	if blacklistErr != nil {
+		return blacklistErr
+	}
+	return whitelistErr
+}
+
+// Returns the stratum error for a login as address, nil if the address may log in
+func (l *AddressLists) check(address string) *ErrorReply {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	key := addressListKey(address, l.poolAddress)
+	if _, listed := l.blacklist[key]; listed {
+		return &ErrorReply{Code: errCodeAddressBlacklisted, Message: "Address is not allowed to mine on this pool"}
+	}
+	if _, listed := l.whitelist[key]; l.whitelistOnly && !listed {
+		return &ErrorReply{Code: errCodeAddressNotWhitelisted, Message: "Address is not whitelisted on this private pool"}
+	}
+	return nil
+}
+
+// Returns the sorted addresses of both lists
+func (l *AddressLists) list() (blacklist []string, whitelist []string, whitelistOnly bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, address := range l.blacklist {
+		blacklist = append(blacklist, address)
+	}
+	for _, address := range l.whitelist {
+		whitelist = append(whitelist, address)
+	}
+	sort.Strings(blacklist)
+	sort.Strings(whitelist)
+	return blacklist, whitelist, l.whitelistOnly
+}
+
+// Loads the address lists of the running config and closes the sessions of addresses no longer allowed
+func (s *StratumServer) loadAddressLists() {
+	cfg := &s.currentConfig().Stratum.AddressLists
+	if err := s.addressLists.load(cfg, s.currentConfig().Address); err != nil {
+		StratumErrorLogger.Printf("[Stratum] Error reading address lists, keeping the previous list: %v", err)
+	}
+
+	blacklist, whitelist, whitelistOnly := s.addressLists.list()
+	if len(blacklist) > 0 || whitelistOnly {
+		StratumInfoLogger.Printf("[Stratum] Loaded address lists, blacklisted: %v, whitelisted: %v, whitelistOnly: %v", len(blacklist), len(whitelist), whitelistOnly)
+	}
+	if whitelistOnly && len(whitelist) == 0 {
+		StratumErrorLogger.Printf("[Stratum] whitelistOnly is set with an empty whitelist, every login will be rejected")
+	}
+	s.closeDisallowedSessions()
+}
+
+// Adds [or removes] address to the blacklist or whitelist file and reloads the lists, other lines and comments of the file are kept. Returns false if the file
+// already had [or did not have] the address
+func (s *StratumServer) updateAddressList(list string, address string, add bool) (bool, error) {
+	cfg := &s.currentConfig().Stratum.AddressLists
+	var file string
+	switch list {
+	case "blacklist":
+		file = cfg.BlacklistFile
+	case "whitelist":
+		file = cfg.WhitelistFile
+	default:
+		return false, errors.New("list must be blacklist or whitelist")
+	}
+	if file == "" {
+		return false, errors.New("no " + list + "File configured")
+	}
+
+	s.addressLists.fileMu.Lock()
+	defer s.addressLists.fileMu.Unlock()
+	lines, err := readAddressFileLines(file)
+	if err != nil {
+		return false, err
+	}
+	var updated []string
+	var found bool
+	key := addressListKey(address, s.currentConfig().Address)
+	for _, line := range lines {
+		if fileAddress := addressFileLine(line); fileAddress != "" && addressListKey(fileAddress, s.currentConfig().Address) == key {
+			found = true
+			if !add {
+				continue
+			}
+		}
+		updated = append(updated, line)
+	}
+	if found == add {
+		return false, nil
+	}
+	if add {
+		updated = append(updated, address)
+	}
+
+	// Written to a temporary file and renamed, so a reload never reads a partial list
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return false, err
+	}
+	_, err = tmp.WriteString(strings.Join(updated, "\n") + "\n")
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return false, err
+	}
+
+	StratumInfoLogger.Printf("[Stratum] Updated %v %v, add: %v", list, address, add)
+	s.loadAddressLists()
+	return true, nil
+}
+
+// Closes the sessions of addresses the lists no longer allow, so blacklisting an address also ends its connections
+func (s *StratumServer) closeDisallowedSessions() {
+	var disallowed []*Session
+	s.sessions.Range(func(cs *Session) {
+		if cs.miner != nil && s.addressLists.check(cs.miner.Address) != nil {
+			disallowed = append(disallowed, cs)
+		}
+	})
+
+	for _, cs := range disallowed {
+		StratumInfoLogger.Printf("[Stratum] Closing session %s of disallowed address %s", cs.ip, cs.miner.Address)
+		cs.conn.Close()
+	}
+}
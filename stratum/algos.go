@@ -0,0 +1,70 @@
+package stratum
+
+import (
+	"math/big"
+	"strings"
+
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// PowAlgo validates shares for a given proof of work algorithm. To support a new algorithm, implement PowAlgo and add it to powAlgos under the name used in config.json "algo" / "algoForks"
+type PowAlgo interface {
+	// Returns whether the share meets the block difficulty (diff) and whether it meets the share difficulty (setDiff)
+	Validate(shareBuff []byte, diff, setDiff big.Int) (bool, bool)
+}
+
+type astroBWTAlgo struct{}
+
+func (astroBWTAlgo) Validate(shareBuff []byte, diff, setDiff big.Int) (bool, bool) {
+	return util.AstroBWTHash(shareBuff[:], diff, setDiff)
+}
+
+type cryptonightAlgo struct{}
+
+// Cryptonight only checks against block difficulty, shares are not validated against setDiff
+func (cryptonightAlgo) Validate(shareBuff []byte, diff, setDiff big.Int) (bool, bool) {
+	return util.CryptonightHash(shareBuff, diff), true
+}
+
+var powAlgos = map[string]PowAlgo{
+	"astrobwt":    astroBWTAlgo{},
+	"cryptonight": cryptonightAlgo{},
+}
+
+// Names miners [xmrig "algo" login extension] advertise for each pool algorithm
+var minerAlgoNames = map[string][]string{
+	"astrobwt":    {"astrobwt"},
+	"cryptonight": {"cryptonight", "cn", "cn/0"},
+}
+
+// Returns whether the algorithms advertised by a miner at login include algo. Miners not advertising any are assumed to support it
+func minerSupportsAlgo(advertised []string, algo string) bool {
+	if len(advertised) == 0 {
+		return true
+	}
+	names, ok := minerAlgoNames[algo]
+	if !ok {
+		names = []string{algo}
+	}
+	for _, a := range advertised {
+		for _, name := range names {
+			if strings.EqualFold(a, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the algorithm to mine at a given height, the last algoFork at or below the height, otherwise the default config algo
+func (s *StratumServer) algoForHeight(height uint64) string {
+	algo := s.algo
+	var forkHeight uint64
+	for _, fork := range s.currentConfig().AlgoForks {
+		if height >= fork.Height && fork.Height >= forkHeight {
+			algo = fork.Algo
+			forkHeight = fork.Height
+		}
+	}
+	return algo
+}
@@ -2,9 +2,15 @@
 package stratum
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"sort"
@@ -30,15 +36,27 @@ type ApiServer struct {
 	//minersMu       sync.RWMutex
 	statsIntv time.Duration
 	stratum   *StratumServer
+	// Incremented by every stats collection, the ETag of responses built from the collected stats
+	statsGeneration uint64
+	// Recent miner exports, see cachedExport
+	exports exportCache
+	// Admin signatures accepted within adminSignatureMaxAge by their X-Admin-Timestamp, see validAdminSignature
+	adminSignaturesMu sync.Mutex
+	adminSignatures   map[string]int64
 }
 
+// Amount and Net are the amount received by the payees, Gross the amount debited from their balances [Net plus their share of Fee with txFeePayer "miner"], Fee the network fee of the transaction
 type ApiPayments struct {
-	Hash      string
-	Timestamp int64
-	Payees    uint64
-	Mixin     uint64
-	Amount    uint64
-	Fee       uint64
+	Hash          string
+	Timestamp     int64
+	Payees        uint64
+	Mixin         uint64
+	Amount        uint64
+	Gross         uint64
+	Net           uint64
+	Fee           uint64
+	Status        string
+	Confirmations int64
 }
 
 type ApiEventPayments struct {
@@ -49,21 +67,31 @@ type ApiEventPayments struct {
 
 type ApiMiner struct {
 	LastBeat      int64
+	LastShare     int64
 	StartedAt     int64
 	ValidShares   int64
 	InvalidShares int64
+	LowDiffShares int64
 	StaleShares   int64
 	Accepts       int64
 	Rejects       int64
 	RoundShares   int64
-	Hashrate      int64
-	Offline       bool
+	// Percent of the current round shares of the pool contributed by the miner
+	RoundContribution float64
+	Hashrate          int64
+	Hashrate10m       int64
+	Hashrate1h        int64
+	Offline           bool
+	DiffOverride      int64
+	ShareTime         float64
 	sync.RWMutex
 	Id            string
 	Address       string
 	IsSolo        bool
 	DonatePercent int64
 	DonationTotal int64
+	Country       string
+	Region        string
 }
 
 type ApiBlocks struct {
@@ -76,6 +104,29 @@ type ApiBlocks struct {
 	TotalShares int64
 	Reward      uint64
 	Solo        bool
+	// Round shares of a pool block as percent of its difficulty, 0 if the round shares are not known yet [candidates] or the block is solo
+	Effort float64 `json:",omitempty"`
+}
+
+// Per-worker [rig] stats of an address, each worker is the miner stored under address@workid
+type ApiWorker struct {
+	Name          string
+	Id            string
+	IsSolo        bool
+	Hashrate      int64
+	Hashrate10m   int64
+	Hashrate1h    int64
+	ValidShares   int64
+	InvalidShares int64
+	LowDiffShares int64
+	StaleShares   int64
+	LastShare     int64
+	LastBeat      int64
+	StartedAt     int64
+	Difficulty    int64
+	ShareTime     float64
+	Connections   int64
+	Offline       bool
 }
 
 type LastBlock struct {
@@ -95,6 +146,8 @@ type Entry struct {
 
 var APIInfoLogger = logFileOutAPI("INFO")
 var APIErrorLogger = logFileOutAPI("ERROR")
+var APIWarnLogger = logFileOutAPI("WARN")
+var APIDebugLogger = logFileOutAPI("DEBUG")
 
 func NewApiServer(cfg *pool.APIConfig, s *StratumServer, eventsconfig *pool.EventsConfig) *ApiServer {
 	hashrateWindow, _ := time.ParseDuration(cfg.HashrateWindow)
@@ -104,7 +157,8 @@ func NewApiServer(cfg *pool.APIConfig, s *StratumServer, eventsconfig *pool.Even
 		backend:        Graviton_backend,
 		hashrateWindow: hashrateWindow,
 		//miners:         make(map[string]*Entry),
-		stratum: s,
+		stratum:         s,
+		adminSignatures: make(map[string]int64),
 	}
 }
 
@@ -112,7 +166,6 @@ func (apiServer *ApiServer) Start() {
 
 	apiServer.statsIntv, _ = time.ParseDuration(apiServer.config.StatsCollectInterval)
 	statsTimer := time.NewTimer(apiServer.statsIntv)
-	log.Printf("[API] Set stats collect interval to %v", apiServer.statsIntv)
 	APIInfoLogger.Printf("[API] Set stats collect interval to %v", apiServer.statsIntv)
 
 	apiServer.collectStats()
@@ -137,18 +190,41 @@ func (apiServer *ApiServer) Start() {
 }
 
 func (apiServer *ApiServer) listen() {
-	log.Printf("[API] Starting API on %v", apiServer.config.Listen)
 	APIInfoLogger.Printf("[API] Starting API on %v", apiServer.config.Listen)
 	router := mux.NewRouter()
-	router.HandleFunc("/api/stats", apiServer.StatsIndex)
-	router.HandleFunc("/api/blocks", apiServer.BlocksIndex)
-	router.HandleFunc("/api/payments", apiServer.PaymentsIndex)
+	router.HandleFunc("/api/stats", apiServer.etag(apiServer.StatsIndex))
+	router.HandleFunc("/api/blocks", apiServer.etag(apiServer.BlocksIndex))
+	router.HandleFunc("/api/payments", apiServer.etag(apiServer.PaymentsIndex))
 	router.HandleFunc("/api/miners", apiServer.MinersIndex)
 	router.HandleFunc("/api/accounts", apiServer.AccountIndex)
+	router.HandleFunc("/api/miner/{address}/export", apiServer.MinerExportIndex)
+	router.HandleFunc("/api/workers", apiServer.WorkersIndex)
+	router.HandleFunc("/api/live", apiServer.LiveIndex)
+	router.HandleFunc("/api/notifications", apiServer.NotificationsIndex)
+	router.HandleFunc("/api/telegram", apiServer.TelegramIndex)
+	router.HandleFunc("/api/settings", apiServer.SettingsIndex)
 	router.HandleFunc("/api/charts", apiServer.ChartsIndex)
 	router.HandleFunc("/api/events", apiServer.EventsIndex)
+	router.HandleFunc("/api/estimate", apiServer.EstimateIndex)
+	router.HandleFunc("/api/metrics", apiServer.MetricsIndex)
+	router.HandleFunc("/metrics", apiServer.PrometheusIndex)
+	router.HandleFunc("/api/admin/maintenance", apiServer.adminAuth(apiServer.AdminMaintenanceIndex))
+	router.HandleFunc("/api/admin/safemode", apiServer.adminAuth(apiServer.AdminSafeModeIndex))
+	router.HandleFunc("/api/admin/difficulty", apiServer.adminAuth(apiServer.AdminDifficultyIndex))
+	router.HandleFunc("/api/admin/reload", apiServer.adminAuth(apiServer.AdminReloadIndex))
+	router.HandleFunc("/api/admin/bans", apiServer.adminAuth(apiServer.AdminBansIndex))
+	router.HandleFunc("/api/admin/farms", apiServer.adminAuth(apiServer.AdminFarmsIndex))
+	router.HandleFunc("/api/admin/addresses", apiServer.adminAuth(apiServer.AdminAddressesIndex))
+	router.HandleFunc("/api/admin/balances", apiServer.adminAuth(apiServer.AdminBalancesIndex))
+	router.HandleFunc("/api/admin/payments", apiServer.adminAuth(apiServer.AdminPaymentsIndex))
+	router.HandleFunc("/api/admin/template", apiServer.adminAuth(apiServer.AdminTemplateIndex))
+	router.HandleFunc("/api/admin/sessions", apiServer.adminAuth(apiServer.AdminSessionsIndex))
+	router.HandleFunc("/api/admin/rounds", apiServer.adminAuth(apiServer.AdminRoundsIndex))
+	router.HandleFunc("/api/admin/loglevel", apiServer.adminAuth(apiServer.AdminLogLevelIndex))
+	router.HandleFunc("/api/admin/overview", apiServer.adminAuth(apiServer.AdminOverviewIndex))
+	router.HandleFunc("/api/admin/proxy", apiServer.adminAuth(apiServer.AdminProxyIndex))
 	router.NotFoundHandler = http.HandlerFunc(notFound)
-	err := http.ListenAndServe(apiServer.config.Listen, router)
+	err := http.ListenAndServe(apiServer.config.Listen, apiServer.httpHandler(router))
 	if err != nil {
 		APIErrorLogger.Printf("[API] Failed to start API: %v", err)
 		log.Fatalf("[API] Failed to start API: %v", err)
@@ -156,32 +232,126 @@ func (apiServer *ApiServer) listen() {
 }
 
 func (apiServer *ApiServer) listenSSL() {
-	log.Printf("[API] Starting SSL API on %v", apiServer.config.SSLListen)
 	APIInfoLogger.Printf("[API] Starting SSL API on %v", apiServer.config.SSLListen)
 	routerSSL := mux.NewRouter()
-	routerSSL.HandleFunc("/api/stats", apiServer.StatsIndex)
-	routerSSL.HandleFunc("/api/blocks", apiServer.BlocksIndex)
-	routerSSL.HandleFunc("/api/payments", apiServer.PaymentsIndex)
+	routerSSL.HandleFunc("/api/stats", apiServer.etag(apiServer.StatsIndex))
+	routerSSL.HandleFunc("/api/blocks", apiServer.etag(apiServer.BlocksIndex))
+	routerSSL.HandleFunc("/api/payments", apiServer.etag(apiServer.PaymentsIndex))
 	routerSSL.HandleFunc("/api/miners", apiServer.MinersIndex)
 	routerSSL.HandleFunc("/api/accounts", apiServer.AccountIndex)
+	routerSSL.HandleFunc("/api/miner/{address}/export", apiServer.MinerExportIndex)
+	routerSSL.HandleFunc("/api/workers", apiServer.WorkersIndex)
+	routerSSL.HandleFunc("/api/live", apiServer.LiveIndex)
+	routerSSL.HandleFunc("/api/notifications", apiServer.NotificationsIndex)
+	routerSSL.HandleFunc("/api/telegram", apiServer.TelegramIndex)
+	routerSSL.HandleFunc("/api/settings", apiServer.SettingsIndex)
 	routerSSL.HandleFunc("/api/charts", apiServer.ChartsIndex)
 	routerSSL.HandleFunc("/api/events", apiServer.EventsIndex)
+	routerSSL.HandleFunc("/api/estimate", apiServer.EstimateIndex)
+	routerSSL.HandleFunc("/api/metrics", apiServer.MetricsIndex)
+	routerSSL.HandleFunc("/metrics", apiServer.PrometheusIndex)
+	routerSSL.HandleFunc("/api/admin/maintenance", apiServer.adminAuth(apiServer.AdminMaintenanceIndex))
+	routerSSL.HandleFunc("/api/admin/safemode", apiServer.adminAuth(apiServer.AdminSafeModeIndex))
+	routerSSL.HandleFunc("/api/admin/difficulty", apiServer.adminAuth(apiServer.AdminDifficultyIndex))
+	routerSSL.HandleFunc("/api/admin/reload", apiServer.adminAuth(apiServer.AdminReloadIndex))
+	routerSSL.HandleFunc("/api/admin/bans", apiServer.adminAuth(apiServer.AdminBansIndex))
+	routerSSL.HandleFunc("/api/admin/farms", apiServer.adminAuth(apiServer.AdminFarmsIndex))
+	routerSSL.HandleFunc("/api/admin/addresses", apiServer.adminAuth(apiServer.AdminAddressesIndex))
+	routerSSL.HandleFunc("/api/admin/balances", apiServer.adminAuth(apiServer.AdminBalancesIndex))
+	routerSSL.HandleFunc("/api/admin/payments", apiServer.adminAuth(apiServer.AdminPaymentsIndex))
+	routerSSL.HandleFunc("/api/admin/template", apiServer.adminAuth(apiServer.AdminTemplateIndex))
+	routerSSL.HandleFunc("/api/admin/sessions", apiServer.adminAuth(apiServer.AdminSessionsIndex))
+	routerSSL.HandleFunc("/api/admin/rounds", apiServer.adminAuth(apiServer.AdminRoundsIndex))
+	routerSSL.HandleFunc("/api/admin/loglevel", apiServer.adminAuth(apiServer.AdminLogLevelIndex))
+	routerSSL.HandleFunc("/api/admin/overview", apiServer.adminAuth(apiServer.AdminOverviewIndex))
+	routerSSL.HandleFunc("/api/admin/proxy", apiServer.adminAuth(apiServer.AdminProxyIndex))
 	routerSSL.NotFoundHandler = http.HandlerFunc(notFound)
-	err := http.ListenAndServeTLS(apiServer.config.SSLListen, apiServer.config.CertFile, apiServer.config.KeyFile, routerSSL)
+	err := http.ListenAndServeTLS(apiServer.config.SSLListen, apiServer.config.CertFile, apiServer.config.KeyFile, apiServer.httpHandler(routerSSL))
 	if err != nil {
 		APIErrorLogger.Printf("[API] Failed to start SSL API: %v", err)
 		log.Fatalf("[API] Failed to start SSL API: %v", err)
 	}
 }
 
+// Wraps admin handlers, requiring the X-Admin-Token header to match the configured adminToken. If no adminToken is configured, admin handlers are disabled
+func (apiServer *ApiServer) adminAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		if !apiServer.isAdmin(r) {
+			APIErrorLogger.Printf("[API] Unauthorized admin request to %v from %v", r.URL.Path, r.RemoteAddr)
+			writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			writer.Header().Set("Cache-Control", "no-cache")
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(writer, r)
+	}
+}
+
+// Maximum difference between X-Admin-Timestamp and the pool's clock for a signed admin request
+const adminSignatureMaxAge = 5 * time.Minute
+
+// Returns whether the request carries a valid X-Admin-Token header, or a valid X-Admin-Signature when adminHmacSecret is set
+func (apiServer *ApiServer) isAdmin(r *http.Request) bool {
+	if token := r.Header.Get("X-Admin-Token"); token != "" {
+		return apiServer.config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(apiServer.config.AdminToken)) == 1
+	}
+	return apiServer.validAdminSignature(r)
+}
+
+// Validates X-Admin-Signature, the hex hmac-sha256 with adminHmacSecret of "<X-Admin-Timestamp>\n<X-Admin-Nonce>\n<method>\n<path and query>". The timestamp [unix seconds] must be within adminSignatureMaxAge of the
+// pool's clock and each signature is accepted once within it, so a captured request cannot be replayed without sending the secret itself
+func (apiServer *ApiServer) validAdminSignature(r *http.Request) bool {
+	signature := strings.ToLower(r.Header.Get("X-Admin-Signature"))
+	nonce := r.Header.Get("X-Admin-Nonce")
+	if apiServer.config.AdminHMACSecret == "" || signature == "" || nonce == "" {
+		return false
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get("X-Admin-Timestamp"), 10, 64)
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	age := now.Sub(time.Unix(timestamp, 0))
+	if age > adminSignatureMaxAge || age < -adminSignatureMaxAge {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(apiServer.config.AdminHMACSecret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "\n" + nonce + "\n" + r.Method + "\n" + r.URL.RequestURI()))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(expected)) != 1 {
+		return false
+	}
+
+	apiServer.adminSignaturesMu.Lock()
+	defer apiServer.adminSignaturesMu.Unlock()
+	// Signatures past adminSignatureMaxAge are rejected by their timestamp already
+	cutoff := now.Add(-adminSignatureMaxAge).Unix()
+	for seen, at := range apiServer.adminSignatures {
+		if at < cutoff {
+			delete(apiServer.adminSignatures, seen)
+		}
+	}
+	if _, replayed := apiServer.adminSignatures[expected]; replayed {
+		APIErrorLogger.Printf("[API] Replayed admin signature for %v from %v", r.URL.Path, r.RemoteAddr)
+		return false
+	}
+	apiServer.adminSignatures[expected] = timestamp
+	return true
+}
+
 func notFound(writer http.ResponseWriter, _ *http.Request) {
 	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
 	writer.Header().Set("Cache-Control", "no-cache")
 	writer.WriteHeader(http.StatusNotFound)
 }
 
 func (apiServer *ApiServer) collectStats() {
+	// In stats-only mode, reopen the shared store so stats reflect the latest commits of the pool process
+	if apiServer.stratum.statsOnly {
+		apiServer.backend.ReopenGravDB()
+	}
+
 	stats := make(map[string]interface{})
 	var numCandidateBlocks, numImmatureBlocks, numMaturedBlocks int
 
@@ -190,7 +360,6 @@ func (apiServer *ApiServer) collectStats() {
 	prevBlock, getHashERR := v.GetLastBlockHeader()
 
 	if getHashERR != nil {
-		log.Printf("[API] Error while retrieving block from node: %v", getHashERR)
 		APIErrorLogger.Printf("[API] Error while retrieving block from node: %v", getHashERR)
 		lastblockDB := &LastBlock{}
 		stats["lastblock"] = lastblockDB
@@ -201,7 +370,7 @@ func (apiServer *ApiServer) collectStats() {
 	}
 
 	// Build Payments stats
-	processedPayments := apiServer.backend.GetProcessedPayments()
+	processedPayments := Storage_backend.GetProcessedPayments()
 	if processedPayments != nil {
 		apiPayments, totalPayments, totalMinersPaid := apiServer.convertPaymentsResults(processedPayments)
 		if int64(len(apiPayments)) > apiServer.config.Payments {
@@ -212,6 +381,7 @@ func (apiServer *ApiServer) collectStats() {
 		stats["payments"] = apiPayments // Retain full list for other use cases in load more options etc.
 		stats["totalPayments"] = totalPayments
 		stats["totalMinersPaid"] = totalMinersPaid
+		stats["txFees"] = paymentFeeTotals(processedPayments)
 	}
 
 	// Build found block stats
@@ -268,14 +438,49 @@ func (apiServer *ApiServer) collectStats() {
 	stats["totalSoloWorkers"] = totalSoloWorkers
 	stats["totalRoundShares"] = totalRoundShares
 
-	// Chart data
-	poolHashrateChart := apiServer.backend.GetChartsData("poolhashrate")
-	poolMinersChart := apiServer.backend.GetChartsData("totalpoolminers")
-	poolWorkersChart := apiServer.backend.GetChartsData("totalpoolworkers")
-	soloHashrateChart := apiServer.backend.GetChartsData("solohashrate")
-	soloMinersChart := apiServer.backend.GetChartsData("totalsolominers")
-	soloWorkersChart := apiServer.backend.GetChartsData("totalsoloworkers")
-	poolDifficultyChart := apiServer.backend.GetChartsData("pooldifficulty")
+	// Effort of the current round against the network difficulty and the average effort of the last effortBlocks pool blocks
+	if lastBlock, ok := stats["lastblock"].(*LastBlock); ok {
+		if networkDifficulty, err := strconv.ParseInt(lastBlock.Difficulty, 10, 64); err == nil && networkDifficulty > 0 {
+			stats["currentEffort"] = float64(totalRoundShares) / float64(networkDifficulty) * 100
+		}
+	}
+	averageEffort, effortBlocks := apiServer.averageEffort()
+	stats["averageEffort"] = averageEffort
+	stats["effortBlocks"] = effortBlocks
+
+	// Last payments wallet health check, payouts are paused while it is unreachable or underfunded
+	if payouts := apiServer.stratum.payouts; payouts != nil {
+		if health := payouts.walletHealth(); health != nil {
+			stats["walletHealth"] = health
+		}
+	}
+
+	// Open stratum connections against the global maxConnections, with the connections of each port
+	if !apiServer.stratum.statsOnly {
+		stats["connections"] = atomic.LoadInt64(&apiServer.stratum.connections)
+		stats["maxConnections"] = apiServer.stratum.currentConfig().Stratum.MaxConnections
+		stats["rejectedConnections"] = atomic.LoadInt64(&apiServer.stratum.rejectedConnections)
+		stats["portConnections"] = apiServer.stratum.portConnections()
+	}
+
+	// Upstream pool connection in proxy mode
+	if proxy := apiServer.stratum.proxy; proxy != nil {
+		stats["proxy"] = proxy.status(apiServer.stratum)
+	}
+
+	// Connected miners and hashrate by country/region/ASN, only with live sessions and geoip enabled
+	if apiServer.stratum.geo != nil {
+		stats["geo"] = apiServer.stratum.geoStats()
+	}
+
+	// Chart data, the downsampled history is served by /api/charts?chart=<chart>
+	poolHashrateChart := apiServer.recentChartsData("poolhashrate")
+	poolMinersChart := apiServer.recentChartsData("totalpoolminers")
+	poolWorkersChart := apiServer.recentChartsData("totalpoolworkers")
+	soloHashrateChart := apiServer.recentChartsData("solohashrate")
+	soloMinersChart := apiServer.recentChartsData("totalsolominers")
+	soloWorkersChart := apiServer.recentChartsData("totalsoloworkers")
+	poolDifficultyChart := apiServer.recentChartsData("pooldifficulty")
 	stats["poolHashrateChart"] = poolHashrateChart
 	stats["poolMinersChart"] = poolMinersChart
 	stats["poolWorkersChart"] = poolWorkersChart
@@ -294,6 +499,41 @@ func (apiServer *ApiServer) collectStats() {
 	stats["eventRewardAmount"] = apiServer.eventsconfig.RandomRewardEventConfig.RewardValueInDERO
 
 	apiServer.stats.Store(stats)
+	atomic.AddUint64(&apiServer.statsGeneration, 1)
+	apiServer.publishLiveStats(stats)
+}
+
+// Pushes the freshly collected pool and network stats to live stats clients, and worker stats to clients subscribed to an address
+func (apiServer *ApiServer) publishLiveStats(stats map[string]interface{}) {
+	live := apiServer.stratum.live
+	if live == nil {
+		return
+	}
+
+	poolStats := make(map[string]interface{})
+	for _, k := range []string{"poolHashrate", "totalPoolMiners", "totalPoolWorkers", "soloHashrate", "totalSoloMiners", "totalSoloWorkers", "totalRoundShares", "currentEffort", "blocksTotal"} {
+		poolStats[k] = stats[k]
+	}
+	live.publish("stats", poolStats)
+
+	network := make(map[string]interface{})
+	network["lastblock"] = stats["lastblock"]
+	if info := apiServer.stratum.rpc().Info(); info != nil {
+		network["height"] = info.Height
+		network["difficulty"] = info.Difficulty
+		network["txPoolSize"] = info.TxPoolSize
+	}
+	live.publish("network", network)
+
+	// Workers are built once per subscribed address, however many clients are subscribed to it
+	addresses := live.subscribedAddresses()
+	if len(addresses) == 0 {
+		return
+	}
+	miners, connections := apiServer.workersOf(addresses)
+	for address := range addresses {
+		live.publishTo(address, "miner", apiServer.workersReply(address, miners[address], connections))
+	}
 }
 
 func (apiServer *ApiServer) convertPaymentsResults(processedPayments *ProcessedPayments) ([]*ApiPayments, int64, int64) {
@@ -303,6 +543,9 @@ func (apiServer *ApiServer) convertPaymentsResults(processedPayments *ProcessedP
 	var totalMinersPaid int
 	var tempMinerArr []string
 
+	// Payout status is only tracked when confirmTracking is enabled, otherwise Status is left empty
+	payoutTxs := Storage_backend.GetPayoutTxs()
+
 	for _, value := range processedPayments.MinerPayments {
 		reply := &ApiPayments{}
 
@@ -325,20 +568,31 @@ func (apiServer *ApiServer) convertPaymentsResults(processedPayments *ProcessedP
 				// Append details such as amount, payees, etc.
 				reply = apiPayments[value.TxHash]
 				reply.Amount = v.Amount + value.Amount
+				reply.Gross = v.Gross + value.Amount + value.Fee
+				reply.Net = v.Net + value.Amount
 				reply.Payees = v.Payees + 1
 				reply.Mixin = value.Mixin
 			} else {
-				reply = &ApiPayments{Hash: value.TxHash, Timestamp: value.Timestamp, Mixin: value.Mixin, Amount: value.Amount, Fee: value.TxFee, Payees: 1}
+				reply = &ApiPayments{Hash: value.TxHash, Timestamp: value.Timestamp, Mixin: value.Mixin, Amount: value.Amount, Gross: value.Amount + value.Fee, Net: value.Amount, Fee: value.TxFee, Payees: 1}
 				totalPayments++
 			}
 		} else {
-			reply = &ApiPayments{Hash: value.TxHash, Timestamp: value.Timestamp, Mixin: value.Mixin, Amount: value.Amount, Fee: value.TxFee, Payees: 1}
+			reply = &ApiPayments{Hash: value.TxHash, Timestamp: value.Timestamp, Mixin: value.Mixin, Amount: value.Amount, Gross: value.Amount + value.Fee, Net: value.Amount, Fee: value.TxFee, Payees: 1}
 			totalPayments++
 		}
 		apiPayments[value.TxHash] = reply
 	}
 	totalMinersPaid = len(tempMinerArr)
 
+	if payoutTxs != nil {
+		for txHash, payment := range apiPayments {
+			if payoutTx, ok := payoutTxs.Txs[txHash]; ok {
+				payment.Status = payoutTx.Status
+				payment.Confirmations = payoutTx.Confirmations
+			}
+		}
+	}
+
 	for p := range apiPayments {
 		paymentsArr = append(paymentsArr, apiPayments[p])
 	}
@@ -351,6 +605,25 @@ func (apiServer *ApiServer) convertPaymentsResults(processedPayments *ProcessedP
 	return paymentsArr, totalPayments, int64(totalMinersPaid)
 }
 
+// Returns the cumulative network fees of the payout transactions, the part of them charged to the payees [txFeePayer "miner"] and the part paid by the pool
+func paymentFeeTotals(processedPayments *ProcessedPayments) map[string]uint64 {
+	var total, miners uint64
+	txs := make(map[string]struct{})
+	for _, payment := range processedPayments.MinerPayments {
+		miners += payment.Fee
+		// TxFee is recorded with each payee of the transaction
+		if _, ok := txs[payment.TxHash]; !ok {
+			txs[payment.TxHash] = struct{}{}
+			total += payment.TxFee
+		}
+	}
+	totals := map[string]uint64{"total": total, "miners": miners, "pool": 0}
+	if total > miners {
+		totals["pool"] = total - miners
+	}
+	return totals
+}
+
 func (apiServer *ApiServer) convertBlocksResults(minedBlocks []*BlockDataGrav) []*ApiBlocks {
 	apiBlocks := make(map[string]*ApiBlocks)
 	var blocksArr []*ApiBlocks
@@ -359,6 +632,7 @@ func (apiServer *ApiServer) convertBlocksResults(minedBlocks []*BlockDataGrav) [
 		trimmedAddr := value.Address[0:7] + "..." + value.Address[len(value.Address)-5:len(value.Address)]
 		// Check to ensure apiBlocks has items
 		reply = &ApiBlocks{Hash: value.Hash, Address: trimmedAddr, Height: value.Height, Orphan: value.Orphan, Timestamp: value.Timestamp, Difficulty: value.Difficulty, TotalShares: value.TotalShares, Reward: value.Reward, Solo: value.Solo}
+		reply.Effort = blockEffort(value)
 		apiBlocks[value.Hash] = reply
 	}
 	for b := range apiBlocks {
@@ -373,6 +647,60 @@ func (apiServer *ApiServer) convertBlocksResults(minedBlocks []*BlockDataGrav) [
 	return blocksArr
 }
 
+// Returns the round shares of a pool block as percent of its difficulty, 0 for solo blocks and blocks without round shares [candidates]
+func blockEffort(block *BlockDataGrav) float64 {
+	if block.Solo || block.TotalShares <= 0 || block.Difficulty <= 0 {
+		return 0
+	}
+	return float64(block.TotalShares) / float64(block.Difficulty) * 100
+}
+
+// Returns shares as percent of the total round shares
+func roundContribution(shares, totalRoundShares int64) float64 {
+	if totalRoundShares <= 0 {
+		return 0
+	}
+	return float64(shares) / float64(totalRoundShares) * 100
+}
+
+// Returns the effort of the last effortBlocks pool blocks with known round shares [orphans included, their work was done all the same] and the number of blocks
+// averaged. Weighted by difficulty, i.e. the shares of the blocks against their difficulty summed up. 100 / averageEffort is the luck of the pool
+func (apiServer *ApiServer) averageEffort() (float64, int) {
+	n := apiServer.config.EffortBlocks
+	if n <= 0 {
+		n = 100
+	}
+
+	var blocks []*BlockDataGrav
+	for _, blockType := range []string{"immature", "matured"} {
+		found := apiServer.backend.GetBlocksFound(blockType)
+		if found == nil {
+			continue
+		}
+		for _, block := range found.MinedBlocks {
+			if blockEffort(block) > 0 {
+				blocks = append(blocks, block)
+			}
+		}
+	}
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return blocks[i].Height > blocks[j].Height
+	})
+	if len(blocks) > n {
+		blocks = blocks[:n]
+	}
+
+	var shares, difficulty float64
+	for _, block := range blocks {
+		shares += float64(block.TotalShares)
+		difficulty += float64(block.Difficulty)
+	}
+	if difficulty == 0 {
+		return 0, 0
+	}
+	return shares / difficulty * 100, len(blocks)
+}
+
 func (apiServer *ApiServer) convertMinerResults(miners []*Miner) ([]*ApiMiner, int64, int64, int64, int64, int64, int64, int64) {
 	apiMiners := make(map[string]*ApiMiner)
 	var minersArr []*ApiMiner
@@ -401,7 +729,7 @@ func (apiServer *ApiServer) convertMinerResults(miners []*Miner) ([]*ApiMiner, i
 		})
 	}
 
-	currRoundShares := apiServer.backend.GetPoolRoundStats()
+	currRoundShares := Storage_backend.GetPoolRoundStats()
 	if currRoundShares != nil {
 		for _, v := range currRoundShares.RoundShares {
 			totalRoundShares += v
@@ -424,7 +752,7 @@ func (apiServer *ApiServer) convertMinerResults(miners []*Miner) ([]*ApiMiner, i
 				}
 				if currMiner != nil && windowHashes {
 					var Offline bool
-					var Hashrate int64
+					var Hashrate, Hashrate10m, Hashrate1h int64
 					var ID string
 
 					// Set miner to offline
@@ -436,6 +764,8 @@ func (apiServer *ApiServer) convertMinerResults(miners []*Miner) ([]*ApiMiner, i
 					if !Offline {
 						Hashrate = currMiner.getHashrate(apiServer.stratum.estimationWindow, apiServer.stratum.hashrateExpiration)
 					}
+					// Rolling windows are reported offline as well, they decay as the window passes the last shares
+					Hashrate10m, Hashrate1h = currMiner.getRollingHashrates(now)
 
 					// Utilizing extracted workid value, could be leveraging workid instead of full id value for stats [later worker stats on a per-address layer potentially]
 					if currMiner.WorkID != "" {
@@ -448,23 +778,36 @@ func (apiServer *ApiServer) convertMinerResults(miners []*Miner) ([]*ApiMiner, i
 						}
 					}
 
+					currMiner.RLock()
+					country, region := currMiner.Country, currMiner.Region
+					currMiner.RUnlock()
+
 					// Generate struct for miner stats
 					reply = &ApiMiner{
-						LastBeat:      currMiner.LastBeat,
-						StartedAt:     currMiner.StartedAt,
-						ValidShares:   currMiner.ValidShares,
-						InvalidShares: currMiner.InvalidShares,
-						StaleShares:   currMiner.StaleShares,
-						Accepts:       currMiner.Accepts,
-						Rejects:       currMiner.Rejects,
-						RoundShares:   currRoundShares.RoundShares[currMiner.Id],
-						Hashrate:      Hashrate,
-						Offline:       Offline,
-						Id:            ID,
-						Address:       currMiner.Address[0:7] + "..." + currMiner.Address[len(currMiner.Address)-5:len(currMiner.Address)],
-						IsSolo:        currMiner.IsSolo,
-						DonatePercent: currMiner.DonatePercent,
-						DonationTotal: currMiner.DonationTotal,
+						LastBeat:          currMiner.LastBeat,
+						LastShare:         currMiner.LastShare,
+						StartedAt:         currMiner.StartedAt,
+						ValidShares:       currMiner.ValidShares,
+						InvalidShares:     currMiner.InvalidShares,
+						LowDiffShares:     currMiner.LowDiffShares,
+						StaleShares:       currMiner.StaleShares,
+						Accepts:           currMiner.Accepts,
+						Rejects:           currMiner.Rejects,
+						RoundShares:       currRoundShares.RoundShares[currMiner.Id],
+						RoundContribution: roundContribution(currRoundShares.RoundShares[currMiner.Id], totalRoundShares),
+						Hashrate:          Hashrate,
+						Hashrate10m:       Hashrate10m,
+						Hashrate1h:        Hashrate1h,
+						Offline:           Offline,
+						DiffOverride:      apiServer.stratum.getDiffOverride(currMiner),
+						ShareTime:         currMiner.ShareTime,
+						Id:                ID,
+						Address:           currMiner.Address[0:7] + "..." + currMiner.Address[len(currMiner.Address)-5:len(currMiner.Address)],
+						IsSolo:            currMiner.IsSolo,
+						DonatePercent:     currMiner.DonatePercent,
+						DonationTotal:     currMiner.DonationTotal,
+						Country:           country,
+						Region:            region,
 					}
 
 					apiMiners[ID+currMiner.Address] = reply
@@ -493,53 +836,73 @@ func (apiServer *ApiServer) convertMinerResults(miners []*Miner) ([]*ApiMiner, i
 func (apiServer *ApiServer) GetConfigIndex() map[string]interface{} {
 	stats := make(map[string]interface{})
 
-	stats["poolHost"] = apiServer.stratum.config.PoolHost
-	stats["blockchainExplorer"] = apiServer.stratum.config.BlockchainExplorer
-	stats["transactionExplorer"] = apiServer.stratum.config.TransactionExploer
-	stats["version"] = "1.0.0"
-	stats["algo"] = apiServer.stratum.config.Algo
-	stats["coin"] = apiServer.stratum.config.Coin
-	stats["coinUnits"] = apiServer.stratum.config.CoinUnits
-	stats["coinDecimalPlaces"] = apiServer.stratum.config.CoinDecimalPlaces
-	stats["coinDifficultyTarget"] = apiServer.stratum.config.CoinDifficultyTarget
-	stats["payIDAddressSeparator"] = apiServer.stratum.config.Stratum.PaymentID.AddressSeparator
-	stats["workIDAddressSeparator"] = apiServer.stratum.config.Stratum.WorkerID.AddressSeparator
-	stats["fixedDiffAddressSeparator"] = apiServer.stratum.config.Stratum.FixedDiff.AddressSeparator
-	stats["soloIDSeparator"] = apiServer.stratum.config.Stratum.SoloMining.AddressSeparator
-	stats["hashDonationSeparator"] = apiServer.stratum.config.Stratum.DonatePercent.AddressSeparator
+	stats["poolHost"] = apiServer.stratum.currentConfig().PoolHost
+	stats["blockchainExplorer"] = apiServer.stratum.currentConfig().BlockchainExplorer
+	stats["transactionExplorer"] = apiServer.stratum.currentConfig().TransactionExploer
+	stats["version"] = Version
+	stats["algo"] = apiServer.stratum.currentConfig().Algo
+	stats["coin"] = apiServer.stratum.currentConfig().Coin
+	stats["coinUnits"] = apiServer.stratum.currentConfig().CoinUnits
+	stats["coinDecimalPlaces"] = apiServer.stratum.currentConfig().CoinDecimalPlaces
+	stats["coinDifficultyTarget"] = apiServer.stratum.currentConfig().CoinDifficultyTarget
+	stats["payIDAddressSeparator"] = apiServer.stratum.currentConfig().Stratum.PaymentID.AddressSeparator
+	stats["workIDAddressSeparator"] = apiServer.stratum.currentConfig().Stratum.WorkerID.AddressSeparator
+	stats["fixedDiffAddressSeparator"] = apiServer.stratum.currentConfig().Stratum.FixedDiff.AddressSeparator
+	stats["soloIDSeparator"] = apiServer.stratum.currentConfig().Stratum.SoloMining.AddressSeparator
+	stats["hashDonationSeparator"] = apiServer.stratum.currentConfig().Stratum.DonatePercent.AddressSeparator
 	stats["donationAddress"] = apiServer.stratum.donateID
-	stats["donationDescription"] = apiServer.stratum.config.DonationDescription
-	stats["ports"] = apiServer.stratum.config.Stratum.Ports
-	stats["unlockDepth"] = apiServer.stratum.config.UnlockerConfig.Depth
-	unlockTime, _ := time.ParseDuration(apiServer.stratum.config.UnlockerConfig.Interval)
+	stats["donationDescription"] = apiServer.stratum.currentConfig().DonationDescription
+	// Certificate paths of TLS ports are not published
+	ports := make([]pool.Port, len(apiServer.stratum.currentConfig().Stratum.Ports))
+	copy(ports, apiServer.stratum.currentConfig().Stratum.Ports)
+	for i := range ports {
+		ports[i].CertFile = ""
+		ports[i].KeyFile = ""
+	}
+	stats["ports"] = ports
+	stats["diffProfiles"] = apiServer.stratum.currentConfig().Stratum.DiffProfiles
+	stats["unlockDepth"] = apiServer.stratum.currentConfig().UnlockerConfig.Depth
+	unlockTime, _ := time.ParseDuration(apiServer.stratum.currentConfig().UnlockerConfig.Interval)
 	unlockInterval := int64(unlockTime / time.Second)
 	stats["unlockInterval"] = unlockInterval
-	stats["poolFee"] = apiServer.stratum.config.UnlockerConfig.PoolFee
-	stats["paymentMixin"] = apiServer.stratum.config.PaymentsConfig.Mixin
-	stats["paymentMinimum"] = apiServer.stratum.config.PaymentsConfig.Threshold
-	paymentTime, _ := time.ParseDuration(apiServer.stratum.config.PaymentsConfig.Interval)
+	stats["poolFee"] = apiServer.stratum.currentConfig().UnlockerConfig.PoolFee
+	stats["paymentMixin"] = apiServer.stratum.currentConfig().PaymentsConfig.Mixin
+	stats["paymentMinimum"] = apiServer.stratum.currentConfig().PaymentsConfig.Threshold
+	paymentTime, _ := time.ParseDuration(apiServer.stratum.currentConfig().PaymentsConfig.Interval)
 	paymentInterval := int64(paymentTime / time.Second)
 	stats["paymentInterval"] = paymentInterval
+	if apiServer.stratum.currentConfig().PaymentsConfig.Scheme == "pplns" {
+		stats["paymentScheme"] = "pplns"
+	} else {
+		stats["paymentScheme"] = "prop"
+	}
+	stats["varDiffTargetTime"] = apiServer.stratum.currentConfig().Stratum.VarDiff.TargetTime
 
 	return stats
 }
 
 func (apiServer *ApiServer) StatsIndex(writer http.ResponseWriter, _ *http.Request) {
 	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
 	writer.Header().Set("Cache-Control", "no-cache")
 	writer.WriteHeader(http.StatusOK)
 
 	reply := make(map[string]interface{})
 
+	now := util.MakeTimestamp() / 1000
+	reply["version"] = Version
+	reply["commit"] = Commit
+	reply["startedAt"] = apiServer.stratum.startedAt
+	reply["uptime"] = now - apiServer.stratum.startedAt
+
 	stats := apiServer.getStats()
 	if stats != nil {
-		reply["now"] = util.MakeTimestamp() / 1000
+		reply["now"] = now
 		reply["lastblock"] = stats["lastblock"]
 		reply["config"] = apiServer.GetConfigIndex()
 		reply["payments"] = stats["paymentsSmall"]
 		reply["totalPayments"] = stats["totalPayments"]
 		reply["totalMinersPaid"] = stats["totalMinersPaid"]
+		reply["txFees"] = stats["txFees"]
 		reply["candidates"] = stats["candidatesSmall"]
 		reply["immature"] = stats["immatureSmall"]
 		reply["matured"] = stats["maturedSmall"]
@@ -555,19 +918,120 @@ func (apiServer *ApiServer) StatsIndex(writer http.ResponseWriter, _ *http.Reque
 		reply["totalSoloMiners"] = stats["totalSoloMiners"]
 		reply["totalSoloWorkers"] = stats["totalSoloWorkers"]
 		reply["totalRoundShares"] = stats["totalRoundShares"]
+		if geo, ok := stats["geo"]; ok {
+			reply["geo"] = geo
+		}
+		if health, ok := stats["walletHealth"]; ok {
+			reply["walletHealth"] = health
+		}
 	}
 
 	err := json.NewEncoder(writer).Encode(reply)
 	if err != nil {
-		log.Printf("[API] Error serializing API response: %v", err)
 		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
 	}
 }
 
-func (apiServer *ApiServer) BlocksIndex(writer http.ResponseWriter, _ *http.Request) {
+// History query of /api/blocks and /api/payments: ?limit=&offset= pages the most recent first lists, ?from=&to= [unix timestamps, inclusive] and ?address= filter them
+type apiPage struct {
+	limit   int
+	offset  int
+	from    int64
+	to      int64
+	address string
+}
+
+func parseApiPage(r *http.Request) (*apiPage, error) {
+	query := r.URL.Query()
+	page := &apiPage{address: query.Get("address")}
+	for key, value := range map[string]*int64{"from": &page.from, "to": &page.to} {
+		if v := query.Get(key); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %v %q", key, v)
+			}
+			*value = n
+		}
+	}
+	for key, value := range map[string]*int{"limit": &page.limit, "offset": &page.offset} {
+		if v := query.Get(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %v %q", key, v)
+			}
+			*value = n
+		}
+	}
+	return page, nil
+}
+
+func (p *apiPage) inRange(timestamp int64) bool {
+	return timestamp >= p.from && (p.to == 0 || timestamp <= p.to)
+}
+
+// Returns the bounds of the requested page within n items, all of them without a limit
+func (p *apiPage) bounds(n int) (int, int) {
+	start := p.offset
+	if start > n {
+		start = n
+	}
+	end := n
+	// Compared as the remaining count, start+limit overflows for a huge limit
+	if p.limit > 0 && p.limit < n-start {
+		end = start + p.limit
+	}
+	return start, end
+}
+
+// Returns the page of blocks within range and the number of them
+func (p *apiPage) blocks(blocks []*ApiBlocks) ([]*ApiBlocks, int) {
+	var matching []*ApiBlocks
+	for _, block := range blocks {
+		if p.inRange(block.Timestamp) {
+			matching = append(matching, block)
+		}
+	}
+	start, end := p.bounds(len(matching))
+	return matching[start:end], len(matching)
+}
+
+// Returns the page of payments within range and the number of them
+func (p *apiPage) payments(payments []*ApiPayments) ([]*ApiPayments, int) {
+	var matching []*ApiPayments
+	for _, payment := range payments {
+		if p.inRange(payment.Timestamp) {
+			matching = append(matching, payment)
+		}
+	}
+	start, end := p.bounds(len(matching))
+	return matching[start:end], len(matching)
+}
+
+// Returns the blocks found by address of blockType, read from the backend as the stats only keep trimmed addresses
+func (apiServer *ApiServer) addressBlocks(blockType, address string) []*ApiBlocks {
+	blocksFound := apiServer.backend.GetBlocksFound(blockType)
+	if blocksFound == nil {
+		return nil
+	}
+	var minedBlocks []*BlockDataGrav
+	for _, block := range blocksFound.MinedBlocks {
+		if block.Address == address {
+			minedBlocks = append(minedBlocks, block)
+		}
+	}
+	return apiServer.convertBlocksResults(minedBlocks)
+}
+
+func (apiServer *ApiServer) BlocksIndex(writer http.ResponseWriter, r *http.Request) {
 	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
 	writer.Header().Set("Cache-Control", "no-cache")
+
+	page, err := parseApiPage(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(writer).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
 	writer.WriteHeader(http.StatusOK)
 
 	reply := make(map[string]interface{})
@@ -575,54 +1039,91 @@ func (apiServer *ApiServer) BlocksIndex(writer http.ResponseWriter, _ *http.Requ
 	stats := apiServer.getStats()
 	if stats != nil {
 		reply["now"] = util.MakeTimestamp() / 1000
-		reply["candidates"] = stats["candidates"]
-		reply["immature"] = stats["immature"]
-		reply["matured"] = stats["matured"]
-		reply["candidatesTotal"] = stats["candidatesTotal"]
-		reply["immatureTotal"] = stats["immatureTotal"]
-		reply["maturedTotal"] = stats["maturedTotal"]
-		reply["blocksTotal"] = stats["blocksTotal"]
+		// Totals are of the blocks matching the filters, the lists hold the requested page of them
+		var blocksTotal int
+		for _, blockType := range []string{"candidates", "immature", "matured"} {
+			var blocks []*ApiBlocks
+			if page.address != "" {
+				blocks = apiServer.addressBlocks(strings.TrimSuffix(blockType, "s"), page.address)
+			} else {
+				blocks, _ = stats[blockType].([]*ApiBlocks)
+			}
+			blocksPage, total := page.blocks(blocks)
+			reply[blockType] = blocksPage
+			reply[blockType+"Total"] = total
+			blocksTotal += total
+		}
+		reply["blocksTotal"] = blocksTotal
 	}
 
-	err := json.NewEncoder(writer).Encode(reply)
+	err = json.NewEncoder(writer).Encode(reply)
 	if err != nil {
-		log.Printf("[API] Error serializing API response: %v", err)
 		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
 	}
 }
 
-func (apiServer *ApiServer) PaymentsIndex(writer http.ResponseWriter, _ *http.Request) {
+func (apiServer *ApiServer) PaymentsIndex(writer http.ResponseWriter, r *http.Request) {
 	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
 	writer.Header().Set("Cache-Control", "no-cache")
+
+	page, err := parseApiPage(r)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(writer).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
 	writer.WriteHeader(http.StatusOK)
 
 	reply := make(map[string]interface{})
 
 	stats := apiServer.getStats()
 	if stats != nil {
-		reply["payments"] = stats["payments"]
-		reply["totalPayments"] = stats["totalPayments"]
+		var payments []*ApiPayments
+		if page.address != "" {
+			// Payments of the address only, each with the amount paid to it
+			payments, _ = apiServer.addressPayments(page.address)
+		} else {
+			payments, _ = stats["payments"].([]*ApiPayments)
+		}
+		// totalPayments is the number of payments matching the filters, the list holds the requested page of them
+		paymentsPage, total := page.payments(payments)
+		reply["payments"] = paymentsPage
+		reply["totalPayments"] = total
 		reply["totalMinersPaid"] = stats["totalMinersPaid"]
+		reply["txFees"] = stats["txFees"]
 	}
 
-	err := json.NewEncoder(writer).Encode(reply)
+	err = json.NewEncoder(writer).Encode(reply)
 	if err != nil {
-		log.Printf("[API] Error serializing API response: %v", err)
 		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
 	}
 }
 
-func (apiServer *ApiServer) MinersIndex(writer http.ResponseWriter, _ *http.Request) {
+func (apiServer *ApiServer) MinersIndex(writer http.ResponseWriter, r *http.Request) {
 	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
 	writer.Header().Set("Cache-Control", "no-cache")
-	writer.WriteHeader(http.StatusOK)
 
 	reply := make(map[string]interface{})
 
-	stats := apiServer.getStats()
-	if stats != nil {
+	// Miner lookup by address, id or ip [ip lookups require the X-Admin-Token header]
+	query := r.URL.Query()
+	var lookupBy, lookupValue string
+	for _, key := range []string{"address", "id", "ip"} {
+		if value := query.Get(key); value != "" {
+			lookupBy, lookupValue = key, value
+			break
+		}
+	}
+	if lookupBy == "ip" && !apiServer.isAdmin(r) {
+		APIErrorLogger.Printf("[API] Unauthorized miner ip lookup from %v", r.RemoteAddr)
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+
+	if lookupBy != "" {
+		reply = apiServer.lookupMiners(lookupBy, lookupValue)
+	} else if stats := apiServer.getStats(); stats != nil {
 		reply["miners"] = stats["miners"]
 		reply["poolHashrate"] = stats["poolHashrate"]
 		reply["totalPoolMiners"] = stats["totalPoolMiners"]
@@ -634,143 +1135,638 @@ func (apiServer *ApiServer) MinersIndex(writer http.ResponseWriter, _ *http.Requ
 
 	err := json.NewEncoder(writer).Encode(reply)
 	if err != nil {
-		log.Printf("[API] Error serializing API response: %v", err)
 		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
 	}
 }
 
-func (apiServer *ApiServer) AccountIndex(writer http.ResponseWriter, r *http.Request) {
-	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
-	writer.Header().Set("Cache-Control", "no-cache")
-	writer.WriteHeader(http.StatusOK)
-
-	keys, ok := r.URL.Query()["address"]
+// Looks up live miners from s.miners by address [all of its workers/payment ids], full id or ip, along with their balances and connection count
+func (apiServer *ApiServer) lookupMiners(lookupBy, value string) map[string]interface{} {
+	reply := make(map[string]interface{})
+	reply["lookup"] = lookupBy
+	reply[lookupBy] = value
 
-	if !ok || len(keys[0]) < 1 {
-		log.Printf("URL Param 'address' is missing.")
-		return
+	// Stats-only mode has no live miners, so lookups are served from stored miner stats
+	var miners []*Miner
+	if apiServer.stratum.statsOnly {
+		miners = apiServer.backend.GetAllMinerStats()
+	} else {
+		miners = apiServer.stratum.miners.Values()
 	}
 
-	address := keys[0]
-
-	reply := make(map[string]interface{})
-
-	var mExist bool
-	minerRegistrations := Graviton_backend.GetMinerIDRegistrations()
-	for _, v := range minerRegistrations {
-		if v.Address == address {
-			mExist = true
-			break
+	var matched []*Miner
+	minerIDs := make(map[string]struct{})
+	addresses := make(map[string]struct{})
+	for _, miner := range miners {
+		var match bool
+		switch lookupBy {
+		case "address":
+			match = miner.Address == value
+		case "id":
+			match = miner.Id == value
+		case "ip":
+			match = miner.Ip == value
+		}
+		if match {
+			matched = append(matched, miner)
+			minerIDs[miner.Id] = struct{}{}
+			addresses[miner.Address] = struct{}{}
 		}
 	}
 
-	if mExist {
-		reply["address"] = address
-		addrStats := apiServer.getAddressStats(address)
-
-		reply["miners"] = addrStats["miners"]
-		reply["poolHashrate"] = addrStats["poolHashrate"]
-		reply["totalPoolMiners"] = addrStats["totalPoolMiners"]
-		reply["totalPoolWorkers"] = addrStats["totalPoolWorkers"]
-		reply["soloHashrate"] = addrStats["soloHashrate"]
-		reply["totalSoloMiners"] = addrStats["totalSoloMiners"]
-		reply["totalSoloWorkers"] = addrStats["totalSoloWorkers"]
-		reply["payments"] = addrStats["payments"]
-		reply["totalPayments"] = addrStats["totalPayments"]
-		reply["pendingPayment"] = addrStats["pendingPayment"]
-	} else {
-		log.Printf("Address stats lookup failed. No address found for: %v", address)
+	apiMiners, poolHashrate, _, totalPoolWorkers, soloHashrate, _, totalSoloWorkers, _ := apiServer.convertMinerResults(matched)
+	reply["miners"] = apiMiners
+	reply["hashrate"] = poolHashrate + soloHashrate
+	reply["poolHashrate"] = poolHashrate
+	reply["soloHashrate"] = soloHashrate
+	reply["totalWorkers"] = totalPoolWorkers + totalSoloWorkers
+
+	// Connections are counted from the live sessions, a miner id may have several sessions open
+	var connections int64
+	apiServer.stratum.sessions.Range(func(cs *Session) {
+		if cs.miner == nil {
+			return
+		}
+		if _, ok := minerIDs[cs.miner.Id]; ok {
+			connections++
+		}
+	})
+	reply["connections"] = connections
+
+	// Balances are kept by address, so each address matched is reported separately
+	pendingBalances := make(map[string]uint64)
+	paidBalances := make(map[string]uint64)
+	for address := range addresses {
+		pendingBalances[address] = 0
+		paidBalances[address] = 0
 	}
 
-	/*
-		stats := apiServer.getStats()
-		if stats != nil {
-			reply["payments"] = stats["payments"]
-			reply["totalPayments"] = stats["totalPayments"]
-			reply["totalMinersPaid"] = stats["totalMinersPaid"]
+	pendingPayments := Storage_backend.GetPendingPayments()
+	for _, pending := range pendingPayments {
+		if _, ok := addresses[pending.Address]; ok {
+			pendingBalances[pending.Address] += pending.Amount
 		}
-	*/
+	}
 
-	err := json.NewEncoder(writer).Encode(reply)
-	if err != nil {
-		log.Printf("[API] Error serializing API response: %v", err)
-		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	processedPayments := Storage_backend.GetProcessedPayments()
+	if processedPayments != nil {
+		for _, payment := range processedPayments.MinerPayments {
+			if _, ok := addresses[payment.Login]; ok {
+				paidBalances[payment.Login] += payment.Amount
+			}
+		}
 	}
+
+	reply["pendingBalances"] = pendingBalances
+	reply["paidBalances"] = paidBalances
+
+	return reply
 }
 
-func (apiServer *ApiServer) ChartsIndex(writer http.ResponseWriter, _ *http.Request) {
+func (apiServer *ApiServer) WorkersIndex(writer http.ResponseWriter, r *http.Request) {
 	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
 	writer.Header().Set("Cache-Control", "no-cache")
 	writer.WriteHeader(http.StatusOK)
 
-	reply := make(map[string]interface{})
-
-	stats := apiServer.getStats()
-	if stats != nil {
-		reply["poolHashrateChart"] = stats["poolHashrateChart"]
-		reply["poolMinersChart"] = stats["poolMinersChart"]
-		reply["poolWorkersChart"] = stats["poolWorkersChart"]
-		reply["soloHashrateChart"] = stats["soloHashrateChart"]
-		reply["soloMinersChart"] = stats["soloMinersChart"]
-		reply["soloWorkersChart"] = stats["soloWorkersChart"]
-		reply["poolDifficultyChart"] = stats["poolDifficultyChart"]
+	address := r.URL.Query().Get("address")
+	if address == "" {
+		APIInfoLogger.Printf("URL Param 'address' is missing.")
+		return
 	}
 
+	reply := apiServer.getWorkers(address)
+
 	err := json.NewEncoder(writer).Encode(reply)
 	if err != nil {
-		log.Printf("[API] Error serializing API response: %v", err)
 		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
 	}
 }
 
-func (apiServer *ApiServer) getAddressStats(address string) map[string]interface{} {
-	addressStats := make(map[string]interface{})
+// Returns each worker of the address with its own hashrate, shares, last seen, difficulty and live connections, instead of the aggregated address row
+func (apiServer *ApiServer) getWorkers(address string) map[string]interface{} {
+	miners, connections := apiServer.workersOf(map[string]struct{}{address: {}})
+	return apiServer.workersReply(address, miners[address], connections)
+}
 
-	// Get miners associated by address
-	var addrMinerSlice []*Miner
+// Returns the miners of addresses grouped by address, and the live connections of each of their miner ids. Miners and sessions are walked once for all addresses
+func (apiServer *ApiServer) workersOf(addresses map[string]struct{}) (map[string][]*Miner, map[string]int64) {
+	// Stats-only mode has no live miners, so workers are served from stored miner stats
+	var all []*Miner
+	if apiServer.stratum.statsOnly {
+		all = apiServer.backend.GetAllMinerStats()
+	} else {
+		all = apiServer.stratum.miners.Values()
+	}
 
-	minerStats := apiServer.backend.GetAllMinerStats()
-	if minerStats != nil {
-		for _, miner := range minerStats {
-			if miner.Address == address {
-				addrMinerSlice = append(addrMinerSlice, miner)
-			}
+	miners := make(map[string][]*Miner)
+	for _, miner := range all {
+		if miner == nil {
+			continue
+		}
+		if _, ok := addresses[miner.Address]; ok {
+			miners[miner.Address] = append(miners[miner.Address], miner)
 		}
 	}
 
-	apiMiners, poolHashrate, totalPoolMiners, totalPoolWorkers, soloHashrate, totalSoloMiners, totalSoloWorkers, _ := apiServer.convertMinerResults(addrMinerSlice)
-	addressStats["miners"] = apiMiners
-	addressStats["poolHashrate"] = poolHashrate
-	addressStats["totalPoolMiners"] = totalPoolMiners
-	addressStats["totalPoolWorkers"] = totalPoolWorkers
-	addressStats["soloHashrate"] = soloHashrate
-	addressStats["totalSoloMiners"] = totalSoloMiners
-	addressStats["totalSoloWorkers"] = totalSoloWorkers
+	connections := make(map[string]int64)
+	apiServer.stratum.sessions.Range(func(cs *Session) {
+		if cs.miner == nil {
+			return
+		}
+		if _, ok := addresses[cs.miner.Address]; ok {
+			connections[cs.miner.Id]++
+		}
+	})
+	return miners, connections
+}
 
-	// Get payments associated by address
-	var addrPaymentSlice []*MinerPayments
+// Builds the workers reply of address from its miners
+func (apiServer *ApiServer) workersReply(address string, miners []*Miner, connections map[string]int64) map[string]interface{} {
+	reply := make(map[string]interface{})
+	reply["address"] = address
 
-	processedPayments := apiServer.backend.GetProcessedPayments()
-	if processedPayments != nil {
-		for _, payment := range processedPayments.MinerPayments {
-			if payment.Login == address {
-				addrPaymentSlice = append(addrPaymentSlice, payment)
-			}
+	now := util.MakeTimestamp() / 1000
+	var workers []*ApiWorker
+	var hashrate, hashrate10m, hashrate1h, onlineWorkers int64
+	for _, miner := range miners {
+
+		// If hashrateExpiration is set to -1 [0 duration], then keep data forever
+		lastBeat := atomic.LoadInt64(&miner.LastBeat)
+		if apiServer.stratum.hashrateExpiration != 0 && lastBeat < now-int64(apiServer.stratum.hashrateExpiration/time.Second) {
+			continue
+		}
+
+		worker := &ApiWorker{
+			Name:          miner.WorkID,
+			Id:            miner.Id,
+			IsSolo:        miner.IsSolo,
+			ValidShares:   atomic.LoadInt64(&miner.ValidShares),
+			InvalidShares: atomic.LoadInt64(&miner.InvalidShares),
+			LowDiffShares: atomic.LoadInt64(&miner.LowDiffShares),
+			StaleShares:   atomic.LoadInt64(&miner.StaleShares),
+			LastShare:     atomic.LoadInt64(&miner.LastShare),
+			LastBeat:      lastBeat,
+			StartedAt:     miner.StartedAt,
+			Difficulty:    atomic.LoadInt64(&miner.LastDifficulty),
+			Connections:   connections[miner.Id],
+			Offline:       lastBeat < now-int64(apiServer.stratum.estimationWindow/time.Second)/2,
+		}
+		if worker.Name == "" {
+			if miner.IsSolo {
+				worker.Name = "solo~undefined"
+			} else {
+				worker.Name = "undefined"
+			}
 		}
+		miner.RLock()
+		worker.ShareTime = miner.ShareTime
+		miner.RUnlock()
+
+		if !worker.Offline {
+			worker.Hashrate = miner.getHashrate(apiServer.stratum.estimationWindow, apiServer.stratum.hashrateExpiration)
+			hashrate += worker.Hashrate
+			onlineWorkers++
+		}
+		worker.Hashrate10m, worker.Hashrate1h = miner.getRollingHashrates(now)
+		hashrate10m += worker.Hashrate10m
+		hashrate1h += worker.Hashrate1h
+		workers = append(workers, worker)
 	}
 
-	addrProcessedPayments := &ProcessedPayments{MinerPayments: addrPaymentSlice}
+	sort.SliceStable(workers, func(i, j int) bool {
+		return workers[i].Name < workers[j].Name
+	})
 
-	apiPayments, totalPayments, _ := apiServer.convertPaymentsResults(addrProcessedPayments)
+	reply["workers"] = workers
+	reply["hashrate"] = hashrate
+	reply["hashrate10m"] = hashrate10m
+	reply["hashrate1h"] = hashrate1h
+	reply["totalWorkers"] = len(workers)
+	reply["onlineWorkers"] = onlineWorkers
+
+	return reply
+}
+
+// Websocket pushing live events as {"type", "timestamp", "data"}: block [found, matured, orphaned], payment and stats/network [each statsCollectInterval].
+// With ?address=<address> the client is also pushed a miner event with the address' workers each statsCollectInterval
+func (apiServer *ApiServer) LiveIndex(writer http.ResponseWriter, r *http.Request) {
+	if apiServer.stratum.live == nil {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	apiServer.stratum.live.serve(writer, r)
+}
+
+// GET returns the notification registration of ?address=<address>, POST with ?address=<address>&email=<email>&webhook=<url>&workers=true|false registers it and DELETE unregisters it.
+// Only addresses that have mined on the pool can register, and POST and DELETE need &proof= or &code= as for /api/settings
+func (apiServer *ApiServer) NotificationsIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	notifications := apiServer.stratum.notifications
+	address := r.URL.Query().Get("address")
+	if notifications == nil || address == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reply := make(map[string]interface{})
+	reply["address"] = address
+	status := http.StatusOK
+
+	// Registrations direct mail and webhook requests from the pool, so changing them needs the same proof of ownership as /api/settings
+	if r.Method == "POST" || r.Method == "DELETE" {
+		if apiServer.stratum.statsOnly {
+			writer.WriteHeader(http.StatusBadRequest)
+			reply["error"] = "notifications can only be changed through the stratum pool process"
+			json.NewEncoder(writer).Encode(reply)
+			return
+		}
+		if !apiServer.settingsAuth(r, address) {
+			APIInfoLogger.Printf("[API] Unauthorized notification change from %v for %v", r.RemoteAddr, address)
+			writer.WriteHeader(http.StatusForbidden)
+			reply["error"] = "proof of address ownership required: supply a share proof or settings code"
+			json.NewEncoder(writer).Encode(reply)
+			return
+		}
+	}
+
+	switch r.Method {
+	case "POST":
+		var mExist bool
+		minerRegistrations := Graviton_backend.GetMinerIDRegistrations()
+		for _, v := range minerRegistrations {
+			if v.Address == address {
+				mExist = true
+				break
+			}
+		}
+		if !mExist {
+			status = http.StatusNotFound
+			reply["error"] = "address has not mined on the pool"
+			break
+		}
+
+		workers, _ := strconv.ParseBool(r.URL.Query().Get("workers"))
+		registration, err := notifications.register(address, r.URL.Query().Get("email"), r.URL.Query().Get("webhook"), workers)
+		if registration == nil {
+			status = http.StatusBadRequest
+			reply["error"] = err.Error()
+			break
+		}
+		if err != nil {
+			APIErrorLogger.Printf("[API] Error storing notification registration for %v: %v", address, err)
+		}
+		APIInfoLogger.Printf("[API] Notification registration from %v for %v", r.RemoteAddr, address)
+		reply["registration"] = registration.masked()
+	case "DELETE":
+		unregistered, err := notifications.unregister(address)
+		if err != nil {
+			APIErrorLogger.Printf("[API] Error storing notification registrations after removing %v: %v", address, err)
+		}
+		if unregistered {
+			APIInfoLogger.Printf("[API] Notification unregistration from %v for %v", r.RemoteAddr, address)
+		}
+		reply["unregistered"] = unregistered
+	default:
+		if registration := notifications.registration(address); registration != nil {
+			reply["registration"] = registration.masked()
+		}
+	}
+	writer.WriteHeader(status)
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// GET ?address= returns a telegram bot deep link, which links the chat opening it to the address, and the number of chats already linked. Chats unlink with /stop.
+// Authenticated by &proof= or &code= as for /api/settings
+func (apiServer *ApiServer) TelegramIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	telegram := apiServer.stratum.telegram
+	address := r.URL.Query().Get("address")
+	if telegram == nil || address == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reply := make(map[string]interface{})
+	reply["address"] = address
+	status := http.StatusOK
+
+	if !util.ValidateAddress(address, apiServer.stratum.currentConfig().Address) {
+		status = http.StatusBadRequest
+		reply["error"] = "invalid address"
+	} else if !apiServer.settingsAuth(r, address) {
+		// A linked chat is sent the blocks, payments and workers of the address, so a link needs the same proof of ownership as /api/settings
+		APIInfoLogger.Printf("[API] Unauthorized telegram link request from %v for %v", r.RemoteAddr, address)
+		status = http.StatusForbidden
+		reply["error"] = "proof of address ownership required: supply a share proof or settings code"
+	} else if link, expires, err := telegram.deepLink(address); err != nil {
+		APIErrorLogger.Printf("[API] Error creating telegram link for %v: %v", address, err)
+		status = http.StatusInternalServerError
+		reply["error"] = err.Error()
+	} else {
+		reply["link"] = link
+		reply["expires"] = expires
+		reply["linkedChats"] = telegram.linkedChats(address)
+	}
+	writer.WriteHeader(status)
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// GET returns the settings of ?address=, POST with ?address=&minPayment=<DERO>&interval=<duration> sets its payout settings and &email=&telegram= its contact settings,
+// the parameters left out are kept. Without contact parameters, minPayment and interval both empty resets the address to the pool minPayment. A POST is authenticated by
+// &proof=<result of a recently accepted share>, &code=<amount in DERO of the code payment> or, with minerSettingsIpAuth, coming from an ip with active workers of the address.
+// POST ?address=&requestCode=true sends the code payment to the address
+func (apiServer *ApiServer) SettingsIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	address := r.URL.Query().Get("address")
+	if address == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	paymentsConfig := apiServer.stratum.currentConfig().PaymentsConfig
+	reply := make(map[string]interface{})
+	reply["address"] = address
+	reply["enabled"] = paymentsConfig.MinerSettings
+	reply["poolMinPayment"] = paymentsConfig.Threshold
+	status := http.StatusOK
+
+	switch r.Method {
+	case "POST":
+		if !paymentsConfig.MinerSettings {
+			status = http.StatusBadRequest
+			reply["error"] = "miner settings are disabled on this pool"
+			break
+		}
+		// Share-proofs, settings codes and sessions are kept by the stratum process, which a statsOnly api cannot check
+		if apiServer.stratum.statsOnly {
+			status = http.StatusBadRequest
+			reply["error"] = "settings can only be set through the stratum pool process, or payout settings with the login"
+			break
+		}
+
+		query := r.URL.Query()
+		if query.Get("requestCode") == "true" {
+			APIInfoLogger.Printf("[API] Settings code request from %v for %v", r.RemoteAddr, address)
+			expires, err := apiServer.stratum.requestSettingsCode(address)
+			if err != nil {
+				status = http.StatusBadRequest
+				reply["error"] = err.Error()
+				break
+			}
+			reply["codeSent"] = true
+			reply["codeExpires"] = expires
+			break
+		}
+
+		_, hasEmail := query["email"]
+		_, hasTelegram := query["telegram"]
+		_, hasMinPayment := query["minPayment"]
+		_, hasInterval := query["interval"]
+		setContact := hasEmail || hasTelegram
+		setPayout := hasMinPayment || hasInterval || !setContact
+
+		threshold, interval, err := apiServer.stratum.parsePayoutSettings(query.Get("minPayment") + "/" + query.Get("interval"))
+		if err != nil && setPayout {
+			status = http.StatusBadRequest
+			reply["error"] = err.Error()
+			break
+		}
+		email, telegram, err := validateContactSettings(query.Get("email"), query.Get("telegram"))
+		if err != nil {
+			status = http.StatusBadRequest
+			reply["error"] = err.Error()
+			break
+		}
+		if !apiServer.settingsAuth(r, address) {
+			APIErrorLogger.Printf("[API] Rejected settings from %v for %v, not authenticated", r.RemoteAddr, address)
+			status = http.StatusForbidden
+			reply["error"] = "not authenticated: pass the result of a recently accepted share of the address as proof, or a settings code as code"
+			break
+		}
+
+		APIInfoLogger.Printf("[API] Settings from %v for %v: minPayment %v, interval %vs, email set: %v, telegram: %v", r.RemoteAddr, address, threshold, interval, hasEmail, telegram)
+		settings, err := apiServer.stratum.updateMinerSettings(address, func(settings *MinerSettings) {
+			if setPayout {
+				settings.Threshold = threshold
+				settings.Interval = interval
+			}
+			if hasEmail {
+				settings.Email = email
+			}
+			if hasTelegram {
+				settings.Telegram = telegram
+			}
+		})
+		if err != nil {
+			APIErrorLogger.Printf("[API] Error storing settings for %v: %v", address, err)
+			status = http.StatusInternalServerError
+			break
+		}
+		if !settings.empty() {
+			reply["settings"] = settings.masked()
+		}
+	default:
+		if settings := Storage_backend.GetMinerSettings()[address]; settings != nil {
+			reply["settings"] = settings.masked()
+		}
+	}
+	writer.WriteHeader(status)
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// Returns whether a POST /api/settings is authenticated for address, by a share-proof, a settings code or, with minerSettingsIpAuth, the ip of an active worker of the address.
+// The proof and code are used up once checked
+func (apiServer *ApiServer) settingsAuth(r *http.Request, address string) bool {
+	query := r.URL.Query()
+	if proof := query.Get("proof"); proof != "" {
+		return apiServer.stratum.checkShareProof(address, proof)
+	}
+	if code := query.Get("code"); code != "" {
+		return apiServer.stratum.checkSettingsCode(address, code)
+	}
+	if apiServer.stratum.currentConfig().PaymentsConfig.MinerSettingsIPAuth {
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+		return apiServer.stratum.activeWorkerIP(address, ip)
+	}
+	return false
+}
+
+func (apiServer *ApiServer) AccountIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+
+	keys, ok := r.URL.Query()["address"]
+
+	if !ok || len(keys[0]) < 1 {
+		APIInfoLogger.Printf("URL Param 'address' is missing.")
+		return
+	}
+
+	address := keys[0]
+
+	reply := make(map[string]interface{})
+
+	var mExist bool
+	minerRegistrations := Graviton_backend.GetMinerIDRegistrations()
+	for _, v := range minerRegistrations {
+		if v.Address == address {
+			mExist = true
+			break
+		}
+	}
+
+	if mExist {
+		reply["address"] = address
+		addrStats := apiServer.getAddressStats(address)
+
+		reply["miners"] = addrStats["miners"]
+		reply["poolHashrate"] = addrStats["poolHashrate"]
+		reply["totalPoolMiners"] = addrStats["totalPoolMiners"]
+		reply["totalPoolWorkers"] = addrStats["totalPoolWorkers"]
+		reply["soloHashrate"] = addrStats["soloHashrate"]
+		reply["totalSoloMiners"] = addrStats["totalSoloMiners"]
+		reply["totalSoloWorkers"] = addrStats["totalSoloWorkers"]
+		reply["payments"] = addrStats["payments"]
+		reply["totalPayments"] = addrStats["totalPayments"]
+		reply["pendingPayment"] = addrStats["pendingPayment"]
+	} else {
+		APIInfoLogger.Printf("Address stats lookup failed. No address found for: %v", address)
+	}
+
+	/*
+		stats := apiServer.getStats()
+		if stats != nil {
+			reply["payments"] = stats["payments"]
+			reply["totalPayments"] = stats["totalPayments"]
+			reply["totalMinersPaid"] = stats["totalMinersPaid"]
+		}
+	*/
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// Returns the chart without its downsampled values, nil if there is no chart data
+func (apiServer *ApiServer) recentChartsData(chartType string) *GravitonCharts {
+	charts := apiServer.backend.GetChartsData(chartType)
+	if charts == nil {
+		return nil
+	}
+	return &GravitonCharts{Values: charts.Values}
+}
+
+func (apiServer *ApiServer) ChartsIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	reply := make(map[string]interface{})
+
+	// History of a single chart, the most recent values followed by the downsampled ones
+	if chart := r.URL.Query().Get("chart"); chart != "" {
+		if chart == "minerhashrate" {
+			address := r.URL.Query().Get("address")
+			if address == "" {
+				writer.WriteHeader(http.StatusBadRequest)
+				reply["error"] = "address is required for the minerhashrate chart"
+				json.NewEncoder(writer).Encode(reply)
+				return
+			}
+			chart += ":" + address
+		}
+		from, _ := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+		to, _ := strconv.ParseInt(r.URL.Query().Get("to"), 10, 64)
+
+		values := []*ChartData{}
+		if charts := apiServer.backend.GetChartsData(chart); charts != nil {
+			values = charts.series(from, to)
+		}
+		writer.WriteHeader(http.StatusOK)
+		reply["chart"] = r.URL.Query().Get("chart")
+		reply["values"] = values
+		err := json.NewEncoder(writer).Encode(reply)
+		if err != nil {
+			APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+		}
+		return
+	}
+
+	writer.WriteHeader(http.StatusOK)
+	stats := apiServer.getStats()
+	if stats != nil {
+		reply["poolHashrateChart"] = stats["poolHashrateChart"]
+		reply["poolMinersChart"] = stats["poolMinersChart"]
+		reply["poolWorkersChart"] = stats["poolWorkersChart"]
+		reply["soloHashrateChart"] = stats["soloHashrateChart"]
+		reply["soloMinersChart"] = stats["soloMinersChart"]
+		reply["soloWorkersChart"] = stats["soloWorkersChart"]
+		reply["poolDifficultyChart"] = stats["poolDifficultyChart"]
+	}
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+func (apiServer *ApiServer) getAddressStats(address string) map[string]interface{} {
+	addressStats := make(map[string]interface{})
+
+	// Get miners associated by address
+	var addrMinerSlice []*Miner
+
+	minerStats := apiServer.backend.GetAllMinerStats()
+	if minerStats != nil {
+		for _, miner := range minerStats {
+			if miner.Address == address {
+				addrMinerSlice = append(addrMinerSlice, miner)
+			}
+		}
+	}
+
+	apiMiners, poolHashrate, totalPoolMiners, totalPoolWorkers, soloHashrate, totalSoloMiners, totalSoloWorkers, totalRoundShares := apiServer.convertMinerResults(addrMinerSlice)
+	addressStats["miners"] = apiMiners
+	// Percent of the current pool round contributed by the workers of the address
+	var roundShares int64
+	for _, miner := range apiMiners {
+		roundShares += miner.RoundShares
+	}
+	addressStats["roundShares"] = roundShares
+	addressStats["roundContribution"] = roundContribution(roundShares, totalRoundShares)
+	addressStats["poolHashrate"] = poolHashrate
+	addressStats["totalPoolMiners"] = totalPoolMiners
+	addressStats["totalPoolWorkers"] = totalPoolWorkers
+	addressStats["soloHashrate"] = soloHashrate
+	addressStats["totalSoloMiners"] = totalSoloMiners
+	addressStats["totalSoloWorkers"] = totalSoloWorkers
+
+	apiPayments, totalPayments := apiServer.addressPayments(address)
 	addressStats["payments"] = apiPayments
 	addressStats["totalPayments"] = totalPayments
 
 	// Get pending payments associated by address
 	var pendingAmount uint64
 
-	pendingPayments := apiServer.backend.GetPendingPayments()
+	pendingPayments := Storage_backend.GetPendingPayments()
 	if pendingPayments != nil {
 		for _, pending := range pendingPayments {
 			if pending.Address == address {
@@ -784,6 +1780,25 @@ func (apiServer *ApiServer) getAddressStats(address string) map[string]interface
 	return addressStats
 }
 
+// Returns the payments associated by address and the number of them
+func (apiServer *ApiServer) addressPayments(address string) ([]*ApiPayments, int64) {
+	var addrPaymentSlice []*MinerPayments
+
+	processedPayments := Storage_backend.GetProcessedPayments()
+	if processedPayments != nil {
+		for _, payment := range processedPayments.MinerPayments {
+			if payment.Login == address {
+				addrPaymentSlice = append(addrPaymentSlice, payment)
+			}
+		}
+	}
+
+	addrProcessedPayments := &ProcessedPayments{MinerPayments: addrPaymentSlice}
+
+	apiPayments, totalPayments, _ := apiServer.convertPaymentsResults(addrProcessedPayments)
+	return apiPayments, totalPayments
+}
+
 func (apiServer *ApiServer) getEventsData() ([]*ApiEventPayments, int64) {
 	var eventPaymentSlice []*ApiEventPayments
 	var eventPayouts int64
@@ -875,7 +1890,6 @@ func (apiServer *ApiServer) getEventsData() ([]*ApiEventPayments, int64) {
 
 func (apiServer *ApiServer) EventsIndex(writer http.ResponseWriter, _ *http.Request) {
 	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
 	writer.Header().Set("Cache-Control", "no-cache")
 	writer.WriteHeader(http.StatusOK)
 
@@ -893,26 +1907,1113 @@ func (apiServer *ApiServer) EventsIndex(writer http.ResponseWriter, _ *http.Requ
 
 	err := json.NewEncoder(writer).Encode(reply)
 	if err != nil {
-		log.Printf("[API] Error serializing API response: %v", err)
 		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
 	}
 }
 
-func (apiServer *ApiServer) getStats() map[string]interface{} {
-	stats := apiServer.stats.Load()
-	if stats != nil {
-		return stats.(map[string]interface{})
-	}
-	return nil
-}
+func (apiServer *ApiServer) EstimateIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
 
-func logFileOutAPI(lType string) *log.Logger {
-	var logFileName string
-	if lType == "ERROR" {
-		logFileName = "logs/apiError.log"
-	} else {
-		logFileName = "logs/api.log"
+	keys, ok := r.URL.Query()["id"]
+
+	if !ok || len(keys[0]) < 1 {
+		APIInfoLogger.Printf("URL Param 'id' is missing.")
+		return
 	}
+
+	minerID := keys[0]
+
+	reply := apiServer.getMinerEstimate(minerID)
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// Estimates daily earnings of a given miner id based off of its recent hashrate, the current network difficulty, block reward and pool fee
+func (apiServer *ApiServer) getMinerEstimate(minerID string) map[string]interface{} {
+	estimate := make(map[string]interface{})
+	estimate["id"] = minerID
+	estimate["hashrate"] = int64(0)
+	estimate["estimatedDailyEarnings"] = uint64(0)
+
+	currMiner := apiServer.backend.GetMinerStatsByID(minerID)
+	if currMiner == nil {
+		estimate["reason"] = "No miner stats found for this id."
+		return estimate
+	}
+
+	t := apiServer.stratum.currentBlockTemplate()
+	if t == nil || t.Difficulty == 0 {
+		estimate["reason"] = "No block template available to estimate against, try again shortly."
+		return estimate
+	}
+
+	now := util.MakeTimestamp() / 1000
+	window := int64(apiServer.stratum.estimationWindow / time.Second)
+
+	// Same offline determination as convertMinerResults, an offline miner has no hashrate to estimate from
+	if currMiner.LastBeat < (now - window/2) {
+		estimate["reason"] = "Miner is offline, no recent shares to estimate from."
+		return estimate
+	}
+
+	// Require a full estimation window of share history, otherwise hashrate is too volatile to reliably estimate from
+	if now-currMiner.StartedAt < window {
+		estimate["reason"] = fmt.Sprintf("Insufficient share history to estimate, miner must be connected for at least %v.", apiServer.stratum.estimationWindow)
+		return estimate
+	}
+
+	hashrate := currMiner.getHashrate(apiServer.stratum.estimationWindow, apiServer.stratum.hashrateExpiration)
+	if hashrate <= 0 {
+		estimate["reason"] = "No recent shares within the estimation window to estimate from."
+		return estimate
+	}
+
+	// Expected blocks per day is the miner hashrate share of the network difficulty over a day's worth of seconds. Pool fee is only charged on pool blocks
+	dailyReward := float64(hashrate) * 86400 / float64(t.Difficulty) * float64(t.Expected_reward)
+	if !currMiner.IsSolo {
+		dailyReward = dailyReward * (1 - apiServer.stratum.currentConfig().UnlockerConfig.PoolFee/100)
+	}
+
+	estimate["hashrate"] = hashrate
+	estimate["difficulty"] = t.Difficulty
+	estimate["blockReward"] = t.Expected_reward
+	estimate["poolFee"] = apiServer.stratum.currentConfig().UnlockerConfig.PoolFee
+	estimate["isSolo"] = currMiner.IsSolo
+	estimate["estimatedDailyEarnings"] = uint64(dailyReward)
+
+	return estimate
+}
+
+func (apiServer *ApiServer) MetricsIndex(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+
+	reply := make(map[string]interface{})
+	reply["now"] = util.MakeTimestamp() / 1000
+	reply["broadcast"] = apiServer.stratum.broadcastMetrics.Snapshot()
+	if apiServer.stratum.verifier != nil {
+		reply["verifier"] = apiServer.stratum.verifier.Snapshot()
+	}
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// Pool metrics in the Prometheus text format. Shares and blocks are counters, per minute rates are left to the query [e.g. rate(dero_pool_shares_total[5m]) * 60]
+func (apiServer *ApiServer) PrometheusIndex(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+
+	s := apiServer.stratum
+	w := &bytes.Buffer{}
+
+	sessions := s.sessions.Count()
+	writePromHeader(w, "dero_pool_sessions", "gauge", "Connected stratum sessions.")
+	writePromSample(w, "dero_pool_sessions", float64(sessions))
+
+	writePromHeader(w, "dero_pool_connections", "gauge", "Open stratum connections by port.")
+	portConnections := s.portConnections()
+	ports := make([]int, 0, len(portConnections))
+	for port := range portConnections {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	for _, port := range ports {
+		writePromSample(w, "dero_pool_connections", float64(portConnections[port]), "port", strconv.Itoa(port))
+	}
+	writePromHeader(w, "dero_pool_connections_rejected_total", "counter", "Connections rejected since start by maxConnections.")
+	writePromSample(w, "dero_pool_connections_rejected_total", float64(atomic.LoadInt64(&s.rejectedConnections)))
+	writePromHeader(w, "dero_pool_duplicate_sessions_closed_total", "counter", "Older sessions closed since start by collapseDuplicates.")
+	writePromSample(w, "dero_pool_duplicate_sessions_closed_total", float64(atomic.LoadInt64(&s.duplicateSessions)))
+	writePromHeader(w, "dero_pool_oversized_messages_total", "counter", "Stratum and getwork requests rejected since start for exceeding the message limits.")
+	writePromSample(w, "dero_pool_oversized_messages_total", float64(atomic.LoadInt64(&s.oversizedMessages)))
+	writePromHeader(w, "dero_pool_miner_logins_rejected_total", "counter", "Logins rejected since start by maxMinerConnections.")
+	writePromSample(w, "dero_pool_miner_logins_rejected_total", float64(atomic.LoadInt64(&s.rejectedMinerLogins)))
+	writePromHeader(w, "dero_pool_rate_limited_total", "counter", "Requests exceeding the stratum rateLimit since start.")
+	writePromSample(w, "dero_pool_rate_limited_total", float64(atomic.LoadInt64(&s.rateLimited)))
+
+	if proxy := s.proxy; proxy != nil {
+		connected := 0.0
+		if proxy.ready() {
+			connected = 1
+		}
+		writePromHeader(w, "dero_pool_proxy_connected", "gauge", "Whether the pool is logged in to the upstream pool in proxy mode.")
+		writePromSample(w, "dero_pool_proxy_connected", connected)
+		writePromHeader(w, "dero_pool_proxy_shares_total", "counter", "Shares forwarded to the upstream pool since start by result.")
+		writePromSample(w, "dero_pool_proxy_shares_total", float64(atomic.LoadInt64(&proxy.Accepted)), "result", "accepted")
+		writePromSample(w, "dero_pool_proxy_shares_total", float64(atomic.LoadInt64(&proxy.Rejected)), "result", "rejected")
+	}
+
+	if s.roundJournal != nil {
+		writePromHeader(w, "dero_pool_share_write_buffer", "gauge", "Journaled shares buffered by shareWriteBatching and not written yet.")
+		writePromSample(w, "dero_pool_share_write_buffer", float64(s.roundJournal.depth()))
+		writePromHeader(w, "dero_pool_share_write_flushes_total", "counter", "Batches of buffered shares written to the journal since start.")
+		writePromSample(w, "dero_pool_share_write_flushes_total", float64(atomic.LoadInt64(&s.roundJournal.flushes)))
+	}
+
+	writePromHeader(w, "dero_pool_template_rejects_total", "counter", "Block templates rejected by the template checks since start by reason.")
+	for reason, count := range s.templateChecks.rejects() {
+		writePromSample(w, "dero_pool_template_rejects_total", float64(count), "reason", reason)
+	}
+
+	if payouts := s.payouts; payouts != nil {
+		if health := payouts.walletHealth(); health != nil {
+			paused := 0.0
+			if health.Paused {
+				paused = 1
+			}
+			writePromHeader(w, "dero_pool_payments_paused", "gauge", "Whether payouts are paused by the wallet health check.")
+			writePromSample(w, "dero_pool_payments_paused", paused)
+			writePromHeader(w, "dero_pool_wallet_unlocked_balance", "gauge", "Unlocked balance of the payments wallet in atomic units.")
+			writePromSample(w, "dero_pool_wallet_unlocked_balance", float64(health.UnlockedBalance))
+			writePromHeader(w, "dero_pool_payments_due", "gauge", "Pending balances due for payout in atomic units.")
+			writePromSample(w, "dero_pool_payments_due", float64(health.Due))
+			writePromHeader(w, "dero_pool_wallet_sweep", "gauge", "Payments wallet balance above hotWalletBuffer and the pending balances in atomic units, to sweep to cold storage.")
+			writePromSample(w, "dero_pool_wallet_sweep", float64(health.Sweep))
+		}
+	}
+
+	writePromHeader(w, "dero_pool_miners_registered", "gauge", "Miner ids registered with the pool.")
+	writePromSample(w, "dero_pool_miners_registered", float64(len(Graviton_backend.GetMinerIDRegistrations())))
+	writePromHeader(w, "dero_pool_miners_in_memory", "gauge", "Miners held in memory, evicted miners excluded.")
+	writePromSample(w, "dero_pool_miners_in_memory", float64(s.miners.Count()))
+	writePromHeader(w, "dero_pool_miners_evicted_total", "counter", "Offline miners evicted from memory since start.")
+	writePromSample(w, "dero_pool_miners_evicted_total", float64(atomic.LoadInt64(&s.minersEvicted)))
+	writePromHeader(w, "dero_pool_miners_restored_total", "counter", "Evicted miners restored from storage on login since start.")
+	writePromSample(w, "dero_pool_miners_restored_total", float64(atomic.LoadInt64(&s.minersRestored)))
+
+	writePromHeader(w, "dero_pool_shares_total", "counter", "Shares submitted since start by result.")
+	writePromSample(w, "dero_pool_shares_total", float64(atomic.LoadInt64(&s.shareMetrics.Valid)), "result", "valid")
+	writePromSample(w, "dero_pool_shares_total", float64(atomic.LoadInt64(&s.shareMetrics.Invalid)), "result", "invalid")
+	writePromSample(w, "dero_pool_shares_total", float64(atomic.LoadInt64(&s.shareMetrics.Stale)), "result", "stale")
+	writePromSample(w, "dero_pool_shares_total", float64(atomic.LoadInt64(&s.shareMetrics.LowDiff)), "result", "lowdiff")
+	writePromHeader(w, "dero_pool_late_shares_total", "counter", "Shares for the previous height accepted since start within staleGracePeriod, counted as valid as well.")
+	writePromSample(w, "dero_pool_late_shares_total", float64(atomic.LoadInt64(&s.shareMetrics.Late)))
+	writePromHeader(w, "dero_pool_port_shares_total", "counter", "Shares submitted since start by port and result.")
+	s.listenersMu.Lock()
+	for _, e := range s.endpoints {
+		port := strconv.Itoa(e.config.Port)
+		writePromSample(w, "dero_pool_port_shares_total", float64(atomic.LoadInt64(&e.shares.Valid)), "port", port, "result", "valid")
+		writePromSample(w, "dero_pool_port_shares_total", float64(atomic.LoadInt64(&e.shares.Invalid)), "port", port, "result", "invalid")
+		writePromSample(w, "dero_pool_port_shares_total", float64(atomic.LoadInt64(&e.shares.Stale)), "port", port, "result", "stale")
+		writePromSample(w, "dero_pool_port_shares_total", float64(atomic.LoadInt64(&e.shares.LowDiff)), "port", port, "result", "lowdiff")
+	}
+	s.listenersMu.Unlock()
+	if s.rejectAlarms != nil {
+		writePromHeader(w, "dero_pool_reject_alarms", "gauge", "Raised reject and stale rate alarms by scope.")
+		for scope, count := range s.rejectAlarms.active() {
+			writePromSample(w, "dero_pool_reject_alarms", float64(count), "scope", scope)
+		}
+	}
+
+	writePromHeader(w, "dero_pool_block_submissions_total", "counter", "Blocks submitted to the daemon since start by result.")
+	writePromSample(w, "dero_pool_block_submissions_total", float64(atomic.LoadInt64(&s.shareMetrics.BlocksAccepted)), "result", "accepted")
+	writePromSample(w, "dero_pool_block_submissions_total", float64(atomic.LoadInt64(&s.shareMetrics.BlocksRejected)), "result", "rejected")
+
+	// Block, round and hashrate figures come from the last stats collection
+	if stats := apiServer.getStats(); stats != nil {
+		writePromHeader(w, "dero_pool_blocks", "gauge", "Blocks found by state.")
+		for _, state := range []string{"candidates", "immature", "matured"} {
+			if total, ok := stats[state+"Total"].(int); ok {
+				writePromSample(w, "dero_pool_blocks", float64(total), "state", state)
+			}
+		}
+		if roundShares, ok := stats["totalRoundShares"].(int64); ok {
+			writePromHeader(w, "dero_pool_round_shares", "gauge", "Shares of the current pool round.")
+			writePromSample(w, "dero_pool_round_shares", float64(roundShares))
+		}
+		if effort, ok := stats["currentEffort"].(float64); ok {
+			writePromHeader(w, "dero_pool_round_effort_percent", "gauge", "Shares of the current pool round as percent of the network difficulty.")
+			writePromSample(w, "dero_pool_round_effort_percent", effort)
+		}
+		if effort, ok := stats["averageEffort"].(float64); ok {
+			writePromHeader(w, "dero_pool_average_effort_percent", "gauge", "Average effort of the last effortBlocks pool blocks.")
+			writePromSample(w, "dero_pool_average_effort_percent", effort)
+		}
+		writePromHeader(w, "dero_pool_hashrate", "gauge", "Hashrate by mining mode.")
+		if hashrate, ok := stats["poolHashrate"].(int64); ok {
+			writePromSample(w, "dero_pool_hashrate", float64(hashrate), "mode", "pool")
+		}
+		if hashrate, ok := stats["soloHashrate"].(int64); ok {
+			writePromSample(w, "dero_pool_hashrate", float64(hashrate), "mode", "solo")
+		}
+		writePromHeader(w, "dero_pool_workers", "gauge", "Online workers by mining mode.")
+		if workers, ok := stats["totalPoolWorkers"].(int64); ok {
+			writePromSample(w, "dero_pool_workers", float64(workers), "mode", "pool")
+		}
+		if workers, ok := stats["totalSoloWorkers"].(int64); ok {
+			writePromSample(w, "dero_pool_workers", float64(workers), "mode", "solo")
+		}
+	}
+
+	if len(s.upstreams) > 0 {
+		writePromHeader(w, "dero_pool_upstream_latency_seconds", "gauge", "Duration of the last rpc request to the upstream daemon.")
+		for _, upstream := range s.upstreams {
+			writePromSample(w, "dero_pool_upstream_latency_seconds", time.Duration(atomic.LoadInt64(&upstream.LastLatency)).Seconds(), "upstream", upstream.Name)
+		}
+		writePromHeader(w, "dero_pool_upstream_sick", "gauge", "Whether the upstream daemon is marked sick.")
+		for _, upstream := range s.upstreams {
+			var sick float64
+			if upstream.Sick() {
+				sick = 1
+			}
+			writePromSample(w, "dero_pool_upstream_sick", sick, "upstream", upstream.Name)
+		}
+	}
+
+	var pendingAmount uint64
+	pendingPayments := Storage_backend.GetPendingPayments()
+	for _, pending := range pendingPayments {
+		pendingAmount += pending.Amount
+	}
+	var safeMode float64
+	if s.inSafeMode() {
+		safeMode = 1
+	}
+	writePromHeader(w, "dero_pool_safe_mode", "gauge", "Whether the pool is in safe mode after the startup state check, crediting and payouts paused.")
+	writePromSample(w, "dero_pool_safe_mode", safeMode)
+
+	writePromHeader(w, "dero_pool_payments_pending", "gauge", "Pending payments queued for payout.")
+	writePromSample(w, "dero_pool_payments_pending", float64(len(pendingPayments)))
+	writePromHeader(w, "dero_pool_payments_pending_amount", "gauge", "Total amount of pending payments in atomic units.")
+	writePromSample(w, "dero_pool_payments_pending_amount", float64(pendingAmount))
+	if stats := apiServer.getStats(); stats != nil {
+		if txFees, ok := stats["txFees"].(map[string]uint64); ok {
+			writePromHeader(w, "dero_pool_payment_tx_fees", "counter", "Network fees of payout transactions in atomic units by payer, as of the last stats collection.")
+			writePromSample(w, "dero_pool_payment_tx_fees", float64(txFees["miners"]), "payer", "miners")
+			writePromSample(w, "dero_pool_payment_tx_fees", float64(txFees["pool"]), "payer", "pool")
+		}
+	}
+	intentCounts := make(map[string]int)
+	for _, intent := range sortedPaymentIntents() {
+		if intent.open() {
+			intentCounts[intent.Status]++
+		}
+	}
+	writePromHeader(w, "dero_pool_payment_intents", "gauge", "Open payment intents by status.")
+	for _, intentStatus := range []string{intentPending, intentRetry, intentUnknown, intentSent} {
+		writePromSample(w, "dero_pool_payment_intents", float64(intentCounts[intentStatus]), "status", intentStatus)
+	}
+
+	if v := s.verifier; v != nil {
+		writePromHeader(w, "dero_pool_share_verify_queued", "gauge", "Shares queued for proof of work verification, current and max since start.")
+		writePromSample(w, "dero_pool_share_verify_queued", float64(len(v.queue)), "stat", "current")
+		writePromSample(w, "dero_pool_share_verify_queued", float64(atomic.LoadInt64(&v.MaxQueued)), "stat", "max")
+		writePromHeader(w, "dero_pool_share_verify_total", "counter", "Shares verified by the verifier workers since start, shares rejected as busy on a full queue and block candidates verified inline on a full queue.")
+		writePromSample(w, "dero_pool_share_verify_total", float64(atomic.LoadInt64(&v.Verified)), "result", "verified")
+		writePromSample(w, "dero_pool_share_verify_total", float64(atomic.LoadInt64(&v.Busy)), "result", "busy")
+		writePromSample(w, "dero_pool_share_verify_total", float64(atomic.LoadInt64(&v.Inline)), "result", "inline")
+	}
+
+	if n := s.daemonNotifier; n != nil {
+		writePromHeader(w, "dero_pool_daemon_notifications_total", "counter", "Daemon block notifications received since start by source.")
+		writePromSample(w, "dero_pool_daemon_notifications_total", float64(atomic.LoadInt64(&n.Websocket)), "source", "websocket")
+		writePromSample(w, "dero_pool_daemon_notifications_total", float64(atomic.LoadInt64(&n.Exec)), "source", "exec")
+		writePromHeader(w, "dero_pool_daemon_notification_templates_total", "counter", "Refreshes triggered by daemon notifications which brought a new block template since start.")
+		writePromSample(w, "dero_pool_daemon_notification_templates_total", float64(atomic.LoadInt64(&n.NewTemplates)))
+	}
+
+	if s.shareCache != nil {
+		writePromHeader(w, "dero_pool_share_cache_size", "gauge", "Shares recorded for pool-wide duplicate detection within shareCacheTtl.")
+		writePromSample(w, "dero_pool_share_cache_size", float64(s.shareCache.count()))
+	}
+
+	b := &s.broadcastMetrics
+	writePromHeader(w, "dero_pool_broadcasts_total", "counter", "Job broadcasts since start.")
+	writePromSample(w, "dero_pool_broadcasts_total", float64(atomic.LoadInt64(&b.Broadcasts)))
+	writePromHeader(w, "dero_pool_broadcast_duration_seconds", "gauge", "Duration of job broadcasts, last and max since start.")
+	writePromSample(w, "dero_pool_broadcast_duration_seconds", float64(atomic.LoadInt64(&b.LastDuration))/1000, "stat", "last")
+	writePromSample(w, "dero_pool_broadcast_duration_seconds", float64(atomic.LoadInt64(&b.MaxDuration))/1000, "stat", "max")
+	writePromHeader(w, "dero_pool_broadcast_removed_total", "counter", "Sessions removed on a failed job push [write queue full or closed].")
+	writePromSample(w, "dero_pool_broadcast_removed_total", float64(atomic.LoadInt64(&b.TotalRemoved)))
+	writePromHeader(w, "dero_pool_broadcast_max_queued", "gauge", "Deepest session write queue seen by a job push since start.")
+	writePromSample(w, "dero_pool_broadcast_max_queued", float64(atomic.LoadInt64(&b.MaxQueued)))
+
+	if _, err := writer.Write(w.Bytes()); err != nil {
+		APIErrorLogger.Printf("[API] Error writing metrics response: %v", err)
+	}
+}
+
+// GET returns safe mode state and the issues found by the startup state check, POST with ?acknowledge=true leaves safe mode
+func (apiServer *ApiServer) AdminSafeModeIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	if r.Method == "POST" {
+		acknowledge, err := strconv.ParseBool(r.URL.Query().Get("acknowledge"))
+		if err != nil || !acknowledge {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		APIInfoLogger.Printf("[API] Admin request from %v to acknowledge safe mode", r.RemoteAddr)
+		apiServer.stratum.acknowledgeSafeMode()
+	}
+	writer.WriteHeader(http.StatusOK)
+
+	issues, since := apiServer.stratum.safeModeState()
+	reply := make(map[string]interface{})
+	reply["safeMode"] = apiServer.stratum.inSafeMode()
+	reply["issues"] = issues
+	reply["since"] = since
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// GET returns maintenance mode state, POST with ?enabled=true|false toggles maintenance mode
+func (apiServer *ApiServer) AdminMaintenanceIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	if r.Method == "POST" {
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		APIInfoLogger.Printf("[API] Admin request from %v to set maintenance mode: %v", r.RemoteAddr, enabled)
+		apiServer.stratum.setMaintenance(enabled)
+	}
+	writer.WriteHeader(http.StatusOK)
+
+	reply := make(map[string]interface{})
+	reply["maintenance"] = apiServer.stratum.inMaintenance()
+	reply["pauseJobs"] = apiServer.stratum.currentConfig().Stratum.MaintenancePauseJobs
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// POST re-reads the config file and applies its mutable settings, see StratumServer.ReloadConfig
+func (apiServer *ApiServer) AdminReloadIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	if r.Method != "POST" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	APIInfoLogger.Printf("[API] Admin request from %v to reload config", r.RemoteAddr)
+
+	reply := make(map[string]interface{})
+	if err := apiServer.stratum.ReloadConfig(); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		reply["reloaded"] = false
+		reply["error"] = err.Error()
+	} else {
+		writer.WriteHeader(http.StatusOK)
+		reply["reloaded"] = true
+	}
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// GET returns the default log level and the module levels, POST with ?module=<module>&level=<debug|info|warn|error> sets the level of the module [the default level
+// without module] until the next restart or reload
+func (apiServer *ApiServer) AdminLogLevelIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	reply := make(map[string]interface{})
+	switch r.Method {
+	case "GET":
+	case "POST":
+		module := r.URL.Query().Get("module")
+		level, err := util.SetLogLevel(module, r.URL.Query().Get("level"))
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			reply["error"] = err.Error()
+			json.NewEncoder(writer).Encode(reply)
+			return
+		}
+		APIInfoLogger.Printf("[API] Admin request from %v set log level of %q to %v", r.RemoteAddr, module, level)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+
+	reply["level"], reply["modules"] = util.LogLevels()
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// Number of miners by hashrate in the admin overview
+const overviewTopMiners = 10
+
+// GET returns a single document of what an operator checks daily for a one-page ops dashboard: daemon height and health, wallet balance against the pending
+// liabilities, the last block found and effort, the payment queue, the top miners, bans and error rates. Stats come from the last stats collection
+func (apiServer *ApiServer) AdminOverviewIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	if r.Method != "GET" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+
+	s := apiServer.stratum
+	stats := apiServer.getStats()
+	now := util.MakeTimestamp() / 1000
+
+	reply := make(map[string]interface{})
+	reply["now"] = now
+	reply["uptime"] = now - s.startedAt
+	reply["sessions"] = s.sessions.Count()
+	reply["miners"] = s.miners.Count()
+
+	// Daemon height and health
+	daemon := make(map[string]interface{})
+	daemon["sick"] = s.isSick()
+	daemon["maintenance"] = s.inMaintenance()
+	daemon["safeMode"] = s.inSafeMode()
+	if t := s.currentBlockTemplate(); t != nil {
+		daemon["templateHeight"] = t.Height
+	}
+	if len(s.upstreams) > 0 {
+		daemon["upstream"] = s.rpc().Name
+		var upstreams []map[string]interface{}
+		for _, upstream := range s.upstreams {
+			status := map[string]interface{}{
+				"name":    upstream.Name,
+				"sick":    upstream.Sick(),
+				"latency": time.Duration(atomic.LoadInt64(&upstream.LastLatency)).Seconds(),
+			}
+			if info := upstream.Info(); info != nil {
+				status["height"] = info.Height
+				status["topoheight"] = info.Topoheight
+				status["status"] = info.Status
+			}
+			upstreams = append(upstreams, status)
+		}
+		daemon["upstreams"] = upstreams
+	}
+	reply["daemon"] = daemon
+
+	// Unlocked wallet balance against the liabilities [pending balances], locked funds can not pay them yet
+	var liabilities uint64
+	pendingPayments := Storage_backend.GetPendingPayments()
+	for _, pending := range pendingPayments {
+		liabilities += pending.Amount
+	}
+	wallet := make(map[string]interface{})
+	wallet["liabilities"] = liabilities
+	if s.payouts != nil {
+		if health := s.payouts.walletHealth(); health != nil {
+			wallet["health"] = health
+			wallet["surplus"] = int64(health.UnlockedBalance) - int64(liabilities)
+		}
+	}
+	reply["wallet"] = wallet
+
+	// Payment queue depth
+	intentCounts := make(map[string]int)
+	for _, intent := range sortedPaymentIntents() {
+		if intent.open() {
+			intentCounts[intent.Status]++
+		}
+	}
+	reply["payments"] = map[string]interface{}{
+		"pending":       len(pendingPayments),
+		"pendingAmount": liabilities,
+		"intents":       intentCounts,
+	}
+
+	// Last block found and effort, top miners by hashrate
+	if stats != nil {
+		var lastFound *ApiBlocks
+		for _, key := range []string{"candidates", "immature", "matured"} {
+			blocks, _ := stats[key].([]*ApiBlocks)
+			for _, block := range blocks {
+				if lastFound == nil || block.Height > lastFound.Height {
+					lastFound = block
+				}
+			}
+		}
+		if lastFound != nil {
+			reply["lastBlockFound"] = lastFound
+		}
+		reply["networkBlock"] = stats["lastblock"]
+		reply["poolHashrate"] = stats["poolHashrate"]
+		reply["currentEffort"] = stats["currentEffort"]
+		reply["averageEffort"] = stats["averageEffort"]
+		reply["effortBlocks"] = stats["effortBlocks"]
+
+		miners, _ := stats["miners"].([]*ApiMiner)
+		top := make([]*ApiMiner, len(miners))
+		copy(top, miners)
+		sort.SliceStable(top, func(i, j int) bool { return top[i].Hashrate > top[j].Hashrate })
+		if len(top) > overviewTopMiners {
+			top = top[:overviewTopMiners]
+		}
+		reply["topMiners"] = top
+	}
+
+	// Bans and error rates
+	if s.banning != nil {
+		reply["bans"] = len(s.banning.list())
+	}
+	valid := atomic.LoadInt64(&s.shareMetrics.Valid)
+	invalid := atomic.LoadInt64(&s.shareMetrics.Invalid)
+	stale := atomic.LoadInt64(&s.shareMetrics.Stale)
+	lowDiff := atomic.LoadInt64(&s.shareMetrics.LowDiff)
+	percent := func(count int64) float64 {
+		if total := valid + invalid + stale + lowDiff; total > 0 {
+			return float64(count) / float64(total) * 100
+		}
+		return 0
+	}
+	reply["errors"] = map[string]interface{}{
+		"shares":            valid + invalid + stale + lowDiff,
+		"invalidPercent":    percent(invalid),
+		"stalePercent":      percent(stale),
+		"lowDiffPercent":    percent(lowDiff),
+		"blocksRejected":    atomic.LoadInt64(&s.shareMetrics.BlocksRejected),
+		"templateRejects":   s.templateChecks.rejects(),
+		"rejectAlarms":      s.rejectAlarms.active(),
+		"oversizedMessages": atomic.LoadInt64(&s.oversizedMessages),
+		"rateLimited":       atomic.LoadInt64(&s.rateLimited),
+	}
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// GET returns the active bans, POST with ?target=<ip|cidr>&duration=<duration>&reason=<reason> bans the target [no duration bans it until removed] and DELETE with ?target=<ip|cidr> removes the ban
+func (apiServer *ApiServer) AdminBansIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	banning := apiServer.stratum.banning
+	if banning == nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reply := make(map[string]interface{})
+	target := r.URL.Query().Get("target")
+	switch r.Method {
+	case "POST":
+		var duration time.Duration
+		if d := r.URL.Query().Get("duration"); d != "" {
+			parsed, err := time.ParseDuration(d)
+			if err != nil || parsed < 0 {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			duration = parsed
+		}
+		reason := r.URL.Query().Get("reason")
+		if reason == "" {
+			reason = "manual"
+		}
+		APIInfoLogger.Printf("[API] Admin request from %v to ban %v for %v: %v", r.RemoteAddr, target, duration, reason)
+		ban, err := banning.add(target, reason, duration, false)
+		if ban == nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			reply["error"] = err.Error()
+			break
+		}
+		if err != nil {
+			APIErrorLogger.Printf("[API] Error storing ban of %v: %v", target, err)
+		}
+		apiServer.stratum.closeBannedSessions()
+		writer.WriteHeader(http.StatusOK)
+		reply["ban"] = ban
+	case "DELETE":
+		APIInfoLogger.Printf("[API] Admin request from %v to remove ban of %v", r.RemoteAddr, target)
+		removed, err := banning.remove(target)
+		if err != nil && !removed {
+			writer.WriteHeader(http.StatusBadRequest)
+			reply["error"] = err.Error()
+			break
+		}
+		if err != nil {
+			APIErrorLogger.Printf("[API] Error storing bans after removing %v: %v", target, err)
+		}
+		writer.WriteHeader(http.StatusOK)
+		reply["removed"] = removed
+	default:
+		writer.WriteHeader(http.StatusOK)
+		bans := banning.list()
+		reply["bans"] = bans
+		reply["totalBans"] = len(bans)
+	}
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// GET returns the registered farms, POST with ?name=<name>&address=<address> registers the farm [address optional] and returns its token, DELETE with ?name=<name> removes the farm.
+// Registering a farm again issues a new token, both close the sessions of the farm
+func (apiServer *ApiServer) AdminFarmsIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	name := r.URL.Query().Get("name")
+	if apiServer.stratum.statsOnly || (r.Method != "GET" && name == "") {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reply := make(map[string]interface{})
+	switch r.Method {
+	case "POST":
+		address := r.URL.Query().Get("address")
+		APIInfoLogger.Printf("[API] Admin request from %v to register farm %v, address: %v", r.RemoteAddr, name, address)
+		farm, token, err := apiServer.stratum.registerFarm(name, address)
+		if farm == nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			reply["error"] = err.Error()
+			break
+		}
+		if err != nil {
+			APIErrorLogger.Printf("[API] Error storing farm %v: %v", name, err)
+		}
+		writer.WriteHeader(http.StatusOK)
+		reply["farm"] = farm.Name
+		reply["address"] = farm.Address
+		reply["token"] = token
+	case "DELETE":
+		APIInfoLogger.Printf("[API] Admin request from %v to remove farm %v", r.RemoteAddr, name)
+		removed, err := apiServer.stratum.removeFarm(name)
+		if err != nil {
+			APIErrorLogger.Printf("[API] Error storing farms after removing %v: %v", name, err)
+		}
+		writer.WriteHeader(http.StatusOK)
+		reply["removed"] = removed
+	default:
+		writer.WriteHeader(http.StatusOK)
+		farms, sessions := apiServer.stratum.listFarms()
+		reply["farms"] = farms
+		reply["sessions"] = sessions
+		reply["totalFarms"] = len(farms)
+	}
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// GET lists the blacklist and whitelist, POST/DELETE with ?list=blacklist|whitelist&address=<address> adds or removes the address in the file of the list
+func (apiServer *ApiServer) AdminAddressesIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	list := r.URL.Query().Get("list")
+	address := r.URL.Query().Get("address")
+	if apiServer.stratum.statsOnly || (r.Method != "GET" && (list == "" || address == "")) {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reply := make(map[string]interface{})
+	switch r.Method {
+	case "POST", "DELETE":
+		add := r.Method == "POST"
+		if err := util.CheckAddress(address, apiServer.stratum.currentConfig().Address); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			reply["error"] = err.Error()
+			break
+		}
+		APIInfoLogger.Printf("[API] Admin request from %v to update %v %v, add: %v", r.RemoteAddr, list, address, add)
+		updated, err := apiServer.stratum.updateAddressList(list, address, add)
+		if err != nil {
+			APIErrorLogger.Printf("[API] Error updating %v %v: %v", list, address, err)
+			writer.WriteHeader(http.StatusBadRequest)
+			reply["error"] = err.Error()
+			break
+		}
+		writer.WriteHeader(http.StatusOK)
+		reply["updated"] = updated
+	default:
+		writer.WriteHeader(http.StatusOK)
+		blacklist, whitelist, whitelistOnly := apiServer.stratum.addressLists.list()
+		reply["blacklist"] = blacklist
+		reply["whitelist"] = whitelist
+		reply["whitelistOnly"] = whitelistOnly
+	}
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// GET returns difficulty overrides [?id=<minerid> for a single miner], POST with ?id=<minerid>&diff=<difficulty> sets the override for the miner. diff=0 clears it
+func (apiServer *ApiServer) AdminDifficultyIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	id := r.URL.Query().Get("id")
+	if r.Method == "POST" {
+		diff, err := strconv.ParseInt(r.URL.Query().Get("diff"), 10, 64)
+		if id == "" || err != nil || diff < 0 || apiServer.stratum.statsOnly {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		APIInfoLogger.Printf("[API] Admin request from %v to set difficulty override for %v: %v", r.RemoteAddr, id, diff)
+		err = apiServer.stratum.setDiffOverride(id, diff)
+		if err != nil {
+			APIErrorLogger.Printf("[API] Error storing difficulty override for %v: %v", id, err)
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	writer.WriteHeader(http.StatusOK)
+
+	reply := make(map[string]interface{})
+	apiServer.stratum.diffOverridesMu.RLock()
+	if id != "" {
+		reply["id"] = id
+		reply["diff"] = apiServer.stratum.diffOverrides[id]
+	} else {
+		overrides := make(map[string]int64)
+		for k, v := range apiServer.stratum.diffOverrides {
+			overrides[k] = v
+		}
+		reply["overrides"] = overrides
+	}
+	apiServer.stratum.diffOverridesMu.RUnlock()
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// GET with ?address=<login> returns the pending balance of the login, POST with ?address=<login>&amount=<amount> adds amount [negative to debit] to it. Amounts are in atomic units, i.e.: 1 DERO = 1000000000000
+func (apiServer *ApiServer) AdminBalancesIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	address := r.URL.Query().Get("address")
+	if address == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reply := make(map[string]interface{})
+	reply["address"] = address
+	if r.Method == "POST" {
+		amount, err := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 64)
+		if err != nil || amount == 0 || apiServer.stratum.statsOnly {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		APIInfoLogger.Printf("[API] Admin request from %v to adjust balance of %v by %v", r.RemoteAddr, address, amount)
+		balance, err := apiServer.stratum.adjustBalance(address, amount)
+		if err != nil {
+			APIErrorLogger.Printf("[API] Error adjusting balance of %v: %v", address, err)
+			writer.WriteHeader(http.StatusBadRequest)
+			reply["error"] = err.Error()
+		} else {
+			writer.WriteHeader(http.StatusOK)
+		}
+		reply["balance"] = balance
+	} else {
+		writer.WriteHeader(http.StatusOK)
+		var balance uint64
+		for _, p := range Storage_backend.GetPendingPayments() {
+			if p.Address == address {
+				balance = p.Amount
+				break
+			}
+		}
+		reply["balance"] = balance
+	}
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// POST starts a payout run now rather than at the next payments interval, a run already in progress finishes first. GET lists the payment intents, POST with intent resolves one
+func (apiServer *ApiServer) AdminPaymentsIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	if r.Method != "GET" && r.Method != "POST" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	payouts := apiServer.stratum.payouts
+	if payouts == nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reply := make(map[string]interface{})
+	status := http.StatusOK
+	switch key := r.URL.Query().Get("intent"); {
+	case r.Method == "GET":
+		reply["intents"] = sortedPaymentIntents()
+	case key != "":
+		action := r.URL.Query().Get("action")
+		APIInfoLogger.Printf("[API] Admin request from %v to %v payment intent %v", r.RemoteAddr, action, key)
+		intent, err := payouts.resolveIntent(key, action, r.URL.Query().Get("txid"))
+		if err != nil {
+			status = http.StatusBadRequest
+			reply["error"] = err.Error()
+		}
+		if intent != nil {
+			reply["intent"] = intent
+		}
+	default:
+		APIInfoLogger.Printf("[API] Admin request from %v to run payments", r.RemoteAddr)
+		go payouts.process(apiServer.stratum)
+		reply["started"] = true
+	}
+	writer.WriteHeader(status)
+
+	reply["dryRun"] = payouts.currentConfig().DryRun
+	if health := payouts.walletHealth(); health != nil {
+		reply["walletHealth"] = health
+	}
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// POST re-checks the upstreams and fetches a new block template, broadcasting it to the miners if it changed
+func (apiServer *ApiServer) AdminTemplateIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	if r.Method != "POST" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if apiServer.stratum.statsOnly {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	APIInfoLogger.Printf("[API] Admin request from %v to refresh the block template", r.RemoteAddr)
+	apiServer.stratum.checkUpstreams()
+	refreshed := apiServer.stratum.fetchBlockTemplate(false)
+	writer.WriteHeader(http.StatusOK)
+
+	reply := make(map[string]interface{})
+	reply["refreshed"] = refreshed
+	reply["upstream"] = apiServer.stratum.rpc().Name
+	if t := apiServer.stratum.currentBlockTemplate(); t != nil {
+		reply["height"] = t.Height
+		reply["difficulty"] = t.Difficulty
+	}
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+type AdminSession struct {
+	Id            string
+	Address       string
+	WorkID        string
+	IP            string
+	Port          int
+	TrustedShares int64
+}
+
+// GET returns the connected sessions, DELETE closes them. Both can be filtered with ?id=<minerid> or ?ip=<ip>, DELETE requires one of them.
+// DELETE with &ban=<duration> also bans the ips of the closed sessions [ban=0 until removed]
+func (apiServer *ApiServer) AdminSessionsIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	id := r.URL.Query().Get("id")
+	ip := r.URL.Query().Get("ip")
+	banParam := r.URL.Query().Get("ban")
+	var banDuration time.Duration
+	if r.Method == "DELETE" {
+		if id == "" && ip == "" {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if banParam != "" {
+			parsed, err := time.ParseDuration(banParam)
+			if err != nil || parsed < 0 || apiServer.stratum.banning == nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			banDuration = parsed
+		}
+	}
+
+	var matched []*Session
+	apiServer.stratum.sessions.Range(func(cs *Session) {
+		if cs.miner == nil || (id != "" && cs.miner.Id != id) || (ip != "" && cs.ip != ip) {
+			return
+		}
+		matched = append(matched, cs)
+	})
+
+	sessions := make([]*AdminSession, 0, len(matched))
+	for _, cs := range matched {
+		sessions = append(sessions, &AdminSession{Id: cs.miner.Id, Address: cs.miner.Address, WorkID: cs.miner.WorkID, IP: cs.ip, Port: cs.endpoint.config.Port, TrustedShares: atomic.LoadInt64(&cs.trustedShares)})
+	}
+
+	reply := make(map[string]interface{})
+	if r.Method == "DELETE" {
+		APIInfoLogger.Printf("[API] Admin request from %v to close %v sessions of id '%v' ip '%v', ban: '%v'", r.RemoteAddr, len(matched), id, ip, banParam)
+		if banParam != "" {
+			banned := make(map[string]bool)
+			for _, cs := range matched {
+				if banned[cs.ip] {
+					continue
+				}
+				banned[cs.ip] = true
+				if _, err := apiServer.stratum.banning.add(cs.ip, "kicked by admin", banDuration, false); err != nil {
+					APIErrorLogger.Printf("[API] Error storing ban of %v: %v", cs.ip, err)
+				}
+			}
+		}
+		for _, cs := range matched {
+			cs.conn.Close()
+		}
+		reply["closed"] = len(matched)
+	}
+	writer.WriteHeader(http.StatusOK)
+	reply["sessions"] = sessions
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// POST with ?amount=<atomic units>&txid=<txid> credits a payout the upstream pool sent to the proxy login to the local miners, split over the shares of the current
+// round. Proxy mode only
+func (apiServer *ApiServer) AdminProxyIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	proxy := apiServer.stratum.proxy
+	if proxy == nil || apiServer.stratum.statsOnly {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reply := make(map[string]interface{})
+	status := http.StatusOK
+	switch r.Method {
+	case "GET":
+	case "POST":
+		amount, err := strconv.ParseUint(r.URL.Query().Get("amount"), 10, 64)
+		txid := r.URL.Query().Get("txid")
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		APIInfoLogger.Printf("[API] Admin request from %v to credit upstream payout %v of %v", r.RemoteAddr, txid, amount)
+		rewards, err := proxy.creditPayout(apiServer.stratum, amount, txid)
+		if err != nil {
+			status = http.StatusBadRequest
+			reply["error"] = err.Error()
+		} else {
+			reply["rewards"] = rewards
+		}
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writer.WriteHeader(status)
+
+	reply["proxy"] = proxy.status(apiServer.stratum)
+	if round := Storage_backend.GetPoolRoundStats(); round != nil {
+		var shares int64
+		for _, n := range round.RoundShares {
+			shares += n
+		}
+		reply["roundShares"] = shares
+	}
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// GET returns the raw shares of the current round, or with ?height=<height> the stored round shares [and PPLNS window, if any] of the block found at height
+func (apiServer *ApiServer) AdminRoundsIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	reply := make(map[string]interface{})
+	if h := r.URL.Query().Get("height"); h != "" {
+		height, err := strconv.ParseInt(h, 10, 64)
+		if err != nil || height <= 0 {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		roundShares, totalShares, _ := Storage_backend.GetRoundShares(height)
+		reply["height"] = height
+		reply["roundShares"] = roundShares
+		reply["totalRoundShares"] = totalShares
+		if pplnsShares, pplnsTotal, ok := Storage_backend.GetPPLNSRoundShares(height); ok {
+			reply["pplnsShares"] = pplnsShares
+			reply["totalPPLNSShares"] = pplnsTotal
+		}
+	} else {
+		round := Storage_backend.GetPoolRoundStats()
+		if round == nil {
+			round = &PoolRound{}
+		}
+		var totalShares int64
+		for _, v := range round.RoundShares {
+			totalShares += v
+		}
+		reply["startTimestamp"] = round.StartTimestamp
+		reply["timestamp"] = round.Timestamp
+		reply["lastBlockHeight"] = round.LastBlockHeight
+		reply["roundShares"] = round.RoundShares
+		reply["totalRoundShares"] = totalShares
+	}
+	writer.WriteHeader(http.StatusOK)
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+func (apiServer *ApiServer) getStats() map[string]interface{} {
+	stats := apiServer.stats.Load()
+	if stats != nil {
+		return stats.(map[string]interface{})
+	}
+	return nil
+}
+
+func logFileOutAPI(lType string) *util.Logger {
+	logFileName := util.LogFileName("api", lType)
 	os.Mkdir("logs", 0705)
 	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0705)
 	if err != nil {
@@ -921,5 +3022,5 @@ func logFileOutAPI(lType string) *log.Logger {
 
 	logType := lType + ": "
 	l := log.New(f, logType, log.LstdFlags|log.Lmicroseconds)
-	return l
+	return util.NewLogger("api", lType, l)
 }
@@ -0,0 +1,137 @@
+package stratum
+
+import (
+	"compress/gzip"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// Wraps the api routers so a frontend hosted elsewhere can use the api directly: sets the CORS headers for the corsOrigins, answers CORS preflight requests
+// and, with gzip enabled, compresses responses for clients accepting it. Live stats websocket upgrades are passed through untouched
+func (apiServer *ApiServer) httpHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if origin := corsOrigin(apiServer.config.CorsOrigins, r.Header.Get("Origin")); origin != "" {
+			writer.Header().Set("Access-Control-Allow-Origin", origin)
+			writer.Header().Set("Access-Control-Expose-Headers", "ETag")
+			if origin != "*" {
+				writer.Header().Add("Vary", "Origin")
+			}
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, If-None-Match, X-Admin-Token, X-Admin-Signature, X-Admin-Timestamp, X-Admin-Nonce")
+			writer.Header().Set("Access-Control-Max-Age", "600")
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if !apiServer.config.Gzip || websocket.IsWebSocketUpgrade(r) || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			router.ServeHTTP(writer, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: writer}
+		defer gw.close()
+		router.ServeHTTP(gw, r)
+	})
+}
+
+// Returns the Access-Control-Allow-Origin for a request from origin, "*" if no origins are configured or they include "*", "" if origin is not allowed
+func corsOrigin(origins []string, origin string) string {
+	if len(origins) == 0 {
+		return "*"
+	}
+	for _, allowed := range origins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// Compresses the body written by the handler. Bodiless responses [204, 304] are passed through as is
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.Header().Add("Vary", "Accept-Encoding")
+	if status != http.StatusNoContent && status != http.StatusNotModified {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+func (w *gzipResponseWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+		gzipWriters.Put(w.gz)
+	}
+}
+
+// Serves the handler with a weak ETag of the stats collection its response is built from and the request uri, answering If-None-Match with 304 Not Modified
+// until the next collection. Only for handlers replying from the collected stats, with etags enabled
+func (apiServer *ApiServer) etag(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		generation := atomic.LoadUint64(&apiServer.statsGeneration)
+		if !apiServer.config.ETags || r.Method != http.MethodGet || generation == 0 {
+			handler(writer, r)
+			return
+		}
+
+		h := fnv.New64a()
+		h.Write([]byte(r.URL.RequestURI()))
+		tag := fmt.Sprintf("W/\"%d-%x\"", generation, h.Sum64())
+		writer.Header().Set("ETag", tag)
+		if etagMatches(r.Header.Get("If-None-Match"), tag) {
+			writer.WriteHeader(http.StatusNotModified)
+			return
+		}
+		handler(writer, r)
+	}
+}
+
+// Returns whether the If-None-Match header lists tag or is "*", compared weakly
+func etagMatches(header, tag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,331 @@
+package stratum
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// A banned ip or subnet [cidr]. Until 0 never expires, only manual bans can be permanent
+type Ban struct {
+	Target string
+	Reason string
+	Auto   bool
+	Since  int64
+	Until  int64
+}
+
+// Valid/invalid shares of an ip within the current check window
+type ipShareStats struct {
+	valid       int64
+	invalid     int64
+	windowStart int64
+}
+
+type BanList struct {
+	config      *pool.BanningConfig
+	checkWindow int64
+	banDuration time.Duration
+	mu          sync.RWMutex
+	bans        map[string]*Ban
+	subnets     map[string]*net.IPNet
+	shares      map[string]*ipShareStats
+}
+
+// Returns the check window and ban duration of cfg, defaulting to 10m and 1h
+func banningDurations(cfg *pool.BanningConfig) (time.Duration, time.Duration) {
+	checkWindow, err := time.ParseDuration(cfg.CheckWindow)
+	if err != nil || checkWindow <= 0 {
+		checkWindow = 10 * time.Minute
+	}
+	banDuration, err := time.ParseDuration(cfg.BanDuration)
+	if err != nil || banDuration <= 0 {
+		banDuration = time.Hour
+	}
+	return checkWindow, banDuration
+}
+
+func NewBanList(cfg *pool.BanningConfig) *BanList {
+	checkWindow, banDuration := banningDurations(cfg)
+
+	b := &BanList{
+		config:      cfg,
+		checkWindow: int64(checkWindow / time.Second),
+		banDuration: banDuration,
+		bans:        make(map[string]*Ban),
+		subnets:     make(map[string]*net.IPNet),
+		shares:      make(map[string]*ipShareStats),
+	}
+
+	for _, ban := range Graviton_backend.GetBans() {
+		if _, network, err := parseBanTarget(ban.Target); err == nil {
+			b.bans[ban.Target] = ban
+			if network != nil {
+				b.subnets[ban.Target] = network
+			}
+		}
+	}
+
+	StratumInfoLogger.Printf("[Banning] Banning ips over %v%% invalid shares of at least %v shares within %v for %v, subnet: %v. %v stored bans", cfg.InvalidPercent, cfg.MinShares, checkWindow, banDuration, cfg.BanSubnet, len(b.bans))
+
+	// Windows of ips that stopped submitting would otherwise accumulate, they are dropped once per check window
+	timer := time.NewTimer(checkWindow)
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				timer.Reset(b.pruneShares())
+			}
+		}
+	}()
+	return b
+}
+
+// Drops the share windows that ran out, returns the check window to prune again after
+func (b *BanList) pruneShares() time.Duration {
+	now := util.MakeTimestamp() / 1000
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ip, stats := range b.shares {
+		if now-stats.windowStart >= b.checkWindow {
+			delete(b.shares, ip)
+		}
+	}
+	return time.Duration(b.checkWindow) * time.Second
+}
+
+// Applies the thresholds of a reloaded config [checkWindow, minShares, invalidPercent, banDuration, banSubnet]. Share windows already running keep counting
+func (b *BanList) reload(cfg *pool.BanningConfig) {
+	if b == nil {
+		return
+	}
+	checkWindow, banDuration := banningDurations(cfg)
+
+	b.mu.Lock()
+	b.config = cfg
+	b.checkWindow = int64(checkWindow / time.Second)
+	b.banDuration = banDuration
+	b.mu.Unlock()
+
+	StratumInfoLogger.Printf("[Banning] Reloaded, banning ips over %v%% invalid shares of at least %v shares within %v for %v, subnet: %v", cfg.InvalidPercent, cfg.MinShares, checkWindow, banDuration, cfg.BanSubnet)
+}
+
+// Returns the duration of automatic bans
+func (b *BanList) duration() time.Duration {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.banDuration
+}
+
+// Normalizes an ip or cidr ban target, returning the network for cidr targets [nil for single ips]
+func parseBanTarget(target string) (string, *net.IPNet, error) {
+	target = strings.TrimSpace(target)
+	if strings.Contains(target, "/") {
+		_, network, err := net.ParseCIDR(target)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid cidr %q", target)
+		}
+		return network.String(), network, nil
+	}
+	ip := net.ParseIP(target)
+	if ip == nil {
+		return "", nil, fmt.Errorf("invalid ip %q", target)
+	}
+	return ip.String(), nil, nil
+}
+
+// Returns the /24 [IPv4] or /64 [IPv6] of ip, banned along with it when banSubnet is set
+func banSubnetOf(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// Returns the ban matching ip, if any. Expired bans are not matched and are removed on the next store
+func (b *BanList) isBanned(ip string) (*Ban, bool) {
+	if b == nil {
+		return nil, false
+	}
+	now := util.MakeTimestamp() / 1000
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if ban, ok := b.bans[ip]; ok && (ban.Until == 0 || ban.Until > now) {
+		return ban, true
+	}
+	if len(b.subnets) == 0 {
+		return nil, false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, false
+	}
+	for target, network := range b.subnets {
+		ban := b.bans[target]
+		if network.Contains(parsed) && (ban.Until == 0 || ban.Until > now) {
+			return ban, true
+		}
+	}
+	return nil, false
+}
+
+// Counts a share of the session ip towards its check window, banning the ip [and its subnet with banSubnet] once minShares were submitted within the window and more than invalidPercent were invalid.
+// Shares of farm sessions are not counted
+func (b *BanList) recordShare(s *StratumServer, cs *Session, valid bool) {
+	if b == nil || cs.farm != "" {
+		return
+	}
+	ip := cs.ip
+	now := util.MakeTimestamp() / 1000
+
+	b.mu.Lock()
+	// Thresholds are read under the lock, as a reload swaps them
+	cfg, checkWindow, banDuration := b.config, b.checkWindow, b.banDuration
+	stats, ok := b.shares[ip]
+	if !ok || now-stats.windowStart >= checkWindow {
+		stats = &ipShareStats{windowStart: now}
+		b.shares[ip] = stats
+	}
+	if valid {
+		stats.valid++
+	} else {
+		stats.invalid++
+	}
+	total := stats.valid + stats.invalid
+	exceeded := total >= cfg.MinShares && float64(stats.invalid)*100/float64(total) > cfg.InvalidPercent && stats.invalid > 0
+	if exceeded {
+		delete(b.shares, ip)
+	}
+	b.mu.Unlock()
+
+	if !exceeded {
+		return
+	}
+
+	reason := fmt.Sprintf("%v of %v shares invalid within %vs", stats.invalid, total, checkWindow)
+	target := ip
+	if cfg.BanSubnet {
+		if subnet := banSubnetOf(ip); subnet != "" {
+			target = subnet
+		}
+	}
+	StratumErrorLogger.Printf("[Banning] Banning %s for %v: %s", target, banDuration, reason)
+	if _, err := b.add(target, reason, banDuration, true); err != nil {
+		StratumErrorLogger.Printf("[Banning] Err storing ban of %s: %v", target, err)
+	}
+	s.closeBannedSessions()
+}
+
+// Bans target [ip or cidr] for duration, 0 bans it until removed
+func (b *BanList) add(target, reason string, duration time.Duration, auto bool) (*Ban, error) {
+	target, network, err := parseBanTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	now := util.MakeTimestamp() / 1000
+	ban := &Ban{Target: target, Reason: reason, Auto: auto, Since: now}
+	if duration > 0 {
+		ban.Until = now + int64(duration/time.Second)
+	}
+
+	b.mu.Lock()
+	b.bans[target] = ban
+	if network != nil {
+		b.subnets[target] = network
+	}
+	b.mu.Unlock()
+
+	return ban, b.store()
+}
+
+// Removes the ban of target, returns false if it was not banned
+func (b *BanList) remove(target string) (bool, error) {
+	target, _, err := parseBanTarget(target)
+	if err != nil {
+		return false, err
+	}
+
+	b.mu.Lock()
+	_, ok := b.bans[target]
+	delete(b.bans, target)
+	delete(b.subnets, target)
+	b.mu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, b.store()
+}
+
+// Returns the active bans, newest first
+func (b *BanList) list() []*Ban {
+	now := util.MakeTimestamp() / 1000
+
+	b.mu.RLock()
+	bans := make([]*Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		if ban.Until == 0 || ban.Until > now {
+			bans = append(bans, ban)
+		}
+	}
+	b.mu.RUnlock()
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Since > bans[j].Since
+	})
+	return bans
+}
+
+// Stores the active bans, dropping expired ones
+func (b *BanList) store() error {
+	now := util.MakeTimestamp() / 1000
+
+	b.mu.Lock()
+	bans := make(map[string]*Ban)
+	for target, ban := range b.bans {
+		if ban.Until != 0 && ban.Until <= now {
+			delete(b.bans, target)
+			delete(b.subnets, target)
+			continue
+		}
+		bans[target] = ban
+	}
+	b.mu.Unlock()
+
+	writeWait, _ := time.ParseDuration("10ms")
+	for Graviton_backend.Writing == 1 {
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	err := Graviton_backend.OverwriteBans(bans)
+	Graviton_backend.Writing = 0
+	return err
+}
+
+// Closes the sessions of banned ips, so a ban also ends the connections it was triggered by
+func (s *StratumServer) closeBannedSessions() {
+	var banned []*Session
+	s.sessions.Range(func(cs *Session) {
+		if _, ok := s.banning.isBanned(cs.ip); ok {
+			banned = append(banned, cs)
+		}
+	})
+
+	for _, cs := range banned {
+		StratumInfoLogger.Printf("[Banning] Closing session of banned ip %s", cs.ip)
+		cs.conn.Close()
+	}
+}
@@ -1,11 +1,15 @@
 package stratum
 
 import (
-	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/util"
 )
 
 type BlockTemplate struct {
@@ -16,47 +20,176 @@ type BlockTemplate struct {
 	Height             uint64
 	Prev_Hash          string
 	Reserved_Offset    uint64
+	ReserveSize        int
 	Epoch              uint64
 	Status             string
+	Algo               string
 	Buffer             []byte
+	jobCache           *jobCache
+	// Sequence of the template, incremented for every new template. Upstream jobs of the same height in proxy mode keep the sequence
+	seq uint64
+	// Job id of the upstream pool the template was made from in proxy mode, "" for daemon templates
+	upstreamJobId string
+	// Job slots of the reserved space handed out for the template, see nextJobSlot
+	jobSlots uint32
+}
+
+// Per-template cache of the portions of a job shared between sessions, so getJob only splices in the session extranonce. Each template gets its own cache, so a template swapping mid-build never mixes the two
+type jobCache struct {
+	sync.RWMutex
+	blob    string
+	targets map[int64]string
+}
+
+// Layout of the template reserved space. The pool part identifies each job: the extranonce of its connection [unique among the connections of the pool],
+// the instance id of the pool process and the slot of the job in the template. Ports with extraNonceSize leave that many bytes after it to the connection
+const (
+	reservedExtraNonceSize  = 4
+	reservedInstanceSize    = 3
+	reservedJobSize         = 3
+	reservedPoolSize        = reservedExtraNonceSize + reservedInstanceSize + reservedJobSize
+	maxClientExtraNonceSize = 8
+)
+
+// Returns the reserved space requested with block templates, the pool part and the largest extraNonceSize of the ports
+func (s *StratumServer) reserveSize() int {
+	size := 0
+	for _, port := range s.currentConfig().Stratum.Ports {
+		if clientSize := clampExtraNonceSize(port.ExtraNonceSize); clientSize > size {
+			size = clientSize
+		}
+	}
+	return reservedPoolSize + size
+}
+
+func clampExtraNonceSize(size int) int {
+	if size < 0 {
+		return 0
+	}
+	if size > maxClientExtraNonceSize {
+		return maxClientExtraNonceSize
+	}
+	return size
+}
+
+// Returns the bytes of the reserved space of t left to connections of the port, at most what the template was requested with
+func (e *Endpoint) extraNonceSize(t *BlockTemplate) int {
+	// In proxy mode the reserved space is the part the upstream pool leaves to the proxy, none of it is left to connections
+	if t != nil && t.upstreamJobId != "" {
+		return 0
+	}
+	size := clampExtraNonceSize(e.config.ExtraNonceSize)
+	if t != nil && t.ReserveSize > 0 && size > t.ReserveSize-reservedPoolSize {
+		size = t.ReserveSize - reservedPoolSize
+	}
+	return size
+}
+
+// Returns the slot of the next job of the template in the reserved space. The reserved space of each template is partitioned in slots handed out in order,
+// 0 to the first job of the template, 1 to the next and so on, so a broadcast gives each session its own slot. The first 2^24 jobs of a template
+// [reservedJobSize] have distinct slots, so sessions never receive identical work of a template even if their extranonces collided [wrapped extranonce,
+// instance id shared with another pool process]
+func (t *BlockTemplate) nextJobSlot() uint32 {
+	return atomic.AddUint32(&t.jobSlots, 1) - 1
+}
+
+// Returns the pool part of the reserved space of a job of the connection with extraNonce
+func (s *StratumServer) reservedBytes(extraNonce, jobSlot uint32) []byte {
+	reserved := make([]byte, reservedPoolSize)
+	binary.BigEndian.PutUint32(reserved, extraNonce)
+	copy(reserved[reservedExtraNonceSize:], s.instanceId)
+	var job [4]byte
+	binary.BigEndian.PutUint32(job[:], jobSlot)
+	copy(reserved[reservedExtraNonceSize+reservedInstanceSize:], job[4-reservedJobSize:])
+	return reserved
 }
 
 var BlocksInfoLogger = logFileOutBlocks("INFO")
 var BlocksErrorLogger = logFileOutBlocks("ERROR")
 
-func (b *BlockTemplate) nextBlob(extraNonce uint32, instanceID []byte) string {
-	extraBuff := new(bytes.Buffer)
-	binary.Write(extraBuff, binary.BigEndian, extraNonce)
-
+func (b *BlockTemplate) nextBlob(reserved []byte) string {
 	blobBuff := make([]byte, len(b.Buffer))
 	copy(blobBuff, b.Buffer)
-	copy(blobBuff[b.Reserved_Offset+4:b.Reserved_Offset+7], instanceID)
-	copy(blobBuff[b.Reserved_Offset:], extraBuff.Bytes())
-	blob := blobBuff
-	return hex.EncodeToString(blob)
+	copy(blobBuff[b.Reserved_Offset:], reserved)
+	return hex.EncodeToString(blobBuff)
+}
+
+// Returns the same blob as nextBlob, reusing the hex encoded template blob from the job cache if enabled
+func (b *BlockTemplate) cachedBlob(reserved []byte) string {
+	c := b.jobCache
+	if c == nil {
+		return b.nextBlob(reserved)
+	}
+
+	c.RLock()
+	base := c.blob
+	c.RUnlock()
+	if base == "" {
+		base = hex.EncodeToString(b.Buffer)
+
+		c.Lock()
+		c.blob = base
+		c.Unlock()
+	}
+
+	offset := int(b.Reserved_Offset) * 2
+	return base[:offset] + hex.EncodeToString(reserved) + base[offset+len(reserved)*2:]
 }
 
-func (s *StratumServer) fetchBlockTemplate() bool {
+// Returns the target hex of a difficulty, reusing it from the job cache if enabled
+func (b *BlockTemplate) cachedTarget(diff int64, encoding string) string {
+	c := b.jobCache
+	if c == nil {
+		return util.GetTargetHexEncoded(diff, encoding)
+	}
+
+	c.RLock()
+	targetHex, ok := c.targets[diff]
+	c.RUnlock()
+	if !ok {
+		targetHex = util.GetTargetHexEncoded(diff, encoding)
+
+		c.Lock()
+		c.targets[diff] = targetHex
+		c.Unlock()
+	}
+	return targetHex
+}
+
+// Fetches the block template and stores it if it is new, returns whether it was. Templates failing validateTemplate are not stored, relaxed is passed on to it
+func (s *StratumServer) fetchBlockTemplate(relaxed bool) bool {
+	// In proxy mode templates are the jobs pushed by the upstream pool, see setProxyJob
+	if s.proxy != nil {
+		return false
+	}
 	r := s.rpc()
-	reply, err := r.GetBlockTemplate(10, s.config.Address)
+	reserveSize := s.reserveSize()
+	reply, err := r.GetBlockTemplate(reserveSize, s.currentConfig().Address)
+	if err != nil {
+		if next, ok := s.failover(r, err); ok {
+			r = next
+			reply, err = r.GetBlockTemplate(reserveSize, s.currentConfig().Address)
+		}
+	}
 	if err != nil {
-		log.Printf("[Blocks] Error while refreshing block template: %s", err)
 		BlocksErrorLogger.Printf("[Blocks] Error while refreshing block template: %s", err)
 		return false
 	}
 
 	t := s.currentBlockTemplate()
 
-	if t != nil && t.Prev_Hash == reply.Prev_Hash {
-		// Fallback to height comparison
-		if len(reply.Prev_Hash) == 0 && reply.Height > t.Height {
-			log.Printf("[Blocks] New block to mine on %s at height %v, diff: %v", r.Name, reply.Height, reply.Difficulty)
-			BlocksInfoLogger.Printf("[Blocks] New block to mine on %s at height %v, diff: %v", r.Name, reply.Height, reply.Difficulty)
-		} else {
-			return false
-		}
+	// Fallback to height comparison
+	if t != nil && t.Prev_Hash == reply.Prev_Hash && !(len(reply.Prev_Hash) == 0 && reply.Height > t.Height) {
+		return false
+	}
+
+	buffer, err := s.validateTemplate(reply, t, reserveSize, relaxed)
+	if err != nil {
+		return false
+	}
+	if len(reply.Prev_Hash) == 0 {
+		BlocksInfoLogger.Printf("[Blocks] New block to mine on %s at height %v, diff: %v", r.Name, reply.Height, reply.Difficulty)
 	} else {
-		log.Printf("[Blocks] New block to mine on %s at height %v, diff: %v, prev_hash: %s", r.Name, reply.Height, reply.Difficulty, reply.Prev_Hash)
 		BlocksInfoLogger.Printf("[Blocks] New block to mine on %s at height %v, diff: %v, prev_hash: %s", r.Name, reply.Height, reply.Difficulty, reply.Prev_Hash)
 	}
 
@@ -68,21 +201,80 @@ func (s *StratumServer) fetchBlockTemplate() bool {
 		Height:             reply.Height,
 		Prev_Hash:          reply.Prev_Hash,
 		Reserved_Offset:    reply.Reserved_Offset,
+		ReserveSize:        reserveSize,
 		Epoch:              reply.Epoch,
 		Status:             reply.Status,
+		Algo:               s.algoForHeight(reply.Height),
+	}
+	newTemplate.Buffer = buffer
+	if s.currentConfig().Stratum.JobCache {
+		newTemplate.jobCache = &jobCache{targets: make(map[int64]string)}
+	}
+	if t != nil && t.Algo != newTemplate.Algo {
+		BlocksInfoLogger.Printf("[Blocks] Algorithm changed from %s to %s at height %v", t.Algo, newTemplate.Algo, reply.Height)
 	}
-	newTemplate.Buffer, _ = hex.DecodeString(reply.Blockhashing_blob)
+	if t != nil && newTemplate.Height > t.Height {
+		s.prevBlockTemplate.Store(t)
+	}
+	newTemplate.seq = atomic.AddUint64(&s.templateSeq, 1)
 	s.blockTemplate.Store(&newTemplate)
+	s.templateMoved(reply.Height)
 	return true
 }
 
-func logFileOutBlocks(lType string) *log.Logger {
-	var logFileName string
-	if lType == "ERROR" {
-		logFileName = "logs/blocksError.log"
-	} else {
-		logFileName = "logs/blocks.log"
+// Resets the block template watchdog on a new template, the pool is no longer sick if the daemon was stuck
+func (s *StratumServer) templateMoved(height uint64) {
+	atomic.StoreInt64(&s.templateUpdatedAt, time.Now().UnixNano())
+	if atomic.SwapInt32(&s.templateStuck, 0) == 1 {
+		BlocksInfoLogger.Printf("[Blocks] Block template is moving again at height %v, daemon is no longer stuck", height)
+	}
+}
+
+// Returns whether the block template height has not changed within blockTemplateMaxAge. Checked at most every blockTemplateMaxAge/4 so a stuck daemon is not hammered every refresh
+func (s *StratumServer) templateStalled() bool {
+	if s.templateMaxAge <= 0 {
+		return false
 	}
+	updatedAt := atomic.LoadInt64(&s.templateUpdatedAt)
+	if updatedAt == 0 {
+		return false
+	}
+	now := time.Now().UnixNano()
+	if now-updatedAt < int64(s.templateMaxAge) {
+		return false
+	}
+	checkAt := atomic.LoadInt64(&s.templateCheckAt)
+	if now < checkAt || !atomic.CompareAndSwapInt64(&s.templateCheckAt, checkAt, now+int64(s.templateMaxAge/4)) {
+		return false
+	}
+	return true
+}
+
+// Watchdog for a stalled template: re-checks the upstreams [switching to a healthy one if available] and refetches. If the template still has not moved, the daemon is confirmed stuck and the pool is marked sick until a new template arrives
+func (s *StratumServer) forceRefreshBlockTemplate() bool {
+	t := s.currentBlockTemplate()
+	age := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&s.templateUpdatedAt))
+	BlocksErrorLogger.Printf("[Blocks] Block template height %v has not changed in %v, forcing a refresh", t.Height, age.Round(time.Second))
+
+	s.checkUpstreams()
+	// A template stalled this long is replaced even at a lower height or another difficulty, e.g. from an upstream behind the one that stalled
+	if s.fetchBlockTemplate(true) {
+		return true
+	}
+
+	s.markTemplateStuck(s.rpc().Name, t.Height)
+	return false
+}
+
+// Marks the pool sick once a forced refresh confirmed the daemon stuck, until templateMoved
+func (s *StratumServer) markTemplateStuck(daemon string, height uint64) {
+	if atomic.CompareAndSwapInt32(&s.templateStuck, 0, 1) {
+		BlocksErrorLogger.Printf("[Blocks] Daemon %s is stuck at height %v, marking pool sick until a new block template is received", daemon, height)
+	}
+}
+
+func logFileOutBlocks(lType string) *util.Logger {
+	logFileName := util.LogFileName("blocks", lType)
 	os.Mkdir("logs", 0705)
 	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0705)
 	if err != nil {
@@ -91,5 +283,5 @@ func logFileOutBlocks(lType string) *log.Logger {
 
 	logType := lType + ": "
 	l := log.New(f, logType, log.LstdFlags|log.Lmicroseconds)
-	return l
+	return util.NewLogger("blocks", lType, l)
 }
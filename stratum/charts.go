@@ -3,6 +3,7 @@ package stratum
 import (
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"time"
 
@@ -19,6 +20,13 @@ type Charts struct {
 type ChartData struct {
 	Timestamp int64
 	Value     int64
+	Samples   int64 `json:",omitempty"` // Number of values averaged into a downsampled value
+}
+
+// Downsampled values of a chart, one per resolution seconds
+type ChartTier struct {
+	Resolution int64
+	Values     []*ChartData
 }
 
 var ChartsInfoLogger = logFileOutCharts("INFO")
@@ -30,7 +38,6 @@ func NewChartsProcessor(pcfg *pool.PoolChartsConfig, scfg *pool.SoloChartsConfig
 }
 
 func (c *Charts) Start() {
-	log.Printf("[Charts] Starting charts data collection")
 	ChartsInfoLogger.Printf("[Charts] Starting charts data collection")
 	writeWait, _ := time.ParseDuration("10ms")
 
@@ -38,7 +45,6 @@ func (c *Charts) Start() {
 	if c.PoolChartsConfig.Hashrate.Enabled {
 		phrIntv := time.Duration(c.PoolChartsConfig.Interval) * time.Second
 		phrTimer := time.NewTimer(phrIntv)
-		log.Printf("[Charts] Set pool hashrate chart interval to %v", phrIntv)
 		ChartsInfoLogger.Printf("[Charts] Set pool hashrate chart interval to %v", phrIntv)
 
 		go func() {
@@ -50,15 +56,14 @@ func (c *Charts) Start() {
 					if stats["poolHashrate"] == nil {
 						phrTimer.Reset(phrIntv)
 					} else {
-						log.Printf("[Charts] Pool Hashrate: %v", stats["poolHashrate"])
+						ChartsInfoLogger.Printf("[Charts] Pool Hashrate: %v", stats["poolHashrate"])
 						cData := &ChartData{Timestamp: now, Value: stats["poolHashrate"].(int64)}
 						for Graviton_backend.Writing == 1 {
-							//log.Printf("[Charts-poolhashrate] GravitonDB is writing... sleeping for %v...", writeWait)
 							//StorageInfoLogger.Printf("[Charts-poolhashrate] GravitonDB is writing... sleeping for %v...", writeWait)
 							time.Sleep(writeWait)
 						}
 						Graviton_backend.Writing = 1
-						Graviton_backend.WriteChartsData(cData, "poolhashrate", c.PoolChartsConfig.Interval, c.PoolChartsConfig.Hashrate.MaximumPeriod)
+						Graviton_backend.WriteChartsData(cData, "poolhashrate", c.PoolChartsConfig.Hashrate.MaximumPeriod, c.PoolChartsConfig.Retention)
 						Graviton_backend.Writing = 0
 						phrTimer.Reset(phrIntv)
 					}
@@ -71,7 +76,6 @@ func (c *Charts) Start() {
 	if c.PoolChartsConfig.Miners.Enabled {
 		pmIntv := time.Duration(c.PoolChartsConfig.Interval) * time.Second
 		pmTimer := time.NewTimer(pmIntv)
-		log.Printf("[Charts] Set pool miners chart interval to %v", pmIntv)
 		ChartsInfoLogger.Printf("[Charts] Set pool miners chart interval to %v", pmIntv)
 
 		go func() {
@@ -83,15 +87,14 @@ func (c *Charts) Start() {
 					if stats["totalPoolMiners"] == nil {
 						pmTimer.Reset(pmIntv)
 					} else {
-						log.Printf("[Charts] Pool Miners: %v", stats["totalPoolMiners"])
+						ChartsInfoLogger.Printf("[Charts] Pool Miners: %v", stats["totalPoolMiners"])
 						cData := &ChartData{Timestamp: now, Value: stats["totalPoolMiners"].(int64)}
 						for Graviton_backend.Writing == 1 {
-							//log.Printf("[Charts-totalpoolminers] GravitonDB is writing... sleeping for %v...", writeWait)
 							//StorageInfoLogger.Printf("[Charts-totalpoolminers] GravitonDB is writing... sleeping for %v...", writeWait)
 							time.Sleep(writeWait)
 						}
 						Graviton_backend.Writing = 1
-						Graviton_backend.WriteChartsData(cData, "totalpoolminers", c.PoolChartsConfig.Interval, c.PoolChartsConfig.Miners.MaximumPeriod)
+						Graviton_backend.WriteChartsData(cData, "totalpoolminers", c.PoolChartsConfig.Miners.MaximumPeriod, c.PoolChartsConfig.Retention)
 						Graviton_backend.Writing = 0
 						pmTimer.Reset(pmIntv)
 					}
@@ -104,7 +107,6 @@ func (c *Charts) Start() {
 	if c.PoolChartsConfig.Workers.Enabled {
 		pwIntv := time.Duration(c.PoolChartsConfig.Interval) * time.Second
 		pwTimer := time.NewTimer(pwIntv)
-		log.Printf("[Charts] Set pool workers chart interval to %v", pwIntv)
 		ChartsInfoLogger.Printf("[Charts] Set pool workers chart interval to %v", pwIntv)
 
 		go func() {
@@ -116,15 +118,14 @@ func (c *Charts) Start() {
 					if stats["totalPoolWorkers"] == nil {
 						pwTimer.Reset(pwIntv)
 					} else {
-						log.Printf("[Charts] Pool Workers: %v", stats["totalPoolWorkers"])
+						ChartsInfoLogger.Printf("[Charts] Pool Workers: %v", stats["totalPoolWorkers"])
 						cData := &ChartData{Timestamp: now, Value: stats["totalPoolWorkers"].(int64)}
 						for Graviton_backend.Writing == 1 {
-							//log.Printf("[Charts-totalpoolworkers] GravitonDB is writing... sleeping for %v...", writeWait)
 							//StorageInfoLogger.Printf("[Charts-totalpoolworkers] GravitonDB is writing... sleeping for %v...", writeWait)
 							time.Sleep(writeWait)
 						}
 						Graviton_backend.Writing = 1
-						Graviton_backend.WriteChartsData(cData, "totalpoolworkers", c.PoolChartsConfig.Interval, c.PoolChartsConfig.Workers.MaximumPeriod)
+						Graviton_backend.WriteChartsData(cData, "totalpoolworkers", c.PoolChartsConfig.Workers.MaximumPeriod, c.PoolChartsConfig.Retention)
 						Graviton_backend.Writing = 0
 						pwTimer.Reset(pwIntv)
 					}
@@ -137,7 +138,6 @@ func (c *Charts) Start() {
 	if c.SoloChartsConfig.Hashrate.Enabled {
 		shrIntv := time.Duration(c.SoloChartsConfig.Interval) * time.Second
 		shrTimer := time.NewTimer(shrIntv)
-		log.Printf("[Charts] Set solo hashrate chart interval to %v", shrIntv)
 		ChartsInfoLogger.Printf("[Charts] Set solo hashrate chart interval to %v", shrIntv)
 
 		go func() {
@@ -149,15 +149,14 @@ func (c *Charts) Start() {
 					if stats["soloHashrate"] == nil {
 						shrTimer.Reset(shrIntv)
 					} else {
-						log.Printf("[Charts] Solo Hashrate: %v", stats["soloHashrate"])
+						ChartsInfoLogger.Printf("[Charts] Solo Hashrate: %v", stats["soloHashrate"])
 						cData := &ChartData{Timestamp: now, Value: stats["soloHashrate"].(int64)}
 						for Graviton_backend.Writing == 1 {
-							//log.Printf("[Charts-solohashrate] GravitonDB is writing... sleeping for %v...", writeWait)
 							//StorageInfoLogger.Printf("[Charts-solohashrate] GravitonDB is writing... sleeping for %v...", writeWait)
 							time.Sleep(writeWait)
 						}
 						Graviton_backend.Writing = 1
-						Graviton_backend.WriteChartsData(cData, "solohashrate", c.SoloChartsConfig.Interval, c.SoloChartsConfig.Hashrate.MaximumPeriod)
+						Graviton_backend.WriteChartsData(cData, "solohashrate", c.SoloChartsConfig.Hashrate.MaximumPeriod, c.SoloChartsConfig.Retention)
 						Graviton_backend.Writing = 0
 						shrTimer.Reset(shrIntv)
 					}
@@ -170,7 +169,6 @@ func (c *Charts) Start() {
 	if c.SoloChartsConfig.Miners.Enabled {
 		smIntv := time.Duration(c.SoloChartsConfig.Interval) * time.Second
 		smTimer := time.NewTimer(smIntv)
-		log.Printf("[Charts] Set solo miners chart interval to %v", smIntv)
 		ChartsInfoLogger.Printf("[Charts] Set solo miners chart interval to %v", smIntv)
 
 		go func() {
@@ -182,15 +180,14 @@ func (c *Charts) Start() {
 					if stats["totalSoloMiners"] == nil {
 						smTimer.Reset(smIntv)
 					} else {
-						log.Printf("[Charts] Solo Miners: %v", stats["totalSoloMiners"])
+						ChartsInfoLogger.Printf("[Charts] Solo Miners: %v", stats["totalSoloMiners"])
 						cData := &ChartData{Timestamp: now, Value: stats["totalSoloMiners"].(int64)}
 						for Graviton_backend.Writing == 1 {
-							//log.Printf("[Charts-totalsolominers] GravitonDB is writing... sleeping for %v...", writeWait)
 							//StorageInfoLogger.Printf("[Charts-totalsolominers] GravitonDB is writing... sleeping for %v...", writeWait)
 							time.Sleep(writeWait)
 						}
 						Graviton_backend.Writing = 1
-						Graviton_backend.WriteChartsData(cData, "totalsolominers", c.SoloChartsConfig.Interval, c.SoloChartsConfig.Miners.MaximumPeriod)
+						Graviton_backend.WriteChartsData(cData, "totalsolominers", c.SoloChartsConfig.Miners.MaximumPeriod, c.SoloChartsConfig.Retention)
 						Graviton_backend.Writing = 0
 						smTimer.Reset(smIntv)
 					}
@@ -203,7 +200,6 @@ func (c *Charts) Start() {
 	if c.SoloChartsConfig.Workers.Enabled {
 		swIntv := time.Duration(c.SoloChartsConfig.Interval) * time.Second
 		swTimer := time.NewTimer(swIntv)
-		log.Printf("[Charts] Set pool workers chart interval to %v", swIntv)
 		ChartsInfoLogger.Printf("[Charts] Set pool workers chart interval to %v", swIntv)
 
 		go func() {
@@ -215,15 +211,14 @@ func (c *Charts) Start() {
 					if stats["totalSoloWorkers"] == nil {
 						swTimer.Reset(swIntv)
 					} else {
-						log.Printf("[Charts] Solo Workers: %v", stats["totalSoloWorkers"])
+						ChartsInfoLogger.Printf("[Charts] Solo Workers: %v", stats["totalSoloWorkers"])
 						cData := &ChartData{Timestamp: now, Value: stats["totalSoloWorkers"].(int64)}
 						for Graviton_backend.Writing == 1 {
-							//log.Printf("[Charts-totalsoloworkers] GravitonDB is writing... sleeping for %v...", writeWait)
 							//StorageInfoLogger.Printf("[Charts-totalsoloworkers] GravitonDB is writing... sleeping for %v...", writeWait)
 							time.Sleep(writeWait)
 						}
 						Graviton_backend.Writing = 1
-						Graviton_backend.WriteChartsData(cData, "totalsoloworkers", c.SoloChartsConfig.Interval, c.SoloChartsConfig.Workers.MaximumPeriod)
+						Graviton_backend.WriteChartsData(cData, "totalsoloworkers", c.SoloChartsConfig.Workers.MaximumPeriod, c.SoloChartsConfig.Retention)
 						Graviton_backend.Writing = 0
 						swTimer.Reset(swIntv)
 					}
@@ -236,7 +231,6 @@ func (c *Charts) Start() {
 	if c.PoolChartsConfig.Difficulty.Enabled {
 		pdIntv := time.Duration(c.PoolChartsConfig.Interval) * time.Second
 		pdTimer := time.NewTimer(pdIntv)
-		log.Printf("[Charts] Set pool difficulty chart interval to %v", pdIntv)
 		ChartsInfoLogger.Printf("[Charts] Set pool difficulty chart interval to %v", pdIntv)
 
 		go func() {
@@ -250,36 +244,154 @@ func (c *Charts) Start() {
 					prevBlock, getHashERR := v.GetLastBlockHeader()
 
 					if getHashERR != nil {
-						log.Printf("[API] Error while retrieving block from node: %v", getHashERR)
 						APIErrorLogger.Printf("[API] Error while retrieving block from node: %v", getHashERR)
 					} else {
 						lastBlock := prevBlock.BlockHeader
 						diff, _ = strconv.ParseInt(lastBlock.Difficulty, 10, 64)
 					}
-					log.Printf("[Charts] Pool Difficulty: %v", diff)
+					ChartsInfoLogger.Printf("[Charts] Pool Difficulty: %v", diff)
 					cData := &ChartData{Timestamp: now, Value: diff}
 					for Graviton_backend.Writing == 1 {
-						//log.Printf("[Charts-pooldifficulty] GravitonDB is writing... sleeping for %v...", writeWait)
 						//StorageInfoLogger.Printf("[Charts-pooldifficulty] GravitonDB is writing... sleeping for %v...", writeWait)
 						time.Sleep(writeWait)
 					}
 					Graviton_backend.Writing = 1
-					Graviton_backend.WriteChartsData(cData, "pooldifficulty", c.PoolChartsConfig.Interval, c.PoolChartsConfig.Difficulty.MaximumPeriod)
+					Graviton_backend.WriteChartsData(cData, "pooldifficulty", c.PoolChartsConfig.Difficulty.MaximumPeriod, c.PoolChartsConfig.Retention)
 					Graviton_backend.Writing = 0
 					pdTimer.Reset(pdIntv)
 				}
 			}
 		}()
 	}
+
+	// Miner Hashrate
+	if c.PoolChartsConfig.MinerHashrate.Enabled {
+		mhrIntv := time.Duration(c.PoolChartsConfig.Interval) * time.Second
+		mhrTimer := time.NewTimer(mhrIntv)
+		ChartsInfoLogger.Printf("[Charts] Set miner hashrate chart interval to %v", mhrIntv)
+
+		go func() {
+			for {
+				select {
+				case <-mhrTimer.C:
+					stats := c.Api.getStats()
+					now := util.MakeTimestamp() / 1000
+					if stats["miners"] == nil {
+						mhrTimer.Reset(mhrIntv)
+					} else {
+						// Hashrate of the workers of each address, pool and solo
+						hashrates := make(map[string]int64)
+						for _, miner := range stats["miners"].([]*ApiMiner) {
+							hashrates[miner.Address] += miner.Hashrate
+						}
+						cData := make(map[string]*ChartData)
+						for address, hashrate := range hashrates {
+							cData[address] = &ChartData{Timestamp: now, Value: hashrate}
+						}
+						ChartsInfoLogger.Printf("[Charts] Miner Hashrate: %v addresses", len(cData))
+						for Graviton_backend.Writing == 1 {
+							time.Sleep(writeWait)
+						}
+						Graviton_backend.Writing = 1
+						Graviton_backend.WriteMinerChartsData(cData, c.PoolChartsConfig.MinerHashrate.MaximumPeriod, c.PoolChartsConfig.Retention)
+						Graviton_backend.Writing = 0
+						mhrTimer.Reset(mhrIntv)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// Adds data to the chart, most recent first. Values older than maximumPeriod are averaged into the first retention tier, and values older than the period
+// of a tier into the next one. Values aging out of the last tier [or of maximumPeriod without retention] are dropped. Returns false if the timestamp is already registered
+func (charts *GravitonCharts) add(data *ChartData, maximumPeriod int64, retention []pool.ChartRetention) bool {
+	for _, value := range charts.Values {
+		if value.Timestamp == data.Timestamp {
+			return false
+		}
+	}
+
+	var expired []*ChartData
+	charts.Values, expired = splitChartValues(append(charts.Values, data), data.Timestamp-maximumPeriod)
+
+	// Tiers are rebuilt if the retention config changed
+	tiers := make([]*ChartTier, len(retention))
+	for i, r := range retention {
+		if i < len(charts.Downsampled) && charts.Downsampled[i].Resolution == r.Resolution {
+			tiers[i] = charts.Downsampled[i]
+		} else {
+			tiers[i] = &ChartTier{Resolution: r.Resolution}
+		}
+	}
+	charts.Downsampled = tiers
+
+	for i, tier := range charts.Downsampled {
+		if tier.Resolution <= 0 {
+			continue
+		}
+		for _, value := range expired {
+			tier.fold(value)
+		}
+		tier.Values, expired = splitChartValues(tier.Values, data.Timestamp-retention[i].Period)
+	}
+	return true
+}
+
+// Sorts values most recent first and splits them into the values after cutoff and the values at or before it
+func splitChartValues(values []*ChartData, cutoff int64) ([]*ChartData, []*ChartData) {
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].Timestamp > values[j].Timestamp
+	})
+	i := sort.Search(len(values), func(i int) bool {
+		return values[i].Timestamp <= cutoff
+	})
+	return values[:i], values[i:]
+}
+
+// Averages value into the value of its resolution period, weighted by the number of values already averaged into either
+func (tier *ChartTier) fold(value *ChartData) {
+	samples := value.Samples
+	if samples < 1 {
+		samples = 1
+	}
+	ts := value.Timestamp - value.Timestamp%tier.Resolution
+	for _, v := range tier.Values {
+		if v.Timestamp == ts {
+			v.Value = (v.Value*v.Samples + value.Value*samples) / (v.Samples + samples)
+			v.Samples += samples
+			return
+		}
+	}
+	tier.Values = append(tier.Values, &ChartData{Timestamp: ts, Value: value.Value, Samples: samples})
 }
 
-func logFileOutCharts(lType string) *log.Logger {
-	var logFileName string
-	if lType == "ERROR" {
-		logFileName = "logs/chartsError.log"
-	} else {
-		logFileName = "logs/charts.log"
+// Returns the values between from and to [0 for no bound], most recent first. Downsampled values only fill in before the most recent values of the chart
+func (charts *GravitonCharts) series(from, to int64) []*ChartData {
+	var values []*ChartData
+	oldest := int64(-1)
+	add := func(tierValues []*ChartData) {
+		for _, v := range tierValues {
+			if oldest != -1 && v.Timestamp >= oldest {
+				continue
+			}
+			if (from == 0 || v.Timestamp >= from) && (to == 0 || v.Timestamp <= to) {
+				values = append(values, v)
+			}
+		}
+		if len(tierValues) > 0 && (oldest == -1 || tierValues[len(tierValues)-1].Timestamp < oldest) {
+			oldest = tierValues[len(tierValues)-1].Timestamp
+		}
+	}
+	add(charts.Values)
+	for _, tier := range charts.Downsampled {
+		add(tier.Values)
 	}
+	return values
+}
+
+func logFileOutCharts(lType string) *util.Logger {
+	logFileName := util.LogFileName("charts", lType)
 	os.Mkdir("logs", 0705)
 	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0705)
 	if err != nil {
@@ -288,5 +400,5 @@ func logFileOutCharts(lType string) *log.Logger {
 
 	logType := lType + ": "
 	l := log.New(f, logType, log.LstdFlags|log.Lmicroseconds)
-	return l
+	return util.NewLogger("charts", lType, l)
 }
@@ -0,0 +1,130 @@
+package stratum
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+	"github.com/gorilla/websocket"
+)
+
+// Refreshes the block template as soon as the daemon announces a new chain tip, instead of waiting for the next blockRefreshInterval poll. Notifications come from
+// a websocket subscription to the daemon [any json-rpc notification it pushes] or from a POST to the notify listener, e.g. by the daemon's block notify command.
+// Polling keeps running as the fallback for missed notifications
+type DaemonNotifier struct {
+	config  *pool.DaemonNotifyConfig
+	trigger chan struct{}
+	// Notifications received since start by source
+	Websocket int64
+	Exec      int64
+	// Notifications which brought a new block template
+	NewTemplates int64
+}
+
+func NewDaemonNotifier(cfg *pool.DaemonNotifyConfig) *DaemonNotifier {
+	return &DaemonNotifier{config: cfg, trigger: make(chan struct{}, 1)}
+}
+
+func (n *DaemonNotifier) Start(s *StratumServer) {
+	go func() {
+		for range n.trigger {
+			if s.refreshBlockTemplate(true) {
+				atomic.AddInt64(&n.NewTemplates, 1)
+			}
+		}
+	}()
+
+	if n.config.Websocket != "" {
+		BlocksInfoLogger.Printf("[Blocks] Subscribing to daemon notifications at %s", n.config.Websocket)
+		go n.subscribe()
+	}
+	if n.config.Listen != "" {
+		BlocksInfoLogger.Printf("[Blocks] Listening for block notifications on %s", n.config.Listen)
+		go n.listen()
+	}
+}
+
+// Queues a template refresh. Notifications arriving while one is queued are folded into it, a burst only refreshes once
+func (n *DaemonNotifier) notify() {
+	select {
+	case n.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Keeps a websocket connection to the daemon, reconnecting after reconnectInterval when it drops
+func (n *DaemonNotifier) subscribe() {
+	reconnect, err := time.ParseDuration(n.config.ReconnectInterval)
+	if err != nil || reconnect <= 0 {
+		reconnect = 5 * time.Second
+	}
+	for {
+		if err := n.readNotifications(); err != nil {
+			BlocksErrorLogger.Printf("[Blocks] Daemon notification websocket %s: %v, reconnecting in %v", n.config.Websocket, err, reconnect)
+		}
+		time.Sleep(reconnect)
+	}
+}
+
+func (n *DaemonNotifier) readNotifications() error {
+	conn, _, err := websocket.DefaultDialer.Dial(n.config.Websocket, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if n.config.SubscribeMethod != "" {
+		request := map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": n.config.SubscribeMethod}
+		if err := conn.WriteJSON(request); err != nil {
+			return err
+		}
+	}
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		// Only notifications [a method without an id] announce anything, replies to the subscribe request are skipped
+		var msg struct {
+			Method string           `json:"method"`
+			Id     *json.RawMessage `json:"id"`
+		}
+		if json.Unmarshal(message, &msg) != nil || msg.Method == "" || msg.Id != nil {
+			continue
+		}
+		atomic.AddInt64(&n.Websocket, 1)
+		n.notify()
+	}
+}
+
+// Serves POST /notify for block notify commands [e.g. curl -X POST http://127.0.0.1:8090/notify], with the token as ?token= or X-Notify-Token if set
+func (n *DaemonNotifier) listen() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/notify", func(writer http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if n.config.Token != "" {
+			token := r.Header.Get("X-Notify-Token")
+			if token == "" {
+				token = r.URL.Query().Get("token")
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(n.config.Token)) != 1 {
+				writer.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		atomic.AddInt64(&n.Exec, 1)
+		n.notify()
+		writer.WriteHeader(http.StatusNoContent)
+	})
+
+	if err := http.ListenAndServe(n.config.Listen, mux); err != nil {
+		BlocksErrorLogger.Printf("[Blocks] Block notify listener on %s failed: %v", n.config.Listen, err)
+	}
+}
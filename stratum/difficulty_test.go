@@ -0,0 +1,105 @@
+package stratum
+
+import (
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// Returns a little endian hash of exactly the given value, the difficulty of the hash being Diff1 / value
+func hashOfValue(value *big.Int) []byte {
+	hash := make([]byte, 32)
+	bigEndian := value.Bytes()
+	for i, b := range bigEndian {
+		hash[len(bigEndian)-1-i] = b
+	}
+	return hash
+}
+
+// Shares at or just above the assigned difficulty are accepted, shares just below it are rejected as low difficulty
+func TestShareDifficultyBoundary(t *testing.T) {
+	for _, difficulty := range []int64{1000, 35000, 1 << 32} {
+		setDiff := big.NewInt(difficulty)
+
+		// The largest hash meeting the difficulty, one more falls just below it
+		atBoundary := new(big.Int).Div(util.Diff1, setDiff)
+		belowBoundary := new(big.Int).Add(atBoundary, big.NewInt(1))
+		aboveBoundary := new(big.Int).Sub(atBoundary, big.NewInt(1))
+
+		hashDiff, errCode := shareDifficulty(hashOfValue(atBoundary), setDiff)
+		if errCode != 0 || hashDiff.Cmp(setDiff) != 0 {
+			t.Fatalf("difficulty %v: share at the boundary got difficulty %v and code %v", difficulty, hashDiff, errCode)
+		}
+		hashDiff, errCode = shareDifficulty(hashOfValue(aboveBoundary), setDiff)
+		if errCode != 0 || hashDiff.Cmp(setDiff) < 0 {
+			t.Fatalf("difficulty %v: share just above the boundary got difficulty %v and code %v", difficulty, hashDiff, errCode)
+		}
+		hashDiff, errCode = shareDifficulty(hashOfValue(belowBoundary), setDiff)
+		if errCode != errCodeLowDifficulty {
+			t.Fatalf("difficulty %v: share just below the boundary got difficulty %v and code %v, expected low difficulty", difficulty, hashDiff, errCode)
+		}
+		if expected := big.NewInt(difficulty - 1); hashDiff.Cmp(expected) != 0 {
+			t.Fatalf("difficulty %v: share just below the boundary got difficulty %v, expected %v", difficulty, hashDiff, expected)
+		}
+	}
+}
+
+// A zero hash has no difficulty and is rejected as a bad hash, not as low difficulty
+func TestShareDifficultyBadHash(t *testing.T) {
+	if _, errCode := shareDifficulty(make([]byte, 32), big.NewInt(1000)); errCode != errCodeOther {
+		t.Fatalf("zero hash got code %v, expected %v", errCode, errCodeOther)
+	}
+	if _, errCode := shareDifficulty(nil, big.NewInt(1000)); errCode != errCodeOther {
+		t.Fatalf("empty hash got code %v, expected %v", errCode, errCodeOther)
+	}
+}
+
+// Difficulties survive the trip through the target sent to miners, the compact encoding only exactly at lower difficulties
+func TestTargetRoundTrip(t *testing.T) {
+	// The compact encoding can not represent difficulties of 2^32 and above, its target being 0
+	for _, test := range []struct {
+		encoding     string
+		difficulties []int64
+		exactTo      int64
+	}{
+		{"uint32", []int64{1, 100, 1000, 35000, 60000, 1000000, 1000000000}, 60000},
+		{"uint64", []int64{1, 100, 1000, 35000, 60000, 1000000, 1000000000, 1 << 40}, 1000000000},
+	} {
+		for _, difficulty := range test.difficulties {
+			targetHex := util.GetTargetHexEncoded(difficulty, test.encoding)
+			got, ok := util.GetTargetDifficulty(targetHex)
+			if !ok {
+				t.Fatalf("%v: target %v of difficulty %v does not decode", test.encoding, targetHex, difficulty)
+			}
+			// Precision is lost by truncating the target, which can only raise the difficulty it represents
+			if got < difficulty {
+				t.Fatalf("%v: target %v of difficulty %v represents the lower difficulty %v", test.encoding, targetHex, difficulty, got)
+			}
+			if difficulty <= test.exactTo && got != difficulty {
+				t.Fatalf("%v: target %v of difficulty %v represents difficulty %v", test.encoding, targetHex, difficulty, got)
+			}
+		}
+	}
+}
+
+// The weakest hash a miner finds meeting the target sent with a job is accepted at the difficulty of the job
+func TestShareAtSentTarget(t *testing.T) {
+	for encoding, difficulties := range map[string][]int64{
+		"uint32": {1000, 35000, 1000000, 1000000000},
+		"uint64": {1000, 35000, 1000000, 1000000000, 1 << 40},
+	} {
+		for _, difficulty := range difficulties {
+			targetBytes, _ := hex.DecodeString(util.GetTargetHexEncoded(difficulty, encoding))
+
+			// The target is the most significant bytes of the hash value, the bytes below it zero
+			hash := make([]byte, 32)
+			copy(hash[32-len(targetBytes):], targetBytes)
+
+			if hashDiff, errCode := shareDifficulty(hash, big.NewInt(difficulty)); errCode != 0 {
+				t.Fatalf("%v: share at the target of difficulty %v got difficulty %v and code %v", encoding, difficulty, hashDiff, errCode)
+			}
+		}
+	}
+}
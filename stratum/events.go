@@ -40,7 +40,6 @@ func NewEventsProcessor(eventsconfig *pool.EventsConfig, coinunits int64) *Event
 }
 
 func (e *Events) Start() {
-	log.Printf("[Events] Starting events data collection")
 	EventsInfoLogger.Printf("[Events] Starting events data collection")
 	writeWait, _ := time.ParseDuration("10ms")
 
@@ -49,16 +48,12 @@ func (e *Events) Start() {
 		// Start of every day event interval
 		rreIntv := time.Duration(e.EventsConfig.RandomRewardEventConfig.StepIntervalInSeconds) * time.Second
 		rreTimer := time.NewTimer(rreIntv)
-		log.Printf("[Events] Set random rewards event step interval to '%v'", rreIntv)
 		EventsInfoLogger.Printf("[Events] Set random rewards event step interval to '%v'", rreIntv)
 
-		log.Printf("[Events] Set event start date to '%v'", e.EventsConfig.RandomRewardEventConfig.StartDay)
 		EventsInfoLogger.Printf("[Events] Set event start date to '%v'", e.EventsConfig.RandomRewardEventConfig.StartDay)
 
-		log.Printf("[Events] Set event end date to '%v'", e.EventsConfig.RandomRewardEventConfig.EndDay)
 		EventsInfoLogger.Printf("[Events] Set event end date to '%v'", e.EventsConfig.RandomRewardEventConfig.EndDay)
 
-		log.Printf("[Events] Set bonus event date to '%v'", e.EventsConfig.RandomRewardEventConfig.Bonus1hrDayEventDate)
 		EventsInfoLogger.Printf("[Events] Set bonus event date to '%v'", e.EventsConfig.RandomRewardEventConfig.Bonus1hrDayEventDate)
 
 		go func() {
@@ -173,7 +168,6 @@ func (e *Events) Start() {
 													// Already one, compare
 													if cm.StartedAt < loadedStartedAt {
 														// Set v.StartedAt
-														log.Printf("[Events] Storing startedAt for %v . Current value: %v , New Value: %v", address, loadedStartedAt, cm.StartedAt)
 														EventsInfoLogger.Printf("[Events] Storing startedAt for %v . Current value: %v , New Value: %v", address, loadedStartedAt, cm.StartedAt)
 														storedstats[address].StartedAt = cm.StartedAt
 													} else {
@@ -190,7 +184,6 @@ func (e *Events) Start() {
 													// Already one, compare
 													if cm.LastBeat > loadedLastBeat {
 														// Set v.LastBeat
-														log.Printf("[Events] Storing LastBeat for %v . Current value: %v , New Value: %v", address, loadedLastBeat, cm.LastBeat)
 														EventsInfoLogger.Printf("[Events] Storing LastBeat for %v . Current value: %v , New Value: %v", address, loadedLastBeat, cm.LastBeat)
 														storedstats[address].LastBeat = cm.LastBeat
 													} else {
@@ -210,7 +203,6 @@ func (e *Events) Start() {
 											storedstats = make(map[string]*Miner)
 											address := cm.Address
 
-											log.Printf("[Events] Storing details for address %v . Did not exist before.", address)
 											EventsInfoLogger.Printf("[Events] Storing details for address %v . Did not exist before.", address)
 											storedAddressDetails := &Miner{StartedAt: cm.StartedAt, LastBeat: cm.LastBeat}
 
@@ -233,7 +225,6 @@ func (e *Events) Start() {
 										if v.LastBeat <= now-300 && v.LastBeat >= todaysStartTime {
 											if storedstats[address].LastBeat != 0 && storedstats[address].StartedAt != 0 {
 												storedstats[address].EventDataOffset += now - (v.LastBeat + storedstats[address].EventDataOffset + 300)
-												log.Printf("[Events] Address (%v) eventdataoffset %v", address, storedstats[address].EventDataOffset)
 												EventsInfoLogger.Printf("[Events] Address (%v) eventdataoffset %v", address, storedstats[address].EventDataOffset)
 											} /*else if storedstats[address].LastBeat != 0 && storedstats[address].StartedAt != 0 {
 												storedstats[address].EventDataOffset = now - (v.LastBeat + 300)
@@ -248,11 +239,9 @@ func (e *Events) Start() {
 									err := Graviton_backend.OverwriteEventsData(storedstats, todaysdate)
 									Graviton_backend.Writing = 0
 									if err != nil {
-										log.Printf("[Events] Error overwriting events data")
 										EventsInfoLogger.Printf("[Events] Error overwriting events data")
 									}
 								} else {
-									log.Printf("[Events] No stats to store for event, no connected miners.")
 									EventsInfoLogger.Printf("[Events] No stats to store for event, no connected miners.")
 								}
 
@@ -286,14 +275,12 @@ func (e *Events) Start() {
 
 												if backendStats[k].StartedAt > unixStartTime {
 													// Do logic to calc difference
-													log.Printf("[Events] Difference (%v) adding to offset: %v", k, backendStats[k].StartedAt-unixStartTime)
 													EventsInfoLogger.Printf("[Events] Difference (%v) adding to offset: %v", k, backendStats[k].StartedAt-unixStartTime)
 
 													backendStats[k].EventDataOffset += backendStats[k].StartedAt - unixStartTime
 												} else if backendStats[k].LastBeat < unixStartTime {
 													beatNow := time.Now().UTC().UnixNano() / int64(time.Millisecond) / 1000
 
-													log.Printf("[Events] LastBeat is greater than unixStartTime. Difference (%v) adding to offset: %v", k, beatNow-unixStartTime)
 													EventsInfoLogger.Printf("[Events] LastBeat is greater than unixStartTime. Difference (%v) adding to offset: %v", k, beatNow-unixStartTime)
 
 													backendStats[k].EventDataOffset += beatNow - unixStartTime
@@ -308,22 +295,18 @@ func (e *Events) Start() {
 												minerOffsetFloat := float64(minerOffset)
 												offsetPercent := minerOffsetFloat / yesterdayTimeWindowFloat
 												if offsetPercent >= e.EventsConfig.RandomRewardEventConfig.MinerPercentCriteria {
-													log.Printf("[Events] Adding miner (%v). Meets criteria: %v . startedAt (%v) && lastBeat (%v)", k, offsetPercent, backendStats[k].StartedAt, backendStats[k].LastBeat)
 													EventsInfoLogger.Printf("[Events] Adding miner (%v). Meets criteria: %v . startedAt (%v) && lastBeat (%v)", k, offsetPercent, backendStats[k].StartedAt, backendStats[k].LastBeat)
 													tempMinerArr = append(tempMinerArr, k)
 												} else {
-													log.Printf("[Events] Not adding miner (%v), they did not meet the mining percent criteria: %v . startedAt (%v) && lastBeat (%v)", k, offsetPercent, backendStats[k].StartedAt, backendStats[k].LastBeat)
 													EventsInfoLogger.Printf("[Events] Not adding miner (%v), they did not meet the mining percent criteria: %v . startedAt (%v) && lastBeat (%v)", k, offsetPercent, backendStats[k].StartedAt, backendStats[k].LastBeat)
 												}
 											}
 										}
 
 										if tempMinerArr != nil {
-											log.Printf("[Events] Choosing the winner for yesterday: %v", yesterdaysdate)
 											EventsInfoLogger.Printf("[Events] Choosing the winner for yesterday: %v", yesterdaysdate)
 											rand.Seed(time.Now().Unix())
 											n := rand.Int() % len(tempMinerArr)
-											log.Printf("[Events] Chosen address string: %v , int: %v / %v . Rewarding: %v", tempMinerArr[n], n, len(tempMinerArr), uint64(e.EventsConfig.RandomRewardEventConfig.RewardValueInDERO*e.CoinUnits))
 											EventsInfoLogger.Printf("[Events] Chosen address string: %v , int: %v / %v . Rewarding: %v", tempMinerArr[n], n, len(tempMinerArr), uint64(e.EventsConfig.RandomRewardEventConfig.RewardValueInDERO*e.CoinUnits))
 
 											info := &PaymentPending{}
@@ -335,10 +318,9 @@ func (e *Events) Start() {
 												time.Sleep(writeWait)
 											}
 											Graviton_backend.Writing = 1
-											infoErr := Graviton_backend.WritePendingPayments(info)
+											infoErr := Storage_backend.WritePendingPayments(info)
 											Graviton_backend.Writing = 0
 											if infoErr != nil {
-												log.Printf("[Events] Graviton DB err: %v", infoErr)
 												EventsErrorLogger.Printf("[Events] Graviton DB err: %v", infoErr)
 											}
 
@@ -349,7 +331,6 @@ func (e *Events) Start() {
 											eventPaymentErr := Graviton_backend.WriteEventsPayment(info, yesterdaysdate)
 											Graviton_backend.Writing = 0
 											if eventPaymentErr != nil {
-												log.Printf("[Events] Graviton DB err: %v", eventPaymentErr)
 												EventsErrorLogger.Printf("[Events] Graviton DB err: %v", eventPaymentErr)
 											}
 										} else {
@@ -397,14 +378,12 @@ func (e *Events) Start() {
 
 									if backendStats[k].StartedAt > unixStartTime {
 										// Do logic to calc difference
-										log.Printf("[Events] Difference (%v) adding to offset: %v", k, backendStats[k].StartedAt-unixStartTime)
 										EventsInfoLogger.Printf("[Events] Difference (%v) adding to offset: %v", k, backendStats[k].StartedAt-unixStartTime)
 
 										backendStats[k].EventDataOffset += backendStats[k].StartedAt - unixStartTime
 									} else if backendStats[k].LastBeat < unixStartTime {
 										beatNow := time.Now().UTC().UnixNano() / int64(time.Millisecond) / 1000
 
-										log.Printf("[Events] LastBeat is greater than unixStartTime. Difference (%v) adding to offset: %v", k, beatNow-unixStartTime)
 										EventsInfoLogger.Printf("[Events] LastBeat is greater than unixStartTime. Difference (%v) adding to offset: %v", k, beatNow-unixStartTime)
 
 										backendStats[k].EventDataOffset += beatNow - unixStartTime
@@ -419,22 +398,18 @@ func (e *Events) Start() {
 									minerOffsetFloat := float64(minerOffset)
 									offsetPercent := minerOffsetFloat / yesterdayTimeWindowFloat
 									if offsetPercent >= e.EventsConfig.RandomRewardEventConfig.MinerPercentCriteria {
-										log.Printf("[Events] Adding miner (%v). Meets criteria: %v . startedAt (%v) && lastBeat (%v)", k, offsetPercent, backendStats[k].StartedAt, backendStats[k].LastBeat)
 										EventsInfoLogger.Printf("[Events] Adding miner (%v). Meets criteria: %v . startedAt (%v) && lastBeat (%v)", k, offsetPercent, backendStats[k].StartedAt, backendStats[k].LastBeat)
 										tempMinerArr = append(tempMinerArr, k)
 									} else {
-										log.Printf("[Events] Not adding miner (%v), they did not meet the mining percent criteria: %v . startedAt (%v) && lastBeat (%v)", k, offsetPercent, backendStats[k].StartedAt, backendStats[k].LastBeat)
 										EventsInfoLogger.Printf("[Events] Not adding miner (%v), they did not meet the mining percent criteria: %v . startedAt (%v) && lastBeat (%v)", k, offsetPercent, backendStats[k].StartedAt, backendStats[k].LastBeat)
 									}
 								}
 							}
 
 							if tempMinerArr != nil {
-								log.Printf("[Events] Choosing the winner for yesterday: %v", yesterdaysdate)
 								EventsInfoLogger.Printf("[Events] Choosing the winner for yesterday: %v", yesterdaysdate)
 								rand.Seed(time.Now().Unix())
 								n := rand.Int() % len(tempMinerArr)
-								log.Printf("[Events] Chosen address string: %v , int: %v / %v . Rewarding: %v", tempMinerArr[n], n, len(tempMinerArr), uint64(e.EventsConfig.RandomRewardEventConfig.RewardValueInDERO*e.CoinUnits))
 								EventsInfoLogger.Printf("[Events] Chosen address string: %v , int: %v / %v. Rewarding: %v", tempMinerArr[n], n, len(tempMinerArr), uint64(e.EventsConfig.RandomRewardEventConfig.RewardValueInDERO*e.CoinUnits))
 
 								info := &PaymentPending{}
@@ -446,10 +421,9 @@ func (e *Events) Start() {
 									time.Sleep(writeWait)
 								}
 								Graviton_backend.Writing = 1
-								infoErr := Graviton_backend.WritePendingPayments(info)
+								infoErr := Storage_backend.WritePendingPayments(info)
 								Graviton_backend.Writing = 0
 								if infoErr != nil {
-									log.Printf("[Events] Graviton DB err: %v", infoErr)
 									EventsErrorLogger.Printf("[Events] Graviton DB err: %v", infoErr)
 								}
 
@@ -460,7 +434,6 @@ func (e *Events) Start() {
 								eventPaymentErr := Graviton_backend.WriteEventsPayment(info, yesterdaysdate)
 								Graviton_backend.Writing = 0
 								if eventPaymentErr != nil {
-									log.Printf("[Events] Graviton DB err: %v", eventPaymentErr)
 									EventsErrorLogger.Printf("[Events] Graviton DB err: %v", eventPaymentErr)
 								}
 							} else {
@@ -500,22 +473,18 @@ func (e *Events) Start() {
 									unixStartTime := thisHourStartWindow.UnixNano() / int64(time.Millisecond) / 1000
 
 									if backendStats[k].LastBeat >= unixStartTime {
-										log.Printf("[Events] Adding miner (%v). LastBeat is within the hour (%v : %v).", k, thisHourStartWindow, backendStats[k].LastBeat)
 										EventsInfoLogger.Printf("[Events] Adding miner (%v). LastBeat is within the hour (%v : %v).", k, thisHourStartWindow, backendStats[k].LastBeat)
 										tempMinerArr = append(tempMinerArr, k)
 									} else {
-										log.Printf("[Events] Not adding miner (%v), lastbeat is not within this hour (%v : %v).", k, thisHourStartWindow, backendStats[k].LastBeat)
 										EventsInfoLogger.Printf("[Events] Not adding miner (%v), lastbeat is not within this hour (%v : %v).", k, thisHourStartWindow, backendStats[k].LastBeat)
 									}
 								}
 							}
 
 							if tempMinerArr != nil {
-								log.Printf("[Events] Choosing the winner for this hour: %v", lastHourBonusDate)
 								EventsInfoLogger.Printf("[Events] Choosing the winner for this hour: %v", lastHourBonusDate)
 								rand.Seed(time.Now().Unix())
 								n := rand.Int() % len(tempMinerArr)
-								log.Printf("[Events] Chosen address string: %v , int: %v / %v . Rewarding: %v", tempMinerArr[n], n, len(tempMinerArr), uint64(e.EventsConfig.RandomRewardEventConfig.RewardValueInDERO*e.CoinUnits))
 								EventsInfoLogger.Printf("[Events] Chosen address string: %v , int: %v / %v . Rewarding: %v", tempMinerArr[n], n, len(tempMinerArr), uint64(e.EventsConfig.RandomRewardEventConfig.RewardValueInDERO*e.CoinUnits))
 
 								info := &PaymentPending{}
@@ -527,10 +496,9 @@ func (e *Events) Start() {
 									time.Sleep(writeWait)
 								}
 								Graviton_backend.Writing = 1
-								infoErr := Graviton_backend.WritePendingPayments(info)
+								infoErr := Storage_backend.WritePendingPayments(info)
 								Graviton_backend.Writing = 0
 								if infoErr != nil {
-									log.Printf("[Events] Graviton DB err: %v", infoErr)
 									EventsErrorLogger.Printf("[Events] Graviton DB err: %v", infoErr)
 								}
 
@@ -541,11 +509,9 @@ func (e *Events) Start() {
 								eventPaymentErr := Graviton_backend.WriteEventsPayment(info, lastHourBonusDate)
 								Graviton_backend.Writing = 0
 								if eventPaymentErr != nil {
-									log.Printf("[Events] Graviton DB err: %v", eventPaymentErr)
 									EventsErrorLogger.Printf("[Events] Graviton DB err: %v", eventPaymentErr)
 								}
 							} else {
-								//log.Printf("[Events] No miners within this hour's data. No rewards processed.")
 								//EventsInfoLogger.Printf("[Events] No miners within this hour's data. No rewards processed.")
 							}
 						} else {
@@ -560,13 +526,8 @@ func (e *Events) Start() {
 	}
 }
 
-func logFileOutEvents(lType string) *log.Logger {
-	var logFileName string
-	if lType == "ERROR" {
-		logFileName = "logs/eventsError.log"
-	} else {
-		logFileName = "logs/events.log"
-	}
+func logFileOutEvents(lType string) *util.Logger {
+	logFileName := util.LogFileName("events", lType)
 	os.Mkdir("logs", 0705)
 	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0705)
 	if err != nil {
@@ -575,5 +536,5 @@ func logFileOutEvents(lType string) *log.Logger {
 
 	logType := lType + ": "
 	l := log.New(f, logType, log.LstdFlags|log.Lmicroseconds)
-	return l
+	return util.NewLogger("events", lType, l)
 }
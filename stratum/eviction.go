@@ -0,0 +1,145 @@
+package stratum
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// Frees the miners offline for longer than offlineAfter: their aggregate stats are written to storage marked with EvictedAt, and they are removed from s.miners.
+// Evicted miners are not loaded back by the stats writes, a login restores them from storage. Miners with sessions, round shares not yet stored or the donation
+// miner are kept
+func (s *StratumServer) evictOfflineMiners(offlineAfter time.Duration) {
+	now := util.MakeTimestamp() / 1000
+	cutoff := now - int64(offlineAfter/time.Second)
+	round := Storage_backend.GetPoolRoundStats()
+
+	var evicted int
+	for _, m := range s.miners.Values() {
+		if atomic.LoadInt64(&m.LastBeat) > cutoff || atomic.LoadInt64(&m.LastShare) > cutoff || atomic.LoadInt64(&m.StartedAt) > cutoff {
+			continue
+		}
+		if s.evictMiner(m, round, now) {
+			evicted++
+		}
+	}
+
+	if evicted > 0 {
+		StratumInfoLogger.Printf("[Stratum] Evicted %v miners offline for more than %v, %v miners in memory", evicted, offlineAfter, s.miners.Count())
+	}
+}
+
+// Queues a miner whose last session closed to be released from s.miners by releaseMiners. With the queue full it is left to releaseIdleMiners
+func (s *StratumServer) queueMinerRelease(m *Miner) {
+	if s.releaseQueue == nil {
+		return
+	}
+	select {
+	case s.releaseQueue <- m:
+	default:
+	}
+}
+
+// Releases the miners queued by removeSession as their last session closed, evicted the same as offline miners. Miners with round shares not yet stored are
+// kept until releaseIdleMiners runs after the next round stats update
+func (s *StratumServer) releaseMiners() {
+	for m := range s.releaseQueue {
+		s.evictMiner(m, Storage_backend.GetPoolRoundStats(), util.MakeTimestamp()/1000)
+	}
+}
+
+// Releases every miner without a live session whose round shares are stored, run after each miner stats write so miners kept by releaseMiners do not pile up
+func (s *StratumServer) releaseIdleMiners() {
+	now := util.MakeTimestamp() / 1000
+	round := Storage_backend.GetPoolRoundStats()
+
+	var released int
+	for _, m := range s.miners.Values() {
+		if s.evictMiner(m, round, now) {
+			released++
+		}
+	}
+	if released > 0 {
+		StratumInfoLogger.Printf("[Stratum] Released %v miners without sessions, %v miners in memory", released, s.miners.Count())
+	}
+}
+
+// Writes the stats of m marked with EvictedAt and removes it from s.miners. Returns false if it was kept: the donation miner, miners with sessions and miners with
+// round shares not yet stored in round are
+func (s *StratumServer) evictMiner(m *Miner, round *PoolRound, now int64) bool {
+	if m.Id == s.donateID || m.liveSessions() > 0 {
+		return false
+	}
+	if round != nil && !m.IsSolo && m.hasSharesAfter(round.Timestamp) {
+		return false
+	}
+	// Already evicted by a concurrent release
+	if !atomic.CompareAndSwapInt64(&m.EvictedAt, 0, now) {
+		return false
+	}
+	s.withholding.keep(m)
+
+	writeWait, _ := time.ParseDuration("10ms")
+	for Graviton_backend.Writing == 1 {
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	err := Graviton_backend.WriteMinerStatsByID(m, s.hashrateExpiration)
+	Graviton_backend.Writing = 0
+	if err != nil {
+		StratumErrorLogger.Printf("[Stratum] Could not store stats of miner %v, keeping it: %v", m.Id, err)
+		atomic.StoreInt64(&m.EvictedAt, 0)
+		return false
+	}
+	// Removed under the sessions lock of the miner, which registerSession attaches sessions under: a login between the checks above and here either
+	// attached its session already and the miner is kept, or attaches it after the removal and puts the miner back, as it is still marked EvictedAt
+	m.sessionsMu.Lock()
+	if len(m.sessions) > 0 {
+		m.sessionsMu.Unlock()
+		atomic.StoreInt64(&m.EvictedAt, 0)
+		return false
+	}
+	s.miners.Remove(m.Id)
+	m.sessionsMu.Unlock()
+	atomic.AddInt64(&s.minersEvicted, 1)
+	return true
+}
+
+// Restores the all-time stats of an evicted miner into miner, newly created for its login. Returns false if the miner was not evicted. Its hashrate starts over
+func (s *StratumServer) restoreEvictedMiner(miner *Miner) bool {
+	stored := Graviton_backend.GetMinerStatsByID(miner.Id)
+	if stored == nil || stored.EvictedAt == 0 {
+		return false
+	}
+
+	miner.LastShare = stored.LastShare
+	miner.LastDifficulty = stored.LastDifficulty
+	miner.Accepts = stored.Accepts
+	miner.Rejects = stored.Rejects
+	miner.DonationTotal = stored.DonationTotal
+	miner.ExpectedBlocks = stored.ExpectedBlocks
+	miner.Country = stored.Country
+	miner.Region = stored.Region
+	s.withholding.restore(miner.Id, stored.WithholdingSamples)
+
+	atomic.AddInt64(&s.minersRestored, 1)
+	return true
+}
+
+func (m *Miner) liveSessions() int {
+	m.sessionsMu.Lock()
+	defer m.sessionsMu.Unlock()
+	return len(m.sessions)
+}
+
+func (m *Miner) hasSharesAfter(timestamp int64) bool {
+	m.RLock()
+	defer m.RUnlock()
+	for k := range m.Shares {
+		if k > timestamp {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,254 @@
+package stratum
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Payment of an address in an export, amounts in atomic units
+type ApiExportPayment struct {
+	TxHash    string
+	Timestamp int64
+	Amount    uint64
+	TxFee     uint64
+}
+
+// Daily summary of an address in an export, by utc date. Shares and Rewards are those of the pool blocks found that day, Hashrate the average of the address hashrate chart
+type ApiExportDay struct {
+	Date     string
+	Shares   int64
+	Hashrate int64
+	Rewards  int64
+	Paid     uint64
+	Payments int64
+}
+
+// Exports walk the whole payment and block history, so an address is built at most once per exportCacheTTL, one export at a time, and at most exportCacheMax are kept
+const (
+	exportCacheTTL = 5 * time.Minute
+	exportCacheMax = 1000
+)
+
+type exportCache struct {
+	mu      sync.Mutex
+	entries map[string]*exportEntry
+}
+
+type exportEntry struct {
+	payments []*ApiExportPayment
+	days     []*ApiExportDay
+	builtAt  time.Time
+}
+
+// GET /api/miner/<address>/export[?format=csv] returns the payments and daily share/hashrate summaries of the address as a json [default] or csv download.
+// The csv has a type column, "payment" rows carry the payment columns and "day" rows the summary columns. Only addresses that have mined on the pool are exported
+func (apiServer *ApiServer) MinerExportIndex(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	address := mux.Vars(r)["address"]
+	format := r.URL.Query().Get("format")
+	if address == "" || (format != "" && format != "json" && format != "csv") {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var mExist bool
+	for _, v := range Graviton_backend.GetMinerIDRegistrations() {
+		if v.Address == address {
+			mExist = true
+			break
+		}
+	}
+	if !mExist {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	payments, days := apiServer.cachedExport(address)
+	filename := address + "-export"
+	if format == "csv" {
+		writer.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+		writer.Header().Set("Content-Disposition", "attachment; filename=\""+filename+".csv\"")
+		writer.WriteHeader(http.StatusOK)
+		if err := apiServer.writeExportCSV(writer, payments, days); err != nil {
+			APIErrorLogger.Printf("[API] Error writing export of %v: %v", address, err)
+		}
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Content-Disposition", "attachment; filename=\""+filename+".json\"")
+	writer.WriteHeader(http.StatusOK)
+	reply := make(map[string]interface{})
+	reply["address"] = address
+	reply["coinUnits"] = apiServer.stratum.currentConfig().CoinUnits
+	reply["payments"] = payments
+	reply["days"] = days
+
+	err := json.NewEncoder(writer).Encode(reply)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing API response: %v", err)
+	}
+}
+
+// Returns the export of the address built within exportCacheTTL, building it otherwise. Builds are serialized by the cache lock
+func (apiServer *ApiServer) cachedExport(address string) ([]*ApiExportPayment, []*ApiExportDay) {
+	c := &apiServer.exports
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if e, ok := c.entries[address]; ok && now.Sub(e.builtAt) < exportCacheTTL {
+		return e.payments, e.days
+	}
+
+	payments, days := apiServer.exportAddress(address)
+	if c.entries == nil {
+		c.entries = make(map[string]*exportEntry)
+	}
+	for k, e := range c.entries {
+		if now.Sub(e.builtAt) >= exportCacheTTL {
+			delete(c.entries, k)
+		}
+	}
+	if len(c.entries) < exportCacheMax {
+		c.entries[address] = &exportEntry{payments: payments, days: days, builtAt: now}
+	}
+	return payments, days
+}
+
+// Returns whether login [a payment login, block reward login or miner id] belongs to address, its workers and payment ids included
+func (apiServer *ApiServer) exportLogin(login, address string) bool {
+	if login == address {
+		return true
+	}
+	loginAddress, _, _, _, _, _ := apiServer.stratum.splitLoginString(login)
+	return loginAddress == address
+}
+
+// Returns the payments of the address, most recent first, and its daily summaries by date
+func (apiServer *ApiServer) exportAddress(address string) ([]*ApiExportPayment, []*ApiExportDay) {
+	days := make(map[string]*ApiExportDay)
+	day := func(timestamp int64) *ApiExportDay {
+		date := time.Unix(timestamp, 0).UTC().Format("2006-01-02")
+		d, ok := days[date]
+		if !ok {
+			d = &ApiExportDay{Date: date}
+			days[date] = d
+		}
+		return d
+	}
+
+	payments := []*ApiExportPayment{}
+	if processedPayments := Storage_backend.GetProcessedPayments(); processedPayments != nil {
+		for _, payment := range processedPayments.MinerPayments {
+			if !apiServer.exportLogin(payment.Login, address) {
+				continue
+			}
+			payments = append(payments, &ApiExportPayment{TxHash: payment.TxHash, Timestamp: payment.Timestamp, Amount: payment.Amount, TxFee: payment.TxFee})
+			d := day(payment.Timestamp)
+			d.Paid += payment.Amount
+			d.Payments++
+		}
+	}
+	sort.SliceStable(payments, func(i, j int) bool {
+		return payments[i].Timestamp > payments[j].Timestamp
+	})
+
+	// Shares of the rounds of the pool blocks, a round is only counted once if several blocks were found on it
+	rounds := make(map[int64]bool)
+	for _, blockType := range []string{"candidate", "immature", "matured"} {
+		blocks := apiServer.backend.GetBlocksFound(blockType)
+		if blocks == nil {
+			continue
+		}
+		for _, block := range blocks.MinedBlocks {
+			d := day(block.Timestamp)
+			for login, reward := range block.Rewards {
+				if apiServer.exportLogin(login, address) {
+					d.Rewards += reward
+				}
+			}
+			if block.Solo {
+				continue
+			}
+
+			shares, _, ok := Storage_backend.GetPPLNSRoundShares(block.Height)
+			if !ok {
+				if rounds[block.RoundHeight] {
+					continue
+				}
+				rounds[block.RoundHeight] = true
+				shares, _, _ = Storage_backend.GetRoundShares(block.RoundHeight)
+			}
+			for id, value := range shares {
+				if apiServer.exportLogin(id, address) {
+					d.Shares += value
+				}
+			}
+		}
+	}
+
+	// Average hashrate by day, the chart keeps downsampled values for older days
+	hashrates := make(map[string][2]int64)
+	if charts := apiServer.backend.GetChartsData("minerhashrate:" + address); charts != nil {
+		for _, v := range charts.series(0, 0) {
+			d := day(v.Timestamp)
+			samples := v.Samples
+			if samples == 0 {
+				samples = 1
+			}
+			sum := hashrates[d.Date]
+			hashrates[d.Date] = [2]int64{sum[0] + v.Value*samples, sum[1] + samples}
+		}
+	}
+
+	summaries := make([]*ApiExportDay, 0, len(days))
+	for date, d := range days {
+		if sum := hashrates[date]; sum[1] > 0 {
+			d.Hashrate = sum[0] / sum[1]
+		}
+		summaries = append(summaries, d)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Date < summaries[j].Date
+	})
+	return payments, summaries
+}
+
+// Returns the atomic amount in coins, with as many decimals as coinUnits has
+func (apiServer *ApiServer) exportCoins(amount int64) string {
+	units := apiServer.stratum.currentConfig().CoinUnits
+	if units <= 1 {
+		return strconv.FormatInt(amount, 10)
+	}
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	decimals := len(strconv.FormatInt(units, 10)) - 1
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/units, decimals, amount%units)
+}
+
+func (apiServer *ApiServer) writeExportCSV(writer http.ResponseWriter, payments []*ApiExportPayment, days []*ApiExportDay) error {
+	w := csv.NewWriter(writer)
+	w.Write([]string{"type", "date", "timestamp", "txHash", "amount", "txFee", "shares", "hashrate", "rewards", "paid", "payments"})
+	for _, p := range payments {
+		date := time.Unix(p.Timestamp, 0).UTC().Format("2006-01-02")
+		w.Write([]string{"payment", date, strconv.FormatInt(p.Timestamp, 10), p.TxHash, apiServer.exportCoins(int64(p.Amount)), apiServer.exportCoins(int64(p.TxFee)), "", "", "", "", ""})
+	}
+	for _, d := range days {
+		w.Write([]string{"day", d.Date, "", "", "", "", strconv.FormatInt(d.Shares, 10), strconv.FormatInt(d.Hashrate, 10), apiServer.exportCoins(d.Rewards), apiServer.exportCoins(int64(d.Paid)), strconv.FormatInt(d.Payments, 10)})
+	}
+	w.Flush()
+	return w.Error()
+}
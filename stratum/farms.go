@@ -0,0 +1,156 @@
+package stratum
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// A farm registered by an admin [POST /api/admin/farms] for the farm ports, its sessions log in with the farm token as password. Only the sha256 of the token
+// is stored, the token itself is returned once on registration. With Address set, the farm can only log in as that address
+type Farm struct {
+	Name         string
+	Address      string `json:",omitempty"`
+	TokenHash    string `json:",omitempty"`
+	RegisteredAt int64
+}
+
+// Bytes of randomness of a farm token
+const farmTokenSize = 32
+
+func farmTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *StratumServer) loadFarms() {
+	s.farms = Graviton_backend.GetFarms()
+	if s.farms == nil {
+		s.farms = make(map[string]*Farm)
+	}
+	if len(s.farms) > 0 {
+		StratumInfoLogger.Printf("[Stratum] Loaded %v registered farms", len(s.farms))
+	}
+}
+
+// Returns the farm registered with token, nil if there is none
+func (s *StratumServer) farmByToken(token string) *Farm {
+	if token == "" {
+		return nil
+	}
+	hash := []byte(farmTokenHash(token))
+
+	s.farmsMu.RLock()
+	defer s.farmsMu.RUnlock()
+	for _, farm := range s.farms {
+		if subtle.ConstantTimeCompare(hash, []byte(farm.TokenHash)) == 1 {
+			return farm
+		}
+	}
+	return nil
+}
+
+// Registers the farm and returns its new token. Registering a farm again issues a new token, sessions logged in with the previous one are closed
+func (s *StratumServer) registerFarm(name, address string) (*Farm, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", errors.New("farm name is required")
+	}
+	if address != "" && !util.ValidateAddress(address, s.currentConfig().Address) {
+		return nil, "", errors.New("invalid farm address")
+	}
+
+	tokenBytes := make([]byte, farmTokenSize)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, "", err
+	}
+	token := hex.EncodeToString(tokenBytes)
+	farm := &Farm{Name: name, Address: address, TokenHash: farmTokenHash(token), RegisteredAt: util.MakeTimestamp() / 1000}
+
+	s.farmsMu.Lock()
+	s.farms[name] = farm
+	s.farmsMu.Unlock()
+	s.closeFarmSessions(name)
+
+	StratumInfoLogger.Printf("[Stratum] Registered farm %v, address: %v", name, address)
+	return farm, token, s.storeFarms()
+}
+
+// Removes the farm and closes its sessions, returns false if it is not registered
+func (s *StratumServer) removeFarm(name string) (bool, error) {
+	s.farmsMu.Lock()
+	_, ok := s.farms[name]
+	delete(s.farms, name)
+	s.farmsMu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	s.closeFarmSessions(name)
+
+	StratumInfoLogger.Printf("[Stratum] Removed farm %v", name)
+	return true, s.storeFarms()
+}
+
+func (s *StratumServer) storeFarms() error {
+	s.farmsMu.RLock()
+	farms := make(map[string]*Farm)
+	for k, v := range s.farms {
+		farms[k] = v
+	}
+	s.farmsMu.RUnlock()
+
+	writeWait, _ := time.ParseDuration("10ms")
+	for Graviton_backend.Writing == 1 {
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	err := Graviton_backend.OverwriteFarms(farms)
+	Graviton_backend.Writing = 0
+	return err
+}
+
+// Returns the registered farms by name without their token hash, with the number of sessions of each
+func (s *StratumServer) listFarms() ([]*Farm, map[string]int) {
+	sessions := make(map[string]int)
+	s.sessions.Range(func(cs *Session) {
+		if cs.farm != "" {
+			sessions[cs.farm]++
+		}
+	})
+
+	s.farmsMu.RLock()
+	farms := make([]*Farm, 0, len(s.farms))
+	for _, farm := range s.farms {
+		listed := *farm
+		listed.TokenHash = ""
+		farms = append(farms, &listed)
+	}
+	s.farmsMu.RUnlock()
+
+	sort.Slice(farms, func(i, j int) bool {
+		return farms[i].Name < farms[j].Name
+	})
+	return farms, sessions
+}
+
+// Closes the sessions logged in as the farm, so a new or removed token also ends the connections of the previous one
+func (s *StratumServer) closeFarmSessions(name string) {
+	var farmSessions []*Session
+	s.sessions.Range(func(cs *Session) {
+		if cs.farm == name {
+			farmSessions = append(farmSessions, cs)
+		}
+	})
+
+	for _, cs := range farmSessions {
+		StratumInfoLogger.Printf("[Stratum] Closing session %s of farm %s", cs.ip, name)
+		cs.conn.Close()
+	}
+}
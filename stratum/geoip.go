@@ -0,0 +1,293 @@
+package stratum
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// GeoInfo is the country/region/ASN a session ip is attributed to. Region is the ISO code of the country subdivision [e.g. state], "" if the database has none
+type GeoInfo struct {
+	Country string
+	Region  string
+	ASN     string
+}
+
+// GeoLookup resolves an ip to its GeoInfo. To plug in another GeoIP source, implement GeoLookup and set it as the stratum geo lookup
+type GeoLookup interface {
+	Lookup(ip net.IP) (*GeoInfo, bool)
+}
+
+type GeoStats struct {
+	Miners      int64
+	Connections int64
+	Hashrate    int64
+}
+
+type geoRange struct {
+	start []byte
+	end   []byte
+	info  *GeoInfo
+}
+
+// Built-in GeoLookup from a csv of network,country,asn[,region] lines [e.g. "1.0.0.0/24,AU,AS13335,QLD"], ranges are kept sorted for binary search
+type csvGeoDB struct {
+	ranges []geoRange
+}
+
+func loadGeoDB(path string) (*csvGeoDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	db := &csvGeoDB{}
+	var skipped int64
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			skipped++
+			continue
+		}
+
+		// Header lines and unparsable networks are skipped
+		_, network, err := net.ParseCIDR(strings.TrimSpace(record[0]))
+		if err != nil {
+			skipped++
+			continue
+		}
+
+		start := network.IP.To16()
+		end := make([]byte, len(start))
+		mask := network.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:net.IPv6len-net.IPv4len], mask...)
+		}
+		for i := range start {
+			end[i] = start[i] | ^mask[i]
+		}
+		info := &GeoInfo{Country: strings.TrimSpace(record[1]), ASN: strings.TrimSpace(record[2])}
+		if len(record) > 3 {
+			info.Region = strings.TrimSpace(record[3])
+		}
+		db.ranges = append(db.ranges, geoRange{start: start, end: end, info: info})
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].start, db.ranges[j].start) < 0
+	})
+
+	if skipped > 0 {
+		StratumErrorLogger.Printf("[Stratum] Skipped %v unparsable lines in %s", skipped, path)
+	}
+	return db, nil
+}
+
+func (db *csvGeoDB) Lookup(ip net.IP) (*GeoInfo, bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return nil, false
+	}
+
+	// Last range starting at or before the ip
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].start, ip) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip, db.ranges[i].end) > 0 {
+		return nil, false
+	}
+	return db.ranges[i].info, true
+}
+
+// GeoLookup from MaxMind databases [GeoIP2/GeoLite2 City or Country mmdb], with the ASN from a separate GeoLite2 ASN mmdb if given
+type maxmindGeoDB struct {
+	reader *geoip2.Reader
+	asn    *geoip2.Reader
+	city   bool
+}
+
+func loadMaxMindDB(path, asnPath string) (*maxmindGeoDB, error) {
+	reader, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	dbType := reader.Metadata().DatabaseType
+	if !strings.Contains(dbType, "City") && !strings.Contains(dbType, "Country") {
+		reader.Close()
+		return nil, fmt.Errorf("unsupported database type %s, a City or Country database is required", dbType)
+	}
+	db := &maxmindGeoDB{reader: reader, city: strings.Contains(dbType, "City")}
+
+	if asnPath != "" {
+		if db.asn, err = geoip2.Open(asnPath); err != nil {
+			reader.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+func (db *maxmindGeoDB) Lookup(ip net.IP) (*GeoInfo, bool) {
+	if ip == nil {
+		return nil, false
+	}
+
+	info := &GeoInfo{}
+	if db.city {
+		record, err := db.reader.City(ip)
+		if err != nil {
+			return nil, false
+		}
+		info.Country = record.Country.IsoCode
+		if len(record.Subdivisions) > 0 {
+			info.Region = record.Subdivisions[0].IsoCode
+		}
+	} else {
+		record, err := db.reader.Country(ip)
+		if err != nil {
+			return nil, false
+		}
+		info.Country = record.Country.IsoCode
+	}
+	if db.asn != nil {
+		if record, err := db.asn.ASN(ip); err == nil && record.AutonomousSystemNumber != 0 {
+			info.ASN = fmt.Sprintf("AS%d", record.AutonomousSystemNumber)
+		}
+	}
+
+	// Networks the database has no record of [e.g. private ranges] resolve to an empty country
+	if info.Country == "" {
+		return nil, false
+	}
+	if info.ASN == "" {
+		info.ASN = "unknown"
+	}
+	return info, true
+}
+
+// Loads a MaxMind database if the path ends in .mmdb and the built-in csv otherwise, returning a description of what was loaded for logging
+func loadGeoLookup(database, asnDatabase string) (GeoLookup, string, error) {
+	if strings.HasSuffix(strings.ToLower(database), ".mmdb") {
+		db, err := loadMaxMindDB(database, asnDatabase)
+		if err != nil {
+			return nil, "", err
+		}
+		return db, fmt.Sprintf("MaxMind %s database", db.reader.Metadata().DatabaseType), nil
+	}
+	db, err := loadGeoDB(database)
+	if err != nil {
+		return nil, "", err
+	}
+	return db, fmt.Sprintf("%v geoip ranges", len(db.ranges)), nil
+}
+
+// Tags the session and its miner with its country/region/ASN. Run in its own goroutine after login so lookups never block the login path
+func (s *StratumServer) enrichSession(cs *Session) {
+	info, ok := s.geo.Lookup(net.ParseIP(cs.ip))
+	if !ok {
+		return
+	}
+	cs.Lock()
+	cs.geo = info
+	miner := cs.miner
+	cs.Unlock()
+
+	// The miner keeps the location of its latest session, stored with its stats
+	if miner != nil {
+		miner.Lock()
+		miner.Country = info.Country
+		miner.Region = info.Region
+		miner.Unlock()
+	}
+}
+
+// Key of a region within the region breakdown, prefixed with its country as region codes are only unique within a country [e.g. US-CA]
+func geoRegionKey(geo *GeoInfo) string {
+	if geo.Country == "unknown" {
+		return geo.Country
+	}
+	if geo.Region == "" {
+		return geo.Country + "-unknown"
+	}
+	return geo.Country + "-" + geo.Region
+}
+
+// Aggregates live sessions and their miners' hashrate by country, region and ASN. A miner's hashrate is split evenly across its sessions
+func (s *StratumServer) geoStats() map[string]interface{} {
+	countries := make(map[string]*GeoStats)
+	regions := make(map[string]*GeoStats)
+	asns := make(map[string]*GeoStats)
+
+	type sessionGeo struct {
+		minerID string
+		geo     *GeoInfo
+	}
+	var sessions []sessionGeo
+	minerSessions := make(map[string]int64)
+	miners := make(map[string]*Miner)
+
+	s.sessions.Range(func(cs *Session) {
+		if cs.miner == nil {
+			return
+		}
+		cs.Lock()
+		geo := cs.geo
+		cs.Unlock()
+		if geo == nil {
+			geo = &GeoInfo{Country: "unknown", ASN: "unknown"}
+		}
+		sessions = append(sessions, sessionGeo{minerID: cs.miner.Id, geo: geo})
+		minerSessions[cs.miner.Id]++
+		miners[cs.miner.Id] = cs.miner
+	})
+
+	hashrates := make(map[string]int64)
+	for id, miner := range miners {
+		hashrates[id] = miner.getHashrate(s.estimationWindow, s.hashrateExpiration)
+	}
+
+	countryMiners := make(map[string]map[string]struct{})
+	regionMiners := make(map[string]map[string]struct{})
+	asnMiners := make(map[string]map[string]struct{})
+	add := func(groups map[string]*GeoStats, groupMiners map[string]map[string]struct{}, key, minerID string) {
+		if groups[key] == nil {
+			groups[key] = &GeoStats{}
+			groupMiners[key] = make(map[string]struct{})
+		}
+		groups[key].Connections++
+		groups[key].Hashrate += hashrates[minerID] / minerSessions[minerID]
+		if _, ok := groupMiners[key][minerID]; !ok {
+			groupMiners[key][minerID] = struct{}{}
+			groups[key].Miners++
+		}
+	}
+	for _, sg := range sessions {
+		add(countries, countryMiners, sg.geo.Country, sg.minerID)
+		add(regions, regionMiners, geoRegionKey(sg.geo), sg.minerID)
+		add(asns, asnMiners, sg.geo.ASN, sg.minerID)
+	}
+
+	geo := make(map[string]interface{})
+	geo["countries"] = countries
+	geo["regions"] = regions
+	geo["asns"] = asns
+	return geo
+}
@@ -0,0 +1,414 @@
+package stratum
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// HTTP getwork endpoint for browser and CPU miners which can not speak raw TCP stratum. Each getwork session is a stratum session of its own [login, jobs, vardiff,
+// shares and banning work as on a stratum port] whose connection is a getworkConn: jobs pushed to the session are kept as the current job instead of being written.
+//
+//	POST /getwork {"login", "pass"[, "rigid"]}            logs in, returns {"session", "id", "job"}. GET /getwork?login=<login>&pass=<pass> does as well
+//	GET  /getwork?session=<session>[&longpoll=<job_id>]  returns the current job, with longpoll once it is no longer job_id [or after longPollTimeout]
+//	POST /getwork {"session", "job_id", "nonce", "result"} submits a share
+type GetworkServer struct {
+	config   *pool.GetworkConfig
+	endpoint *Endpoint
+
+	sessionTimeout  time.Duration
+	longPollTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*getworkSession
+}
+
+type getworkSession struct {
+	cs       *Session
+	conn     *getworkConn
+	lastSeen int64
+}
+
+type GetworkReply struct {
+	Session string        `json:"session,omitempty"`
+	Id      string        `json:"id,omitempty"`
+	Job     *JobReplyData `json:"job,omitempty"`
+	Status  string        `json:"status,omitempty"`
+	Message string        `json:"message,omitempty"`
+	Error   *ErrorReply   `json:"error,omitempty"`
+}
+
+// Body of a getwork POST, a login without session and a submit with it
+type GetworkSubmit struct {
+	Session string `json:"session"`
+	Login   string `json:"login"`
+	Pass    string `json:"pass"`
+	RigId   string `json:"rigid"`
+	SubmitParams
+}
+
+// Bytes of randomness of a getwork session id
+const getworkSessionSize = 16
+
+func NewGetworkServer(cfg *pool.GetworkConfig, targetEncoding string) (*GetworkServer, error) {
+	_, portStr, err := net.SplitHostPort(cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &GetworkServer{config: cfg, sessions: make(map[string]*getworkSession)}
+	g.endpoint = NewEndpoint(&pool.Port{Difficulty: cfg.Difficulty, Port: port, MaxConnections: cfg.MaxSessions, Desc: "getwork"}, targetEncoding)
+
+	g.sessionTimeout, err = time.ParseDuration(cfg.SessionTimeout)
+	if err != nil || g.sessionTimeout <= 0 {
+		g.sessionTimeout = 5 * time.Minute
+	}
+	g.longPollTimeout, err = time.ParseDuration(cfg.LongPollTimeout)
+	if err != nil || g.longPollTimeout <= 0 {
+		g.longPollTimeout = 30 * time.Second
+	}
+	return g, nil
+}
+
+func (g *GetworkServer) Listen(s *StratumServer) {
+	s.listenersMu.Lock()
+	s.endpoints = append(s.endpoints, g.endpoint)
+	s.listenersMu.Unlock()
+
+	// Sessions not polled within sessionTimeout are gone [closed tab, stopped miner], they are removed like a disconnected stratum session
+	go func() {
+		ticker := time.NewTicker(g.sessionTimeout / 2)
+		for range ticker.C {
+			g.expireSessions()
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/getwork", func(writer http.ResponseWriter, r *http.Request) {
+		g.serve(s, writer, r)
+	})
+
+	StratumInfoLogger.Printf("[Stratum] Getwork listening on %s, diff: %v, session timeout: %v, long poll timeout: %v", g.config.Listen, g.config.Difficulty, g.sessionTimeout, g.longPollTimeout)
+	if err := http.ListenAndServe(g.config.Listen, mux); err != nil {
+		StratumErrorLogger.Printf("[Stratum] Getwork listener on %s failed: %v", g.config.Listen, err)
+	}
+}
+
+func (g *GetworkServer) serve(s *StratumServer, writer http.ResponseWriter, r *http.Request) {
+	if origin := corsOrigin(g.config.CorsOrigins, r.Header.Get("Origin")); origin != "" {
+		writer.Header().Set("Access-Control-Allow-Origin", origin)
+		writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	}
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	if !s.beginRequest() {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer s.endRequest()
+
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	var status int
+	var reply *GetworkReply
+	switch r.Method {
+	case "OPTIONS":
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	case "GET":
+		query := r.URL.Query()
+		if sessionID := query.Get("session"); sessionID != "" {
+			status, reply = g.getJob(s, sessionID, query.Get("longpoll"), r)
+		} else {
+			status, reply = g.login(s, ip, &LoginParams{Login: query.Get("login"), Pass: query.Get("pass"), Agent: r.UserAgent(), RigId: query.Get("rigid")})
+		}
+	case "POST":
+		// Same stratum messageLimits as a message of a stratum connection
+		limits := s.messageLimits()
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(limits.maxMessageSize)+1))
+		var params GetworkSubmit
+		switch {
+		case err != nil:
+			status, reply = http.StatusBadRequest, &GetworkReply{Error: &ErrorReply{Code: errCodeOther, Message: "Malformed submit"}}
+		case len(body) > limits.maxMessageSize:
+			status, reply = g.rejectMessage(s, ip, fmt.Sprintf("message over %v bytes", limits.maxMessageSize))
+		case jsonTooDeep(body, limits.maxDepth):
+			status, reply = g.rejectMessage(s, ip, fmt.Sprintf("nested deeper than %v", limits.maxDepth))
+		case json.Unmarshal(body, &params) != nil:
+			status, reply = http.StatusBadRequest, &GetworkReply{Error: &ErrorReply{Code: errCodeOther, Message: "Malformed submit"}}
+		case params.Session == "":
+			status, reply = g.login(s, ip, &LoginParams{Login: params.Login, Pass: params.Pass, Agent: r.UserAgent(), RigId: params.RigId})
+		default:
+			status, reply = g.submit(s, &params)
+		}
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if reply.Error != nil {
+		reply.Error = s.withHelp(reply.Error)
+	}
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(reply); err != nil {
+		StratumErrorLogger.Printf("[Stratum] Error serializing getwork reply to %s: %v", ip, err)
+	}
+}
+
+// Rejects a request over the messageLimits before it is decoded. Without a session to ban it is only counted and logged
+func (g *GetworkServer) rejectMessage(s *StratumServer, ip, reason string) (int, *GetworkReply) {
+	atomic.AddInt64(&s.oversizedMessages, 1)
+	StratumErrorLogger.Printf("[Stratum] Rejected getwork request from %s exceeding the message limits: %s", ip, reason)
+	return http.StatusRequestEntityTooLarge, &GetworkReply{Error: &ErrorReply{Code: errCodeMessageLimit, Message: "Request exceeds the message limits, " + reason}}
+}
+
+// Starts a session logged in as params, with the first job. An ip has at most maxSessionsPerIp sessions
+func (g *GetworkServer) login(s *StratumServer, ip string, params *LoginParams) (int, *GetworkReply) {
+	if params.Login == "" {
+		return http.StatusBadRequest, &GetworkReply{Error: &ErrorReply{Code: errCodeInvalidAddress, Message: "Missing login"}}
+	}
+	if _, banned := s.banning.isBanned(ip); banned {
+		HandlersDebugLogger.Printf("[Banning] Rejected getwork login from banned ip %s", ip)
+		return http.StatusForbidden, &GetworkReply{Error: &ErrorReply{Code: errCodeBannedIP, Message: "Banned ip, logins from it are rejected"}}
+	}
+	if !s.acquireConnection(g.endpoint) {
+		atomic.AddInt64(&s.rejectedConnections, 1)
+		return http.StatusServiceUnavailable, &GetworkReply{Error: &ErrorReply{Code: errCodePoolFull, Message: "Too many connections, please try again later"}}
+	}
+
+	token := make([]byte, getworkSessionSize)
+	if _, err := rand.Read(token); err != nil {
+		s.releaseConnection(g.endpoint)
+		return http.StatusInternalServerError, &GetworkReply{Error: &ErrorReply{Code: errCodeOther, Message: "Could not start session"}}
+	}
+	sessionID := hex.EncodeToString(token)
+
+	conn := newGetworkConn(ip)
+	cs := &Session{conn: conn, ip: ip, endpoint: g.endpoint, VarDiff: &VarDiff{}, send: make(chan []byte, s.writeQueueSize), extraNonce: atomic.AddUint32(&s.extraNonce, 1)}
+	go cs.writeLoop(s.writeTimeout)
+	gs := &getworkSession{cs: cs, conn: conn, lastSeen: util.MakeTimestamp() / 1000}
+	// Sessions closed by the pool [kicked, banned, write queue overflow] are dropped, as the read loop of a stratum session would on a closed connection
+	conn.onClose = func() { g.drop(s, sessionID) }
+
+	g.mu.Lock()
+	if max := g.config.MaxSessionsPerIp; max > 0 && g.sessionsOf(ip) >= max {
+		g.mu.Unlock()
+		cs.closeQueue()
+		s.releaseConnection(g.endpoint)
+		atomic.AddInt64(&s.rejectedConnections, 1)
+		return http.StatusTooManyRequests, &GetworkReply{Error: &ErrorReply{Code: errCodePoolFull, Message: "Too many getwork sessions from your ip"}}
+	}
+	g.sessions[sessionID] = gs
+	g.mu.Unlock()
+
+	if allowed, _ := cs.allowRequest(s, "login"); !allowed {
+		g.drop(s, sessionID)
+		return http.StatusTooManyRequests, &GetworkReply{Error: &ErrorReply{Code: errCodeOther, Message: "Rate limited"}}
+	}
+
+	if reason := s.messageLimits().checkLogin(params); reason != "" {
+		s.messageLimitExceeded(cs, reason)
+		g.drop(s, sessionID)
+		return http.StatusRequestEntityTooLarge, &GetworkReply{Error: &ErrorReply{Code: errCodeMessageLimit, Message: "Request exceeds the message limits, " + reason}}
+	}
+	jobReply, errReply := s.handleLoginRPC(cs, params)
+	if errReply != nil {
+		g.drop(s, sessionID)
+		return http.StatusForbidden, &GetworkReply{Error: errReply}
+	}
+	conn.setJob(jobReply.Job)
+
+	return http.StatusOK, &GetworkReply{Session: sessionID, Id: jobReply.Id, Job: jobReply.Job, Status: jobReply.Status}
+}
+
+// Returns the current job of the session. With longpoll set to the current job id, waits for the next job up to longPollTimeout
+func (g *GetworkServer) getJob(s *StratumServer, sessionID, longpoll string, r *http.Request) (int, *GetworkReply) {
+	gs := g.session(sessionID)
+	if gs == nil || gs.cs.miner == nil {
+		return http.StatusUnauthorized, &GetworkReply{Error: &ErrorReply{Code: errCodeUnauthenticated, Message: "Unauthenticated"}}
+	}
+	if allowed, disconnect := gs.cs.allowRequest(s, "getjob"); disconnect {
+		gs.conn.Close()
+		return http.StatusTooManyRequests, &GetworkReply{Error: &ErrorReply{Code: errCodeOther, Message: "Rate limit exceeded"}}
+	} else if !allowed {
+		return http.StatusTooManyRequests, &GetworkReply{Error: &ErrorReply{Code: errCodeOther, Message: "Rate limited"}}
+	}
+
+	job, changed := gs.conn.currentJob()
+	if longpoll != "" && job != nil && job.JobId == longpoll {
+		timeout := time.NewTimer(g.longPollTimeout)
+		select {
+		case <-changed:
+		case <-timeout.C:
+		case <-r.Context().Done():
+		}
+		timeout.Stop()
+		atomic.StoreInt64(&gs.lastSeen, util.MakeTimestamp()/1000)
+	}
+
+	// A new block template not pushed yet [e.g. the session joined during a broadcast] is fetched as with getjob
+	reply, errReply := s.handleGetJobRPC(gs.cs, &GetJobParams{Id: gs.cs.miner.Id})
+	if errReply != nil {
+		return http.StatusServiceUnavailable, &GetworkReply{Error: errReply}
+	}
+	if reply.JobId != "" {
+		gs.conn.setJob(reply)
+	}
+	job, _ = gs.conn.currentJob()
+	return http.StatusOK, &GetworkReply{Id: gs.cs.miner.Id, Job: job, Status: "OK"}
+}
+
+func (g *GetworkServer) submit(s *StratumServer, params *GetworkSubmit) (int, *GetworkReply) {
+	gs := g.session(params.Session)
+	if gs == nil || gs.cs.miner == nil {
+		return http.StatusUnauthorized, &GetworkReply{Error: &ErrorReply{Code: errCodeUnauthenticated, Message: "Unauthenticated"}}
+	}
+	if allowed, disconnect := gs.cs.allowRequest(s, "submit"); disconnect {
+		gs.conn.Close()
+		return http.StatusTooManyRequests, &GetworkReply{Error: &ErrorReply{Code: errCodeOther, Message: "Rate limit exceeded"}}
+	} else if !allowed {
+		return http.StatusTooManyRequests, &GetworkReply{Error: &ErrorReply{Code: errCodeOther, Message: "Rate limited"}}
+	}
+
+	params.Id = gs.cs.miner.Id
+	if reason := s.messageLimits().checkSubmit(&params.SubmitParams); reason != "" {
+		s.messageLimitExceeded(gs.cs, reason)
+		gs.conn.Close()
+		return http.StatusRequestEntityTooLarge, &GetworkReply{Error: &ErrorReply{Code: errCodeMessageLimit, Message: "Request exceeds the message limits, " + reason}}
+	}
+	reply, errReply := s.handleSubmitRPC(gs.cs, &params.SubmitParams)
+	if errReply != nil {
+		return http.StatusOK, &GetworkReply{Error: errReply}
+	}
+	return http.StatusOK, &GetworkReply{Status: reply.Status, Message: reply.Message}
+}
+
+// Returns the number of sessions of ip. Caller holds g.mu
+func (g *GetworkServer) sessionsOf(ip string) int {
+	var count int
+	for _, gs := range g.sessions {
+		if gs.cs.ip == ip {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns the session of id and marks it as seen, nil if there is none
+func (g *GetworkServer) session(id string) *getworkSession {
+	g.mu.Lock()
+	gs := g.sessions[id]
+	g.mu.Unlock()
+	if gs != nil {
+		atomic.StoreInt64(&gs.lastSeen, util.MakeTimestamp()/1000)
+	}
+	return gs
+}
+
+// Removes the session from getwork and the stratum sessions, safe to call more than once
+func (g *GetworkServer) drop(s *StratumServer, id string) {
+	g.mu.Lock()
+	gs, ok := g.sessions[id]
+	delete(g.sessions, id)
+	g.mu.Unlock()
+	if !ok {
+		return
+	}
+	s.removeSession(gs.cs)
+	s.releaseConnection(g.endpoint)
+}
+
+func (g *GetworkServer) expireSessions() {
+	cutoff := util.MakeTimestamp()/1000 - int64(g.sessionTimeout/time.Second)
+	var expired []*getworkSession
+	g.mu.Lock()
+	for _, gs := range g.sessions {
+		if atomic.LoadInt64(&gs.lastSeen) < cutoff {
+			expired = append(expired, gs)
+		}
+	}
+	g.mu.Unlock()
+
+	for _, gs := range expired {
+		HandlersDebugLogger.Printf("[Stratum] Getwork session of %s expired", gs.cs.ip)
+		gs.conn.Close()
+	}
+}
+
+// Connection of a getwork session. Job pushes written to it become the current job of the session and wake its long polls, other messages are discarded
+type getworkConn struct {
+	addr    net.Addr
+	mu      sync.Mutex
+	job     *JobReplyData
+	changed chan struct{}
+	closed  sync.Once
+	onClose func()
+}
+
+func newGetworkConn(ip string) *getworkConn {
+	return &getworkConn{addr: &net.TCPAddr{IP: net.ParseIP(ip)}, changed: make(chan struct{})}
+}
+
+// Sets the current job and wakes the long polls waiting on the previous one
+func (c *getworkConn) setJob(job *JobReplyData) {
+	if job == nil || job.JobId == "" {
+		return
+	}
+	c.mu.Lock()
+	c.job = job
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+}
+
+// Returns the current job and a channel closed once it is replaced
+func (c *getworkConn) currentJob() (*JobReplyData, chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.job, c.changed
+}
+
+func (c *getworkConn) Write(payload []byte) (int, error) {
+	var push struct {
+		Method string        `json:"method"`
+		Params *JobReplyData `json:"params"`
+	}
+	if json.Unmarshal(payload, &push) == nil && push.Method == "job" {
+		c.setJob(push.Params)
+	}
+	return len(payload), nil
+}
+
+func (c *getworkConn) Close() error {
+	c.closed.Do(func() {
+		if c.onClose != nil {
+			// Closed from within session handling [e.g. under the session shard lock], the session is dropped outside of it
+			go c.onClose()
+		}
+	})
+	return nil
+}
+
+func (c *getworkConn) Read(b []byte) (int, error)         { return 0, net.ErrClosed }
+func (c *getworkConn) LocalAddr() net.Addr                { return c.addr }
+func (c *getworkConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *getworkConn) SetDeadline(t time.Time) error      { return nil }
+func (c *getworkConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *getworkConn) SetWriteDeadline(t time.Time) error { return nil }
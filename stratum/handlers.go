@@ -2,6 +2,8 @@ package stratum
 
 import (
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"regexp"
@@ -24,20 +26,77 @@ const (
 var noncePattern *regexp.Regexp
 var HandlersInfoLogger = logFileOutHandlers("INFO")
 var HandlersErrorLogger = logFileOutHandlers("ERROR")
+var HandlersWarnLogger = logFileOutHandlers("WARN")
+var HandlersDebugLogger = logFileOutHandlers("DEBUG")
 
 func init() {
 	noncePattern, _ = regexp.Compile("^[0-9a-f]{8}$")
 }
 
 func (s *StratumServer) handleLoginRPC(cs *Session, params *LoginParams) (*JobReply, *ErrorReply) {
+	// A session which is already logged in is treated as a re-auth, see the session association below
+	prevMiner := cs.miner
+
+	// Sessions still open while shutting down are about to be closed
+	if prevMiner == nil && s.isShuttingDown() {
+		return nil, &ErrorReply{Code: errCodePoolUnavailable, Message: "Pool is restarting, please reconnect"}
+	}
+
+	// Politely reject new logins while in maintenance mode, existing sessions keep working
+	if prevMiner == nil && s.inMaintenance() {
+		message := s.currentConfig().Stratum.MaintenanceMessage
+		if message == "" {
+			message = "Pool is under maintenance, please try again later"
+		}
+		HandlersInfoLogger.Printf("[Handlers] Rejected login from %s during maintenance mode", cs.ip)
+		return nil, &ErrorReply{Code: errCodePoolUnavailable, Message: message}
+	}
+
+	// Reject miners advertising an algorithm list [xmrig "algo"] without the algorithm currently mined, rather than have all of their shares rejected
+	algo := s.algo
+	if t := s.currentBlockTemplate(); t != nil {
+		algo = t.Algo
+	}
+	if !minerSupportsAlgo(params.Algo, algo) {
+		HandlersErrorLogger.Printf("[Handlers] Rejected login from %s, miner algorithms %v do not include the pool algorithm %s - %s", cs.ip, params.Algo, algo, params.Login)
+		return nil, &ErrorReply{Code: errCodeUnsupportedAlgo, Message: "Unsupported algorithm, this pool mines " + algo}
+	}
+
+	// Farm ports only take sessions of registered farms, logged in with their farm token as password
+	var farm *Farm
+	if cs.endpoint.config.Farm {
+		if farm = s.farmByToken(params.Pass); farm == nil {
+			HandlersErrorLogger.Printf("[Handlers] Rejected login from %s on farm port %v without a registered farm token - %s", cs.ip, cs.endpoint.config.Port, params.Login)
+			return nil, &ErrorReply{Code: errCodeFarmAuth, Message: "Farm port, login with a registered farm token as password"}
+		}
+	}
 
 	var id string
+	// Payout settings are split off first, their value may hold the other separators [e.g. "." of fixedDiff in "#0.5"]
+	login, payoutSettings := s.splitPayoutSettings(params.Login)
 	// Login validation / splitting optimized by Peppinux (https://github.com/peppinux)
-	address, workID, paymentid, fixDiff, donatePerc, isSolo := s.splitLoginString(params.Login)
+	address, workID, paymentid, fixDiff, donatePerc, isSolo := s.splitLoginString(login)
+
+	// Without a worker suffix in the login, use the xmrig rig id as worker id
+	if (workID == "" || workID == address) && strings.TrimSpace(params.RigId) != "" {
+		workID = strings.TrimSpace(params.RigId)
+	}
+
+	// Every miner on a solo port mines solo, without needing the solo address prefix
+	soloPort := cs.endpoint.config.PoolMode == "solo"
+	if soloPort {
+		isSolo = true
+	}
 
 	// Initially set cs.difficulty. If there's no fixDiff defined, inside of cs.getJob the diff target will be set to cs.endpoint.difficulty,
 	// otherwise will be set to fixDiff (as long as it's above min diff in config)
 	if fixDiff != 0 {
+		// Reject fixed difficulties below the port's absolute floor outright, so a miner cannot flood the server with trivial shares
+		if floor := cs.endpoint.config.DiffFloor; floor > 0 && fixDiff < uint64(floor) {
+			HandlersErrorLogger.Printf("[Handlers] Rejected login from %s with fixed difficulty %v below the port %v floor of %v - %s", cs.ip, fixDiff, cs.endpoint.config.Port, floor, params.Login)
+			return nil, &ErrorReply{Code: errCodeBelowMinDiff, Message: fmt.Sprintf("Fixed difficulty is below the minimum of %v for this port", floor)}
+		}
+
 		// If fixDiff is lower than mindiff, set equal to mindiff
 		if fixDiff < uint64(cs.endpoint.config.MinDiff) {
 			fixDiff = uint64(cs.endpoint.config.MinDiff)
@@ -49,6 +108,12 @@ func (s *StratumServer) handleLoginRPC(cs *Session, params *LoginParams) (*JobRe
 		cs.isFixedDiff = false
 	}
 
+	// Farms mine at the port difficulty, their hashrate is known upfront and is not retargeted
+	if farm != nil {
+		cs.difficulty = cs.endpoint.config.Difficulty
+		cs.isFixedDiff = true
+	}
+
 	// Take care of less than 0 or greater than 100 vals for donate percentages
 	if donatePerc < 0 {
 		donatePerc = 0
@@ -62,14 +127,12 @@ func (s *StratumServer) handleLoginRPC(cs *Session, params *LoginParams) (*JobRe
 			_, err := hex.DecodeString(paymentid)
 
 			if err != nil {
-				log.Printf("[Handlers] Invalid paymentID %s used for login by %s - %s", paymentid, cs.ip, params.Login)
 				HandlersErrorLogger.Printf("[Handlers] Invalid paymentID %s used for login by %s - %s", paymentid, cs.ip, params.Login)
-				return nil, &ErrorReply{Code: -1, Message: "Invalid paymentID used for login"}
+				return nil, &ErrorReply{Code: errCodeMalformedPaymentID, Message: "Invalid paymentID used for login"}
 			}
 		} else {
-			log.Printf("[Handlers] Invalid paymentID %s used for login by %s - %s", paymentid, cs.ip, params.Login)
 			HandlersErrorLogger.Printf("[Handlers] Invalid paymentID %s used for login by %s - %s", paymentid, cs.ip, params.Login)
-			return nil, &ErrorReply{Code: -1, Message: "Invalid paymentID used for login"}
+			return nil, &ErrorReply{Code: errCodeMalformedPaymentID, Message: "Invalid paymentID used for login"}
 		}
 
 		// Adding paymentid onto the worker id because later when payments are processed, it's easily identifiable what is the paymentid to supply for creating tx etc.
@@ -77,12 +140,12 @@ func (s *StratumServer) handleLoginRPC(cs *Session, params *LoginParams) (*JobRe
 	}
 
 	// If solo is used, then add solo: to front of id for logging
-	if isSolo && s.config.Stratum.SoloMining.Enabled {
+	if isSolo && (s.currentConfig().Stratum.SoloMining.Enabled || soloPort) {
 		if id != "" {
 			// If id is not "" (default value upon var), then it must have a paymentid
-			id = "solo" + s.config.Stratum.SoloMining.AddressSeparator + id
+			id = "solo" + s.currentConfig().Stratum.SoloMining.AddressSeparator + id
 		} else {
-			id = "solo" + s.config.Stratum.SoloMining.AddressSeparator + address
+			id = "solo" + s.currentConfig().Stratum.SoloMining.AddressSeparator + address
 		}
 	}
 
@@ -90,10 +153,10 @@ func (s *StratumServer) handleLoginRPC(cs *Session, params *LoginParams) (*JobRe
 	if workID != address && workID != "" {
 		if id != "" {
 			// If id is not "" (default value upon var), then it must have a paymentid or is solo and has been set. So append workID to it
-			id = id + s.config.Stratum.WorkerID.AddressSeparator + workID
+			id = id + s.currentConfig().Stratum.WorkerID.AddressSeparator + workID
 		} else {
 			// If id is "" (default value upon var), then it does not have paymentid and append workID to address normally
-			id = address + s.config.Stratum.WorkerID.AddressSeparator + workID
+			id = address + s.currentConfig().Stratum.WorkerID.AddressSeparator + workID
 		}
 	} else {
 		if id == "" {
@@ -102,36 +165,76 @@ func (s *StratumServer) handleLoginRPC(cs *Session, params *LoginParams) (*JobRe
 		}
 	}
 
-	switch s.config.Coin {
+	switch s.currentConfig().Coin {
 	case "DERO":
-		if !util.ValidateAddress(address, s.config.Address) {
-			log.Printf("[Handlers] Invalid address %s used for login by %s", address, cs.ip)
-			HandlersErrorLogger.Printf("[Handlers] Invalid address %s used for login by %s", address, cs.ip)
-			return nil, &ErrorReply{Code: -1, Message: "Invalid address used for login"}
+		info, err := util.ParseAddress(address, s.currentConfig().Address)
+		if errors.Is(err, util.ErrAddressWrongNetwork) {
+			HandlersErrorLogger.Printf("[Handlers] Wrong network address %s used for login by %s: %v", address, cs.ip, err)
+			return nil, &ErrorReply{Code: errCodeWrongNetwork, Message: "Wrong network address used for login, " + util.AddressNetwork(address) + " address used on a " + util.AddressNetwork(s.currentConfig().Address) + " pool"}
+		} else if err != nil {
+			HandlersErrorLogger.Printf("[Handlers] Malformed address %s used for login by %s: %v", address, cs.ip, err)
+			reason := err.Error()
+			if addrErr, ok := err.(*util.AddressError); ok {
+				reason = addrErr.Reason
+			}
+			return nil, &ErrorReply{Code: errCodeInvalidAddress, Message: "Malformed address used for login, " + reason}
+		}
+
+		// The payment id of an integrated address is part of the address, a second one from the login would not be used by the wallet
+		if info.Integrated && paymentid != "" {
+			HandlersErrorLogger.Printf("[Handlers] Integrated address %s used with paymentID %s for login by %s", address, paymentid, cs.ip)
+			return nil, &ErrorReply{Code: errCodeMalformedPaymentID, Message: "Integrated address used for login with a paymentID, the address already contains paymentID " + info.PaymentID}
+		}
+		if !info.Integrated && paymentid == "" && s.isServiceAddress(address) {
+			HandlersErrorLogger.Printf("[Handlers] Service address %s used without a paymentID for login by %s", address, cs.ip)
+			return nil, &ErrorReply{Code: errCodeMalformedPaymentID, Message: "Service address used for login without a paymentID, login with " + address + s.currentConfig().Stratum.PaymentID.AddressSeparator + "<paymentID> or its integrated address"}
 		}
 	default:
-		if !util.ValidateAddressNonDERO(address, s.config.Address) {
-			log.Printf("[Handlers] Invalid address %s used for login by %s", address, cs.ip)
+		if !util.ValidateAddressNonDERO(address, s.currentConfig().Address) {
 			HandlersErrorLogger.Printf("[Handlers] Invalid address %s used for login by %s", address, cs.ip)
-			return nil, &ErrorReply{Code: -1, Message: "Invalid address used for login"}
+			return nil, &ErrorReply{Code: errCodeInvalidAddress, Message: "Invalid address used for login"}
+		}
+	}
+
+	if errReply := s.addressLists.check(address); errReply != nil {
+		HandlersErrorLogger.Printf("[Handlers] Rejected login from %s with address %s: %s", cs.ip, address, errReply.Message)
+		return nil, errReply
+	}
+
+	if farm != nil && farm.Address != "" && farm.Address != address {
+		HandlersErrorLogger.Printf("[Handlers] Rejected login from %s as farm %s with address %s, the farm is registered for %s", cs.ip, farm.Name, address, farm.Address)
+		return nil, &ErrorReply{Code: errCodeFarmAuth, Message: "Farm token is registered for another address"}
+	}
+
+	// Payout settings from the login apply to the address, so to every worker and paymentID of it. Anyone can log in with any address, so they are only stored after the session's first accepted share
+	if payoutSettings != "" {
+		threshold, interval, err := s.parsePayoutSettings(payoutSettings)
+		if err != nil {
+			HandlersErrorLogger.Printf("[Handlers] Invalid payout settings %s used for login by %s: %v - %s", payoutSettings, cs.ip, err, params.Login)
+			return nil, &ErrorReply{Code: errCodeInvalidPayoutSettings, Message: "Invalid payout settings used for login, " + err.Error()}
 		}
+		cs.Lock()
+		cs.pendingPayoutSettings = &MinerSettings{Threshold: threshold, Interval: interval}
+		cs.Unlock()
 	}
 
 	t := s.currentBlockTemplate()
 	if t == nil {
-		return nil, &ErrorReply{Code: -1, Message: "Job not ready"}
+		return nil, &ErrorReply{Code: errCodePoolUnavailable, Message: "Job not ready"}
 	}
 
 	miner, ok := s.miners.Get(id)
 	if !ok {
-		log.Printf("[Handlers] Registering new miner: %s@%s, Address: %s, PaymentID: %s, fixedDiff: %v, donatePercent: %v, isSolo: %v", id, cs.ip, address, paymentid, fixDiff, donatePerc, isSolo)
-		HandlersInfoLogger.Printf("[Handlers] Registering new miner: %s@%s, Address: %s, PaymentID: %s, fixedDiff: %v, donatePercent: %v, isSolo: %v", id, cs.ip, address, paymentid, fixDiff, donatePerc, isSolo)
 		miner = NewMiner(id, address, paymentid, fixDiff, workID, donatePerc, isSolo, cs.ip)
+		if s.restoreEvictedMiner(miner) {
+			HandlersInfoLogger.Printf("[Handlers] Restoring evicted miner: %s@%s", id, cs.ip)
+		} else {
+			HandlersInfoLogger.Printf("[Handlers] Registering new miner: %s@%s, Address: %s, PaymentID: %s, fixedDiff: %v, donatePercent: %v, isSolo: %v", id, cs.ip, address, paymentid, fixDiff, donatePerc, isSolo)
+		}
 		s.registerMiner(miner)
 
 		writeWait, _ := time.ParseDuration("10ms")
 		for Graviton_backend.Writing == 1 {
-			//log.Printf("[Handlers-handleLoginRPC] GravitonDB is writing... sleeping for %v...", writeWait)
 			//StorageInfoLogger.Printf("[Handlers-handleLoginRPC] GravitonDB is writing... sleeping for %v...", writeWait)
 			time.Sleep(writeWait)
 		}
@@ -140,7 +243,10 @@ func (s *StratumServer) handleLoginRPC(cs *Session, params *LoginParams) (*JobRe
 		Graviton_backend.Writing = 0
 	} else {
 		now := util.MakeTimestamp() / 1000
-		miner.StartedAt = now
+		// Re-auth as the same miner on the same session keeps its stats running
+		if prevMiner != miner {
+			miner.StartedAt = now
+		}
 		miner.DonatePercent = donatePerc
 		miner.PaymentID = paymentid
 		miner.FixedDiff = fixDiff
@@ -148,25 +254,75 @@ func (s *StratumServer) handleLoginRPC(cs *Session, params *LoginParams) (*JobRe
 		miner.WorkID = workID
 	}
 
-	log.Printf("[Handlers] Miner connected %s@%s, Address: %s, PaymentID: %s, fixedDiff: %v, donatePercent: %v, isSolo: %v", id, cs.ip, address, paymentid, fixDiff, donatePerc, isSolo)
-	HandlersInfoLogger.Printf("[Handlers] Miner connected %s@%s, Address: %s, PaymentID: %s, fixedDiff: %v, donatePercent: %v, isSolo: %v", id, cs.ip, address, paymentid, fixDiff, donatePerc, isSolo)
+	// Start reconnecting miners near their steady-state difficulty from their previous session, truly new miners stay at the endpoint default
+	if !cs.isFixedDiff && s.currentConfig().Stratum.VarDiff.Enabled && s.currentConfig().Stratum.VarDiff.RestoreDiff {
+		lastDiff := atomic.LoadInt64(&miner.LastDifficulty)
+		if lastDiff == 0 && !ok {
+			if storedMiner := Graviton_backend.GetMinerStatsByID(id); storedMiner != nil {
+				lastDiff = storedMiner.LastDifficulty
+			}
+		}
+		if lastDiff > 0 {
+			minDiff, maxDiff := cs.endpoint.varDiffBounds(&s.currentConfig().Stratum.VarDiff)
+			if lastDiff < minDiff {
+				lastDiff = minDiff
+			} else if lastDiff > maxDiff {
+				lastDiff = maxDiff
+			}
+			HandlersInfoLogger.Printf("[Handlers] Restoring difficulty %v from previous session for %s@%s", lastDiff, id, cs.ip)
+			cs.difficulty = lastDiff
+		}
+	}
+	if !cs.isFixedDiff {
+		atomic.StoreInt64(&miner.LastDifficulty, cs.difficulty)
+	}
+
+	if farm != nil {
+		cs.farm = farm.Name
+	} else {
+		cs.farm = ""
+	}
+	if !s.registerSession(cs, miner) {
+		HandlersErrorLogger.Printf("[Handlers] Rejected login from %s, miner %s is at the max of %v connections", cs.ip, id, s.currentConfig().Stratum.MaxMinerConnections)
+		return nil, &ErrorReply{Code: errCodeMinerConnections, Message: fmt.Sprintf("Too many connections for this miner, the maximum is %v", s.currentConfig().Stratum.MaxMinerConnections)}
+	}
 
-	s.registerSession(cs)
+	HandlersInfoLogger.Printf("[Handlers] Miner connected %s@%s, Address: %s, PaymentID: %s, fixedDiff: %v, donatePercent: %v, isSolo: %v", id, cs.ip, address, paymentid, fixDiff, donatePerc, isSolo)
 	miner.heartbeat()
+	if s.geo != nil && prevMiner == nil {
+		go s.enrichSession(cs)
+	}
+
+	// Re-auth: if the session switched miners, the previous miner is detached from the session, otherwise the association is left as is
+	switch prevMiner {
+	case nil:
+		s.webhooks.MinerConnected(miner, cs.ip)
+	case miner:
+		HandlersInfoLogger.Printf("[Handlers] Miner %s@%s re-authenticated on the same session", id, cs.ip)
+	default:
+		HandlersInfoLogger.Printf("[Handlers] Session %s switched from miner %s to %s", cs.ip, prevMiner.Id, id)
+		s.webhooks.MinerDisconnected(prevMiner, cs.ip)
+		s.webhooks.MinerConnected(miner, cs.ip)
+	}
 
 	//log.Printf("[handleGetJobRPC] getJob: %v", cs.getJob(t))
 	job := cs.getJob(t, s, 0)
-	return &JobReply{Id: id, Job: job, Status: "OK"}, nil
+	reply := &JobReply{Id: id, Job: job, Status: "OK"}
+	// Tells miners such as xmrig to keep the reserved nonce byte
+	if cs.endpoint.config.NiceHash {
+		reply.Extensions = []string{"nicehash"}
+	}
+	return reply, nil
 }
 
 func (s *StratumServer) handleGetJobRPC(cs *Session, params *GetJobParams) (*JobReplyData, *ErrorReply) {
-	miner, ok := s.miners.Get(params.Id)
+	miner, ok := s.sessionMiner(cs, params.Id)
 	if !ok {
-		return nil, &ErrorReply{Code: -1, Message: "Unauthenticated"}
+		return nil, &ErrorReply{Code: errCodeUnauthenticated, Message: "Unauthenticated"}
 	}
 	t := s.currentBlockTemplate()
 	if t == nil || s.isSick() {
-		return nil, &ErrorReply{Code: -1, Message: "Job not ready"}
+		return nil, &ErrorReply{Code: errCodePoolUnavailable, Message: "Job not ready"}
 	}
 	miner.heartbeat()
 
@@ -174,52 +330,220 @@ func (s *StratumServer) handleGetJobRPC(cs *Session, params *GetJobParams) (*Job
 	return reply, nil
 }
 
+// Keepalives keep NAT mappings of idle miners open. The session deadline is refreshed on every request in handleClient, so this only counts as a heartbeat of a logged in miner
+func (s *StratumServer) handleKeepAliveRPC(cs *Session, params *KeepAliveParams) *StatusReply {
+	if cs.miner != nil {
+		cs.miner.heartbeat()
+	}
+	return &StatusReply{Status: "KEEPALIVED"}
+}
+
+// Returns the miner of id only if this session is logged in as it. s.miners keeps miners without live sessions for stats, so membership alone would let a session getjob/submit as any stored miner
+func (s *StratumServer) sessionMiner(cs *Session, id string) (*Miner, bool) {
+	miner, ok := s.miners.Get(id)
+	if !ok || cs.miner != miner {
+		return nil, false
+	}
+	return miner, true
+}
+
 func (s *StratumServer) handleSubmitRPC(cs *Session, params *SubmitParams) (*StatusReply, *ErrorReply) {
-	miner, ok := s.miners.Get(params.Id)
+	miner, ok := s.sessionMiner(cs, params.Id)
 	if !ok {
-		return nil, &ErrorReply{Code: -1, Message: "Unauthenticated"}
+		return nil, &ErrorReply{Code: errCodeUnauthenticated, Message: "Unauthenticated"}
 	}
 	miner.heartbeat()
 
 	// Upon job submissions, miner(s) will get error message saying to contact pool owner when stratum .isSick()
 	if s.isSick() {
-		return nil, &ErrorReply{Code: -1, Message: "Server error. Contact pool owner."}
+		return nil, &ErrorReply{Code: errCodeOther, Message: "Server error. Contact pool owner."}
 	}
 
-	job := cs.findJob(params.JobId)
+	job, expired := cs.findJob(s, params.JobId)
+	if expired {
+		HandlersErrorLogger.Printf("[Handlers] Share for expired job %s from %s@%s", params.JobId, miner.Id, cs.ip)
+		atomic.AddInt64(&miner.StaleShares, 1)
+		atomic.AddInt64(&s.shareMetrics.Stale, 1)
+		atomic.AddInt64(&cs.endpoint.shares.Stale, 1)
+		return nil, &ErrorReply{Code: errCodeJobNotFound, Message: "Job not found or expired"}
+	}
 	if job == nil {
-		return nil, &ErrorReply{Code: -1, Message: "Invalid job id"}
+		return nil, &ErrorReply{Code: errCodeJobNotFound, Message: "Invalid job id"}
 	}
 
 	if !noncePattern.MatchString(params.Nonce) {
-		return nil, &ErrorReply{Code: -1, Message: "Malformed nonce"}
+		cs.untrust()
+		s.banning.recordShare(s, cs, false)
+		return nil, &ErrorReply{Code: errCodeOther, Message: "Malformed nonce"}
 	}
 	nonce := strings.ToLower(params.Nonce)
-	exist := job.submit(nonce)
+	// On nicehash ports the reserved nonce byte must be kept as sent in the job
+	if cs.nicehashNonce != "" && nonce[6:] != cs.nicehashNonce {
+		atomic.AddInt64(&miner.InvalidShares, 1)
+		atomic.AddInt64(&s.shareMetrics.Invalid, 1)
+		atomic.AddInt64(&cs.endpoint.shares.Invalid, 1)
+		cs.untrust()
+		s.banning.recordShare(s, cs, false)
+		return nil, &ErrorReply{Code: errCodeOther, Message: "Invalid nonce, the nicehash nonce byte was modified"}
+	}
+	// Ports with extraNonceSize take the connection part of the reserved space with the share, it has to be of that size
+	extraNonce := strings.ToLower(params.ExtraNonce)
+	if size := cs.endpoint.extraNonceSize(s.currentBlockTemplate()); extraNonce != "" || size > 0 {
+		if _, err := hex.DecodeString(extraNonce); err != nil || len(extraNonce) != size*2 {
+			atomic.AddInt64(&miner.InvalidShares, 1)
+			atomic.AddInt64(&s.shareMetrics.Invalid, 1)
+			atomic.AddInt64(&cs.endpoint.shares.Invalid, 1)
+			cs.untrust()
+			s.banning.recordShare(s, cs, false)
+			return nil, &ErrorReply{Code: errCodeOther, Message: fmt.Sprintf("Malformed extranonce, expected %v hex bytes", size)}
+		}
+		params.ExtraNonce = extraNonce
+	}
+	exist, full := job.submit(nonce+extraNonce, s.currentConfig().Stratum.MaxJobSubmissions)
 	if exist {
 		atomic.AddInt64(&miner.InvalidShares, 1)
-		return nil, &ErrorReply{Code: -1, Message: "Duplicate share"}
+		atomic.AddInt64(&s.shareMetrics.Invalid, 1)
+		atomic.AddInt64(&cs.endpoint.shares.Invalid, 1)
+		cs.untrust()
+		s.banning.recordShare(s, cs, false)
+		return nil, &ErrorReply{Code: errCodeDuplicateShare, Message: "Duplicate share"}
 	}
 
 	t := s.currentBlockTemplate()
+	// In proxy mode shares are validated against the upstream job they were mined on, as long as it is of the current height
+	if job.template != nil && job.template.Height == t.Height {
+		t = job.template
+	}
+
+	// The job reached maxJobSubmissions, reject the share and push a new job [new extranonce] so the miner carries on without losing more than this share
+	if full {
+		HandlersErrorLogger.Printf("[Handlers] Job %s reached %v submissions from %s@%s, pushing a new job", job.id, s.currentConfig().Stratum.MaxJobSubmissions, miner.Id, cs.ip)
+		if job.height == t.Height {
+			reply := cs.getJob(t, s, 0)
+			if err := cs.pushMessage("job", &reply); err != nil {
+				HandlersErrorLogger.Printf("[Handlers] Job transmit error to %s: %v", cs.ip, err)
+			}
+		}
+		return nil, &ErrorReply{Code: errCodeJobNotFound, Message: "Job share limit reached, switching to a new job"}
+	}
+	// Shares for the previous height are accepted within staleGracePeriod of the template change [network latency always overlaps], validated against the previous template
+	late := false
+	if job.height != t.Height {
+		if prev := s.graceBlockTemplate(t, job.height); prev != nil {
+			t, late = prev, true
+			if job.template != nil {
+				t = job.template
+			}
+		}
+	}
 	if job.height != t.Height {
-		log.Printf("[Handlers] Stale share for height %d from %s@%s", job.height, miner.Id, cs.ip)
 		HandlersErrorLogger.Printf("[Handlers] Stale share for height %d from %s@%s", job.height, miner.Id, cs.ip)
 		atomic.AddInt64(&miner.StaleShares, 1)
-		return nil, &ErrorReply{Code: -1, Message: "Block expired"}
+		atomic.AddInt64(&s.shareMetrics.Stale, 1)
+		atomic.AddInt64(&cs.endpoint.shares.Stale, 1)
+		return nil, &ErrorReply{Code: errCodeJobNotFound, Message: "Block expired"}
 	}
 
-	validShare, minerOutput := miner.processShare(s, cs, job, t, nonce, params)
+	// Per-job duplicate detection above is per session, also check across all sessions of the same miner so the same work can't be re-credited from a sibling session.
+	// Keyed by the work like shareCache, a client could vary the result it sends
+	shareKey := shareCacheKey(job, extraNonce, nonce)
+	if miner.submit(job.height, shareKey) {
+		HandlersErrorLogger.Printf("[Handlers] Duplicate share across sessions for height %d from %s@%s", job.height, miner.Id, cs.ip)
+		atomic.AddInt64(&miner.InvalidShares, 1)
+		atomic.AddInt64(&s.shareMetrics.Invalid, 1)
+		atomic.AddInt64(&cs.endpoint.shares.Invalid, 1)
+		cs.untrust()
+		s.banning.recordShare(s, cs, false)
+		return nil, &ErrorReply{Code: errCodeDuplicateShare, Message: "Duplicate share"}
+	}
+
+	// Both checks above are bound to a session or miner id, the same work submitted after a reconnect, to another port or as another worker is caught pool-wide
+	if s.shareCache.submit(job, extraNonce, nonce) {
+		HandlersErrorLogger.Printf("[Handlers] Duplicate share within shareCacheTtl for height %d from %s@%s", job.height, miner.Id, cs.ip)
+		atomic.AddInt64(&miner.InvalidShares, 1)
+		atomic.AddInt64(&s.shareMetrics.Invalid, 1)
+		atomic.AddInt64(&cs.endpoint.shares.Invalid, 1)
+		cs.untrust()
+		s.banning.recordShare(s, cs, false)
+		return nil, &ErrorReply{Code: errCodeDuplicateShare, Message: "Duplicate share"}
+	}
+
+	validShare, minerOutput, errCode := miner.processShare(s, cs, job, t, nonce, params, late)
 	if !validShare {
-		return nil, &ErrorReply{Code: -1, Message: minerOutput}
+		miner.forgetShare(job.height, shareKey)
+		s.shareCache.forget(job, extraNonce, nonce)
+		return nil, &ErrorReply{Code: errCode, Message: minerOutput}
+	}
+	cs.Lock()
+	pending := cs.pendingPayoutSettings
+	cs.pendingPayoutSettings = nil
+	cs.Unlock()
+	if pending != nil {
+		if _, err := s.setPayoutSettings(miner.Address, pending.Threshold, pending.Interval); err != nil {
+			HandlersErrorLogger.Printf("[Handlers] Could not set payout settings of %s: %v", miner.Address, err)
+		}
+	}
+
+	reply := &StatusReply{Status: "OK", Message: minerOutput}
+	if s.currentConfig().Stratum.ShareFeedback {
+		// processShare already checked the result, so it decodes to a difficulty
+		hashBytes, _ := hex.DecodeString(params.Result)
+		if hashDiff, ok := util.GetHashDifficulty(hashBytes); ok && hashDiff.IsUint64() {
+			reply.ShareDifficulty = hashDiff.Uint64()
+		}
+		reply.RoundShares = s.minerRoundShares(miner)
+	}
+	return reply, nil
+}
+
+func (s *StratumServer) handleUnknownRPC(cs *Session, req *JSONRpcReq) *ErrorReply {
+	// Only log the full request on the first occurrence per connection and once per unknownMethodLogInterval per IP, otherwise log at debug level so the logs cannot be spammed
+	first := atomic.AddInt64(&cs.unknownMethods, 1) == 1
+	if first && s.allowUnknownRPCLog(cs.ip) {
+		HandlersErrorLogger.Printf("[Handlers] Unknown RPC method from %s: %v", cs.ip, req)
+	} else {
+		HandlersDebugLogger.Printf("[Handlers] Unknown RPC method %q from %s", req.Method, cs.ip)
+	}
+	return &ErrorReply{Code: errCodeInvalidMethod, Message: "Invalid method"}
+}
+
+// Rate limits unknown RPC method logging per IP to once per unknownMethodLogInterval
+func (s *StratumServer) allowUnknownRPCLog(ip string) bool {
+	now := util.MakeTimestamp() / 1000
+	intv := int64(s.unknownMethodLogIntv / time.Second)
+
+	s.unknownMethodsMu.Lock()
+	defer s.unknownMethodsMu.Unlock()
+
+	if last, ok := s.unknownMethodsLog[ip]; ok && now-last < intv {
+		return false
 	}
-	return &StatusReply{Status: "OK", Message: minerOutput}, nil
+	s.unknownMethodsLog[ip] = now
+
+	return true
 }
 
-func (s *StratumServer) handleUnknownRPC(req *JSONRpcReq) *ErrorReply {
-	log.Printf("[Handlers] Unknown RPC method: %v", req)
-	HandlersErrorLogger.Printf("[Handlers] Unknown RPC method: %v", req)
-	return &ErrorReply{Code: -1, Message: "Invalid method"}
+// Drops the IPs whose unknownMethodLogInterval ran out, so the map does not grow unbounded. Returns the interval to prune again after
+func (s *StratumServer) pruneUnknownRPCLog() time.Duration {
+	now := util.MakeTimestamp() / 1000
+	intv := int64(s.unknownMethodLogIntv / time.Second)
+
+	s.unknownMethodsMu.Lock()
+	defer s.unknownMethodsMu.Unlock()
+	for ip, last := range s.unknownMethodsLog {
+		if now-last >= intv {
+			delete(s.unknownMethodsLog, ip)
+		}
+	}
+	return s.unknownMethodLogIntv
+}
+
+func (s *StratumServer) isSupportedMethod(method string) bool {
+	if s.supportedMethods == nil {
+		return true
+	}
+	_, ok := s.supportedMethods[method]
+	return ok
 }
 
 func (s *StratumServer) broadcastNewJobs() {
@@ -227,30 +551,33 @@ func (s *StratumServer) broadcastNewJobs() {
 	if t == nil || s.isSick() {
 		return
 	}
-	s.sessionsMu.RLock()
-	defer s.sessionsMu.RUnlock()
-	count := len(s.sessions)
-	log.Printf("[Handlers] Broadcasting new jobs to %d miners", count)
+	if s.inMaintenance() && s.currentConfig().Stratum.MaintenancePauseJobs {
+		return
+	}
+	count := s.sessions.Count()
 	HandlersInfoLogger.Printf("[Handlers] Broadcasting new jobs to %d miners", count)
-	bcast := make(chan int, 1024*16)
-	n := 0
 
-	for m := range s.sessions {
-		n++
-		bcast <- n
-		go func(cs *Session) {
-			reply := cs.getJob(t, s, 0)
-			err := cs.pushMessage("job", &reply)
+	start := time.Now()
+	s.broadcastMetrics.broadcastStarted(count)
+
+	// Pushes only queue the job to each session writer, a slow miner overflows its own queue and is dropped without holding up the others
+	var failed []*Session
+	s.sessions.Range(func(cs *Session) {
+		reply := cs.getJob(t, s, 0)
+		err := cs.pushMessage("job", &reply)
+		s.broadcastMetrics.pushFinished(err != nil, len(cs.send))
+		if err != nil {
+			HandlersErrorLogger.Printf("[Handlers] Job transmit error to %s: %v", cs.ip, err)
+			failed = append(failed, cs)
+		} else {
+			s.setDeadline(cs.conn)
+		}
+	})
+	s.broadcastMetrics.broadcastFinished(time.Since(start))
 
-			<-bcast
-			if err != nil {
-				log.Printf("[Handlers] Job transmit error to %s: %v", cs.ip, err)
-				HandlersErrorLogger.Printf("[Handlers] Job transmit error to %s: %v", cs.ip, err)
-				s.removeSession(cs)
-			} else {
-				s.setDeadline(cs.conn)
-			}
-		}(m)
+	// removeSession locks the shard of the session, so failed sessions are removed once the broadcast released the shards
+	for _, cs := range failed {
+		s.removeSession(cs)
 	}
 }
 
@@ -259,67 +586,88 @@ func (s *StratumServer) updateFixedDiffJobs() {
 	if t == nil || s.isSick() {
 		return
 	}
-	s.sessionsMu.RLock()
-	defer s.sessionsMu.RUnlock()
-	bcast := make(chan int, 1024*16)
-	n := 0
-
-	for m := range s.sessions {
-		n++
-		bcast <- n
-		go func(cs *Session) {
-			// If fixed diff, ignore cycling update miner jobs
-			if !cs.isFixedDiff {
-				preJob := cs.difficulty
-				newDiff := cs.calcVarDiff(float64(preJob), s)
-				// If job diffs aren't the same, advertise new job
-				if preJob != newDiff {
-					reply := cs.getJob(t, s, newDiff)
-					log.Printf("[Handlers] Retargetting difficulty from %v to %v for %v", preJob, newDiff, cs.ip)
-					HandlersInfoLogger.Printf("[Handlers] Retargetting difficulty from %v to %v for %v", preJob, newDiff, cs.ip)
-					cs.difficulty = newDiff
-					err := cs.pushMessage("job", &reply)
-					<-bcast
-					if err != nil {
-						log.Printf("[Handlers] Job transmit error to %s: %v", cs.ip, err)
-						HandlersErrorLogger.Printf("[Handlers] Job transmit error to %s: %v", cs.ip, err)
-						s.removeSession(cs)
-					} else {
-						s.setDeadline(cs.conn)
-					}
-				}
-			}
-		}(m)
+	var failed []*Session
+	s.sessions.Range(func(cs *Session) {
+		// If fixed diff or the difficulty is overridden by an admin, ignore cycling update miner jobs
+		if cs.isFixedDiff || s.getDiffOverride(cs.miner) > 0 {
+			return
+		}
+		preJob := cs.difficulty
+		newDiff := cs.calcVarDiff(float64(preJob), s)
+		// If job diffs aren't the same, advertise new job
+		if preJob == newDiff {
+			return
+		}
+		// With retargetKeepJob, only the target of the current job changes and the miner carries on with its blob
+		var reply *JobReplyData
+		if s.currentConfig().Stratum.RetargetKeepJob {
+			reply = cs.retargetJob(t, s, newDiff)
+		} else {
+			reply = cs.getJob(t, s, newDiff)
+		}
+		HandlersInfoLogger.Printf("[Handlers] Retargetting difficulty from %v to %v for %v", preJob, newDiff, cs.ip)
+		cs.difficulty = newDiff
+		if cs.miner != nil {
+			atomic.StoreInt64(&cs.miner.LastDifficulty, newDiff)
+		}
+		if err := cs.pushMessage("job", &reply); err != nil {
+			HandlersErrorLogger.Printf("[Handlers] Job transmit error to %s: %v", cs.ip, err)
+			failed = append(failed, cs)
+		} else {
+			s.setDeadline(cs.conn)
+		}
+	})
+
+	for _, cs := range failed {
+		s.removeSession(cs)
 	}
 }
 
-func (s *StratumServer) refreshBlockTemplate(bcast bool) {
-	newBlock := s.fetchBlockTemplate()
+// Fetches the block template, broadcasting it if bcast and it is new. Returns whether it was new. Refreshes are serialized, polling and daemon notifications may overlap
+func (s *StratumServer) refreshBlockTemplate(bcast bool) bool {
+	s.templateRefreshMu.Lock()
+	defer s.templateRefreshMu.Unlock()
+
+	newBlock := s.fetchBlockTemplate(false)
+	if !newBlock && s.templateStalled() {
+		newBlock = s.forceRefreshBlockTemplate()
+	}
 	if newBlock && bcast {
 		s.broadcastNewJobs()
 	}
+	return newBlock
 }
 
 // Optimized splitting functions with runes from @Peppinux (https://github.com/peppinux)
+// Returns whether address is one of the configured paymentId serviceAddresses [e.g. exchange deposit addresses], which are only paid out with a payment id
+func (s *StratumServer) isServiceAddress(address string) bool {
+	for _, serviceAddress := range s.currentConfig().Stratum.PaymentID.ServiceAddresses {
+		if address == serviceAddress {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *StratumServer) splitLoginString(loginWorkerPair string) (addr, wid, pid string, diff uint64, donperc int64, isSolo bool) {
 	currParam := paramAddr // String always starts with ADDRESS
 	currSubstr := ""       // Substring starts empty
 
 	// Check for solo:
-	soloPair := "solo" + s.config.Stratum.SoloMining.AddressSeparator
+	soloPair := "solo" + s.currentConfig().Stratum.SoloMining.AddressSeparator
 	if strings.Index(loginWorkerPair, soloPair) != -1 {
 		isSolo = true
 		loginWorkerPair = loginWorkerPair[5:len(loginWorkerPair)] // shave off 5 since solo: is 5 chars, but isSolo will return true to be used to append solo: afterwards [retains addr result properly]
-		log.Printf("%s", loginWorkerPair)
+		HandlersDebugLogger.Printf("%s", loginWorkerPair)
 	} else {
 		isSolo = false
 	}
 
 	// Since input vals from json are string, need to convert to a rune array, then references just use [0] slice since these are just '@', '+', '.' in config.json
-	widAddrSep := []rune(s.config.Stratum.WorkerID.AddressSeparator)
-	pidAddrSep := []rune(s.config.Stratum.PaymentID.AddressSeparator)
-	fDiffAddrSep := []rune(s.config.Stratum.FixedDiff.AddressSeparator)
-	donPercAddrSep := []rune(s.config.Stratum.DonatePercent.AddressSeparator)
+	widAddrSep := []rune(s.currentConfig().Stratum.WorkerID.AddressSeparator)
+	pidAddrSep := []rune(s.currentConfig().Stratum.PaymentID.AddressSeparator)
+	fDiffAddrSep := []rune(s.currentConfig().Stratum.FixedDiff.AddressSeparator)
+	donPercAddrSep := []rune(s.currentConfig().Stratum.DonatePercent.AddressSeparator)
 
 	lastPos := len(loginWorkerPair) - 1
 	for pos, c := range loginWorkerPair {
@@ -361,13 +709,8 @@ func (s *StratumServer) splitLoginString(loginWorkerPair string) (addr, wid, pid
 	return
 }
 
-func logFileOutHandlers(lType string) *log.Logger {
-	var logFileName string
-	if lType == "ERROR" {
-		logFileName = "logs/handlersError.log"
-	} else {
-		logFileName = "logs/handlers.log"
-	}
+func logFileOutHandlers(lType string) *util.Logger {
+	logFileName := util.LogFileName("handlers", lType)
 	os.Mkdir("logs", 0705)
 	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0705)
 	if err != nil {
@@ -376,5 +719,5 @@ func logFileOutHandlers(lType string) *log.Logger {
 
 	logType := lType + ": "
 	l := log.New(f, logType, log.LstdFlags|log.Lmicroseconds)
-	return l
+	return util.NewLogger("handlers", lType, l)
 }
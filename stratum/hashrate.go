@@ -0,0 +1,90 @@
+package stratum
+
+import (
+	"time"
+)
+
+// Rolling hashrate windows reported next to the estimationWindow hashrate
+const (
+	hashrateShortWindow = 10 * time.Minute
+	hashrateLongWindow  = time.Hour
+
+	// Accepted share difficulty is summed per bucket, the buckets cover hashrateLongWindow
+	hashrateBucketSeconds = 60
+	hashrateBuckets       = int(hashrateLongWindow / time.Second / hashrateBucketSeconds)
+)
+
+// Accepted share difficulty of a miner over the last hashrateLongWindow in buckets of hashrateBucketSeconds, so the hashrate over any window up to it is the difficulty summed
+// within the window over its duration regardless of the difficulty each share was submitted at. Stored with the miner stats and guarded by the miner lock
+type ShareWindow struct {
+	// Difficulty sum of each bucket and the bucket [unix time / hashrateBucketSeconds] it holds, a bucket is reset when reused for a later one
+	Difficulty []int64
+	Bucket     []int64
+	StartedAt  int64
+}
+
+func NewShareWindow(now int64) *ShareWindow {
+	return &ShareWindow{Difficulty: make([]int64, hashrateBuckets), Bucket: make([]int64, hashrateBuckets), StartedAt: now}
+}
+
+// Adds an accepted share of difficulty diff at timestamp ts
+func (w *ShareWindow) add(ts, diff int64) {
+	// Stored windows of another bucket count are started over
+	if len(w.Difficulty) != hashrateBuckets || len(w.Bucket) != hashrateBuckets {
+		*w = *NewShareWindow(ts)
+	}
+	bucket := ts / hashrateBucketSeconds
+	i := int(bucket % int64(hashrateBuckets))
+	if w.Bucket[i] != bucket {
+		w.Bucket[i] = bucket
+		w.Difficulty[i] = 0
+	}
+	w.Difficulty[i] += diff
+}
+
+// Returns the hashrate over the last window [up to hashrateLongWindow] at now. A window started less than window ago is averaged over the time since it started
+func (w *ShareWindow) hashrate(window time.Duration, now int64) int64 {
+	if w == nil || len(w.Difficulty) != hashrateBuckets || len(w.Bucket) != hashrateBuckets {
+		return 0
+	}
+	buckets := int64(window / time.Second / hashrateBucketSeconds)
+	if buckets <= 0 || buckets > int64(hashrateBuckets) {
+		buckets = int64(hashrateBuckets)
+	}
+
+	// The current bucket is only filled up to now
+	current := now / hashrateBucketSeconds
+	duration := (buckets-1)*hashrateBucketSeconds + now - current*hashrateBucketSeconds + 1
+	if since := now - w.StartedAt + 1; since < duration {
+		duration = since
+	}
+	if duration <= 0 {
+		return 0
+	}
+
+	var difficulty int64
+	for i, bucket := range w.Bucket {
+		if bucket > current-buckets && bucket <= current {
+			difficulty += w.Difficulty[i]
+		}
+	}
+	return difficulty / duration
+}
+
+// Adds an accepted share to the rolling hashrate windows of the miner. Caller holds the miner lock
+func (m *Miner) addShareDifficulty(ts, diff int64) {
+	if diff <= 0 {
+		return
+	}
+	if m.ShareWindow == nil {
+		m.ShareWindow = NewShareWindow(ts)
+	}
+	m.ShareWindow.add(ts, diff)
+}
+
+// Returns the miner hashrate over the last hashrateShortWindow and hashrateLongWindow
+func (m *Miner) getRollingHashrates(now int64) (int64, int64) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.ShareWindow.hashrate(hashrateShortWindow, now), m.ShareWindow.hashrate(hashrateLongWindow, now)
+}
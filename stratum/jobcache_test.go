@@ -0,0 +1,104 @@
+package stratum
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const jobCacheTestBlobSize = 200
+
+func newJobCacheTestTemplate(cached bool, fill byte) *BlockTemplate {
+	t := &BlockTemplate{Buffer: make([]byte, jobCacheTestBlobSize), Reserved_Offset: 120}
+	for i := range t.Buffer {
+		t.Buffer[i] = fill + byte(i)
+	}
+	if cached {
+		t.jobCache = &jobCache{targets: make(map[int64]string)}
+	}
+	return t
+}
+
+// The cache only saves work, jobs of a cached template are identical to those built from scratch
+func TestJobCacheMatchesUncached(t *testing.T) {
+	s := &StratumServer{instanceId: []byte{1, 2, 3}}
+	cached, uncached := newJobCacheTestTemplate(true, 7), newJobCacheTestTemplate(false, 7)
+	for i := uint32(0); i < 100; i++ {
+		reserved := s.reservedBytes(i, cached.nextJobSlot())
+		if blob, expected := cached.cachedBlob(reserved), uncached.nextBlob(reserved); blob != expected {
+			t.Fatalf("job %v: cached blob %v, expected %v", i, blob, expected)
+		}
+	}
+	for _, encoding := range []string{"uint32", "uint64"} {
+		for _, diff := range []int64{1000, 35000, 1000000} {
+			cached.jobCache.targets = make(map[int64]string)
+			first, again := cached.cachedTarget(diff, encoding), cached.cachedTarget(diff, encoding)
+			if expected := uncached.cachedTarget(diff, encoding); first != expected || again != expected {
+				t.Fatalf("%v: cached target %v then %v of difficulty %v, expected %v", encoding, first, again, diff, expected)
+			}
+		}
+	}
+}
+
+// Sessions building jobs while the template swaps each get a job entirely of one template, never a mix of both
+func TestJobCacheTemplateSwap(t *testing.T) {
+	var current atomic.Value
+	current.Store(newJobCacheTestTemplate(true, 0))
+
+	expected := make(map[byte]string)
+	for _, fill := range []byte{0, 1, 2, 3} {
+		expected[fill] = newJobCacheTestTemplate(false, fill).nextBlob(make([]byte, reservedPoolSize))
+	}
+
+	var wg sync.WaitGroup
+	mixed := make(chan string, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 2000; j++ {
+				template := current.Load().(*BlockTemplate)
+				blob := template.cachedBlob(make([]byte, reservedPoolSize))
+				template.cachedTarget(int64(1000+j%10), "uint32")
+				if blob != expected[template.Buffer[0]] {
+					select {
+					case mixed <- blob:
+					default:
+					}
+					return
+				}
+			}
+		}()
+	}
+	for _, fill := range []byte{1, 2, 3} {
+		current.Store(newJobCacheTestTemplate(true, fill))
+	}
+	wg.Wait()
+	close(mixed)
+	for blob := range mixed {
+		t.Fatalf("job blob %v matches no template", blob)
+	}
+}
+
+// Builds the blob and target of a getjob under concurrent load, without and with the job cache
+func benchmarkGetJob(b *testing.B, cached bool) {
+	s := &StratumServer{instanceId: []byte{1, 2, 3}}
+	template := newJobCacheTestTemplate(cached, 0)
+	var extraNonce uint32
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			reserved := s.reservedBytes(atomic.AddUint32(&extraNonce, 1), template.nextJobSlot())
+			template.cachedBlob(reserved)
+			template.cachedTarget(35000, "uint32")
+		}
+	})
+}
+
+func BenchmarkGetJobUncached(b *testing.B) {
+	benchmarkGetJob(b, false)
+}
+
+func BenchmarkGetJobCached(b *testing.B) {
+	benchmarkGetJob(b, true)
+}
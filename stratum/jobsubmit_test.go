@@ -0,0 +1,105 @@
+package stratum
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const jobSubmitTestMax = 4096
+
+func newJobSubmitTestJob() *Job {
+	return &Job{id: "1", submissions: make(map[string]struct{})}
+}
+
+// Nonces are recorded until the job is full, a full job rejects new nonces and still detects the duplicates of those it holds
+func TestJobSubmitCap(t *testing.T) {
+	job := newJobSubmitTestJob()
+	for i := 0; i < jobSubmitTestMax; i++ {
+		if exist, full := job.submit(fmt.Sprintf("%08x", i), jobSubmitTestMax); exist || full {
+			t.Fatalf("nonce %v: duplicate %v, full %v before the cap", i, exist, full)
+		}
+	}
+	if exist, full := job.submit("00000000", jobSubmitTestMax); !exist || full {
+		t.Fatalf("duplicate of a recorded nonce: duplicate %v, full %v", exist, full)
+	}
+	if exist, full := job.submit("ffffffff", jobSubmitTestMax); exist || !full {
+		t.Fatalf("new nonce of a full job: duplicate %v, full %v", exist, full)
+	}
+	// Nonces are never evicted, the rejected nonce is not recorded either
+	if exist, full := job.submit(fmt.Sprintf("%08x", jobSubmitTestMax-1), jobSubmitTestMax); !exist || full {
+		t.Fatalf("duplicate of the last recorded nonce: duplicate %v, full %v", exist, full)
+	}
+	if remembered := len(job.submissions); remembered != jobSubmitTestMax {
+		t.Fatalf("job remembers %v nonces, expected %v", remembered, jobSubmitTestMax)
+	}
+}
+
+// Without a cap, every nonce is remembered
+func TestJobSubmitUnbounded(t *testing.T) {
+	job := newJobSubmitTestJob()
+	for i := 0; i < 2*jobSubmitTestMax; i++ {
+		if _, full := job.submit(fmt.Sprintf("%08x", i), 0); full {
+			t.Fatalf("nonce %v: unbounded job full", i)
+		}
+	}
+	if remembered := len(job.submissions); remembered != 2*jobSubmitTestMax {
+		t.Fatalf("job remembers %v nonces, expected %v", remembered, 2*jobSubmitTestMax)
+	}
+}
+
+// Sessions submitting to a single job concurrently never grow it past the cap, and each nonce is accepted at most once
+func TestJobSubmitBoundedUnderLoad(t *testing.T) {
+	job := newJobSubmitTestJob()
+	var accepted, full int64
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < jobSubmitTestMax; j++ {
+				// Every nonce is submitted by two goroutines
+				exist, isFull := job.submit(fmt.Sprintf("%02x%08x", i/2, j), jobSubmitTestMax)
+				switch {
+				case isFull:
+					atomic.AddInt64(&full, 1)
+				case !exist:
+					atomic.AddInt64(&accepted, 1)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if remembered := len(job.submissions); remembered != jobSubmitTestMax {
+		t.Fatalf("job remembers %v nonces, expected the cap of %v", remembered, jobSubmitTestMax)
+	}
+	if accepted != jobSubmitTestMax {
+		t.Fatalf("%v nonces accepted, expected %v", accepted, jobSubmitTestMax)
+	}
+	if full == 0 {
+		t.Fatalf("no nonce rejected by the full job")
+	}
+}
+
+// Submits unique nonces to a single job from many goroutines, reporting the nonces the job ends up remembering
+func benchmarkJobSubmit(b *testing.B, max int) {
+	job := newJobSubmitTestJob()
+	var nonce uint64
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			job.submit(fmt.Sprintf("%016x", atomic.AddUint64(&nonce, 1)), max)
+		}
+	})
+	b.ReportMetric(float64(len(job.submissions)), "nonces")
+}
+
+func BenchmarkJobSubmitUnbounded(b *testing.B) {
+	benchmarkJobSubmit(b, 0)
+}
+
+func BenchmarkJobSubmitCapped(b *testing.B) {
+	benchmarkJobSubmit(b, jobSubmitTestMax)
+}
@@ -0,0 +1,201 @@
+package stratum
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+	"github.com/Nelbert442/dero-golang-pool/util"
+	"github.com/gorilla/websocket"
+)
+
+// Event pushed to live stats subscribers, Type is one of block, payment, stats, network or miner
+type LiveEvent struct {
+	Type      string      `json:"type"`
+	Timestamp int64       `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// Fans out live events to the websocket clients of /api/live. Publishing never blocks, clients too slow to keep up with their send buffer are dropped
+type LiveHub struct {
+	mu         sync.RWMutex
+	clients    map[*liveClient]struct{}
+	maxClients int
+	upgrader   websocket.Upgrader
+}
+
+type liveClient struct {
+	conn    *websocket.Conn
+	send    chan []byte
+	address string
+	closed  sync.Once
+}
+
+const (
+	liveSendBuffer   = 64
+	liveWriteTimeout = 10 * time.Second
+	livePingInterval = 30 * time.Second
+)
+
+func NewLiveHub(cfg *pool.APIConfig) *LiveHub {
+	maxClients := cfg.LiveMaxClients
+	if maxClients <= 0 {
+		maxClients = 1000
+	}
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 4096,
+		// Same origins as the json api, the frontend may be served from another host. Clients without an Origin are not browsers
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || corsOrigin(cfg.CorsOrigins, origin) != ""
+		},
+	}
+	return &LiveHub{clients: make(map[*liveClient]struct{}), maxClients: maxClients, upgrader: upgrader}
+}
+
+// Publishes the event to every client
+func (h *LiveHub) publish(eventType string, data interface{}) {
+	h.publishTo("", eventType, data)
+}
+
+// Publishes the event to the clients subscribed to address [?address=<address>], every client when address is ""
+func (h *LiveHub) publishTo(address, eventType string, data interface{}) {
+	if h == nil {
+		return
+	}
+	payload, err := json.Marshal(&LiveEvent{Type: eventType, Timestamp: util.MakeTimestamp() / 1000, Data: data})
+	if err != nil {
+		APIErrorLogger.Printf("[API] Error serializing live %s event: %v", eventType, err)
+		return
+	}
+
+	var slow []*liveClient
+	h.mu.RLock()
+	for c := range h.clients {
+		if address != "" && c.address != address {
+			continue
+		}
+		select {
+		case c.send <- payload:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, c := range slow {
+		h.remove(c)
+	}
+}
+
+// Returns the addresses clients are subscribed to, so per address events are only built for those
+func (h *LiveHub) subscribedAddresses() map[string]struct{} {
+	addresses := make(map[string]struct{})
+	if h == nil {
+		return addresses
+	}
+	h.mu.RLock()
+	for c := range h.clients {
+		if c.address != "" {
+			addresses[c.address] = struct{}{}
+		}
+	}
+	h.mu.RUnlock()
+	return addresses
+}
+
+func (h *LiveHub) remove(c *liveClient) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+	c.closed.Do(func() {
+		close(c.send)
+	})
+}
+
+// Upgrades the request to a websocket and streams live events until the client disconnects
+func (h *LiveHub) serve(writer http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	full := len(h.clients) >= h.maxClients
+	h.mu.RUnlock()
+	if full {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(writer, r, nil)
+	if err != nil {
+		APIErrorLogger.Printf("[API] Live stats upgrade failed from %v: %v", r.RemoteAddr, err)
+		return
+	}
+
+	c := &liveClient{conn: conn, send: make(chan []byte, liveSendBuffer), address: r.URL.Query().Get("address")}
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+
+	go c.writeLoop()
+
+	// Clients only receive, reading detects the disconnect and handles pong/close frames
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(2 * livePingInterval))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(2 * livePingInterval))
+		return nil
+	})
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	h.remove(c)
+}
+
+func (c *liveClient) writeLoop() {
+	ping := time.NewTicker(livePingInterval)
+	defer func() {
+		ping.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case payload, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-ping.C:
+			c.conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Block event of a found [candidate], matured or orphaned block. The finder address is trimmed the same as in /api/blocks
+type LiveBlock struct {
+	Height     int64
+	Hash       string
+	Address    string
+	Difficulty int64
+	Reward     uint64
+	Solo       bool
+	State      string
+}
+
+func newLiveBlock(block *BlockDataGrav, state string) *LiveBlock {
+	address := block.Address
+	if len(address) > 12 {
+		address = address[0:7] + "..." + address[len(address)-5:]
+	}
+	return &LiveBlock{Height: block.Height, Hash: block.Hash, Address: address, Difficulty: block.Difficulty, Reward: block.Reward, Solo: block.Solo, State: state}
+}
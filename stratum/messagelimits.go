@@ -0,0 +1,197 @@
+package stratum
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+// Size of the read buffer of a stratum connection
+const messageReadBuffer = 4096
+
+// Defaults of the stratum messageLimits left unset
+const (
+	defaultMaxMessageSize = MaxReqSize
+	defaultMaxDepth       = 8
+	defaultMaxLogin       = 256
+	defaultMaxPass        = 256
+	defaultMaxAgent       = 256
+	defaultMaxJobId       = 64
+	defaultMaxField       = 128
+
+	// Hex lengths of a submitted nonce [4 bytes] and result [32 byte hash]
+	maxNonceHex  = 8
+	maxResultHex = 64
+)
+
+// Limits of the messages read from a stratum session, checked before a request is handled. Oversized logins would otherwise be walked rune by rune in splitLoginString
+type messageLimits struct {
+	maxMessageSize int
+	maxDepth       int
+	maxLogin       int
+	maxPass        int
+	maxAgent       int
+	maxJobId       int
+	maxField       int
+	ban            bool
+}
+
+// Returns the stratum messageLimits of the running config with defaults for the unset ones
+func (s *StratumServer) messageLimits() *messageLimits {
+	cfg := s.currentConfig().Stratum.MessageLimits
+	limit := func(value, def int) int {
+		if value <= 0 {
+			return def
+		}
+		return value
+	}
+	return &messageLimits{
+		maxMessageSize: limit(cfg.MaxMessageSize, defaultMaxMessageSize),
+		maxDepth:       limit(cfg.MaxDepth, defaultMaxDepth),
+		maxLogin:       limit(cfg.MaxLogin, defaultMaxLogin),
+		maxPass:        limit(cfg.MaxPass, defaultMaxPass),
+		maxAgent:       limit(cfg.MaxAgent, defaultMaxAgent),
+		maxJobId:       limit(cfg.MaxJobId, defaultMaxJobId),
+		maxField:       limit(cfg.MaxField, defaultMaxField),
+		ban:            cfg.Ban,
+	}
+}
+
+// Returns whether the json in data nests arrays and objects deeper than max. Brackets within strings are skipped
+func jsonTooDeep(data []byte, max int) bool {
+	var depth int
+	var inString, escaped bool
+	for _, c := range data {
+		if inString {
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+			if depth > max {
+				return true
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return false
+}
+
+// Returns why the request envelope exceeds the limits, "" if it does not. Its nesting is checked with jsonTooDeep before decoding
+func (l *messageLimits) checkRequest(req *JSONRpcReq) string {
+	if len(req.Method) > l.maxField {
+		return fmt.Sprintf("method of %v bytes", len(req.Method))
+	}
+	if req.Id != nil && len(*req.Id) > l.maxField {
+		return fmt.Sprintf("id of %v bytes", len(*req.Id))
+	}
+	return ""
+}
+
+// Returns the id of a request rejected by checkRequest to reply with, nil if the id itself is over the limits
+func (l *messageLimits) replyId(req *JSONRpcReq) *json.RawMessage {
+	if req.Id != nil && len(*req.Id) > l.maxField {
+		return nil
+	}
+	return req.Id
+}
+
+// Reads the next line of r, without its line ending, put together from the reads of the buffer of r. Returns tooLong once the line is over max bytes, without
+// reading the rest of it
+func readMessage(r *bufio.Reader, max int) ([]byte, bool, error) {
+	var message []byte
+	for {
+		data, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, false, err
+		}
+		if len(message)+len(data) > max {
+			return nil, true, nil
+		}
+		if !isPrefix && message == nil {
+			// The whole line was in the buffer, data is only valid until the next read but is handled before it
+			return data, false, nil
+		}
+		message = append(message, data...)
+		if !isPrefix {
+			return message, false, nil
+		}
+	}
+}
+
+func (l *messageLimits) checkLogin(params *LoginParams) string {
+	switch {
+	case len(params.Login) > l.maxLogin:
+		return fmt.Sprintf("login of %v bytes", len(params.Login))
+	case len(params.Pass) > l.maxPass:
+		return fmt.Sprintf("pass of %v bytes", len(params.Pass))
+	case len(params.Agent) > l.maxAgent:
+		return fmt.Sprintf("agent of %v bytes", len(params.Agent))
+	case len(params.RigId) > l.maxField:
+		return fmt.Sprintf("rigid of %v bytes", len(params.RigId))
+	case len(params.Algo) > l.maxField:
+		return fmt.Sprintf("%v algorithms", len(params.Algo))
+	}
+	for _, algo := range params.Algo {
+		if len(algo) > l.maxField {
+			return fmt.Sprintf("algorithm of %v bytes", len(algo))
+		}
+	}
+	return ""
+}
+
+func (l *messageLimits) checkSubmit(params *SubmitParams) string {
+	switch {
+	case len(params.Id) > l.maxField:
+		return fmt.Sprintf("id of %v bytes", len(params.Id))
+	case len(params.JobId) > l.maxJobId:
+		return fmt.Sprintf("job id of %v bytes", len(params.JobId))
+	case len(params.Nonce) > maxNonceHex:
+		return fmt.Sprintf("nonce of %v bytes", len(params.Nonce))
+	case len(params.Result) > maxResultHex:
+		return fmt.Sprintf("result of %v bytes", len(params.Result))
+	case len(params.ExtraNonce) > l.maxField:
+		return fmt.Sprintf("extranonce of %v bytes", len(params.ExtraNonce))
+	}
+	return ""
+}
+
+func (l *messageLimits) checkId(id string) string {
+	if len(id) > l.maxField {
+		return fmt.Sprintf("id of %v bytes", len(id))
+	}
+	return ""
+}
+
+// Counts a message over the limits, banning the session ip with messageLimits ban [and banning enabled]. Farm sessions are not banned
+func (s *StratumServer) messageLimitExceeded(cs *Session, reason string) {
+	atomic.AddInt64(&s.oversizedMessages, 1)
+	StratumErrorLogger.Printf("[Stratum] Rejected request from %s exceeding the message limits: %s", cs.ip, reason)
+
+	if !s.messageLimits().ban || s.banning == nil || cs.farm != "" {
+		return
+	}
+	banDuration := s.banning.duration()
+	StratumErrorLogger.Printf("[Banning] Banning %s for %v: message limits exceeded, %s", cs.ip, banDuration, reason)
+	if _, err := s.banning.add(cs.ip, "Message limits exceeded, "+reason, banDuration, true); err != nil {
+		StratumErrorLogger.Printf("[Banning] Err storing ban of %s: %v", cs.ip, err)
+	}
+	s.closeBannedSessions()
+}
+
+// Replies the message limit error to the request id and disconnects the session. An id over the limits is not echoed back
+func (s *StratumServer) rejectMessage(cs *Session, id *json.RawMessage, reason string) error {
+	s.messageLimitExceeded(cs, reason)
+	return cs.sendError(id, s.withHelp(&ErrorReply{Code: errCodeMessageLimit, Message: "Request exceeds the message limits, " + reason}), true)
+}
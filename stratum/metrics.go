@@ -0,0 +1,105 @@
+package stratum
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Pool-wide share and block submission counters, incremented next to the per-miner counters
+type ShareMetrics struct {
+	Valid          int64
+	Invalid        int64
+	Stale          int64
+	LowDiff        int64
+	Late           int64
+	BlocksAccepted int64
+	BlocksRejected int64
+}
+
+// Internal metrics of job broadcast fan-out, updated atomically by broadcastNewJobs
+type BroadcastMetrics struct {
+	Broadcasts       int64
+	LastDuration     int64
+	MaxDuration      int64
+	LastSessions     int64
+	TotalSessions    int64
+	LastRemoved      int64
+	TotalRemoved     int64
+	MaxQueued        int64
+	LastBroadcastAt  int64
+	lastRemovedCount int64
+}
+
+// Counts a queued job push, queued is the length of the session write queue after it. Sessions whose push failed [full queue or closed] are counted as removed
+func (b *BroadcastMetrics) pushFinished(removed bool, queued int) {
+	if removed {
+		atomic.AddInt64(&b.lastRemovedCount, 1)
+		atomic.AddInt64(&b.TotalRemoved, 1)
+		return
+	}
+	for {
+		max := atomic.LoadInt64(&b.MaxQueued)
+		if int64(queued) <= max || atomic.CompareAndSwapInt64(&b.MaxQueued, max, int64(queued)) {
+			return
+		}
+	}
+}
+
+func (b *BroadcastMetrics) broadcastStarted(sessions int) {
+	atomic.AddInt64(&b.Broadcasts, 1)
+	atomic.StoreInt64(&b.LastSessions, int64(sessions))
+	atomic.AddInt64(&b.TotalSessions, int64(sessions))
+	atomic.StoreInt64(&b.lastRemovedCount, 0)
+	atomic.StoreInt64(&b.LastBroadcastAt, time.Now().Unix())
+}
+
+func (b *BroadcastMetrics) broadcastFinished(duration time.Duration) {
+	ms := int64(duration / time.Millisecond)
+	atomic.StoreInt64(&b.LastDuration, ms)
+	atomic.StoreInt64(&b.LastRemoved, atomic.LoadInt64(&b.lastRemovedCount))
+	for {
+		max := atomic.LoadInt64(&b.MaxDuration)
+		if ms <= max || atomic.CompareAndSwapInt64(&b.MaxDuration, max, ms) {
+			return
+		}
+	}
+}
+
+// Returns a map of the broadcast metrics for the api. Durations are in milliseconds
+func (b *BroadcastMetrics) Snapshot() map[string]interface{} {
+	metrics := make(map[string]interface{})
+	metrics["broadcasts"] = atomic.LoadInt64(&b.Broadcasts)
+	metrics["lastDurationMs"] = atomic.LoadInt64(&b.LastDuration)
+	metrics["maxDurationMs"] = atomic.LoadInt64(&b.MaxDuration)
+	metrics["lastSessions"] = atomic.LoadInt64(&b.LastSessions)
+	metrics["totalSessions"] = atomic.LoadInt64(&b.TotalSessions)
+	metrics["lastRemoved"] = atomic.LoadInt64(&b.LastRemoved)
+	metrics["totalRemoved"] = atomic.LoadInt64(&b.TotalRemoved)
+	metrics["maxQueued"] = atomic.LoadInt64(&b.MaxQueued)
+	metrics["lastBroadcastAt"] = atomic.LoadInt64(&b.LastBroadcastAt)
+	return metrics
+}
+
+// Writes the HELP and TYPE lines of a Prometheus metric, followed by its samples with writePromSample
+func writePromHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// Writes a Prometheus sample. labels are name/value pairs, e.g. "result", "valid"
+func writePromSample(w io.Writer, name string, value float64, labels ...string) {
+	fmt.Fprint(w, name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			fmt.Fprint(w, "{")
+		} else {
+			fmt.Fprint(w, ",")
+		}
+		fmt.Fprintf(w, "%s=%q", labels[i], labels[i+1])
+		if i+3 >= len(labels) {
+			fmt.Fprint(w, "}")
+		}
+	}
+	fmt.Fprintf(w, " %v\n", value)
+}
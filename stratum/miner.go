@@ -1,13 +1,12 @@
 package stratum
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/big"
+	"math/rand"
 	"os"
 	"sort"
 	"strconv"
@@ -22,28 +21,44 @@ import (
 type Job struct {
 	height uint64
 	sync.RWMutex
-	id          string
-	extraNonce  uint32
+	id string
+	// Pool part of the reserved space of the job, see reservedBytes
+	reserved []byte
+	// Template of the upstream job in proxy mode, upstream jobs of the same height differ in their blob
+	template    *BlockTemplate
+	difficulty  int64
+	algo        string
 	submissions map[string]struct{}
+	// Sequence of the block template the job was made from, see jobExpireTemplates
+	templateSeq uint64
 }
 
 type Miner struct {
 	LastBeat        int64
+	LastShare       int64
 	StartedAt       int64
 	EventDataOffset int64
 	//EventDataTempTime int64
 	ValidShares     int64
 	InvalidShares   int64
+	LowDiffShares   int64
 	StaleShares     int64
-	TrustedShares   int64
 	Accepts         int64
 	Rejects         int64
 	Shares          map[int64]int64
 	LastRoundShares int64
 	RoundShares     int64
 	RoundHeight     int64
+	LastDifficulty  int64
+	ExpectedBlocks  float64
+	ShareTime       float64
 	Hashrate        int64
+	ShareWindow     *ShareWindow
 	Offline         bool
+	// Unix time the miner was evicted from memory at, see evictOfflineMiners. 0 for miners in memory
+	EvictedAt int64
+	// Withholding samples of the miner as it was evicted, restored with it. See Withholding.keep
+	WithholdingSamples []WithholdingSample
 	sync.RWMutex
 	Id            string
 	Address       string
@@ -54,159 +69,279 @@ type Miner struct {
 	Ip            string
 	DonatePercent int64
 	DonationTotal int64
+	Country       string
+	Region        string
+
+	offlineNotified int32
+
+	// Live sessions logged in as this miner, maintained by registerSession/removeSession under the miner sessionsMu. s.miners also caches miners from storage for stats, so an entry alone does not mean the miner is connected
+	sessionsMu sync.Mutex
+	sessions   map[*Session]struct{}
+
+	// Fee weight of the pool shares in Shares by timestamp, see addFees
+	fees map[int64]float64
+
+	// Shares submitted by this miner at recentSharesHeight by their shareCacheKey, shared across all of the miner's sessions for duplicate detection
+	recentShares       map[string]struct{}
+	recentSharesHeight uint64
+
+	// Recently accepted share results by timestamp, the share-proofs of POST /api/settings. See addShareProof
+	shareProofs map[string]int64
 }
 
 var MinerInfoLogger = logFileOutMiner("INFO")
 var MinerErrorLogger = logFileOutMiner("ERROR")
+var MinerWarnLogger = logFileOutMiner("WARN")
+var MinerDebugLogger = logFileOutMiner("DEBUG")
 
-func (job *Job) submit(nonce string) bool {
+// Returns whether the nonce was already submitted for this job, otherwise records it. With max > 0, a job holding max nonces is full and no longer records new ones,
+// nonces are never evicted since a forgotten nonce could be re-credited
+func (job *Job) submit(nonce string, max int) (bool, bool) {
 	job.Lock()
 	defer job.Unlock()
 	if _, exist := job.submissions[nonce]; exist {
-		return true
+		return true, false
+	}
+	if max > 0 && len(job.submissions) >= max {
+		return false, true
 	}
 	job.submissions[nonce] = struct{}{}
+	return false, false
+}
+
+// Returns true if the share [its shareCacheKey, the work hashed rather than the result sent] was already submitted by any session of this miner at the given height,
+// otherwise records it. Only the current height is retained since shares at other heights are rejected as stale
+func (m *Miner) submit(height uint64, key string) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.recentShares == nil || m.recentSharesHeight != height {
+		m.recentShares = make(map[string]struct{})
+		m.recentSharesHeight = height
+	}
+	if _, exist := m.recentShares[key]; exist {
+		return true
+	}
+	m.recentShares[key] = struct{}{}
 	return false
 }
 
+// Removes a recorded share which was not credited [rejected by processShare], so it can be submitted again like ShareCache.forget
+func (m *Miner) forgetShare(height uint64, key string) {
+	m.Lock()
+	defer m.Unlock()
+	if m.recentSharesHeight == height {
+		delete(m.recentShares, key)
+	}
+}
+
+// Offset in the blob of the nonce byte reserved by the pool on nicehash ports, the last of the 4 nonce bytes at offset 39. Miners in nicehash mode only iterate the other 3 bytes
+const nicehashNonceOffset = 39 + 3
+
 func NewMiner(id string, address string, paymentid string, fixedDiff uint64, workID string, donationPercent int64, isSolo bool, ip string) *Miner {
 	shares := make(map[int64]int64)
 	now := util.MakeTimestamp() / 1000
-	return &Miner{Id: id, Address: address, PaymentID: paymentid, FixedDiff: fixedDiff, IsSolo: isSolo, WorkID: workID, DonatePercent: donationPercent, Ip: ip, Shares: shares, StartedAt: now}
+	return &Miner{Id: id, Address: address, PaymentID: paymentid, FixedDiff: fixedDiff, IsSolo: isSolo, WorkID: workID, DonatePercent: donationPercent, Ip: ip, Shares: shares, StartedAt: now, ShareWindow: NewShareWindow(now)}
 }
 
-func (cs *Session) calcVarDiff(currDiff float64, s *StratumServer) int64 {
-	var newDiff float64
-	timestamp := time.Now().Unix()
-
-	variance := s.config.Stratum.VarDiff.VariancePercent / 100 * float64(s.config.Stratum.VarDiff.TargetTime)
-	tMin := float64(s.config.Stratum.VarDiff.TargetTime) - variance
-	tMax := float64(s.config.Stratum.VarDiff.TargetTime) + variance
-
-	// Set last time varDiff config was handled, usually done initially and builds the map for timestamparr
-	if cs.VarDiff.LastRetargetTimestamp == 0 {
-		cs.VarDiff.LastRetargetTimestamp = timestamp - s.config.Stratum.VarDiff.RetargetTime/2
-		cs.VarDiff.LastTimeStamp = timestamp
-		cs.VarDiff.TimestampArr = make(map[int64]int64)
-
-		return int64(currDiff)
+func (cs *Session) getJob(t *BlockTemplate, s *StratumServer, diff int64) *JobReplyData {
+	lastBlockHeight := cs.lastBlockHeight
+	if lastBlockHeight == t.Height {
+		return &JobReplyData{}
 	}
 
-	if (timestamp - cs.VarDiff.LastRetargetTimestamp) < s.config.Stratum.VarDiff.RetargetTime {
-		return int64(currDiff)
-	}
+	targetDiff, targetHex := cs.jobTarget(t, s, diff)
 
-	if len(cs.VarDiff.TimestampArr) <= 0 {
-		sinceLast := timestamp - cs.VarDiff.LastTimeStamp
-		cs.VarDiff.TimestampArr[sinceLast] += sinceLast
+	var reserved []byte
+	if t.upstreamJobId != "" {
+		reserved = proxyReservedBytes(cs.extraNonce, t.nextJobSlot(), t.ReserveSize)
+	} else {
+		reserved = s.reservedBytes(cs.extraNonce, t.nextJobSlot())
 	}
-	cs.VarDiff.LastRetargetTimestamp = timestamp
-
-	var avg float64
-	var sum int64
-	for _, v := range cs.VarDiff.TimestampArr {
-		sum = sum + v
+	id := atomic.AddUint64(&cs.endpoint.jobSequence, 1)
+	job := &Job{
+		id:          strconv.FormatUint(id, 10),
+		reserved:    reserved,
+		height:      t.Height,
+		difficulty:  targetDiff,
+		algo:        t.Algo,
+		templateSeq: t.seq,
 	}
-
-	avg = float64(sum) / float64(len(cs.VarDiff.TimestampArr))
-
-	diffCalc := float64(s.config.Stratum.VarDiff.TargetTime) / avg
-
-	if avg > tMax && currDiff >= float64(s.config.Stratum.VarDiff.MinDiff) {
-		if diffCalc*currDiff < float64(s.config.Stratum.VarDiff.MinDiff) {
-			diffCalc = float64(s.config.Stratum.VarDiff.MinDiff) / currDiff
-		}
-	} else if avg < tMin {
-		diffMax := float64(s.config.Stratum.VarDiff.MaxDiff)
-
-		if diffCalc*currDiff > diffMax {
-			diffCalc = diffMax / currDiff
-		}
-	} else {
-		return int64(currDiff)
+	if t.upstreamJobId != "" {
+		job.template = t
 	}
+	job.submissions = make(map[string]struct{})
+	cs.pushJob(job, s.currentConfig().Stratum.JobBacklog)
+	return cs.jobReply(t, s, job, targetHex)
+}
 
-	newDiff = currDiff * diffCalc
-
-	if newDiff <= 0 {
-		newDiff = currDiff
+// Returns the last job of the session again under a new job id with the target of diff, so a vardiff retarget between blocks only changes the target and the miner
+// keeps hashing the same blob. A new job is made if the last job is not of the current template. Results already submitted for the last job are duplicates of the
+// miner at the height, they are not credited again under the new id
+func (cs *Session) retargetJob(t *BlockTemplate, s *StratumServer, diff int64) *JobReplyData {
+	last := cs.lastJob()
+	if last == nil || last.height != t.Height || last.templateSeq != t.seq || (last.template != nil && last.template != t) {
+		return cs.getJob(t, s, diff)
 	}
 
-	maxJump := s.config.Stratum.VarDiff.MaxJump / 100 * currDiff
-
-	// Prevent diff scale up/down to be more than maxJump %.
-	if newDiff > currDiff && !(newDiff-maxJump <= currDiff) {
-		newDiff = currDiff + maxJump
-	} else if currDiff > newDiff && !(newDiff+(maxJump) >= currDiff) {
-		newDiff = currDiff - (maxJump)
+	targetDiff, targetHex := cs.jobTarget(t, s, diff)
+	id := atomic.AddUint64(&cs.endpoint.jobSequence, 1)
+	job := &Job{
+		id:          strconv.FormatUint(id, 10),
+		reserved:    last.reserved,
+		template:    last.template,
+		height:      last.height,
+		difficulty:  targetDiff,
+		algo:        last.algo,
+		templateSeq: last.templateSeq,
 	}
-
-	// Reset timestampArr
-	cs.VarDiff.TimestampArr = make(map[int64]int64)
-
-	return int64(newDiff)
+	job.submissions = make(map[string]struct{})
+	cs.pushJob(job, s.currentConfig().Stratum.JobBacklog)
+	return cs.jobReply(t, s, job, targetHex)
 }
 
-func (cs *Session) getJob(t *BlockTemplate, s *StratumServer, diff int64) *JobReplyData {
+// Returns the difficulty and target of a job of the session at diff [the session difficulty if 0], taking admin overrides, fixed difficulty and nicehash minimums into account
+func (cs *Session) jobTarget(t *BlockTemplate, s *StratumServer, diff int64) (int64, string) {
 	if diff == 0 {
 		diff = cs.difficulty
 	}
 
-	lastBlockHeight := cs.lastBlockHeight
-	if lastBlockHeight == t.Height {
-		return &JobReplyData{}
-	}
-
-	// Define difficulty and set targetHex = util.GetTargetHex(cs.difficulty) else targetHex == cs.endpoint.targetHex
+	// Define difficulty and set targetHex = util.GetTargetHexEncoded(cs.difficulty) else targetHex == cs.endpoint.targetHex
 	var targetHex string
+	var targetDiff int64
 
-	if diff != 0 && cs.isFixedDiff { // If fixed difficulty is defined
+	if override := s.getDiffOverride(cs.miner); override > 0 { // If an admin difficulty override is set, it takes precedence over fixed diff and vardiff
+		targetDiff = override
+		targetHex = t.cachedTarget(targetDiff, s.currentConfig().Stratum.TargetEncoding)
+	} else if diff != 0 && cs.isFixedDiff { // If fixed difficulty is defined
 		if diff >= cs.endpoint.config.MinDiff {
-			targetHex = util.GetTargetHex(diff)
+			targetDiff = diff
 		} else {
-			targetHex = util.GetTargetHex(cs.endpoint.config.MinDiff)
+			targetDiff = cs.endpoint.config.MinDiff
 		}
+		targetHex = t.cachedTarget(targetDiff, s.currentConfig().Stratum.TargetEncoding)
 	} else { // If vardiff is enabled, otherwise use the default value of the session
-		if s.config.Stratum.VarDiff.Enabled {
-			targetHex = util.GetTargetHex(diff)
+		if s.currentConfig().Stratum.VarDiff.Enabled {
+			targetDiff = diff
+			targetHex = t.cachedTarget(targetDiff, s.currentConfig().Stratum.TargetEncoding)
 		} else { // If not fixed diff and vardiff is not enabled, use default config difficulty and targetHex
+			targetDiff = cs.endpoint.config.Difficulty
 			targetHex = cs.endpoint.targetHex
 		}
 	}
 
-	extraNonce := atomic.AddUint32(&cs.endpoint.extraNonce, 1)
-	blob := t.nextBlob(extraNonce, cs.endpoint.instanceId)
-	id := atomic.AddUint64(&cs.endpoint.jobSequence, 1)
-	job := &Job{
-		id:         strconv.FormatUint(id, 10),
-		extraNonce: extraNonce,
-		height:     t.Height,
+	// NiceHash rejects work below its minimum difficulty, so nicehash ports never send a lower target
+	if cs.endpoint.config.NiceHash && targetDiff < cs.endpoint.config.NiceHashMinDiff {
+		targetDiff = cs.endpoint.config.NiceHashMinDiff
+		targetHex = t.cachedTarget(targetDiff, s.currentConfig().Stratum.TargetEncoding)
+	}
+	return targetDiff, targetHex
+}
+
+func (cs *Session) jobReply(t *BlockTemplate, s *StratumServer, job *Job, targetHex string) *JobReplyData {
+	blob := t.cachedBlob(job.reserved)
+	if cs.nicehashNonce != "" {
+		blob = blob[:nicehashNonceOffset*2] + cs.nicehashNonce + blob[nicehashNonceOffset*2+2:]
+	}
+	reply := &JobReplyData{JobId: job.id, Blob: blob, Target: targetHex}
+	// Connections iterating their own part of the reserved space are told where it is, they submit it with the share as extranonce
+	if size := cs.endpoint.extraNonceSize(t); size > 0 {
+		reply.ExtraNonceOffset = t.Reserved_Offset + reservedPoolSize
+		reply.ExtraNonceSize = size
+	}
+	// Compact jobs only carry the fields miners need to hash, algo and height are optional hints
+	if !s.currentConfig().Stratum.CompactJobs {
+		reply.Algo = t.Algo
+		reply.Height = t.Height
 	}
-	job.submissions = make(map[string]struct{})
-	cs.pushJob(job)
-	reply := &JobReplyData{JobId: job.id, Blob: blob, Target: targetHex, Algo: s.config.Algo, Height: t.Height}
 	return reply
 }
 
-func (cs *Session) pushJob(job *Job) {
+// Default of jobBacklog, the jobs remembered per session
+const defaultJobBacklog = 4
+
+// Stores the job in the job ring of the session, overwriting the oldest job once the ring holds backlog jobs
+func (cs *Session) pushJob(job *Job, backlog int) {
+	if backlog <= 0 {
+		backlog = defaultJobBacklog
+	}
+
 	cs.Lock()
 	defer cs.Unlock()
-	cs.validJobs = append(cs.validJobs, job)
 
-	if len(cs.validJobs) > 4 {
-		cs.validJobs = cs.validJobs[1:]
+	// The ring is rebuilt when the backlog changed on a reload, keeping the most recent jobs
+	if len(cs.validJobs) != backlog {
+		jobs := make([]*Job, backlog)
+		kept := 0
+		for i := 1; i <= len(cs.validJobs); i++ {
+			prev := cs.validJobs[(cs.nextJob-i+len(cs.validJobs))%len(cs.validJobs)]
+			if prev == nil {
+				break
+			}
+			if kept == backlog-1 {
+				cs.expireJob(prev.id)
+				continue
+			}
+			kept++
+			jobs[backlog-1-kept] = prev
+		}
+		cs.validJobs = jobs
+		cs.nextJob = backlog - 1
+	}
+	if prev := cs.validJobs[cs.nextJob]; prev != nil {
+		cs.expireJob(prev.id)
+	}
+	cs.validJobs[cs.nextJob] = job
+	cs.nextJob = (cs.nextJob + 1) % backlog
+}
+
+// Number of job ids kept per session after they dropped out of its ring, so their shares are rejected as expired rather than as unknown jobs
+const expiredJobsKept = 64
+
+// Records the id of a job dropped out of the ring. Caller holds the session lock
+func (cs *Session) expireJob(id string) {
+	if len(cs.expiredJobs) < expiredJobsKept {
+		cs.expiredJobs = append(cs.expiredJobs, id)
+		return
 	}
+	cs.expiredJobs[cs.nextExpired] = id
+	cs.nextExpired = (cs.nextExpired + 1) % expiredJobsKept
 }
 
-func (cs *Session) findJob(id string) *Job {
+// Returns the job most recently sent to the session, nil before the first one
+func (cs *Session) lastJob() *Job {
+	cs.Lock()
+	defer cs.Unlock()
+	if len(cs.validJobs) == 0 {
+		return nil
+	}
+	return cs.validJobs[(cs.nextJob-1+len(cs.validJobs))%len(cs.validJobs)]
+}
+
+// Returns the job of the session with id. Returns expired if the session was sent the job but it is no longer in its ring or is jobExpireTemplates templates old
+func (cs *Session) findJob(s *StratumServer, id string) (*Job, bool) {
+	expireTemplates := uint64(s.currentConfig().Stratum.JobExpireTemplates)
+	var currentSeq uint64
+	if t := s.currentBlockTemplate(); t != nil {
+		currentSeq = t.seq
+	}
+
 	cs.Lock()
 	defer cs.Unlock()
 	for _, job := range cs.validJobs {
-		if job.id == id {
-			return job
+		if job != nil && job.id == id {
+			if expireTemplates > 0 && currentSeq-job.templateSeq >= expireTemplates {
+				return nil, true
+			}
+			return job, false
+		}
+	}
+	// Job ids are a sequence of the port shared by its sessions, only the ids this session was sent count as expired
+	for _, expired := range cs.expiredJobs {
+		if expired == id {
+			return nil, true
 		}
 	}
-	return nil
+	return nil, false
 }
 
 func (m *Miner) heartbeat() {
@@ -214,7 +349,23 @@ func (m *Miner) heartbeat() {
 	atomic.StoreInt64(&m.LastBeat, now)
 }
 
-func (m *Miner) storeShare(diff, minershares, templateHeight int64, hashrateExpiration time.Duration) {
+// Returns the pool fee percent of shares found on the endpoint, the port fee if set otherwise the unlocker poolFee
+func (s *StratumServer) portFee(e *Endpoint) float64 {
+	if e != nil && e.config.Fee != nil {
+		return *e.config.Fee
+	}
+	return s.currentConfig().UnlockerConfig.PoolFee
+}
+
+// Adds the fee weight [shares x fee percent] of shares found at timestamp, summed into the round fees alongside m.Shares. Caller holds the miner lock
+func (m *Miner) addFees(timestamp, shares int64, fee float64) {
+	if m.fees == nil {
+		m.fees = make(map[int64]float64)
+	}
+	m.fees[timestamp] += float64(shares) * fee
+}
+
+func (m *Miner) storeShare(diff, minershares, templateHeight int64, fee float64, hashrateExpiration time.Duration) {
 	now := util.MakeTimestamp() / 1000
 	hashExpiration := int64(hashrateExpiration / time.Second)
 
@@ -253,10 +404,12 @@ func (m *Miner) storeShare(diff, minershares, templateHeight int64, hashrateExpi
 		// No need to add blank diff shares to m.Shares. Usually only 0 if running NextRound from storage.go
 		if diff != 0 {
 			m.Shares[now] += diff
+			m.addFees(now, diff, fee)
 
 			for k := range m.Shares {
 				if k < now-hashExpiration {
 					delete(m.Shares, k)
+					delete(m.fees, k)
 				}
 			}
 		}
@@ -288,7 +441,101 @@ func (m *Miner) getHashrate(estimationWindow, hashrateExpiration time.Duration)
 	return int64(float64(totalShares) / float64(boundary))
 }
 
-func (m *Miner) processShare(s *StratumServer, cs *Session, job *Job, t *BlockTemplate, nonce string, params *SubmitParams) (bool, string) {
+// Returns the part of its difficulty a late share is credited, staleGraceCredit within (0, 1] and full credit otherwise
+func (s *StratumServer) staleGraceCredit() float64 {
+	credit := s.currentConfig().Stratum.StaleGraceCredit
+	if credit <= 0 || credit > 1 {
+		return 1
+	}
+	return credit
+}
+
+// How long the stored round is kept in memory for the round shares of share replies, so they do not read the store on every share
+const roundSharesCacheTTL = 10 * time.Second
+
+// Stored round kept in memory by minerRoundShares and when it was read
+type roundSharesCache struct {
+	sync.Mutex
+	round    *PoolRound
+	loadedAt time.Time
+}
+
+// Has the next read load the round again, after the round rolled over
+func (c *roundSharesCache) invalidate() {
+	c.Lock()
+	c.loadedAt = time.Time{}
+	c.Unlock()
+}
+
+// Returns the stored round, read from storage at most every roundSharesCacheTTL
+func (s *StratumServer) cachedPoolRound() *PoolRound {
+	c := &s.roundSharesCache
+	c.Lock()
+	defer c.Unlock()
+	if c.loadedAt.IsZero() || time.Since(c.loadedAt) >= roundSharesCacheTTL {
+		c.round = Storage_backend.GetPoolRoundStats()
+		c.loadedAt = time.Now()
+	}
+	return c.round
+}
+
+// Returns the shares of a pool miner in the current round: the shares of the stored round and the shares accepted since it was stored. Solo miners have no round shares.
+// The stored round is the one kept in memory, shares accepted since it was read are counted from the miner shares so the total stays current
+func (s *StratumServer) minerRoundShares(m *Miner) int64 {
+	if m.IsSolo {
+		return 0
+	}
+	round := s.cachedPoolRound()
+	if round == nil {
+		return 0
+	}
+	shares := round.RoundShares[m.Id]
+	m.RLock()
+	for k, v := range m.Shares {
+		if k > round.Timestamp {
+			shares += v
+		}
+	}
+	m.RUnlock()
+	return shares
+}
+
+// Returns whether validation of a share of a trusted session is skipped. trustedSharesPercent of the shares are skipped at random, the rest are validated as spot-checks.
+// Block candidates are always validated and a spot-check is forced after trustedSharesCount skipped shares in a row
+func (cs *Session) skipTrustedShare(s *StratumServer, block bool) bool {
+	percent := s.currentConfig().TrustedSharesPercent
+	if percent <= 0 || percent > 100 {
+		percent = 90
+	}
+	if block || atomic.LoadInt64(&cs.skippedShares) >= atomic.LoadInt64(&s.trustedSharesCount) || rand.Float64()*100 >= percent {
+		atomic.StoreInt64(&cs.skippedShares, 0)
+		return false
+	}
+	atomic.AddInt64(&cs.skippedShares, 1)
+	return true
+}
+
+// Revokes the trust of the session after a rejected share, its shares are all validated until trustedSharesCount are validated in a row again
+func (cs *Session) untrust() {
+	atomic.StoreInt64(&cs.trustedShares, 0)
+	atomic.StoreInt64(&cs.skippedShares, 0)
+}
+
+// Validates and credits a share for job of template t. A late share [for the previous height within staleGracePeriod] is credited staleGraceCredit of its
+// difficulty and never submitted as a block, the network moved past its height
+// Returns the difficulty of a share hash, with errCodeOther if the hash is unusable or errCodeLowDifficulty if it is below the assigned difficulty setDiff
+func shareDifficulty(hashBytes []byte, setDiff *big.Int) (*big.Int, int) {
+	hashDiff, ok := util.GetHashDifficulty(hashBytes)
+	if !ok {
+		return nil, errCodeOther
+	}
+	if hashDiff.Cmp(setDiff) < 0 {
+		return hashDiff, errCodeLowDifficulty
+	}
+	return hashDiff, 0
+}
+
+func (m *Miner) processShare(s *StratumServer, cs *Session, job *Job, t *BlockTemplate, nonce string, params *SubmitParams, late bool) (bool, string, int) {
 
 	// Var definitions
 	var extraMinerMessage string
@@ -300,28 +547,39 @@ func (m *Miner) processShare(s *StratumServer, cs *Session, job *Job, t *BlockTe
 	var hashBytes []byte
 	var diff big.Int
 	var donation float64
+	fee := s.portFee(cs.endpoint)
 	diff.SetUint64(t.Difficulty)
+	// Validate against the difficulty of the target sent with the job, cs.difficulty may have been retargeted since the job was sent
 	var setDiff big.Int
-	setDiff.SetUint64(uint64(cs.difficulty))
+	if job.difficulty != 0 {
+		setDiff.SetUint64(uint64(job.difficulty))
+	} else {
+		setDiff.SetUint64(uint64(cs.difficulty))
+	}
 	r := s.rpc()
 
 	shareBuff := make([]byte, len(t.Buffer))
 	copy(shareBuff, t.Buffer)
-	copy(shareBuff[t.Reserved_Offset+4:t.Reserved_Offset+7], cs.endpoint.instanceId)
-
-	extraBuff := new(bytes.Buffer)
-	binary.Write(extraBuff, binary.BigEndian, job.extraNonce)
-	copy(shareBuff[t.Reserved_Offset:], extraBuff.Bytes())
+	copy(shareBuff[t.Reserved_Offset:], job.reserved)
+	// Validated against the extraNonceSize of the port in handleSubmitRPC
+	if params.ExtraNonce != "" {
+		extraNonceBuff, _ := hex.DecodeString(params.ExtraNonce)
+		copy(shareBuff[t.Reserved_Offset+reservedPoolSize:], extraNonceBuff)
+	}
 
 	nonceBuff, _ := hex.DecodeString(nonce)
 	copy(shareBuff[39:], nonceBuff)
 
-	// After trustedSharesCount is hit (number of accepted shares in a row based on config.json), hash validation will be skipped until an incorrect hash is submitted
-	if atomic.LoadInt64(&m.TrustedShares) >= s.trustedSharesCount {
+	// After trustedSharesCount is hit (number of validated shares in a row on this session based on config.json), hash validation is skipped for trustedSharesPercent of the shares until an incorrect hash is submitted
+	trusted := atomic.LoadInt64(&cs.trustedShares) >= atomic.LoadInt64(&s.trustedSharesCount)
+	if trusted {
 		shareType = "Trusted"
 	} else {
 		shareType = "Valid"
 	}
+	if late {
+		shareType = "Late " + shareType
+	}
 
 	// Append share type, solo or pool for logging assistance
 	if m.IsSolo {
@@ -330,56 +588,94 @@ func (m *Miner) processShare(s *StratumServer, cs *Session, job *Job, t *BlockTe
 		shareType = shareType + " POOL"
 	}
 
+	// Reject shares for jobs of a different algorithm than the current block template, i.e. jobs sent prior to an algoFork
+	if job.algo != t.Algo {
+		minerOutput := "Rejected share, job algorithm is no longer valid"
+		MinerErrorLogger.Printf("[Miner] Rejected share for algo %s, current algo is %s - from %v@%v", job.algo, t.Algo, m.Id, cs.ip)
+		atomic.AddInt64(&m.InvalidShares, 1)
+		atomic.AddInt64(&s.shareMetrics.Invalid, 1)
+		atomic.AddInt64(&cs.endpoint.shares.Invalid, 1)
+		return false, minerOutput, errCodeJobNotFound
+	}
+
 	hashBytes, _ = hex.DecodeString(result)
 
-	if s.config.BypassShareValidation || shareType == "Trusted SOLO" || shareType == "Trusted POOL" {
-		bypassShareValidation = true
-	} else {
-		switch s.algo {
-		case "astrobwt":
-			checkPowHashBig, success = util.AstroBWTHash(shareBuff[:], diff, setDiff)
-
-			if !success {
-				minerOutput := "Bad hash. If you see often [> 1/10 shares on avg], check input on miner software."
-				log.Printf("[Miner] Bad hash, check input on miner software, from miner %v@%v", m.Id, cs.ip)
-				MinerErrorLogger.Printf("[Miner] Bad hash, check input on miner software,  from miner %v@%v", m.Id, cs.ip)
-
-				if shareType == "Trusted" {
-					log.Printf("[Miner] Miner is no longer submitting trusted shares: %v@%v", m.Id, cs.ip)
-					MinerErrorLogger.Printf("[Miner] Miner is no longer submitting trusted shares: %v@%v", m.Id, cs.ip)
-					shareType = "Valid"
-				}
+	hashDiff, errCode := shareDifficulty(hashBytes, &setDiff)
+	if errCode == errCodeOther {
+		minerOutput := "Bad hash"
+		MinerErrorLogger.Printf("[Miner] Bad hash from miner %v@%v . Could not get hash difficulty.", m.Id, cs.ip)
+		atomic.AddInt64(&m.InvalidShares, 1)
+		atomic.AddInt64(&s.shareMetrics.Invalid, 1)
+		atomic.AddInt64(&cs.endpoint.shares.Invalid, 1)
+		cs.untrust()
+		s.banning.recordShare(s, cs, false)
+		return false, minerOutput, errCodeOther
+	}
 
-				atomic.AddInt64(&m.InvalidShares, 1)
-				atomic.StoreInt64(&m.TrustedShares, 0)
-				return false, minerOutput
-			}
+	// Reject shares that do not meet the session's assigned difficulty before spending time validating the hash. Counted separately from invalid shares, since the hash itself may be legitimate [e.g. miner misreporting or ignoring its difficulty]
+	if errCode == errCodeLowDifficulty {
+		minerOutput := "Low difficulty share"
+		MinerErrorLogger.Printf("[Miner] Rejected low difficulty share of %v / %v from %v@%v", hashDiff, &setDiff, m.Id, cs.ip)
+		atomic.AddInt64(&m.LowDiffShares, 1)
+		atomic.AddInt64(&s.shareMetrics.LowDiff, 1)
+		atomic.AddInt64(&cs.endpoint.shares.LowDiff, 1)
+		cs.untrust()
+		s.banning.recordShare(s, cs, false)
+		return false, minerOutput, errCodeLowDifficulty
+	}
 
-			atomic.AddInt64(&m.TrustedShares, 1)
-		case "cryptonight":
-			checkPowHashBig = util.CryptonightHash(shareBuff, diff)
+	// May be redundant, or use instead of CheckPowHashBig in future.
+	block := hashDiff.Cmp(&diff) >= 0
 
-			atomic.AddInt64(&m.TrustedShares, 1)
-		default:
+	if s.currentConfig().BypassShareValidation || (trusted && cs.skipTrustedShare(s, block)) {
+		bypassShareValidation = true
+	} else {
+		algo, ok := powAlgos[job.algo]
+		if !ok {
 			// Handle when no algo is defined or unhandled algo is defined, let miner know issues (properly gets sent back in job detail rejection message)
 			minerOutput := "Rejected share, no pool algo defined. Contact pool owner."
-			log.Printf("[Miner] Rejected share, no pool algo defined (%s). Contact pool owner - from %v@%v", s.algo, m.Id, cs.ip)
-			MinerErrorLogger.Printf("[Miner] Rejected share, no pool algo defined (%s). Contact pool owner - from %v@%v", s.algo, m.Id, cs.ip)
-			return false, minerOutput
+			MinerErrorLogger.Printf("[Miner] Rejected share, no pool algo defined (%s). Contact pool owner - from %v@%v", job.algo, m.Id, cs.ip)
+			return false, minerOutput, errCodeOther
+		}
+
+		var verified bool
+		checkPowHashBig, success, verified = s.verifier.verify(algo, shareBuff, diff, setDiff, block)
+		if !verified {
+			minerOutput := "Pool is busy, share was not verified"
+			MinerErrorLogger.Printf("[Miner] Share verification queue full for %v, rejected share from %v@%v", s.verifier.timeout, m.Id, cs.ip)
+			return false, minerOutput, errCodePoolBusy
+		}
+
+		if !success {
+			minerOutput := "Bad hash. If you see often [> 1/10 shares on avg], check input on miner software."
+			MinerErrorLogger.Printf("[Miner] Bad hash, check input on miner software,  from miner %v@%v", m.Id, cs.ip)
+
+			if trusted {
+				MinerErrorLogger.Printf("[Miner] Miner failed a trusted share spot-check, validating all of its shares again: %v@%v", m.Id, cs.ip)
+			}
+
+			atomic.AddInt64(&m.InvalidShares, 1)
+			atomic.AddInt64(&s.shareMetrics.Invalid, 1)
+			atomic.AddInt64(&cs.endpoint.shares.Invalid, 1)
+			cs.untrust()
+			s.banning.recordShare(s, cs, false)
+			return false, minerOutput, errCodeOther
 		}
+
+		atomic.AddInt64(&cs.trustedShares, 1)
 	}
 
-	hashDiff, ok := util.GetHashDifficulty(hashBytes)
-	if !ok {
-		minerOutput := "Bad hash"
-		log.Printf("[Miner] Bad hash from miner %v@%v . Could not get hash difficulty.", m.Id, cs.ip)
-		MinerErrorLogger.Printf("[Miner] Bad hash from miner %v@%v . Could not get hash difficulty.", m.Id, cs.ip)
-		atomic.AddInt64(&m.InvalidShares, 1)
-		return false, minerOutput
+	// In proxy mode shares meeting the upstream job target are forwarded upstream, locally they are credited like any other share
+	if t.upstreamJobId != "" {
+		if block {
+			s.proxy.submit(m, t, nonce, result, shareBuff)
+		}
+		block, checkPowHashBig = false, false
 	}
 
-	// May be redundant, or use instead of CheckPowHashBig in future.
-	block := hashDiff.Cmp(&diff) >= 0
+	if late {
+		block, checkPowHashBig = false, false
+	}
 
 	// If bypassing share validation (either with true/false of config or miner is trusted), block should define properly if a block is found and can set checkPowHashBig to true. Perhaps future improvements to be made here
 	if block && bypassShareValidation {
@@ -388,6 +684,13 @@ func (m *Miner) processShare(s *StratumServer, cs *Session, job *Job, t *BlockTe
 
 	if checkPowHashBig && block {
 		blockSubmit, err := r.SubmitBlock(t.Blocktemplate_blob, hex.EncodeToString(shareBuff))
+		// Submit to the next healthy upstream if the daemon could not be reached, a rejection by the daemon is not retried
+		if err != nil && blockSubmit == nil {
+			if next, ok := s.failover(r, err); ok {
+				r = next
+				blockSubmit, err = r.SubmitBlock(t.Blocktemplate_blob, hex.EncodeToString(shareBuff))
+			}
+		}
 		var blockSubmitReply *rpc.SubmitBlock_Result = &rpc.SubmitBlock_Result{}
 
 		if blockSubmit != nil {
@@ -398,27 +701,31 @@ func (m *Miner) processShare(s *StratumServer, cs *Session, job *Job, t *BlockTe
 
 		if err != nil || blockSubmitReply.Status != "OK" {
 			atomic.AddInt64(&m.Rejects, 1)
+			atomic.AddInt64(&s.shareMetrics.BlocksRejected, 1)
 			atomic.AddInt64(&r.Rejects, 1)
-			log.Printf("[BLOCK] Block rejected at height %d: %v", t.Height, err)
 			MinerErrorLogger.Printf("[BLOCK] Block rejected at height %d: %v", t.Height, err)
-			return false, "Bad hash"
+			return false, "Bad hash", errCodeOther
 		} else {
-			log.Printf("[BLOCK] Block accepted. Hash: %s, Status: %s", blockSubmitReply.BLID, blockSubmitReply.Status)
 			MinerInfoLogger.Printf("[BLOCK] Block accepted. Hash: %s, Status: %s", blockSubmitReply.BLID, blockSubmitReply.Status)
 
 			now := util.MakeTimestamp() / 1000
 
 			atomic.AddInt64(&m.Accepts, 1)
+			atomic.AddInt64(&s.shareMetrics.BlocksAccepted, 1)
 			atomic.AddInt64(&r.Accepts, 1)
 			atomic.StoreInt64(&r.LastSubmissionAt, now)
 
+			s.webhooks.BlockFound(m, cs.ip, int64(t.Height), blockSubmitReply.BLID, t.Expected_reward)
+			s.telegram.BlockFound(m, int64(t.Height), blockSubmitReply.BLID, t.Expected_reward)
+			if s.currentConfig().Stratum.BlockNotify.Enabled {
+				go s.notifyBlockFound(cs, t.Height, blockSubmitReply.BLID, m.IsSolo)
+			}
+
+			blockType := "POOL"
 			if m.IsSolo {
-				log.Printf("[BLOCK] SOLO Block found at height %d, diff: %v, blid: %s, by miner: %v@%v", t.Height, t.Difficulty, blockSubmitReply.BLID, m.Id, cs.ip)
-				MinerInfoLogger.Printf("[BLOCK] SOLO Block found at height %d, diff: %v, blid: %s, by miner: %v@%v", t.Height, t.Difficulty, blockSubmitReply.BLID, m.Id, cs.ip)
-			} else {
-				log.Printf("[BLOCK] POOL Block found at height %d, diff: %v, blid: %s, by miner: %v@%v", t.Height, t.Difficulty, blockSubmitReply.BLID, m.Id, cs.ip)
-				MinerInfoLogger.Printf("[BLOCK] POOL Block found at height %d, diff: %v, blid: %s, by miner: %v@%v", t.Height, t.Difficulty, blockSubmitReply.BLID, m.Id, cs.ip)
+				blockType = "SOLO"
 			}
+			MinerInfoLogger.Printw(fmt.Sprintf("[BLOCK] %s Block found at height %d", blockType, t.Height), "height", t.Height, "difficulty", t.Difficulty, "blid", blockSubmitReply.BLID, "miner", m.Id, "ip", cs.ip, "solo", m.IsSolo)
 
 			// Graviton store of successful block
 			// This could be 'cleaned' to one-liners etc., but just depends on how you feel. Upon build/testing was simpler to view in-line for spec values
@@ -436,6 +743,14 @@ func (m *Miner) processShare(s *StratumServer, cs *Session, job *Job, t *BlockTe
 			info.Solo = m.IsSolo
 			info.Address = m.Address
 			info.BlockState = "candidate"
+			// Only solo ports charge their fee on solo blocks, solo blocks of the soloMining login prefix are credited whole
+			if m.IsSolo && cs.endpoint.config.PoolMode == "solo" {
+				info.Fee = &fee
+			}
+
+			liveBlock := newLiveBlock(info, info.BlockState)
+			liveBlock.Reward = t.Expected_reward
+			s.live.publish("block", liveBlock)
 
 			if m.DonatePercent > 0 && m.Address != s.donateID {
 				donation = float64(m.DonatePercent) / 100 * float64(cs.difficulty)
@@ -443,12 +758,12 @@ func (m *Miner) processShare(s *StratumServer, cs *Session, job *Job, t *BlockTe
 
 				donateMiner, ok := s.miners.Get(s.donateID)
 				if !ok {
-					log.Printf("[Miner] Miner %v@%v intended to donate %v shares, however donation miner is not setup.", params.Id, cs.ip, int64(donation))
 					MinerErrorLogger.Printf("[Miner] Miner %v@%v intended to donate %v shares, however donation miner is not setup.", params.Id, cs.ip, int64(donation))
 				} else {
-					log.Printf("[Miner] Miner %v@%v donated %v shares.", params.Id, cs.ip, int64(donation))
 					MinerInfoLogger.Printf("[Miner] Miner %v@%v donated %v shares.", params.Id, cs.ip, int64(donation))
-					donateMiner.storeShare(cs.difficulty, int64(donation), int64(t.Height), s.hashrateExpiration)
+					donateMiner.storeShare(cs.difficulty, int64(donation), int64(t.Height), fee, s.hashrateExpiration)
+					s.recordRoundShare(donateMiner, cs.difficulty, fee)
+					s.recordPPLNSShare(donateMiner, int64(donation), fee, t.Difficulty)
 				}
 			}
 
@@ -456,17 +771,20 @@ func (m *Miner) processShare(s *StratumServer, cs *Session, job *Job, t *BlockTe
 			// No need to add blank diff shares to m.Shares. Usually only 0 if running NextRound from storage.go
 			if cs.difficulty != 0 {
 				m.Shares[now] += cs.difficulty
+				if !m.IsSolo {
+					m.addFees(now, cs.difficulty, fee)
+				}
 			}
 			m.Unlock()
+			s.recordRoundShare(m, cs.difficulty, fee)
+			s.recordPPLNSShare(m, cs.difficulty-int64(donation), fee, t.Difficulty)
 
 			// Only update next round miner stats if a pool block is found, so can determine this by the miner who found the block's solo status
 			if !m.IsSolo {
-				log.Printf("[Miner] Updating miner stats in DB for current round...")
 				MinerInfoLogger.Printf("[Miner] Updating miner stats in DB for current round...")
 
 				writeWait, _ := time.ParseDuration("10ms")
 				for Graviton_backend.Writing == 1 {
-					//log.Printf("[Miner-processShare] GravitonDB is writing... sleeping for %v...", writeWait)
 					//StorageInfoLogger.Printf("[Miner-processShare] GravitonDB is writing... sleeping for %v...", writeWait)
 					time.Sleep(writeWait)
 				}
@@ -474,21 +792,20 @@ func (m *Miner) processShare(s *StratumServer, cs *Session, job *Job, t *BlockTe
 				_ = Graviton_backend.WriteMinerStats(s.miners, s.hashrateExpiration)
 
 				//Graviton_backend.Writing = 1
-				log.Printf("[Miner] Adding block to graviton...")
 				MinerInfoLogger.Printf("[Miner] Adding block to graviton...")
 				infoErr := Graviton_backend.WriteBlocks(info, info.BlockState)
 				//Graviton_backend.Writing = 0
 				if infoErr != nil {
-					log.Printf("[BLOCK] Graviton DB err: %v", infoErr)
 					MinerErrorLogger.Printf("[BLOCK] Graviton DB err: %v", infoErr)
 				}
 
-				_ = Graviton_backend.UpdatePoolRoundStats(s.miners, true)
+				_ = Storage_backend.UpdatePoolRoundStats(s.miners, true)
+				s.storePPLNSRound(info.Height)
 				Graviton_backend.Writing = 0
+				s.roundSharesCache.invalidate()
 			} else {
 				writeWait, _ := time.ParseDuration("10ms")
 				for Graviton_backend.Writing == 1 {
-					//log.Printf("[Miner-processShare] GravitonDB is writing... sleeping for %v...", writeWait)
 					//StorageInfoLogger.Printf("[Miner-processShare] GravitonDB is writing... sleeping for %v...", writeWait)
 					time.Sleep(writeWait)
 				}
@@ -496,7 +813,6 @@ func (m *Miner) processShare(s *StratumServer, cs *Session, job *Job, t *BlockTe
 				infoErr := Graviton_backend.WriteBlocks(info, info.BlockState)
 				Graviton_backend.Writing = 0
 				if infoErr != nil {
-					log.Printf("[BLOCK] Graviton DB err: %v", infoErr)
 					MinerErrorLogger.Printf("[BLOCK] Graviton DB err: %v", infoErr)
 				}
 			}
@@ -504,12 +820,6 @@ func (m *Miner) processShare(s *StratumServer, cs *Session, job *Job, t *BlockTe
 			// Refresh current BT and send new jobs
 			s.refreshBlockTemplate(true)
 		}
-	} else if hashDiff.Cmp(&setDiff) < 0 {
-		minerOutput := "Low difficulty share"
-		log.Printf("[Miner] Rejected low difficulty share of %v / %v from %v@%v", hashDiff, setDiff, m.Id, cs.ip)
-		MinerErrorLogger.Printf("[Miner] Rejected low difficulty share of %v / %v from %v@%v", hashDiff, setDiff, m.Id, cs.ip)
-		atomic.AddInt64(&m.InvalidShares, 1)
-		return false, minerOutput
 	}
 
 	// Using minermap to store share data rather than direct to DB, future scale might have issues with the large concurrent writes to DB directly
@@ -517,25 +827,35 @@ func (m *Miner) processShare(s *StratumServer, cs *Session, job *Job, t *BlockTe
 
 	// Store share for current height and current round shares on normal basis. If block && checkPowHashBig, miner round share has already been counted, no need to double count here
 	if !block && !checkPowHashBig {
-		// If miner is donating, take % out of cs.difficulty (share amount stored) and storeShare to donation addr
+		credit := cs.difficulty
+		if late {
+			credit = int64(float64(credit) * s.staleGraceCredit())
+			atomic.AddInt64(&s.shareMetrics.Late, 1)
+		}
+
+		// If miner is donating, take % out of credit (share amount stored) and storeShare to donation addr
 		if m.DonatePercent > 0 && m.Address != s.donateID {
-			donation = float64(m.DonatePercent) / 100 * float64(cs.difficulty)
+			donation = float64(m.DonatePercent) / 100 * float64(credit)
 			atomic.AddInt64(&m.DonationTotal, int64(donation))
 
 			donateMiner, ok := s.miners.Get(s.donateID)
 			if !ok {
-				log.Printf("[Miner] Miner %v@%v intended to donate %v shares, however donation miner is not setup.", params.Id, cs.ip, int64(donation))
 				MinerErrorLogger.Printf("[Miner] Miner %v@%v intended to donate %v shares, however donation miner is not setup.", params.Id, cs.ip, int64(donation))
 			} else {
-				log.Printf("[Miner] Miner %v@%v donated %v shares.", params.Id, cs.ip, int64(donation))
 				MinerInfoLogger.Printf("[Miner] Miner %v@%v donated %v shares.", params.Id, cs.ip, int64(donation))
-				donateMiner.storeShare(int64(donation), int64(donation), int64(t.Height), s.hashrateExpiration)
+				donateMiner.storeShare(int64(donation), int64(donation), int64(t.Height), fee, s.hashrateExpiration)
+				s.recordRoundShare(donateMiner, int64(donation), fee)
+				s.recordPPLNSShare(donateMiner, int64(donation), fee, t.Difficulty)
 			}
 
-			minerShare := cs.difficulty - int64(donation)
-			m.storeShare(cs.difficulty, minerShare, int64(t.Height), s.hashrateExpiration)
+			minerShare := credit - int64(donation)
+			m.storeShare(credit, minerShare, int64(t.Height), fee, s.hashrateExpiration)
+			s.recordRoundShare(m, credit, fee)
+			s.recordPPLNSShare(m, minerShare, fee, t.Difficulty)
 		} else {
-			m.storeShare(cs.difficulty, cs.difficulty, int64(t.Height), s.hashrateExpiration)
+			m.storeShare(credit, credit, int64(t.Height), fee, s.hashrateExpiration)
+			s.recordRoundShare(m, credit, fee)
+			s.recordPPLNSShare(m, credit, fee, t.Difficulty)
 		}
 	} else {
 		// Add extra miner message to return back to mining software if a block is found by the miner - only certain miner software will read/use these results
@@ -547,21 +867,23 @@ func (m *Miner) processShare(s *StratumServer, cs *Session, job *Job, t *BlockTe
 	}
 
 	atomic.AddInt64(&m.ValidShares, 1)
+	atomic.AddInt64(&s.shareMetrics.Valid, 1)
+	atomic.AddInt64(&cs.endpoint.shares.Valid, 1)
+	s.banning.recordShare(s, cs, true)
+	atomic.StoreInt64(&m.LastShare, util.MakeTimestamp()/1000)
+	// Rolling hashrates and vardiff count the share at the difficulty of the job it was submitted for
+	m.Lock()
+	m.addShareDifficulty(util.MakeTimestamp()/1000, setDiff.Int64())
+	m.addShareProof(params.Result, util.MakeTimestamp()/1000)
+	if t.Difficulty > 0 {
+		m.ExpectedBlocks += float64(setDiff.Int64()) / float64(t.Difficulty)
+	}
+	m.Unlock()
+	atomic.StoreInt32(&m.offlineNotified, 0)
 
-	log.Printf("[Miner] %s share at difficulty %v/%v from %v@%v", shareType, cs.difficulty, hashDiff, params.Id, cs.ip)
 	MinerInfoLogger.Printf("[Miner] %s share at difficulty %v/%v from %v@%v", shareType, cs.difficulty, hashDiff, params.Id, cs.ip)
 
-	ts := time.Now().Unix()
-	// Omit the first round to setup the vars if they aren't setup, otherwise commit to timestamparr
-	if cs.VarDiff.LastRetargetTimestamp == 0 {
-		cs.VarDiff.LastRetargetTimestamp = ts - s.config.Stratum.VarDiff.RetargetTime/2
-		cs.VarDiff.LastTimeStamp = ts
-		cs.VarDiff.TimestampArr = make(map[int64]int64)
-	} else {
-		sinceLast := ts - cs.VarDiff.LastTimeStamp
-		cs.VarDiff.TimestampArr[sinceLast] += sinceLast
-		cs.VarDiff.LastTimeStamp = ts
-	}
+	cs.VarDiff.recordShare(time.Now().Unix(), s.currentConfig().Stratum.VarDiff.RetargetTime, setDiff.Int64())
 
 	s.miners.Set(m.Id, m)
 
@@ -574,16 +896,11 @@ func (m *Miner) processShare(s *StratumServer, cs *Session, job *Job, t *BlockTe
 		}
 	}
 
-	return true, extraMinerMessage
+	return true, extraMinerMessage, 0
 }
 
-func logFileOutMiner(lType string) *log.Logger {
-	var logFileName string
-	if lType == "ERROR" {
-		logFileName = "logs/minerError.log"
-	} else {
-		logFileName = "logs/miner.log"
-	}
+func logFileOutMiner(lType string) *util.Logger {
+	logFileName := util.LogFileName("miner", lType)
 	os.Mkdir("logs", 0705)
 	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0705)
 	if err != nil {
@@ -592,5 +909,5 @@ func logFileOutMiner(lType string) *log.Logger {
 
 	logType := lType + ": "
 	l := log.New(f, logType, log.LstdFlags|log.Lmicroseconds)
-	return l
+	return util.NewLogger("miner", lType, l)
 }
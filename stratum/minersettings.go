@@ -0,0 +1,452 @@
+package stratum
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/rpc"
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// Settings of an address, chosen by the miner with the payoutSettings login suffix or POST /api/settings. Threshold is in atomic units, 0 is the pool minPayment.
+// Interval is the minimum time between payouts of the address in seconds, 0 pays out on every payout run. Email is where its notifications are emailed when
+// its notification registration has none, Telegram the handle a frontend or bot can reach the miner at
+type MinerSettings struct {
+	Address   string
+	Threshold uint64
+	Interval  int64
+	Email     string `json:",omitempty"`
+	Telegram  string `json:",omitempty"`
+	UpdatedAt int64
+}
+
+// Returns whether the settings hold nothing, the backends remove such settings instead of storing them
+func (m *MinerSettings) empty() bool {
+	return m.Threshold == 0 && m.Interval == 0 && m.Email == "" && m.Telegram == ""
+}
+
+// Returns the settings with the email partially hidden, as the api is keyed by the public wallet address
+func (m *MinerSettings) masked() *MinerSettings {
+	settings := *m
+	settings.Email = maskEmail(m.Email)
+	return &settings
+}
+
+// A one-time code of POST /api/settings, delivered to the address as the amount of a tiny payment
+type settingsCode struct {
+	amount   uint64
+	sentAt   int64
+	attempts int
+}
+
+// Wrong codes accepted before a code is invalidated, so the amount can not be guessed within its validity
+const settingsCodeAttempts = 5
+
+var telegramHandle = regexp.MustCompile(`^@?[A-Za-z0-9_]{5,32}$`)
+
+// Accepted share results kept per miner as share-proofs for POST /api/settings, and for how long a result is accepted as proof
+const (
+	maxShareProofs   = 32
+	shareProofMaxAge = 10 * time.Minute
+)
+
+// Splits the payoutSettings suffix [e.g. "#5" or "#5/24h"] off the login, it is always the last part of the login. Returns the login as is when the separator is not configured
+func (s *StratumServer) splitPayoutSettings(login string) (string, string) {
+	separator := s.currentConfig().Stratum.PayoutSettings.AddressSeparator
+	if separator == "" {
+		return login, ""
+	}
+	i := strings.Index(login, separator)
+	if i == -1 {
+		return login, ""
+	}
+	return login[:i], login[i+len(separator):]
+}
+
+// Parses payout settings of the form <minPayment in DERO>[/<interval>], e.g. "5", "0.5/24h" or "/12h". An empty minPayment keeps the pool minPayment
+func (s *StratumServer) parsePayoutSettings(value string) (uint64, int64, error) {
+	thresholdValue, intervalValue := value, ""
+	if i := strings.Index(value, "/"); i != -1 {
+		thresholdValue, intervalValue = value[:i], value[i+1:]
+	}
+
+	var threshold uint64
+	if thresholdValue != "" {
+		dero, err := strconv.ParseFloat(thresholdValue, 64)
+		if err != nil || dero < 0 || math.IsInf(dero, 0) {
+			return 0, 0, fmt.Errorf("invalid minimum payment %q", thresholdValue)
+		}
+		threshold = uint64(dero * float64(s.currentConfig().CoinUnits))
+	}
+
+	var interval int64
+	if intervalValue != "" {
+		intv, err := time.ParseDuration(intervalValue)
+		if err != nil || intv < 0 {
+			return 0, 0, fmt.Errorf("invalid payment interval %q", intervalValue)
+		}
+		interval = int64(intv / time.Second)
+	}
+	return threshold, interval, s.validatePayoutSettings(threshold, interval)
+}
+
+// Bounds the settings of a miner. A threshold must be above the pool minPayment and within minerMaxPayment, an interval within minerMaxInterval,
+// so payouts of an address can only be delayed so far by whoever mines to it
+func (s *StratumServer) validatePayoutSettings(threshold uint64, interval int64) error {
+	cfg := s.currentConfig().PaymentsConfig
+	coinUnits := float64(s.currentConfig().CoinUnits)
+	if threshold != 0 && threshold <= cfg.Threshold {
+		return fmt.Errorf("minimum payment must be above the pool minimum of %v DERO", float64(cfg.Threshold)/coinUnits)
+	}
+	if cfg.MinerMaxPayment > 0 && threshold > cfg.MinerMaxPayment {
+		return fmt.Errorf("minimum payment must be at most %v DERO", float64(cfg.MinerMaxPayment)/coinUnits)
+	}
+	maxInterval, err := time.ParseDuration(cfg.MinerMaxInterval)
+	if err != nil || maxInterval <= 0 {
+		maxInterval = 7 * 24 * time.Hour
+	}
+	if interval > int64(maxInterval/time.Second) {
+		return fmt.Errorf("payment interval must be at most %v", maxInterval)
+	}
+	return nil
+}
+
+// Validates a notification email and telegram handle, either may be empty to clear it. Returns them normalized [the bare email address, the handle with its @]
+func validateContactSettings(email, telegram string) (string, string, error) {
+	if email != "" {
+		parsed, err := mail.ParseAddress(email)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid email %q", email)
+		}
+		email = parsed.Address
+	}
+	if telegram != "" {
+		if !telegramHandle.MatchString(telegram) {
+			return "", "", fmt.Errorf("invalid telegram handle %q", telegram)
+		}
+		telegram = "@" + strings.TrimPrefix(telegram, "@")
+	}
+	return email, telegram, nil
+}
+
+// Applies update to the stored settings of address and stores them, unless they are unchanged. Settings left empty are removed
+func (s *StratumServer) updateMinerSettings(address string, update func(settings *MinerSettings)) (*MinerSettings, error) {
+	if !s.currentConfig().PaymentsConfig.MinerSettings {
+		return nil, errors.New("miner settings are disabled on this pool")
+	}
+	settings := &MinerSettings{Address: address}
+	stored := Storage_backend.GetMinerSettings()[address]
+	if stored != nil {
+		*settings = *stored
+	}
+	update(settings)
+	if stored != nil && *settings == *stored {
+		return stored, nil
+	}
+	settings.UpdatedAt = util.MakeTimestamp() / 1000
+
+	writeWait, _ := time.ParseDuration("10ms")
+	for Graviton_backend.Writing == 1 {
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	err := Storage_backend.WriteMinerSettings(settings)
+	Graviton_backend.Writing = 0
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// Stores the payout settings of address, its contact settings are kept. Resetting both to 0 returns the address to the pool minPayment
+func (s *StratumServer) setPayoutSettings(address string, threshold uint64, interval int64) (*MinerSettings, error) {
+	settings, err := s.updateMinerSettings(address, func(settings *MinerSettings) {
+		settings.Threshold = threshold
+		settings.Interval = interval
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	StratumInfoLogger.Printf("[Stratum] Set payout settings of %v to minPayment: %v, interval: %vs", address, threshold, interval)
+	return settings, nil
+}
+
+// Returns whether ip has a live session of address which submitted a share within shareProofMaxAge, i.e. the caller runs active workers of the address
+func (s *StratumServer) activeWorkerIP(address, ip string) bool {
+	if ip == "" {
+		return false
+	}
+	minTs := util.MakeTimestamp()/1000 - int64(shareProofMaxAge/time.Second)
+	active := false
+	s.sessions.Range(func(cs *Session) {
+		if !active && cs.ip == ip && cs.miner != nil && cs.miner.Address == address && atomic.LoadInt64(&cs.miner.LastShare) >= minTs {
+			active = true
+		}
+	})
+	return active
+}
+
+// Returns for how long a settings code is valid, which is also the minimum time between two codes of an address
+func (s *StratumServer) settingsCodeInterval() time.Duration {
+	interval, err := time.ParseDuration(s.currentConfig().PaymentsConfig.MinerSettingsCodeInterval)
+	if err != nil || interval <= 0 {
+		interval = time.Hour
+	}
+	return interval
+}
+
+// Maximum codes sent pool-wide within minerSettingsCodeInterval when minerSettingsCodeLimit is unset
+const defaultSettingsCodeLimit = 10
+
+// Returns the login holding the largest pending balance of address, and whether a miner of address has accepted shares. Codes are only sent to such addresses,
+// so the wallet does not pay codes to any address asked for
+func (s *StratumServer) settingsCodeEligible(address string) (string, uint64, bool) {
+	var login string
+	var balance uint64
+	for _, p := range Storage_backend.GetPendingPayments() {
+		if pendingAddress, _, _, _, _, _ := s.splitLoginString(p.Address); pendingAddress == address && p.Amount > balance {
+			login, balance = p.Address, p.Amount
+		}
+	}
+
+	var accepted bool
+	for _, m := range s.miners.Values() {
+		if m != nil && m.Address == address && atomic.LoadInt64(&m.Accepts) > 0 {
+			accepted = true
+			break
+		}
+	}
+	return login, balance, accepted || balance > 0
+}
+
+// Sends a one-time settings code to address: a payment of a random amount of at most minerSettingsCodeAmount atomic units, which the miner reads in its wallet
+// and passes as code. Only addresses with a pending balance or accepted shares get codes, at most minerSettingsCodeLimit pool-wide per minerSettingsCodeInterval,
+// and the code amount is debited from the pending balance of the address as far as it covers it. Returns when the code expires
+func (s *StratumServer) requestSettingsCode(address string) (int64, error) {
+	cfg := s.currentConfig()
+	if cfg.PaymentsConfig.MinerSettingsCodeAmount == 0 || s.payouts == nil {
+		return 0, errors.New("settings codes are disabled on this pool")
+	}
+	if !util.ValidateAddress(address, cfg.Address) {
+		return 0, errors.New("invalid address")
+	}
+	login, balance, eligible := s.settingsCodeEligible(address)
+	if !eligible {
+		return 0, errors.New("codes are only sent to addresses with a pending balance or accepted shares")
+	}
+	limit := cfg.PaymentsConfig.MinerSettingsCodeLimit
+	if limit <= 0 {
+		limit = defaultSettingsCodeLimit
+	}
+	now := util.MakeTimestamp() / 1000
+	interval := int64(s.settingsCodeInterval() / time.Second)
+
+	// The code is reserved before it is sent, so concurrent requests for an address send a single payment
+	s.settingsCodesMu.Lock()
+	if s.settingsCodes == nil {
+		s.settingsCodes = make(map[string]*settingsCode)
+	}
+	if code := s.settingsCodes[address]; code != nil && now-code.sentAt < interval {
+		s.settingsCodesMu.Unlock()
+		return 0, fmt.Errorf("a code was already sent to the address, another one can be requested in %vs", code.sentAt+interval-now)
+	}
+	sent := s.settingsCodesSent[:0]
+	for _, ts := range s.settingsCodesSent {
+		if now-ts < interval {
+			sent = append(sent, ts)
+		}
+	}
+	s.settingsCodesSent = sent
+	if len(sent) >= limit {
+		s.settingsCodesMu.Unlock()
+		return 0, errors.New("too many settings codes were requested, try again later")
+	}
+	amount, err := rand.Int(rand.Reader, new(big.Int).SetUint64(cfg.PaymentsConfig.MinerSettingsCodeAmount))
+	if err != nil {
+		s.settingsCodesMu.Unlock()
+		return 0, err
+	}
+	code := &settingsCode{amount: amount.Uint64() + 1, sentAt: now}
+	s.settingsCodes[address] = code
+	s.settingsCodesSent = append(s.settingsCodesSent, now)
+	s.settingsCodesMu.Unlock()
+
+	release := func() {
+		s.settingsCodesMu.Lock()
+		if s.settingsCodes[address] == code {
+			delete(s.settingsCodes, address)
+		}
+		for i, ts := range s.settingsCodesSent {
+			if ts == now {
+				s.settingsCodesSent = append(s.settingsCodesSent[:i], s.settingsCodesSent[i+1:]...)
+				break
+			}
+		}
+		s.settingsCodesMu.Unlock()
+	}
+
+	// Debited before the payment is sent and credited back if it fails, so a payout in between can not pay the amount out as well
+	var debit uint64
+	if login != "" {
+		debit = code.amount
+		if debit > balance {
+			debit = balance
+		}
+		if _, err = s.adjustBalance(login, -int64(debit)); err != nil {
+			release()
+			return 0, err
+		}
+	}
+
+	txHash, err := s.payouts.sendSettingsCode(address, code.amount)
+	if err != nil {
+		release()
+		if debit > 0 {
+			if _, creditErr := s.adjustBalance(login, int64(debit)); creditErr != nil {
+				StratumErrorLogger.Printf("[Stratum] Err crediting back settings code debit of %v to %v: %v", debit, login, creditErr)
+			}
+		}
+		return 0, err
+	}
+
+	StratumInfoLogger.Printf("[Stratum] Sent settings code to %v, debited %v from %v, tx: %v", address, debit, login, txHash)
+	return now + interval, nil
+}
+
+// Checks a settings code for address, the amount in DERO of the code payment it was sent. A code is used up once it matched, or after settingsCodeAttempts wrong codes
+func (s *StratumServer) checkSettingsCode(address, value string) bool {
+	if value == "" {
+		return false
+	}
+	dero, err := strconv.ParseFloat(value, 64)
+	if err != nil || dero <= 0 || math.IsInf(dero, 0) {
+		return false
+	}
+	amount := uint64(math.Round(dero * float64(s.currentConfig().CoinUnits)))
+
+	s.settingsCodesMu.Lock()
+	defer s.settingsCodesMu.Unlock()
+	code := s.settingsCodes[address]
+	if code == nil || code.attempts >= settingsCodeAttempts || util.MakeTimestamp()/1000-code.sentAt >= int64(s.settingsCodeInterval()/time.Second) {
+		return false
+	}
+	if code.amount != amount {
+		code.attempts++
+		return false
+	}
+	// The code is spent but kept until it expires, so no other code is sent to the address before
+	code.attempts = settingsCodeAttempts
+	return true
+}
+
+// Sends the settings code payment of amount to address. It does not race a payout on the wallet: while a payout runs the code is refused rather than waited for,
+// so code requests can not hold up payouts
+func (u *PayoutsProcessor) sendSettingsCode(address string, amount uint64) (string, error) {
+	if !u.mu.TryLock() {
+		return "", errors.New("payouts are running, request the code again shortly")
+	}
+	defer u.mu.Unlock()
+
+	var params rpc.Transfer_Params
+	params.Mixin = u.currentConfig().Mixin
+	params.Get_tx_key = true
+	params.Destinations = []rpc.Destinations{{Amount: amount, Address: address}}
+	paymentOutput, err := u.sendTransaction(u.rpc.Url.String(), params)
+	if err != nil {
+		PaymentsErrorLogger.Printf("[Payments] Error sending settings code to %v: %v", address, err)
+		return "", err
+	}
+	if paymentOutput == nil || len(paymentOutput.Tx_hash_list) == 0 {
+		return "", errors.New("wallet returned no transaction")
+	}
+	return paymentOutput.Tx_hash_list[0], nil
+}
+
+// Keeps the result of an accepted share as a share-proof of the miner address. Caller holds the miner lock
+func (m *Miner) addShareProof(result string, ts int64) {
+	if m.shareProofs == nil {
+		m.shareProofs = make(map[string]int64)
+	}
+	m.shareProofs[result] = ts
+
+	if len(m.shareProofs) > maxShareProofs {
+		oldest, oldestTs := "", int64(math.MaxInt64)
+		for k, v := range m.shareProofs {
+			if v < oldestTs {
+				oldest, oldestTs = k, v
+			}
+		}
+		delete(m.shareProofs, oldest)
+	}
+}
+
+// Checks a share-proof for address: the result hash of a share accepted from any worker of the address within shareProofMaxAge. Only the miner submitting the share
+// knows the result, so it proves the caller mines to the address. A proof is used up once checked
+func (s *StratumServer) checkShareProof(address, proof string) bool {
+	if proof == "" {
+		return false
+	}
+	minTs := util.MakeTimestamp()/1000 - int64(shareProofMaxAge/time.Second)
+	for _, m := range s.miners.Values() {
+		if m == nil || m.Address != address {
+			continue
+		}
+		m.Lock()
+		ts, ok := m.shareProofs[proof]
+		if ok {
+			delete(m.shareProofs, proof)
+		}
+		m.Unlock()
+		if ok && ts >= minTs {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the pending amount of an address is due for payout: above its minPayment setting [or the pool minPayment] and its payout interval passed since it was last paid at lastPaid
+func (u *PayoutsProcessor) payoutDue(settings *MinerSettings, amount uint64, lastPaid, now int64) bool {
+	threshold := u.currentConfig().Threshold
+	if settings != nil && settings.Threshold > threshold {
+		threshold = settings.Threshold
+	}
+	if amount <= threshold {
+		return false
+	}
+	if settings != nil && settings.Interval > 0 && lastPaid > 0 && now-lastPaid < settings.Interval {
+		return false
+	}
+	return true
+}
+
+// Returns the payout settings by address and when each address was last paid, empty when miner settings are disabled
+func (u *PayoutsProcessor) minerPayoutSettings() (map[string]*MinerSettings, map[string]int64) {
+	settings := make(map[string]*MinerSettings)
+	lastPaid := make(map[string]int64)
+	if !u.currentConfig().MinerSettings {
+		return settings, lastPaid
+	}
+
+	for address, setting := range Storage_backend.GetMinerSettings() {
+		settings[address] = setting
+	}
+	if processed := Storage_backend.GetProcessedPayments(); processed != nil {
+		for _, payment := range processed.MinerPayments {
+			address, _, _, _, _, _ := u.stratum.splitLoginString(payment.Login)
+			if payment.Timestamp > lastPaid[address] {
+				lastPaid[address] = payment.Timestamp
+			}
+		}
+	}
+	return settings, lastPaid
+}
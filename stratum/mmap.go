@@ -2,7 +2,6 @@
 package stratum
 
 import (
-	"hash/fnv"
 	"sync"
 )
 
@@ -27,9 +26,17 @@ func NewMinersMap() MinersMap {
 
 // Returns shard under given key
 func (m MinersMap) GetShard(key string) *MinersMapShared {
-	hasher := fnv.New32()
-	hasher.Write([]byte(key))
-	return m[int(hasher.Sum32())%SHARD_COUNT]
+	return m[int(fnv32(key)%uint32(SHARD_COUNT))]
+}
+
+// FNV-1 hash of key [same as hash/fnv New32], without allocating a hasher and a copy of key on every lookup
+func fnv32(key string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash *= 16777619
+		hash ^= uint32(key[i])
+	}
+	return hash
 }
 
 // Sets the given value under the specified key.
@@ -74,6 +81,20 @@ func (m MinersMap) Count() int {
 	return count
 }
 
+// Returns a slice of all elements within the map at the time of calling.
+func (m MinersMap) Values() []*Miner {
+	var values []*Miner
+	for i := 0; i < SHARD_COUNT; i++ {
+		shard := m[i]
+		shard.RLock()
+		for _, val := range shard.Items {
+			values = append(values, val)
+		}
+		shard.RUnlock()
+	}
+	return values
+}
+
 // Checks if map is empty.
 func (m MinersMap) IsEmpty() bool {
 	return m.Count() == 0
@@ -0,0 +1,395 @@
+package stratum
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// Where a miner wants its idle alerts sent. With Workers set each worker going idle is alerted, otherwise only the whole address going idle [all of its workers]
+type NotificationRegistration struct {
+	Address    string
+	Email      string
+	WebhookURL string
+	Workers    bool
+	Timestamp  int64
+}
+
+type NotificationProcessor struct {
+	config        *pool.NotificationsConfig
+	client        *http.Client
+	queue         chan *notification
+	mu            sync.RWMutex
+	registrations map[string]*NotificationRegistration
+	idleNotified  map[string]bool
+}
+
+type notification struct {
+	registration *NotificationRegistration
+	event        *WebhookEvent
+}
+
+// Number of goroutines delivering queued notifications
+const notificationWorkers = 2
+
+var NotificationsInfoLogger = logFileOutNotifications("INFO")
+var NotificationsErrorLogger = logFileOutNotifications("ERROR")
+
+func NewNotificationProcessor(cfg *pool.NotificationsConfig) *NotificationProcessor {
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil || timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = 1024
+	}
+
+	n := &NotificationProcessor{
+		config:        cfg,
+		client:        &http.Client{Timeout: timeout, Transport: webhookTransport()},
+		queue:         make(chan *notification, queueSize),
+		registrations: make(map[string]*NotificationRegistration),
+		idleNotified:  make(map[string]bool),
+	}
+	return n
+}
+
+func (n *NotificationProcessor) Start() {
+	if stored := Graviton_backend.GetNotificationRegistrations(); stored != nil {
+		n.registrations = stored
+	}
+	NotificationsInfoLogger.Printf("[Notifications] Starting notifications for %v registered addresses, smtp: %v, miner webhooks allowed: %v", len(n.registrations), n.config.SMTPHost != "", n.config.AllowWebhooks)
+
+	for i := 0; i < notificationWorkers; i++ {
+		go func() {
+			for notif := range n.queue {
+				n.deliver(notif)
+			}
+		}()
+	}
+}
+
+// Registers [or replaces] the email and/or webhook url idle alerts of address are sent to
+func (n *NotificationProcessor) register(address, email, webhookURL string, workers bool) (*NotificationRegistration, error) {
+	if email == "" && webhookURL == "" {
+		return nil, errors.New("email or webhook is required")
+	}
+	if email != "" {
+		if n.config.SMTPHost == "" {
+			return nil, errors.New("email notifications are not enabled")
+		}
+		parsed, err := mail.ParseAddress(email)
+		if err != nil {
+			return nil, fmt.Errorf("invalid email: %v", err)
+		}
+		email = parsed.Address
+	}
+	if webhookURL != "" {
+		if !n.config.AllowWebhooks {
+			return nil, errors.New("webhook notifications are not enabled")
+		}
+		parsed, err := url.Parse(webhookURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, errors.New("invalid webhook url")
+		}
+		if err := checkWebhookHost(parsed.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+
+	registration := &NotificationRegistration{Address: address, Email: email, WebhookURL: webhookURL, Workers: workers, Timestamp: util.MakeTimestamp() / 1000}
+	n.mu.Lock()
+	n.registrations[address] = registration
+	n.mu.Unlock()
+
+	return registration, n.store()
+}
+
+// Removes the registration of address, returns false if it had none
+func (n *NotificationProcessor) unregister(address string) (bool, error) {
+	n.mu.Lock()
+	_, ok := n.registrations[address]
+	delete(n.registrations, address)
+	delete(n.idleNotified, address)
+	n.mu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, n.store()
+}
+
+func (n *NotificationProcessor) registration(address string) *NotificationRegistration {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.registrations[address]
+}
+
+func (n *NotificationProcessor) store() error {
+	n.mu.RLock()
+	registrations := make(map[string]*NotificationRegistration)
+	for k, v := range n.registrations {
+		registrations[k] = v
+	}
+	n.mu.RUnlock()
+
+	writeWait, _ := time.ParseDuration("10ms")
+	for Graviton_backend.Writing == 1 {
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	err := Graviton_backend.OverwriteNotificationRegistrations(registrations)
+	Graviton_backend.Writing = 0
+	return err
+}
+
+// Alerts a worker that has not submitted an accepted share within workerOfflineThreshold, if its address registered for worker alerts
+func (n *NotificationProcessor) WorkerOffline(miner *Miner) {
+	if n == nil {
+		return
+	}
+	registration := n.registration(miner.Address)
+	if registration == nil || !registration.Workers {
+		return
+	}
+	n.enqueue(registration, &WebhookEvent{Event: "workerOffline", Id: miner.Id, Address: miner.Address, Worker: miner.WorkID, LastShare: atomic.LoadInt64(&miner.LastShare)})
+}
+
+// Checks the registered addresses for all of their workers being idle, alerting once until any of them submits a share again. lastShares is the latest share of each address
+func (n *NotificationProcessor) checkIdleAddresses(lastShares map[string]int64, maxLastShare int64) {
+	if n == nil {
+		return
+	}
+
+	var idle []*NotificationRegistration
+	n.mu.Lock()
+	for address, registration := range n.registrations {
+		lastShare, ok := lastShares[address]
+		if !ok || lastShare > maxLastShare {
+			// Addresses without connected workers since the last restart are not alerted, they would otherwise all be idle right after a restart
+			delete(n.idleNotified, address)
+			continue
+		}
+		if !n.idleNotified[address] {
+			n.idleNotified[address] = true
+			idle = append(idle, registration)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, registration := range idle {
+		n.enqueue(registration, &WebhookEvent{Event: "minerOffline", Id: registration.Address, Address: registration.Address, LastShare: lastShares[registration.Address]})
+	}
+}
+
+// Queues the notification for delivery without blocking the offline check. If the queue is full, the notification is dropped
+func (n *NotificationProcessor) enqueue(registration *NotificationRegistration, event *WebhookEvent) {
+	event.Timestamp = util.MakeTimestamp() / 1000
+
+	select {
+	case n.queue <- &notification{registration: registration, event: event}:
+	default:
+		NotificationsErrorLogger.Printf("[Notifications] Queue is full, dropping %s notification for %s", event.Event, event.Id)
+	}
+}
+
+func (n *NotificationProcessor) deliver(notif *notification) {
+	event := notif.event
+
+	// Without an email in the registration, the notification email of the address settings is used
+	email := notif.registration.Email
+	if email == "" {
+		if settings := Storage_backend.GetMinerSettings()[notif.registration.Address]; settings != nil {
+			email = settings.Email
+		}
+	}
+	if email != "" {
+		if err := n.sendEmail(email, event); err != nil {
+			NotificationsErrorLogger.Printf("[Notifications] Failed to email %s notification for %s: %v", event.Event, event.Id, err)
+		} else {
+			NotificationsInfoLogger.Printf("[Notifications] Emailed %s notification for %s", event.Event, event.Id)
+		}
+	}
+
+	if notif.registration.WebhookURL != "" {
+		if err := n.post(notif.registration.WebhookURL, event); err != nil {
+			NotificationsErrorLogger.Printf("[Notifications] Failed to deliver %s webhook notification for %s: %v", event.Event, event.Id, err)
+		} else {
+			NotificationsInfoLogger.Printf("[Notifications] Delivered %s webhook notification for %s", event.Event, event.Id)
+		}
+	}
+}
+
+func (n *NotificationProcessor) sendEmail(to string, event *WebhookEvent) error {
+	var subject, body string
+	lastShare := time.Unix(event.LastShare, 0).UTC().Format(time.RFC1123)
+	if event.Event == "workerOffline" {
+		worker := event.Worker
+		if worker == "" {
+			worker = event.Id
+		}
+		subject = fmt.Sprintf("Worker %s is offline", worker)
+		body = fmt.Sprintf("Worker %s of %s has not submitted a share since %s.", worker, event.Address, lastShare)
+	} else {
+		subject = "Your miners are offline"
+		body = fmt.Sprintf("None of the workers of %s has submitted a share since %s.", event.Address, lastShare)
+	}
+
+	// Worker names come from the miner's login, so header line breaks are stripped
+	subject = strings.NewReplacer("\r", "", "\n", "").Replace(subject)
+	msg := "From: " + n.config.EmailFrom + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body + "\r\n"
+
+	var auth smtp.Auth
+	if n.config.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", n.config.SMTPUsername, n.config.SMTPPassword, n.config.SMTPHost)
+	}
+	port := n.config.SMTPPort
+	if port == 0 {
+		port = 587
+	}
+	return smtp.SendMail(n.config.SMTPHost+":"+strconv.Itoa(port), auth, n.config.EmailFrom, []string{to}, []byte(msg))
+}
+
+func (n *NotificationProcessor) post(url string, event *WebhookEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %v", resp.Status)
+	}
+	return nil
+}
+
+// Private, loopback, link-local and unspecified ranges webhooks may not be delivered to, so a registration cannot make the pool request its own host or network
+var webhookBlockedNets = parseCIDRs("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func webhookIPBlocked(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, ipNet := range webhookBlockedNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rejects a webhook host resolving to any blocked address
+func checkWebhookHost(host string) error {
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return errors.New("webhook host does not resolve")
+	}
+	for _, ip := range ips {
+		if webhookIPBlocked(ip) {
+			return errors.New("webhook host resolves to a private or loopback address")
+		}
+	}
+	return nil
+}
+
+// Checks the address actually dialed as well, since the host may resolve differently at delivery than at registration
+func webhookTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || webhookIPBlocked(ip) {
+				return fmt.Errorf("webhook address %v is not allowed", host)
+			}
+			return nil
+		},
+	}
+	return &http.Transport{Proxy: http.ProxyFromEnvironment, DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second}
+}
+
+// Returns the registration with the email and webhook host partially hidden, as the api is keyed by the public wallet address
+func (r *NotificationRegistration) masked() map[string]interface{} {
+	reply := make(map[string]interface{})
+	reply["address"] = r.Address
+	reply["workers"] = r.Workers
+	reply["timestamp"] = r.Timestamp
+	if r.Email != "" {
+		reply["email"] = maskEmail(r.Email)
+	}
+	if r.WebhookURL != "" {
+		webhook := "***"
+		if parsed, err := url.Parse(r.WebhookURL); err == nil {
+			webhook = parsed.Scheme + "://" + parsed.Host + "/***"
+		}
+		reply["webhook"] = webhook
+	}
+	return reply
+}
+
+// Returns the email with its local part hidden but for the first character
+func maskEmail(email string) string {
+	if at := strings.LastIndex(email, "@"); at > 0 {
+		email = email[:1] + "***" + email[at:]
+	}
+	return email
+}
+
+func logFileOutNotifications(lType string) *util.Logger {
+	logFileName := util.LogFileName("notifications", lType)
+	os.Mkdir("logs", 0705)
+	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0705)
+	if err != nil {
+		panic(err)
+	}
+
+	logType := lType + ": "
+	l := log.New(f, logType, log.LstdFlags|log.Lmicroseconds)
+	return util.NewLogger("notifications", lType, l)
+}
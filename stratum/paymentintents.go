@@ -0,0 +1,388 @@
+package stratum
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+	"github.com/Nelbert442/dero-golang-pool/rpc"
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// Statuses of a payment intent. An intent is stored pending before its transaction is sent, and sent with the tx hash before its payees are debited.
+// The logins of open intents are left out of payouts, so a payout is never sent twice
+const (
+	intentPending   = "pending"   // Being sent. Still pending on the next run, the pool stopped while sending and the intent becomes unknown
+	intentRetry     = "retry"     // Rejected by the wallet, sent again at NextAttempt
+	intentUnknown   = "unknown"   // No reply from the wallet, the transaction may have been sent. Held until resolved with POST /api/admin/payments?intent=<key>
+	intentSent      = "sent"      // Sent by the wallet, payees not debited yet
+	intentCompleted = "completed" // Sent and payees debited
+	intentFailed    = "failed"    // Retries used up or cancelled, the balances stay pending for the next payouts
+)
+
+// Completed and failed intents are kept for
+const paymentIntentRetention = 7 * 24 * time.Hour
+
+// Returns a pending intent for payees, its key is unique to the payees, amounts and creation time
+func newPaymentIntent(paymentID string, payees []*IntentPayee) *PaymentIntent {
+	now := time.Now()
+	h := sha256.New()
+	fmt.Fprintf(h, "%s/%d", paymentID, now.UnixNano())
+	for _, payee := range payees {
+		fmt.Fprintf(h, "/%s:%d", payee.Login, payee.Amount)
+	}
+	return &PaymentIntent{Key: hex.EncodeToString(h.Sum(nil)), PaymentID: paymentID, Payees: payees, Status: intentPending, CreatedAt: now.Unix()}
+}
+
+func (intent *PaymentIntent) open() bool {
+	return intent.Status != intentCompleted && intent.Status != intentFailed
+}
+
+// Charges the payees of intent their share of its network fee, pro rata of their amount, with txFeePayer "miner". The fee is that of the transaction built by the wallet
+// without relaying it, txFeeReserve if the wallet could not build it. The share is taken off the amount sent, the balance debited stays the same.
+// The pool pays the difference to the actual fee of the transaction sent, as well as the fee of payees whose amount would not cover their share
+func (u *PayoutsProcessor) chargeTxFee(walletURL string, intent *PaymentIntent) {
+	cfg := u.currentConfig()
+	if cfg.TxFeePayer != "miner" {
+		return
+	}
+	var total uint64
+	for _, payee := range intent.Payees {
+		total += payee.Amount
+	}
+	if total == 0 {
+		return
+	}
+
+	txFee := cfg.TxFeeReserve
+	params := u.transferParams(intent)
+	params.Do_not_relay = true
+	params.Get_tx_hex = false
+	// In dry-run mode the wallet is not contacted for the estimate either, txFeeReserve is charged
+	estimate, err := u.sendTransaction(walletURL, params)
+	if err == nil && estimate != nil && len(estimate.Fee_list) > 0 && estimate.Fee_list[0] > 0 {
+		txFee = estimate.Fee_list[0]
+	} else if !cfg.DryRun {
+		PaymentsErrorLogger.Printf("[Payments] Could not get the fee of payout %v from the wallet, charging txFeeReserve %v: %v", intent.Key, txFee, err)
+	}
+	if txFee == 0 {
+		return
+	}
+
+	for _, payee := range intent.Payees {
+		fee := new(big.Int).Mul(new(big.Int).SetUint64(txFee), new(big.Int).SetUint64(payee.Amount))
+		fee.Div(fee, new(big.Int).SetUint64(total))
+		if fee.Uint64() < payee.Amount {
+			payee.Fee = fee.Uint64()
+			payee.Amount -= payee.Fee
+		}
+	}
+}
+
+// Rejects unknown txFeePayer values, which would otherwise silently have the pool pay the fees
+func validateTxFeePayer(cfg *pool.PaymentsConfig) error {
+	switch cfg.TxFeePayer {
+	case "", "pool", "miner":
+		return nil
+	}
+	return fmt.Errorf("invalid payments txFeePayer %q, expected \"pool\" or \"miner\"", cfg.TxFeePayer)
+}
+
+func (intent *PaymentIntent) amount() uint64 {
+	var amount uint64
+	for _, payee := range intent.Payees {
+		amount += payee.Amount
+	}
+	return amount
+}
+
+// Returns the stored intents oldest first
+func sortedPaymentIntents() []*PaymentIntent {
+	var intents []*PaymentIntent
+	if stored := Storage_backend.GetPaymentIntents(); stored != nil {
+		for _, intent := range stored.Intents {
+			intents = append(intents, intent)
+		}
+	}
+	sort.SliceStable(intents, func(i, j int) bool {
+		return intents[i].CreatedAt < intents[j].CreatedAt
+	})
+	return intents
+}
+
+// Stores the intent, pruning completed and failed intents older than paymentIntentRetention. Nothing is stored in dry-run mode
+func (u *PayoutsProcessor) storeIntent(intent *PaymentIntent) error {
+	if u.currentConfig().DryRun {
+		return nil
+	}
+	now := util.MakeTimestamp() / 1000
+	intent.UpdatedAt = now
+
+	writeWait, _ := time.ParseDuration("10ms")
+	for Graviton_backend.Writing == 1 {
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	intents := Storage_backend.GetPaymentIntents()
+	if intents == nil {
+		intents = &PaymentIntents{Intents: make(map[string]*PaymentIntent)}
+	}
+	intents.Intents[intent.Key] = intent
+	for key, stored := range intents.Intents {
+		if !stored.open() && now-stored.UpdatedAt > int64(paymentIntentRetention/time.Second) {
+			delete(intents.Intents, key)
+		}
+	}
+	err := Storage_backend.OverwritePaymentIntents(intents)
+	Graviton_backend.Writing = 0
+	if err != nil {
+		PaymentsErrorLogger.Printf("[Payments] Graviton DB err storing payment intent %v: %v", intent.Key, err)
+	}
+	return err
+}
+
+func (u *PayoutsProcessor) transferParams(intent *PaymentIntent) rpc.Transfer_Params {
+	var params rpc.Transfer_Params
+	params.Mixin = u.currentConfig().Mixin
+	params.Unlock_time = 0
+	params.Get_tx_key = true
+	params.Do_not_relay = false
+	params.Get_tx_hex = true
+	params.Payment_ID = intent.PaymentID
+	for _, payee := range intent.Payees {
+		params.Destinations = append(params.Destinations, rpc.Destinations{Amount: payee.Amount, Address: payee.Address})
+	}
+	return params
+}
+
+// Sends the transaction of intent and debits its payees. The intent is stored before sending and again with the tx hash before debiting,
+// so a payout interrupted at any point is resumed by resumeIntents instead of being sent again
+func (u *PayoutsProcessor) payIntent(walletURL string, intent *PaymentIntent, payPending []*PaymentPending) ([]*PaymentPending, error) {
+	intent.Attempts++
+	intent.Status = intentPending
+	if err := u.storeIntent(intent); err != nil {
+		// Without the intent stored, an interrupted payout could be sent again
+		return payPending, err
+	}
+
+	paymentOutput, err := u.sendTransaction(walletURL, u.transferParams(intent))
+	if err == nil && (paymentOutput == nil || len(paymentOutput.Tx_hash_list) == 0) {
+		err = errors.New("failed to generate transaction. It was sent successfully to rpc server, but no reply back")
+	}
+	if err != nil {
+		u.failIntent(intent, err)
+		u.storeIntent(intent)
+		return payPending, err
+	}
+	PaymentsDebugLogger.Printf("[Payments] Success: %v", paymentOutput)
+	PaymentsInfoLogger.Printw("[Payments] Payout sent", "intent", intent.Key, "txHash", paymentOutput.Tx_hash_list[0], "payees", len(intent.Payees), "amount", intent.amount(), "paymentId", intent.PaymentID)
+
+	intent.TxHash = paymentOutput.Tx_hash_list[0]
+	// As pool owner, you probably want to store keys so that you can prove a send if required.
+	if len(paymentOutput.Tx_key_list) > 0 {
+		intent.TxKey = paymentOutput.Tx_key_list[0]
+	}
+	if len(paymentOutput.Fee_list) > 0 {
+		intent.TxFee = paymentOutput.Fee_list[0]
+	}
+	intent.Status = intentSent
+	u.storeIntent(intent)
+
+	return u.completeIntent(intent, payPending)
+}
+
+// Debits the payees of a sent intent that are not debited yet and completes it. The intent is stored after each debit, so a payout resumed after a crash
+// does not debit the payees already debited again
+func (u *PayoutsProcessor) completeIntent(intent *PaymentIntent, payPending []*PaymentPending) ([]*PaymentPending, error) {
+	var err error
+	for _, payee := range intent.Payees {
+		if payee.Debited {
+			continue
+		}
+		// The fee recorded is the fee of the whole transaction, along with the payee's share of it with txFeePayer "miner"
+		payPending, err = u.recordPayout(payPending, payee.Login, payee.Amount, payee.Fee, intent.TxHash, intent.TxKey, intent.TxFee)
+		if err != nil {
+			u.storeIntent(intent)
+			return payPending, err
+		}
+		payee.Debited = true
+		if err = u.storeIntent(intent); err != nil {
+			// Debiting the remaining payees unrecorded would have a resume debit them again, the intent stays sent until resolved
+			return payPending, err
+		}
+	}
+	intent.Status = intentCompleted
+	u.storeIntent(intent)
+	return payPending, nil
+}
+
+// Returns whether the wallet rejected the request [or it never reached the wallet], so the transaction was certainly not sent
+func walletRejected(err error) bool {
+	if _, ok := err.(*rpc.RPCError); ok {
+		return true
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		if opErr, ok := urlErr.Err.(*net.OpError); ok && opErr.Op == "dial" {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the intent to be retried with backoff when the wallet rejected it, failed once retryAttempts are used up. Without a reply from the wallet the transaction
+// may have been sent, the intent is held as unknown
+func (u *PayoutsProcessor) failIntent(intent *PaymentIntent, err error) {
+	cfg := u.currentConfig()
+	intent.LastError = err.Error()
+
+	if !walletRejected(err) {
+		intent.Status = intentUnknown
+		PaymentsErrorLogger.Printf("[Payments] No reply from the wallet for payout %v of %v to %v payees, it may have been sent. Holding it until resolved with /api/admin/payments: %v", intent.Key, intent.amount(), len(intent.Payees), err)
+		return
+	}
+
+	maxAttempts := cfg.RetryAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+	if intent.Attempts >= maxAttempts {
+		intent.Status = intentFailed
+		PaymentsErrorLogger.Printf("[Payments] Payout %v failed after %v attempts, balances stay pending: %v", intent.Key, intent.Attempts, err)
+		return
+	}
+
+	backoff, perr := time.ParseDuration(cfg.RetryBackoff)
+	if perr != nil || backoff <= 0 {
+		backoff = time.Minute
+	}
+	maxBackoff, perr := time.ParseDuration(cfg.RetryMaxBackoff)
+	if perr != nil || maxBackoff <= 0 {
+		maxBackoff = time.Hour
+	}
+	for i := 1; i < intent.Attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	intent.Status = intentRetry
+	intent.NextAttempt = util.MakeTimestamp()/1000 + int64(backoff/time.Second)
+	PaymentsErrorLogger.Printf("[Payments] Payout %v rejected by the wallet, retrying in %v [attempt %v of %v]: %v", intent.Key, backoff, intent.Attempts, maxAttempts, err)
+}
+
+// Resumes stored intents: sent intents are completed, retry intents due are sent again and intents found pending become unknown. Returns the logins
+// of the open intents, which are left out of new payouts, and the updated pending payments
+func (u *PayoutsProcessor) resumeIntents(walletURL string, payPending []*PaymentPending) (map[string]bool, []*PaymentPending) {
+	held := make(map[string]bool)
+	now := util.MakeTimestamp() / 1000
+
+	for _, intent := range sortedPaymentIntents() {
+		// Nothing is sent or stored in dry-run mode, open intents are only held
+		switch {
+		case u.currentConfig().DryRun:
+		case intent.Status == intentPending:
+			intent.Status = intentUnknown
+			intent.LastError = "the pool stopped while sending the payout"
+			u.storeIntent(intent)
+			PaymentsErrorLogger.Printf("[Payments] Payout %v of %v to %v payees was interrupted while sending, it may have been sent. Holding it until resolved with /api/admin/payments", intent.Key, intent.amount(), len(intent.Payees))
+		case intent.Status == intentSent:
+			PaymentsInfoLogger.Printf("[Payments] Resuming sent payout %v [%v], debiting its payees", intent.Key, intent.TxHash)
+			payPending, _ = u.completeIntent(intent, payPending)
+		case intent.Status == intentRetry && intent.NextAttempt <= now:
+			PaymentsInfoLogger.Printf("[Payments] Retrying payout %v of %v to %v payees", intent.Key, intent.amount(), len(intent.Payees))
+			payPending, _ = u.payIntent(walletURL, intent, payPending)
+		}
+
+		if intent.open() {
+			for _, payee := range intent.Payees {
+				held[payee.Login] = true
+			}
+		}
+	}
+	return held, payPending
+}
+
+// Checks for retry intents due every retryBackoff, so rejected payouts are sent again in between payout runs
+func (u *PayoutsProcessor) startIntentRetries() {
+	intv, err := time.ParseDuration(u.currentConfig().RetryBackoff)
+	if err != nil || intv <= 0 {
+		intv = time.Minute
+	}
+
+	timer := time.NewTimer(intv)
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				u.retryIntents()
+				timer.Reset(intv)
+			}
+		}
+	}()
+}
+
+// Sends the retry intents that are due, unless payouts are paused
+func (u *PayoutsProcessor) retryIntents() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if health := u.walletHealth(); health != nil && health.Paused {
+		return
+	}
+	u.resumeIntents(u.rpc.Url.String(), Storage_backend.GetPendingPayments())
+}
+
+// Resolves an unknown or retry intent: "retry" sends it again, "cancel" fails it so the balances stay pending, and "complete" with the txid the wallet sent it with
+// debits its payees
+func (u *PayoutsProcessor) resolveIntent(key, action, txid string) (*PaymentIntent, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var intent *PaymentIntent
+	if stored := Storage_backend.GetPaymentIntents(); stored != nil {
+		intent = stored.Intents[key]
+	}
+	if intent == nil {
+		return nil, fmt.Errorf("payment intent %v not found", key)
+	}
+	if intent.Status != intentUnknown && intent.Status != intentRetry {
+		return intent, fmt.Errorf("payment intent %v is %v, only unknown and retry intents can be resolved", key, intent.Status)
+	}
+
+	switch action {
+	case "retry":
+		intent.Status = intentRetry
+		intent.Attempts = 0
+		intent.NextAttempt = util.MakeTimestamp() / 1000
+		PaymentsInfoLogger.Printf("[Payments] Payout %v set to be sent again", key)
+		return intent, u.storeIntent(intent)
+	case "cancel":
+		intent.Status = intentFailed
+		intent.LastError = "cancelled"
+		PaymentsInfoLogger.Printf("[Payments] Payout %v cancelled, balances stay pending", key)
+		return intent, u.storeIntent(intent)
+	case "complete":
+		if txid == "" {
+			return intent, errors.New("txid is required to complete a payment intent")
+		}
+		transfer, err := u.rpc.GetTransferByTxid(u.rpc.Url.String(), txid)
+		if err != nil {
+			return intent, fmt.Errorf("wallet does not know transaction %v: %v", txid, err)
+		}
+		intent.Status = intentSent
+		intent.TxHash = txid
+		intent.TxFee = transfer.Transfer.Fees
+		u.storeIntent(intent)
+		PaymentsInfoLogger.Printf("[Payments] Payout %v completed with transaction %v, debiting its payees", key, txid)
+		_, err = u.completeIntent(intent, Storage_backend.GetPendingPayments())
+		return intent, err
+	}
+	return intent, fmt.Errorf("unknown action %q, expected retry, cancel or complete", action)
+}
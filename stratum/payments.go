@@ -6,6 +6,8 @@ import (
 	"log"
 	"math/big"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Nelbert442/dero-golang-pool/pool"
@@ -16,10 +18,17 @@ import (
 )
 
 type PayoutsProcessor struct {
-	config   *pool.PaymentsConfig
-	rpc      *rpc.RPCClient
-	halt     bool
-	lastFail error
+	stratum        *StratumServer
+	rpc            *rpc.RPCClient
+	halt           bool
+	lastFail       error
+	confirmTimeout time.Duration
+	dryRunTxs      int
+	// Guards pending payments between payouts and payout confirmation tracking, which restores balances of failed payouts
+	mu sync.Mutex
+	// Last wallet health check, see checkWalletHealth
+	health   *WalletHealth
+	healthMu sync.RWMutex
 }
 
 type PayoutTracker struct {
@@ -49,32 +58,49 @@ type Transfer struct {
 var wallet *walletapi.Wallet
 var PaymentsInfoLogger = logFileOutPayments("INFO")
 var PaymentsErrorLogger = logFileOutPayments("ERROR")
+var PaymentsWarnLogger = logFileOutPayments("WARN")
+var PaymentsDebugLogger = logFileOutPayments("DEBUG")
 
-func NewPayoutsProcessor(cfg *pool.PaymentsConfig, s *StratumServer) *PayoutsProcessor {
-	u := &PayoutsProcessor{config: cfg} //backend: s.backend}
-	u.rpc = s.rpc()
+func NewPayoutsProcessor(s *StratumServer) *PayoutsProcessor {
+	if err := validateTxFeePayer(&s.currentConfig().PaymentsConfig); err != nil {
+		PaymentsErrorLogger.Printf("[Payments] Config error: %v", err)
+		log.Fatalf("[Payments] Config error: %v", err)
+	}
+	u := &PayoutsProcessor{stratum: s} //backend: s.backend}
+	// Set payouts rpc to the stratumserver wallet rpc, so configured wallet credentials are used
+	u.rpc = s.walletRPC
+	s.payouts = u
 	return u
 }
 
+// Payments settings are read from the stratum config on use, so a config reload applies to the next payout
+func (u *PayoutsProcessor) currentConfig() *pool.PaymentsConfig {
+	return &u.stratum.currentConfig().PaymentsConfig
+}
+
 func (u *PayoutsProcessor) Start(s *StratumServer) {
-	log.Printf("[Payments] Starting payouts")
 	PaymentsInfoLogger.Printf("[Payments] Starting payouts")
 
-	intv, _ := time.ParseDuration(u.config.Interval)
+	intv, _ := time.ParseDuration(u.currentConfig().Interval)
 	timer := time.NewTimer(intv)
-	log.Printf("[Payments] Set payouts interval to %v", intv)
 	PaymentsInfoLogger.Printf("[Payments] Set payouts interval to %v", intv)
+	if u.currentConfig().DryRun {
+		PaymentsInfoLogger.Printf("[Payments] Dry-run mode enabled, payouts are only logged and no balances are debited")
+	}
 
-	payments := Graviton_backend.GetPendingPayments()
+	payments := Storage_backend.GetPendingPayments()
 
 	if len(payments) > 0 {
 		// Quick loop through to check if pending payments have reached threshold. Log to screen any insufficient balances pending as well as to screen/log any failed payments that are above threshold
 		var checkedPayments []*PaymentPending
 		var insufficientBalances []*PaymentPending
+		settings, lastPaid := u.minerPayoutSettings()
+		now := util.MakeTimestamp() / 1000
 		for _, val := range payments {
 			amount := val.Amount
+			address, _, _, _, _, _ := s.splitLoginString(val.Address)
 
-			if !u.reachedThreshold(amount) {
+			if !u.payoutDue(settings[address], amount, lastPaid[address], now) {
 				insufficientBalances = append(insufficientBalances, val)
 				continue
 			}
@@ -83,69 +109,208 @@ func (u *PayoutsProcessor) Start(s *StratumServer) {
 		}
 
 		if len(checkedPayments) > 0 {
-			log.Printf("[Payments] Previous payout failed, trying to resolve it. List of failed payments:\n %v",
-				formatPendingPayments(checkedPayments))
 			PaymentsInfoLogger.Printf("[Payments] Previous payout failed, trying to resolve it. List of failed payments:\n %v", formatPendingPayments(checkedPayments))
 		}
 
 		if len(insufficientBalances) > 0 {
-			log.Printf("[Payments] List of pending payments with insufficient balances (< %v):\n %v", u.config.Threshold,
-				formatPendingPayments(insufficientBalances))
+			PaymentsInfoLogger.Printf("[Payments] List of pending payments with insufficient balances (< %v):\n %v", u.currentConfig().Threshold, formatPendingPayments(insufficientBalances))
 		}
 	}
 
 	// Immediately process payouts after start
 	u.process(s)
 	timer.Reset(intv)
+	u.startWalletHealth(s)
+	u.startIntentRetries()
 
 	go func() {
 		for {
 			select {
 			case <-timer.C:
 				u.process(s)
+				if next, err := time.ParseDuration(u.currentConfig().Interval); err == nil && next > 0 && next != intv {
+					PaymentsInfoLogger.Printf("[Payments] Set payouts interval to %v", next)
+					intv = next
+				}
 				timer.Reset(intv)
 			}
 		}
 	}()
+
+	if u.currentConfig().ConfirmTracking {
+		confirmIntv, err := time.ParseDuration(u.currentConfig().ConfirmInterval)
+		if err != nil || confirmIntv <= 0 {
+			confirmIntv = time.Minute
+		}
+		u.confirmTimeout, err = time.ParseDuration(u.currentConfig().ConfirmTimeout)
+		if err != nil || u.confirmTimeout <= 0 {
+			u.confirmTimeout = time.Hour
+		}
+		PaymentsInfoLogger.Printf("[Payments] Tracking payouts to %v confirmations every %v, failing payouts unseen by the wallet after %v", u.currentConfig().Confirmations, confirmIntv, u.confirmTimeout)
+
+		confirmTimer := time.NewTimer(confirmIntv)
+
+		go func() {
+			for {
+				select {
+				case <-confirmTimer.C:
+					u.checkPayouts(s)
+					confirmTimer.Reset(confirmIntv)
+				}
+			}
+		}()
+	}
+}
+
+// Polls the wallet for pending payout transactions. They are confirmed once they reach the configured confirmations, or failed if the wallet reports them as not found
+// after confirmTimeout, in which case the payees balances are restored. Any other error [timeouts, a restarting wallet] keeps them pending, as a sent transaction failed
+// would pay its payees twice
+func (u *PayoutsProcessor) checkPayouts(s *StratumServer) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	payoutTxs := Storage_backend.GetPayoutTxs()
+	if payoutTxs == nil {
+		return
+	}
+	t := s.currentBlockTemplate()
+	if t == nil {
+		return
+	}
+
+	// Make sure the wallet is reachable first, so that an outage is not mistaken for dropped transactions
+	walletURL := u.rpc.Url.String()
+	_, err := u.rpc.GetBalance(walletURL)
+	if err != nil {
+		PaymentsErrorLogger.Printf("[Payments] Error when connecting to wallet %s to check payouts. Will try again later: %v", walletURL, err)
+		return
+	}
+
+	now := util.MakeTimestamp() / 1000
+	var updated bool
+	writeWait, _ := time.ParseDuration("10ms")
+
+	for txHash, payoutTx := range payoutTxs.Txs {
+		if payoutTx.Status != "pending" {
+			continue
+		}
+		updated = true
+		payoutTx.CheckedAt = now
+
+		transfer, err := u.rpc.GetTransferByTxid(walletURL, txHash)
+		if err == nil {
+			// Height is 0 while the transaction is still in the mempool
+			if transfer.Transfer.Height > 0 {
+				payoutTx.Height = transfer.Transfer.Height
+				payoutTx.Confirmations = int64(t.Height) - int64(transfer.Transfer.Height)
+				if payoutTx.Confirmations >= u.currentConfig().Confirmations {
+					payoutTx.Status = "confirmed"
+					PaymentsInfoLogger.Printf("[Payments] Payout %v confirmed at height %v with %v confirmations", txHash, payoutTx.Height, payoutTx.Confirmations)
+					for _, payee := range payoutTx.Payees {
+						address, _, _, _, _, _ := s.splitLoginString(payee.Login)
+						s.telegram.PaymentConfirmed(address, payee.Amount, txHash, payoutTx.Height)
+					}
+				}
+			}
+			continue
+		}
+
+		if !walletTxNotFound(err) {
+			PaymentsErrorLogger.Printf("[Payments] Could not check payout %v, keeping it pending: %v", txHash, err)
+			continue
+		}
+		if now-payoutTx.Timestamp < int64(u.confirmTimeout/time.Second) {
+			continue
+		}
+
+		payoutTx.Status = "failed"
+		PaymentsErrorLogger.Printf("[Payments] Payout %v was not seen by the wallet within %v, marking as failed and restoring balances: %v", txHash, u.confirmTimeout, err)
+
+		for _, payee := range payoutTx.Payees {
+			restored := &PaymentPending{Address: payee.Login, Amount: payee.Amount, Timestamp: now}
+
+			for Graviton_backend.Writing == 1 {
+				time.Sleep(writeWait)
+			}
+			Graviton_backend.Writing = 1
+			restoreErr := Storage_backend.WritePendingPayments(restored)
+			Graviton_backend.Writing = 0
+			if restoreErr != nil {
+				PaymentsErrorLogger.Printf("[Payments] Graviton DB err restoring %v DERO to %v: %v", payee.Amount, payee.Login, restoreErr)
+				continue
+			}
+			PaymentsInfoLogger.Printf("[Payments] Restored %v DERO to %v from failed payout %v", payee.Amount, payee.Login, txHash)
+		}
+	}
+
+	if updated {
+		for Graviton_backend.Writing == 1 {
+			time.Sleep(writeWait)
+		}
+		Graviton_backend.Writing = 1
+		err = Storage_backend.OverwritePayoutTxs(payoutTxs)
+		Graviton_backend.Writing = 0
+		if err != nil {
+			PaymentsErrorLogger.Printf("[Payments] Graviton DB err: %v", err)
+		}
+	}
 }
 
 func (u *PayoutsProcessor) process(s *StratumServer) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if s.inSafeMode() {
+		PaymentsErrorLogger.Printf("[Payments] Payouts paused by safe mode until acknowledged. Will try again in %s", u.currentConfig().Interval)
+		return
+	}
+
+	if health := u.checkWalletHealth(s); health.Paused {
+		PaymentsErrorLogger.Printf("[Payments] Payouts paused, %v. Will try again in %s", health.Reason, u.currentConfig().Interval)
+		return
+	}
 
-	maxAddresses := u.config.MaxAddresses
+	maxAddresses := u.currentConfig().MaxAddresses
 	var payoutList []rpc.Destinations
 	var paymentIDPayeeList []rpc.Destinations
 	var payIDList []string
-	var payPending []*PaymentPending
 
-	walletURL := fmt.Sprintf("http://%s:%v/json_rpc", u.config.WalletHost, u.config.WalletPort)
+	walletURL := u.rpc.Url.String()
+	u.dryRunTxs = 0
 	mustPay := 0
 	minersPaid := 0
 	totalAmount := big.NewInt(0)
 
-	// Graviton DB Pending Balance
-	payPending = Graviton_backend.GetPendingPayments()
+	// Graviton DB Pending Balance. Interrupted and failed payouts are resumed first, their logins are not paid again until they are resolved
+	held, payPending := u.resumeIntents(walletURL, Storage_backend.GetPendingPayments())
+	// Addresses with their own minPayment/interval are paid out once those are reached instead of the pool minPayment
+	settings, lastPaid := u.minerPayoutSettings()
+	now := util.MakeTimestamp() / 1000
+
+	// Check if we have enough funds. Payees are paid in order until the unlocked balance runs out, the rest stays pending for the next run
+	poolBalanceObj, err := u.rpc.GetBalance(walletURL)
+	if err != nil || poolBalanceObj == nil {
+		// TODO: mark sick maybe for tracking and frontend reporting?
+		PaymentsErrorLogger.Printf("[Payments] Error when getting balance from wallet %s. Will try again in %s", walletURL, u.currentConfig().Interval)
+		return
+	}
+	poolBalance := poolBalanceObj.UnlockedBalance
 	for _, val := range payPending {
 
 		login := val.Address
 		amount := val.Amount
 
-		if !u.reachedThreshold(amount) {
+		if held[login] {
 			continue
 		}
 
-		// Check if we have enough funds
-		poolBalanceObj, err := u.rpc.GetBalance(walletURL)
-		if err != nil {
-			// TODO: mark sick maybe for tracking and frontend reporting?
-			log.Printf("[Payments] Error when getting balance from wallet %s. Will try again in %s", walletURL, u.config.Interval)
-			PaymentsErrorLogger.Printf("[Payments] Error when getting balance from wallet %s. Will try again in %s", walletURL, u.config.Interval)
-			break
+		if settingsAddress, _, _, _, _, _ := s.splitLoginString(login); !u.payoutDue(settings[settingsAddress], amount, lastPaid[settingsAddress], now) {
+			continue
 		}
-		poolBalance := poolBalanceObj.UnlockedBalance
+
 		// Use <= here as in the event of running at 0 pool fee and no other balance, you will not be able to payout since invalid balance will occur from tx generation
 		if poolBalance <= amount {
-			log.Printf("[Payments] Not enough balance for payment, need %v DERO, pool has %v DERO", amount, poolBalance)
-			PaymentsErrorLogger.Printf("[Payments] Not enough balance for payment, need %v DERO, pool has %v DERO", amount, poolBalance)
+			PaymentsWarnLogger.Printf("[Payments] Not enough balance left for payment, need %v DERO, pool has %v DERO left. Remaining payouts stay pending", amount, poolBalance)
 			break
 		}
 
@@ -155,22 +320,19 @@ func (u *PayoutsProcessor) process(s *StratumServer) {
 
 		addr, _, paymentID, _, _, _ := s.splitLoginString(login)
 
-		log.Printf("[Payments] Split login. Address: %v, paymentID: %v", addr, paymentID)
-		PaymentsInfoLogger.Printf("[Payments] Split login. Address: %v, paymentID: %v", addr, paymentID)
+		PaymentsDebugLogger.Printf("[Payments] Split login. Address: %v, paymentID: %v", addr, paymentID)
 
 		// Validate Address - DERO will validate against native DERO validation functions, rest will validate against util [against pool address for comparison, similar to login]
-		switch s.config.Coin {
+		switch s.currentConfig().Coin {
 		case "DERO":
-			_, err := address.NewAddress(addr)
+			err := util.CheckAddress(addr, s.currentConfig().Address)
 
 			if err != nil {
-				log.Printf("[Payments] Invalid address format. Will not process payments - %v - %v", addr, err)
 				PaymentsErrorLogger.Printf("[Payments] Invalid address format. Will not process payments - %v - %v", addr, err)
 				continue
 			}
 		default:
-			if !util.ValidateAddressNonDERO(addr, s.config.Address) {
-				log.Printf("[Payments] Invalid address format. Will not process payments - %v", addr)
+			if !util.ValidateAddressNonDERO(addr, s.currentConfig().Address) {
 				PaymentsErrorLogger.Printf("[Payments] Invalid address format. Will not process payments - %v", addr)
 				continue
 			}
@@ -181,6 +343,7 @@ func (u *PayoutsProcessor) process(s *StratumServer) {
 			Address: addr,
 		}
 		mustPay++
+		poolBalance -= amount
 
 		// If paymentID, put in an array that'll be walked through one at a time versus combining addresses/amounts.
 		if paymentID != "" {
@@ -254,248 +417,231 @@ func (u *PayoutsProcessor) process(s *StratumServer) {
 		*/
 
 		// Send DERO - RPC (working)
-		var currPayout rpc.Transfer_Params
-		var lastPos int
-		currPayout.Mixin = u.config.Mixin
-		currPayout.Unlock_time = 0
-		currPayout.Get_tx_key = true
-		currPayout.Do_not_relay = false
-		currPayout.Get_tx_hex = true
-
 		// Payout paymentID addresses, one at a time since paymentID is used in the tx generation and is a non-array input
 		for p, payee := range payIDTracker.Destinations {
-			currPayout.Payment_ID = payIDTracker.PaymentIDs[p]
-			currPayout.Destinations = append(currPayout.Destinations, payee)
-
-			paymentOutput, err := u.rpc.SendTransaction(walletURL, currPayout)
+			login := payee.Address + s.currentConfig().Stratum.PaymentID.AddressSeparator + payIDTracker.PaymentIDs[p]
+			payees := []*IntentPayee{{Login: login, Address: payee.Address, Amount: payee.Amount}}
+			intent := newPaymentIntent(payIDTracker.PaymentIDs[p], payees)
+			u.chargeTxFee(walletURL, intent)
 
+			var err error
+			payPending, err = u.payIntent(walletURL, intent, payPending)
 			if err != nil {
-				log.Printf("[Payments] Error with transaction: %v", err)
 				PaymentsErrorLogger.Printf("[Payments] Error with transaction: %v", err)
 				break
 			}
-			log.Printf("[Payments] Success: %v", paymentOutput)
-			PaymentsInfoLogger.Printf("[Payments] Success: %v", paymentOutput)
-			// Log transaction hash
-			txHash := paymentOutput.Tx_hash_list
-			txFee := paymentOutput.Fee_list
-			// As pool owner, you probably want to store keys so that you can prove a send if required.
-			txKey := paymentOutput.Tx_key_list
-
-			if txHash == nil {
-				log.Printf("[Payments] Failed to generate transaction. It was sent successfully to rpc server, but no reply back.")
-				PaymentsErrorLogger.Printf("[Payments] Failed to generate transaction. It was sent successfully to rpc server, but no reply back.")
-
-				break
-			}
 
-			// Debit miner's balance and update stats
-			login := payee.Address + s.config.Stratum.PaymentID.AddressSeparator + currPayout.Payment_ID
-			amount := payee.Amount
+			minersPaid++
+			totalAmount.Add(totalAmount, big.NewInt(int64(intent.amount())))
+		}
 
-			for j, f := range payPending {
-				if login == f.Address {
-					payPending = removePendingPayments(payPending, j)
-					break
-				}
+		// Payout non-paymentID addresses, batched into transactions of up to maxAddresses recipients
+		batches := batchPayouts(payoutList, int(maxAddresses))
+		if len(batches) > 0 {
+			PaymentsInfoLogger.Printf("[Payments] Sending %v payees in %v transactions of up to %v recipients", len(payoutList), len(batches), maxAddresses)
+		}
+		for _, batch := range batches {
+			var payees []*IntentPayee
+			for _, payee := range batch {
+				payees = append(payees, &IntentPayee{Login: payee.Address, Address: payee.Address, Amount: payee.Amount})
 			}
+			intent := newPaymentIntent("", payees)
+			u.chargeTxFee(walletURL, intent)
 
-			prunedPaymentsPending := &PendingPayments{PendingPayout: payPending}
-
-			err = Graviton_backend.OverwritePendingPayments(prunedPaymentsPending)
+			var err error
+			payPending, err = u.payIntent(walletURL, intent, payPending)
 			if err != nil {
-				log.Printf("[Payments] Error overwriting pending payments. %v", err)
-				PaymentsErrorLogger.Printf("[Payments] Error overwriting pending payments. %v", err)
+				PaymentsErrorLogger.Printf("[Payments] Error with transaction: %v", err)
 				break
 			}
 
-			// Update stats for pool payments (gravitondb)
-			info := &MinerPayments{}
-			info.Login = login
-			info.TxHash = txHash[0]
-			info.TxKey = txKey[0]
-			info.TxFee = txFee[0]
-			info.Mixin = u.config.Mixin
-			info.Amount = amount
-			info.Timestamp = util.MakeTimestamp() / 1000
-
-			writeWait, _ := time.ParseDuration("10ms")
-			for Graviton_backend.Writing == 1 {
-				//log.Printf("[Payments-writeprocessedpayments] GravitonDB is writing... sleeping for %v...", writeWait)
-				//StorageInfoLogger.Printf("[Payments-writeprocessedpayments] GravitonDB is writing... sleeping for %v...", writeWait)
-				time.Sleep(writeWait)
-			}
-			Graviton_backend.Writing = 1
-			infoErr := Graviton_backend.WriteProcessedPayments(info)
-			Graviton_backend.Writing = 0
-			if infoErr != nil {
-				log.Printf("[Payments] Graviton DB err: %v", infoErr)
-				PaymentsErrorLogger.Printf("[Payments] Graviton DB err: %v", infoErr)
-				break
-			}
+			minersPaid += len(batch)
+			totalAmount.Add(totalAmount, big.NewInt(int64(intent.amount())))
+		}
+	}
 
-			minersPaid++
-			totalAmount.Add(totalAmount, big.NewInt(int64(amount)))
+	if mustPay > 0 && u.currentConfig().DryRun {
+		PaymentsInfoLogger.Printf("[Payments] Dry-run: would pay total %v DERO to %v of %v payees in %v transactions, no balances were debited", totalAmount, minersPaid, mustPay, u.dryRunTxs)
+	} else if mustPay > 0 {
+		PaymentsInfoLogger.Printf("[Payments] Paid total %v DERO to %v of %v payees", totalAmount, minersPaid, mustPay)
+	} else {
+		PaymentsInfoLogger.Printf("[Payments] No payees that have reached payout threshold")
+	}
+}
+
+// Groups payees into transactions of up to maxAddresses recipients. A transaction can only hold one integrated address [its payment id becomes the tx payment id],
+// so further integrated addresses are placed in the next batch with room instead of sending the current batch early
+func batchPayouts(payoutList []rpc.Destinations, maxAddresses int) [][]rpc.Destinations {
+	if maxAddresses < 1 {
+		maxAddresses = 1
+	}
+
+	var batches [][]rpc.Destinations
+	var hasIntegrated []bool
+	for _, payee := range payoutList {
+		integrated := false
+		if addr, err := address.NewAddress(payee.Address); err == nil && addr.IsIntegratedAddress() {
+			integrated = true
 		}
-		currPayout.Destinations = nil
 
-		var hasIntegratedAddr bool
+		placed := false
+		for i := range batches {
+			if len(batches[i]) < maxAddresses && !(integrated && hasIntegrated[i]) {
+				batches[i] = append(batches[i], payee)
+				hasIntegrated[i] = hasIntegrated[i] || integrated
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			batches = append(batches, []rpc.Destinations{payee})
+			hasIntegrated = append(hasIntegrated, integrated)
+		}
+	}
+	return batches
+}
 
-		// Payout non-paymentID addresses, max at a time according to maxAddresses in config
-		for i, value := range payoutList {
-			currPayout.Payment_ID = ""
-			currPayout.Destinations = append(currPayout.Destinations, value)
+// Adds delta [negative to debit] to the pending balance of login, returning the new balance. The balance can not go below 0, a balance of 0 is removed from the pending payments
+func (s *StratumServer) adjustBalance(login string, delta int64) (uint64, error) {
+	// Payouts debit the same pending payments, so adjustments wait for a running payout
+	if s.payouts != nil {
+		s.payouts.mu.Lock()
+		defer s.payouts.mu.Unlock()
+	}
 
-			// Check if current list of destinations has an integrated address (we cannot have more than 1). TOOD: Can re-do this to get to max addresses and include 1 integrated address rather than immediately sending when integrated is found
-			for _, v := range currPayout.Destinations {
-				vAddr, _ := address.NewAddress(v.Address)
+	writeWait, _ := time.ParseDuration("10ms")
+	for Graviton_backend.Writing == 1 {
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	defer func() {
+		Graviton_backend.Writing = 0
+	}()
 
-				if vAddr.IsIntegratedAddress() {
-					hasIntegratedAddr = true
-				}
+	var previous, balance uint64
+	err := Storage_backend.UpdatePendingPayments(func(payPending []*PaymentPending) ([]*PaymentPending, error) {
+		var current *PaymentPending
+		pos := -1
+		for i, p := range payPending {
+			if p.Address == login {
+				current = p
+				pos = i
+				break
 			}
+		}
+		if current == nil {
+			current = &PaymentPending{Address: login}
+		}
+		previous = current.Amount
 
-			// Payout if maxAddresses is reached or the payout list ending is reached or there is an integrated address within the list of recipients, send the tx
-			if len(currPayout.Destinations) >= int(maxAddresses) || i+1 == len(payoutList) || hasIntegratedAddr {
-				hasIntegratedAddr = false
-				paymentOutput, err := u.rpc.SendTransaction(walletURL, currPayout)
+		if delta < 0 && uint64(-delta) > current.Amount {
+			return nil, fmt.Errorf("balance of %v is lower than the debit of %v", current.Amount, -delta)
+		}
+		balance = uint64(int64(current.Amount) + delta)
 
-				if err != nil {
-					log.Printf("[Payments] Error with transaction: %v", err)
-					PaymentsErrorLogger.Printf("[Payments] Error with transaction: %v", err)
-					break
-				}
-				log.Printf("[Payments] Success: %v", paymentOutput)
-				PaymentsInfoLogger.Printf("[Payments] Success: %v", paymentOutput)
-				// Log transaction hash
-				txHash := paymentOutput.Tx_hash_list
-				txFee := paymentOutput.Fee_list
-				// As pool owner, you probably want to store keys so that you can prove a send if required.
-				txKey := paymentOutput.Tx_key_list
-
-				if txHash == nil {
-					log.Printf("[Payments] Failed to generate transaction. It was sent successfully to rpc server, but no reply back.")
-					PaymentsErrorLogger.Printf("[Payments] Failed to generate transaction. It was sent successfully to rpc server, but no reply back.")
-
-					break
-				}
+		updated := &PaymentPending{Timestamp: util.MakeTimestamp() / 1000, Amount: balance, Address: login}
+		if pos >= 0 {
+			payPending = removePendingPayments(payPending, pos)
+		}
+		if balance > 0 {
+			payPending = append(payPending, updated)
+		}
+		return payPending, nil
+	})
+	if err != nil {
+		return previous, err
+	}
+	PaymentsInfoLogger.Printf("[Payments] Adjusted pending balance of %v by %v from %v to %v", login, delta, previous, balance)
+	return balance, nil
+}
 
-				if len(payoutList) > 1 && maxAddresses > 1 {
-					payPos := i - lastPos
-					for k := 0; k <= payPos; k++ {
-						// Debit miner's balance and update stats
-						login := payoutList[lastPos+k].Address
-						amount := payoutList[lastPos+k].Amount
-
-						for j, f := range payPending {
-							if login == f.Address {
-								payPending = removePendingPayments(payPending, j)
-								break
-							}
-						}
-
-						prunedPaymentsPending := &PendingPayments{PendingPayout: payPending}
-
-						err = Graviton_backend.OverwritePendingPayments(prunedPaymentsPending)
-						if err != nil {
-							log.Printf("[Payments] Error overwriting pending payments. %v", err)
-							PaymentsErrorLogger.Printf("[Payments] Error overwriting pending payments. %v", err)
-							break
-						}
-
-						// Update stats for pool payments (gravitondb)
-						info := &MinerPayments{}
-						info.Login = login
-						info.TxHash = txHash[0]
-						info.TxKey = txKey[0]
-						info.TxFee = txFee[0]
-						info.Mixin = u.config.Mixin
-						info.Amount = amount
-						info.Timestamp = util.MakeTimestamp() / 1000
-
-						writeWait, _ := time.ParseDuration("10ms")
-						for Graviton_backend.Writing == 1 {
-							//log.Printf("[Payments-writeprocessedpayments] GravitonDB is writing... sleeping for %v...", writeWait)
-							//StorageInfoLogger.Printf("[Payments-writeprocessedpayments] GravitonDB is writing... sleeping for %v...", writeWait)
-							time.Sleep(writeWait)
-						}
-						Graviton_backend.Writing = 1
-						infoErr := Graviton_backend.WriteProcessedPayments(info)
-						Graviton_backend.Writing = 0
-						if infoErr != nil {
-							log.Printf("[Payments] Graviton DB err: %v", infoErr)
-							PaymentsErrorLogger.Printf("[Payments] Graviton DB err: %v", infoErr)
-							break
-						}
-
-						minersPaid++
-						totalAmount.Add(totalAmount, big.NewInt(int64(amount)))
-					}
-				} else {
-					log.Printf("[Payments] Processing payoutList[i]: %v", payoutList[i])
-					PaymentsInfoLogger.Printf("[Payments] Processing payoutList[i]: %v", payoutList[i])
-					// Debit miner's balance and update stats
-					login := value.Address
-					amount := value.Amount
-
-					for j, f := range payPending {
-						if login == f.Address {
-							//log.Printf("[Payments] Removing payPending: %v", payPending[j])
-							payPending = removePendingPayments(payPending, j)
-							break
-						}
-					}
+// Returns whether err is the wallet replying that it does not know the transaction, as opposed to the request failing on the way
+func walletTxNotFound(err error) bool {
+	rpcErr, ok := err.(*rpc.RPCError)
+	return ok && strings.Contains(strings.ToLower(rpcErr.Message), "not found")
+}
 
-					prunedPaymentsPending := &PendingPayments{PendingPayout: payPending}
+// Sends the payout transaction through the wallet rpc, or only builds it with Do_not_relay. In dry-run mode, the transaction is only logged and a placeholder reply
+// without a fee is returned
+func (u *PayoutsProcessor) sendTransaction(walletURL string, params rpc.Transfer_Params) (*rpc.TransferSplit_Result, error) {
+	if !u.currentConfig().DryRun {
+		return u.rpc.SendTransaction(walletURL, params)
+	}
+	if params.Do_not_relay {
+		PaymentsInfoLogger.Printf("[Payments] Dry-run: would estimate the fee of a transaction with mixin %v, paymentID '%v', destinations: %v", params.Mixin, params.Payment_ID, params.Destinations)
+		return &rpc.TransferSplit_Result{Fee_list: []uint64{0}}, nil
+	}
 
-					err = Graviton_backend.OverwritePendingPayments(prunedPaymentsPending)
-					if err != nil {
-						log.Printf("[Payments] Error overwriting pending payments. %v", err)
-						PaymentsErrorLogger.Printf("[Payments] Error overwriting pending payments. %v", err)
-						break
-					}
+	u.dryRunTxs++
+	PaymentsInfoLogger.Printf("[Payments] Dry-run: would send transaction %v with mixin %v, paymentID '%v', destinations: %v", u.dryRunTxs, params.Mixin, params.Payment_ID, params.Destinations)
+	return &rpc.TransferSplit_Result{Tx_hash_list: []string{"dryrun"}, Tx_key_list: []string{""}, Fee_list: []uint64{0}}, nil
+}
 
-					// Update stats for pool payments (gravitondb)
-					info := &MinerPayments{}
-					info.Login = login
-					info.TxHash = txHash[0]
-					info.TxKey = txKey[0]
-					info.TxFee = txFee[0]
-					info.Mixin = u.config.Mixin
-					info.Amount = amount
-					info.Timestamp = util.MakeTimestamp() / 1000
-
-					writeWait, _ := time.ParseDuration("10ms")
-					for Graviton_backend.Writing == 1 {
-						//log.Printf("[Payments-writeprocessedpayments] GravitonDB is writing... sleeping for %v...", writeWait)
-						//StorageInfoLogger.Printf("[Payments-writeprocessedpayments] GravitonDB is writing... sleeping for %v...", writeWait)
-						time.Sleep(writeWait)
-					}
-					Graviton_backend.Writing = 1
-					infoErr := Graviton_backend.WriteProcessedPayments(info)
-					Graviton_backend.Writing = 0
-					if infoErr != nil {
-						log.Printf("[Payments] Graviton DB err: %v", infoErr)
-						PaymentsErrorLogger.Printf("[Payments] Graviton DB err: %v", infoErr)
-						break
-					}
+// Debits the paid amount and the fee charged [its gross] from the pending balance of login and records the processed payment. An error is only returned if the balance
+// could not be debited, a failure to record the payment afterwards is logged. In dry-run mode, nothing is written and the pending payments are returned as is
+func (u *PayoutsProcessor) recordPayout(payPending []*PaymentPending, login string, amount, fee uint64, txHash, txKey string, txFee uint64) ([]*PaymentPending, error) {
+	gross := amount + fee
+	if u.currentConfig().DryRun {
+		PaymentsInfoLogger.Printf("[Payments] Dry-run: would debit %v from %v, sending %v", gross, login, amount)
+		return payPending, nil
+	}
 
-					minersPaid++
-					totalAmount.Add(totalAmount, big.NewInt(int64(amount)))
+	// The balance may have been credited since the payout was built [a resumed payout, or another pool process sharing the store], only the amount paid is
+	// debited from the stored balances
+	writeWait, _ := time.ParseDuration("10ms")
+	for Graviton_backend.Writing == 1 {
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	err := Storage_backend.UpdatePendingPayments(func(stored []*PaymentPending) ([]*PaymentPending, error) {
+		for j, f := range stored {
+			if login == f.Address {
+				if f.Amount > gross {
+					f.Amount -= gross
+				} else {
+					stored = removePendingPayments(stored, j)
 				}
-				// Empty currpayout destinations array
-				currPayout.Destinations = nil
-				lastPos = i + 1 // Increment lastPos so it'll be equal to i next round in loop (if required)
+				break
 			}
 		}
+		payPending = stored
+		return stored, nil
+	})
+	Graviton_backend.Writing = 0
+	if err != nil {
+		PaymentsErrorLogger.Printf("[Payments] Error overwriting pending payments. %v", err)
+		return payPending, err
 	}
 
-	if mustPay > 0 {
-		log.Printf("[Payments] Paid total %v DERO to %v of %v payees", totalAmount, minersPaid, mustPay)
-		PaymentsInfoLogger.Printf("[Payments] Paid total %v DERO to %v of %v payees", totalAmount, minersPaid, mustPay)
-	} else {
-		log.Printf("[Payments] No payees that have reached payout threshold")
+	// Update stats for pool payments (gravitondb)
+	info := &MinerPayments{}
+	info.Login = login
+	info.TxHash = txHash
+	info.TxKey = txKey
+	info.TxFee = txFee
+	info.Fee = fee
+	info.Mixin = u.currentConfig().Mixin
+	info.Amount = amount
+	info.Timestamp = util.MakeTimestamp() / 1000
+
+	for Graviton_backend.Writing == 1 {
+		//StorageInfoLogger.Printf("[Payments-writeprocessedpayments] GravitonDB is writing... sleeping for %v...", writeWait)
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	err = Storage_backend.WriteProcessedPayments(info)
+	if err == nil && u.currentConfig().ConfirmTracking {
+		err = Storage_backend.WritePayoutTx(info)
 	}
+	Graviton_backend.Writing = 0
+	if err != nil {
+		PaymentsErrorLogger.Printf("[Payments] Graviton DB err recording payment %v of %v to %v: %v", txHash, amount, login, err)
+	}
+
+	// Payees are not exposed to all clients, same as /api/payments
+	u.stratum.live.publish("payment", map[string]interface{}{"hash": txHash, "amount": amount, "fee": txFee, "mixin": info.Mixin})
+
+	return payPending, nil
 }
 
 func removePendingPayments(s []*PaymentPending, i int) []*PaymentPending {
@@ -514,17 +660,8 @@ func formatPendingPayments(list []*PaymentPending) string {
 	return s
 }
 
-func (self PayoutsProcessor) reachedThreshold(amount uint64) bool {
-	return self.config.Threshold < amount
-}
-
-func logFileOutPayments(lType string) *log.Logger {
-	var logFileName string
-	if lType == "ERROR" {
-		logFileName = "logs/paymentsError.log"
-	} else {
-		logFileName = "logs/payments.log"
-	}
+func logFileOutPayments(lType string) *util.Logger {
+	logFileName := util.LogFileName("payments", lType)
 	os.Mkdir("logs", 0705)
 	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0705)
 	if err != nil {
@@ -533,5 +670,5 @@ func logFileOutPayments(lType string) *log.Logger {
 
 	logType := lType + ": "
 	l := log.New(f, logType, log.LstdFlags|log.Lmicroseconds)
-	return l
+	return util.NewLogger("payments", lType, l)
 }
@@ -0,0 +1,132 @@
+package stratum
+
+import (
+	"testing"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+)
+
+// Store counting the writes of payouts. Anything else used of the store panics on the nil Storage
+type dryRunTestStorage struct {
+	Storage
+	intents *PaymentIntents
+	writes  int
+}
+
+func (d *dryRunTestStorage) GetPaymentIntents() *PaymentIntents { return d.intents }
+
+func (d *dryRunTestStorage) UpdatePendingPayments(modify func(pending []*PaymentPending) ([]*PaymentPending, error)) error {
+	d.writes++
+	return nil
+}
+
+func (d *dryRunTestStorage) OverwritePendingPayments(info *PendingPayments) error {
+	d.writes++
+	return nil
+}
+
+func (d *dryRunTestStorage) WriteProcessedPayments(info *MinerPayments) error {
+	d.writes++
+	return nil
+}
+
+func (d *dryRunTestStorage) WritePayoutTx(info *MinerPayments) error {
+	d.writes++
+	return nil
+}
+
+func (d *dryRunTestStorage) OverwritePaymentIntents(info *PaymentIntents) error {
+	d.writes++
+	return nil
+}
+
+func newDryRunTestProcessor(t *testing.T) (*PayoutsProcessor, *dryRunTestStorage) {
+	store := &dryRunTestStorage{}
+	previous := Storage_backend
+	Storage_backend = store
+	t.Cleanup(func() { Storage_backend = previous })
+
+	s := &StratumServer{}
+	s.config.Store(&pool.Config{PaymentsConfig: pool.PaymentsConfig{DryRun: true, Mixin: 8}})
+	return &PayoutsProcessor{stratum: s}, store
+}
+
+func dryRunTestPending() []*PaymentPending {
+	return []*PaymentPending{{Address: "dERoFirst", Amount: 1000}, {Address: "dERoSecond", Amount: 2000}, {Address: "dERoThird+paymentid", Amount: 3000}}
+}
+
+// A dry-run payout goes through sending and debiting its payees without storing anything or debiting a balance
+func TestDryRunPayoutDoesNotDebit(t *testing.T) {
+	u, store := newDryRunTestProcessor(t)
+	payPending := dryRunTestPending()
+
+	batch := newPaymentIntent("", []*IntentPayee{{Login: "dERoFirst", Address: "dERoFirst", Amount: 1000}, {Login: "dERoSecond", Address: "dERoSecond", Amount: 2000}})
+	withPaymentID := newPaymentIntent("paymentid", []*IntentPayee{{Login: "dERoThird+paymentid", Address: "dERoThird", Amount: 3000}})
+	for _, intent := range []*PaymentIntent{batch, withPaymentID} {
+		var err error
+		if payPending, err = u.payIntent("http://127.0.0.1:0/json_rpc", intent, payPending); err != nil {
+			t.Fatalf("dry-run payout failed: %v", err)
+		}
+	}
+
+	if store.writes != 0 {
+		t.Fatalf("dry-run payouts wrote to the store %v times", store.writes)
+	}
+	if u.dryRunTxs != 2 {
+		t.Fatalf("dry-run logged %v transactions, expected 2", u.dryRunTxs)
+	}
+	expected := dryRunTestPending()
+	if len(payPending) != len(expected) {
+		t.Fatalf("%v pending payments after the dry-run, expected %v", len(payPending), len(expected))
+	}
+	for i, pending := range payPending {
+		if *pending != *expected[i] {
+			t.Fatalf("pending payment of %v changed from %v to %v", pending.Address, expected[i].Amount, pending.Amount)
+		}
+	}
+}
+
+// Stored intents are neither resumed nor retried in dry-run mode, their payees are only held out of the payout
+func TestDryRunResumeIntents(t *testing.T) {
+	u, store := newDryRunTestProcessor(t)
+	sent := newPaymentIntent("", []*IntentPayee{{Login: "dERoFirst", Address: "dERoFirst", Amount: 1000}})
+	sent.Status = intentSent
+	sent.TxHash = "hash"
+	retry := newPaymentIntent("", []*IntentPayee{{Login: "dERoSecond", Address: "dERoSecond", Amount: 2000}})
+	retry.Status = intentRetry
+	store.intents = &PaymentIntents{Intents: map[string]*PaymentIntent{sent.Key: sent, retry.Key: retry}}
+
+	held, payPending := u.resumeIntents("http://127.0.0.1:0/json_rpc", dryRunTestPending())
+	if store.writes != 0 {
+		t.Fatalf("dry-run resume wrote to the store %v times", store.writes)
+	}
+	if u.dryRunTxs != 0 {
+		t.Fatalf("dry-run resume sent %v transactions", u.dryRunTxs)
+	}
+	if !held["dERoFirst"] || !held["dERoSecond"] || held["dERoThird+paymentid"] {
+		t.Fatalf("held %v, expected the payees of the open intents", held)
+	}
+	for i, pending := range dryRunTestPending() {
+		if *payPending[i] != *pending {
+			t.Fatalf("pending payment of %v changed from %v to %v", pending.Address, pending.Amount, payPending[i].Amount)
+		}
+	}
+}
+
+// With txFeePayer "miner", a dry-run payout charges txFeeReserve without contacting the wallet for the fee estimate
+func TestDryRunChargeTxFee(t *testing.T) {
+	u, _ := newDryRunTestProcessor(t)
+	u.stratum.config.Store(&pool.Config{PaymentsConfig: pool.PaymentsConfig{DryRun: true, Mixin: 8, TxFeePayer: "miner", TxFeeReserve: 300}})
+
+	intent := newPaymentIntent("", []*IntentPayee{{Login: "dERoFirst", Address: "dERoFirst", Amount: 1000}, {Login: "dERoSecond", Address: "dERoSecond", Amount: 2000}})
+	u.chargeTxFee("http://127.0.0.1:0/json_rpc", intent)
+
+	if u.dryRunTxs != 0 {
+		t.Fatalf("dry-run fee estimate logged %v transactions", u.dryRunTxs)
+	}
+	for i, expected := range []uint64{100, 200} {
+		if payee := intent.Payees[i]; payee.Fee != expected {
+			t.Fatalf("%v charged a fee of %v, expected %v of txFeeReserve", payee.Login, payee.Fee, expected)
+		}
+	}
+}
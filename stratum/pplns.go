@@ -0,0 +1,148 @@
+package stratum
+
+import (
+	"sync"
+
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// Share weight submitted by a miner id. Consecutive shares of the same miner and fee are merged into one entry to keep the window small.
+// Fee is the pool fee percent of the port the shares were found on, nil for entries stored before per port fees [unlocker poolFee]
+type PPLNSShare struct {
+	Login     string
+	Shares    int64
+	Fee       *float64 `json:",omitempty"`
+	Timestamp int64
+}
+
+// Rolling window of the last N x network difficulty pool shares, oldest first. Rewards of pool blocks are split over the window as it was when the block was found
+type pplnsWindow struct {
+	sync.Mutex
+	shares []*PPLNSShare
+	total  int64
+	n      float64
+}
+
+func newPPLNSWindow(n float64, stored []*PPLNSShare) *pplnsWindow {
+	if n <= 0 {
+		n = 2
+	}
+	w := &pplnsWindow{n: n}
+	for _, share := range stored {
+		if share == nil || share.Shares <= 0 {
+			continue
+		}
+		w.shares = append(w.shares, share)
+		w.total += share.Shares
+	}
+	return w
+}
+
+// Adds shares of login found at fee percent to the window, then trims the oldest shares past N x netDiff. The oldest entry is cut partially so the window holds exactly N x netDiff once full
+func (w *pplnsWindow) add(login string, shares int64, fee float64, netDiff int64) {
+	if shares <= 0 {
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	if last := len(w.shares) - 1; last >= 0 && w.shares[last].Login == login && w.shares[last].Fee != nil && *w.shares[last].Fee == fee {
+		w.shares[last].Shares += shares
+		w.shares[last].Timestamp = util.MakeTimestamp() / 1000
+	} else {
+		w.shares = append(w.shares, &PPLNSShare{Login: login, Shares: shares, Fee: &fee, Timestamp: util.MakeTimestamp() / 1000})
+	}
+	w.total += shares
+
+	if netDiff <= 0 {
+		return
+	}
+	limit := int64(w.n * float64(netDiff))
+	var trimmed int
+	for w.total > limit && trimmed < len(w.shares) {
+		excess := w.total - limit
+		oldest := w.shares[trimmed]
+		if oldest.Shares <= excess {
+			w.total -= oldest.Shares
+			trimmed++
+			continue
+		}
+		oldest.Shares -= excess
+		w.total -= excess
+	}
+	if trimmed > 0 {
+		w.shares = append([]*PPLNSShare(nil), w.shares[trimmed:]...)
+	}
+}
+
+// Returns the shares and fee weights in the window by login, in the same form as round shares/fees so calculateRewardsForSharesGrav can split rewards over it.
+// Entries without a fee are weighted at defaultFee
+func (w *pplnsWindow) snapshot(defaultFee float64) (map[string]int64, map[string]float64) {
+	w.Lock()
+	defer w.Unlock()
+
+	shares := make(map[string]int64)
+	fees := make(map[string]float64)
+	for _, share := range w.shares {
+		fee := defaultFee
+		if share.Fee != nil {
+			fee = *share.Fee
+		}
+		shares[share.Login] += share.Shares
+		fees[share.Login] += float64(share.Shares) * fee
+	}
+	return shares, fees
+}
+
+// Returns a copy of the window entries for storage
+func (w *pplnsWindow) values() []*PPLNSShare {
+	w.Lock()
+	defer w.Unlock()
+
+	values := make([]*PPLNSShare, len(w.shares))
+	for i, share := range w.shares {
+		s := *share
+		if share.Fee != nil {
+			fee := *share.Fee
+			s.Fee = &fee
+		}
+		values[i] = &s
+	}
+	return values
+}
+
+// Counts a valid pool share found at fee percent towards the PPLNS window, solo shares are never paid out of pool blocks
+func (s *StratumServer) recordPPLNSShare(m *Miner, shares int64, fee float64, netDiff uint64) {
+	if s.pplns == nil || m.IsSolo {
+		return
+	}
+	s.pplns.add(m.Id, shares, fee, int64(netDiff))
+}
+
+// Stores the window so it survives restarts. Caller holds the Graviton_backend.Writing flag
+func (s *StratumServer) storePPLNSWindow() {
+	if s.pplns == nil {
+		return
+	}
+	err := Storage_backend.WritePPLNSWindow(s.pplns.values())
+	if err != nil {
+		StratumErrorLogger.Printf("[PPLNS] Err storing window: %v", err)
+	}
+}
+
+// Stores the window as it is when a pool block is found, the unlocker splits the block reward over it. Caller holds the Graviton_backend.Writing flag
+func (s *StratumServer) storePPLNSRound(height int64) {
+	if s.pplns == nil {
+		return
+	}
+	shares, fees := s.pplns.snapshot(s.currentConfig().UnlockerConfig.PoolFee)
+	StratumInfoLogger.Printf("[PPLNS] Storing window of %v miners for block at height %v", len(shares), height)
+	err := Storage_backend.WritePPLNSRoundShares(height, shares)
+	if err == nil {
+		err = Storage_backend.WritePPLNSRoundFees(height, fees)
+	}
+	if err != nil {
+		StratumErrorLogger.Printf("[PPLNS] Err storing window for block at height %v: %v", height, err)
+	}
+}
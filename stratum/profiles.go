@@ -0,0 +1,62 @@
+package stratum
+
+import (
+	"log"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+)
+
+// Fills the settings a port leaves unset from the stratum diffProfiles preset it names, so the ports reported by the api carry the resolved settings.
+// A port naming an unknown profile is a config error
+func applyDiffProfiles(cfg *pool.Config) {
+	for i := range cfg.Stratum.Ports {
+		port := &cfg.Stratum.Ports[i]
+		if port.Profile == "" {
+			continue
+		}
+		profile, ok := cfg.Stratum.DiffProfiles[port.Profile]
+		if !ok {
+			log.Fatalf("[Stratum] Port %v uses difficulty profile %q which is not defined in stratum diffProfiles", port.Port, port.Profile)
+		}
+
+		if port.Difficulty == 0 {
+			port.Difficulty = profile.Difficulty
+		}
+		if port.MinDiff == 0 {
+			port.MinDiff = profile.MinDiff
+		}
+		if port.DiffFloor == 0 {
+			port.DiffFloor = profile.DiffFloor
+		}
+		if port.VarDiffMin == 0 {
+			port.VarDiffMin = profile.VarDiffMin
+		}
+		if port.VarDiffMax == 0 {
+			port.VarDiffMax = profile.VarDiffMax
+		}
+		if port.MaxConnections == 0 && port.MaxConn == 0 {
+			port.MaxConnections = profile.MaxConnections
+		}
+		if port.Desc == "" {
+			port.Desc = profile.Desc
+		}
+		if profile.NiceHash {
+			port.NiceHash = true
+		}
+		if port.NiceHashMinDiff == 0 {
+			port.NiceHashMinDiff = profile.NiceHashMinDiff
+		}
+	}
+}
+
+// Returns the vardiff bounds of the sessions of the port, its varDiffMin and varDiffMax or the varDiff minDiff and maxDiff
+func (e *Endpoint) varDiffBounds(cfg *pool.VarDiffConfig) (int64, int64) {
+	minDiff, maxDiff := cfg.MinDiff, cfg.MaxDiff
+	if e.config.VarDiffMin > 0 {
+		minDiff = e.config.VarDiffMin
+	}
+	if e.config.VarDiffMax > 0 {
+		maxDiff = e.config.VarDiffMax
+	}
+	return minDiff, maxDiff
+}
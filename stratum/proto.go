@@ -23,41 +23,113 @@ type JSONPushMessage struct {
 }
 
 type LoginParams struct {
-	Login string `json:"login"`
-	Pass  string `json:"pass"`
-	Agent string `json:"agent"`
+	Login string     `json:"login"`
+	Pass  string     `json:"pass"`
+	Agent string     `json:"agent"`
+	Algo  LoginAlgos `json:"algo"`
+	RigId string     `json:"rigid"`
+}
+
+// Algorithms advertised by the miner at login, xmrig sends a list but a single string is accepted as well
+type LoginAlgos []string
+
+func (a *LoginAlgos) UnmarshalJSON(data []byte) error {
+	var algo string
+	if err := json.Unmarshal(data, &algo); err == nil {
+		if algo != "" {
+			*a = LoginAlgos{algo}
+		}
+		return nil
+	}
+	var algos []string
+	if err := json.Unmarshal(data, &algos); err != nil {
+		return err
+	}
+	*a = algos
+	return nil
 }
 
 type GetJobParams struct {
 	Id string `json:"id"`
 }
 
+type KeepAliveParams struct {
+	Id string `json:"id"`
+}
+
 type SubmitParams struct {
 	Id     string `json:"id"`
 	JobId  string `json:"job_id"`
 	Nonce  string `json:"nonce"`
 	Result string `json:"result"`
+	// Hex of the connection part of the reserved space on ports with extraNonceSize
+	ExtraNonce string `json:"extranonce,omitempty"`
+}
+
+type WelcomeMessageParams struct {
+	Message string `json:"message"`
+}
+
+type BlockFoundParams struct {
+	Height uint64 `json:"height"`
+	Hash   string `json:"hash"`
+	Solo   bool   `json:"solo"`
+	Finder bool   `json:"finder"`
 }
 
 type JobReply struct {
-	Id     string        `json:"id"`
-	Job    *JobReplyData `json:"job"`
-	Status string        `json:"status"`
+	Id         string        `json:"id"`
+	Job        *JobReplyData `json:"job"`
+	Extensions []string      `json:"extensions,omitempty"`
+	Status     string        `json:"status"`
 }
 
 type JobReplyData struct {
 	Blob   string `json:"blob"`
 	JobId  string `json:"job_id"`
 	Target string `json:"target"`
-	Algo   string `json:"algo"`
-	Height uint64 `json:"height"`
+	Algo   string `json:"algo,omitempty"`
+	Height uint64 `json:"height,omitempty"`
+	// Offset in the blob and size of the reserved space left to the connection, on ports with extraNonceSize
+	ExtraNonceOffset uint64 `json:"extranonce_offset,omitempty"`
+	ExtraNonceSize   int    `json:"extranonce_size,omitempty"`
 }
 
 type StatusReply struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
+	// Share feedback of accepted shares with stratum shareFeedback: the difficulty computed from the share result and the round shares of the miner so far
+	ShareDifficulty uint64 `json:"shareDifficulty,omitempty"`
+	RoundShares     int64  `json:"roundShares,omitempty"`
 }
 
+// Stratum error codes, so proxies and farm management software can react to an error without parsing its message. Share and request errors follow the common
+// stratum codes [and json-rpc for unknown methods], login rejections have codes of their own
+const (
+	errCodeOther           = 20
+	errCodeJobNotFound     = 21
+	errCodeDuplicateShare  = 22
+	errCodeLowDifficulty   = 23
+	errCodeUnauthenticated = 24
+	errCodeInvalidMethod   = -32601
+
+	errCodeInvalidAddress        = 101
+	errCodeWrongNetwork          = 102
+	errCodeBannedIP              = 103
+	errCodePoolFull              = 104
+	errCodeMalformedPaymentID    = 105
+	errCodeBelowMinDiff          = 106
+	errCodeMinerConnections      = 107
+	errCodeFarmAuth              = 108
+	errCodeInvalidPayoutSettings = 109
+	errCodeUnsupportedAlgo       = 110
+	errCodePoolUnavailable       = 111
+	errCodePoolBusy              = 112
+	errCodeAddressBlacklisted    = 113
+	errCodeAddressNotWhitelisted = 114
+	errCodeMessageLimit          = 115
+)
+
 type ErrorReply struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
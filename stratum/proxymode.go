@@ -0,0 +1,485 @@
+package stratum
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// Stratum client of proxy mode. The pool logs in to an upstream pool as a single miner and serves its jobs as block templates: every connection gets its own
+// extranonce within the reserved space the upstream leaves to the proxy [the extraNonceSize of the upstream port], and shares meeting the target of the
+// upstream job are forwarded to it instead of being submitted to the daemon. The upstream pays the proxy login, creditPayout splits each upstream payout over
+// the shares of the local round
+type ProxyClient struct {
+	config    *pool.ProxyModeConfig
+	timeout   time.Duration
+	keepAlive time.Duration
+	reconnect time.Duration
+
+	// Upstream connection, its login and the requests awaiting a reply, guarded by mu. Writes to the connection hold mu as well
+	mu           sync.Mutex
+	conn         net.Conn
+	loginId      string
+	loginRequest uint64
+	requestId    uint64
+	pending      map[uint64]*proxyShare
+	connected    int32
+
+	// Shares forwarded upstream since start, and the ones accepted or rejected by it
+	Submitted int64
+	Accepted  int64
+	Rejected  int64
+
+	// Txids of the upstream payouts credited since start
+	creditMu sync.Mutex
+	credited map[string]bool
+}
+
+// A share forwarded upstream, kept until its reply
+type proxyShare struct {
+	minerId string
+	height  uint64
+	sentAt  time.Time
+}
+
+// Request to the upstream pool
+type proxyRequest struct {
+	Id     uint64      `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+// Message from the upstream pool, a reply to one of the requests [Id set] or a pushed job
+type proxyMessage struct {
+	Id     *uint64          `json:"id"`
+	Method string           `json:"method"`
+	Params *json.RawMessage `json:"params"`
+	Result *json.RawMessage `json:"result"`
+	Error  *json.RawMessage `json:"error"`
+}
+
+// Status of the upstream pool connection served in /api/stats
+type ProxyStatus struct {
+	Url       string
+	Connected bool
+	Height    uint64
+	Submitted int64
+	Accepted  int64
+	Rejected  int64
+}
+
+func NewProxyClient(cfg *pool.ProxyModeConfig) *ProxyClient {
+	p := &ProxyClient{config: cfg}
+	p.timeout, _ = time.ParseDuration(cfg.Timeout)
+	if p.timeout <= 0 {
+		p.timeout = 2 * time.Minute
+	}
+	p.keepAlive, _ = time.ParseDuration(cfg.KeepAliveInterval)
+	if p.keepAlive <= 0 {
+		p.keepAlive = time.Minute
+	}
+	p.reconnect, _ = time.ParseDuration(cfg.ReconnectInterval)
+	if p.reconnect <= 0 {
+		p.reconnect = 10 * time.Second
+	}
+	return p
+}
+
+// Connects to the upstream pool and keeps reconnecting every reconnectInterval once disconnected. The pool is sick while it is not logged in upstream
+func (p *ProxyClient) Start(s *StratumServer) {
+	StratumInfoLogger.Printf("[Proxy] Relaying work of upstream pool %s, timeout: %v, keepalive every %v", p.config.Url, p.timeout, p.keepAlive)
+	go func() {
+		for {
+			err := p.run(s)
+			p.disconnected()
+			StratumErrorLogger.Printf("[Proxy] Disconnected from upstream pool %s: %v, reconnecting in %v", p.config.Url, err, p.reconnect)
+			time.Sleep(p.reconnect)
+		}
+	}()
+}
+
+func (p *ProxyClient) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: p.timeout}
+	if p.config.TLS {
+		return tls.DialWithDialer(dialer, "tcp", p.config.Url, &tls.Config{})
+	}
+	return dialer.Dial("tcp", p.config.Url)
+}
+
+// Logs in to the upstream pool and handles its messages until the connection fails
+func (p *ProxyClient) run(s *StratumServer) error {
+	conn, err := p.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	p.mu.Lock()
+	p.conn = conn
+	p.pending = make(map[uint64]*proxyShare)
+	p.mu.Unlock()
+
+	login := p.config.Login
+	if login == "" {
+		login = s.currentConfig().Address
+	}
+	params := &LoginParams{Login: login, Pass: p.config.Password, Agent: "dero-golang-pool/" + Version}
+	id, err := p.send("login", params, nil)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.loginRequest = id
+	p.mu.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go p.keepAliveLoop(stop)
+
+	reader := bufio.NewReaderSize(conn, MaxReqSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(p.timeout))
+		data, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return err
+		}
+		if isPrefix {
+			return errors.New("message over the maximum request size")
+		}
+		if len(data) <= 1 {
+			continue
+		}
+		var msg proxyMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("malformed message: %v", err)
+		}
+		if err := p.handleMessage(s, &msg); err != nil {
+			return err
+		}
+	}
+}
+
+// Sends keepalives to the upstream pool so an idle proxy [no shares meeting the upstream target] is not timed out, and drops submits left without a reply
+func (p *ProxyClient) keepAliveLoop(stop chan struct{}) {
+	ticker := time.NewTicker(p.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			loginId := p.loginId
+			for id, share := range p.pending {
+				if time.Since(share.sentAt) > p.timeout {
+					delete(p.pending, id)
+				}
+			}
+			p.mu.Unlock()
+			if loginId == "" {
+				continue
+			}
+			if _, err := p.send("keepalived", &KeepAliveParams{Id: loginId}, nil); err != nil {
+				StratumErrorLogger.Printf("[Proxy] Keepalive to upstream pool failed: %v", err)
+			}
+		}
+	}
+}
+
+// Writes a request to the upstream pool, share is kept as pending until its reply. A failed write closes the connection
+func (p *ProxyClient) send(method string, params interface{}, share *proxyShare) (uint64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return 0, errors.New("not connected")
+	}
+	p.requestId++
+	id := p.requestId
+	data, err := json.Marshal(&proxyRequest{Id: id, Method: method, Params: params})
+	if err != nil {
+		return 0, err
+	}
+	if share != nil {
+		p.pending[id] = share
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	if _, err = p.conn.Write(append(data, '\n')); err != nil {
+		p.conn.Close()
+		return 0, err
+	}
+	return id, nil
+}
+
+func (p *ProxyClient) handleMessage(s *StratumServer, msg *proxyMessage) error {
+	if msg.Method == "job" {
+		var job JobReplyData
+		if msg.Params == nil || json.Unmarshal(*msg.Params, &job) != nil {
+			return errors.New("malformed job")
+		}
+		return s.setProxyJob(&job)
+	}
+	// Other pushes [e.g. welcome messages] are not relayed
+	if msg.Id == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	share := p.pending[*msg.Id]
+	delete(p.pending, *msg.Id)
+	isLogin := *msg.Id == p.loginRequest
+	p.mu.Unlock()
+
+	switch {
+	case isLogin:
+		if msg.Error != nil || msg.Result == nil {
+			return fmt.Errorf("login rejected: %s", proxyErrorMessage(msg.Error))
+		}
+		var reply JobReply
+		if err := json.Unmarshal(*msg.Result, &reply); err != nil || reply.Job == nil {
+			return errors.New("malformed login reply")
+		}
+		p.mu.Lock()
+		p.loginId = reply.Id
+		p.mu.Unlock()
+		atomic.StoreInt32(&p.connected, 1)
+		if err := s.setProxyJob(reply.Job); err != nil {
+			return err
+		}
+		StratumInfoLogger.Printf("[Proxy] Logged in to upstream pool %s", p.config.Url)
+	case share != nil:
+		if msg.Error != nil {
+			atomic.AddInt64(&p.Rejected, 1)
+			StratumErrorLogger.Printf("[Proxy] Upstream pool rejected share at height %v from %v: %s", share.height, share.minerId, proxyErrorMessage(msg.Error))
+		} else {
+			atomic.AddInt64(&p.Accepted, 1)
+			StratumInfoLogger.Printf("[Proxy] Upstream pool accepted share at height %v from %v in %v", share.height, share.minerId, time.Since(share.sentAt))
+		}
+	}
+	return nil
+}
+
+// Returns the message of an error reply, the stratum error object or a plain string
+func proxyErrorMessage(raw *json.RawMessage) string {
+	if raw == nil {
+		return "no result"
+	}
+	var reply ErrorReply
+	if err := json.Unmarshal(*raw, &reply); err == nil && reply.Message != "" {
+		return reply.Message
+	}
+	var message string
+	if err := json.Unmarshal(*raw, &message); err == nil {
+		return message
+	}
+	return string(*raw)
+}
+
+func (p *ProxyClient) disconnected() {
+	atomic.StoreInt32(&p.connected, 0)
+	p.mu.Lock()
+	p.conn = nil
+	p.loginId = ""
+	p.pending = nil
+	p.mu.Unlock()
+}
+
+// Returns whether the proxy is logged in upstream, i.e. its template is a live upstream job
+func (p *ProxyClient) ready() bool {
+	return atomic.LoadInt32(&p.connected) == 1
+}
+
+// Forwards a share of the upstream job of template t. The upstream part of the reserved space [holding the extranonce of the local connection] is sent as extranonce
+func (p *ProxyClient) submit(m *Miner, t *BlockTemplate, nonce, result string, shareBuff []byte) {
+	p.mu.Lock()
+	loginId := p.loginId
+	p.mu.Unlock()
+
+	params := &SubmitParams{
+		Id:         loginId,
+		JobId:      t.upstreamJobId,
+		Nonce:      nonce,
+		Result:     result,
+		ExtraNonce: hex.EncodeToString(shareBuff[t.Reserved_Offset : t.Reserved_Offset+uint64(t.ReserveSize)]),
+	}
+	atomic.AddInt64(&p.Submitted, 1)
+	if _, err := p.send("submit", params, &proxyShare{minerId: m.Id, height: t.Height, sentAt: time.Now()}); err != nil {
+		atomic.AddInt64(&p.Rejected, 1)
+		StratumErrorLogger.Printf("[Proxy] Could not forward share at height %v from %v: %v", t.Height, m.Id, err)
+	}
+}
+
+// Credits an upstream payout of amount to the local miners: split over the shares of the current round since the last payout, less the pool fee of each share,
+// as the unlocker does for a pool block. The round shares are cleared in the same update, so a share is paid by one payout only. A txid already credited is refused
+func (p *ProxyClient) creditPayout(s *StratumServer, amount uint64, txid string) (map[string]int64, error) {
+	if amount == 0 || txid == "" {
+		return nil, errors.New("amount and txid are required")
+	}
+	p.creditMu.Lock()
+	if p.credited == nil {
+		p.credited = make(map[string]bool)
+	}
+	if p.credited[txid] {
+		p.creditMu.Unlock()
+		return nil, fmt.Errorf("upstream payout %v was already credited", txid)
+	}
+	p.credited[txid] = true
+	p.creditMu.Unlock()
+
+	writeWait, _ := time.ParseDuration("10ms")
+	for Graviton_backend.Writing == 1 {
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	// Shares not stored to the round yet are added first, so they are part of this payout
+	err := Storage_backend.UpdatePoolRoundStats(s.miners, false)
+	var shares map[string]int64
+	var fees map[string]float64
+	var total int64
+	if err == nil {
+		err = Storage_backend.UpdatePoolRound(func(round *PoolRound) (*PoolRound, error) {
+			if round == nil || len(round.RoundShares) == 0 {
+				return nil, errors.New("no local round shares to credit the payout to")
+			}
+			shares, fees, total = round.RoundShares, round.RoundFees, 0
+			for _, n := range shares {
+				total += n
+			}
+			round.RoundShares = make(map[string]int64)
+			if round.RoundFees != nil {
+				round.RoundFees = make(map[string]float64)
+			}
+			return round, nil
+		})
+	}
+	Graviton_backend.Writing = 0
+	if err != nil || total == 0 {
+		p.creditMu.Lock()
+		delete(p.credited, txid)
+		p.creditMu.Unlock()
+		if err == nil {
+			err = errors.New("no local round shares to credit the payout to")
+		}
+		return nil, err
+	}
+
+	rewards, _ := calculateRewardsForSharesGrav(s, shares, fees, total, new(big.Rat).SetUint64(amount), s.currentConfig().UnlockerConfig.PoolFee)
+	now := util.MakeTimestamp() / 1000
+	for login, reward := range rewards {
+		if reward <= 0 {
+			continue
+		}
+		for Graviton_backend.Writing == 1 {
+			time.Sleep(writeWait)
+		}
+		Graviton_backend.Writing = 1
+		err = Storage_backend.WritePendingPayments(&PaymentPending{Address: login, Amount: uint64(reward), Timestamp: now})
+		Graviton_backend.Writing = 0
+		if err != nil {
+			StratumErrorLogger.Printf("[Proxy] Err crediting %v of upstream payout %v to %v: %v", reward, txid, login, err)
+		}
+	}
+
+	StratumInfoLogger.Printf("[Proxy] Credited upstream payout %v of %v over %v round shares: %v", txid, amount, total, rewards)
+	return rewards, nil
+}
+
+func (p *ProxyClient) status(s *StratumServer) *ProxyStatus {
+	status := &ProxyStatus{
+		Url:       p.config.Url,
+		Connected: p.ready(),
+		Submitted: atomic.LoadInt64(&p.Submitted),
+		Accepted:  atomic.LoadInt64(&p.Accepted),
+		Rejected:  atomic.LoadInt64(&p.Rejected),
+	}
+	if t := s.currentBlockTemplate(); t != nil {
+		status.Height = t.Height
+	}
+	return status
+}
+
+// Returns the reserved space of a job of the connection with extraNonce in proxy mode, the size the upstream pool leaves to the proxy. The job slot takes the
+// last 4 bytes and the extranonce of the connection as much of the rest as fits, so the slot is never truncated and jobs of a template stay distinct however
+// little space the upstream leaves [setProxyJob requires more than 4 bytes]
+func proxyReservedBytes(extraNonce, jobSlot uint32, size int) []byte {
+	reserved := make([]byte, size)
+	var slot, connection [4]byte
+	binary.BigEndian.PutUint32(slot[:], jobSlot)
+	binary.BigEndian.PutUint32(connection[:], extraNonce)
+	n := size - len(slot)
+	if n > len(connection) {
+		n = len(connection)
+	}
+	copy(reserved[size-len(slot)-n:], connection[len(connection)-n:])
+	copy(reserved[size-len(slot):], slot[:])
+	return reserved
+}
+
+// Makes a job of the upstream pool the block template and broadcasts it. Jobs leaving no room for the connection extranonce and a job sequence cannot be
+// split between the connections, and jobs without a height [compactJobs upstream] cannot be told apart from stale ones, both are refused
+func (s *StratumServer) setProxyJob(job *JobReplyData) error {
+	buffer, err := hex.DecodeString(job.Blob)
+	if err != nil || len(buffer) <= nicehashNonceOffset {
+		return errors.New("malformed job blob")
+	}
+	if job.ExtraNonceSize <= reservedExtraNonceSize {
+		return fmt.Errorf("upstream job leaves %v bytes of extranonce, proxy mode needs more than %v [extraNonceSize of the upstream port]", job.ExtraNonceSize, reservedExtraNonceSize)
+	}
+	if job.ExtraNonceOffset+uint64(job.ExtraNonceSize) > uint64(len(buffer)) {
+		return errors.New("upstream job extranonce is out of the blob")
+	}
+	if job.Height == 0 {
+		return errors.New("upstream job has no height, disable compactJobs on the upstream pool")
+	}
+	diff, ok := util.GetTargetDifficulty(job.Target)
+	if !ok {
+		return fmt.Errorf("malformed job target %q", job.Target)
+	}
+
+	algo := job.Algo
+	if algo == "" {
+		algo = s.algoForHeight(job.Height)
+	}
+	newTemplate := BlockTemplate{
+		Blockhashing_blob: job.Blob,
+		Difficulty:        uint64(diff),
+		Height:            job.Height,
+		Reserved_Offset:   job.ExtraNonceOffset,
+		ReserveSize:       job.ExtraNonceSize,
+		Algo:              algo,
+		Buffer:            buffer,
+		upstreamJobId:     job.JobId,
+	}
+	if s.currentConfig().Stratum.JobCache {
+		newTemplate.jobCache = &jobCache{targets: make(map[int64]string)}
+	}
+
+	// Upstream jobs of the same height [e.g. retargets] replace the template without counting as a template change
+	t := s.currentBlockTemplate()
+	if t == nil || newTemplate.Height != t.Height {
+		BlocksInfoLogger.Printf("[Blocks] New block to mine from upstream pool at height %v, target diff: %v", job.Height, diff)
+		if t != nil && newTemplate.Height > t.Height {
+			s.prevBlockTemplate.Store(t)
+		}
+		s.templateMoved(job.Height)
+		newTemplate.seq = atomic.AddUint64(&s.templateSeq, 1)
+	} else {
+		newTemplate.seq = t.seq
+		// A retarget may keep the blob of the replaced job, its slots carry on so jobs of both never share work
+		newTemplate.jobSlots = atomic.LoadUint32(&t.jobSlots)
+	}
+	s.blockTemplate.Store(&newTemplate)
+	s.broadcastNewJobs()
+	return nil
+}
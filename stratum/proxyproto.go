@@ -0,0 +1,119 @@
+package stratum
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Signature starting a PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Time allowed for the load balancer to send the PROXY header after accept
+const proxyHeaderTimeout = 10 * time.Second
+
+// Conn reading through the bufio.Reader used to parse the PROXY header, so bytes buffered past the header are not lost
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Reads the PROXY protocol v1 or v2 header from conn and returns the client ip it carries along with the conn to use for the session.
+// LOCAL [v2] and UNKNOWN [v1] headers, used by load balancer health checks, return the connection's own ip. A connection without a valid header is an error
+func readProxyHeader(conn net.Conn) (net.Conn, string, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReaderSize(conn, 512)
+	wrapped := &proxyConn{Conn: conn, reader: reader}
+	ownIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	peek, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if bytes.Equal(peek, proxyV2Signature) {
+		ip, err := readProxyV2(reader)
+		if err != nil {
+			return nil, "", err
+		}
+		if ip == "" {
+			ip = ownIP
+		}
+		return wrapped, ip, nil
+	}
+
+	if !bytes.HasPrefix(peek, []byte("PROXY ")) {
+		return nil, "", errors.New("missing PROXY protocol header")
+	}
+
+	// v1 headers are at most 107 bytes including the trailing CRLF
+	line, err := reader.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, "", errors.New("malformed PROXY v1 header")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return wrapped, ownIP, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, "", fmt.Errorf("malformed PROXY v1 header: %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, "", fmt.Errorf("invalid PROXY v1 source address %s", fields[2])
+	}
+	return wrapped, ip.String(), nil
+}
+
+// Reads a PROXY v2 header, returning the source ip or "" for LOCAL commands and unsupported address families
+func readProxyV2(reader *bufio.Reader) (string, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if header[12]>>4 != 2 {
+		return "", fmt.Errorf("unsupported PROXY v2 version %v", header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	addresses := make([]byte, length)
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return "", err
+	}
+
+	// LOCAL connections are the load balancer's own, e.g. health checks
+	if command == 0 {
+		return "", nil
+	}
+	if command != 1 {
+		return "", fmt.Errorf("unsupported PROXY v2 command %v", command)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(addresses) < 12 {
+			return "", errors.New("short PROXY v2 IPv4 addresses")
+		}
+		return net.IP(addresses[0:4]).String(), nil
+	case 0x21: // TCP over IPv6
+		if len(addresses) < 36 {
+			return "", errors.New("short PROXY v2 IPv6 addresses")
+		}
+		return net.IP(addresses[0:16]).String(), nil
+	}
+	return "", nil
+}
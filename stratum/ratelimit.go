@@ -0,0 +1,89 @@
+package stratum
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Token bucket of a rate limited method of a session, refilled at the configured rate per second up to burst tokens
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Takes a token, refilling the bucket for the time passed since the last take. Returns false when the bucket is empty
+func (b *tokenBucket) take(rate, burst float64, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Returns the rate per second configured for method, 0 for methods that are not rate limited
+func (s *StratumServer) methodRate(method string) float64 {
+	cfg := s.currentConfig().Stratum.RateLimit
+	switch method {
+	case "login":
+		return cfg.Login
+	case "getjob":
+		return cfg.GetJob
+	case "submit":
+		return cfg.Submit
+	}
+	return 0
+}
+
+// Checks a request of the session against the rateLimit of its method. Returns whether the request is handled and whether the session is to be
+// disconnected. A session exceeding a rate is disconnected, or with action "mute" its rate limited requests are dropped for muteDuration
+func (cs *Session) allowRequest(s *StratumServer, method string) (bool, bool) {
+	cfg := s.currentConfig().Stratum.RateLimit
+	rate := s.methodRate(method)
+	if !cfg.Enabled || rate <= 0 || cs.farm != "" {
+		return true, false
+	}
+	burst := float64(cfg.Burst)
+	if burst < 1 {
+		burst = 10
+	}
+
+	now := time.Now()
+	cs.rateMu.Lock()
+	defer cs.rateMu.Unlock()
+	if now.Before(cs.mutedUntil) {
+		return false, false
+	}
+	if cs.rateBuckets == nil {
+		cs.rateBuckets = make(map[string]*tokenBucket)
+	}
+	bucket, ok := cs.rateBuckets[method]
+	if !ok {
+		bucket = &tokenBucket{}
+		cs.rateBuckets[method] = bucket
+	}
+	if bucket.take(rate, burst, now) {
+		return true, false
+	}
+
+	atomic.AddInt64(&s.rateLimited, 1)
+	if cfg.Action != "mute" {
+		StratumErrorLogger.Printf("[Stratum] Session %s exceeded %v %s requests/s, disconnecting", cs.ip, rate, method)
+		return false, true
+	}
+	mute, err := time.ParseDuration(cfg.MuteDuration)
+	if err != nil || mute <= 0 {
+		mute = time.Minute
+	}
+	cs.mutedUntil = now.Add(mute)
+	StratumErrorLogger.Printf("[Stratum] Session %s exceeded %v %s requests/s, muting it for %v", cs.ip, rate, method, mute)
+	return false, false
+}
@@ -0,0 +1,396 @@
+package stratum
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+	"github.com/go-redis/redis"
+)
+
+// Redis implementation of Storage, so several pool processes [or hosts] share their shares, round stats, balances and payment records. Values are stored as the same json as in Graviton, under <prefix>:<graviton key>
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// Attempts of a read-modify-write before giving up, retried when another pool process wrote the same key in between
+const redisUpdateRetries = 10
+
+func NewRedisStore(cfg *pool.RedisConfig, poolHost string) (*RedisStore, error) {
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = poolHost
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Endpoint,
+		Password: cfg.Password,
+		DB:       int(cfg.Database),
+		PoolSize: cfg.PoolSize,
+	})
+	if err := client.Ping().Err(); err != nil {
+		return nil, fmt.Errorf("[Redis] could not connect to %v: %v", cfg.Endpoint, err)
+	}
+
+	StorageInfoLogger.Printf("[Redis] Connected to %v, database %v, key prefix %v", cfg.Endpoint, cfg.Database, prefix)
+	return &RedisStore{client: client, prefix: prefix}, nil
+}
+
+func (r *RedisStore) key(key string) string {
+	return r.prefix + ":" + key
+}
+
+// Unmarshals the value at key into result, returns false if the key does not exist or could not be read
+func (r *RedisStore) get(key string, result interface{}) bool {
+	v, err := r.client.Get(r.key(key)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			StorageErrorLogger.Printf("[Redis] ERROR getting %v: %v", key, err)
+		}
+		return false
+	}
+	if err = json.Unmarshal(v, result); err != nil {
+		StorageErrorLogger.Printf("[Redis] could not unmarshal %v: %v", key, err)
+		return false
+	}
+	return true
+}
+
+func (r *RedisStore) set(key string, info interface{}) error {
+	confBytes, err := json.Marshal(info)
+	if err != nil {
+		StorageErrorLogger.Printf("[Redis] could not marshal %v info: %v", key, err)
+		return fmt.Errorf("[Redis] could not marshal %v info: %v", key, err)
+	}
+	if err = r.client.Set(r.key(key), confBytes, 0).Err(); err != nil {
+		StorageErrorLogger.Printf("[Redis] ERROR: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Read-modify-write of the value at key within a WATCH transaction. modify gets the stored value [nil if the key does not exist] and returns the value to store,
+// it is called again if another pool process wrote the key before the transaction completed
+func (r *RedisStore) update(key string, modify func(stored []byte) (interface{}, error)) error {
+	fullKey := r.key(key)
+
+	for i := 0; i < redisUpdateRetries; i++ {
+		err := r.client.Watch(func(tx *redis.Tx) error {
+			stored, err := tx.Get(fullKey).Bytes()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			info, err := modify(stored)
+			if err != nil {
+				return err
+			}
+			confBytes, err := json.Marshal(info)
+			if err != nil {
+				return fmt.Errorf("could not marshal %v info: %v", key, err)
+			}
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				pipe.Set(fullKey, confBytes, 0)
+				return nil
+			})
+			return err
+		}, fullKey)
+
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			StorageErrorLogger.Printf("[Redis] ERROR updating %v: %v", key, err)
+		}
+		return err
+	}
+
+	StorageErrorLogger.Printf("[Redis] ERROR updating %v: key kept changing after %v attempts", key, redisUpdateRetries)
+	return fmt.Errorf("[Redis] could not update %v, key kept changing after %v attempts", key, redisUpdateRetries)
+}
+
+func (r *RedisStore) WriteRoundShares(roundHeight int64, roundShares map[string]int64) error {
+	key := "miners:round:" + strconv.FormatInt(roundHeight, 10)
+	StorageInfoLogger.Printf("[Redis-WriteRoundShares] Storing %v with values: %v", key, roundShares)
+	return r.set(key, roundShares)
+}
+
+func (r *RedisStore) GetRoundShares(roundHeight int64) (map[string]int64, int64, error) {
+	var result map[string]int64
+	var totalRoundShares int64
+
+	r.get("miners:round:"+strconv.FormatInt(roundHeight, 10), &result)
+	for _, value := range result {
+		totalRoundShares += value
+	}
+
+	return result, totalRoundShares, nil
+}
+
+func (r *RedisStore) WriteRoundFees(roundHeight int64, roundFees map[string]float64) error {
+	return r.set("miners:roundfees:"+strconv.FormatInt(roundHeight, 10), roundFees)
+}
+
+func (r *RedisStore) GetRoundFees(roundHeight int64) (map[string]float64, bool) {
+	var result map[string]float64
+	if !r.get("miners:roundfees:"+strconv.FormatInt(roundHeight, 10), &result) {
+		return nil, false
+	}
+	return result, result != nil
+}
+
+func (r *RedisStore) WritePPLNSRoundShares(roundHeight int64, roundShares map[string]int64) error {
+	key := "pplns:round:" + strconv.FormatInt(roundHeight, 10)
+	StorageInfoLogger.Printf("[Redis-WritePPLNSRoundShares] Storing %v with values: %v", key, roundShares)
+	return r.set(key, roundShares)
+}
+
+func (r *RedisStore) GetPPLNSRoundShares(roundHeight int64) (map[string]int64, int64, bool) {
+	var result map[string]int64
+	var totalRoundShares int64
+
+	if !r.get("pplns:round:"+strconv.FormatInt(roundHeight, 10), &result) {
+		return nil, 0, false
+	}
+	for _, value := range result {
+		totalRoundShares += value
+	}
+
+	return result, totalRoundShares, true
+}
+
+func (r *RedisStore) WritePPLNSRoundFees(roundHeight int64, roundFees map[string]float64) error {
+	return r.set("pplns:roundfees:"+strconv.FormatInt(roundHeight, 10), roundFees)
+}
+
+func (r *RedisStore) GetPPLNSRoundFees(roundHeight int64) (map[string]float64, bool) {
+	var result map[string]float64
+	if !r.get("pplns:roundfees:"+strconv.FormatInt(roundHeight, 10), &result) {
+		return nil, false
+	}
+	return result, result != nil
+}
+
+func (r *RedisStore) RemoveRounds(roundHeights []int64) error {
+	var keys []string
+	for _, roundHeight := range roundHeights {
+		height := strconv.FormatInt(roundHeight, 10)
+		keys = append(keys, r.key("miners:round:"+height), r.key("miners:roundfees:"+height), r.key("pplns:round:"+height), r.key("pplns:roundfees:"+height))
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := r.client.Del(keys...).Err(); err != nil {
+		StorageErrorLogger.Printf("[Redis] ERROR: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (r *RedisStore) WritePPLNSWindow(shares []*PPLNSShare) error {
+	return r.set("pplns:window", shares)
+}
+
+func (r *RedisStore) GetPPLNSWindow() []*PPLNSShare {
+	var result []*PPLNSShare
+	r.get("pplns:window", &result)
+	return result
+}
+
+// Round rollover is decided on the blocks in Graviton_backend, the round itself is read from and stored to redis
+func (r *RedisStore) UpdatePoolRoundStats(miners MinersMap, blockFound bool) error {
+	return Graviton_backend.updatePoolRoundStats(r, miners, blockFound)
+}
+
+func (r *RedisStore) OverwritePoolRoundStats(info *PoolRound) error {
+	return r.set("pool:currentround", info)
+}
+
+func (r *RedisStore) UpdatePoolRound(modify func(round *PoolRound) (*PoolRound, error)) error {
+	return r.update("pool:currentround", func(stored []byte) (interface{}, error) {
+		var round *PoolRound
+		if stored != nil {
+			_ = json.Unmarshal(stored, &round)
+		}
+		return modify(round)
+	})
+}
+
+func (r *RedisStore) GetPoolRoundStats() *PoolRound {
+	var result *PoolRound
+	r.get("pool:currentround", &result)
+	return result
+}
+
+func (r *RedisStore) WriteImmaturePayments(info *PaymentPending) error {
+	return r.update("payments:immature", func(stored []byte) (interface{}, error) {
+		paymentsPending := &PendingPayments{}
+		if stored != nil {
+			_ = json.Unmarshal(stored, paymentsPending)
+		}
+		paymentsPending.PendingPayout = append(paymentsPending.PendingPayout, info)
+		return paymentsPending, nil
+	})
+}
+
+func (r *RedisStore) WritePendingPayments(info *PaymentPending) error {
+	return r.update("payments:pending", func(stored []byte) (interface{}, error) {
+		paymentsPending := &PendingPayments{}
+		if stored != nil {
+			_ = json.Unmarshal(stored, paymentsPending)
+		}
+
+		// Check through existing pending payments and append amount if login already has a pending amount
+		for _, currPayment := range paymentsPending.PendingPayout {
+			if info.Address == currPayment.Address {
+				StorageInfoLogger.Printf("[Redis] Updating value for %v from %v to %v", info.Address, currPayment.Amount, currPayment.Amount+info.Amount)
+				currPayment.Amount += info.Amount
+				return paymentsPending, nil
+			}
+		}
+
+		StorageInfoLogger.Printf("[Redis] Appending new payment: %v", info)
+		// Stored as a copy, modify may run again on retry and info must stay as given
+		payment := *info
+		paymentsPending.PendingPayout = append(paymentsPending.PendingPayout, &payment)
+		return paymentsPending, nil
+	})
+}
+
+func (r *RedisStore) GetPendingPayments() []*PaymentPending {
+	var reply *PendingPayments
+	if r.get("payments:pending", &reply) && reply != nil {
+		return reply.PendingPayout
+	}
+	return nil
+}
+
+func (r *RedisStore) OverwritePendingPayments(info *PendingPayments) error {
+	return r.set("payments:pending", info)
+}
+
+func (r *RedisStore) UpdatePendingPayments(modify func(pending []*PaymentPending) ([]*PaymentPending, error)) error {
+	return r.update("payments:pending", func(stored []byte) (interface{}, error) {
+		paymentsPending := &PendingPayments{}
+		if stored != nil {
+			_ = json.Unmarshal(stored, paymentsPending)
+		}
+		pending, err := modify(paymentsPending.PendingPayout)
+		if err != nil {
+			return nil, err
+		}
+		return &PendingPayments{PendingPayout: pending}, nil
+	})
+}
+
+func (r *RedisStore) WriteProcessedPayments(info *MinerPayments) error {
+	return r.update("payments:processed", func(stored []byte) (interface{}, error) {
+		paymentsProcessed := &ProcessedPayments{}
+		if stored != nil {
+			_ = json.Unmarshal(stored, paymentsProcessed)
+		}
+		paymentsProcessed.MinerPayments = append(paymentsProcessed.MinerPayments, info)
+		return paymentsProcessed, nil
+	})
+}
+
+func (r *RedisStore) GetProcessedPayments() *ProcessedPayments {
+	var reply *ProcessedPayments
+	if r.get("payments:processed", &reply) {
+		return reply
+	}
+	return nil
+}
+
+func (r *RedisStore) OverwriteProcessedPayments(info *ProcessedPayments) error {
+	return r.set("payments:processed", info)
+}
+
+// Adds the processed payment to its payout transaction record [keyed by txid], creating the record as pending if it does not exist
+func (r *RedisStore) WritePayoutTx(info *MinerPayments) error {
+	return r.update("payments:txs", func(stored []byte) (interface{}, error) {
+		payoutTxs := &PayoutTxs{}
+		if stored != nil {
+			_ = json.Unmarshal(stored, payoutTxs)
+		}
+		if payoutTxs.Txs == nil {
+			payoutTxs.Txs = make(map[string]*PayoutTx)
+		}
+
+		payoutTx, ok := payoutTxs.Txs[info.TxHash]
+		if !ok {
+			payoutTx = &PayoutTx{TxHash: info.TxHash, TxKey: info.TxKey, TxFee: info.TxFee, Timestamp: info.Timestamp, Status: "pending"}
+			payoutTxs.Txs[info.TxHash] = payoutTx
+		}
+		payoutTx.Payees = append(payoutTx.Payees, info)
+		return payoutTxs, nil
+	})
+}
+
+func (r *RedisStore) OverwritePayoutTxs(info *PayoutTxs) error {
+	return r.set("payments:txs", info)
+}
+
+func (r *RedisStore) GetPayoutTxs() *PayoutTxs {
+	var reply *PayoutTxs
+	if r.get("payments:txs", &reply) && reply != nil {
+		if reply.Txs == nil {
+			reply.Txs = make(map[string]*PayoutTx)
+		}
+		return reply
+	}
+	return nil
+}
+
+func (r *RedisStore) OverwritePaymentIntents(info *PaymentIntents) error {
+	return r.set("payments:intents", info)
+}
+
+func (r *RedisStore) GetPaymentIntents() *PaymentIntents {
+	var reply *PaymentIntents
+	if r.get("payments:intents", &reply) && reply != nil {
+		if reply.Intents == nil {
+			reply.Intents = make(map[string]*PaymentIntent)
+		}
+		return reply
+	}
+	return nil
+}
+
+func (r *RedisStore) WriteMinerSettings(settings *MinerSettings) error {
+	return r.update("miners:settings", func(stored []byte) (interface{}, error) {
+		minerSettings := make(map[string]*MinerSettings)
+		if stored != nil {
+			_ = json.Unmarshal(stored, &minerSettings)
+		}
+		if minerSettings == nil {
+			minerSettings = make(map[string]*MinerSettings)
+		}
+		if settings.empty() {
+			delete(minerSettings, settings.Address)
+		} else {
+			minerSettings[settings.Address] = settings
+		}
+		return minerSettings, nil
+	})
+}
+
+func (r *RedisStore) GetMinerSettings() map[string]*MinerSettings {
+	var reply map[string]*MinerSettings
+	r.get("miners:settings", &reply)
+	if reply == nil {
+		reply = make(map[string]*MinerSettings)
+	}
+	return reply
+}
+
+func (r *RedisStore) OverwriteTelegramLinks(info []*TelegramLink) error {
+	return r.set("telegram:links", info)
+}
+
+func (r *RedisStore) GetTelegramLinks() []*TelegramLink {
+	var reply []*TelegramLink
+	r.get("telegram:links", &reply)
+	return reply
+}
@@ -0,0 +1,190 @@
+package stratum
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+)
+
+// Rolling rejected [invalid and low difficulty] and stale share rates of the pool, each port, each miner address and each worker over window. Every check samples
+// the cumulative share counters of each scope, the rates are of the shares since the oldest sample within window. An alarm is raised once when a rate reaches its
+// threshold and cleared once it drops below it again
+type RejectAlarms struct {
+	mu      sync.Mutex
+	samples map[string][]shareSample
+	// Scope of the raised alarms by scope key and kind [reject or stale]
+	alarmed map[string]string
+}
+
+// Cumulative share counters of a scope at a check
+type shareSample struct {
+	at       int64
+	valid    int64
+	rejected int64
+	stale    int64
+}
+
+type rejectScope struct {
+	key        string
+	scope      string
+	name       string
+	address    string
+	worker     string
+	thresholds pool.RejectThresholds
+	counters   shareSample
+}
+
+func NewRejectAlarms() *RejectAlarms {
+	return &RejectAlarms{samples: make(map[string][]shareSample), alarmed: make(map[string]string)}
+}
+
+// Returns the scopes to check with their current counters. Workers of an address are summed into the miner scope
+func (s *StratumServer) rejectScopes(cfg *pool.RejectAlarmsConfig) []*rejectScope {
+	now := time.Now().Unix()
+	scopes := []*rejectScope{{key: "pool", scope: "pool", name: "pool", thresholds: cfg.Pool, counters: s.shareMetrics.sample(now)}}
+
+	ports := make(map[int]*rejectScope)
+	s.listenersMu.Lock()
+	for _, e := range s.endpoints {
+		port, ok := ports[e.config.Port]
+		if !ok {
+			name := strconv.Itoa(e.config.Port)
+			port = &rejectScope{key: "port:" + name, scope: "port", name: name, thresholds: cfg.Port, counters: shareSample{at: now}}
+			ports[e.config.Port] = port
+			scopes = append(scopes, port)
+		}
+		port.counters.add(e.shares.sample(now))
+	}
+	s.listenersMu.Unlock()
+
+	addresses := make(map[string]*rejectScope)
+	for _, m := range s.miners.Values() {
+		if m.Id == s.donateID {
+			continue
+		}
+		counters := m.sample(now)
+		scopes = append(scopes, &rejectScope{key: "worker:" + m.Id, scope: "worker", name: m.Id, address: m.Address, worker: m.WorkID, thresholds: cfg.Worker, counters: counters})
+
+		address, ok := addresses[m.Address]
+		if !ok {
+			address = &rejectScope{key: "miner:" + m.Address, scope: "miner", name: m.Address, address: m.Address, thresholds: cfg.Miner, counters: shareSample{at: now}}
+			addresses[m.Address] = address
+			scopes = append(scopes, address)
+		}
+		address.counters.add(counters)
+	}
+	return scopes
+}
+
+func (m *ShareMetrics) sample(now int64) shareSample {
+	return shareSample{
+		at:       now,
+		valid:    atomic.LoadInt64(&m.Valid),
+		rejected: atomic.LoadInt64(&m.Invalid) + atomic.LoadInt64(&m.LowDiff),
+		stale:    atomic.LoadInt64(&m.Stale),
+	}
+}
+
+func (m *Miner) sample(now int64) shareSample {
+	return shareSample{
+		at:       now,
+		valid:    atomic.LoadInt64(&m.ValidShares),
+		rejected: atomic.LoadInt64(&m.InvalidShares) + atomic.LoadInt64(&m.LowDiffShares),
+		stale:    atomic.LoadInt64(&m.StaleShares),
+	}
+}
+
+func (a *shareSample) add(b shareSample) {
+	a.valid += b.valid
+	a.rejected += b.rejected
+	a.stale += b.stale
+}
+
+// Samples every scope and raises or clears its alarms. Scopes no longer present [miners gone from s.miners] are forgotten
+func (s *StratumServer) checkRejectRates() {
+	cfg := s.currentConfig().RejectAlarms
+	window, err := time.ParseDuration(cfg.Window)
+	if err != nil || window <= 0 {
+		window = 15 * time.Minute
+	}
+
+	a := s.rejectAlarms
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	seen := make(map[string]struct{})
+	for _, scope := range s.rejectScopes(&cfg) {
+		seen[scope.key] = struct{}{}
+
+		// Keep the newest sample at or before the start of the window as the baseline
+		samples := append(a.samples[scope.key], scope.counters)
+		cutoff := scope.counters.at - int64(window/time.Second)
+		for len(samples) > 1 && samples[1].at <= cutoff {
+			samples = samples[1:]
+		}
+		a.samples[scope.key] = samples
+
+		base := samples[0]
+		valid := scope.counters.valid - base.valid
+		rejected := scope.counters.rejected - base.rejected
+		stale := scope.counters.stale - base.stale
+		total := valid + rejected + stale
+		// Counters restart with the miner, a drop means a new baseline
+		if valid < 0 || rejected < 0 || stale < 0 {
+			a.samples[scope.key] = []shareSample{scope.counters}
+			continue
+		}
+		if total == 0 || total < scope.thresholds.MinShares {
+			continue
+		}
+
+		s.updateRejectAlarm(scope, "reject", float64(rejected)/float64(total), scope.thresholds.RejectRate, total)
+		s.updateRejectAlarm(scope, "stale", float64(stale)/float64(total), scope.thresholds.StaleRate, total)
+	}
+
+	for key := range a.samples {
+		if _, ok := seen[key]; !ok {
+			delete(a.samples, key)
+			delete(a.alarmed, key+"|reject")
+			delete(a.alarmed, key+"|stale")
+		}
+	}
+}
+
+// Raises the alarm of kind when rate reaches threshold, clears it once rate is back below. A threshold of 0 disables the alarm. Called with the alarms locked
+func (s *StratumServer) updateRejectAlarm(scope *rejectScope, kind string, rate, threshold float64, shares int64) {
+	if threshold <= 0 {
+		return
+	}
+	key := scope.key + "|" + kind
+	_, alarmed := s.rejectAlarms.alarmed[key]
+
+	if rate >= threshold && !alarmed {
+		s.rejectAlarms.alarmed[key] = scope.scope
+		StratumErrorLogger.Printf("[Stratum] %v %v rate of %v is %.2f%% over the last %v shares, above the threshold of %.2f%%", scope.scope, kind, scope.name, rate*100, shares, threshold*100)
+		s.webhooks.RejectAlarm("rejectAlarm", scope, kind, rate, shares)
+		s.telegram.RejectAlarm(true, scope, kind, rate, shares)
+	} else if rate < threshold && alarmed {
+		delete(s.rejectAlarms.alarmed, key)
+		StratumInfoLogger.Printf("[Stratum] %v %v rate of %v is back to %.2f%% over the last %v shares", scope.scope, kind, scope.name, rate*100, shares)
+		s.webhooks.RejectAlarm("rejectAlarmCleared", scope, kind, rate, shares)
+		s.telegram.RejectAlarm(false, scope, kind, rate, shares)
+	}
+}
+
+// Returns the number of raised alarms by scope
+func (a *RejectAlarms) active() map[string]int {
+	counts := map[string]int{"pool": 0, "port": 0, "miner": 0, "worker": 0}
+	if a == nil {
+		return counts
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, scope := range a.alarmed {
+		counts[scope]++
+	}
+	return counts
+}
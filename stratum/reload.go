@@ -0,0 +1,106 @@
+package stratum
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// Sets the config file re-read on reload [SIGHUP or POST /api/admin/reload]
+func (s *StratumServer) SetConfigFile(configFile string) {
+	s.configFile = configFile
+}
+
+// Reloads the config file on SIGHUP
+func (s *StratumServer) SetupReloadHandler() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			StratumInfoLogger.Printf("[Stratum] SIGHUP received, reloading config")
+			s.ReloadConfig()
+		}
+	}()
+}
+
+// Re-reads the config file and applies its mutable settings [vardiff, trusted shares count/percent, payout interval/threshold/mixin/max addresses, address lists, banning thresholds]
+// without dropping connections. Everything else [ports, upstreams, storage, api, turning banning on or off, ...] only applies on restart. The running config is left untouched if the file does not parse or validate
+func (s *StratumServer) ReloadConfig() error {
+	if s.configFile == "" {
+		return errors.New("no config file to reload")
+	}
+
+	configFile, err := os.Open(s.configFile)
+	if err != nil {
+		StratumErrorLogger.Printf("[Stratum] Config reload failed: %v", err)
+		return err
+	}
+	defer configFile.Close()
+
+	var reloaded pool.Config
+	if err = json.NewDecoder(configFile).Decode(&reloaded); err != nil {
+		StratumErrorLogger.Printf("[Stratum] Config reload failed, keeping the running config: %v", err)
+		return err
+	}
+	// Turning vardiff on or off needs a restart, as its retarget timer is only started when enabled at startup
+	reloaded.Stratum.VarDiff.Enabled = s.currentConfig().Stratum.VarDiff.Enabled
+	// Same for banning, its ban list is only created when enabled at startup
+	reloaded.Banning.Enabled = s.currentConfig().Banning.Enabled
+	if err = validateReload(&reloaded); err != nil {
+		StratumErrorLogger.Printf("[Stratum] Config reload failed, keeping the running config: %v", err)
+		return err
+	}
+
+	if err = util.ConfigureLogging(reloaded.Logging.Format, reloaded.Logging.Level, reloaded.Logging.Modules); err != nil {
+		StratumErrorLogger.Printf("[Stratum] Config reload failed, keeping the running config: %v", err)
+		return err
+	}
+
+	// Copy the running config and only swap in the mutable settings, handlers load the new config atomically
+	next := *s.currentConfig()
+	next.Logging = reloaded.Logging
+	next.Stratum.VarDiff = reloaded.Stratum.VarDiff
+	next.TrustedSharesCount = reloaded.TrustedSharesCount
+	next.TrustedSharesPercent = reloaded.TrustedSharesPercent
+	next.PaymentsConfig.Interval = reloaded.PaymentsConfig.Interval
+	next.PaymentsConfig.Threshold = reloaded.PaymentsConfig.Threshold
+	next.PaymentsConfig.Mixin = reloaded.PaymentsConfig.Mixin
+	next.PaymentsConfig.MaxAddresses = reloaded.PaymentsConfig.MaxAddresses
+	next.Stratum.AddressLists = reloaded.Stratum.AddressLists
+	next.Banning = reloaded.Banning
+	s.config.Store(&next)
+	atomic.StoreInt64(&s.trustedSharesCount, next.TrustedSharesCount)
+	s.loadAddressLists()
+	s.banning.reload(&next.Banning)
+
+	StratumInfoLogger.Printf("[Stratum] Reloaded config from %s. varDiff: %+v, trustedSharesCount: %v, trustedSharesPercent: %v, payments interval: %v, minPayment: %v, mixin: %v, maxAddresses: %v", s.configFile, next.Stratum.VarDiff, next.TrustedSharesCount, next.TrustedSharesPercent, next.PaymentsConfig.Interval, next.PaymentsConfig.Threshold, next.PaymentsConfig.Mixin, next.PaymentsConfig.MaxAddresses)
+	return nil
+}
+
+// Rejects reloaded settings that would break the running pool
+func validateReload(cfg *pool.Config) error {
+	vardiff := cfg.Stratum.VarDiff
+	if vardiff.Enabled {
+		if vardiff.MinDiff <= 0 || vardiff.MaxDiff < vardiff.MinDiff {
+			return fmt.Errorf("invalid varDiff minDiff/maxDiff %v/%v", vardiff.MinDiff, vardiff.MaxDiff)
+		}
+		if vardiff.TargetTime <= 0 || vardiff.RetargetTime <= 0 {
+			return fmt.Errorf("invalid varDiff targetTime/retargetTime %v/%v", vardiff.TargetTime, vardiff.RetargetTime)
+		}
+	}
+	if intv, err := time.ParseDuration(cfg.PaymentsConfig.Interval); err != nil || intv <= 0 {
+		return fmt.Errorf("invalid payments interval %q", cfg.PaymentsConfig.Interval)
+	}
+	if cfg.PaymentsConfig.MaxAddresses == 0 {
+		return errors.New("invalid payments maxAddresses 0")
+	}
+	return nil
+}
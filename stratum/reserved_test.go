@@ -0,0 +1,93 @@
+package stratum
+
+import (
+	"encoding/hex"
+	"math"
+	"sync/atomic"
+	"testing"
+)
+
+const reservedTestSessions = 5000
+
+// Every session of a broadcast gets work no other session of the template has
+func TestReservedBytesDistinctAcrossSessions(t *testing.T) {
+	s := &StratumServer{instanceId: []byte{1, 2, 3}}
+	template := &BlockTemplate{}
+	seen := make(map[string]bool)
+	for i := 0; i < reservedTestSessions; i++ {
+		reserved := s.reservedBytes(atomic.AddUint32(&s.extraNonce, 1), template.nextJobSlot())
+		if len(reserved) != reservedPoolSize {
+			t.Fatalf("reserved space of %v bytes, expected %v", len(reserved), reservedPoolSize)
+		}
+		key := hex.EncodeToString(reserved)
+		if seen[key] {
+			t.Fatalf("session %v got the reserved space %v of another session", i, key)
+		}
+		seen[key] = true
+	}
+}
+
+// Extranonces wrapping around collide, the job slots of the template still keep the work of every session distinct
+func TestReservedBytesDistinctAfterExtraNonceWraparound(t *testing.T) {
+	s := &StratumServer{instanceId: []byte{1, 2, 3}, extraNonce: math.MaxUint32 - reservedTestSessions/2}
+	template := &BlockTemplate{}
+	seen := make(map[string]bool)
+	extraNonces := make(map[uint32]bool)
+	for i := 0; i < reservedTestSessions; i++ {
+		extraNonce := atomic.AddUint32(&s.extraNonce, 1)
+		extraNonces[extraNonce] = true
+		// A second session sharing the extranonce, as after a full wraparound
+		for j := 0; j < 2; j++ {
+			key := hex.EncodeToString(s.reservedBytes(extraNonce, template.nextJobSlot()))
+			if seen[key] {
+				t.Fatalf("session %v with extranonce %v got the reserved space %v of another session", i, extraNonce, key)
+			}
+			seen[key] = true
+		}
+	}
+	if !extraNonces[0] {
+		t.Fatalf("extranonce did not wrap around")
+	}
+}
+
+// Slots are handed out per template, each template starts at slot 0
+func TestJobSlotsPerTemplate(t *testing.T) {
+	first, second := &BlockTemplate{}, &BlockTemplate{}
+	for i := uint32(0); i < 10; i++ {
+		if slot := first.nextJobSlot(); slot != i {
+			t.Fatalf("slot %v of the first template, expected %v", slot, i)
+		}
+	}
+	if slot := second.nextJobSlot(); slot != 0 {
+		t.Fatalf("first slot of the second template is %v, expected 0", slot)
+	}
+}
+
+// However little reserved space the upstream leaves, the job slot is kept whole and the extranonce truncated
+func TestProxyReservedBytesTruncation(t *testing.T) {
+	for _, size := range []int{reservedExtraNonceSize + 1, 6, 8, 12} {
+		template := &BlockTemplate{ReserveSize: size}
+		seen := make(map[string]bool)
+		for i := 0; i < reservedTestSessions; i++ {
+			// Every session shares the extranonce, only the slot tells the jobs apart
+			reserved := proxyReservedBytes(math.MaxUint32, template.nextJobSlot(), size)
+			if len(reserved) != size {
+				t.Fatalf("size %v: reserved space of %v bytes", size, len(reserved))
+			}
+			key := hex.EncodeToString(reserved)
+			if seen[key] {
+				t.Fatalf("size %v: session %v got the reserved space %v of another session", size, i, key)
+			}
+			seen[key] = true
+		}
+	}
+
+	reserved := proxyReservedBytes(0x0a0b0c0d, 0x01020304, 10)
+	if got := hex.EncodeToString(reserved); got != "00000a0b0c0d01020304" {
+		t.Fatalf("reserved space %v, expected the extranonce followed by the slot", got)
+	}
+	reserved = proxyReservedBytes(0x0a0b0c0d, 0x01020304, 5)
+	if got := hex.EncodeToString(reserved); got != "0d01020304" {
+		t.Fatalf("reserved space %v, expected the last extranonce byte followed by the slot", got)
+	}
+}
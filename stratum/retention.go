@@ -0,0 +1,226 @@
+package stratum
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// Prunes the history kept in storage per the retention config, so long running pools do not grow the store [and its startup time] without bound:
+// round shares and fees of blocks past roundDays, hashrate charts of miners without a value in chartDays, and the block and payment history beyond maxBlocks and maxPayments.
+// Blocks and payments cut from the history are appended to archiveDir first, if set. Blocks still pending [candidate or immature] and their rounds are never pruned
+func (s *StratumServer) applyRetention() {
+	cfg := s.currentConfig().Retention
+	now := util.MakeTimestamp() / 1000
+	writeWait, _ := time.ParseDuration("10ms")
+
+	// Writing is taken for each batch and released in between, so share and stats writes are not held up for the whole pass
+	lockWriting := func() {
+		for Graviton_backend.Writing == 1 {
+			time.Sleep(writeWait)
+		}
+		Graviton_backend.Writing = 1
+	}
+	unlockWriting := func() { Graviton_backend.Writing = 0 }
+
+	var removed int
+	lockWriting()
+
+	// Block history, most recent first
+	var history []*BlockDataGrav
+	pendingRounds := make(map[int64]bool)
+	if blocks := Graviton_backend.GetBlocksFound("all"); blocks != nil {
+		for _, block := range blocks.MinedBlocks {
+			if block.BlockState == "matured" || block.BlockState == "orphaned" {
+				history = append(history, block)
+			} else {
+				pendingRounds[block.Height] = true
+				pendingRounds[block.RoundHeight] = true
+			}
+		}
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Height > history[j].Height
+	})
+	// The round of the last pool block is the one rounds are stored against next
+	if last := Graviton_backend.lastPoolBlock(); last != nil {
+		pendingRounds[last.Height] = true
+	}
+
+	var prunedBlocks []*BlockDataGrav
+	if cfg.MaxBlocks > 0 && len(history) > cfg.MaxBlocks {
+		prunedBlocks = history[cfg.MaxBlocks:]
+	}
+
+	// Rounds of blocks older than roundDays, and of blocks cut from the history which could not be looked up afterwards
+	roundHeights := make(map[int64]bool)
+	for i, block := range history {
+		if (cfg.RoundDays > 0 && block.Timestamp < now-cfg.RoundDays*86400) || (prunedBlocks != nil && i >= cfg.MaxBlocks) {
+			for _, height := range []int64{block.Height, block.RoundHeight} {
+				if !pendingRounds[height] {
+					roundHeights[height] = true
+				}
+			}
+		}
+	}
+	if len(roundHeights) > 0 {
+		var heights []int64
+		for height := range roundHeights {
+			heights = append(heights, height)
+		}
+		if err := Storage_backend.RemoveRounds(heights); err != nil {
+			StorageErrorLogger.Printf("[Retention] Error removing %v rounds: %v", len(heights), err)
+		} else {
+			StorageInfoLogger.Printf("[Retention] Removed the shares of %v rounds", len(heights))
+			removed += len(heights)
+		}
+	}
+	unlockWriting()
+
+	if len(prunedBlocks) > 0 {
+		lockWriting()
+		if err := archiveRetention(cfg.ArchiveDir, "blocks.jsonl", prunedBlocks); err != nil {
+			StorageErrorLogger.Printf("[Retention] Could not archive %v blocks, keeping them: %v", len(prunedBlocks), err)
+		} else if err = Graviton_backend.RemoveBlocks(prunedBlocks); err != nil {
+			StorageErrorLogger.Printf("[Retention] Error removing %v blocks: %v", len(prunedBlocks), err)
+		} else {
+			StorageInfoLogger.Printf("[Retention] Removed %v blocks at or below height %v from the block history", len(prunedBlocks), prunedBlocks[0].Height)
+			removed += len(prunedBlocks)
+		}
+		unlockWriting()
+	}
+
+	if cfg.ChartDays > 0 {
+		lockWriting()
+		charts, err := Graviton_backend.RemoveMinerCharts(now - cfg.ChartDays*86400)
+		unlockWriting()
+		if err != nil {
+			StorageErrorLogger.Printf("[Retention] Error removing miner hashrate charts: %v", err)
+		} else if charts > 0 {
+			StorageInfoLogger.Printf("[Retention] Removed %v miner hashrate charts without values in %v days", charts, cfg.ChartDays)
+			removed += charts
+		}
+	}
+
+	if cfg.MaxPayments > 0 {
+		lockWriting()
+		removed += s.trimPaymentHistory(cfg.MaxPayments, cfg.ArchiveDir)
+		unlockWriting()
+	}
+
+	// Migrating copies only the latest snapshot to a new store, dropping the versions still holding the pruned values. It takes the store lock exclusively,
+	// waiting for the reads and writes in progress and holding off new ones until the swapped store is open
+	if cfg.Compact && removed > 0 && Storage_backend == Graviton_backend {
+		StorageInfoLogger.Printf("[Retention] Compacting the store after removing %v entries", removed)
+		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
+	}
+}
+
+// Caps the processed payments at the most recent max, always keeping the last payment of each login [payout intervals are checked against it].
+// Payout tx records no longer pending of the removed payments are removed with them. Returns the number of payments removed
+func (s *StratumServer) trimPaymentHistory(max int, archiveDir string) int {
+	processed := Storage_backend.GetProcessedPayments()
+	if processed == nil || len(processed.MinerPayments) <= max {
+		return 0
+	}
+
+	kept, pruned := trimPayments(processed.MinerPayments, max)
+	if len(pruned) == 0 {
+		return 0
+	}
+	if err := archiveRetention(archiveDir, "payments.jsonl", pruned); err != nil {
+		StorageErrorLogger.Printf("[Retention] Could not archive %v payments, keeping them: %v", len(pruned), err)
+		return 0
+	}
+	if err := Storage_backend.OverwriteProcessedPayments(&ProcessedPayments{MinerPayments: kept}); err != nil {
+		StorageErrorLogger.Printf("[Retention] Error removing %v payments: %v", len(pruned), err)
+		return 0
+	}
+	StorageInfoLogger.Printf("[Retention] Removed %v payments from the payment history, kept %v", len(pruned), len(kept))
+
+	if payoutTxs := Storage_backend.GetPayoutTxs(); payoutTxs != nil {
+		keptTxs := make(map[string]bool)
+		for _, payment := range kept {
+			keptTxs[payment.TxHash] = true
+		}
+		var txs int
+		for txHash, tx := range payoutTxs.Txs {
+			if !keptTxs[txHash] && tx.Status != "pending" {
+				delete(payoutTxs.Txs, txHash)
+				txs++
+			}
+		}
+		if txs > 0 {
+			if err := Storage_backend.OverwritePayoutTxs(payoutTxs); err != nil {
+				StorageErrorLogger.Printf("[Retention] Error removing %v payout txs: %v", txs, err)
+			}
+		}
+	}
+	return len(pruned)
+}
+
+// Splits payments into the most recent max [plus the last payment of each login beyond them] and the rest, both in their stored order
+func trimPayments(payments []*MinerPayments, max int) ([]*MinerPayments, []*MinerPayments) {
+	recent := make([]*MinerPayments, len(payments))
+	copy(recent, payments)
+	sort.SliceStable(recent, func(i, j int) bool {
+		return recent[i].Timestamp > recent[j].Timestamp
+	})
+
+	keep := make(map[*MinerPayments]bool)
+	lastPaid := make(map[string]bool)
+	for i, payment := range recent {
+		if i < max || !lastPaid[payment.Login] {
+			keep[payment] = true
+		}
+		lastPaid[payment.Login] = true
+	}
+
+	var kept, pruned []*MinerPayments
+	for _, payment := range payments {
+		if keep[payment] {
+			kept = append(kept, payment)
+		} else {
+			pruned = append(pruned, payment)
+		}
+	}
+	return kept, pruned
+}
+
+// Appends the values to the archive file in dir as json lines, nothing is archived without a dir
+func archiveRetention(dir, file string, values interface{}) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0705); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, file), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	switch v := values.(type) {
+	case []*BlockDataGrav:
+		for _, block := range v {
+			if err = enc.Encode(block); err != nil {
+				break
+			}
+		}
+	case []*MinerPayments:
+		for _, payment := range v {
+			if err = enc.Encode(payment); err != nil {
+				break
+			}
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,273 @@
+package stratum
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// Append-only journal of the pool shares accepted since the current round was last stored. Round stats are only stored every storeMinerStatsInterval,
+// the journal keeps the shares in between so a crash or restart mid-round does not lose them. Entries are json lines, replayed into the stored round on startup
+type RoundJournal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	// Write-behind buffer of shareWriteBatching: entries are written in one batch every flushInterval or once maxEntries are buffered. 0 writes each entry
+	maxEntries int
+	buffer     []byte
+	buffered   int
+	flushes    int64
+}
+
+type roundJournalEntry struct {
+	Login     string
+	Shares    int64
+	Fees      float64
+	Timestamp int64
+}
+
+func NewRoundJournal(path string) (*RoundJournal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &RoundJournal{path: path, file: f}, nil
+}
+
+func (j *RoundJournal) record(login string, shares int64, fees float64, timestamp int64) {
+	line, _ := json.Marshal(&roundJournalEntry{Login: login, Shares: shares, Fees: fees, Timestamp: timestamp})
+
+	j.mu.Lock()
+	var err error
+	if j.maxEntries > 0 {
+		j.buffer = append(append(j.buffer, line...), '\n')
+		j.buffered++
+		if j.buffered >= j.maxEntries {
+			err = j.write()
+		}
+	} else {
+		_, err = j.file.Write(append(line, '\n'))
+	}
+	j.mu.Unlock()
+	if err != nil {
+		StratumErrorLogger.Printf("[RoundJournal] Err journaling share of %v: %v", login, err)
+	}
+}
+
+// Writes the buffered entries in one write, j must be locked. Entries of a failed write are dropped rather than retried, as a partial write retried would journal them twice.
+// The entries dropped are logged, their shares are still counted in memory and only missing from a recovery before the round is next stored
+func (j *RoundJournal) write() error {
+	if j.buffered == 0 {
+		return nil
+	}
+	n, err := j.file.Write(j.buffer)
+	if err != nil {
+		// Entries are whole lines, those before the point of failure made it
+		written := bytes.Count(j.buffer[:n], []byte{'\n'})
+		StratumErrorLogger.Printf("[RoundJournal] Dropped %v of %v buffered shares on a failed write: %v", j.buffered-written, j.buffered, err)
+	}
+	j.buffer = j.buffer[:0]
+	j.buffered = 0
+	atomic.AddInt64(&j.flushes, 1)
+	return err
+}
+
+func (j *RoundJournal) flush() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.write()
+}
+
+// Returns the number of entries buffered and not written yet
+func (j *RoundJournal) depth() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.buffered
+}
+
+// Returns the journaled shares newer than timestamp. A line cut short by a crash is skipped
+func (j *RoundJournal) entries(timestamp int64) ([]*roundJournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.read(timestamp)
+}
+
+// Reads the journal, j must be locked. Buffered entries are written first so none are left out
+func (j *RoundJournal) read(timestamp int64) ([]*roundJournalEntry, error) {
+	if err := j.write(); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(j.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*roundJournalEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var entry roundJournalEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil || entry.Login == "" {
+			continue
+		}
+		if entry.Timestamp > timestamp {
+			entries = append(entries, &entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// Drops the shares up to timestamp, which the stored round already counts
+func (j *RoundJournal) compact(timestamp int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries, err := j.read(timestamp)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		line, _ := json.Marshal(entry)
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	// Write the remaining shares aside and swap the file in, so a crash while compacting keeps either journal whole
+	tmpPath := j.path + ".tmp"
+	if err = os.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, j.path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	j.file.Close()
+	j.file = f
+	return nil
+}
+
+// Journals a valid pool share credited to the current round along with its fee, solo shares are not part of pool rounds
+func (s *StratumServer) recordRoundShare(m *Miner, shares int64, fee float64) {
+	if s.roundJournal == nil || m.IsSolo || shares == 0 {
+		return
+	}
+	s.roundJournal.record(m.Id, shares, float64(shares)*fee, util.MakeTimestamp()/1000)
+}
+
+// Writes the shares buffered by shareWriteBatching to the journal, on shutdown they are written whether or not the round is stored
+func (s *StratumServer) flushRoundJournal() {
+	if s.roundJournal == nil {
+		return
+	}
+	if err := s.roundJournal.flush(); err != nil {
+		StratumErrorLogger.Printf("[RoundJournal] Err flushing buffered shares: %v", err)
+	}
+}
+
+// Compacts the journal after the round was stored. Caller holds the Graviton_backend.Writing flag
+func (s *StratumServer) compactRoundJournal() {
+	if s.roundJournal == nil {
+		return
+	}
+	round := Storage_backend.GetPoolRoundStats()
+	if round == nil {
+		return
+	}
+	if err := s.roundJournal.compact(round.Timestamp); err != nil {
+		StratumErrorLogger.Printf("[RoundJournal] Err compacting journal: %v", err)
+	}
+}
+
+// Startup reconciliation: credits the journaled shares the stored round is missing [accepted after it was last stored] to it. If a pool block was stored
+// that the round did not roll over for yet, the shares up to the block are credited to its round and the rest to the next one
+func (s *StratumServer) recoverRoundShares() {
+	if s.roundJournal == nil {
+		return
+	}
+
+	round := Storage_backend.GetPoolRoundStats()
+	var timestamp int64
+	if round != nil {
+		timestamp = round.Timestamp
+	}
+	entries, err := s.roundJournal.entries(timestamp)
+	if err != nil {
+		StratumErrorLogger.Printf("[RoundJournal] Err reading journal, round shares are not recovered: %v", err)
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+	if round == nil {
+		round = &PoolRound{RoundFees: make(map[string]float64)}
+	}
+
+	writeWait, _ := time.ParseDuration("10ms")
+	for Graviton_backend.Writing == 1 {
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	defer func() {
+		Graviton_backend.Writing = 0
+	}()
+
+	// Credits the entries up to until [0 = all] to round, returning the rest
+	credit := func(round *PoolRound, entries []*roundJournalEntry, until int64) []*roundJournalEntry {
+		var rest []*roundJournalEntry
+		var shares int64
+		if round.RoundShares == nil {
+			round.RoundShares = make(map[string]int64)
+		}
+		for _, entry := range entries {
+			if until > 0 && entry.Timestamp > until {
+				rest = append(rest, entry)
+				continue
+			}
+			round.RoundShares[entry.Login] += entry.Shares
+			if round.RoundFees != nil {
+				round.RoundFees[entry.Login] += entry.Fees
+			}
+			shares += entry.Shares
+			if entry.Timestamp > round.Timestamp {
+				round.Timestamp = entry.Timestamp
+			}
+		}
+		StratumInfoLogger.Printf("[RoundJournal] Recovered %v shares of %v journal entries into the current round", shares, len(entries)-len(rest))
+		return rest
+	}
+
+	block := Graviton_backend.lastPoolBlock()
+	if block != nil && (round.StartTimestamp < block.Timestamp || round.LastBlockHeight < block.Height) {
+		entries = credit(round, entries, block.Timestamp)
+		if err = Storage_backend.OverwritePoolRoundStats(round); err == nil {
+			err = Storage_backend.UpdatePoolRoundStats(s.miners, false)
+		}
+		if err != nil {
+			StratumErrorLogger.Printf("[RoundJournal] Err storing recovered round shares: %v", err)
+			return
+		}
+		round = Storage_backend.GetPoolRoundStats()
+		if round == nil || len(entries) == 0 {
+			s.compactRoundJournal()
+			return
+		}
+	}
+
+	credit(round, entries, 0)
+	if err = Storage_backend.OverwritePoolRoundStats(round); err != nil {
+		StratumErrorLogger.Printf("[RoundJournal] Err storing recovered round shares: %v", err)
+		return
+	}
+	s.compactRoundJournal()
+}
@@ -0,0 +1,109 @@
+package stratum
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// Startup check of the stored state. Returns the inconsistencies found: a round or found blocks ahead of the daemon [the store belongs to another chain or
+// the daemon was resynced], pending balances which are duplicated, empty, overflow their sum or, with payments enabled, add up to more than the payments wallet
+// holds, and payment intents left unfinished by an interrupted payout, whose transaction may or may not have been sent
+func (s *StratumServer) validateState() []string {
+	var issues []string
+
+	var height int64
+	if info, err := s.rpc().GetInfo(); err == nil {
+		height = info.Height
+	}
+	if height > 0 {
+		if round := Storage_backend.GetPoolRoundStats(); round != nil && round.LastBlockHeight > height {
+			issues = append(issues, fmt.Sprintf("round last block height %v is ahead of the daemon height %v", round.LastBlockHeight, height))
+		}
+		for _, blockType := range []string{"candidate", "immature", "matured"} {
+			blocks := Graviton_backend.GetBlocksFound(blockType)
+			if blocks == nil {
+				continue
+			}
+			for _, block := range blocks.MinedBlocks {
+				if block.Height > height {
+					issues = append(issues, fmt.Sprintf("%v block %v is ahead of the daemon height %v", blockType, block.Height, height))
+				}
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	var sum uint64
+	overflow := false
+	for _, pending := range Storage_backend.GetPendingPayments() {
+		switch {
+		case pending.Address == "":
+			issues = append(issues, fmt.Sprintf("pending balance of %v without a login", pending.Amount))
+		case seen[pending.Address]:
+			issues = append(issues, fmt.Sprintf("pending balance of %v is stored more than once", pending.Address))
+		case pending.Amount == 0:
+			issues = append(issues, fmt.Sprintf("pending balance of %v is empty", pending.Address))
+		}
+		seen[pending.Address] = true
+		if sum > math.MaxUint64-pending.Amount {
+			issues = append(issues, "pending balances overflow their sum")
+			overflow = true
+			break
+		}
+		sum += pending.Amount
+	}
+	// The wallet holds every balance not paid yet [immature rewards are not pending balances yet], so pending balances above its total balance were credited twice
+	// or belong to another wallet. The total balance is compared, not the unlocked one, as change of the last payout may still be locked
+	if !overflow && sum > 0 && s.currentConfig().PaymentsConfig.Enabled && s.walletRPC != nil {
+		if balance, err := s.walletRPC.GetBalance(s.walletRPC.Url.String()); err != nil || balance == nil {
+			issues = append(issues, fmt.Sprintf("pending balances of %v could not be reconciled, the wallet is unreachable: %v", sum, err))
+		} else if sum > balance.Balance {
+			issues = append(issues, fmt.Sprintf("pending balances of %v exceed the wallet balance of %v by %v", sum, balance.Balance, sum-balance.Balance))
+		}
+	}
+
+	for _, intent := range sortedPaymentIntents() {
+		if intent.Status == intentPending || intent.Status == intentUnknown {
+			issues = append(issues, fmt.Sprintf("payment intent %v of %v is %v, its transaction may have been sent", intent.Key, intent.amount(), intent.Status))
+		}
+	}
+	return issues
+}
+
+// Boots into safe mode with the issues found. Miners keep mining and their shares keep counting towards the round, but block rewards are not credited
+// to balances and payouts are paused until the operator acknowledges with POST /api/admin/safemode?acknowledge=true
+func (s *StratumServer) enterSafeMode(issues []string) {
+	s.safeModeMu.Lock()
+	s.safeModeIssues = issues
+	s.safeModeSince = util.MakeTimestamp() / 1000
+	s.safeModeMu.Unlock()
+	atomic.StoreInt32(&s.safeMode, 1)
+
+	for _, issue := range issues {
+		StratumErrorLogger.Printf("[Stratum] Startup state check: %v", issue)
+	}
+	StratumErrorLogger.Printf("[Stratum] Entering safe mode, %v issues found. Crediting and payouts are paused until acknowledged with POST /api/admin/safemode?acknowledge=true", len(issues))
+	s.telegram.SafeMode(issues)
+}
+
+// Leaves safe mode, crediting and payouts resume with their next run
+func (s *StratumServer) acknowledgeSafeMode() {
+	if atomic.SwapInt32(&s.safeMode, 0) == 0 {
+		return
+	}
+	StratumInfoLogger.Printf("[Stratum] Safe mode acknowledged, resuming crediting and payouts")
+}
+
+func (s *StratumServer) inSafeMode() bool {
+	return atomic.LoadInt32(&s.safeMode) == 1
+}
+
+// Returns the issues safe mode was entered with and when
+func (s *StratumServer) safeModeState() ([]string, int64) {
+	s.safeModeMu.RLock()
+	defer s.safeModeMu.RUnlock()
+	return s.safeModeIssues, s.safeModeSince
+}
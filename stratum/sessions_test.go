@@ -0,0 +1,246 @@
+package stratum
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+)
+
+func newSessionsTestServer() *StratumServer {
+	s := &StratumServer{miners: NewMinersMap(), sessions: NewSessionsMap(), releaseQueue: make(chan *Miner, minerReleaseQueueSize)}
+	s.config.Store(&pool.Config{})
+	return s
+}
+
+func newSessionsTestSession(extraNonce uint32) *Session {
+	return &Session{ip: "127.0.0.1", extraNonce: extraNonce, send: make(chan []byte, 1)}
+}
+
+// Drains the release queue, returning how many times miner was queued
+func queuedReleases(s *StratumServer, miner *Miner) int {
+	queued := 0
+	for {
+		select {
+		case m := <-s.releaseQueue:
+			if m == miner {
+				queued++
+			}
+		default:
+			return queued
+		}
+	}
+}
+
+// The miner is queued for release once its last session is removed, not before
+func TestRemoveSessionReleasesMinerOnLastSession(t *testing.T) {
+	s := newSessionsTestServer()
+	miner := NewMiner("miner", "address", "", 0, "worker", 0, false, "127.0.0.1")
+	s.registerMiner(miner)
+
+	first, second := newSessionsTestSession(1), newSessionsTestSession(2)
+	if !s.registerSession(first, miner) || !s.registerSession(second, miner) {
+		t.Fatalf("sessions not registered")
+	}
+
+	s.removeSession(first)
+	if queued := queuedReleases(s, miner); queued != 0 {
+		t.Fatalf("miner queued for release with a session left")
+	}
+	if sessions := miner.liveSessions(); sessions != 1 {
+		t.Fatalf("miner has %v sessions, expected 1", sessions)
+	}
+
+	s.removeSession(second)
+	// A second removal of the same session [job transmit error then disconnect] does not queue it again
+	s.removeSession(second)
+	if queued := queuedReleases(s, miner); queued != 1 {
+		t.Fatalf("miner queued for release %v times, expected once", queued)
+	}
+	if sessions := miner.liveSessions(); sessions != 0 {
+		t.Fatalf("miner has %v sessions, expected none", sessions)
+	}
+}
+
+// A session logging in as another miner releases the previous one if it was its last session
+func TestRegisterSessionReleasesPreviousMiner(t *testing.T) {
+	s := newSessionsTestServer()
+	prev := NewMiner("prev", "address", "", 0, "prev", 0, false, "127.0.0.1")
+	next := NewMiner("next", "address", "", 0, "next", 0, false, "127.0.0.1")
+
+	cs := newSessionsTestSession(1)
+	s.registerSession(cs, prev)
+	s.registerSession(cs, next)
+
+	if queued := queuedReleases(s, prev); queued != 1 {
+		t.Fatalf("previous miner queued for release %v times, expected once", queued)
+	}
+	if prev.liveSessions() != 0 || next.liveSessions() != 1 {
+		t.Fatalf("sessions not moved to the new miner: %v previous, %v new", prev.liveSessions(), next.liveSessions())
+	}
+	if miner, ok := s.sessionMiner(cs, prev.Id); ok || miner != nil {
+		t.Fatalf("session still bound to the previous miner")
+	}
+}
+
+// A login that got the miner before it was evicted puts it back into s.miners
+func TestRegisterSessionRestoresEvictedMiner(t *testing.T) {
+	s := newSessionsTestServer()
+	miner := NewMiner("miner", "address", "", 0, "worker", 0, false, "127.0.0.1")
+	miner.EvictedAt = 1
+
+	if !s.registerSession(newSessionsTestSession(1), miner) {
+		t.Fatalf("session not registered")
+	}
+	if _, ok := s.miners.Get(miner.Id); !ok {
+		t.Fatalf("evicted miner not put back")
+	}
+	if miner.EvictedAt != 0 {
+		t.Fatalf("miner still marked evicted")
+	}
+}
+
+// Sessions registered and removed concurrently, in any order, leave the miner without sessions and queued for release
+func TestRegisterRemoveSessionRace(t *testing.T) {
+	s := newSessionsTestServer()
+	miner := NewMiner("miner", "address", "", 0, "worker", 0, false, "127.0.0.1")
+	s.registerMiner(miner)
+
+	const sessions = 200
+	var wg sync.WaitGroup
+	for i := 0; i < sessions; i++ {
+		cs := newSessionsTestSession(uint32(i))
+		wg.Add(2)
+		// The removal can run before the registration, in which case it is a no-op and the session is removed again below
+		go func() {
+			defer wg.Done()
+			s.registerSession(cs, miner)
+		}()
+		go func() {
+			defer wg.Done()
+			s.removeSession(cs)
+		}()
+	}
+	wg.Wait()
+
+	for _, cs := range s.sessions.Values() {
+		s.removeSession(cs)
+	}
+	if count := s.sessions.Count(); count != 0 {
+		t.Fatalf("%v sessions left", count)
+	}
+	if live := miner.liveSessions(); live != 0 {
+		t.Fatalf("miner has %v sessions left", live)
+	}
+	if queuedReleases(s, miner) == 0 {
+		t.Fatalf("miner not queued for release after its last session")
+	}
+}
+
+const (
+	registryBenchMiners   = 1000
+	registryBenchSessions = 5000
+)
+
+// The sessions registry before sharding, for comparison: a single lock over every session, duplicates of a login found by scanning all of them
+type unshardedSessions struct {
+	sync.RWMutex
+	miners map[*Session]*Miner
+}
+
+func (u *unshardedSessions) register(cs *Session, miner *Miner) {
+	u.Lock()
+	defer u.Unlock()
+	for other, otherMiner := range u.miners {
+		if other != cs && otherMiner == miner && other.ip == cs.ip {
+			delete(u.miners, other)
+		}
+	}
+	u.miners[cs] = miner
+}
+
+func (u *unshardedSessions) remove(cs *Session) {
+	u.Lock()
+	defer u.Unlock()
+	delete(u.miners, cs)
+}
+
+// Miners and sessions of a busy pool, every session from its own ip so none are collapsed
+func newRegistryBench() (*StratumServer, []*Miner, []*Session) {
+	s := newSessionsTestServer()
+	cfg := *s.currentConfig()
+	cfg.Stratum.CollapseDuplicates = true
+	s.config.Store(&cfg)
+	// Nothing releases miners here, releases are dropped rather than queued
+	s.releaseQueue = make(chan *Miner)
+
+	miners := make([]*Miner, registryBenchMiners)
+	for i := range miners {
+		miners[i] = NewMiner(fmt.Sprintf("miner%v", i), "address", "", 0, "worker", 0, false, "127.0.0.1")
+		s.registerMiner(miners[i])
+	}
+	sessions := make([]*Session, registryBenchSessions)
+	for i := range sessions {
+		sessions[i] = newSessionsTestSession(uint32(i))
+		sessions[i].ip = fmt.Sprintf("10.0.%v.%v", i/256, i%256)
+	}
+	return s, miners, sessions
+}
+
+// Logs in and disconnects sessions concurrently next to the sessions of a busy pool, through the registry before sharding
+func BenchmarkLoginUnsharded(b *testing.B) {
+	_, miners, sessions := newRegistryBench()
+	registry := &unshardedSessions{miners: make(map[*Session]*Miner)}
+	for i, cs := range sessions {
+		registry.register(cs, miners[i%len(miners)])
+	}
+	b.ResetTimer()
+	var next uint32 = registryBenchSessions
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddUint32(&next, 1)
+			cs := &Session{ip: fmt.Sprintf("10.1.0.%v", i%256), extraNonce: i}
+			registry.register(cs, miners[int(i)%len(miners)])
+			registry.remove(cs)
+		}
+	})
+}
+
+// Same as BenchmarkLoginUnsharded through registerSession and removeSession
+func BenchmarkLoginSharded(b *testing.B) {
+	s, miners, sessions := newRegistryBench()
+	for i, cs := range sessions {
+		s.registerSession(cs, miners[i%len(miners)])
+	}
+	b.ResetTimer()
+	var next uint32 = registryBenchSessions
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddUint32(&next, 1)
+			cs := &Session{ip: fmt.Sprintf("10.1.0.%v", i%256), extraNonce: i, send: make(chan []byte, 1)}
+			s.registerSession(cs, miners[int(i)%len(miners)])
+			s.removeSession(cs)
+		}
+	})
+}
+
+// Looks up the miner of submits concurrently. The miners map was sharded before the sessions, submits only look up the miner of the session so there is no before to compare
+func BenchmarkSubmitMinerLookup(b *testing.B) {
+	s, miners, sessions := newRegistryBench()
+	for i, cs := range sessions {
+		s.registerSession(cs, miners[i%len(miners)])
+	}
+	var next uint32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cs := sessions[int(atomic.AddUint32(&next, 1))%len(sessions)]
+			if _, ok := s.sessionMiner(cs, cs.miner.Id); !ok {
+				b.Fatalf("miner of the session not found")
+			}
+		}
+	})
+}
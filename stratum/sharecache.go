@@ -0,0 +1,109 @@
+package stratum
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Pool-wide set of the shares submitted within ttl, by the work they hashed: template, reserved bytes of the job, extranonce and nonce. Job and miner duplicate detection only cover a session and a miner id,
+// this catches the same work submitted again after a reconnect [new session, new jobs] or to another port or as another worker. Split in SHARD_COUNT shards like MinersMap
+type ShareCache struct {
+	ttl    time.Duration
+	shards []*shareCacheShard
+}
+
+type shareCacheShard struct {
+	sync.Mutex
+	// Expiry by share key, unix nanoseconds
+	items map[string]int64
+}
+
+// Returns a cache keeping shares for ttl, nil [every share is new] if ttl is not positive. Expired shares are purged every ttl
+func NewShareCache(ttl time.Duration) *ShareCache {
+	if ttl <= 0 {
+		return nil
+	}
+	c := &ShareCache{ttl: ttl, shards: make([]*shareCacheShard, SHARD_COUNT)}
+	for i := range c.shards {
+		c.shards[i] = &shareCacheShard{items: make(map[string]int64)}
+	}
+
+	go func() {
+		ticker := time.NewTicker(ttl)
+		for range ticker.C {
+			c.purge()
+		}
+	}()
+	return c
+}
+
+// The result sent by the miner is not part of the key, it is only checked after the cache so a client could vary it to pass the same work as new
+func shareCacheKey(job *Job, extraNonce, nonce string) string {
+	return strconv.FormatUint(job.height, 10) + ":" + strconv.FormatUint(job.templateSeq, 10) + ":" + hex.EncodeToString(job.reserved) + ":" + extraNonce + ":" + nonce
+}
+
+func (c *ShareCache) shard(key string) *shareCacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%uint32(SHARD_COUNT)]
+}
+
+// Returns true if the share was already submitted within ttl, otherwise records it
+func (c *ShareCache) submit(job *Job, extraNonce, nonce string) bool {
+	if c == nil {
+		return false
+	}
+	key := shareCacheKey(job, extraNonce, nonce)
+	shard := c.shard(key)
+	now := time.Now().UnixNano()
+
+	shard.Lock()
+	defer shard.Unlock()
+	if expiry, ok := shard.items[key]; ok && expiry > now {
+		return true
+	}
+	shard.items[key] = now + int64(c.ttl)
+	return false
+}
+
+// Removes a recorded share which was not credited [rejected or not verified], so it can be submitted again
+func (c *ShareCache) forget(job *Job, extraNonce, nonce string) {
+	if c == nil {
+		return
+	}
+	key := shareCacheKey(job, extraNonce, nonce)
+	shard := c.shard(key)
+	shard.Lock()
+	delete(shard.items, key)
+	shard.Unlock()
+}
+
+// Returns the number of shares recorded, expired ones included until purged
+func (c *ShareCache) count() int {
+	if c == nil {
+		return 0
+	}
+	var count int
+	for _, shard := range c.shards {
+		shard.Lock()
+		count += len(shard.items)
+		shard.Unlock()
+	}
+	return count
+}
+
+func (c *ShareCache) purge() {
+	now := time.Now().UnixNano()
+	for _, shard := range c.shards {
+		shard.Lock()
+		for key, expiry := range shard.items {
+			if expiry <= now {
+				delete(shard.items, key)
+			}
+		}
+		shard.Unlock()
+	}
+}
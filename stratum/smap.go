@@ -0,0 +1,64 @@
+package stratum
+
+import (
+	"sync"
+)
+
+// A "thread" safe set of the live sessions, split in SHARD_COUNT shards like MinersMap so that logins, disconnects and broadcasts of different sessions
+// do not contend on a single lock. A session is kept in the shard of its extranonce, which is unique among the connections of the pool
+type SessionsMap []*SessionsMapShared
+type SessionsMapShared struct {
+	Items        map[*Session]struct{}
+	sync.RWMutex // Guards the shard, and the miner association [cs.miner] of the sessions in it
+}
+
+func NewSessionsMap() SessionsMap {
+	m := make(SessionsMap, SHARD_COUNT)
+	for i := 0; i < SHARD_COUNT; i++ {
+		m[i] = &SessionsMapShared{Items: make(map[*Session]struct{})}
+	}
+	return m
+}
+
+// Returns the shard of the session
+func (m SessionsMap) GetShard(cs *Session) *SessionsMapShared {
+	return m[int(cs.extraNonce%uint32(SHARD_COUNT))]
+}
+
+// Returns the number of sessions within the set.
+func (m SessionsMap) Count() int {
+	count := 0
+	for i := 0; i < SHARD_COUNT; i++ {
+		shard := m[i]
+		shard.RLock()
+		count += len(shard.Items)
+		shard.RUnlock()
+	}
+	return count
+}
+
+// Returns a slice of all sessions within the set at the time of calling.
+func (m SessionsMap) Values() []*Session {
+	var values []*Session
+	for i := 0; i < SHARD_COUNT; i++ {
+		shard := m[i]
+		shard.RLock()
+		for cs := range shard.Items {
+			values = append(values, cs)
+		}
+		shard.RUnlock()
+	}
+	return values
+}
+
+// Calls f for every session, holding the read lock of one shard at a time. f must not register or remove sessions
+func (m SessionsMap) Range(f func(cs *Session)) {
+	for i := 0; i < SHARD_COUNT; i++ {
+		shard := m[i]
+		shard.RLock()
+		for cs := range shard.Items {
+			f(cs)
+		}
+		shard.RUnlock()
+	}
+}
@@ -10,10 +10,12 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/Nelbert442/dero-golang-pool/pool"
+	"github.com/Nelbert442/dero-golang-pool/util"
 	"github.com/deroproject/graviton"
 )
 
@@ -22,6 +24,8 @@ type PoolRound struct {
 	Timestamp       int64
 	LastBlockHeight int64
 	RoundShares     map[string]int64
+	// Fee weight [shares x pool fee percent of their port] by login. nil for rounds started before per port fees, those are charged the unlocker poolFee
+	RoundFees map[string]float64
 }
 
 type MiningShare struct {
@@ -51,7 +55,8 @@ type GravitonMiners struct {
 }
 
 type GravitonCharts struct {
-	Values []*ChartData
+	Values      []*ChartData
+	Downsampled []*ChartTier `json:",omitempty"`
 }
 
 type BlockDataGrav struct {
@@ -69,6 +74,11 @@ type BlockDataGrav struct {
 	ExtraReward *big.Int
 	RoundHeight int64
 	BlockState  string
+	// Pool fee percent of the solo port a solo block was found on, nil for pool blocks [charged by their round fees] and solo blocks found with the soloMining
+	// login prefix, which are not charged a fee
+	Fee *float64 `json:",omitempty"`
+	// Rewards credited to the pending balances by login when the block matured, debited again if the block is orphaned afterwards
+	Rewards map[string]int64 `json:",omitempty"`
 }
 
 type BlocksFoundByHeight struct {
@@ -79,16 +89,64 @@ type BlocksFound struct {
 	MinedBlocks []*BlockDataGrav
 }
 
+// Amount is the amount sent [net], Fee the share of the transaction fee charged to the payee with txFeePayer "miner", so the balance debited [gross] is Amount + Fee
 type MinerPayments struct {
 	Login     string
 	TxHash    string
 	TxKey     string
 	TxFee     uint64
+	Fee       uint64 `json:",omitempty"`
 	Mixin     uint64
 	Amount    uint64
 	Timestamp int64
 }
 
+// Payout transaction tracked to confirmation, keyed by txid. Status is one of pending, confirmed or failed
+type PayoutTx struct {
+	TxHash        string
+	TxKey         string
+	TxFee         uint64
+	Timestamp     int64
+	Height        uint64
+	Confirmations int64
+	Status        string
+	CheckedAt     int64
+	Payees        []*MinerPayments
+}
+
+type PayoutTxs struct {
+	Txs map[string]*PayoutTx
+}
+
+// Payout transaction persisted under its idempotency key before it is sent, so an interrupted or failed payout is resumed instead of paid twice. See paymentintents.go for the statuses
+type PaymentIntent struct {
+	Key         string
+	PaymentID   string
+	Payees      []*IntentPayee
+	Status      string
+	Attempts    int
+	NextAttempt int64  `json:",omitempty"`
+	LastError   string `json:",omitempty"`
+	TxHash      string `json:",omitempty"`
+	TxKey       string `json:",omitempty"`
+	TxFee       uint64
+	CreatedAt   int64
+	UpdatedAt   int64
+}
+
+// Recipient of a payment intent, Debited once Amount [sent] plus Fee [its share of the transaction fee with txFeePayer "miner"] is taken off the pending balance of the login
+type IntentPayee struct {
+	Login   string
+	Address string
+	Amount  uint64
+	Fee     uint64 `json:",omitempty"`
+	Debited bool
+}
+
+type PaymentIntents struct {
+	Intents map[string]*PaymentIntent
+}
+
 type ProcessedPayments struct {
 	MinerPayments []*MinerPayments
 }
@@ -104,14 +162,19 @@ type PendingPayments struct {
 }
 
 type GravitonStore struct {
-	DB            *graviton.Store
-	DBFolder      string
-	DBPath        string
-	DBTree        string
-	migrating     int
+	DB       *graviton.Store
+	DBFolder string
+	DBPath   string
+	DBTree   string
+	// Held for reading by every use of DB [from loading the snapshot until the commit], and for writing to migrate, reopen or close it so DB is never swapped under a reader
+	dbMu          sync.RWMutex
 	DBMaxSnapshot uint64
 	DBMigrateWait time.Duration
 	Writing       int
+	// Upper bound of the miner shares this process last added to the current round, see updatePoolRoundStats
+	roundWatermark int64
+	// Set in stats-only mode, where the store is shared with the pool process and never migrated or written to
+	ReadOnly bool
 }
 
 type TreeKV struct {
@@ -119,14 +182,73 @@ type TreeKV struct {
 	v []byte
 }
 
+// Shares, round stats, balances and payment records. Implemented by GravitonStore [embedded, single process] and RedisStore [shared by several pool processes or hosts]
+type Storage interface {
+	WriteRoundShares(roundHeight int64, roundShares map[string]int64) error
+	GetRoundShares(roundHeight int64) (map[string]int64, int64, error)
+	WriteRoundFees(roundHeight int64, roundFees map[string]float64) error
+	GetRoundFees(roundHeight int64) (map[string]float64, bool)
+	WritePPLNSRoundShares(roundHeight int64, roundShares map[string]int64) error
+	GetPPLNSRoundShares(roundHeight int64) (map[string]int64, int64, bool)
+	WritePPLNSRoundFees(roundHeight int64, roundFees map[string]float64) error
+	GetPPLNSRoundFees(roundHeight int64) (map[string]float64, bool)
+	RemoveRounds(roundHeights []int64) error
+	WritePPLNSWindow(shares []*PPLNSShare) error
+	GetPPLNSWindow() []*PPLNSShare
+	UpdatePoolRoundStats(miners MinersMap, blockFound bool) error
+	OverwritePoolRoundStats(info *PoolRound) error
+	// Read-modify-write of the current round, atomic against other pool processes sharing the store. modify may be called again if another process wrote in between
+	UpdatePoolRound(modify func(round *PoolRound) (*PoolRound, error)) error
+	GetPoolRoundStats() *PoolRound
+	WriteImmaturePayments(info *PaymentPending) error
+	WritePendingPayments(info *PaymentPending) error
+	GetPendingPayments() []*PaymentPending
+	OverwritePendingPayments(info *PendingPayments) error
+	// Read-modify-write of the pending balances, atomic against other pool processes sharing the store. modify may be called again if another process wrote in between
+	UpdatePendingPayments(modify func(pending []*PaymentPending) ([]*PaymentPending, error)) error
+	WriteProcessedPayments(info *MinerPayments) error
+	GetProcessedPayments() *ProcessedPayments
+	OverwriteProcessedPayments(info *ProcessedPayments) error
+	WritePayoutTx(info *MinerPayments) error
+	OverwritePayoutTxs(info *PayoutTxs) error
+	GetPayoutTxs() *PayoutTxs
+	OverwritePaymentIntents(info *PaymentIntents) error
+	GetPaymentIntents() *PaymentIntents
+	WriteMinerSettings(settings *MinerSettings) error
+	GetMinerSettings() map[string]*MinerSettings
+	OverwriteTelegramLinks(info []*TelegramLink) error
+	GetTelegramLinks() []*TelegramLink
+}
+
 var Graviton_backend *GravitonStore = &GravitonStore{}
+
+// Set by NewStorageBackend from the storageBackend config, everything not covered by Storage [blocks, miner stats, charts, events, ...] stays in Graviton_backend
+var Storage_backend Storage = Graviton_backend
 var StorageInfoLogger = logFileOutStorage("INFO")
 var StorageErrorLogger = logFileOutStorage("ERROR")
 
+// Selects Storage_backend from the storageBackend config, graviton [default] or redis. Graviton_backend is opened either way for everything else
+func NewStorageBackend(cfg *pool.Config) {
+	switch cfg.StorageBackend {
+	case "", "graviton":
+		Storage_backend = Graviton_backend
+	case "redis":
+		redisStore, err := NewRedisStore(&cfg.Redis, cfg.PoolHost)
+		if err != nil {
+			StorageErrorLogger.Printf("%v", err)
+			log.Fatalf("%v", err)
+		}
+		Storage_backend = redisStore
+	default:
+		StorageErrorLogger.Printf("[Storage] Unknown storageBackend %q, expected graviton or redis", cfg.StorageBackend)
+		log.Fatalf("[Storage] Unknown storageBackend %q, expected graviton or redis", cfg.StorageBackend)
+	}
+}
+
 func (g *GravitonStore) NewGravDB(poolhost, dbFolder, dbmigratewait string, dbmaxsnapshot uint64) {
 	current_path, err := os.Getwd()
 	if err != nil {
-		log.Printf("%v", err)
+		StorageErrorLogger.Printf("%v", err)
 	}
 
 	g.DBMigrateWait, _ = time.ParseDuration(dbmigratewait)
@@ -141,21 +263,72 @@ func (g *GravitonStore) NewGravDB(poolhost, dbFolder, dbmigratewait string, dbma
 
 	g.DBTree = poolhost
 
-	log.Printf("[Graviton] Initializing graviton store at path: %v", filepath.Join(current_path, dbFolder))
 	StorageInfoLogger.Printf("[Graviton] Initializing graviton store at path: %v", filepath.Join(current_path, dbFolder))
 }
 
+// Returns the most recent snapshot with DB read-locked, release unlocks it once the caller is done with the snapshot and its commit. The store is migrated
+// first once it reached g.DBMaxSnapshot commits
+func (g *GravitonStore) loadSnapshot() (*graviton.Snapshot, func()) {
+	g.dbMu.RLock()
+	ss, _ := g.DB.LoadSnapshot(0)
+	if ss.GetVersion() >= g.DBMaxSnapshot {
+		g.dbMu.RUnlock()
+		g.dbMu.Lock()
+		// Another caller may have migrated while the lock was released
+		if latest, _ := g.DB.LoadSnapshot(0); latest.GetVersion() >= g.DBMaxSnapshot {
+			g.swapGravDB(g.DBFolder)
+		}
+		g.dbMu.Unlock()
+		g.dbMu.RLock()
+		ss, _ = g.DB.LoadSnapshot(0)
+	}
+	return ss, g.dbMu.RUnlock
+}
+
+// Closes the store once no reader is using it
+func (g *GravitonStore) Close() {
+	g.dbMu.Lock()
+	defer g.dbMu.Unlock()
+	g.DB.Close()
+}
+
+// Reopens the store at g.DBPath, used in stats-only mode to follow commits and migrations of the pool process sharing the DB
+func (g *GravitonStore) ReopenGravDB() {
+	g.dbMu.Lock()
+	defer g.dbMu.Unlock()
+	g.reopenGravDB()
+}
+
+func (g *GravitonStore) reopenGravDB() {
+	g.DB.Close()
+	store, err := graviton.NewDiskStore(g.DBPath)
+	if err != nil {
+		StorageErrorLogger.Printf("[Graviton] Error reopening graviton store at path %v: %v", g.DBPath, err)
+	} else {
+		g.DB = store
+	}
+}
+
 // Swaps the store pointer from existing to new after copying latest snapshot to new DB - fast as cursor + disk writes allow [possible other alternatives such as mem store for some of these interwoven, testing needed]
 func (g *GravitonStore) SwapGravDB(poolhost, dbFolder string) {
-	// Use g.migrating as a simple 'mutex' of sorts to lock other read/write functions out of doing anything with DB until this function has completed.
-	g.migrating = 1
+	g.dbMu.Lock()
+	defer g.dbMu.Unlock()
+	g.swapGravDB(dbFolder)
+}
+
+// Migrates the store, the caller holds dbMu for writing
+func (g *GravitonStore) swapGravDB(dbFolder string) {
+	// Migration is left to the pool process, a read-only store just reopens to pick up the migrated DB
+	if g.ReadOnly {
+		g.reopenGravDB()
+		return
+	}
+
 	// Rename existing bak to bak2, then goroutine to cleanup so process doesn't wait for old db cleanup time
 	var bakFolder string = dbFolder + "_bak"
 	var bak2Folder string = dbFolder + "_bak2"
-	log.Printf("Renaming directory %v to %v", bakFolder, bak2Folder)
 	StorageInfoLogger.Printf("Renaming directory %v to %v", bakFolder, bak2Folder)
 	os.Rename(bakFolder, bak2Folder)
-	log.Printf("Removing directory %v", bak2Folder)
 	StorageInfoLogger.Printf("Removing directory %v", bak2Folder)
 	go os.RemoveAll(bak2Folder)
 
@@ -163,10 +336,9 @@ func (g *GravitonStore) SwapGravDB(poolhost, dbFolder string) {
 	store := g.DB
 	ss, _ := store.LoadSnapshot(0)
 	tree, _ := ss.GetTree(g.DBTree)
-	log.Printf("SS: %v", ss.GetVersion())
+	StorageInfoLogger.Printf("SS: %v", ss.GetVersion())
 
 	c := tree.Cursor()
-	log.Printf("Getting k/v pairs")
 	StorageInfoLogger.Printf("Getting k/v pairs")
 	// Duplicate the LATEST (snapshot 0) to the new DB, this starts the DB over again, but still retaining X number of old DBs for version in future use cases. Here we get the vals before swapping to new db in mem
 	var treeKV []*TreeKV // Just k & v which are of type []byte
@@ -174,18 +346,15 @@ func (g *GravitonStore) SwapGravDB(poolhost, dbFolder string) {
 		temp := &TreeKV{k, v}
 		treeKV = append(treeKV, temp)
 	}
-	log.Printf("Closing store")
 	StorageInfoLogger.Printf("Closing store")
 	store.Close()
 
 	// Backup last set of g.DBMaxSnapshot snapshots, can offload elsewhere or make this process as X many times as you want to backup.
 	var oldFolder string
 	oldFolder = g.DBPath
-	log.Printf("Renaming directory %v to %v", oldFolder, bakFolder)
 	StorageInfoLogger.Printf("Renaming directory %v to %v", oldFolder, bakFolder)
 	os.Rename(oldFolder, bakFolder)
 
-	log.Printf("Creating new disk store")
 	StorageInfoLogger.Printf("Creating new disk store")
 	g.DB, _ = graviton.NewDiskStore(g.DBPath)
 
@@ -194,25 +363,19 @@ func (g *GravitonStore) SwapGravDB(poolhost, dbFolder string) {
 	ss, _ = store.LoadSnapshot(0)
 	tree, _ = ss.GetTree(g.DBTree)
 
-	log.Printf("Putting k/v pairs into tree...")
 	StorageInfoLogger.Printf("Putting k/v pairs into tree...")
 	for _, val := range treeKV {
 		tree.Put(val.k, val.v)
 	}
-	log.Printf("Committing k/v pairs to tree")
 	StorageInfoLogger.Printf("Committing k/v pairs to tree")
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
-	log.Printf("Migration to new DB is done.")
 	StorageInfoLogger.Printf("Migration to new DB is done.")
-	g.migrating = 0
 }
 
 func (g *GravitonStore) WriteBlocks(info *BlockDataGrav, blockType string) error {
-	log.Printf("[Graviton] Inputting info: %v", info)
 	StorageInfoLogger.Printf("[Graviton] Inputting info: %v", info)
 	confBytes, err := json.Marshal(info)
 	if err != nil {
@@ -224,28 +387,12 @@ func (g *GravitonStore) WriteBlocks(info *BlockDataGrav, blockType string) error
 	if blockType == "candidate" {
 		err = g.WriteBlocksFoundByHeightArr(info.Height, info.Solo)
 		if err != nil {
-			log.Printf("[Graviton] Error writing blocksfoundbyheightarr: %v", err)
 			StorageErrorLogger.Printf("[Graviton] Error writing blocksfoundbyheightarr: %v", err)
 		}
 	}
 
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[WriteBlocks] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[WriteBlocks] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 
@@ -267,12 +414,10 @@ func (g *GravitonStore) WriteBlocks(info *BlockDataGrav, blockType string) error
 			maturedBlocks = &BlocksFound{MinedBlocks: maturedBlocksArr}
 		} else {
 			// Retrieve value and convert to BlocksFoundByHeight, so that you can manipulate and update db
-			log.Printf("Appending block. Stored []byte maturedblocks slice size: %v", len(currMaturedBlocks))
 			StorageInfoLogger.Printf("Appending block. Stored []byte maturedblocks slice size: %v", len(currMaturedBlocks))
 			_ = json.Unmarshal(currMaturedBlocks, &maturedBlocks)
 
 			maturedBlocks.MinedBlocks = append(maturedBlocks.MinedBlocks, info)
-			log.Printf("Appending block. MaturedBlock slice size: %v", len(maturedBlocks.MinedBlocks))
 			StorageInfoLogger.Printf("Appending block. MaturedBlock slice size: %v", len(maturedBlocks.MinedBlocks))
 		}
 		newMaturedBlocks, err = json.Marshal(maturedBlocks)
@@ -285,21 +430,48 @@ func (g *GravitonStore) WriteBlocks(info *BlockDataGrav, blockType string) error
 		tree.Put([]byte(key), newMaturedBlocks)
 	}
 
-	// Remove blocks from previous rounds (orphaned removes candidate, immature removes candidate, matured removes immature)
+	// Remove blocks from previous rounds (orphaned removes candidate, immature or matured, immature removes candidate, matured removes immature)
 	switch blockType {
 	case "orphaned":
-		key := "block:" + "candidate" + ":" + strconv.FormatInt(info.Height, 10)
+		// Blocks are orphaned from any of the previous states, matured blocks too when they are no longer in the main chain after crediting
+		for _, state := range []string{"candidate", "immature"} {
+			key := "block:" + state + ":" + strconv.FormatInt(info.Height, 10)
+			if v, _ := tree.Get([]byte(key)); v == nil {
+				continue
+			}
 
-		log.Printf("[Graviton] Removing info: %v", key)
-		StorageInfoLogger.Printf("[Graviton] Removing info: %v", key)
-		err := tree.Delete([]byte(key))
-		if err != nil {
-			return err
+			StorageInfoLogger.Printf("[Graviton] Removing info: %v", key)
+			err := tree.Delete([]byte(key))
+			if err != nil {
+				return err
+			}
+		}
+
+		currMaturedBlocks, _ := tree.Get([]byte("block:matured"))
+		if currMaturedBlocks != nil {
+			var maturedBlocks *BlocksFound
+			_ = json.Unmarshal(currMaturedBlocks, &maturedBlocks)
+			if maturedBlocks != nil {
+				var remaining []*BlockDataGrav
+				for _, block := range maturedBlocks.MinedBlocks {
+					if block.Height != info.Height || block.Hash != info.Hash {
+						remaining = append(remaining, block)
+					}
+				}
+				if len(remaining) != len(maturedBlocks.MinedBlocks) {
+					StorageInfoLogger.Printf("[Graviton] Removing matured block at height %v", info.Height)
+					newMaturedBlocks, err := json.Marshal(&BlocksFound{MinedBlocks: remaining})
+					if err != nil {
+						StorageErrorLogger.Printf("[Graviton] could not marshal maturedBlocks info: %v", err)
+						return fmt.Errorf("[Graviton] could not marshal maturedBlocks info: %v", err)
+					}
+					tree.Put([]byte("block:matured"), newMaturedBlocks)
+				}
+			}
 		}
 	case "immature":
 		key := "block:" + "candidate" + ":" + strconv.FormatInt(info.Height, 10)
 
-		log.Printf("[Graviton] Removing info: %v", key)
 		StorageInfoLogger.Printf("[Graviton] Removing info: %v", key)
 		err := tree.Delete([]byte(key))
 		if err != nil {
@@ -308,7 +480,6 @@ func (g *GravitonStore) WriteBlocks(info *BlockDataGrav, blockType string) error
 	case "matured":
 		key := "block:" + "immature" + ":" + strconv.FormatInt(info.Height, 10)
 
-		log.Printf("[Graviton] Removing info: %v", key)
 		StorageInfoLogger.Printf("[Graviton] Removing info: %v", key)
 		err := tree.Delete([]byte(key))
 		if err != nil {
@@ -317,7 +488,6 @@ func (g *GravitonStore) WriteBlocks(info *BlockDataGrav, blockType string) error
 	}
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
 	return nil
@@ -325,23 +495,8 @@ func (g *GravitonStore) WriteBlocks(info *BlockDataGrav, blockType string) error
 
 // Array of int64 [heights] of blocks found by pool, this does not include solo blocks found. Used as reference points for round hash calculations
 func (g *GravitonStore) WriteBlocksFoundByHeightArr(height int64, isSolo bool) error {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[WriteBlocksFoundByHeightArr] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[WriteBlocksFoundByHeightArr] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "block:blocksFoundByHeight"
@@ -370,30 +525,14 @@ func (g *GravitonStore) WriteBlocksFoundByHeightArr(height int64, isSolo bool) e
 
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
 	return nil
 }
 
 func (g *GravitonStore) GetBlocksFoundByHeightArr() *BlocksFoundByHeight {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[GetBlocksFoundByHeightArr] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[GetBlocksFoundByHeightArr] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	currFoundByHeight, err := tree.Get([]byte("block:blocksFoundByHeight"))
@@ -409,23 +548,8 @@ func (g *GravitonStore) GetBlocksFoundByHeightArr() *BlocksFoundByHeight {
 
 // Allow for getting the blocks found by pool/solo. blocktype: orphaned, candidate, immature, matured or specify all for returning all blocks
 func (g *GravitonStore) GetBlocksFound(blocktype string) *BlocksFound {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[GetBlocksFound] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[GetBlocksFound] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 
@@ -501,13 +625,12 @@ func (g *GravitonStore) WriteImmatureBlock(block *BlockDataGrav) error {
 	// If block is not solo, set totalShares.
 	// TODO: Configure share tracking for solo as well? For effort calcs
 	if !block.Solo {
-		_, totalShares, _ := g.GetRoundShares(block.Height)
+		_, totalShares, _ := Storage_backend.GetRoundShares(block.Height)
 		immatureBlock.TotalShares = totalShares
 	}
 
 	err := g.WriteBlocks(immatureBlock, "immature")
 	if err != nil {
-		log.Printf("[Graviton] Error when adding immature block store at height %v: %v", immatureBlock.Height, err)
 		StorageErrorLogger.Printf("[Graviton] Error when adding immature block store at height %v: %v", immatureBlock.Height, err)
 	}
 
@@ -522,13 +645,12 @@ func (g *GravitonStore) WriteMaturedBlocks(block *BlockDataGrav) error {
 	// If block is not solo, set totalShares.
 	// TODO: Configure share tracking for solo as well? For effort calcs
 	if !block.Solo {
-		_, totalShares, _ := g.GetRoundShares(block.Height)
+		_, totalShares, _ := Storage_backend.GetRoundShares(block.Height)
 		maturedBlock.TotalShares = totalShares
 	}
 
 	err := g.WriteBlocks(maturedBlock, "matured")
 	if err != nil {
-		log.Printf("[Graviton] Error when adding matured block store at height %v: %v", maturedBlock.Height, err)
 		StorageErrorLogger.Printf("[Graviton] Error when adding matured block store at height %v: %v", maturedBlock.Height, err)
 	}
 
@@ -536,13 +658,13 @@ func (g *GravitonStore) WriteMaturedBlocks(block *BlockDataGrav) error {
 }
 
 func (g *GravitonStore) WriteOrphanedBlocks(orphanedBlocks []*BlockDataGrav) error {
-	// Remove blocks from candidates store and add them to orphaned block store
+	// Remove blocks from the candidate, immature or matured store and add them to orphaned block store
 	for _, value := range orphanedBlocks {
+		value.BlockState = "orphaned"
 
 		// Add to orphan store
 		err := g.WriteBlocks(value, "orphaned")
 		if err != nil {
-			log.Printf("[Graviton] Error when adding orphaned block store at height %v: %v", value.Height, err)
 			StorageErrorLogger.Printf("[Graviton] Error when adding orphaned block store at height %v: %v", value.Height, err)
 			break
 		}
@@ -551,29 +673,76 @@ func (g *GravitonStore) WriteOrphanedBlocks(orphanedBlocks []*BlockDataGrav) err
 	return nil
 }
 
-// Function that will remove a k/v pair
-func (g *GravitonStore) RemoveKey(key string) error {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
+// Removes matured and orphaned blocks from the block history, used by the retention to cap it. Heights without a candidate or immature block left are removed from blocksFoundByHeight
+func (g *GravitonStore) RemoveBlocks(blocks []*BlockDataGrav) error {
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[RemoveKey] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[RemoveKey] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+	removed := make(map[int64]bool)
+	for _, block := range blocks {
+		removed[block.Height] = true
+		if block.BlockState == "orphaned" {
+			if err := tree.Delete([]byte("block:orphaned:" + strconv.FormatInt(block.Height, 10))); err != nil {
+				StorageErrorLogger.Printf("[Graviton] Error removing orphaned block at height %v: %v", block.Height, err)
+			}
+		}
+	}
+
+	if currMaturedBlocks, _ := tree.Get([]byte("block:matured")); currMaturedBlocks != nil {
+		var maturedBlocks *BlocksFound
+		_ = json.Unmarshal(currMaturedBlocks, &maturedBlocks)
+		if maturedBlocks != nil {
+			var remaining []*BlockDataGrav
+			for _, block := range maturedBlocks.MinedBlocks {
+				if !removed[block.Height] {
+					remaining = append(remaining, block)
+				}
+			}
+			newMaturedBlocks, err := json.Marshal(&BlocksFound{MinedBlocks: remaining})
+			if err != nil {
+				StorageErrorLogger.Printf("[Graviton] could not marshal maturedBlocks info: %v", err)
+				return fmt.Errorf("[Graviton] could not marshal maturedBlocks info: %v", err)
+			}
+			tree.Put([]byte("block:matured"), newMaturedBlocks)
+		}
+	}
+
+	if currFoundByHeight, _ := tree.Get([]byte("block:blocksFoundByHeight")); currFoundByHeight != nil {
+		var foundByHeight *BlocksFoundByHeight
+		_ = json.Unmarshal(currFoundByHeight, &foundByHeight)
+		if foundByHeight != nil {
+			for height := range removed {
+				candidate, _ := tree.Get([]byte("block:candidate:" + strconv.FormatInt(height, 10)))
+				immature, _ := tree.Get([]byte("block:immature:" + strconv.FormatInt(height, 10)))
+				if candidate == nil && immature == nil {
+					delete(foundByHeight.Heights, height)
+				}
+			}
+			newFoundByHeight, err := json.Marshal(foundByHeight)
+			if err != nil {
+				StorageErrorLogger.Printf("[Graviton] could not marshal foundByHeight info: %v", err)
+				return fmt.Errorf("[Graviton] could not marshal foundByHeight info: %v", err)
+			}
+			tree.Put([]byte("block:blocksFoundByHeight"), newFoundByHeight)
+		}
 	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
 
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
+	return nil
+}
+
+// Function that will remove a k/v pair
+func (g *GravitonStore) RemoveKey(key string) error {
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 
-	log.Printf("[Graviton] Removing info: %v", key)
 	StorageInfoLogger.Printf("[Graviton] Removing info: %v", key)
 	err := tree.Delete([]byte(key))
 	if err != nil {
@@ -582,30 +751,14 @@ func (g *GravitonStore) RemoveKey(key string) error {
 	}
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
 	return nil
 }
 
 func (g *GravitonStore) WriteImmaturePayments(info *PaymentPending) error {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[WriteImmaturePayments] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[WriteImmaturePayments] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "payments:immature"
@@ -635,7 +788,6 @@ func (g *GravitonStore) WriteImmaturePayments(info *PaymentPending) error {
 	tree.Put([]byte(key), newPaymentsPending)
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
 	/*
@@ -650,23 +802,8 @@ func (g *GravitonStore) WriteImmaturePayments(info *PaymentPending) error {
 }
 
 func (g *GravitonStore) WritePendingPayments(info *PaymentPending) error {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[WritePendingPayments] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[WritePendingPayments] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "payments:pending"
@@ -689,7 +826,6 @@ func (g *GravitonStore) WritePendingPayments(info *PaymentPending) error {
 		var updateExisting bool
 		for p, currPayment := range paymentsPending.PendingPayout {
 			if info.Address == currPayment.Address {
-				log.Printf("[Graviton] Updating value for %v from %v to %v", info.Address, paymentsPending.PendingPayout[p].Amount, (paymentsPending.PendingPayout[p].Amount + info.Amount))
 				StorageInfoLogger.Printf("[Graviton] Updating value for %v from %v to %v", info.Address, paymentsPending.PendingPayout[p].Amount, (paymentsPending.PendingPayout[p].Amount + info.Amount))
 				paymentsPending.PendingPayout[p].Amount += info.Amount
 				updateExisting = true
@@ -698,7 +834,6 @@ func (g *GravitonStore) WritePendingPayments(info *PaymentPending) error {
 
 		// If an existing payment was not upated since the addresses didn't match, append the new payment
 		if !updateExisting {
-			log.Printf("[Graviton] Appending new payment: %v", info)
 			StorageInfoLogger.Printf("[Graviton] Appending new payment: %v", info)
 			paymentsPending.PendingPayout = append(paymentsPending.PendingPayout, info)
 		}
@@ -712,7 +847,6 @@ func (g *GravitonStore) WritePendingPayments(info *PaymentPending) error {
 	tree.Put([]byte(key), newPaymentsPending)
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
 	/*
@@ -727,23 +861,8 @@ func (g *GravitonStore) WritePendingPayments(info *PaymentPending) error {
 }
 
 func (g *GravitonStore) GetPendingPayments() []*PaymentPending {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[GetPendingPayments] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[GetPendingPayments] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "payments:pending"
@@ -766,23 +885,8 @@ func (g *GravitonStore) OverwritePendingPayments(info *PendingPayments) error {
 		return fmt.Errorf("[Graviton] could not marshal pendingpayments info: %v", err)
 	}
 
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[OverwritePendingPayments] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[OverwritePendingPayments] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "payments:pending"
@@ -790,30 +894,23 @@ func (g *GravitonStore) OverwritePendingPayments(info *PendingPayments) error {
 	tree.Put([]byte(key), confBytes)
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
 	return nil
 }
 
-func (g *GravitonStore) WriteProcessedPayments(info *MinerPayments) error {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[WriteProcessedPayments] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[WriteProcessedPayments] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+// Graviton is written by a single process, the caller holds the Writing flag
+func (g *GravitonStore) UpdatePendingPayments(modify func(pending []*PaymentPending) ([]*PaymentPending, error)) error {
+	pending, err := modify(g.GetPendingPayments())
+	if err != nil {
+		return err
 	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
+	return g.OverwritePendingPayments(&PendingPayments{PendingPayout: pending})
+}
 
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+func (g *GravitonStore) WriteProcessedPayments(info *MinerPayments) error {
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "payments:processed"
@@ -830,12 +927,10 @@ func (g *GravitonStore) WriteProcessedPayments(info *MinerPayments) error {
 		paymentsProcessed = &ProcessedPayments{MinerPayments: paymentsProcessedArr}
 	} else {
 		// Retrieve value and convert to BlocksFoundByHeight, so that you can manipulate and update db
-		log.Printf("Appending payment processed. Stored []byte minerpayments slice size: %v", len(currPaymentsProcessed))
 		StorageInfoLogger.Printf("Appending payment processed. Stored []byte minerpayments slice size: %v", len(currPaymentsProcessed))
 		_ = json.Unmarshal(currPaymentsProcessed, &paymentsProcessed)
 
 		paymentsProcessed.MinerPayments = append(paymentsProcessed.MinerPayments, info)
-		log.Printf("Appending payment processed. MinerPayments slice size: %v", len(paymentsProcessed.MinerPayments))
 		StorageInfoLogger.Printf("Appending payment processed. MinerPayments slice size: %v", len(paymentsProcessed.MinerPayments))
 	}
 	newPaymentsProcessed, err = json.Marshal(paymentsProcessed)
@@ -848,30 +943,14 @@ func (g *GravitonStore) WriteProcessedPayments(info *MinerPayments) error {
 	// TODO: max value size of 104857600 would come out to ~299,593 payments [~[350]byte or so a piece] capable of being stored this way before errs on value store and need for splitting.
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
 	return nil
 }
 
 func (g *GravitonStore) GetProcessedPayments() *ProcessedPayments {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[GetProcessedPayments] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[GetProcessedPayments] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "payments:processed"
@@ -886,138 +965,450 @@ func (g *GravitonStore) GetProcessedPayments() *ProcessedPayments {
 	return nil
 }
 
-func join(args ...interface{}) string {
-	s := make([]string, len(args))
-	for i, v := range args {
-		switch v.(type) {
-		case string:
-			s[i] = v.(string)
-		case int64:
-			s[i] = strconv.FormatInt(v.(int64), 10)
-		case uint64:
-			s[i] = strconv.FormatUint(v.(uint64), 10)
-		case float64:
-			s[i] = strconv.FormatFloat(v.(float64), 'f', 0, 64)
-		case bool:
-			if v.(bool) {
-				s[i] = "1"
-			} else {
-				s[i] = "0"
-			}
-		case *big.Int:
-			n := v.(*big.Int)
-			if n != nil {
-				s[i] = n.String()
-			} else {
-				s[i] = "0"
-			}
-		default:
-			panic("Invalid type specified for conversion")
-		}
+// This function is to overwrite processed payments, used by the retention to cap the payment history
+func (g *GravitonStore) OverwriteProcessedPayments(info *ProcessedPayments) error {
+	confBytes, err := json.Marshal(info)
+	if err != nil {
+		StorageErrorLogger.Printf("[Graviton] could not marshal paymentsProcessed info: %v", err)
+		return fmt.Errorf("[Graviton] could not marshal paymentsProcessed info: %v", err)
 	}
-	return strings.Join(s, ":")
-}
 
-func (blockDataGrav *BlockDataGrav) RoundKey() string {
-	return join(blockDataGrav.RoundHeight, blockDataGrav.Hash)
-}
+	ss, release := g.loadSnapshot()
+	defer release()
 
-func (g *GravitonStore) WriteConfig(config *pool.Config) error {
-	confBytes, err := json.Marshal(config)
-	if err != nil {
-		StorageErrorLogger.Printf("[Graviton] could not marshal pool.Config info: %v", err)
-		return fmt.Errorf("[Graviton] could not marshal pool.Config info: %v", err)
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "payments:processed"
+
+	tree.Put([]byte(key), confBytes)
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
+	return nil
+}
 
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
+// Adds the processed payment to its payout transaction record [keyed by txid], creating the record as pending if it does not exist
+func (g *GravitonStore) WritePayoutTx(info *MinerPayments) error {
+	payoutTxs := g.GetPayoutTxs()
+	if payoutTxs == nil {
+		payoutTxs = &PayoutTxs{Txs: make(map[string]*PayoutTx)}
+	}
 
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[WriteConfig] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[WriteConfig] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+	payoutTx, ok := payoutTxs.Txs[info.TxHash]
+	if !ok {
+		payoutTx = &PayoutTx{TxHash: info.TxHash, TxKey: info.TxKey, TxFee: info.TxFee, Timestamp: info.Timestamp, Status: "pending"}
+		payoutTxs.Txs[info.TxHash] = payoutTx
 	}
+	payoutTx.Payees = append(payoutTx.Payees, info)
 
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
+	return g.OverwritePayoutTxs(payoutTxs)
+}
 
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+func (g *GravitonStore) OverwritePayoutTxs(info *PayoutTxs) error {
+	confBytes, err := json.Marshal(info)
+	if err != nil {
+		StorageErrorLogger.Printf("[Graviton] could not marshal payouttxs info: %v", err)
+		return fmt.Errorf("[Graviton] could not marshal payouttxs info: %v", err)
 	}
 
+	ss, release := g.loadSnapshot()
+	defer release()
+
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
-	key := "config:" + config.Coin
-	tree.Put([]byte(key), []byte(confBytes)) // insert a value
+	key := "payments:txs"
+
+	tree.Put([]byte(key), confBytes)
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
 	return nil
 }
 
-func (g *GravitonStore) GetConfig(coin string) *pool.Config {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
+func (g *GravitonStore) GetPayoutTxs() *PayoutTxs {
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "payments:txs"
+	var reply *PayoutTxs
 
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[GetConfig] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[GetConfig] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+	v, _ := tree.Get([]byte(key))
+	if v != nil {
+		_ = json.Unmarshal(v, &reply)
+		if reply != nil && reply.Txs == nil {
+			reply.Txs = make(map[string]*PayoutTx)
+		}
+		return reply
 	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
 
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+	return nil
+}
+
+func (g *GravitonStore) OverwritePaymentIntents(info *PaymentIntents) error {
+	confBytes, err := json.Marshal(info)
+	if err != nil {
+		StorageErrorLogger.Printf("[Graviton] could not marshal paymentintents info: %v", err)
+		return fmt.Errorf("[Graviton] could not marshal paymentintents info: %v", err)
 	}
 
+	ss, release := g.loadSnapshot()
+	defer release()
+
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
-	key := "config:" + coin
-	var reply *pool.Config
+	key := "payments:intents"
+
+	tree.Put([]byte(key), confBytes)
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
+	}
+	return nil
+}
+
+func (g *GravitonStore) GetPaymentIntents() *PaymentIntents {
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "payments:intents"
+	var reply *PaymentIntents
 
 	v, _ := tree.Get([]byte(key))
 	if v != nil {
 		_ = json.Unmarshal(v, &reply)
+		if reply != nil && reply.Intents == nil {
+			reply.Intents = make(map[string]*PaymentIntent)
+		}
 		return reply
 	}
 
 	return nil
 }
 
-func (g *GravitonStore) WriteMinerIDRegistration(miner *Miner) error {
-	log.Printf("[Graviton] Registering miner: %v", miner.Id)
-	StorageInfoLogger.Printf("[Graviton] Registering miner: %v", miner.Id)
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[WriteMinerIDRegistration] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[WriteMinerIDRegistration] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+// Stores the settings of settings.Address, empty settings remove those of the address
+func (g *GravitonStore) WriteMinerSettings(settings *MinerSettings) error {
+	minerSettings := g.GetMinerSettings()
+	if settings.empty() {
+		delete(minerSettings, settings.Address)
+	} else {
+		minerSettings[settings.Address] = settings
 	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
 
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+	confBytes, err := json.Marshal(minerSettings)
+	if err != nil {
+		StorageErrorLogger.Printf("[Graviton] could not marshal minersettings info: %v", err)
+		return fmt.Errorf("[Graviton] could not marshal minersettings info: %v", err)
 	}
 
+	ss, release := g.loadSnapshot()
+	defer release()
+
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
-	key := "miners:registered"
-	currMinerIDs, err := tree.Get([]byte(key))
-	var minerIDs *GravitonMiners
+	key := "miners:settings"
 
-	var newMinerIDs []byte
+	tree.Put([]byte(key), confBytes)
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
+	}
+	return nil
+}
+
+// Returns the payout settings by address, empty if no miner has set any
+func (g *GravitonStore) GetMinerSettings() map[string]*MinerSettings {
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "miners:settings"
+	var reply map[string]*MinerSettings
+
+	v, _ := tree.Get([]byte(key))
+	if v != nil {
+		_ = json.Unmarshal(v, &reply)
+	}
+	if reply == nil {
+		reply = make(map[string]*MinerSettings)
+	}
+
+	return reply
+}
+
+func (g *GravitonStore) OverwriteDiffOverrides(info map[string]int64) error {
+	confBytes, err := json.Marshal(info)
+	if err != nil {
+		StorageErrorLogger.Printf("[Graviton] could not marshal diffoverrides info: %v", err)
+		return fmt.Errorf("[Graviton] could not marshal diffoverrides info: %v", err)
+	}
+
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "miners:diffoverrides"
+
+	tree.Put([]byte(key), confBytes)
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
+	}
+	return nil
+}
+
+func (g *GravitonStore) GetDiffOverrides() map[string]int64 {
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "miners:diffoverrides"
+	var reply map[string]int64
+
+	v, _ := tree.Get([]byte(key))
+	if v != nil {
+		_ = json.Unmarshal(v, &reply)
+		return reply
+	}
+
+	return nil
+}
+
+func (g *GravitonStore) OverwriteFarms(info map[string]*Farm) error {
+	confBytes, err := json.Marshal(info)
+	if err != nil {
+		StorageErrorLogger.Printf("[Graviton] could not marshal farms info: %v", err)
+		return fmt.Errorf("[Graviton] could not marshal farms info: %v", err)
+	}
+
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "farms:registered"
+
+	tree.Put([]byte(key), confBytes)
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
+	}
+	return nil
+}
+
+func (g *GravitonStore) GetFarms() map[string]*Farm {
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "farms:registered"
+	var reply map[string]*Farm
+
+	v, _ := tree.Get([]byte(key))
+	if v != nil {
+		_ = json.Unmarshal(v, &reply)
+		return reply
+	}
+
+	return nil
+}
+
+func (g *GravitonStore) OverwriteTelegramLinks(info []*TelegramLink) error {
+	confBytes, err := json.Marshal(info)
+	if err != nil {
+		StorageErrorLogger.Printf("[Graviton] could not marshal telegram links info: %v", err)
+		return fmt.Errorf("[Graviton] could not marshal telegram links info: %v", err)
+	}
+
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "telegram:links"
+
+	tree.Put([]byte(key), confBytes)
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
+	}
+	return nil
+}
+
+func (g *GravitonStore) GetTelegramLinks() []*TelegramLink {
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "telegram:links"
+	var reply []*TelegramLink
+
+	v, _ := tree.Get([]byte(key))
+	if v != nil {
+		_ = json.Unmarshal(v, &reply)
+		return reply
+	}
+
+	return nil
+}
+
+func (g *GravitonStore) OverwriteNotificationRegistrations(info map[string]*NotificationRegistration) error {
+	confBytes, err := json.Marshal(info)
+	if err != nil {
+		StorageErrorLogger.Printf("[Graviton] could not marshal notification registrations info: %v", err)
+		return fmt.Errorf("[Graviton] could not marshal notification registrations info: %v", err)
+	}
+
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "notifications:registrations"
+
+	tree.Put([]byte(key), confBytes)
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
+	}
+	return nil
+}
+
+func (g *GravitonStore) GetNotificationRegistrations() map[string]*NotificationRegistration {
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "notifications:registrations"
+	var reply map[string]*NotificationRegistration
+
+	v, _ := tree.Get([]byte(key))
+	if v != nil {
+		_ = json.Unmarshal(v, &reply)
+		return reply
+	}
+
+	return nil
+}
+
+func (g *GravitonStore) OverwriteBans(info map[string]*Ban) error {
+	confBytes, err := json.Marshal(info)
+	if err != nil {
+		StorageErrorLogger.Printf("[Graviton] could not marshal bans info: %v", err)
+		return fmt.Errorf("[Graviton] could not marshal bans info: %v", err)
+	}
+
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "banning:bans"
+
+	tree.Put([]byte(key), confBytes)
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
+	}
+	return nil
+}
+
+func (g *GravitonStore) GetBans() map[string]*Ban {
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "banning:bans"
+	var reply map[string]*Ban
+
+	v, _ := tree.Get([]byte(key))
+	if v != nil {
+		_ = json.Unmarshal(v, &reply)
+		return reply
+	}
+
+	return nil
+}
+
+func join(args ...interface{}) string {
+	s := make([]string, len(args))
+	for i, v := range args {
+		switch v.(type) {
+		case string:
+			s[i] = v.(string)
+		case int64:
+			s[i] = strconv.FormatInt(v.(int64), 10)
+		case uint64:
+			s[i] = strconv.FormatUint(v.(uint64), 10)
+		case float64:
+			s[i] = strconv.FormatFloat(v.(float64), 'f', 0, 64)
+		case bool:
+			if v.(bool) {
+				s[i] = "1"
+			} else {
+				s[i] = "0"
+			}
+		case *big.Int:
+			n := v.(*big.Int)
+			if n != nil {
+				s[i] = n.String()
+			} else {
+				s[i] = "0"
+			}
+		default:
+			panic("Invalid type specified for conversion")
+		}
+	}
+	return strings.Join(s, ":")
+}
+
+func (blockDataGrav *BlockDataGrav) RoundKey() string {
+	return join(blockDataGrav.RoundHeight, blockDataGrav.Hash)
+}
+
+func (g *GravitonStore) WriteConfig(config *pool.Config) error {
+	confBytes, err := json.Marshal(config)
+	if err != nil {
+		StorageErrorLogger.Printf("[Graviton] could not marshal pool.Config info: %v", err)
+		return fmt.Errorf("[Graviton] could not marshal pool.Config info: %v", err)
+	}
+
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "config:" + config.Coin
+	tree.Put([]byte(key), []byte(confBytes)) // insert a value
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
+	}
+	return nil
+}
+
+func (g *GravitonStore) GetConfig(coin string) *pool.Config {
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "config:" + coin
+	var reply *pool.Config
+
+	v, _ := tree.Get([]byte(key))
+	if v != nil {
+		_ = json.Unmarshal(v, &reply)
+		return reply
+	}
+
+	return nil
+}
+
+func (g *GravitonStore) WriteMinerIDRegistration(miner *Miner) error {
+	StorageInfoLogger.Printf("[Graviton] Registering miner: %v", miner.Id)
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "miners:registered"
+	currMinerIDs, err := tree.Get([]byte(key))
+	var minerIDs *GravitonMiners
+
+	var newMinerIDs []byte
 
 	if err != nil {
 		// Returns key not found if != nil, or other err, but assuming keynotfound/leafnotfound
@@ -1030,7 +1421,6 @@ func (g *GravitonStore) WriteMinerIDRegistration(miner *Miner) error {
 
 		for _, value := range minerIDs.Miners {
 			if value.Id == miner.Id {
-				log.Printf("[Graviton] Miner already registered: %v", miner.Id)
 				StorageInfoLogger.Printf("[Graviton] Miner already registered: %v", miner.Id)
 				return nil
 			}
@@ -1057,30 +1447,14 @@ func (g *GravitonStore) WriteMinerIDRegistration(miner *Miner) error {
 	tree.Put([]byte(key), newMinerIDs)
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
 	return nil
 }
 
 func (g *GravitonStore) GetMinerIDRegistrations() []*Miner {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[GetMinerIDRegistrations] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[GetMinerIDRegistrations] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "miners:registered"
@@ -1114,6 +1488,16 @@ func (g *GravitonStore) CompareMinerStats(storedMiner, miner *Miner, hashrateExp
 				updatedMiner.Unlock()
 			}
 
+			// Sync last share time, so that it survives restarts until the miner submits a new share
+			if atomic.LoadInt64(&storedMiner.LastShare) > atomic.LoadInt64(&updatedMiner.LastShare) {
+				atomic.StoreInt64(&updatedMiner.LastShare, atomic.LoadInt64(&storedMiner.LastShare))
+			}
+
+			// Sync last session difficulty, so that it survives restarts until the miner logs in again
+			if atomic.LoadInt64(&updatedMiner.LastDifficulty) == 0 {
+				atomic.StoreInt64(&updatedMiner.LastDifficulty, atomic.LoadInt64(&storedMiner.LastDifficulty))
+			}
+
 			// Sync accepts for all-time stats
 			if atomic.LoadInt64(&storedMiner.Accepts) >= atomic.LoadInt64(&updatedMiner.Accepts) {
 				diff := atomic.LoadInt64(&storedMiner.Accepts) - atomic.LoadInt64(&updatedMiner.Accepts)
@@ -1125,6 +1509,16 @@ func (g *GravitonStore) CompareMinerStats(storedMiner, miner *Miner, hashrateExp
 				updatedMiner.Unlock()
 			}
 
+			// Sync expected blocks for withholding detection
+			storedMiner.RLock()
+			storedExpected := storedMiner.ExpectedBlocks
+			storedMiner.RUnlock()
+			updatedMiner.Lock()
+			if storedExpected > updatedMiner.ExpectedBlocks {
+				updatedMiner.ExpectedBlocks = storedExpected
+			}
+			updatedMiner.Unlock()
+
 			// Sync rejects for all-time stats
 			if atomic.LoadInt64(&storedMiner.Rejects) >= atomic.LoadInt64(&updatedMiner.Rejects) {
 				diff := atomic.LoadInt64(&storedMiner.Rejects) - atomic.LoadInt64(&updatedMiner.Rejects)
@@ -1152,24 +1546,13 @@ func (g *GravitonStore) WriteMinerStats(miners MinersMap, hashrateExpiration tim
 	var err error
 	var Commit bool
 	storedMinerSlice := g.GetAllMinerStats()
-
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[WriteMinerStats] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[WriteMinerStats] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+	var registeredMiners []*Miner
+	if storedMinerSlice == nil {
+		registeredMiners = g.GetMinerIDRegistrations()
 	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
 
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 
@@ -1177,6 +1560,10 @@ func (g *GravitonStore) WriteMinerStats(miners MinersMap, hashrateExpiration tim
 	if storedMinerSlice != nil {
 		for _, storedMiner := range storedMinerSlice {
 			currMiner, _ := miners.Get(storedMiner.Id)
+			// Evicted miners stay in storage until they log in again
+			if currMiner == nil && storedMiner.EvictedAt > 0 {
+				continue
+			}
 			updatedMiner, changes := g.CompareMinerStats(storedMiner, currMiner, hashrateExpiration)
 
 			// Set the mmap object of the updated miner
@@ -1200,8 +1587,6 @@ func (g *GravitonStore) WriteMinerStats(miners MinersMap, hashrateExpiration tim
 			}
 		}
 	} else {
-		registeredMiners := g.GetMinerIDRegistrations()
-
 		for _, value := range registeredMiners {
 			currMiner, _ := miners.Get(value.Id)
 
@@ -1220,7 +1605,6 @@ func (g *GravitonStore) WriteMinerStats(miners MinersMap, hashrateExpiration tim
 	if Commit {
 		_, cerr := graviton.Commit(tree)
 		if cerr != nil {
-			log.Printf("[Graviton] ERROR: %v", cerr)
 			StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 		}
 	}
@@ -1239,157 +1623,416 @@ func (g *GravitonStore) WriteMinerStatsByID(miner *Miner, hashrateExpiration tim
 		return fmt.Errorf("[Graviton] could not marshal updated miner info: %v", err)
 	}
 
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "miners:stats:" + updatedMiner.Id
+	tree.Put([]byte(key), []byte(confBytes)) // insert a value
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
+	}
+	return nil
+}
+
+func (g *GravitonStore) GetAllMinerStats() []*Miner {
+	var allMiners []*Miner
+	registeredMiners := g.GetMinerIDRegistrations()
+
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+
+	for _, value := range registeredMiners {
+		key := "miners:stats:" + value.Id
+		var reply *Miner
+
+		v, _ := tree.Get([]byte(key))
+
+		if v != nil {
+			_ = json.Unmarshal(v, &reply)
+			allMiners = append(allMiners, reply)
+		}
+	}
+
+	if allMiners != nil {
+		return allMiners
+	}
+
+	return nil
+}
+
+func (g *GravitonStore) GetMinerStatsByID(minerID string) *Miner {
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "miners:stats:" + minerID
+
+	var reply *Miner
+
+	v, _ := tree.Get([]byte(key))
+	if v != nil {
+		_ = json.Unmarshal(v, &reply)
+		return reply
+	}
+
+	return nil
+}
+
+func (g *GravitonStore) GetRoundShares(roundHeight int64) (map[string]int64, int64, error) {
+
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "miners:round:" + strconv.FormatInt(roundHeight, 10)
+
+	var result map[string]int64
+	var totalRoundShares int64
+
+	v, _ := tree.Get([]byte(key))
+	if v != nil {
+		_ = json.Unmarshal(v, &result)
+	}
+
+	for _, value := range result {
+		totalRoundShares += value
+	}
+
+	return result, totalRoundShares, nil
+}
+
+// Stores the fee weights of the round shares of the pool block at roundHeight
+func (g *GravitonStore) WriteRoundFees(roundHeight int64, roundFees map[string]float64) error {
+	confBytes, err := json.Marshal(roundFees)
+	if err != nil {
+		StorageErrorLogger.Printf("[Graviton] could not marshal roundFees info: %v", err)
+		return fmt.Errorf("[Graviton] could not marshal roundFees info: %v", err)
+	}
+
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "miners:roundfees:" + strconv.FormatInt(roundHeight, 10)
+	tree.Put([]byte(key), []byte(confBytes)) // insert a value
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
+	}
+	return nil
+}
+
+// Returns the fee weights stored for the round shares of the pool block at roundHeight. ok is false if none were stored, i.e. the round started before per port fees
+func (g *GravitonStore) GetRoundFees(roundHeight int64) (map[string]float64, bool) {
+
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "miners:roundfees:" + strconv.FormatInt(roundHeight, 10)
+
+	var result map[string]float64
+
+	v, _ := tree.Get([]byte(key))
+	if v == nil {
+		return nil, false
+	}
+	_ = json.Unmarshal(v, &result)
+
+	return result, result != nil
+}
+
+// Stores the PPLNS window a pool block at roundHeight is paid over
+func (g *GravitonStore) WritePPLNSRoundShares(roundHeight int64, roundShares map[string]int64) error {
+	confBytes, err := json.Marshal(roundShares)
+	if err != nil {
+		StorageErrorLogger.Printf("[Graviton] could not marshal pplns roundShares info: %v", err)
+		return fmt.Errorf("[Graviton] could not marshal pplns roundShares info: %v", err)
+	}
+
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "pplns:round:" + strconv.FormatInt(roundHeight, 10)
+	StorageInfoLogger.Printf("[Graviton-WritePPLNSRoundShares] Storing %v with values: %v", key, roundShares)
+	tree.Put([]byte(key), []byte(confBytes)) // insert a value
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
+	}
+	return nil
+}
+
+// Returns the PPLNS window stored for the pool block at roundHeight. ok is false if none was stored, i.e. the block was found while the proportional scheme was in use
+func (g *GravitonStore) GetPPLNSRoundShares(roundHeight int64) (map[string]int64, int64, bool) {
+
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "pplns:round:" + strconv.FormatInt(roundHeight, 10)
+
+	var result map[string]int64
+	var totalRoundShares int64
+
+	v, _ := tree.Get([]byte(key))
+	if v == nil {
+		return nil, 0, false
+	}
+	_ = json.Unmarshal(v, &result)
 
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[WriteMinerStatsByID] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[WriteMinerStatsByID] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+	for _, value := range result {
+		totalRoundShares += value
 	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
 
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+	return result, totalRoundShares, true
+}
+
+// Stores the fee weights of the PPLNS window a pool block at roundHeight is paid over
+func (g *GravitonStore) WritePPLNSRoundFees(roundHeight int64, roundFees map[string]float64) error {
+	confBytes, err := json.Marshal(roundFees)
+	if err != nil {
+		StorageErrorLogger.Printf("[Graviton] could not marshal roundFees info: %v", err)
+		return fmt.Errorf("[Graviton] could not marshal roundFees info: %v", err)
 	}
 
+	ss, release := g.loadSnapshot()
+	defer release()
+
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
-	key := "miners:stats:" + updatedMiner.Id
+	key := "pplns:roundfees:" + strconv.FormatInt(roundHeight, 10)
 	tree.Put([]byte(key), []byte(confBytes)) // insert a value
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
 	return nil
 }
 
-func (g *GravitonStore) GetAllMinerStats() []*Miner {
-	var allMiners []*Miner
-	registeredMiners := g.GetMinerIDRegistrations()
+// Returns the fee weights stored for the PPLNS window of the pool block at roundHeight. ok is false if none were stored
+func (g *GravitonStore) GetPPLNSRoundFees(roundHeight int64) (map[string]float64, bool) {
 
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
+	ss, release := g.loadSnapshot()
+	defer release()
 
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[GetAllMinerStats] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[GetAllMinerStats] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "pplns:roundfees:" + strconv.FormatInt(roundHeight, 10)
 
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+	var result map[string]float64
+
+	v, _ := tree.Get([]byte(key))
+	if v == nil {
+		return nil, false
 	}
+	_ = json.Unmarshal(v, &result)
 
-	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	return result, result != nil
+}
 
-	for _, value := range registeredMiners {
-		key := "miners:stats:" + value.Id
-		var reply *Miner
+// Removes the round shares and fees [pool and pplns] of the round heights within one commit
+func (g *GravitonStore) RemoveRounds(roundHeights []int64) error {
+	ss, release := g.loadSnapshot()
+	defer release()
 
-		v, _ := tree.Get([]byte(key))
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 
-		if v != nil {
-			_ = json.Unmarshal(v, &reply)
-			allMiners = append(allMiners, reply)
+	for _, roundHeight := range roundHeights {
+		height := strconv.FormatInt(roundHeight, 10)
+		for _, key := range []string{"miners:round:" + height, "miners:roundfees:" + height, "pplns:round:" + height, "pplns:roundfees:" + height} {
+			if v, _ := tree.Get([]byte(key)); v == nil {
+				continue
+			}
+			if err := tree.Delete([]byte(key)); err != nil {
+				StorageErrorLogger.Printf("[Graviton] Error removing %v: %v", key, err)
+				return err
+			}
 		}
 	}
 
-	if allMiners != nil {
-		return allMiners
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
-
 	return nil
 }
 
-func (g *GravitonStore) GetMinerStatsByID(minerID string) *Miner {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[GetMinerStatsByID] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[GetMinerStatsByID] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+func (g *GravitonStore) WritePPLNSWindow(shares []*PPLNSShare) error {
+	confBytes, err := json.Marshal(shares)
+	if err != nil {
+		StorageErrorLogger.Printf("[Graviton] could not marshal pplns window info: %v", err)
+		return fmt.Errorf("[Graviton] could not marshal pplns window info: %v", err)
 	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
 
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+	key := "pplns:window"
+	tree.Put([]byte(key), []byte(confBytes)) // insert a value
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
+	return nil
+}
+
+func (g *GravitonStore) GetPPLNSWindow() []*PPLNSShare {
+
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
-	key := "miners:stats:" + minerID
+	key := "pplns:window"
 
-	var reply *Miner
+	var result []*PPLNSShare
 
 	v, _ := tree.Get([]byte(key))
 	if v != nil {
-		_ = json.Unmarshal(v, &reply)
-		return reply
+		_ = json.Unmarshal(v, &result)
 	}
 
-	return nil
+	return result
 }
 
-func (g *GravitonStore) GetRoundShares(roundHeight int64) (map[string]int64, int64, error) {
+func (g *GravitonStore) UpdatePoolRoundStats(miners MinersMap, blockFound bool) error {
+	return g.updatePoolRoundStats(g, miners, blockFound)
+}
 
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
+// Adds the shares of miners to the current round stored in rounds, rolling over to the next round once a pool block was found. Blocks and miner stats are always read from g.
+// The shares added are those after roundWatermark, the last shares this process added, so with several processes sharing rounds the shares a process accepted before
+// another one stored the round are not skipped. The update is atomic against the other processes
+func (g *GravitonStore) updatePoolRoundStats(rounds Storage, miners MinersMap, blockFound bool) error {
+	storedMinerSlice := g.GetAllMinerStats()
+	var nextRound bool
+	var watermark int64
+	err := rounds.UpdatePoolRound(func(poolRoundStats *PoolRound) (*PoolRound, error) {
+		currentPoolRoundStats := &PoolRound{StartTimestamp: int64(0), Timestamp: int64(0), RoundShares: make(map[string]int64), RoundFees: make(map[string]float64), LastBlockHeight: int64(0)}
+		referenceBlock := g.lastPoolBlock()
+
+		now := (time.Now().UnixNano() / int64(time.Millisecond)) / 1000
+
+		// We need to define StartTimestamp and Timestamp
+		nextRound = false
+		if poolRoundStats != nil {
+			if referenceBlock != nil {
+				if poolRoundStats.StartTimestamp < referenceBlock.Timestamp || poolRoundStats.LastBlockHeight < referenceBlock.Height || blockFound {
+					nextRound = true
+					currentPoolRoundStats.StartTimestamp = poolRoundStats.Timestamp
+					currentPoolRoundStats.Timestamp = referenceBlock.Timestamp
+					currentPoolRoundStats.RoundShares = poolRoundStats.RoundShares
+					currentPoolRoundStats.RoundFees = poolRoundStats.RoundFees
+					currentPoolRoundStats.LastBlockHeight = referenceBlock.Height
+				} else {
+					currentPoolRoundStats.StartTimestamp = poolRoundStats.Timestamp
+					currentPoolRoundStats.Timestamp = now
+					currentPoolRoundStats.RoundShares = poolRoundStats.RoundShares
+					currentPoolRoundStats.RoundFees = poolRoundStats.RoundFees
+					currentPoolRoundStats.LastBlockHeight = poolRoundStats.LastBlockHeight
+				}
+			} else {
+				currentPoolRoundStats.StartTimestamp = poolRoundStats.Timestamp
+				currentPoolRoundStats.Timestamp = now
+				currentPoolRoundStats.RoundShares = poolRoundStats.RoundShares
+				currentPoolRoundStats.RoundFees = poolRoundStats.RoundFees
+			}
+			if currentPoolRoundStats.RoundShares == nil {
+				currentPoolRoundStats.RoundShares = make(map[string]int64)
+			}
+			// Fees are only tracked for rounds started with fee tracking, a round started before keeps being charged the unlocker poolFee as a whole
+			if currentPoolRoundStats.RoundFees == nil && len(currentPoolRoundStats.RoundShares) == 0 {
+				currentPoolRoundStats.RoundFees = make(map[string]float64)
+			}
+		} else {
+			if referenceBlock != nil {
+				currentPoolRoundStats.StartTimestamp = referenceBlock.Timestamp
+				currentPoolRoundStats.Timestamp = now
+				currentPoolRoundStats.RoundShares = make(map[string]int64)
+				currentPoolRoundStats.LastBlockHeight = referenceBlock.Height
+			} else {
+				currentPoolRoundStats.StartTimestamp = 0
+				currentPoolRoundStats.Timestamp = now
+				currentPoolRoundStats.RoundShares = make(map[string]int64)
+			}
+		}
 
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[GetRoundShares] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[GetRoundShares] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
+		// Edge catch for if blockFound is defined (from miner.go after finding a block) and nextRound some reason isn't set to true, set it to true
+		if blockFound && !nextRound && referenceBlock != nil {
+			nextRound = true
+		}
 
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+		// Another process may have stored the round since this one last added its shares
+		from := currentPoolRoundStats.StartTimestamp
+		if g.roundWatermark > 0 && g.roundWatermark < from {
+			from = g.roundWatermark
+		}
 
-	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
-	key := "miners:round:" + strconv.FormatInt(roundHeight, 10)
+		// If storedMinerMap is empty, no round stats to add
+		if storedMinerSlice != nil {
+			for _, storedMiner := range storedMinerSlice {
+				currMiner, ok := miners.Get(storedMiner.Id)
+
+				if ok && !currMiner.IsSolo {
+					currMiner.RLock()
+					for k, v := range currMiner.Shares {
+						if k > from && k <= currentPoolRoundStats.Timestamp {
+							currentPoolRoundStats.RoundShares[storedMiner.Id] += v
+							if currentPoolRoundStats.RoundFees != nil {
+								currentPoolRoundStats.RoundFees[storedMiner.Id] += currMiner.fees[k]
+							}
+						}
+					}
+					currMiner.RUnlock()
+				} else {
+					//StorageInfoLogger.Printf("[UpdatePoolRoundStats] No active miner under %v, no need to update roundshares from this miner.", storedMiner.Id)
+				}
+			}
+		}
 
-	var result map[string]int64
-	var totalRoundShares int64
+		if nextRound {
+			// If nextRound is triggered, we clear the stored pool stats and then we store nextRound details
+			StorageInfoLogger.Printf("[UpdatePoolRoundStats] Starting next round...")
+			StorageInfoLogger.Printf("[UpdatePoolRoundStats] Storing previous round: RoundShares (%v) , Height (%v)", currentPoolRoundStats.RoundShares, referenceBlock.Height)
 
-	v, _ := tree.Get([]byte(key))
-	if v != nil {
-		_ = json.Unmarshal(v, &result)
-	}
+			rounds.WriteRoundShares(referenceBlock.Height, currentPoolRoundStats.RoundShares)
+			if currentPoolRoundStats.RoundFees != nil {
+				rounds.WriteRoundFees(referenceBlock.Height, currentPoolRoundStats.RoundFees)
+			}
 
-	for _, value := range result {
-		totalRoundShares += value
+			StorageInfoLogger.Printf("[UpdatePoolRoundStats] Clearing out stored values and storing clean roundshares object")
+			currentPoolRoundStats.StartTimestamp = referenceBlock.Timestamp
+			currentPoolRoundStats.Timestamp = referenceBlock.Timestamp
+			currentPoolRoundStats.RoundShares = make(map[string]int64)
+			currentPoolRoundStats.RoundFees = make(map[string]float64)
+		}
+
+		watermark = currentPoolRoundStats.Timestamp
+		return currentPoolRoundStats, nil
+	})
+	if err != nil {
+		StorageErrorLogger.Printf("[UpdatePoolRoundStats] Err on overwriting pool stats: %v", err)
+	} else {
+		g.roundWatermark = watermark
+		if nextRound {
+			StorageInfoLogger.Printf("[UpdatePoolRoundStats] Updated pool round stats for next round.")
+		} else {
+			//StorageInfoLogger.Printf("[UpdatePoolRoundStats] Updated pool round stats.")
+		}
 	}
 
-	return result, totalRoundShares, nil
+	return nil
 }
 
-func (g *GravitonStore) UpdatePoolRoundStats(miners MinersMap, blockFound bool) error {
-	storedMinerSlice := g.GetAllMinerStats()
-	poolRoundStats := g.GetPoolRoundStats()
+// Returns the most recent pool [non-solo] block found, nil if none
+func (g *GravitonStore) lastPoolBlock() *BlockDataGrav {
 	candidatePoolBlocksFound := g.GetBlocksFound("candidate")
 	immaturePoolBlocksFound := g.GetBlocksFound("immature")
 	maturePoolBlocksFound := g.GetBlocksFound("matured")
 
-	currentPoolRoundStats := &PoolRound{StartTimestamp: int64(0), Timestamp: int64(0), RoundShares: make(map[string]int64), LastBlockHeight: int64(0)}
 	var referenceBlock *BlockDataGrav
 
 	// Create slice of heights that do not include solo blocks. This will be used to compare the last block found against miner heights below
@@ -1438,96 +2081,7 @@ func (g *GravitonStore) UpdatePoolRoundStats(miners MinersMap, blockFound bool)
 		}
 	}
 
-	now := (time.Now().UnixNano() / int64(time.Millisecond)) / 1000
-
-	// We need to define StartTimestamp and Timestamp
-	var nextRound bool
-	if poolRoundStats != nil {
-		if referenceBlock != nil {
-			if poolRoundStats.StartTimestamp < referenceBlock.Timestamp || poolRoundStats.LastBlockHeight < referenceBlock.Height || blockFound {
-				nextRound = true
-				currentPoolRoundStats.StartTimestamp = poolRoundStats.Timestamp
-				currentPoolRoundStats.Timestamp = referenceBlock.Timestamp
-				currentPoolRoundStats.RoundShares = poolRoundStats.RoundShares
-				currentPoolRoundStats.LastBlockHeight = referenceBlock.Height
-			} else {
-				currentPoolRoundStats.StartTimestamp = poolRoundStats.Timestamp
-				currentPoolRoundStats.Timestamp = now
-				currentPoolRoundStats.RoundShares = poolRoundStats.RoundShares
-				currentPoolRoundStats.LastBlockHeight = poolRoundStats.LastBlockHeight
-			}
-		} else {
-			currentPoolRoundStats.StartTimestamp = poolRoundStats.Timestamp
-			currentPoolRoundStats.Timestamp = now
-			currentPoolRoundStats.RoundShares = poolRoundStats.RoundShares
-		}
-	} else {
-		if referenceBlock != nil {
-			currentPoolRoundStats.StartTimestamp = referenceBlock.Timestamp
-			currentPoolRoundStats.Timestamp = now
-			currentPoolRoundStats.RoundShares = make(map[string]int64)
-			currentPoolRoundStats.LastBlockHeight = referenceBlock.Height
-		} else {
-			currentPoolRoundStats.StartTimestamp = 0
-			currentPoolRoundStats.Timestamp = now
-			currentPoolRoundStats.RoundShares = make(map[string]int64)
-		}
-	}
-
-	// Edge catch for if blockFound is defined (from miner.go after finding a block) and nextRound some reason isn't set to true, set it to true
-	if blockFound && !nextRound && referenceBlock != nil {
-		nextRound = true
-	}
-
-	// If storedMinerMap is empty, no round stats to add
-	if storedMinerSlice != nil {
-		for _, storedMiner := range storedMinerSlice {
-			currMiner, ok := miners.Get(storedMiner.Id)
-
-			if ok && !currMiner.IsSolo {
-				for k, v := range currMiner.Shares {
-					if k > currentPoolRoundStats.StartTimestamp && k <= currentPoolRoundStats.Timestamp {
-						currentPoolRoundStats.RoundShares[storedMiner.Id] += v
-					}
-				}
-			} else {
-				//log.Printf("[UpdatePoolRoundStats] No active miner under %v, no need to update roundshares from this miner.", storedMiner.Id)
-				//StorageInfoLogger.Printf("[UpdatePoolRoundStats] No active miner under %v, no need to update roundshares from this miner.", storedMiner.Id)
-			}
-		}
-	}
-
-	if nextRound {
-		// If nextRound is triggered, we clear the stored pool stats and then we store nextRound details
-		log.Printf("[UpdatePoolRoundStats] Starting next round...")
-		StorageInfoLogger.Printf("[UpdatePoolRoundStats] Starting next round...")
-		log.Printf("[UpdatePoolRoundStats] Storing previous round: RoundShares (%v) , Height (%v)", currentPoolRoundStats.RoundShares, referenceBlock.Height)
-		StorageInfoLogger.Printf("[UpdatePoolRoundStats] Storing previous round: RoundShares (%v) , Height (%v)", currentPoolRoundStats.RoundShares, referenceBlock.Height)
-
-		g.WriteRoundShares(referenceBlock.Height, currentPoolRoundStats.RoundShares)
-
-		log.Printf("[UpdatePoolRoundStats] Clearing out stored values and storing clean roundshares object")
-		StorageInfoLogger.Printf("[UpdatePoolRoundStats] Clearing out stored values and storing clean roundshares object")
-		currentPoolRoundStats.StartTimestamp = referenceBlock.Timestamp
-		currentPoolRoundStats.Timestamp = referenceBlock.Timestamp
-		currentPoolRoundStats.RoundShares = make(map[string]int64)
-	}
-
-	err := g.OverwritePoolRoundStats(currentPoolRoundStats)
-	if err != nil {
-		log.Printf("[UpdatePoolRoundStats] Err on overwriting pool stats: %v", err)
-		StorageErrorLogger.Printf("[UpdatePoolRoundStats] Err on overwriting pool stats: %v", err)
-	} else {
-		if nextRound {
-			log.Printf("[UpdatePoolRoundStats] Updated pool round stats for next round.")
-			StorageInfoLogger.Printf("[UpdatePoolRoundStats] Updated pool round stats for next round.")
-		} else {
-			//log.Printf("[UpdatePoolRoundStats] Updated pool round stats.")
-			//StorageInfoLogger.Printf("[UpdatePoolRoundStats] Updated pool round stats.")
-		}
-	}
-
-	return nil
+	return referenceBlock
 }
 
 // This function is to overwrite pool round stats which will retain *current* pool round details and updated to blank out at each new round / nextRound storage function
@@ -1538,23 +2092,8 @@ func (g *GravitonStore) OverwritePoolRoundStats(info *PoolRound) error {
 		return fmt.Errorf("[Graviton] could not marshal pendingpayments info: %v", err)
 	}
 
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[OverwritePoolRoundStats] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[OverwritePoolRoundStats] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "pool:currentround"
@@ -1562,30 +2101,23 @@ func (g *GravitonStore) OverwritePoolRoundStats(info *PoolRound) error {
 	tree.Put([]byte(key), confBytes)
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
 	return nil
 }
 
-func (g *GravitonStore) GetPoolRoundStats() *PoolRound {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[GetPoolRoundStats] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[GetPoolRoundStats] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+// Graviton is written by a single process, the caller holds the Writing flag
+func (g *GravitonStore) UpdatePoolRound(modify func(round *PoolRound) (*PoolRound, error)) error {
+	round, err := modify(g.GetPoolRoundStats())
+	if err != nil {
+		return err
 	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
+	return g.OverwritePoolRoundStats(round)
+}
 
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+func (g *GravitonStore) GetPoolRoundStats() *PoolRound {
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "pool:currentround"
@@ -1607,132 +2139,79 @@ func (g *GravitonStore) WriteRoundShares(roundHeight int64, roundShares map[stri
 		return fmt.Errorf("[Graviton] could not marshal roundShares info: %v", err)
 	}
 
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[WriteRoundShares] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[WriteRoundShares] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "miners:round:" + strconv.FormatInt(roundHeight, 10)
-	log.Printf("[Graviton-WriteRoundShares] Storing %v with values: %v", key, roundShares)
 	StorageInfoLogger.Printf("[Graviton-WriteRoundShares] Storing %v with values: %v", key, roundShares)
 	tree.Put([]byte(key), []byte(confBytes)) // insert a value
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
 	return nil
 }
 
-func (g *GravitonStore) WriteChartsData(data *ChartData, chartType string, interval, maximumPeriod int64) error {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
+func (g *GravitonStore) WriteChartsData(data *ChartData, chartType string, maximumPeriod int64, retention []pool.ChartRetention) error {
+	return g.writeCharts(map[string]*ChartData{chartType: data}, maximumPeriod, retention)
+}
 
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[WriteChartsData] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[WriteChartsData] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
+// Adds a value to the chart of each miner address, within one commit
+func (g *GravitonStore) WriteMinerChartsData(data map[string]*ChartData, maximumPeriod int64, retention []pool.ChartRetention) error {
+	charts := make(map[string]*ChartData)
+	for address, value := range data {
+		charts["minerhashrate:"+address] = value
 	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
+	return g.writeCharts(charts, maximumPeriod, retention)
+}
 
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+func (g *GravitonStore) writeCharts(data map[string]*ChartData, maximumPeriod int64, retention []pool.ChartRetention) error {
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	chartWait, _ := time.ParseDuration("100ms")
 	time.Sleep(chartWait)
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
-	key := "charts:" + chartType
-	currCharts, err := tree.Get([]byte(key))
-	var charts *GravitonCharts
+	var changed bool
+	for chartType, value := range data {
+		key := "charts:" + chartType
+		charts := &GravitonCharts{}
 
-	var newChartData []byte
-
-	if err != nil {
 		// Returns key not found if != nil, or other err, but assuming keynotfound/leafnotfound
-		var chartArr []*ChartData
-		chartArr = append(chartArr, data)
-		charts = &GravitonCharts{Values: chartArr}
-	} else {
-		// Retrieve value and convert to charts, so that you can manipulate and update db
-		_ = json.Unmarshal(currCharts, &charts)
-
-		for _, value := range charts.Values {
-			if value.Timestamp == data.Timestamp {
-				log.Printf("[Graviton] Chart timestamp already registered: %v", data.Timestamp)
-				//StorageInfoLogger.Printf("[Graviton] Miner already registered: %v", miner.Id)
-				return nil
-			}
+		if currCharts, err := tree.Get([]byte(key)); err == nil {
+			// Retrieve value and convert to charts, so that you can manipulate and update db
+			_ = json.Unmarshal(currCharts, charts)
 		}
 
-		charts.Values = append(charts.Values, data)
-
-		// Sort charts so most recent is index 0 [if preferred reverse, just swap > with <]
-		sort.SliceStable(charts.Values, func(i, j int) bool {
-			return charts.Values[i].Timestamp > charts.Values[j].Timestamp
-		})
-
-		// Trim off the end if .Values has more than defined maximumPeriod of chart data
-		maxNumValues := maximumPeriod / interval
+		if !charts.add(value, maximumPeriod, retention) {
+			StorageInfoLogger.Printf("[Graviton] Chart %v timestamp already registered: %v", chartType, value.Timestamp)
+			continue
+		}
 
-		if int64(len(charts.Values)) >= maxNumValues {
-			// Truncate slice to be to maxNumValues
-			charts.Values = charts.Values[:maxNumValues]
+		newChartData, err := json.Marshal(charts)
+		if err != nil {
+			StorageErrorLogger.Printf("[Graviton] could not marshal charts info: %v", err)
+			return fmt.Errorf("[Graviton] could not marshal charts info: %v", err)
 		}
+		tree.Put([]byte(key), newChartData)
+		changed = true
 	}
 
-	newChartData, err = json.Marshal(charts)
-	if err != nil {
-		StorageErrorLogger.Printf("[Graviton] could not marshal charts info: %v", err)
-		return fmt.Errorf("[Graviton] could not marshal charts info: %v", err)
+	if !changed {
+		return nil
 	}
-
-	tree.Put([]byte(key), newChartData)
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
 	return nil
 }
 
 func (g *GravitonStore) GetChartsData(chartType string) *GravitonCharts {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[GetChartsData] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[GetChartsData] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "charts:" + chartType
@@ -1747,6 +2226,42 @@ func (g *GravitonStore) GetChartsData(chartType string) *GravitonCharts {
 	return result
 }
 
+// Removes the hashrate charts of miner addresses without a value since before cutoff, so charts of miners long gone do not pile up. Returns the number of charts removed
+func (g *GravitonStore) RemoveMinerCharts(cutoff int64) (int, error) {
+	ss, release := g.loadSnapshot()
+	defer release()
+
+	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
+
+	var stale [][]byte
+	c := tree.Cursor()
+	for k, v, err := c.First(); err == nil; k, v, err = c.Next() {
+		if !strings.HasPrefix(string(k), "charts:minerhashrate:") {
+			continue
+		}
+		charts := &GravitonCharts{}
+		_ = json.Unmarshal(v, charts)
+		if values := charts.series(0, 0); len(values) == 0 || values[0].Timestamp < cutoff {
+			stale = append(stale, k)
+		}
+	}
+	if len(stale) == 0 {
+		return 0, nil
+	}
+
+	for _, k := range stale {
+		if err := tree.Delete(k); err != nil {
+			StorageErrorLogger.Printf("[Graviton] Error removing %s: %v", k, err)
+			return 0, err
+		}
+	}
+	_, cerr := graviton.Commit(tree)
+	if cerr != nil {
+		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
+	}
+	return len(stale), nil
+}
+
 // This function is to overwrite events data
 func (g *GravitonStore) OverwriteEventsData(info map[string]*Miner, date string) error {
 	confBytes, err := json.Marshal(info)
@@ -1755,23 +2270,8 @@ func (g *GravitonStore) OverwriteEventsData(info map[string]*Miner, date string)
 		return fmt.Errorf("[Graviton] could not marshal eventsdata info: %v", err)
 	}
 
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[OverwriteEventsData] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[OverwriteEventsData] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "events:" + date
@@ -1779,30 +2279,14 @@ func (g *GravitonStore) OverwriteEventsData(info map[string]*Miner, date string)
 	tree.Put([]byte(key), confBytes)
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
 	return nil
 }
 
 func (g *GravitonStore) GetEventsData(date string) map[string]*Miner {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[GetEventsData] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[GetEventsData] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "events:" + date
@@ -1824,23 +2308,8 @@ func (g *GravitonStore) WriteEventsPayment(payment *PaymentPending, date string)
 		return fmt.Errorf("[Graviton] could not marshal eventsdata info: %v", err)
 	}
 
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[WriteEventsPayment] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[WriteEventsPayment] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "eventspayment:" + date
@@ -1848,30 +2317,14 @@ func (g *GravitonStore) WriteEventsPayment(payment *PaymentPending, date string)
 	tree.Put([]byte(key), confBytes)
 	_, cerr := graviton.Commit(tree)
 	if cerr != nil {
-		log.Printf("[Graviton] ERROR: %v", cerr)
 		StorageErrorLogger.Printf("[Graviton] ERROR: %v", cerr)
 	}
 	return nil
 }
 
 func (g *GravitonStore) GetEventsPayment(date string) *PaymentPending {
-	store := g.DB
-	ss, _ := store.LoadSnapshot(0) // load most recent snapshot
-
-	// Swap DB at g.DBMaxSnapshot+ commits. Check for g.migrating, if so sleep for g.DBMigrateWait ms
-	for g.migrating == 1 {
-		log.Printf("[GetEventsData] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		StorageInfoLogger.Printf("[GetEventsData] G is migrating... sleeping for %v...", g.DBMigrateWait)
-		time.Sleep(g.DBMigrateWait)
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
-	if ss.GetVersion() >= g.DBMaxSnapshot {
-		Graviton_backend.SwapGravDB(Graviton_backend.DBTree, Graviton_backend.DBFolder)
-
-		store = g.DB
-		ss, _ = store.LoadSnapshot(0) // load most recent snapshot
-	}
+	ss, release := g.loadSnapshot()
+	defer release()
 
 	tree, _ := ss.GetTree(g.DBTree) // use or create tree named by poolhost in config
 	key := "eventspayment:" + date
@@ -1886,13 +2339,8 @@ func (g *GravitonStore) GetEventsPayment(date string) *PaymentPending {
 	return result
 }
 
-func logFileOutStorage(lType string) *log.Logger {
-	var logFileName string
-	if lType == "ERROR" {
-		logFileName = "logs/storageError.log"
-	} else {
-		logFileName = "logs/storage.log"
-	}
+func logFileOutStorage(lType string) *util.Logger {
+	logFileName := util.LogFileName("storage", lType)
 	os.Mkdir("logs", 0705)
 	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0705)
 	if err != nil {
@@ -1901,5 +2349,5 @@ func logFileOutStorage(lType string) *log.Logger {
 
 	logType := lType + ": "
 	l := log.New(f, logType, log.LstdFlags|log.Lmicroseconds)
-	return l
+	return util.NewLogger("storage", lType, l)
 }
@@ -3,6 +3,7 @@ package stratum
 import (
 	"bufio"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,6 +12,8 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -22,73 +25,178 @@ import (
 )
 
 type StratumServer struct {
-	roundShares        int64
-	config             *pool.Config
-	miners             MinersMap
-	blockTemplate      atomic.Value
+	roundShares   int64
+	startedAt     int64
+	config        atomic.Value
+	configFile    string
+	miners        MinersMap
+	blockTemplate atomic.Value
+	// Template of the previous height, shares for it are accepted within staleGracePeriod of the template change
+	prevBlockTemplate  atomic.Value
 	upstream           int32
 	upstreams          []*rpc.RPCClient
+	upstreamMaxLatency time.Duration
+	walletRPC          *rpc.RPCClient
 	timeout            time.Duration
 	estimationWindow   time.Duration
-	sessionsMu         sync.RWMutex
-	sessions           map[*Session]struct{}
+	sessions           SessionsMap
 	algo               string
 	trustedSharesCount int64
 	gravitonDB         *GravitonStore
 	hashrateExpiration time.Duration
 	failsCount         int64
 	donateID           string
-}
 
-type Endpoint struct {
-	jobSequence uint64
-	config      *pool.Port
-	difficulty  *big.Int
-	instanceId  []byte
-	extraNonce  uint32
-	targetHex   string
+	supportedMethods     map[string]struct{}
+	unknownMethodLogIntv time.Duration
+	unknownMethodsMu     sync.Mutex
+	unknownMethodsLog    map[string]int64
+	webhooks             *WebhookProcessor
+	notifications        *NotificationProcessor
+	telegram             *TelegramProcessor
+	banning              *BanList
+	payouts              *PayoutsProcessor
+	// Upstream pool client in proxy mode, nil otherwise
+	proxy *ProxyClient
+	// Open stratum connections of all ports and connections rejected by maxConnections since start
+	connections         int64
+	rejectedConnections int64
+	// Older sessions closed by collapseDuplicates and logins rejected by maxMinerConnections since start
+	duplicateSessions   int64
+	rejectedMinerLogins int64
+	// Requests exceeding the stratum rateLimit since start
+	rateLimited int64
+	// Stored round read for the round shares of share replies, see minerRoundShares
+	roundSharesCache roundSharesCache
+	// Random id of the pool process in the reserved space of every job and the last extranonce assigned to a connection, see reservedBytes
+	instanceId        []byte
+	extraNonce        uint32
+	endpoints         []*Endpoint
+	live              *LiveHub
+	geo               GeoLookup
+	pplns             *pplnsWindow
+	roundJournal      *RoundJournal
+	maintenance       int32
+	safeMode          int32
+	safeModeMu        sync.RWMutex
+	safeModeIssues    []string
+	safeModeSince     int64
+	broadcastMetrics  BroadcastMetrics
+	shareMetrics      ShareMetrics
+	writeQueueSize    int
+	writeTimeout      time.Duration
+	statsOnly         bool
+	templateMaxAge    time.Duration
+	templateUpdatedAt int64
+	templateCheckAt   int64
+	templateStuck     int32
+	templateSeq       uint64
+	templateRefreshMu sync.Mutex
+	daemonNotifier    *DaemonNotifier
+	verifier          *ShareVerifier
+	shareCache        *ShareCache
+	rejectAlarms      *RejectAlarms
+	withholding       *Withholding
+	templateChecks    TemplateChecks
+	shuttingDown      int32
+	inFlightRequests  int64
+	listenersMu       sync.Mutex
+	listeners         []*net.TCPListener
+	diffOverridesMu   sync.RWMutex
+	diffOverrides     map[string]int64
+	farmsMu           sync.RWMutex
+	farms             map[string]*Farm
+	addressLists      *AddressLists
+	minersEvicted     int64
+	releaseQueue      chan *Miner
+	minersRestored    int64
+	oversizedMessages int64
+	settingsCodesMu   sync.Mutex
+	settingsCodes     map[string]*settingsCode
+	settingsCodesSent []int64
 }
 
-type VarDiff struct {
-	Difficulty            int64
-	Average               float64
-	TimestampArr          map[int64]int64
-	LastRetargetTimestamp int64
-	LastTimeStamp         int64
+type Endpoint struct {
+	jobSequence   uint64
+	connections   int64
+	nonceSequence uint32
+	config        *pool.Port
+	difficulty    *big.Int
+	targetHex     string
+	// Share counters of the port, incremented next to the pool-wide ones
+	shares ShareMetrics
 }
 
 type Session struct {
 	lastBlockHeight uint64
 	sync.Mutex
-	conn        *net.TCPConn
-	enc         *json.Encoder
-	ip          string
-	endpoint    *Endpoint
-	validJobs   []*Job
-	difficulty  int64
-	VarDiff     *VarDiff
-	isFixedDiff bool
+	conn     net.Conn
+	ip       string
+	endpoint *Endpoint
+	// Ring of the last jobBacklog jobs sent to the session, nextJob is the slot of the next one. expiredJobs is the ring of the last ids dropped out of it, see expireJob
+	validJobs      []*Job
+	nextJob        int
+	expiredJobs    []string
+	nextExpired    int
+	difficulty     int64
+	VarDiff        *VarDiff
+	isFixedDiff    bool
+	unknownMethods int64
+	miner          *Miner
+	welcomed       bool
+	geo            *GeoInfo
+	// Hex of the nonce byte reserved by the pool on nicehash ports, "" on other ports
+	nicehashNonce string
+	// Extranonce of the connection in the reserved space of its jobs, unique among the connections of the pool
+	extraNonce uint32
+	// Consecutive validated shares of the session and trusted shares skipped since the last spot-check. A session has a single ip, so trust is only earned from the ip it is used from
+	trustedShares int64
+	skippedShares int64
+	// Write queue of the session, drained by its writeLoop. sendMu guards sending against closing the queue, overflowed is set once the queue overflowed and the connection was closed
+	send       chan []byte
+	sendMu     sync.RWMutex
+	sendClosed bool
+	overflowed int32
+	// Token buckets of the rate limited methods and until when the session is muted, guarded by rateMu
+	rateMu      sync.Mutex
+	rateBuckets map[string]*tokenBucket
+	mutedUntil  time.Time
+	// Name of the registered farm the session logged in as on a farm port, "" otherwise
+	farm string
+	// Payout settings of the login suffix, applied once the session submits its first accepted share so only a miner actually working for the address sets them. Guarded by the session lock
+	pendingPayoutSettings *MinerSettings
 }
 
 const (
 	MaxReqSize = 10 * 1024
+	// Miners whose last session closed waiting to be released, more than this are left to releaseIdleMiners
+	minerReleaseQueueSize = 1024
 )
 
+// Build version and git commit of the pool, injected at build time with -ldflags "-X github.com/Nelbert442/dero-golang-pool/stratum.Version=<version> -X github.com/Nelbert442/dero-golang-pool/stratum.Commit=<commit>"
+var Version = "1.0.0"
+var Commit = "unknown"
+
 var StratumInfoLogger = logFileOutStratum("INFO")
 var StratumErrorLogger = logFileOutStratum("ERROR")
+var StratumWarnLogger = logFileOutStratum("WARN")
+var StratumDebugLogger = logFileOutStratum("DEBUG")
 
 func NewStratum(cfg *pool.Config) *StratumServer {
-	stratum := &StratumServer{config: cfg}
+	stratum := &StratumServer{startedAt: time.Now().Unix()}
+	applyDiffProfiles(cfg)
+	stratum.config.Store(cfg)
 
 	// Setup our Ctrl+C handler
 	stratum.SetupCloseHandler()
+	stratum.SetupReloadHandler()
 
 	// Startup/create new gravitondb (if it doesn't exist), write the configuration file (config.json) into storage for use / api surfacing later
 	Graviton_backend.NewGravDB(cfg.PoolHost, "pooldb", cfg.GravitonMigrateWait, cfg.GravitonMaxSnapshots) //stratum.gravitonDB.NewGravDB(cfg.PoolHost, "pooldb") // TODO: Add to params in config.json file
+	NewStorageBackend(cfg)
 
 	writeWait, _ := time.ParseDuration("10ms")
 	for Graviton_backend.Writing == 1 {
-		//log.Printf("[Stratum-writeconfig] GravitonDB is writing... sleeping for %v...", writeWait)
 		//StorageInfoLogger.Printf("[Stratum-writeconfig] GravitonDB is writing... sleeping for %v...", writeWait)
 		time.Sleep(writeWait)
 	}
@@ -96,41 +204,307 @@ func NewStratum(cfg *pool.Config) *StratumServer {
 	Graviton_backend.WriteConfig(cfg)
 	Graviton_backend.Writing = 0
 
-	// Set stratum.upstreams length based on cfg.Upstream only if they are set enabled: true. We use arr to simulate this and filter out cfg.Upstream objects
-	var arr []pool.Upstream
-	for _, f := range cfg.Upstream {
-		if f.Enabled {
-			arr = append(arr, f)
-		}
+	stratum.upstreams = newUpstreams(cfg)
+	StratumInfoLogger.Printf("[Stratum] Default upstream: %s => %s", stratum.rpc().Name, stratum.rpc().Url)
+
+	// In proxy mode jobs come from the upstream pool, the daemons are only used for network stats
+	if cfg.ProxyMode.Enabled {
+		stratum.proxy = NewProxyClient(&cfg.ProxyMode)
 	}
 
-	stratum.upstreams = make([]*rpc.RPCClient, len(arr))
-	for i, v := range arr {
-		client, err := rpc.NewRPCClient(&v)
-		if err != nil {
-			log.Fatal(err)
-		} else {
-			stratum.upstreams[i] = client
-			log.Printf("[Stratum] Upstream: %s => %s", client.Name, client.Url)
-			StratumInfoLogger.Printf("[Stratum] Upstream: %s => %s", client.Name, client.Url)
-		}
+	// Wallet rpc client used for payouts. walletUrl takes precedence over walletHost and walletPort
+	walletUrl := cfg.PaymentsConfig.WalletUrl
+	if walletUrl == "" {
+		walletUrl = fmt.Sprintf("http://%s:%v/json_rpc", cfg.PaymentsConfig.WalletHost, cfg.PaymentsConfig.WalletPort)
 	}
-	log.Printf("[Stratum] Default upstream: %s => %s", stratum.rpc().Name, stratum.rpc().Url)
-	StratumInfoLogger.Printf("[Stratum] Default upstream: %s => %s", stratum.rpc().Name, stratum.rpc().Url)
+	walletTimeout := cfg.PaymentsConfig.WalletTimeout
+	if walletTimeout == "" {
+		walletTimeout = "10s"
+	}
+	walletClient, err := rpc.NewRPCClient(&pool.Upstream{Name: "Wallet", Url: walletUrl, Login: cfg.PaymentsConfig.WalletLogin, Password: cfg.PaymentsConfig.WalletPassword, Timeout: walletTimeout})
+	if err != nil {
+		log.Fatal(err)
+	}
+	stratum.walletRPC = walletClient
+	StratumInfoLogger.Printf("[Stratum] Wallet: %s => %s", walletClient.Name, walletClient.Url)
+
+	// Fail fast if the daemon(s), or wallet when payments are enabled, are unreachable
+	stratum.checkRPCConnectivity()
 
 	stratum.miners = NewMinersMap()
-	stratum.sessions = make(map[*Session]struct{})
+	stratum.sessions = NewSessionsMap()
+	// Miners are released from memory once their last session closes, see releaseMiners
+	stratum.releaseQueue = make(chan *Miner, minerReleaseQueueSize)
+	go stratum.releaseMiners()
+	stratum.instanceId = make([]byte, reservedInstanceSize)
+	if _, err := rand.Read(stratum.instanceId); err != nil {
+		StratumErrorLogger.Printf("[Stratum] Can't seed with random bytes: %v", err)
+		log.Fatalf("[Stratum] Can't seed with random bytes: %v", err)
+	}
 	stratum.algo = cfg.Algo
 	stratum.trustedSharesCount = cfg.TrustedSharesCount
+	stratum.verifier = NewShareVerifier(&cfg.Stratum.ShareVerifier)
+	shareCacheTTL, _ := time.ParseDuration(cfg.Stratum.ShareCacheTTL)
+	stratum.shareCache = NewShareCache(shareCacheTTL)
+	stratum.loadDiffOverrides()
+	stratum.loadFarms()
+	stratum.addressLists = NewAddressLists()
+	stratum.loadAddressLists()
+
+	// If live stats are enabled, api websocket clients are pushed events from the stratum, unlocker, payments and stats collection
+	if cfg.API.Enabled && cfg.API.LiveStats {
+		stratum.live = NewLiveHub(&cfg.API)
+	}
+
+	// If banning is enabled, ips submitting mostly invalid shares are banned and banned ips are rejected at accept time
+	if cfg.Banning.Enabled {
+		stratum.banning = NewBanList(&cfg.Banning)
+	}
 
 	timeout, _ := time.ParseDuration(cfg.Stratum.Timeout)
 	stratum.timeout = timeout
 
+	// If supportedMethods is defined, only those methods are handled and anything outside of it is uniformly rejected. Otherwise all built-in methods are handled
+	if len(cfg.Stratum.SupportedMethods) > 0 {
+		stratum.supportedMethods = make(map[string]struct{})
+		for _, method := range cfg.Stratum.SupportedMethods {
+			stratum.supportedMethods[method] = struct{}{}
+		}
+		StratumInfoLogger.Printf("[Stratum] Set supported methods: %v", cfg.Stratum.SupportedMethods)
+	}
+
+	stratum.writeQueueSize = cfg.Stratum.WriteQueueSize
+	if stratum.writeQueueSize <= 0 {
+		stratum.writeQueueSize = 64
+	}
+	stratum.writeTimeout, err = time.ParseDuration(cfg.Stratum.WriteTimeout)
+	if err != nil || stratum.writeTimeout <= 0 {
+		stratum.writeTimeout = 10 * time.Second
+	}
+	StratumInfoLogger.Printf("[Stratum] Set session write queue size: %v, write timeout: %v", stratum.writeQueueSize, stratum.writeTimeout)
+
+	unknownMethodLogIntv, err := time.ParseDuration(cfg.Stratum.UnknownMethodLogInterval)
+	if err != nil || unknownMethodLogIntv <= 0 {
+		unknownMethodLogIntv = time.Minute
+	}
+	stratum.unknownMethodLogIntv = unknownMethodLogIntv
+	stratum.unknownMethodsLog = make(map[string]int64)
+	// IPs that stopped sending unknown methods are dropped once per interval, the check of each request stays a single lookup
+	unknownMethodsTimer := time.NewTimer(unknownMethodLogIntv)
+	go func() {
+		for {
+			select {
+			case <-unknownMethodsTimer.C:
+				unknownMethodsTimer.Reset(stratum.pruneUnknownRPCLog())
+			}
+		}
+	}()
+
+	// If workerOfflineThreshold is defined, periodically check for workers that have not submitted an accepted share within the threshold
+	workerOfflineThreshold, _ := time.ParseDuration(cfg.Stratum.WorkerOfflineThreshold)
+	if workerOfflineThreshold > 0 {
+		workerOfflineIntv := workerOfflineThreshold / 10
+		if workerOfflineIntv < time.Second {
+			workerOfflineIntv = time.Second
+		}
+		workerOfflineTimer := time.NewTimer(workerOfflineIntv)
+		StratumInfoLogger.Printf("[Stratum] Set worker offline threshold to %v", workerOfflineThreshold)
+
+		go func() {
+			for {
+				select {
+				case <-workerOfflineTimer.C:
+					stratum.checkOfflineWorkers(workerOfflineThreshold)
+					workerOfflineTimer.Reset(workerOfflineIntv)
+				}
+			}
+		}()
+	}
+
+	if cfg.Stratum.Maintenance {
+		stratum.setMaintenance(true)
+	}
+
+	// If webhooks are enabled, start the async webhook delivery workers
+	if cfg.Webhooks.Enabled {
+		stratum.webhooks = NewWebhookProcessor(&cfg.Webhooks)
+		stratum.webhooks.Start()
+	}
+
+	// If notifications are enabled, miners can register an email and/or webhook to be alerted when their workers go offline [workerOfflineThreshold]
+	if cfg.Notifications.Enabled {
+		if workerOfflineThreshold <= 0 {
+			StratumErrorLogger.Printf("[Stratum] Notifications are enabled but stratum workerOfflineThreshold is not set, no offline alerts will be sent")
+		}
+		stratum.notifications = NewNotificationProcessor(&cfg.Notifications)
+		stratum.notifications.Start()
+	}
+
+	// If the telegram bot is enabled, miners link their address to a chat with the bot deep link of /api/telegram. Operator alerts go to operatorChat
+	if cfg.Telegram.Enabled {
+		stratum.telegram = NewTelegramProcessor(&cfg.Telegram, cfg.CoinUnits)
+		stratum.telegram.Start()
+	}
+
+	// If the pplns payout scheme is used, pool shares are kept in a rolling window restored from the last stored one
+	if cfg.PaymentsConfig.Scheme == "pplns" {
+		stratum.pplns = newPPLNSWindow(cfg.PaymentsConfig.PPLNSWindow, Storage_backend.GetPPLNSWindow())
+		StratumInfoLogger.Printf("[Stratum] Using pplns payout scheme, window: %v x network difficulty, restored %v shares", stratum.pplns.n, stratum.pplns.total)
+	}
+
+	// If a round shares journal is set, shares accepted between round stats stores are journaled and recovered into the round after a crash or restart
+	if cfg.RoundSharesJournal != "" {
+		journal, err := NewRoundJournal(cfg.RoundSharesJournal)
+		if err != nil {
+			StratumErrorLogger.Printf("[Stratum] Could not open round shares journal %s, continuing without it: %v", cfg.RoundSharesJournal, err)
+		} else {
+			stratum.roundJournal = journal
+			stratum.recoverRoundShares()
+		}
+	}
+
+	// If share write batching is enabled, journaled shares are buffered and written every flushInterval or maxEntries instead of one write per share
+	if stratum.roundJournal != nil && cfg.ShareWriteBatching.Enabled {
+		flushIntv, err := time.ParseDuration(cfg.ShareWriteBatching.FlushInterval)
+		if err != nil || flushIntv <= 0 {
+			flushIntv = 100 * time.Millisecond
+		}
+		maxEntries := cfg.ShareWriteBatching.MaxEntries
+		if maxEntries <= 0 {
+			maxEntries = 500
+		}
+		stratum.roundJournal.mu.Lock()
+		stratum.roundJournal.maxEntries = maxEntries
+		stratum.roundJournal.mu.Unlock()
+		flushTimer := time.NewTimer(flushIntv)
+		StratumInfoLogger.Printf("[Stratum] Set share write batching every %v, max entries: %v", flushIntv, maxEntries)
+
+		go func() {
+			for {
+				select {
+				case <-flushTimer.C:
+					stratum.flushRoundJournal()
+					flushTimer.Reset(flushIntv)
+				}
+			}
+		}()
+	}
+
+	// If startup checks are enabled, the stored state is validated once the round is recovered and any inconsistency boots the pool into safe mode
+	if cfg.StartupChecks {
+		if issues := stratum.validateState(); len(issues) > 0 {
+			stratum.enterSafeMode(issues)
+		} else {
+			StratumInfoLogger.Printf("[Stratum] Startup state check passed")
+		}
+	}
+
+	// If geoip is enabled, sessions are tagged with country/region/ASN after login. A missing or broken database only disables the enrichment
+	if cfg.GeoIP.Enabled {
+		geoDB, loaded, err := loadGeoLookup(cfg.GeoIP.Database, cfg.GeoIP.ASNDatabase)
+		if err != nil {
+			StratumErrorLogger.Printf("[Stratum] Could not load geoip database %s, continuing without geoip: %v", cfg.GeoIP.Database, err)
+		} else {
+			stratum.geo = geoDB
+			StratumInfoLogger.Printf("[Stratum] Loaded %s from %s", loaded, cfg.GeoIP.Database)
+		}
+	}
+
+	// If withholding detection is enabled, periodically compare blocks found by each pool miner against the blocks expected from their shares
+	if cfg.Withholding.Enabled {
+		stratum.withholding = NewWithholding()
+		withholdingIntv, err := time.ParseDuration(cfg.Withholding.Interval)
+		if err != nil || withholdingIntv <= 0 {
+			withholdingIntv = 10 * time.Minute
+		}
+		withholdingTimer := time.NewTimer(withholdingIntv)
+		StratumInfoLogger.Printf("[Stratum] Set withholding detection every %v over a window of %v, min expected blocks: %v, probability: %v", withholdingIntv, cfg.Withholding.Window, cfg.Withholding.MinExpectedBlocks, cfg.Withholding.Probability)
+
+		go func() {
+			for {
+				select {
+				case <-withholdingTimer.C:
+					stratum.checkWithholding()
+					withholdingTimer.Reset(withholdingIntv)
+				}
+			}
+		}()
+	}
+
+	// If reject alarms are enabled, periodically sample the share counters of the pool, ports, miners and workers and alert on rejected and stale rates over their thresholds
+	if cfg.RejectAlarms.Enabled {
+		stratum.rejectAlarms = NewRejectAlarms()
+		rejectAlarmsIntv, err := time.ParseDuration(cfg.RejectAlarms.Interval)
+		if err != nil || rejectAlarmsIntv <= 0 {
+			rejectAlarmsIntv = time.Minute
+		}
+		rejectAlarmsTimer := time.NewTimer(rejectAlarmsIntv)
+		StratumInfoLogger.Printf("[Stratum] Set reject alarms check every %v over a window of %v", rejectAlarmsIntv, cfg.RejectAlarms.Window)
+
+		go func() {
+			for {
+				select {
+				case <-rejectAlarmsTimer.C:
+					stratum.checkRejectRates()
+					rejectAlarmsTimer.Reset(rejectAlarmsIntv)
+				}
+			}
+		}()
+	}
+
+	// If retention is enabled, periodically prune old rounds, stale miner charts and the block and payment history beyond their caps
+	if cfg.Retention.Enabled {
+		retentionIntv, err := time.ParseDuration(cfg.Retention.Interval)
+		if err != nil || retentionIntv <= 0 {
+			retentionIntv = 6 * time.Hour
+		}
+		retentionTimer := time.NewTimer(retentionIntv)
+		StratumInfoLogger.Printf("[Stratum] Set storage retention every %v, round days: %v, chart days: %v, max blocks: %v, max payments: %v", retentionIntv, cfg.Retention.RoundDays, cfg.Retention.ChartDays, cfg.Retention.MaxBlocks, cfg.Retention.MaxPayments)
+
+		go func() {
+			for {
+				select {
+				case <-retentionTimer.C:
+					stratum.applyRetention()
+					retentionTimer.Reset(retentionIntv)
+				}
+			}
+		}()
+	}
+
+	// If miner eviction is enabled, miners offline for longer than offlineAfter are stored and freed from memory, and restored from storage on login
+	if cfg.MinerEviction.Enabled {
+		evictionIntv, err := time.ParseDuration(cfg.MinerEviction.Interval)
+		if err != nil || evictionIntv <= 0 {
+			evictionIntv = 10 * time.Minute
+		}
+		offlineAfter, err := time.ParseDuration(cfg.MinerEviction.OfflineAfter)
+		if err != nil || offlineAfter <= 0 {
+			offlineAfter = 24 * time.Hour
+		}
+		evictionTimer := time.NewTimer(evictionIntv)
+		StratumInfoLogger.Printf("[Stratum] Set miner eviction every %v, offline after: %v", evictionIntv, offlineAfter)
+
+		go func() {
+			for {
+				select {
+				case <-evictionTimer.C:
+					stratum.evictOfflineMiners(offlineAfter)
+					evictionTimer.Reset(evictionIntv)
+				}
+			}
+		}()
+	}
+
 	refreshIntv, _ := time.ParseDuration(cfg.BlockRefreshInterval)
 	refreshTimer := time.NewTimer(refreshIntv)
-	log.Printf("[Stratum] Set block refresh every %v", refreshIntv)
 	StratumInfoLogger.Printf("[Stratum] Set block refresh every %v", refreshIntv)
 
+	stratum.templateMaxAge, _ = time.ParseDuration(cfg.BlockTemplateMaxAge)
+	if stratum.templateMaxAge > 0 {
+		StratumInfoLogger.Printf("[Stratum] Set block template max age to %v", stratum.templateMaxAge)
+	}
+
 	hashExpiration, _ := time.ParseDuration(cfg.HashrateExpiration)
 	stratum.hashrateExpiration = hashExpiration
 
@@ -139,12 +513,17 @@ func NewStratum(cfg *pool.Config) *StratumServer {
 
 	checkIntv, _ := time.ParseDuration(cfg.UpstreamCheckInterval)
 	checkTimer := time.NewTimer(checkIntv)
-	log.Printf("[Stratum] Set upstream check interval every %v", checkIntv)
 	StratumInfoLogger.Printf("[Stratum] Set upstream check interval every %v", checkIntv)
 
+	if cfg.UpstreamMaxLatency != "" {
+		stratum.upstreamMaxLatency, _ = time.ParseDuration(cfg.UpstreamMaxLatency)
+	}
+	if len(stratum.upstreams) > 1 {
+		StratumInfoLogger.Printf("[Stratum] Upstreams fail over when marked sick, over %v latency [0 = not checked] or more than %v blocks behind [0 = not checked]", stratum.upstreamMaxLatency, cfg.UpstreamMaxHeightLag)
+	}
+
 	minerStatsIntv, _ := time.ParseDuration(cfg.StoreMinerStatsInterval)
 	minerStatsTimer := time.NewTimer(minerStatsIntv)
-	log.Printf("[Stratum] Set miner stats store interval every %v", minerStatsIntv)
 	StratumInfoLogger.Printf("[Stratum] Set miner stats store interval every %v", minerStatsIntv)
 
 	infoIntv, _ := time.ParseDuration(cfg.UpstreamCheckInterval)
@@ -155,19 +534,17 @@ func NewStratum(cfg *pool.Config) *StratumServer {
 	var ddiff uint64
 	var ddonperc int64
 	var disSolo bool
-	if stratum.config.DonationAddress != "" {
-		daddress := stratum.config.DonationAddress
+	if stratum.currentConfig().DonationAddress != "" {
+		daddress := stratum.currentConfig().DonationAddress
 		stratum.donateID = daddress
 		dminer, ok := stratum.miners.Get(daddress)
 		if !ok {
-			log.Printf("[Stratum] Registering donation miner: Address: %s", daddress)
 			StratumInfoLogger.Printf("[Stratum] Registering donation miner: Address: %s", daddress)
 			dminer = NewMiner(daddress, daddress, dpid, ddiff, dwid, ddonperc, disSolo, "127.0.0.1")
 			stratum.registerMiner(dminer)
 
 			writeWait, _ := time.ParseDuration("10ms")
 			for Graviton_backend.Writing == 1 {
-				//log.Printf("[Handlers-handleLoginRPC] GravitonDB is writing... sleeping for %v...", writeWait)
 				//StorageInfoLogger.Printf("[Handlers-handleLoginRPC] GravitonDB is writing... sleeping for %v...", writeWait)
 				time.Sleep(writeWait)
 			}
@@ -176,18 +553,16 @@ func NewStratum(cfg *pool.Config) *StratumServer {
 			Graviton_backend.Writing = 0
 		}
 	} else {
-		daddress := stratum.config.Address
+		daddress := stratum.currentConfig().Address
 		stratum.donateID = daddress
 		dminer, ok := stratum.miners.Get(daddress)
 		if !ok {
-			log.Printf("[Stratum] Registering donation miner: Address: %s", daddress)
 			StratumInfoLogger.Printf("[Stratum] Registering donation miner: Address: %s", daddress)
 			dminer = NewMiner(daddress, daddress, dpid, ddiff, dwid, ddonperc, disSolo, "127.0.0.1")
 			stratum.registerMiner(dminer)
 
 			writeWait, _ := time.ParseDuration("10ms")
 			for Graviton_backend.Writing == 1 {
-				//log.Printf("[Handlers-handleLoginRPC] GravitonDB is writing... sleeping for %v...", writeWait)
 				//StorageInfoLogger.Printf("[Handlers-handleLoginRPC] GravitonDB is writing... sleeping for %v...", writeWait)
 				time.Sleep(writeWait)
 			}
@@ -199,6 +574,15 @@ func NewStratum(cfg *pool.Config) *StratumServer {
 
 	// Init block template
 	go stratum.refreshBlockTemplate(false)
+	if stratum.proxy != nil {
+		stratum.proxy.Start(stratum)
+	}
+
+	// If daemon notifications are enabled, new chain tips are refreshed and broadcast right away rather than at the next blockRefreshInterval. Not used in proxy mode, jobs are pushed by the upstream pool
+	if cfg.DaemonNotify.Enabled && stratum.proxy == nil {
+		stratum.daemonNotifier = NewDaemonNotifier(&cfg.DaemonNotify)
+		stratum.daemonNotifier.Start(stratum)
+	}
 
 	go func() {
 		for {
@@ -220,15 +604,25 @@ func NewStratum(cfg *pool.Config) *StratumServer {
 		}
 	}()
 
-	go func() {
-		for {
-			select {
-			case <-checkTimer.C:
-				stratum.updateFixedDiffJobs()
-				checkTimer.Reset(checkIntv)
-			}
+	// Vardiff retargets run on their own timer, sessions are retargeted once their retargetTime has elapsed
+	if cfg.Stratum.VarDiff.Enabled {
+		retargetIntv := time.Duration(cfg.Stratum.VarDiff.RetargetTime) * time.Second / 4
+		if retargetIntv < time.Second {
+			retargetIntv = time.Second
 		}
-	}()
+		retargetTimer := time.NewTimer(retargetIntv)
+		StratumInfoLogger.Printf("[Stratum] Set vardiff target share time to %vs, retarget every %vs, checked every %v", cfg.Stratum.VarDiff.TargetTime, cfg.Stratum.VarDiff.RetargetTime, retargetIntv)
+
+		go func() {
+			for {
+				select {
+				case <-retargetTimer.C:
+					stratum.updateFixedDiffJobs()
+					retargetTimer.Reset(retargetIntv)
+				}
+			}
+		}()
+	}
 
 	go func() {
 		for {
@@ -238,21 +632,24 @@ func NewStratum(cfg *pool.Config) *StratumServer {
 
 				writeWait, _ := time.ParseDuration("10ms")
 				for Graviton_backend.Writing == 1 {
-					//log.Printf("[Stratum-writeminerstats] GravitonDB is writing... sleeping for %v...", writeWait)
 					//StorageInfoLogger.Printf("[Stratum-writeminerstats] GravitonDB is writing... sleeping for %v...", writeWait)
 					time.Sleep(writeWait)
 				}
 				Graviton_backend.Writing = 1
 				err := Graviton_backend.WriteMinerStats(stratum.miners, stratum.hashrateExpiration)
-				err2 := Graviton_backend.UpdatePoolRoundStats(stratum.miners, false)
+				err2 := Storage_backend.UpdatePoolRoundStats(stratum.miners, false)
+				if err2 == nil {
+					stratum.compactRoundJournal()
+				}
+				stratum.storePPLNSWindow()
 				Graviton_backend.Writing = 0
 				if err != nil {
-					log.Printf("[Stratum] Err storing miner stats: %v", err)
 					StratumErrorLogger.Printf("[Stratum] Err storing miner stats: %v", err)
 				}
 				if err2 != nil {
-					log.Printf("[Stratum] Err storing miner round stats: %v", err2)
 					StratumErrorLogger.Printf("[Stratum] Err storing miner round stats: %v", err2)
+				} else {
+					stratum.releaseIdleMiners()
 				}
 				minerStatsTimer.Reset(minerStatsIntv)
 			}
@@ -266,9 +663,11 @@ func NewStratum(cfg *pool.Config) *StratumServer {
 				poll := func(v *rpc.RPCClient) {
 					_, err := v.UpdateInfo()
 					if err != nil {
-						log.Printf("[Stratum] Unable to update info on upstream %s: %v", v.Name, err)
 						StratumErrorLogger.Printf("[Stratum] Unable to update info on upstream %s: %v", v.Name, err)
-						stratum.markSick()
+						// In proxy mode the health of the pool is the upstream pool connection
+						if stratum.proxy == nil {
+							stratum.markSick()
+						}
 					} else {
 						stratum.markOk()
 					}
@@ -293,28 +692,38 @@ func NewStratum(cfg *pool.Config) *StratumServer {
 }
 
 // Defines parameters for the ports to be listened on, such as default difficulty
-func NewEndpoint(cfg *pool.Port) *Endpoint {
+func NewEndpoint(cfg *pool.Port, targetEncoding string) *Endpoint {
 	e := &Endpoint{config: cfg}
-	e.instanceId = make([]byte, 4)
-	_, err := rand.Read(e.instanceId)
-	if err != nil {
-		StratumErrorLogger.Printf("[Stratum] Can't seed with random bytes: %v", err)
-		log.Fatalf("[Stratum] Can't seed with random bytes: %v", err)
-	}
-	e.targetHex = util.GetTargetHex(e.config.Difficulty)
+	e.targetHex = util.GetTargetHexEncoded(e.config.Difficulty, targetEncoding)
 	e.difficulty = big.NewInt(e.config.Difficulty)
+
+	// Verify the target sent to miners represents the configured difficulty, the compact target loses precision at higher difficulties
+	targetDiff, ok := util.GetTargetDifficulty(e.targetHex)
+	if !ok || targetDiff < e.config.Difficulty || float64(targetDiff-e.config.Difficulty)/float64(e.config.Difficulty) > 0.01 {
+		StratumErrorLogger.Printf("[Stratum] Port %v difficulty %v is sent as target %s which represents difficulty %v. Consider setting stratum targetEncoding to uint64", e.config.Port, e.config.Difficulty, e.targetHex, targetDiff)
+	}
 	return e
 }
 
 // Sets up stratum to listen on the ports in config.json
 func (s *StratumServer) Listen() {
 	quit := make(chan bool)
-	for _, port := range s.config.Stratum.Ports {
+	for _, port := range s.currentConfig().Stratum.Ports {
 		go func(cfg pool.Port) {
-			e := NewEndpoint(&cfg)
+			e := NewEndpoint(&cfg, s.currentConfig().Stratum.TargetEncoding)
 			e.Listen(s)
 		}(port)
 	}
+
+	// Browser and CPU miners without TCP stratum mine through the HTTP getwork endpoint
+	if getwork := s.currentConfig().Stratum.Getwork; getwork.Enabled {
+		g, err := NewGetworkServer(&getwork, s.currentConfig().Stratum.TargetEncoding)
+		if err != nil {
+			StratumErrorLogger.Printf("[Stratum] Error: invalid getwork listen %s: %v", getwork.Listen, err)
+			log.Fatalf("[Stratum] Error: invalid getwork listen %s: %v", getwork.Listen, err)
+		}
+		go g.Listen(s)
+	}
 	<-quit
 }
 
@@ -332,50 +741,194 @@ func (e *Endpoint) Listen(s *StratumServer) {
 		log.Fatalf("[Stratum] Error: %v", err)
 	}
 	defer server.Close()
-
-	log.Printf("[Stratum] Stratum listening on %s", bindAddr)
-	StratumInfoLogger.Printf("[Stratum] Stratum listening on %s", bindAddr)
-	accept := make(chan int, e.config.MaxConn)
-	n := 0
-
+	s.listenersMu.Lock()
+	s.listeners = append(s.listeners, server)
+	s.endpoints = append(s.endpoints, e)
+	s.listenersMu.Unlock()
+
+	// TLS ports wrap each accepted connection, the handshake happens on the first read within handleClient so the accept loop is never held up
+	var tlsConfig *tls.Config
+	if e.config.TLS {
+		tlsConfig, err = newTLSConfig(e.config)
+		if err != nil {
+			StratumErrorLogger.Printf("[Stratum] Error setting up TLS on %s: %v", bindAddr, err)
+			log.Fatalf("[Stratum] Error setting up TLS on %s: %v", bindAddr, err)
+		}
+		StratumInfoLogger.Printf("[Stratum] Stratum listening on %s with TLS", bindAddr)
+	} else {
+		StratumInfoLogger.Printf("[Stratum] Stratum listening on %s", bindAddr)
+	}
 	for {
 		conn, err := server.AcceptTCP()
 		if err != nil {
+			// The listener is closed on shutdown
+			if s.isShuttingDown() {
+				return
+			}
 			continue
 		}
 		conn.SetKeepAlive(true)
-		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 
-		VarDiff := &VarDiff{}
+		if !s.acquireConnection(e) {
+			s.rejectConnection(conn, e)
+			continue
+		}
 
-		cs := &Session{conn: conn, ip: ip, enc: json.NewEncoder(conn), endpoint: e, VarDiff: VarDiff}
-		n++
+		go func(conn *net.TCPConn) {
+			defer s.releaseConnection(e)
 
-		accept <- n
-		go func() {
+			ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			var sessionConn net.Conn = conn
+
+			// Behind a load balancer, the client ip comes from the PROXY header which precedes any TLS handshake
+			if e.config.ProxyProtocol {
+				proxied, clientIP, err := readProxyHeader(conn)
+				if err != nil {
+					StratumErrorLogger.Printf("[Stratum] Rejected connection from %s on port %v: %v", ip, e.config.Port, err)
+					conn.Close()
+					return
+				}
+				sessionConn = proxied
+				ip = clientIP
+			}
+
+			if _, banned := s.banning.isBanned(ip); banned {
+				HandlersDebugLogger.Printf("[Banning] Rejected connection from banned ip %s on port %v", ip, e.config.Port)
+				s.closeWithError(sessionConn, e, &ErrorReply{Code: errCodeBannedIP, Message: "Banned ip, connections from it are rejected"})
+				return
+			}
+
+			if tlsConfig != nil {
+				sessionConn = tls.Server(sessionConn, tlsConfig)
+			}
+
+			VarDiff := &VarDiff{}
+
+			cs := &Session{conn: sessionConn, ip: ip, endpoint: e, VarDiff: VarDiff, send: make(chan []byte, s.writeQueueSize), extraNonce: atomic.AddUint32(&s.extraNonce, 1)}
+			if e.config.NiceHash {
+				cs.nicehashNonce = fmt.Sprintf("%02x", byte(atomic.AddUint32(&e.nonceSequence, 1)))
+			}
+			go cs.writeLoop(s.writeTimeout)
 			s.handleClient(cs, e)
-			<-accept
-		}()
+		}(conn)
+	}
+}
+
+// Returns the max connections of the port, maxConnections or the older maxConn. 0 is unlimited
+func (e *Endpoint) maxConnections() int64 {
+	if e.config.MaxConnections > 0 {
+		return int64(e.config.MaxConnections)
+	}
+	return int64(e.config.MaxConn)
+}
+
+// Counts a new connection of the port, returns false without counting it if the port or the global stratum maxConnections is reached
+func (s *StratumServer) acquireConnection(e *Endpoint) bool {
+	total := atomic.AddInt64(&s.connections, 1)
+	port := atomic.AddInt64(&e.connections, 1)
+
+	globalMax := int64(s.currentConfig().Stratum.MaxConnections)
+	portMax := e.maxConnections()
+	if (globalMax > 0 && total > globalMax) || (portMax > 0 && port > portMax) {
+		s.releaseConnection(e)
+		return false
+	}
+	return true
+}
+
+func (s *StratumServer) releaseConnection(e *Endpoint) {
+	atomic.AddInt64(&s.connections, -1)
+	atomic.AddInt64(&e.connections, -1)
+}
+
+// Rejects a connection over maxConnections right away, so the pool does not run out of file descriptors
+func (s *StratumServer) rejectConnection(conn *net.TCPConn, e *Endpoint) {
+	atomic.AddInt64(&s.rejectedConnections, 1)
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	HandlersDebugLogger.Printf("[Stratum] Rejected connection from %s on port %v, max connections reached [port: %v/%v, total: %v/%v]", ip, e.config.Port, atomic.LoadInt64(&e.connections), e.maxConnections(), atomic.LoadInt64(&s.connections), s.currentConfig().Stratum.MaxConnections)
+
+	s.closeWithError(conn, e, &ErrorReply{Code: errCodePoolFull, Message: "Too many connections, please try again later"})
+}
+
+// Closes a connection rejected before its session starts. Plain ports are sent the stratum error first, TLS ports are closed as the error could not be read before a handshake
+func (s *StratumServer) closeWithError(conn net.Conn, e *Endpoint, reply *ErrorReply) {
+	if !e.config.TLS {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		json.NewEncoder(conn).Encode(&JSONRpcResp{Version: "2.0", Error: s.withHelp(reply)})
+	}
+	conn.Close()
+}
+
+// Returns the open connections of each listening port
+func (s *StratumServer) portConnections() map[int]int64 {
+	connections := make(map[int]int64)
+	s.listenersMu.Lock()
+	for _, e := range s.endpoints {
+		connections[e.config.Port] += atomic.LoadInt64(&e.connections)
+	}
+	s.listenersMu.Unlock()
+	return connections
+}
+
+// Supported tlsMinVersion values of a port, defaults to 1.2
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Builds the TLS config of a port from its certFile/keyFile, tlsMinVersion and tlsCipherSuites [Go cipher suite names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256]. Empty cipher suites use the Go defaults
+func newTLSConfig(cfg *pool.Port) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if cfg.TLSMinVersion != "" {
+		version, ok := tlsVersions[cfg.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tlsMinVersion %s", cfg.TLSMinVersion)
+		}
+		minVersion = version
+	}
+
+	var cipherSuites []uint16
+	if len(cfg.TLSCipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range cfg.TLSCipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %s", name)
+			}
+			cipherSuites = append(cipherSuites, id)
+		}
 	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: minVersion, CipherSuites: cipherSuites}, nil
 }
 
 // Handles inbound client data, and sends off to handleMessage for processing things like login, submits etc.
 func (s *StratumServer) handleClient(cs *Session, e *Endpoint) {
-	connbuff := bufio.NewReaderSize(cs.conn, MaxReqSize)
+	limits := s.messageLimits()
+	// The buffer stays small whatever maxMessageSize is, longer messages are put together by readMessage up to it
+	connbuff := bufio.NewReaderSize(cs.conn, messageReadBuffer)
 	s.setDeadline(cs.conn)
 
 	for {
-		data, isPrefix, err := connbuff.ReadLine()
-		if isPrefix {
-			log.Printf("[Stratum] Socket flood detected from %v", cs.ip)
+		data, tooLong, err := readMessage(connbuff, limits.maxMessageSize)
+		if tooLong {
 			StratumErrorLogger.Printf("[Stratum] Socket flood detected from %v", cs.ip)
+			s.messageLimitExceeded(cs, fmt.Sprintf("message over %v bytes", limits.maxMessageSize))
 			break
 		} else if err == io.EOF {
-			log.Printf("[Stratum] Client disconnected %v", cs.ip)
-			StratumErrorLogger.Printf("[Stratum] Client disconnected %v", cs.ip)
+			StratumDebugLogger.Printf("[Stratum] Client disconnected %v", cs.ip)
 			break
 		} else if err != nil {
-			log.Printf("[Stratum] Error reading: %v", err)
 			StratumErrorLogger.Printf("[Stratum] Error reading: %v", err)
 			break
 		}
@@ -383,22 +936,38 @@ func (s *StratumServer) handleClient(cs *Session, e *Endpoint) {
 		// NOTICE: cpuminer-multi sends junk newlines, so we demand at least 1 byte for decode
 		// NOTICE: Ns*CNMiner.exe will send malformed JSON on very low diff, not sure we should handle this
 		if len(data) > 1 {
-			var req JSONRpcReq
-			err = json.Unmarshal(data, &req)
-			if err != nil {
-				log.Printf("[Stratum] Malformed request from %s: %v", cs.ip, err)
-				StratumErrorLogger.Printf("[Stratum] Malformed request from %s: %v", cs.ip, err)
-				break
-			}
-			s.setDeadline(cs.conn)
-			err = cs.handleMessage(s, e, &req)
-			if err != nil {
+			if err = cs.handleRequest(s, e, data, limits); err != nil {
 				break
 			}
 		}
 	}
 	s.removeSession(cs)
-	cs.conn.Close()
+}
+
+// Decodes and handles a single request line. Counted in flight until it returns on any path, so shutdown can wait for shares being processed
+func (cs *Session) handleRequest(s *StratumServer, e *Endpoint, data []byte, limits *messageLimits) error {
+	if !s.beginRequest() {
+		return fmt.Errorf("[Stratum] Shutting down, dropping request from %s", cs.ip)
+	}
+	defer s.endRequest()
+
+	// Nesting is checked before decoding, so a deeply nested message is not walked by the decoder
+	if jsonTooDeep(data, limits.maxDepth) {
+		reason := fmt.Sprintf("nested deeper than %v", limits.maxDepth)
+		s.rejectMessage(cs, nil, reason)
+		return fmt.Errorf("[Stratum] Rejected request from %s: %v", cs.ip, reason)
+	}
+	var req JSONRpcReq
+	if err := json.Unmarshal(data, &req); err != nil {
+		StratumErrorLogger.Printf("[Stratum] Malformed request from %s: %v", cs.ip, err)
+		return err
+	}
+	if reason := limits.checkRequest(&req); reason != "" {
+		s.rejectMessage(cs, limits.replyId(&req), reason)
+		return fmt.Errorf("[Stratum] Rejected request from %s: %v", cs.ip, reason)
+	}
+	s.setDeadline(cs.conn)
+	return cs.handleMessage(s, e, &req)
 }
 
 // Handle messages , login and submit are common
@@ -406,15 +975,25 @@ func (cs *Session) handleMessage(s *StratumServer, e *Endpoint, req *JSONRpcReq)
 	if req.Id == nil {
 		err := fmt.Errorf("[Stratum] Server disconnect request")
 		StratumErrorLogger.Printf("%v", err)
-		log.Printf("%v", err)
 		return err
-	} else if req.Params == nil {
+	} else if req.Params == nil && req.Method != "keepalived" {
 		err := fmt.Errorf("[Stratum] Server RPC request params")
 		StratumErrorLogger.Printf("%v", err)
-		log.Printf("%v", err)
 		return err
 	}
 
+	// Uniformly reject any method outside of the supported methods list, if defined
+	if !s.isSupportedMethod(req.Method) {
+		errReply := s.handleUnknownRPC(cs, req)
+		return cs.sendError(req.Id, s.withHelp(errReply), true)
+	}
+
+	if allowed, disconnect := cs.allowRequest(s, req.Method); disconnect {
+		return fmt.Errorf("[Stratum] Rate limit exceeded by %s", cs.ip)
+	} else if !allowed {
+		return nil
+	}
+
 	// Handle RPC methods
 	switch req.Method {
 
@@ -423,68 +1002,132 @@ func (cs *Session) handleMessage(s *StratumServer, e *Endpoint, req *JSONRpcReq)
 
 		err := json.Unmarshal(*req.Params, &params)
 		if err != nil {
-			log.Printf("[Stratum] Unable to parse params")
 			StratumErrorLogger.Printf("[Stratum] Unable to parse params")
 			return err
 		}
+		if reason := s.messageLimits().checkLogin(&params); reason != "" {
+			return s.rejectMessage(cs, req.Id, reason)
+		}
 		reply, errReply := s.handleLoginRPC(cs, &params)
 		if errReply != nil {
-			return cs.sendError(req.Id, errReply, true)
+			return cs.sendError(req.Id, s.withHelp(errReply), true)
 		}
-		return cs.sendResult(req.Id, &reply)
+		err = cs.sendResult(req.Id, &reply)
+		if err != nil {
+			return err
+		}
+		s.sendWelcomeMessage(cs)
+		return nil
 	case "getjob":
 		var params GetJobParams
 		err := json.Unmarshal(*req.Params, &params)
 		if err != nil {
-			log.Printf("[Stratum] Unable to parse params")
 			StratumErrorLogger.Printf("[Stratum] Unable to parse params")
 			return err
 		}
+		if reason := s.messageLimits().checkId(params.Id); reason != "" {
+			return s.rejectMessage(cs, req.Id, reason)
+		}
 		reply, errReply := s.handleGetJobRPC(cs, &params)
 		if errReply != nil {
-			return cs.sendError(req.Id, errReply, true)
+			return cs.sendError(req.Id, s.withHelp(errReply), true)
 		}
 		return cs.sendResult(req.Id, &reply)
 	case "submit":
 		var params SubmitParams
 		err := json.Unmarshal(*req.Params, &params)
 		if err != nil {
-			log.Printf("[Stratum] Unable to parse params")
 			StratumErrorLogger.Printf("[Stratum] Unable to parse params")
 			return err
 		}
+		if reason := s.messageLimits().checkSubmit(&params); reason != "" {
+			return s.rejectMessage(cs, req.Id, reason)
+		}
 		reply, errReply := s.handleSubmitRPC(cs, &params)
 		if errReply != nil {
-			return cs.sendError(req.Id, errReply, false)
+			return cs.sendError(req.Id, s.withHelp(errReply), false)
 		}
 		return cs.sendResult(req.Id, &reply)
 	case "keepalived":
-		return cs.sendResult(req.Id, &StatusReply{Status: "KEEPALIVED"})
+		// Params [the session id sent by xmrig] are optional, keepalives only refresh the session deadline and the miner's last beat
+		var params KeepAliveParams
+		if req.Params != nil {
+			json.Unmarshal(*req.Params, &params)
+		}
+		reply := s.handleKeepAliveRPC(cs, &params)
+		return cs.sendResult(req.Id, &reply)
 	default:
-		errReply := s.handleUnknownRPC(req)
-		return cs.sendError(req.Id, errReply, true)
+		errReply := s.handleUnknownRPC(cs, req)
+		return cs.sendError(req.Id, s.withHelp(errReply), true)
 	}
 }
 
 func (cs *Session) sendResult(id *json.RawMessage, result interface{}) error {
-	cs.Lock()
-	defer cs.Unlock()
 	message := JSONRpcResp{Id: id, Version: "2.0", Error: nil, Result: result}
-	return cs.enc.Encode(&message)
+	return cs.enqueue(&message)
 }
 
 func (cs *Session) pushMessage(method string, params interface{}) error {
-	cs.Lock()
-	defer cs.Unlock()
 	message := JSONPushMessage{Version: "2.0", Method: method, Params: params}
-	return cs.enc.Encode(&message)
+	return cs.enqueue(&message)
+}
+
+// Pushes the configured welcome message once per session, right after the login reply. It is informational only, so a failed push is logged without dropping the session
+func (s *StratumServer) sendWelcomeMessage(cs *Session) {
+	welcome := s.currentConfig().Stratum.WelcomeMessage
+	if !welcome.Enabled || welcome.Message == "" || cs.welcomed {
+		return
+	}
+	cs.welcomed = true
+
+	method := welcome.Method
+	if method == "" {
+		method = "message"
+	}
+	err := cs.pushMessage(method, &WelcomeMessageParams{Message: welcome.Message})
+	if err != nil {
+		StratumErrorLogger.Printf("[Stratum] Error pushing welcome message to %s: %v", cs.ip, err)
+	}
+}
+
+// Pushes the accepted block to the finding session, and to all sessions for pool blocks with allSessions. Runs in its own goroutine so the submit reply and job flow are not held up, failed pushes are only logged
+func (s *StratumServer) notifyBlockFound(finder *Session, height uint64, hash string, solo bool) {
+	notify := s.currentConfig().Stratum.BlockNotify
+	method := notify.Method
+	if method == "" {
+		method = "block"
+	}
+
+	sessions := []*Session{finder}
+	if notify.AllSessions && !solo {
+		s.sessions.Range(func(cs *Session) {
+			if cs != finder && cs.miner != nil {
+				sessions = append(sessions, cs)
+			}
+		})
+	}
+
+	for _, cs := range sessions {
+		err := cs.pushMessage(method, &BlockFoundParams{Height: height, Hash: hash, Solo: solo, Finder: cs == finder})
+		if err != nil {
+			StratumErrorLogger.Printf("[Stratum] Error pushing block notification to %s: %v", cs.ip, err)
+		}
+	}
+}
+
+// Returns the reply with stratum errorHelpUrl appended to its message, "{code}" in the url is replaced with the error code [e.g. an anchor of each code]
+func (s *StratumServer) withHelp(reply *ErrorReply) *ErrorReply {
+	helpURL := s.currentConfig().Stratum.ErrorHelpURL
+	if helpURL == "" {
+		return reply
+	}
+	helpURL = strings.Replace(helpURL, "{code}", strconv.Itoa(reply.Code), -1)
+	return &ErrorReply{Code: reply.Code, Message: reply.Message + " - see " + helpURL}
 }
 
 func (cs *Session) sendError(id *json.RawMessage, reply *ErrorReply, drop bool) error {
-	cs.Lock()
-	defer cs.Unlock()
 	message := JSONRpcResp{Id: id, Version: "2.0", Error: reply}
-	err := cs.enc.Encode(&message)
+	err := cs.enqueue(&message)
 	if err != nil {
 		return err
 	}
@@ -495,26 +1138,135 @@ func (cs *Session) sendError(id *json.RawMessage, reply *ErrorReply, drop bool)
 	return nil
 }
 
-func (s *StratumServer) setDeadline(conn *net.TCPConn) {
-	conn.SetDeadline(time.Now().Add(s.timeout))
+// Extends the read deadline of the connection, write deadlines are set per write by the session writeLoop
+func (s *StratumServer) setDeadline(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(s.timeout))
 }
 
-func (s *StratumServer) registerSession(cs *Session) {
-	s.sessionsMu.Lock()
-	defer s.sessionsMu.Unlock()
-	s.sessions[cs] = struct{}{}
+// Registers the session and associates it with the logged in miner. Called again on re-auth, in which case the association is replaced.
+// With collapseDuplicates, older sessions of the miner from the same ip are closed. Returns false without registering if the miner is at maxMinerConnections.
+// Only the shard of the session and the miner are locked [in that order], duplicates and the connection limit are checked against the sessions of the miner alone
+func (s *StratumServer) registerSession(cs *Session, miner *Miner) bool {
+	cfg := s.currentConfig().Stratum
+	var duplicates []*Session
+
+	shard := s.sessions.GetShard(cs)
+	shard.Lock()
+	_, registered := shard.Items[cs]
+	prevMiner := cs.miner
+
+	miner.sessionsMu.Lock()
+	if miner.sessions == nil {
+		miner.sessions = make(map[*Session]struct{})
+	}
+	// Farm sessions share the miner and ip of the farm, they are neither collapsed nor limited
+	if cfg.CollapseDuplicates && cs.farm == "" {
+		for other := range miner.sessions {
+			if other != cs && other.ip == cs.ip {
+				duplicates = append(duplicates, other)
+			}
+		}
+	}
+
+	// Sessions of the miner once the duplicates are closed, not counting this one when it re-authenticates as the same miner
+	sessions := len(miner.sessions) - len(duplicates)
+	if _, ok := miner.sessions[cs]; ok {
+		sessions--
+	}
+	if cfg.MaxMinerConnections > 0 && sessions >= cfg.MaxMinerConnections && cs.farm == "" {
+		miner.sessionsMu.Unlock()
+		shard.Unlock()
+		atomic.AddInt64(&s.rejectedMinerLogins, 1)
+		return false
+	}
+	miner.sessions[cs] = struct{}{}
+	// The login got the miner before evictOfflineMiners removed it, it is put back so the shares of the session are not credited to a miner missing from s.miners
+	if atomic.LoadInt64(&miner.EvictedAt) > 0 {
+		atomic.StoreInt64(&miner.EvictedAt, 0)
+		s.miners.Set(miner.Id, miner)
+	}
+	miner.sessionsMu.Unlock()
+
+	// On re-auth the session is released from its previous miner, after the new miner is unlocked so two miners are never locked at once
+	if registered && prevMiner != nil && prevMiner != miner && prevMiner.detachSession(cs) == 0 {
+		s.queueMinerRelease(prevMiner)
+	}
+	cs.miner = miner
+	shard.Items[cs] = struct{}{}
+	shard.Unlock()
+
+	// removeSession locks the shards of the duplicates, so they are closed once the shard of this session is released
+	for _, other := range duplicates {
+		StratumInfoLogger.Printf("[Stratum] Closing older session of miner %v@%v, logged in again from the same ip", miner.Id, other.ip)
+		atomic.AddInt64(&s.duplicateSessions, 1)
+		s.removeSession(other)
+	}
+	return true
 }
 
 func (s *StratumServer) removeSession(cs *Session) {
-	s.sessionsMu.Lock()
-	defer s.sessionsMu.Unlock()
-	delete(s.sessions, cs)
+	shard := s.sessions.GetShard(cs)
+	shard.Lock()
+	defer shard.Unlock()
+
+	// removeSession can be called more than once per session (job transmit error and client disconnect), only notify on the first
+	if _, ok := shard.Items[cs]; ok && cs.miner != nil {
+		s.webhooks.MinerDisconnected(cs.miner, cs.ip)
+		if cs.miner.detachSession(cs) == 0 {
+			StratumInfoLogger.Printf("[Stratum] Last session of miner %v@%v closed", cs.miner.Id, cs.ip)
+			s.queueMinerRelease(cs.miner)
+		}
+	}
+	delete(shard.Items, cs)
+
+	// Close the connection as well, a session removed on a job transmit error would otherwise keep reading requests without receiving jobs. The writer closes it once
+	// the messages already queued [e.g. the error reply of a dropped session] are written
+	cs.closeQueue()
+}
+
+// Removes the session from the live sessions of the miner, returns the number of sessions left
+func (m *Miner) detachSession(cs *Session) int {
+	m.sessionsMu.Lock()
+	defer m.sessionsMu.Unlock()
+	delete(m.sessions, cs)
+	return len(m.sessions)
 }
 
 func (s *StratumServer) registerMiner(miner *Miner) {
 	s.miners.Set(miner.Id, miner)
 }
 
+// Notifies once per worker when it has not submitted an accepted share within the threshold. Notification is reset upon the next accepted share.
+// Addresses registered for notifications are additionally alerted once all of their workers are offline
+func (s *StratumServer) checkOfflineWorkers(threshold time.Duration) {
+	now := util.MakeTimestamp() / 1000
+	maxLastShare := now - int64(threshold/time.Second)
+	lastShares := make(map[string]int64)
+
+	for _, m := range s.miners.Values() {
+		lastShare := atomic.LoadInt64(&m.LastShare)
+		if lastShare > lastShares[m.Address] {
+			lastShares[m.Address] = lastShare
+		}
+		if lastShare == 0 || lastShare > maxLastShare {
+			continue
+		}
+		if atomic.CompareAndSwapInt32(&m.offlineNotified, 0, 1) {
+			StratumErrorLogger.Printf("[Stratum] Worker %v has not submitted a share since %v", m.Id, time.Unix(lastShare, 0))
+			s.webhooks.WorkerOffline(m)
+			s.notifications.WorkerOffline(m)
+			s.telegram.WorkerOffline(m)
+		}
+	}
+
+	s.notifications.checkIdleAddresses(lastShares, maxLastShare)
+}
+
+// Returns the current config. It is swapped as a whole on reload, so read it once for values that have to be consistent with each other
+func (s *StratumServer) currentConfig() *pool.Config {
+	return s.config.Load().(*pool.Config)
+}
+
 func (s *StratumServer) currentBlockTemplate() *BlockTemplate {
 	if t := s.blockTemplate.Load(); t != nil {
 		return t.(*BlockTemplate)
@@ -522,6 +1274,23 @@ func (s *StratumServer) currentBlockTemplate() *BlockTemplate {
 	return nil
 }
 
+// Returns the template of the previous height if jobs of height are still accepted, i.e. height is the height right before the current template's and it was
+// replaced within staleGracePeriod. Returns nil otherwise
+func (s *StratumServer) graceBlockTemplate(t *BlockTemplate, height uint64) *BlockTemplate {
+	grace, err := time.ParseDuration(s.currentConfig().Stratum.StaleGracePeriod)
+	if err != nil || grace <= 0 {
+		return nil
+	}
+	prev, ok := s.prevBlockTemplate.Load().(*BlockTemplate)
+	if !ok || prev == nil || prev.Height != height || t.Height != height+1 {
+		return nil
+	}
+	if time.Since(time.Unix(0, atomic.LoadInt64(&s.templateUpdatedAt))) > grace {
+		return nil
+	}
+	return prev
+}
+
 func (s *StratumServer) currentWork() *BlockTemplate {
 	work := s.blockTemplate.Load()
 	if work != nil {
@@ -531,31 +1300,275 @@ func (s *StratumServer) currentWork() *BlockTemplate {
 	}
 }
 
-// Poll upstreams for health status
+// Poll upstreams for health status. The first upstream [in config order] passing its check and upstreamHealth is used, if none is healthy the first one passing its check
 func (s *StratumServer) checkUpstreams() {
-	candidate := int32(0)
-	backup := false
-
+	passed := make([]bool, len(s.upstreams))
 	for i, v := range s.upstreams {
-		ok, err := v.Check(10, s.config.Address)
+		ok, err := v.Check(s.reserveSize(), s.currentConfig().Address)
 		if err != nil {
-			log.Printf("[Stratum] Upstream %v didn't pass check: %v", v.Name, err)
 			StratumErrorLogger.Printf("[Stratum] Upstream %v didn't pass check: %v", v.Name, err)
 		}
-		if ok && !backup {
+		passed[i] = ok
+	}
+
+	bestHeight := s.bestUpstreamHeight()
+	candidate := int32(-1)
+	fallback := int32(-1)
+	for i, v := range s.upstreams {
+		if !passed[i] {
+			continue
+		}
+		if fallback < 0 {
+			fallback = int32(i)
+		}
+		if healthy, _ := s.upstreamHealth(v, bestHeight); healthy {
 			candidate = int32(i)
-			backup = true
+			break
 		}
 	}
+	if candidate < 0 {
+		candidate = fallback
+	}
+	if candidate < 0 {
+		StratumErrorLogger.Printf("[Stratum] No upstream passed its check, staying on %v", s.rpc().Name)
+		s.telegram.DaemonHealth(s.rpc().Name, false, "check failed")
+		return
+	}
 
-	if s.upstream != candidate {
-		log.Printf("[Stratum] Switching to %v upstream", s.upstreams[candidate].Name)
-		StratumInfoLogger.Printf("[Stratum] Switching to %v upstream", s.upstreams[candidate].Name)
+	current := atomic.LoadInt32(&s.upstream)
+	if current != candidate {
+		_, reason := s.upstreamHealth(s.upstreams[current], bestHeight)
+		if !passed[current] {
+			reason = "check failed"
+		} else if reason == "" {
+			reason = "higher priority upstream is healthy again"
+		}
+		StratumInfoLogger.Printf("[Stratum] Switching from %v to %v upstream: %v", s.upstreams[current].Name, s.upstreams[candidate].Name, reason)
 		atomic.StoreInt32(&s.upstream, candidate)
 	}
+	healthy, reason := s.upstreamHealth(s.upstreams[candidate], bestHeight)
+	s.telegram.DaemonHealth(s.upstreams[candidate].Name, healthy, reason)
+}
+
+// Returns the highest height known from the upstreams' last info poll
+func (s *StratumServer) bestUpstreamHeight() int64 {
+	var best int64
+	for _, v := range s.upstreams {
+		if info := v.Info(); info != nil && info.Height > best {
+			best = info.Height
+		}
+	}
+	return best
+}
+
+// Returns whether the upstream is healthy, and the reason if not: marked sick from rpc errors, last request over upstreamMaxLatency or more than upstreamMaxHeightLag blocks behind bestHeight
+func (s *StratumServer) upstreamHealth(v *rpc.RPCClient, bestHeight int64) (bool, string) {
+	if v.Sick() {
+		return false, "marked sick after repeated rpc errors"
+	}
+	if latency := time.Duration(atomic.LoadInt64(&v.LastLatency)); s.upstreamMaxLatency > 0 && latency > s.upstreamMaxLatency {
+		return false, fmt.Sprintf("latency %v over %v", latency, s.upstreamMaxLatency)
+	}
+	if maxLag := s.currentConfig().UpstreamMaxHeightLag; maxLag > 0 {
+		info := v.Info()
+		if info == nil {
+			return false, "height unknown"
+		}
+		if bestHeight-info.Height > maxLag {
+			return false, fmt.Sprintf("height %v is %v blocks behind %v", info.Height, bestHeight-info.Height, bestHeight)
+		}
+	}
+	return true, ""
+}
+
+// Switches away from the failed upstream to the next healthy one right away, rather than waiting for the next checkUpstreams. Returns the upstream to retry the call with, false if there is none
+func (s *StratumServer) failover(failed *rpc.RPCClient, err error) (*rpc.RPCClient, bool) {
+	if len(s.upstreams) < 2 {
+		return nil, false
+	}
+
+	var failedIndex int
+	for i, v := range s.upstreams {
+		if v == failed {
+			failedIndex = i
+			break
+		}
+	}
+
+	bestHeight := s.bestUpstreamHeight()
+	for n := 1; n < len(s.upstreams); n++ {
+		i := (failedIndex + n) % len(s.upstreams)
+		next := s.upstreams[i]
+		if healthy, _ := s.upstreamHealth(next, bestHeight); !healthy {
+			continue
+		}
+		if atomic.CompareAndSwapInt32(&s.upstream, int32(failedIndex), int32(i)) {
+			StratumErrorLogger.Printf("[Stratum] Upstream %v failed: %v. Failing over to %v upstream", failed.Name, err, next.Name)
+		}
+		return next, true
+	}
+
+	StratumErrorLogger.Printf("[Stratum] Upstream %v failed: %v. No other healthy upstream to fail over to", failed.Name, err)
+	return nil, false
 }
 
 // Loads the current active upstream that is used for getting blocks etc.
+// Validates at startup that at least one upstream daemon is reachable, as well as the wallet if payments are enabled. Exits with a clear message otherwise
+func (s *StratumServer) checkRPCConnectivity() {
+	var reachable int
+	for _, v := range s.upstreams {
+		_, err := v.GetInfo()
+		if err != nil {
+			StratumErrorLogger.Printf("[Stratum] Upstream %s => %s is unreachable: %v", v.Name, v.Url, err)
+			continue
+		}
+		reachable++
+	}
+	if reachable == 0 && s.currentConfig().ProxyMode.Enabled {
+		StratumErrorLogger.Printf("[Stratum] No upstream daemon is reachable, network stats are unavailable until one is")
+	} else if reachable == 0 {
+		StratumErrorLogger.Printf("[Stratum] No upstream daemon is reachable, check upstream host/port/url and login/password in config.json")
+		log.Fatalf("[Stratum] No upstream daemon is reachable, check upstream host/port/url and login/password in config.json")
+	}
+
+	if s.currentConfig().PaymentsConfig.Enabled {
+		_, err := s.walletRPC.GetBalance(s.walletRPC.Url.String())
+		if err != nil {
+			StratumErrorLogger.Printf("[Stratum] Wallet %s is unreachable: %v. Check payments walletHost/walletPort/walletUrl and walletLogin/walletPassword in config.json", s.walletRPC.Url, err)
+			log.Fatalf("[Stratum] Wallet %s is unreachable: %v. Check payments walletHost/walletPort/walletUrl and walletLogin/walletPassword in config.json", s.walletRPC.Url, err)
+		}
+	}
+}
+
+// Toggles maintenance mode. While in maintenance, existing miners keep working but new logins are rejected
+func (s *StratumServer) setMaintenance(enabled bool) {
+	var mode int32
+	if enabled {
+		mode = 1
+	}
+	if atomic.SwapInt32(&s.maintenance, mode) == mode {
+		return
+	}
+	if enabled {
+		StratumInfoLogger.Printf("[Stratum] Entering maintenance mode, new logins will be rejected. Job broadcasts paused: %v", s.currentConfig().Stratum.MaintenancePauseJobs)
+	} else {
+		StratumInfoLogger.Printf("[Stratum] Leaving maintenance mode, accepting new logins")
+	}
+}
+
+func (s *StratumServer) inMaintenance() bool {
+	return atomic.LoadInt32(&s.maintenance) == 1
+}
+
+// Stats-only mode: serves the api from the shared storage with no stratum listeners, block template refresh, miner stats writes or payouts.
+// The daemon upstreams are only used by the api for last block info
+func NewStatsServer(cfg *pool.Config) *StratumServer {
+	stratum := &StratumServer{statsOnly: true, startedAt: time.Now().Unix()}
+	applyDiffProfiles(cfg)
+	stratum.config.Store(cfg)
+
+	Graviton_backend.ReadOnly = true
+	Graviton_backend.NewGravDB(cfg.PoolHost, "pooldb", cfg.GravitonMigrateWait, cfg.GravitonMaxSnapshots)
+	NewStorageBackend(cfg)
+
+	stratum.upstreams = newUpstreams(cfg)
+	if len(stratum.upstreams) == 0 {
+		log.Fatal("[Stratum] No enabled upstream defined, stats-only mode requires a daemon for last block info")
+	}
+	StratumInfoLogger.Printf("[Stratum] Default upstream: %s => %s", stratum.rpc().Name, stratum.rpc().Url)
+
+	stratum.miners = NewMinersMap()
+	stratum.sessions = NewSessionsMap()
+	// Miners are released from memory once their last session closes, see releaseMiners
+	stratum.releaseQueue = make(chan *Miner, minerReleaseQueueSize)
+	go stratum.releaseMiners()
+	stratum.algo = cfg.Algo
+	stratum.loadDiffOverrides()
+	stratum.addressLists = NewAddressLists()
+
+	// Live stats in stats-only mode only carry the stats and network events of the stats collection, blocks and payments are published by the pool process
+	if cfg.API.LiveStats {
+		stratum.live = NewLiveHub(&cfg.API)
+	}
+
+	hashExpiration, _ := time.ParseDuration(cfg.HashrateExpiration)
+	stratum.hashrateExpiration = hashExpiration
+
+	hashWindow, _ := time.ParseDuration(cfg.API.HashrateWindow)
+	stratum.estimationWindow = hashWindow
+
+	if cfg.DonationAddress != "" {
+		stratum.donateID = cfg.DonationAddress
+	} else {
+		stratum.donateID = cfg.Address
+	}
+
+	StratumInfoLogger.Printf("[Stratum] Running in stats-only mode, stratum listeners, block template refresh and payouts are disabled")
+
+	return stratum
+}
+
+func (s *StratumServer) loadDiffOverrides() {
+	s.diffOverrides = Graviton_backend.GetDiffOverrides()
+	if s.diffOverrides == nil {
+		s.diffOverrides = make(map[string]int64)
+	}
+	for id, diff := range s.diffOverrides {
+		StratumInfoLogger.Printf("[Stratum] Difficulty override for %v: %v", id, diff)
+	}
+}
+
+// Returns the admin difficulty override of the miner, 0 if not overridden
+func (s *StratumServer) getDiffOverride(miner *Miner) int64 {
+	if miner == nil {
+		return 0
+	}
+	s.diffOverridesMu.RLock()
+	defer s.diffOverridesMu.RUnlock()
+	return s.diffOverrides[miner.Id]
+}
+
+// Sets the difficulty override for the miner id, which applies from the next job push and persists until cleared with a diff of 0
+func (s *StratumServer) setDiffOverride(id string, diff int64) error {
+	s.diffOverridesMu.Lock()
+	if diff > 0 {
+		s.diffOverrides[id] = diff
+	} else {
+		delete(s.diffOverrides, id)
+	}
+	overrides := make(map[string]int64)
+	for k, v := range s.diffOverrides {
+		overrides[k] = v
+	}
+	s.diffOverridesMu.Unlock()
+
+	writeWait, _ := time.ParseDuration("10ms")
+	for Graviton_backend.Writing == 1 {
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	err := Graviton_backend.OverwriteDiffOverrides(overrides)
+	Graviton_backend.Writing = 0
+	return err
+}
+
+// Returns rpc clients for each enabled upstream in cfg.Upstream
+func newUpstreams(cfg *pool.Config) []*rpc.RPCClient {
+	var upstreams []*rpc.RPCClient
+	for _, f := range cfg.Upstream {
+		if !f.Enabled {
+			continue
+		}
+		client, err := rpc.NewRPCClient(&f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		upstreams = append(upstreams, client)
+		StratumInfoLogger.Printf("[Stratum] Upstream: %s => %s", client.Name, client.Url)
+	}
+	return upstreams
+}
+
 func (s *StratumServer) rpc() *rpc.RPCClient {
 	i := atomic.LoadInt32(&s.upstream)
 	return s.upstreams[i]
@@ -568,8 +1581,16 @@ func (s *StratumServer) markSick() {
 
 // Checks if the stratum server is sick based on failsCount and if healthcheck is true, to see if >= maxfails from config.json
 func (s *StratumServer) isSick() bool {
+	// A daemon confirmed stuck by the block template watchdog marks the pool sick regardless of healthCheck
+	if atomic.LoadInt32(&s.templateStuck) == 1 {
+		return true
+	}
+	// In proxy mode there is no work while the pool is not logged in to the upstream pool
+	if s.proxy != nil && !s.proxy.ready() {
+		return true
+	}
 	x := atomic.LoadInt64(&s.failsCount)
-	if s.config.Stratum.HealthCheck && x >= s.config.Stratum.MaxFails {
+	if s.currentConfig().Stratum.HealthCheck && x >= s.currentConfig().Stratum.MaxFails {
 		return true
 	}
 	return false
@@ -585,47 +1606,116 @@ func (s *StratumServer) markOk() {
 // our clean up procedure and exiting the program.
 // Reference: https://golangcode.com/handle-ctrl-c-exit-in-terminal/
 func (s *StratumServer) SetupCloseHandler() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-c
-		log.Printf("\r- Ctrl+C pressed in Terminal")
-		StratumInfoLogger.Printf("\r- Ctrl+C pressed in Terminal")
-		log.Printf("Closing - syncing miner stats...")
-		StratumInfoLogger.Printf("Closing - syncing miner stats...")
-
-		writeWait, _ := time.ParseDuration("10ms")
-		for Graviton_backend.Writing == 1 {
-			//log.Printf("[Stratum-writeminerstats] GravitonDB is writing... sleeping for %v...", writeWait)
-			//StorageInfoLogger.Printf("[Stratum-writeminerstats] GravitonDB is writing... sleeping for %v...", writeWait)
-			time.Sleep(writeWait)
-		}
-		Graviton_backend.Writing = 1
-		err := Graviton_backend.WriteMinerStats(s.miners, s.hashrateExpiration)
-		err2 := Graviton_backend.UpdatePoolRoundStats(s.miners, false)
-		Graviton_backend.Writing = 0
-		if err != nil {
-			log.Printf("[Stratum] Err storing miner stats: %v", err)
-			StratumErrorLogger.Printf("[Stratum] Err storing miner stats: %v", err)
-		}
-		if err2 != nil {
-			log.Printf("[Stratum] Err storing miner round stats: %v", err2)
-			StratumErrorLogger.Printf("[Stratum] Err storing miner round stats: %v", err2)
-		}
-		// Add 1 second sleep prior to closing to prevent writeminerstats issues
-		time.Sleep(time.Second)
-		Graviton_backend.DB.Close()
+		sig := <-c
+		StratumInfoLogger.Printf("[Stratum] %v received, shutting down", sig)
+		s.shutdown()
 		os.Exit(0)
 	}()
 }
 
-func logFileOutStratum(lType string) *log.Logger {
-	var logFileName string
-	if lType == "ERROR" {
-		logFileName = "logs/stratumError.log"
-	} else {
-		logFileName = "logs/stratum.log"
+// Counts a request in flight, so shutdown can wait for shares being processed. Returns false without counting it once shutdown stopped handling requests.
+// Counted before the check, so shutdown either sees the request in flight or the request sees it stopped
+func (s *StratumServer) beginRequest() bool {
+	atomic.AddInt64(&s.inFlightRequests, 1)
+	if atomic.LoadInt32(&s.shuttingDown) == shutdownStopped {
+		atomic.AddInt64(&s.inFlightRequests, -1)
+		return false
+	}
+	return true
+}
+
+func (s *StratumServer) endRequest() {
+	atomic.AddInt64(&s.inFlightRequests, -1)
+}
+
+// Drains the stratum before exit: new connections and logins are refused, in-flight requests get up to shutdownGracePeriod to finish, each session is told the pool is restarting and closed,
+// then miner stats and round stats are flushed to the backend
+func (s *StratumServer) shutdown() {
+	atomic.StoreInt32(&s.shuttingDown, shutdownDraining)
+
+	s.listenersMu.Lock()
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.listenersMu.Unlock()
+
+	grace, err := time.ParseDuration(s.currentConfig().Stratum.ShutdownGracePeriod)
+	if err != nil || grace < 0 {
+		grace = 10 * time.Second
+	}
+	StratumInfoLogger.Printf("[Stratum] Stopped accepting connections, waiting up to %v for in-flight requests", grace)
+
+	deadline := time.Now().Add(grace)
+	for atomic.LoadInt64(&s.inFlightRequests) > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
 	}
+	if pending := atomic.LoadInt64(&s.inFlightRequests); pending > 0 {
+		StratumWarnLogger.Printf("[Stratum] Grace period over with %v requests still in flight", pending)
+	}
+
+	sessions := s.sessions.Values()
+
+	StratumInfoLogger.Printf("[Stratum] Closing %v sessions", len(sessions))
+	for _, cs := range sessions {
+		// Queued behind the pending messages of the session, the writer then closes the connection. A stalled miner does not hold up the shutdown as writes are not waited on
+		cs.pushMessage("close", &WelcomeMessageParams{Message: "Pool is restarting, please reconnect"})
+		cs.closeQueue()
+	}
+
+	// No request is handled from here on, the ones still in flight past the grace period are waited on so none journals a share after the flush
+	atomic.StoreInt32(&s.shuttingDown, shutdownStopped)
+	for waited := time.Duration(0); atomic.LoadInt64(&s.inFlightRequests) > 0; waited += 50 * time.Millisecond {
+		if waited > 0 && waited%(5*time.Second) == 0 {
+			StratumWarnLogger.Printf("[Stratum] Still waiting for %v requests in flight", atomic.LoadInt64(&s.inFlightRequests))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Handlers are done, no more shares are journaled
+	s.flushRoundJournal()
+
+	StratumInfoLogger.Printf("Closing - syncing miner stats...")
+
+	writeWait, _ := time.ParseDuration("10ms")
+	for Graviton_backend.Writing == 1 {
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	err = Graviton_backend.WriteMinerStats(s.miners, s.hashrateExpiration)
+	err2 := Storage_backend.UpdatePoolRoundStats(s.miners, false)
+	if err2 == nil {
+		// Nothing should be buffered anymore, flushed again so the compaction can not drop an entry it did not see
+		s.flushRoundJournal()
+		s.compactRoundJournal()
+	}
+	s.storePPLNSWindow()
+	Graviton_backend.Writing = 0
+	if err != nil {
+		StratumErrorLogger.Printf("[Stratum] Err storing miner stats: %v", err)
+	}
+	if err2 != nil {
+		StratumErrorLogger.Printf("[Stratum] Err storing miner round stats: %v", err2)
+	}
+	// Add 1 second sleep prior to closing to prevent writeminerstats issues
+	time.Sleep(time.Second)
+	Graviton_backend.Close()
+}
+
+// States of shuttingDown: logins are refused once shutting down, requests once stopped
+const (
+	shutdownDraining = 1
+	shutdownStopped  = 2
+)
+
+func (s *StratumServer) isShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) != 0
+}
+
+func logFileOutStratum(lType string) *util.Logger {
+	logFileName := util.LogFileName("stratum", lType)
 	os.Mkdir("logs", 0705)
 	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0705)
 	if err != nil {
@@ -634,5 +1724,5 @@ func logFileOutStratum(lType string) *log.Logger {
 
 	logType := lType + ": "
 	l := log.New(f, logType, log.LstdFlags|log.Lmicroseconds)
-	return l
+	return util.NewLogger("stratum", lType, l)
 }
@@ -0,0 +1,502 @@
+package stratum
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// A telegram chat linked to an address through the bot /start deep link, it is sent the blocks found, payments and workers going offline of the address
+type TelegramLink struct {
+	Address  string
+	ChatId   string
+	Username string `json:",omitempty"`
+	LinkedAt int64
+}
+
+type TelegramProcessor struct {
+	config    *pool.TelegramConfig
+	coinUnits int64
+	client    *http.Client
+	apiURL    string
+	queue     chan *telegramMessage
+	mu        sync.RWMutex
+	links     []*TelegramLink
+	// Deep link tokens by token, the address each links and when it expires
+	pending       map[string]*telegramPending
+	daemonHealthy map[string]bool
+}
+
+type telegramMessage struct {
+	chatId string
+	text   string
+}
+
+type telegramPending struct {
+	address string
+	expires int64
+}
+
+type telegramUpdate struct {
+	UpdateId int64 `json:"update_id"`
+	Message  *struct {
+		Text string `json:"text"`
+		Chat struct {
+			Id int64 `json:"id"`
+		} `json:"chat"`
+		From *struct {
+			Username string `json:"username"`
+		} `json:"from"`
+	} `json:"message"`
+}
+
+// Long polling timeout of getUpdates, how long a deep link token is valid, the most deep link tokens pending at once and the pause between two messages
+// [telegram limits bots to about 30 messages per second]
+const (
+	telegramPollTimeout = 30 * time.Second
+	telegramLinkTTL     = time.Hour
+	telegramMaxPending  = 10000
+	telegramSendPause   = 50 * time.Millisecond
+)
+
+var TelegramInfoLogger = logFileOutTelegram("INFO")
+var TelegramErrorLogger = logFileOutTelegram("ERROR")
+
+func NewTelegramProcessor(cfg *pool.TelegramConfig, coinUnits int64) *TelegramProcessor {
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil || timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = 1024
+	}
+
+	t := &TelegramProcessor{
+		config:        cfg,
+		coinUnits:     coinUnits,
+		client:        &http.Client{Timeout: timeout + telegramPollTimeout},
+		apiURL:        "https://api.telegram.org/bot" + cfg.BotToken + "/",
+		queue:         make(chan *telegramMessage, queueSize),
+		pending:       make(map[string]*telegramPending),
+		daemonHealthy: make(map[string]bool),
+	}
+	return t
+}
+
+func (t *TelegramProcessor) Start() {
+	if stored := Storage_backend.GetTelegramLinks(); stored != nil {
+		t.links = stored
+	}
+	TelegramInfoLogger.Printf("[Telegram] Starting telegram bot %v with %v linked chats, operator chat: %v, announce chat: %v", t.config.BotName, len(t.links), t.config.OperatorChat != "", t.config.AnnounceChat != "")
+
+	go func() {
+		for msg := range t.queue {
+			if err := t.send(msg.chatId, msg.text); err != nil {
+				TelegramErrorLogger.Printf("[Telegram] Failed to send message to chat %v: %v", msg.chatId, err)
+			}
+			time.Sleep(telegramSendPause)
+		}
+	}()
+	go t.poll()
+
+	// Expired deep link tokens are pruned on a timer, links requested but never opened would otherwise stay in pending
+	go func() {
+		ticker := time.NewTicker(telegramLinkTTL / 4)
+		for range ticker.C {
+			t.prunePending()
+		}
+	}()
+}
+
+func (t *TelegramProcessor) prunePending() {
+	now := util.MakeTimestamp() / 1000
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, v := range t.pending {
+		if v.expires <= now {
+			delete(t.pending, k)
+		}
+	}
+}
+
+// Returns a deep link to the bot which links the chat opening it to address, valid for telegramLinkTTL
+func (t *TelegramProcessor) deepLink(address string) (string, int64, error) {
+	if t.config.BotName == "" {
+		return "", 0, errors.New("telegram botName is not configured")
+	}
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", 0, err
+	}
+	// Start parameters are limited to 64 characters, too short for an address, the token stands in for it
+	token := hex.EncodeToString(tokenBytes)
+	now := util.MakeTimestamp() / 1000
+	expires := now + int64(telegramLinkTTL/time.Second)
+
+	t.mu.Lock()
+	if len(t.pending) >= telegramMaxPending {
+		t.mu.Unlock()
+		return "", 0, errors.New("too many telegram links pending, try again later")
+	}
+	t.pending[token] = &telegramPending{address: address, expires: expires}
+	t.mu.Unlock()
+
+	return "https://t.me/" + strings.TrimPrefix(t.config.BotName, "@") + "?start=" + token, expires, nil
+}
+
+// Returns the number of chats linked to address
+func (t *TelegramProcessor) linkedChats(address string) int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	count := 0
+	for _, link := range t.links {
+		if link.Address == address {
+			count++
+		}
+	}
+	return count
+}
+
+// Polls the bot updates and answers the /start [link] and /stop [unlink] commands
+func (t *TelegramProcessor) poll() {
+	var offset int64
+	for {
+		updates, err := t.getUpdates(offset)
+		if err != nil {
+			TelegramErrorLogger.Printf("[Telegram] Error getting bot updates: %v", err)
+			time.Sleep(telegramPollTimeout / 6)
+			continue
+		}
+		for _, update := range updates {
+			offset = update.UpdateId + 1
+			if update.Message == nil {
+				continue
+			}
+			var username string
+			if update.Message.From != nil {
+				username = update.Message.From.Username
+			}
+			t.command(strconv.FormatInt(update.Message.Chat.Id, 10), username, update.Message.Text)
+		}
+	}
+}
+
+func (t *TelegramProcessor) command(chatId, username, text string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return
+	}
+
+	switch fields[0] {
+	case "/start":
+		if len(fields) < 2 {
+			t.enqueue(chatId, "Open the telegram link of your miner page on the pool to receive alerts for your address here. Send /stop to stop them.")
+			return
+		}
+		address, err := t.link(chatId, username, fields[1])
+		if err != nil {
+			t.enqueue(chatId, "Could not link this chat: "+err.Error())
+			return
+		}
+		t.enqueue(chatId, "Linked to "+shortAddress(address)+". You will be sent its blocks found, payments and workers going offline. Send /stop to stop them.")
+	case "/stop":
+		if count := t.unlink(chatId); count > 0 {
+			t.enqueue(chatId, fmt.Sprintf("Unlinked this chat from %v addresses.", count))
+		} else {
+			t.enqueue(chatId, "This chat is not linked to any address.")
+		}
+	}
+}
+
+// Links the chat to the address of the deep link token, a token is used up once linked
+func (t *TelegramProcessor) link(chatId, username, token string) (string, error) {
+	now := util.MakeTimestamp() / 1000
+	t.mu.Lock()
+	pending := t.pending[token]
+	delete(t.pending, token)
+	if pending == nil || pending.expires <= now {
+		t.mu.Unlock()
+		return "", errors.New("the link is invalid or expired, open a new one from the pool")
+	}
+	for _, link := range t.links {
+		if link.Address == pending.address && link.ChatId == chatId {
+			t.mu.Unlock()
+			return pending.address, nil
+		}
+	}
+	t.links = append(t.links, &TelegramLink{Address: pending.address, ChatId: chatId, Username: username, LinkedAt: now})
+	t.mu.Unlock()
+
+	TelegramInfoLogger.Printf("[Telegram] Linked chat %v to %v", chatId, pending.address)
+	return pending.address, t.store()
+}
+
+// Removes the links of the chat, returns how many it had
+func (t *TelegramProcessor) unlink(chatId string) int {
+	t.mu.Lock()
+	links := t.links[:0]
+	for _, link := range t.links {
+		if link.ChatId != chatId {
+			links = append(links, link)
+		}
+	}
+	count := len(t.links) - len(links)
+	t.links = links
+	t.mu.Unlock()
+
+	if count > 0 {
+		TelegramInfoLogger.Printf("[Telegram] Unlinked chat %v from %v addresses", chatId, count)
+		if err := t.store(); err != nil {
+			TelegramErrorLogger.Printf("[Telegram] Error storing links: %v", err)
+		}
+	}
+	return count
+}
+
+func (t *TelegramProcessor) store() error {
+	t.mu.RLock()
+	links := make([]*TelegramLink, len(t.links))
+	copy(links, t.links)
+	t.mu.RUnlock()
+
+	writeWait, _ := time.ParseDuration("10ms")
+	for Graviton_backend.Writing == 1 {
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	err := Storage_backend.OverwriteTelegramLinks(links)
+	Graviton_backend.Writing = 0
+	return err
+}
+
+// Queues text to every chat linked to address
+func (t *TelegramProcessor) notifyAddress(address, text string) {
+	t.mu.RLock()
+	var chats []string
+	for _, link := range t.links {
+		if link.Address == address {
+			chats = append(chats, link.ChatId)
+		}
+	}
+	t.mu.RUnlock()
+
+	for _, chatId := range chats {
+		t.enqueue(chatId, text)
+	}
+}
+
+func (t *TelegramProcessor) BlockFound(miner *Miner, height int64, hash string, reward uint64) {
+	if t == nil {
+		return
+	}
+	kind := "pool"
+	if miner.IsSolo {
+		kind = "solo"
+	}
+	if t.config.AnnounceChat != "" {
+		t.enqueue(t.config.AnnounceChat, fmt.Sprintf("Block %v found [%v], reward %v DERO, hash %v", height, kind, t.coins(reward), hash))
+	}
+	t.notifyAddress(miner.Address, fmt.Sprintf("Your worker %v found block %v [%v], reward %v DERO", miner.WorkID, height, kind, t.coins(reward)))
+}
+
+func (t *TelegramProcessor) PaymentConfirmed(address string, amount uint64, txHash string, height uint64) {
+	if t == nil {
+		return
+	}
+	t.notifyAddress(address, fmt.Sprintf("Payment of %v DERO to %v confirmed at height %v, tx %v", t.coins(amount), shortAddress(address), height, txHash))
+}
+
+func (t *TelegramProcessor) WorkerOffline(miner *Miner) {
+	if t == nil {
+		return
+	}
+	lastShare := time.Unix(atomic.LoadInt64(&miner.LastShare), 0).UTC().Format("2006-01-02 15:04:05")
+	t.notifyAddress(miner.Address, fmt.Sprintf("Worker %v of %v is offline, last share at %v UTC", miner.WorkID, shortAddress(miner.Address), lastShare))
+}
+
+// Payouts paused [walletPaused], running underfunded [walletUnderfunded] or resumed [walletResumed] by the wallet health check, or the hot wallet balance to sweep [walletSweep], sent to the operator chat
+func (t *TelegramProcessor) WalletAlert(event string, health *WalletHealth) {
+	if t == nil || t.config.OperatorChat == "" {
+		return
+	}
+	switch event {
+	case "walletPaused":
+		t.enqueue(t.config.OperatorChat, fmt.Sprintf("Payouts paused: %v. Unlocked balance %v DERO, pending %v DERO", health.Reason, t.coins(health.UnlockedBalance), t.coins(health.Pending)))
+	case "walletUnderfunded":
+		t.enqueue(t.config.OperatorChat, fmt.Sprintf("Payments wallet underfunded: %v. Unlocked balance %v DERO, pending %v DERO. Paying in order until it runs out", health.Reason, t.coins(health.UnlockedBalance), t.coins(health.Pending)))
+	case "walletSweep":
+		message := fmt.Sprintf("Hot wallet unlocked balance %v DERO is above the buffer of %v DERO and %v DERO pending, sweep %v DERO to cold storage", t.coins(health.UnlockedBalance), t.coins(health.Buffer), t.coins(health.Pending), t.coins(health.Sweep))
+		if health.ColdAddress != "" {
+			message += " at " + shortAddress(health.ColdAddress)
+		}
+		t.enqueue(t.config.OperatorChat, message)
+	default:
+		t.enqueue(t.config.OperatorChat, fmt.Sprintf("Payouts resumed. Unlocked balance %v DERO, pending %v DERO", t.coins(health.UnlockedBalance), t.coins(health.Pending)))
+	}
+}
+
+// Reject or stale rate of a scope above its threshold [raised] or back below it. Pool and port alarms go to the operator chat, miner and worker alarms to the chats linked to the address
+func (t *TelegramProcessor) RejectAlarm(raised bool, scope *rejectScope, kind string, rate float64, shares int64) {
+	if t == nil {
+		return
+	}
+	var subject string
+	switch scope.scope {
+	case "pool":
+		subject = "Pool"
+	case "port":
+		subject = "Port " + scope.name
+	case "miner":
+		subject = "Your miners"
+	default:
+		subject = "Your worker " + scope.worker
+	}
+	message := fmt.Sprintf("%v %v rate is back to %.2f%% over the last %v shares", subject, kind, rate*100, shares)
+	if raised {
+		message = fmt.Sprintf("%v %v rate is %.2f%% over the last %v shares", subject, kind, rate*100, shares)
+	}
+
+	if scope.address == "" {
+		if t.config.OperatorChat != "" {
+			t.enqueue(t.config.OperatorChat, message)
+		}
+		return
+	}
+	t.notifyAddress(scope.address, message)
+}
+
+// Inconsistencies found by the startup state check, sent to the operator chat when the pool boots into safe mode
+func (t *TelegramProcessor) SafeMode(issues []string) {
+	if t == nil || t.config.OperatorChat == "" {
+		return
+	}
+	t.enqueue(t.config.OperatorChat, fmt.Sprintf("Pool started in safe mode, crediting and payouts are paused until acknowledged: %v", strings.Join(issues, "; ")))
+}
+
+// Health of the daemon upstream in use from the upstream check, sent to the operator chat when it changes
+func (t *TelegramProcessor) DaemonHealth(name string, healthy bool, reason string) {
+	if t == nil || t.config.OperatorChat == "" {
+		return
+	}
+	t.mu.Lock()
+	previous, known := t.daemonHealthy[name]
+	t.daemonHealthy[name] = healthy
+	t.mu.Unlock()
+	if (!known && healthy) || previous == healthy {
+		return
+	}
+
+	if healthy {
+		t.enqueue(t.config.OperatorChat, fmt.Sprintf("Daemon %v is healthy again", name))
+	} else {
+		t.enqueue(t.config.OperatorChat, fmt.Sprintf("Daemon %v is sick: %v", name, reason))
+	}
+}
+
+// Returns the atomic amount in DERO
+func (t *TelegramProcessor) coins(amount uint64) string {
+	if t.coinUnits <= 1 {
+		return strconv.FormatUint(amount, 10)
+	}
+	return strconv.FormatFloat(float64(amount)/float64(t.coinUnits), 'f', -1, 64)
+}
+
+// Returns the start and end of the address, telegram messages can be shown in notifications where the whole address does not fit
+func shortAddress(address string) string {
+	if len(address) <= 16 {
+		return address
+	}
+	return address[:8] + "..." + address[len(address)-5:]
+}
+
+// Queues the message without blocking the caller [stratum hot path]. If the queue is full, the message is dropped
+func (t *TelegramProcessor) enqueue(chatId, text string) {
+	select {
+	case t.queue <- &telegramMessage{chatId: chatId, text: text}:
+	default:
+		TelegramErrorLogger.Printf("[Telegram] Queue is full, dropping message to chat %v", chatId)
+	}
+}
+
+func (t *TelegramProcessor) getUpdates(offset int64) ([]*telegramUpdate, error) {
+	query := url.Values{}
+	query.Set("offset", strconv.FormatInt(offset, 10))
+	query.Set("timeout", strconv.Itoa(int(telegramPollTimeout/time.Second)))
+	query.Set("allowed_updates", `["message"]`)
+
+	var updates []*telegramUpdate
+	err := t.call("getUpdates?"+query.Encode(), nil, &updates)
+	return updates, err
+}
+
+func (t *TelegramProcessor) send(chatId, text string) error {
+	payload, err := json.Marshal(map[string]interface{}{"chat_id": chatId, "text": text, "disable_web_page_preview": true})
+	if err != nil {
+		return err
+	}
+	return t.call("sendMessage", payload, nil)
+}
+
+// Calls the bot api method, a POST of the json payload if there is one. The result of the reply is decoded into result
+func (t *TelegramProcessor) call(method string, payload []byte, result interface{}) error {
+	var resp *http.Response
+	var err error
+	if payload != nil {
+		resp, err = t.client.Post(t.apiURL+method, "application/json", bytes.NewBuffer(payload))
+	} else {
+		resp, err = t.client.Get(t.apiURL + method)
+	}
+	if err != nil {
+		// The url holds the bot token, it is kept out of the logs
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		Ok          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("unexpected response status %v", resp.Status)
+	}
+	if !reply.Ok {
+		return fmt.Errorf("%v: %v", resp.Status, reply.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(reply.Result, result)
+	}
+	return nil
+}
+
+func logFileOutTelegram(lType string) *util.Logger {
+	logFileName := util.LogFileName("telegram", lType)
+	os.Mkdir("logs", 0705)
+	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0705)
+	if err != nil {
+		panic(err)
+	}
+
+	logType := lType + ": "
+	l := log.New(f, logType, log.LstdFlags|log.Lmicroseconds)
+	return util.NewLogger("telegram", lType, l)
+}
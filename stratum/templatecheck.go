@@ -0,0 +1,125 @@
+package stratum
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Nelbert442/dero-golang-pool/rpc"
+)
+
+// Difficulties of the last templateDiffHistory heights fetched are the reference of the difficulty sanity check, and at least templateDiffMinHistory are needed
+// before it applies. Rejected templates are counted as well, so a genuine difficulty shift is accepted once it persisted over a few heights
+const (
+	templateDiffHistory    = 10
+	templateDiffMinHistory = 3
+)
+
+// Checks of the templates fetched from the daemon before they are broadcast, so a malformed template from a glitching daemon is not sent to every miner
+type TemplateChecks struct {
+	sync.Mutex
+	heights      []uint64
+	diffs        []uint64
+	lastRejected string
+	// Templates rejected since start by reason
+	rejected map[string]int64
+}
+
+// Returns the median difficulty of the recent heights, 0 without enough history
+func (c *TemplateChecks) medianDiff() uint64 {
+	if len(c.diffs) < templateDiffMinHistory {
+		return 0
+	}
+	diffs := make([]uint64, len(c.diffs))
+	copy(diffs, c.diffs)
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i] < diffs[j] })
+	return diffs[len(diffs)/2]
+}
+
+func (c *TemplateChecks) recordDiff(height, diff uint64) {
+	for _, h := range c.heights {
+		if h == height {
+			return
+		}
+	}
+	c.heights = append(c.heights, height)
+	c.diffs = append(c.diffs, diff)
+	if len(c.heights) > templateDiffHistory {
+		c.heights = c.heights[1:]
+		c.diffs = c.diffs[1:]
+	}
+}
+
+// Returns the rejected templates by reason
+func (c *TemplateChecks) rejects() map[string]int64 {
+	c.Lock()
+	defer c.Unlock()
+	rejects := make(map[string]int64)
+	for reason, count := range c.rejected {
+		rejects[reason] = count
+	}
+	return rejects
+}
+
+// Validates the template reply against the current template t: decodable blobs, the reserved space within the hashing blob, no lower height than t and a difficulty
+// within blockTemplateMaxDiffChange of the recent heights. With relaxed [the stalled template watchdog], lower heights and difficulty changes are accepted.
+// Returns the decoded hashing blob, or the error the template was rejected for
+func (s *StratumServer) validateTemplate(reply *rpc.GetBlockTemplateReply, t *BlockTemplate, reserveSize int, relaxed bool) ([]byte, error) {
+	c := &s.templateChecks
+	c.Lock()
+	defer c.Unlock()
+
+	buffer, reason, err := s.checkTemplate(reply, t, reserveSize, relaxed)
+	if err == nil {
+		c.lastRejected = ""
+		return buffer, nil
+	}
+
+	if c.rejected == nil {
+		c.rejected = make(map[string]int64)
+	}
+	c.rejected[reason]++
+	// A rejected template is fetched again every blockRefreshInterval, it is only logged once
+	if key := fmt.Sprintf("%v:%s:%s", reply.Height, reply.Prev_Hash, reason); key != c.lastRejected {
+		c.lastRejected = key
+		BlocksErrorLogger.Printf("[Blocks] Rejected block template at height %v, prev_hash: %s: %v", reply.Height, reply.Prev_Hash, err)
+	}
+	return nil, err
+}
+
+// Runs the template checks, c must be locked
+func (s *StratumServer) checkTemplate(reply *rpc.GetBlockTemplateReply, t *BlockTemplate, reserveSize int, relaxed bool) ([]byte, string, error) {
+	c := &s.templateChecks
+
+	if _, err := hex.DecodeString(reply.Blocktemplate_blob); err != nil || reply.Blocktemplate_blob == "" {
+		return nil, "blob", fmt.Errorf("block template blob is not decodable: %v", err)
+	}
+	buffer, err := hex.DecodeString(reply.Blockhashing_blob)
+	if err != nil || len(buffer) == 0 {
+		return nil, "blob", fmt.Errorf("block hashing blob is not decodable: %v", err)
+	}
+	if reply.Reserved_Offset+uint64(reserveSize) > uint64(len(buffer)) {
+		return nil, "reserved", fmt.Errorf("reserved offset %v and size %v are beyond the %v bytes of the hashing blob", reply.Reserved_Offset, reserveSize, len(buffer))
+	}
+	if reply.Height == 0 {
+		return nil, "height", fmt.Errorf("block template has no height")
+	}
+	if reply.Difficulty == 0 {
+		return nil, "difficulty", fmt.Errorf("block template has no difficulty")
+	}
+
+	median := c.medianDiff()
+	c.recordDiff(reply.Height, reply.Difficulty)
+
+	if t != nil && reply.Height < t.Height && !relaxed {
+		return nil, "height", fmt.Errorf("height is below the current template height %v", t.Height)
+	}
+	if maxChange := s.currentConfig().BlockTemplateMaxDiffChange; maxChange > 1 && median > 0 && !relaxed {
+		diff := float64(reply.Difficulty)
+		if diff > float64(median)*maxChange || diff*maxChange < float64(median) {
+			return nil, "difficulty", fmt.Errorf("difficulty %v is more than %vx off the median difficulty %v of the recent heights", reply.Difficulty, maxChange, median)
+		}
+	}
+	return buffer, "", nil
+}
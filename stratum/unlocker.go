@@ -17,10 +17,11 @@ import (
 )
 
 type BlockUnlocker struct {
-	config   *pool.UnlockerConfig
-	rpc      *rpc.RPCClient
-	halt     bool
-	lastFail error
+	config    *pool.UnlockerConfig
+	rpc       *rpc.RPCClient
+	halt      bool
+	lastFail  error
+	donations []pool.Donation
 }
 
 type UnlockResultGrav struct {
@@ -32,6 +33,8 @@ type UnlockResultGrav struct {
 
 var UnlockerInfoLogger = logFileOutUnlocker("INFO")
 var UnlockerErrorLogger = logFileOutUnlocker("ERROR")
+var UnlockerWarnLogger = logFileOutUnlocker("WARN")
+var UnlockerDebugLogger = logFileOutUnlocker("DEBUG")
 
 // Get constant blocks required to mature from derosuite
 const MINER_TX_AMOUNT_UNLOCK = config.MINER_TX_AMOUNT_UNLOCK
@@ -40,20 +43,55 @@ func NewBlockUnlocker(cfg *pool.UnlockerConfig, s *StratumServer) *BlockUnlocker
 	u := &BlockUnlocker{config: cfg}
 	// Set blockunlocker rpc to stratumserver rpc (defined by current default upstream)
 	u.rpc = s.rpc()
+	u.donations = validDonations(cfg.Donations, s.currentConfig().Coin, s.currentConfig().Address)
 	return u
 }
 
+// Returns the donations with a valid address and percent, in order until their percents would add up to 100% or more of the block reward
+func validDonations(donations []pool.Donation, coin, poolAddress string) []pool.Donation {
+	var valid []pool.Donation
+	var total float64
+	for _, donation := range donations {
+		validAddress := util.ValidateAddressNonDERO(donation.Address, poolAddress)
+		if coin == "DERO" {
+			validAddress = util.ValidateAddress(donation.Address, poolAddress)
+		}
+		if !validAddress || donation.Percent <= 0 || total+donation.Percent >= 100 {
+			UnlockerErrorLogger.Printf("[Unlocker] Skipping donation of %v%% to %v, the address is invalid or the donations would make up the entire block reward", donation.Percent, donation.Address)
+			continue
+		}
+		total += donation.Percent
+		valid = append(valid, donation)
+	}
+	if len(valid) > 0 {
+		UnlockerInfoLogger.Printf("[Unlocker] Crediting donations of %v%% of each block reward to %v addresses", total, len(valid))
+	}
+	return valid
+}
+
+// Splits the donations off the top of a block reward. Returns the amount credited to each donation address and the rest of the reward, which is distributed to miners
+func (u *BlockUnlocker) splitDonations(reward *big.Rat) (map[string]int64, *big.Rat) {
+	credits := make(map[string]int64)
+	rest := new(big.Rat).Set(reward)
+	for _, donation := range u.donations {
+		_, amount := chargeFee(reward, donation.Percent)
+		amountInt, _ := strconv.ParseInt(amount.FloatString(0), 10, 64)
+		credits[donation.Address] += amountInt
+		rest.Sub(rest, new(big.Rat).SetInt64(amountInt))
+	}
+	return credits, rest
+}
+
 func (u *BlockUnlocker) StartBlockUnlocker(s *StratumServer) {
-	log.Printf("[Unlocker] Starting block unlocker")
 	UnlockerInfoLogger.Printf("[Unlocker] Starting block unlocker")
 	interval, _ := time.ParseDuration(u.config.Interval)
 	timer := time.NewTimer(interval)
-	log.Printf("[Unlocker] Set block unlock interval to %v", interval)
 	UnlockerInfoLogger.Printf("[Unlocker] Set block unlock interval to %v", interval)
 
 	// Immediately unlock after start
 	u.unlockPendingBlocks(s)
 	u.unlockAndCreditMiners(s)
+	u.checkMaturedBlocks(s)
 	timer.Reset(interval)
 
 	go func() {
@@ -62,6 +100,7 @@ func (u *BlockUnlocker) StartBlockUnlocker(s *StratumServer) {
 			case <-timer.C:
 				u.unlockPendingBlocks(s)
 				u.unlockAndCreditMiners(s)
+				u.checkMaturedBlocks(s)
 				timer.Reset(interval)
 			}
 		}
@@ -74,7 +113,7 @@ func (u *BlockUnlocker) unlockPendingBlocks(s *StratumServer) {
 
 	//if len(candidates) == 0 || len(candidateBlocks) == 0 {
 	if blocksFound == nil {
-		log.Printf("[Unlocker] No block candidates to unlock")
+		UnlockerInfoLogger.Printf("[Unlocker] No block candidates to unlock")
 		return
 	}
 
@@ -87,38 +126,22 @@ func (u *BlockUnlocker) unlockPendingBlocks(s *StratumServer) {
 	}
 
 	if len(candidateBlocks) == 0 {
-		log.Printf("[Unlocker] No block candidates to unlock")
+		UnlockerInfoLogger.Printf("[Unlocker] No block candidates to unlock")
 		return
 	}
 
 	// Graviton DB implementation
 	resultGrav, err := u.unlockCandidatesGrav(candidateBlocks, "candidates")
 	if err != nil {
-		log.Printf("[Unlocker] Failed to unlock blocks grav: %v", err)
 		UnlockerErrorLogger.Printf("[Unlocker] Failed to unlock blocks grav: %v", err)
 		return
 	}
 
-	log.Printf("[Unlocker] Immature %v blocks, %v orphans", resultGrav.blocks, resultGrav.orphans)
 	UnlockerInfoLogger.Printf("[Unlocker] Immature %v blocks, %v orphans", resultGrav.blocks, resultGrav.orphans)
 
 	if len(resultGrav.orphanedBlocks) > 0 {
-		writeWait, _ := time.ParseDuration("10ms")
-		for Graviton_backend.Writing == 1 {
-			//log.Printf("[Unlocker-writeorphanedblocks] GravitonDB is writing... sleeping for %v...", writeWait)
-			//StorageInfoLogger.Printf("[Unlocker-writeorphanedblocks] GravitonDB is writing... sleeping for %v...", writeWait)
-			time.Sleep(writeWait)
-		}
-		Graviton_backend.Writing = 1
-		err = Graviton_backend.WriteOrphanedBlocks(resultGrav.orphanedBlocks)
-		Graviton_backend.Writing = 0
-		if err != nil {
-			log.Printf("[Unlocker] Failed to insert orphaned blocks into backend: %v", err)
-			UnlockerErrorLogger.Printf("[Unlocker] Failed to insert orphaned blocks into backend: %v", err)
+		if err = u.writeOrphanedBlocks(s, resultGrav.orphanedBlocks, true); err != nil {
 			return
-		} else {
-			log.Printf("[Unlocker] Inserted %v orphaned blocks to backend", resultGrav.orphans)
-			UnlockerInfoLogger.Printf("[Unlocker] Inserted %v orphaned blocks to backend", resultGrav.orphans)
 		}
 	}
 
@@ -126,7 +149,6 @@ func (u *BlockUnlocker) unlockPendingBlocks(s *StratumServer) {
 	for _, block := range resultGrav.maturedBlocks {
 		writeWait, _ := time.ParseDuration("10ms")
 		for Graviton_backend.Writing == 1 {
-			//log.Printf("[Unlocker-writeimmatureblock] GravitonDB is writing... sleeping for %v...", writeWait)
 			//StorageInfoLogger.Printf("[Unlocker-writeimmatureblock] GravitonDB is writing... sleeping for %v...", writeWait)
 			time.Sleep(writeWait)
 		}
@@ -134,20 +156,23 @@ func (u *BlockUnlocker) unlockPendingBlocks(s *StratumServer) {
 		err = Graviton_backend.WriteImmatureBlock(block)
 		Graviton_backend.Writing = 0
 		if err != nil {
-			log.Printf("[Unlocker] Failed to credit rewards for round %v: %v", block.RoundKey(), err)
 			UnlockerErrorLogger.Printf("[Unlocker] Failed to credit rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
 
-		log.Printf("[Unlocker] IMMATURE %v", block.RoundKey())
 		UnlockerInfoLogger.Printf("[Unlocker] IMMATURE %v", block.RoundKey())
 	}
 }
 
 func (u *BlockUnlocker) unlockAndCreditMiners(s *StratumServer) {
+	// Immature blocks stay immature in safe mode, they are credited once it is acknowledged
+	if s.inSafeMode() {
+		UnlockerInfoLogger.Printf("[Unlocker] Safe mode, not crediting matured blocks until acknowledged")
+		return
+	}
+
 	miningInfo, err := u.rpc.GetInfo()
 	if err != nil {
-		log.Printf("[Unlocker] Unable to get current blockchain height from node: %v", err)
 		UnlockerErrorLogger.Printf("[Unlocker] Unable to get current blockchain height from node: %v", err)
 		return
 	}
@@ -157,7 +182,7 @@ func (u *BlockUnlocker) unlockAndCreditMiners(s *StratumServer) {
 	immatureBlocksFound := Graviton_backend.GetBlocksFound("immature")
 
 	if immatureBlocksFound == nil {
-		log.Printf("[Unlocker] No immature blocks to credit miners")
+		UnlockerInfoLogger.Printf("[Unlocker] No immature blocks to credit miners")
 		return
 	}
 
@@ -172,36 +197,20 @@ func (u *BlockUnlocker) unlockAndCreditMiners(s *StratumServer) {
 	}
 
 	if len(immature) == 0 {
-		log.Printf("[Unlocker] No immature blocks to credit miners")
+		UnlockerInfoLogger.Printf("[Unlocker] No immature blocks to credit miners")
 		return
 	}
 
 	result, err := u.unlockCandidatesGrav(immature, "immature")
 	if err != nil {
-		log.Printf("[Unlocker] Failed to unlock blocks: %v", err)
 		UnlockerErrorLogger.Printf("[Unlocker] Failed to unlock blocks: %v", err)
 		return
 	}
-	log.Printf("[Unlocker] Unlocked %v blocks, %v orphans", result.blocks, result.orphans)
 	UnlockerInfoLogger.Printf("[Unlocker] Unlocked %v blocks, %v orphans", result.blocks, result.orphans)
 
 	if len(result.orphanedBlocks) > 0 {
-		writeWait, _ := time.ParseDuration("10ms")
-		for Graviton_backend.Writing == 1 {
-			//log.Printf("[Unlocker-writeorphanedblocks] GravitonDB is writing... sleeping for %v...", writeWait)
-			//StorageInfoLogger.Printf("[Unlocker-writeorphanedblocks] GravitonDB is writing... sleeping for %v...", writeWait)
-			time.Sleep(writeWait)
-		}
-		Graviton_backend.Writing = 1
-		err = Graviton_backend.WriteOrphanedBlocks(result.orphanedBlocks)
-		Graviton_backend.Writing = 0
-		if err != nil {
-			log.Printf("[Unlocker] Failed to insert orphaned blocks into backend: %v", err)
-			UnlockerErrorLogger.Printf("[Unlocker] Failed to insert orphaned blocks into backend: %v", err)
+		if err = u.writeOrphanedBlocks(s, result.orphanedBlocks, true); err != nil {
 			return
-		} else {
-			log.Printf("[Unlocker] Inserted %v orphaned blocks to backend", result.orphans)
-			UnlockerInfoLogger.Printf("[Unlocker] Inserted %v orphaned blocks to backend", result.orphans)
 		}
 	}
 
@@ -212,14 +221,14 @@ func (u *BlockUnlocker) unlockAndCreditMiners(s *StratumServer) {
 	for _, block := range result.maturedBlocks {
 		revenue, minersProfit, poolProfit, roundRewards, err := u.calculateRewardsGrav(s, block)
 		if err != nil {
-			log.Printf("[Unlocker] Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
 			UnlockerErrorLogger.Printf("[Unlocker] Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
+		// Kept with the matured block, so the credit can be reversed if the block is orphaned later on
+		block.Rewards = roundRewards
 
 		writeWait, _ := time.ParseDuration("10ms")
 		for Graviton_backend.Writing == 1 {
-			//log.Printf("[Unlocker-writematuredblocks] GravitonDB is writing... sleeping for %v...", writeWait)
 			//StorageInfoLogger.Printf("[Unlocker-writematuredblocks] GravitonDB is writing... sleeping for %v...", writeWait)
 			time.Sleep(writeWait)
 		}
@@ -227,10 +236,10 @@ func (u *BlockUnlocker) unlockAndCreditMiners(s *StratumServer) {
 		err = Graviton_backend.WriteMaturedBlocks(block)
 		Graviton_backend.Writing = 0
 		if err != nil {
-			log.Printf("[Unlocker] Failed to credit rewards for round %v: %v", block.RoundKey(), err)
 			UnlockerErrorLogger.Printf("[Unlocker] Failed to credit rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
+		s.live.publish("block", newLiveBlock(block, "matured"))
 
 		// Write pending payments to graviton db
 		total := int64(0)
@@ -244,15 +253,13 @@ func (u *BlockUnlocker) unlockAndCreditMiners(s *StratumServer) {
 
 			writeWait, _ := time.ParseDuration("10ms")
 			for Graviton_backend.Writing == 1 {
-				//log.Printf("[Unlocker-writependingpayments] GravitonDB is writing... sleeping for %v...", writeWait)
 				//StorageInfoLogger.Printf("[Unlocker-writependingpayments] GravitonDB is writing... sleeping for %v...", writeWait)
 				time.Sleep(writeWait)
 			}
 			Graviton_backend.Writing = 1
-			infoErr := Graviton_backend.WritePendingPayments(info)
+			infoErr := Storage_backend.WritePendingPayments(info)
 			Graviton_backend.Writing = 0
 			if infoErr != nil {
-				log.Printf("[Unlocker] Graviton DB err: %v", infoErr)
 				UnlockerErrorLogger.Printf("[Unlocker] Graviton DB err: %v", infoErr)
 			}
 		}
@@ -275,16 +282,9 @@ func (u *BlockUnlocker) unlockAndCreditMiners(s *StratumServer) {
 		for login, reward := range roundRewards {
 			entries = append(entries, fmt.Sprintf("\tREWARD %v: %v: %v", block.RoundKey(), login, reward))
 		}
-		log.Printf(strings.Join(entries, "\n"))
 		UnlockerInfoLogger.Printf(strings.Join(entries, "\n"))
 	}
 
-	log.Printf(
-		"[Unlocker] MATURE SESSION: totalRevenue %v, totalMinersProfit %v, totalPoolProfit %v",
-		totalRevenue.FloatString(8),
-		totalMinersProfit.FloatString(8),
-		totalPoolProfit.FloatString(8),
-	)
 	UnlockerInfoLogger.Printf("[Unlocker] MATURE SESSION: totalRevenue %v, totalMinersProfit %v, totalPoolProfit %v", totalRevenue.FloatString(8), totalMinersProfit.FloatString(8), totalPoolProfit.FloatString(8))
 }
 
@@ -298,7 +298,6 @@ func (u *BlockUnlocker) unlockCandidatesGrav(candidates []*BlockDataGrav, blockT
 
 		block, err := u.rpc.GetBlockByHash(hash)
 		if err != nil {
-			log.Printf("[Unlocker] Error while retrieving block %s from node: %v", hash, err)
 			UnlockerErrorLogger.Printf("[Unlocker] Error while retrieving block %s from node: %v", hash, err)
 			return nil, err
 		}
@@ -316,8 +315,7 @@ func (u *BlockUnlocker) unlockCandidatesGrav(candidates []*BlockDataGrav, blockT
 				return nil, err
 			}
 			result.maturedBlocks = append(result.maturedBlocks, candidate)
-			log.Printf("[Unlocker] Mature block %v with %v tx, hash: %v", candidate.Height, block.BlockHeader.Txcount, candidate.Hash)
-			UnlockerInfoLogger.Printf("[Unlocker] Mature block %v with %v tx, hash: %v", candidate.Height, block.BlockHeader.Txcount, candidate.Hash)
+			UnlockerInfoLogger.Printw(fmt.Sprintf("[Unlocker] Mature block %v", candidate.Height), "height", candidate.Height, "txs", block.BlockHeader.Txcount, "hash", candidate.Hash)
 			break
 		}
 
@@ -331,15 +329,15 @@ func (u *BlockUnlocker) unlockCandidatesGrav(candidates []*BlockDataGrav, blockT
 			result.orphans++
 			candidate.Orphan = true
 			result.orphanedBlocks = append(result.orphanedBlocks, candidate)
-			log.Printf("[Unlocker] Orphaned block %v:%v", candidate.RoundHeight, candidate.Nonce)
-			UnlockerInfoLogger.Printf("[Unlocker] Orphaned block %v:%v", candidate.RoundHeight, candidate.Nonce)
+			UnlockerWarnLogger.Printw(fmt.Sprintf("[Unlocker] Orphaned block %v:%v", candidate.RoundHeight, candidate.Nonce), "height", candidate.Height, "roundHeight", candidate.RoundHeight, "nonce", candidate.Nonce, "hash", candidate.Hash)
 		}
 	}
 	return result, nil
 }
 
+// The node also returns blocks which are no longer in the main chain, those are flagged orphan_status
 func matchCandidateGrav(block *rpc.GetBlockHashReply, candidate *BlockDataGrav) bool {
-	return len(candidate.Hash) > 0 && strings.EqualFold(candidate.Hash, block.BlockHeader.Hash)
+	return len(candidate.Hash) > 0 && strings.EqualFold(candidate.Hash, block.BlockHeader.Hash) && !block.BlockHeader.OrphanStatus
 }
 
 func (u *BlockUnlocker) handleBlockGrav(block *rpc.GetBlockHashReply, candidate *BlockDataGrav, blockType string) error {
@@ -352,56 +350,232 @@ func (u *BlockUnlocker) handleBlockGrav(block *rpc.GetBlockHashReply, candidate
 	return nil
 }
 
+// Stores orphaned blocks, restoring the round shares of orphaned pool blocks to the current round if restoreOrphanShares is set and restoreShares: only blocks
+// whose reward was never credited [candidates and immature blocks] are restored, the shares of a matured block were credited and would be paid a second time
+func (u *BlockUnlocker) writeOrphanedBlocks(s *StratumServer, orphanedBlocks []*BlockDataGrav, restoreShares bool) error {
+	writeWait, _ := time.ParseDuration("10ms")
+	for Graviton_backend.Writing == 1 {
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	err := Graviton_backend.WriteOrphanedBlocks(orphanedBlocks)
+	Graviton_backend.Writing = 0
+	if err != nil {
+		UnlockerErrorLogger.Printf("[Unlocker] Failed to insert orphaned blocks into backend: %v", err)
+		return err
+	}
+
+	UnlockerInfoLogger.Printf("[Unlocker] Inserted %v orphaned blocks to backend", len(orphanedBlocks))
+	for _, block := range orphanedBlocks {
+		s.live.publish("block", newLiveBlock(block, "orphaned"))
+		if restoreShares && u.config.RestoreOrphanShares && !block.Solo {
+			u.restoreRoundShares(s, block)
+		}
+	}
+	return nil
+}
+
+// Credits the round shares of an orphaned pool block to the current round, so they are paid by the next block instead of being lost. Under pplns the shares stay in the window anyways
+func (u *BlockUnlocker) restoreRoundShares(s *StratumServer, block *BlockDataGrav) {
+	if s.currentConfig().PaymentsConfig.Scheme == "pplns" {
+		return
+	}
+	shares, totalRoundShares, err := Storage_backend.GetRoundShares(block.RoundHeight)
+	if err != nil || totalRoundShares == 0 {
+		return
+	}
+	fees, _ := Storage_backend.GetRoundFees(block.RoundHeight)
+
+	writeWait, _ := time.ParseDuration("10ms")
+	for Graviton_backend.Writing == 1 {
+		time.Sleep(writeWait)
+	}
+	Graviton_backend.Writing = 1
+	defer func() {
+		Graviton_backend.Writing = 0
+	}()
+
+	err = Storage_backend.UpdatePoolRound(func(round *PoolRound) (*PoolRound, error) {
+		if round == nil {
+			round = &PoolRound{RoundFees: make(map[string]float64)}
+		}
+		if round.RoundShares == nil {
+			round.RoundShares = make(map[string]int64)
+		}
+		for login, n := range shares {
+			round.RoundShares[login] += n
+			if round.RoundFees != nil {
+				// Shares of rounds before per port fees are charged the unlocker poolFee
+				fee, ok := fees[login]
+				if !ok {
+					fee = float64(n) * u.config.PoolFee
+				}
+				round.RoundFees[login] += fee
+			}
+		}
+		return round, nil
+	})
+	if err != nil {
+		UnlockerErrorLogger.Printf("[Unlocker] Failed to restore round shares of orphaned block %v: %v", block.RoundKey(), err)
+		return
+	}
+	UnlockerInfoLogger.Printf("[Unlocker] Restored %v round shares of orphaned block %v to the current round", totalRoundShares, block.RoundKey())
+}
+
+// Rechecks matured blocks within orphanCheckDepth past the unlock depth. A block the node no longer has in the main chain is orphaned after all,
+// the rewards it credited are debited from the pending balances again so that the pool does not pay out a reward it never received
+func (u *BlockUnlocker) checkMaturedBlocks(s *StratumServer) {
+	checkDepth := u.config.OrphanCheckDepth
+	if checkDepth == 0 {
+		checkDepth = u.config.Depth
+	}
+	if checkDepth < 0 || s.inSafeMode() {
+		return
+	}
+
+	miningInfo, err := u.rpc.GetInfo()
+	if err != nil {
+		UnlockerErrorLogger.Printf("[Unlocker] Unable to get current blockchain height from node: %v", err)
+		return
+	}
+	minHeight := miningInfo.Height - u.config.Depth - checkDepth
+
+	maturedBlocksFound := Graviton_backend.GetBlocksFound("matured")
+	if maturedBlocksFound == nil {
+		return
+	}
+
+	var orphanedBlocks []*BlockDataGrav
+	for _, block := range maturedBlocksFound.MinedBlocks {
+		if block.Height <= minHeight {
+			continue
+		}
+		nodeBlock, err := u.rpc.GetBlockByHash(block.Hash)
+		if err != nil || nodeBlock == nil {
+			UnlockerErrorLogger.Printf("[Unlocker] Error while rechecking matured block %s from node: %v", block.Hash, err)
+			return
+		}
+		if matchCandidateGrav(nodeBlock, block) {
+			continue
+		}
+
+		UnlockerErrorLogger.Printf("[Unlocker] Matured block %v is no longer in the main chain, orphaning it", block.RoundKey())
+		block.Orphan = true
+		orphanedBlocks = append(orphanedBlocks, block)
+	}
+
+	// Debited once the blocks are stored as orphaned, so a failed write does not debit them again on the next check. Their round shares were paid by their reward
+	// and are not restored, the reward is reversed instead
+	if len(orphanedBlocks) == 0 || u.writeOrphanedBlocks(s, orphanedBlocks, false) != nil {
+		return
+	}
+	for _, block := range orphanedBlocks {
+		u.reverseRewards(s, block)
+	}
+}
+
+// Debits the rewards an orphaned block credited. A reward already paid out can not be taken back, the part that was is logged
+func (u *BlockUnlocker) reverseRewards(s *StratumServer, block *BlockDataGrav) {
+	if block.Rewards == nil {
+		UnlockerWarnLogger.Printf("[Unlocker] No rewards stored for orphaned block %v [matured before reward tracking], balances are not debited", block.RoundKey())
+		return
+	}
+
+	for login, reward := range block.Rewards {
+		if reward <= 0 {
+			continue
+		}
+		balance, err := s.adjustBalance(login, -reward)
+		if err == nil {
+			continue
+		}
+		// Less than the reward is left pending, debit what is
+		var debited uint64
+		if balance > 0 && balance < uint64(reward) {
+			if _, err = s.adjustBalance(login, -int64(balance)); err == nil {
+				debited = balance
+			}
+		}
+		UnlockerWarnLogger.Printf("[Unlocker] Could only debit %v of the %v reward of %v for orphaned block %v, the rest was already paid out", debited, reward, login, block.RoundKey())
+	}
+	UnlockerInfoLogger.Printf("[Unlocker] Debited the rewards of orphaned block %v: %v", block.RoundKey(), block.Rewards)
+}
+
 func (u *BlockUnlocker) calculateRewardsGrav(s *StratumServer, block *BlockDataGrav) (*big.Rat, *big.Rat, *big.Rat, map[string]int64, error) {
 	// Write miner stats - force a write to ensure latest stats are in db
-	log.Printf("[Unlocker] Storing miner stats")
 	UnlockerInfoLogger.Printf("[Unlocker] Storing miner stats")
 
 	writeWait, _ := time.ParseDuration("10ms")
 	for Graviton_backend.Writing == 1 {
-		//log.Printf("[Unlocker-writeminerstats] GravitonDB is writing... sleeping for %v...", writeWait)
 		//StorageInfoLogger.Printf("[Unlocker-writeminerstats] GravitonDB is writing... sleeping for %v...", writeWait)
 		time.Sleep(writeWait)
 	}
 	Graviton_backend.Writing = 1
 	err := Graviton_backend.WriteMinerStats(s.miners, s.hashrateExpiration)
-	err2 := Graviton_backend.UpdatePoolRoundStats(s.miners, false)
+	err2 := Storage_backend.UpdatePoolRoundStats(s.miners, false)
 	Graviton_backend.Writing = 0
 	if err != nil {
-		log.Printf("[Unlocker] Err storing miner stats: %v", err)
 		UnlockerErrorLogger.Printf("[Unlocker] Err storing miner stats: %v", err)
 	}
 	if err2 != nil {
-		log.Printf("[Unlocker] Err storing miner round stats: %v", err2)
 		UnlockerErrorLogger.Printf("[Unlocker] Err storing miner round stats: %v", err2)
 	}
 	revenue := new(big.Rat).SetUint64(block.Reward)
-	minersProfit, poolProfit := chargeFee(revenue, u.config.PoolFee)
+	// Donations are credited before the miners, who split the rest of the reward
+	donations, reward := u.splitDonations(revenue)
 
 	var shares map[string]int64
+	var fees map[string]float64
 	var totalroundshares int64
 
 	if block.Solo {
+		// The solo miner who found the block is credited the entire reward, minus the pool fee of the port for blocks found on a solo port
+		var fee float64
+		if block.Fee != nil {
+			fee = *block.Fee
+		}
+		minersProfit, poolProfit := chargeFee(reward, fee)
 		rewards := make(map[string]int64)
-		rewards[block.Address] += int64(block.Reward)
+		minerReward, _ := strconv.ParseInt(minersProfit.FloatString(0), 10, 64)
+		rewards[block.Address] += minerReward
+		creditDonations(rewards, donations)
 		return revenue, minersProfit, poolProfit, rewards, nil
+	} else if s.currentConfig().PaymentsConfig.Scheme == "pplns" {
+		// Pool blocks found under pplns are paid over the window stored when the block was found, blocks found before switching schemes fall back to their round shares
+		var ok bool
+		shares, totalroundshares, ok = Storage_backend.GetPPLNSRoundShares(block.Height)
+		if ok {
+			fees, _ = Storage_backend.GetPPLNSRoundFees(block.Height)
+		} else {
+			UnlockerInfoLogger.Printf("[Unlocker] No pplns window stored for block at height %v, using round shares.", block.Height)
+			shares, totalroundshares, err = Storage_backend.GetRoundShares(block.RoundHeight)
+			if err != nil {
+				return nil, nil, nil, nil, err
+			}
+			fees, _ = Storage_backend.GetRoundFees(block.RoundHeight)
+		}
+		UnlockerInfoLogger.Printf("[Unlocker-calculateRewardsGrav] [pplns shares] shares: %v, totalroundshares: %v", shares, totalroundshares)
 	} else {
-		shares, totalroundshares, err = Graviton_backend.GetRoundShares(block.RoundHeight)
-		log.Printf("[Unlocker-calculateRewardsGrav] [round shares] shares: %v, totalroundshares: %v", shares, totalroundshares)
+		shares, totalroundshares, err = Storage_backend.GetRoundShares(block.RoundHeight)
 		UnlockerInfoLogger.Printf("[Unlocker-calculateRewardsGrav] [round shares] shares: %v, totalroundshares: %v", shares, totalroundshares)
 		if err != nil {
 			return nil, nil, nil, nil, err
 		}
+		fees, _ = Storage_backend.GetRoundFees(block.RoundHeight)
 	}
 
-	rewards := calculateRewardsForSharesGrav(s, shares, totalroundshares, minersProfit)
+	rewards, minersProfit := calculateRewardsForSharesGrav(s, shares, fees, totalroundshares, reward, u.config.PoolFee)
 
 	if len(rewards) == 0 {
-		rewards[block.Address] += int64(block.Reward)
-		log.Printf("[Unlocker] No shares stored for this round, rewarding block amount (%v) to miner (%v) who found block.", block.Reward, block.Address)
-		UnlockerInfoLogger.Printf("[Unlocker] No shares stored for this round, rewarding block amount (%v) to miner (%v) who found block.", block.Reward, block.Address)
+		minersProfit = new(big.Rat).Set(reward)
+		minerReward, _ := strconv.ParseInt(reward.FloatString(0), 10, 64)
+		rewards[block.Address] += minerReward
+		UnlockerInfoLogger.Printf("[Unlocker] No shares stored for this round, rewarding block amount (%v) to miner (%v) who found block.", minerReward, block.Address)
 	}
 
+	poolProfit := new(big.Rat).Sub(reward, minersProfit)
+	creditDonations(rewards, donations)
+
 	if block.ExtraReward != nil {
 		extraReward := new(big.Rat).SetInt(block.ExtraReward)
 		poolProfit.Add(poolProfit, extraReward)
@@ -411,26 +585,44 @@ func (u *BlockUnlocker) calculateRewardsGrav(s *StratumServer, block *BlockDataG
 	return revenue, minersProfit, poolProfit, rewards, nil
 }
 
-func calculateRewardsForSharesGrav(s *StratumServer, shares map[string]int64, total int64, reward *big.Rat) map[string]int64 {
+// Splits reward over shares, then charges each login the fee its shares were found at [fee weight / shares]. Logins without fee weights, i.e. rounds started
+// before per port fees, are charged defaultFee. Returns the rewards by address and their sum [miners profit]
+func calculateRewardsForSharesGrav(s *StratumServer, shares map[string]int64, fees map[string]float64, total int64, reward *big.Rat, defaultFee float64) (map[string]int64, *big.Rat) {
 	rewards := make(map[string]int64)
+	minersProfit := new(big.Rat)
 
 	for login, n := range shares {
 		if n != 0 {
 			// Split away for workers, paymentIDs etc. just to compound the shares associated with a given address
 			address, _, paymentID, _, _, _ := s.splitLoginString(login)
 
+			fee := defaultFee
+			if weight, ok := fees[login]; ok {
+				fee = weight / float64(n)
+			}
+
 			percent := big.NewRat(n, total)
-			workerReward := new(big.Rat).Mul(reward, percent)
+			workerReward, _ := chargeFee(new(big.Rat).Mul(reward, percent), fee)
 			workerRewardInt, _ := strconv.ParseInt(workerReward.FloatString(0), 10, 64)
+			minersProfit.Add(minersProfit, new(big.Rat).SetInt64(workerRewardInt))
 			if paymentID != "" {
-				combinedAddr := address + s.config.Stratum.PaymentID.AddressSeparator + paymentID
+				combinedAddr := address + s.currentConfig().Stratum.PaymentID.AddressSeparator + paymentID
 				rewards[combinedAddr] += workerRewardInt
 			} else {
 				rewards[address] += workerRewardInt
 			}
 		}
 	}
-	return rewards
+	return rewards, minersProfit
+}
+
+// Adds the donation credits to the round rewards, they are paid out along with the miner balances
+func creditDonations(rewards map[string]int64, donations map[string]int64) {
+	for address, amount := range donations {
+		if amount > 0 {
+			rewards[address] += amount
+		}
+	}
 }
 
 // Returns new value after fee deduction and fee value.
@@ -440,13 +632,8 @@ func chargeFee(value *big.Rat, fee float64) (*big.Rat, *big.Rat) {
 	return new(big.Rat).Sub(value, feeValue), feeValue
 }
 
-func logFileOutUnlocker(lType string) *log.Logger {
-	var logFileName string
-	if lType == "ERROR" {
-		logFileName = "logs/unlockerError.log"
-	} else {
-		logFileName = "logs/unlocker.log"
-	}
+func logFileOutUnlocker(lType string) *util.Logger {
+	logFileName := util.LogFileName("unlocker", lType)
 	os.Mkdir("logs", 0705)
 	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0705)
 	if err != nil {
@@ -455,5 +642,5 @@ func logFileOutUnlocker(lType string) *log.Logger {
 
 	logType := lType + ": "
 	l := log.New(f, logType, log.LstdFlags|log.Lmicroseconds)
-	return l
+	return util.NewLogger("unlocker", lType, l)
 }
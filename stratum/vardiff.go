@@ -0,0 +1,125 @@
+package stratum
+
+import (
+	"sync"
+	"time"
+)
+
+// Per-session vardiff state. Shares are counted by the session goroutine in processShare while retargets run from updateFixedDiffJobs, so access is guarded by the mutex
+type VarDiff struct {
+	sync.Mutex
+	Difficulty            int64
+	Average               float64
+	Shares                int64
+	ShareDifficulty       int64
+	LastRetargetTimestamp int64
+	LastTimeStamp         int64
+}
+
+// Counts an accepted share of difficulty diff towards the current retarget window. The first share only starts the window, due for retarget after half of retargetTime
+func (v *VarDiff) recordShare(ts, retargetTime, diff int64) {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.LastRetargetTimestamp == 0 {
+		v.LastRetargetTimestamp = ts - retargetTime/2
+		v.LastTimeStamp = ts
+		return
+	}
+	v.Shares++
+	v.ShareDifficulty += diff
+	v.LastTimeStamp = ts
+}
+
+// Returns the retargeted difficulty of the session once retargetTime has elapsed since the last retarget. The average share time of the window is the elapsed time over the shares submitted in it,
+// counted at the current difficulty from the difficulty summed over the window, so shares of jobs sent before the last retarget weigh by the difficulty they were submitted at.
+// A window without shares counts as one share so slow miners are still retargeted down. Difficulty is kept when the average is within variancePercent of targetTime
+func (cs *Session) calcVarDiff(currDiff float64, s *StratumServer) int64 {
+	var newDiff float64
+	timestamp := time.Now().Unix()
+	cfg := s.currentConfig().Stratum.VarDiff
+
+	variance := cfg.VariancePercent / 100 * float64(cfg.TargetTime)
+	tMin := float64(cfg.TargetTime) - variance
+	tMax := float64(cfg.TargetTime) + variance
+
+	v := cs.VarDiff
+	v.Lock()
+	defer v.Unlock()
+
+	// Set last time varDiff config was handled, usually done initially before the first share
+	if v.LastRetargetTimestamp == 0 {
+		v.LastRetargetTimestamp = timestamp - cfg.RetargetTime/2
+		v.LastTimeStamp = timestamp
+		return int64(currDiff)
+	}
+
+	elapsed := timestamp - v.LastRetargetTimestamp
+	if elapsed < cfg.RetargetTime {
+		return int64(currDiff)
+	}
+
+	shares := float64(v.Shares)
+	if v.ShareDifficulty > 0 && currDiff > 0 {
+		shares = float64(v.ShareDifficulty) / currDiff
+	}
+	if shares <= 0 {
+		shares = 1
+	}
+	avg := float64(elapsed) / shares
+
+	// Start the next window
+	v.LastRetargetTimestamp = timestamp
+	v.Shares = 0
+	v.ShareDifficulty = 0
+
+	// Keep the measured share time for tuning, exposed as ShareTime in the miner stats next to the config targetTime
+	v.Average = avg
+	if cs.miner != nil {
+		cs.miner.Lock()
+		cs.miner.ShareTime = avg
+		cs.miner.Unlock()
+	}
+
+	diffCalc := float64(cfg.TargetTime) / avg
+	minDiff, maxDiff := cs.endpoint.varDiffBounds(&cfg)
+
+	if avg > tMax && currDiff >= float64(minDiff) {
+		if diffCalc*currDiff < float64(minDiff) {
+			diffCalc = float64(minDiff) / currDiff
+		}
+	} else if avg < tMin {
+		diffMax := float64(maxDiff)
+
+		if diffCalc*currDiff > diffMax {
+			diffCalc = diffMax / currDiff
+		}
+	} else {
+		return int64(currDiff)
+	}
+
+	newDiff = currDiff * diffCalc
+
+	if newDiff <= 0 {
+		newDiff = currDiff
+	}
+
+	maxJump := cfg.MaxJump / 100 * currDiff
+
+	// Prevent diff scale up/down to be more than maxJump %.
+	if newDiff > currDiff && !(newDiff-maxJump <= currDiff) {
+		newDiff = currDiff + maxJump
+	} else if currDiff > newDiff && !(newDiff+(maxJump) >= currDiff) {
+		newDiff = currDiff - (maxJump)
+	}
+
+	// Prevent diff scale up/down to be more than maxStepUp/maxStepDown times the current diff
+	if cfg.MaxStepUp > 0 && newDiff > currDiff*cfg.MaxStepUp {
+		newDiff = currDiff * cfg.MaxStepUp
+	} else if cfg.MaxStepDown > 0 && newDiff < currDiff*cfg.MaxStepDown {
+		newDiff = currDiff * cfg.MaxStepDown
+	}
+
+	v.Difficulty = int64(newDiff)
+	return int64(newDiff)
+}
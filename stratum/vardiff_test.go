@@ -0,0 +1,106 @@
+package stratum
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+)
+
+func newVarDiffTestSession() (*StratumServer, *Session) {
+	s := &StratumServer{}
+	cfg := &pool.Config{}
+	cfg.Stratum.VarDiff = pool.VarDiffConfig{
+		Enabled:         true,
+		MinDiff:         100,
+		MaxDiff:         1000000000,
+		TargetTime:      30,
+		RetargetTime:    120,
+		VariancePercent: 30,
+		MaxJump:         100,
+		MaxStepUp:       2,
+		MaxStepDown:     0.5,
+	}
+	s.config.Store(cfg)
+	return s, &Session{VarDiff: &VarDiff{}, endpoint: &Endpoint{config: &pool.Port{}}}
+}
+
+// Retargets a session mining at hashrate [difficulty per second] from startDiff, every window submitting exactly the shares of the hashrate.
+// Returns the difficulty after each retarget
+func simulateVarDiff(s *StratumServer, cs *Session, hashrate float64, startDiff int64, retargets int) []int64 {
+	cfg := s.currentConfig().Stratum.VarDiff
+	diff := startDiff
+	var diffs []int64
+	for i := 0; i < retargets; i++ {
+		cs.VarDiff.LastRetargetTimestamp = time.Now().Unix() - cfg.RetargetTime
+		cs.VarDiff.ShareDifficulty = int64(hashrate * float64(cfg.RetargetTime))
+		cs.VarDiff.Shares = cs.VarDiff.ShareDifficulty / diff
+		diff = cs.calcVarDiff(float64(diff), s)
+		diffs = append(diffs, diff)
+	}
+	return diffs
+}
+
+// Checks the difficulties of a simulation move towards the target by at most the configured steps, then settle within the variance of the target time and stay there
+func checkVarDiffConvergence(t *testing.T, s *StratumServer, hashrate float64, startDiff int64, diffs []int64) {
+	cfg := s.currentConfig().Stratum.VarDiff
+	variance := cfg.VariancePercent / 100 * float64(cfg.TargetTime)
+	lowest, highest := hashrate*(float64(cfg.TargetTime)-variance), hashrate*(float64(cfg.TargetTime)+variance)
+
+	previous := startDiff
+	settled := -1
+	for i, diff := range diffs {
+		// Difficulties are truncated to integers, a step down may be a fraction below maxStepDown
+		if float64(diff) > float64(previous)*cfg.MaxStepUp || float64(diff) < math.Floor(float64(previous)*cfg.MaxStepDown) {
+			t.Fatalf("retarget %v from %v to %v, a step of %.2f", i, previous, diff, float64(diff)/float64(previous))
+		}
+		// Never overshooting the band, so the difficulty only moves one way
+		if (startDiff < diff && diff < previous) || (startDiff > diff && diff > previous) {
+			t.Fatalf("retarget %v from %v to %v went back, difficulties %v", i, previous, diff, diffs)
+		}
+		if settled < 0 && float64(diff) >= lowest && float64(diff) <= highest {
+			settled = i
+		}
+		if settled >= 0 && diff != diffs[settled] {
+			t.Fatalf("retarget %v from %v to %v after settling within the variance, difficulties %v", i, previous, diff, diffs)
+		}
+		previous = diff
+	}
+	if settled < 0 {
+		t.Fatalf("did not settle between %v and %v, difficulties %v", lowest, highest, diffs)
+	}
+}
+
+// A miner submitting far faster than the target time is retargeted up by at most maxStepUp per retarget until its share time is within the variance
+func TestVarDiffRapidSubmitConverges(t *testing.T) {
+	s, cs := newVarDiffTestSession()
+	diffs := simulateVarDiff(s, cs, 10000, 1000, 20)
+	checkVarDiffConvergence(t, s, 10000, 1000, diffs)
+	// 1000 only reaches the band around 300000 in 8 doublings
+	if diffs[6] >= 210000 {
+		t.Fatalf("settled faster than maxStepUp allows, difficulties %v", diffs)
+	}
+}
+
+// A miner submitting far slower than the target time is retargeted down by at most maxStepDown per retarget until its share time is within the variance
+func TestVarDiffSlowSubmitConverges(t *testing.T) {
+	s, cs := newVarDiffTestSession()
+	diffs := simulateVarDiff(s, cs, 10, 1000000, 20)
+	checkVarDiffConvergence(t, s, 10, 1000000, diffs)
+	// 1000000 only reaches the band around 300 in 12 halvings
+	if diffs[10] <= 390 {
+		t.Fatalf("settled faster than maxStepDown allows, difficulties %v", diffs)
+	}
+}
+
+// Share times within variancePercent of the target time do not retarget
+func TestVarDiffWithinVariance(t *testing.T) {
+	s, cs := newVarDiffTestSession()
+	// Share times of 22s and 38s against a target of 30s and a variance of 9s
+	for _, diff := range []int64{220000, 380000} {
+		if diffs := simulateVarDiff(s, cs, 10000, diff, 5); diffs[len(diffs)-1] != diff {
+			t.Fatalf("difficulty %v retargeted within the variance, difficulties %v", diff, diffs)
+		}
+	}
+}
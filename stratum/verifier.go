@@ -0,0 +1,123 @@
+package stratum
+
+import (
+	"math/big"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+)
+
+// Second tier of share validation: the cheap checks [job, nonce, duplicates, claimed difficulty] run on the connection goroutine, the proof of work hashing is
+// queued to a bounded pool of workers. A full queue blocks the submitting connection [which stops reading further requests] up to queueTimeout, after which
+// the share is rejected as busy, so submission bursts on a block change can not starve network I/O and job broadcasts of cpu
+type ShareVerifier struct {
+	queue   chan *verifyTask
+	timeout time.Duration
+	workers int
+
+	Verified  int64
+	Busy      int64
+	MaxQueued int64
+	// Block candidates verified on the submitting connection as the queue was full
+	Inline int64
+}
+
+type verifyTask struct {
+	algo      PowAlgo
+	shareBuff []byte
+	diff      big.Int
+	setDiff   big.Int
+	done      chan verifyResult
+}
+
+type verifyResult struct {
+	block bool
+	valid bool
+}
+
+// Default number of shares queued per verifier worker, and how long a share waits for room in a full queue
+const (
+	defaultVerifyQueuePerWorker = 64
+	defaultVerifyQueueTimeout   = 5 * time.Second
+)
+
+func NewShareVerifier(cfg *pool.ShareVerifier) *ShareVerifier {
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = workers * defaultVerifyQueuePerWorker
+	}
+	timeout, err := time.ParseDuration(cfg.QueueTimeout)
+	if err != nil || timeout <= 0 {
+		timeout = defaultVerifyQueueTimeout
+	}
+
+	v := &ShareVerifier{queue: make(chan *verifyTask, queueSize), timeout: timeout, workers: workers}
+	for i := 0; i < workers; i++ {
+		go v.worker()
+	}
+	StratumInfoLogger.Printf("[Stratum] Verifying shares with %v workers, queue of %v shares", workers, queueSize)
+	return v
+}
+
+func (v *ShareVerifier) worker() {
+	for task := range v.queue {
+		block, valid := task.algo.Validate(task.shareBuff, task.diff, task.setDiff)
+		atomic.AddInt64(&v.Verified, 1)
+		task.done <- verifyResult{block: block, valid: valid}
+	}
+}
+
+// Validates the share with algo on the worker pool, same results as PowAlgo Validate. Returns ok false without validating if the queue stayed full for queueTimeout.
+// A block candidate [its claimed hash meets the network difficulty] is never rejected as busy, it is validated on the submitting connection when the queue is full
+func (v *ShareVerifier) verify(algo PowAlgo, shareBuff []byte, diff, setDiff big.Int, candidate bool) (bool, bool, bool) {
+	task := &verifyTask{algo: algo, shareBuff: shareBuff, diff: diff, setDiff: setDiff, done: make(chan verifyResult, 1)}
+
+	select {
+	case v.queue <- task:
+	default:
+		if candidate {
+			atomic.AddInt64(&v.Inline, 1)
+			block, valid := algo.Validate(shareBuff, diff, setDiff)
+			atomic.AddInt64(&v.Verified, 1)
+			return block, valid, true
+		}
+		timer := time.NewTimer(v.timeout)
+		select {
+		case v.queue <- task:
+			timer.Stop()
+		case <-timer.C:
+			atomic.AddInt64(&v.Busy, 1)
+			return false, false, false
+		}
+	}
+
+	queued := int64(len(v.queue))
+	for {
+		max := atomic.LoadInt64(&v.MaxQueued)
+		if queued <= max || atomic.CompareAndSwapInt64(&v.MaxQueued, max, queued) {
+			break
+		}
+	}
+
+	result := <-task.done
+	return result.block, result.valid, true
+}
+
+// Returns a map of the verifier metrics for the api
+func (v *ShareVerifier) Snapshot() map[string]interface{} {
+	metrics := make(map[string]interface{})
+	metrics["workers"] = v.workers
+	metrics["queueSize"] = cap(v.queue)
+	metrics["queued"] = len(v.queue)
+	metrics["maxQueued"] = atomic.LoadInt64(&v.MaxQueued)
+	metrics["verified"] = atomic.LoadInt64(&v.Verified)
+	metrics["busy"] = atomic.LoadInt64(&v.Busy)
+	metrics["inline"] = atomic.LoadInt64(&v.Inline)
+	return metrics
+}
@@ -0,0 +1,130 @@
+package stratum
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+// Last health check of the payments wallet. Payouts are paused while the wallet rpc is unreachable. While its unlocked balance does not cover all pending balances the wallet is
+// Underfunded, payouts keep going in order until the unlocked balance runs out. With a hotWalletBuffer, Sweep is the part of the unlocked balance above both the buffer and all pending balances, which the operator is alerted to move to the cold wallet
+type WalletHealth struct {
+	Reachable       bool
+	Balance         uint64
+	UnlockedBalance uint64
+	Due             uint64
+	Pending         uint64
+	Paused          bool
+	Underfunded     bool
+	Reason          string `json:",omitempty"`
+	CheckedAt       int64
+	PausedAt        int64  `json:",omitempty"`
+	Buffer          uint64 `json:",omitempty"`
+	Sweep           uint64 `json:",omitempty"`
+	// Only named in the sweep alerts, not exposed by the api
+	ColdAddress string `json:"-"`
+}
+
+// Checks the wallet every walletCheckInterval, so a paused scheduler is reported [and resumed] in between payout runs
+func (u *PayoutsProcessor) startWalletHealth(s *StratumServer) {
+	intv, err := time.ParseDuration(u.currentConfig().WalletCheckInterval)
+	if err != nil || intv <= 0 {
+		intv = time.Minute
+	}
+	PaymentsInfoLogger.Printf("[Payments] Checking wallet health every %v", intv)
+
+	timer := time.NewTimer(intv)
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				u.checkWalletHealth(s)
+				timer.Reset(intv)
+			}
+		}
+	}()
+}
+
+// Returns the sum of the pending balances due for payout and the sum of all pending balances
+func (u *PayoutsProcessor) dueAmount(s *StratumServer) (uint64, uint64) {
+	settings, lastPaid := u.minerPayoutSettings()
+	now := util.MakeTimestamp() / 1000
+
+	var due, pending uint64
+	for _, val := range Storage_backend.GetPendingPayments() {
+		pending += val.Amount
+		address, _, _, _, _, _ := s.splitLoginString(val.Address)
+		if u.payoutDue(settings[address], val.Amount, lastPaid[address], now) {
+			due += val.Amount
+		}
+	}
+	return due, pending
+}
+
+// Checks the wallet rpc and its unlocked balance against the pending balances, pausing or resuming payouts. Pausing [walletPaused], running underfunded [walletUnderfunded]
+// and recovering from either [walletResumed] is logged and POSTed to webhooks walletAlertUrl, as is a balance growing above hotWalletBuffer [walletSweep], once until the balance is back under it
+func (u *PayoutsProcessor) checkWalletHealth(s *StratumServer) *WalletHealth {
+	now := util.MakeTimestamp() / 1000
+	health := &WalletHealth{CheckedAt: now, Buffer: u.currentConfig().HotWalletBuffer, ColdAddress: u.currentConfig().ColdWalletAddress}
+	health.Due, health.Pending = u.dueAmount(s)
+
+	walletURL := u.rpc.Url.String()
+	balance, err := u.rpc.GetBalance(walletURL)
+	if err != nil || balance == nil {
+		health.Reason = fmt.Sprintf("wallet %s unreachable: %v", walletURL, err)
+	} else {
+		health.Reachable = true
+		health.Balance = balance.Balance
+		health.UnlockedBalance = balance.UnlockedBalance
+		// Same as a single payout, the unlocked balance also has to cover the tx fee
+		if health.Pending > 0 && health.UnlockedBalance <= health.Pending {
+			health.Underfunded = true
+			health.Reason = fmt.Sprintf("unlocked balance of %v is not above the %v of pending balances", health.UnlockedBalance, health.Pending)
+		}
+		// Pending balances stay in the hot wallet on top of the buffer, only the rest of what can be spent is swept
+		if keep := health.Pending + health.Buffer; health.Buffer > 0 && health.UnlockedBalance > keep {
+			health.Sweep = health.UnlockedBalance - keep
+		}
+	}
+	health.Paused = !health.Reachable
+
+	u.healthMu.Lock()
+	prev := u.health
+	if health.Paused && prev != nil && prev.Paused {
+		health.PausedAt = prev.PausedAt
+	} else if health.Paused {
+		health.PausedAt = now
+	}
+	u.health = health
+	u.healthMu.Unlock()
+
+	wasDegraded := prev != nil && (prev.Paused || prev.Underfunded)
+	switch {
+	case health.Paused && (prev == nil || !prev.Paused):
+		PaymentsErrorLogger.Printf("[Payments] Pausing payouts, %v", health.Reason)
+		s.webhooks.WalletAlert("walletPaused", health)
+		s.telegram.WalletAlert("walletPaused", health)
+	case health.Underfunded && (prev == nil || !prev.Underfunded):
+		PaymentsWarnLogger.Printf("[Payments] Wallet underfunded, %v. Paying in order until the unlocked balance runs out", health.Reason)
+		s.webhooks.WalletAlert("walletUnderfunded", health)
+		s.telegram.WalletAlert("walletUnderfunded", health)
+	case !health.Paused && !health.Underfunded && wasDegraded:
+		PaymentsInfoLogger.Printf("[Payments] Resuming payouts, wallet unlocked balance: %v, pending: %v", health.UnlockedBalance, health.Pending)
+		s.webhooks.WalletAlert("walletResumed", health)
+		s.telegram.WalletAlert("walletResumed", health)
+	}
+	if health.Sweep > 0 && (prev == nil || prev.Sweep == 0) {
+		PaymentsInfoLogger.Printf("[Payments] Hot wallet unlocked balance %v is above the buffer of %v and %v pending, sweep %v to cold storage", health.UnlockedBalance, health.Buffer, health.Pending, health.Sweep)
+		s.webhooks.WalletAlert("walletSweep", health)
+		s.telegram.WalletAlert("walletSweep", health)
+	}
+	return health
+}
+
+// Returns the last wallet health check, nil before the first one
+func (u *PayoutsProcessor) walletHealth() *WalletHealth {
+	u.healthMu.RLock()
+	defer u.healthMu.RUnlock()
+	return u.health
+}
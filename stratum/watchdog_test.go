@@ -0,0 +1,66 @@
+package stratum
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+)
+
+const watchdogTestMaxAge = 40 * time.Millisecond
+
+// A daemon returning the same template is detected once the template is older than blockTemplateMaxAge, the pool is sick once the forced refresh confirms it stuck and recovers with the next template
+func TestTemplateWatchdogStalledDaemon(t *testing.T) {
+	s := &StratumServer{templateMaxAge: watchdogTestMaxAge}
+	s.config.Store(&pool.Config{})
+
+	if s.templateStalled() {
+		t.Fatalf("stalled before a first template")
+	}
+	s.templateMoved(100)
+	if s.templateStalled() {
+		t.Fatalf("stalled on a fresh template")
+	}
+
+	// The daemon keeps returning height 100
+	time.Sleep(watchdogTestMaxAge + 10*time.Millisecond)
+	if !s.templateStalled() {
+		t.Fatalf("template older than the max age not stalled")
+	}
+	// Refreshes until the next check do not force another refresh
+	if s.templateStalled() {
+		t.Fatalf("stalled again before the next check")
+	}
+	if s.isSick() {
+		t.Fatalf("pool sick before the daemon is confirmed stuck")
+	}
+
+	// The forced refresh got no new template either
+	s.markTemplateStuck("daemon", 100)
+	if !s.isSick() {
+		t.Fatalf("pool not sick with the daemon stuck")
+	}
+	time.Sleep(watchdogTestMaxAge/4 + 10*time.Millisecond)
+	if !s.templateStalled() {
+		t.Fatalf("stuck daemon not checked again")
+	}
+
+	s.templateMoved(101)
+	if s.isSick() {
+		t.Fatalf("pool still sick after a new template")
+	}
+	if s.templateStalled() {
+		t.Fatalf("stalled after a new template")
+	}
+}
+
+// Without blockTemplateMaxAge the watchdog never fires
+func TestTemplateWatchdogDisabled(t *testing.T) {
+	s := &StratumServer{}
+	s.config.Store(&pool.Config{})
+	atomic.StoreInt64(&s.templateUpdatedAt, time.Now().Add(-time.Hour).UnixNano())
+	if s.templateStalled() {
+		t.Fatalf("stalled with the watchdog disabled")
+	}
+}
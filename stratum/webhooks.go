@@ -0,0 +1,203 @@
+package stratum
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+	"github.com/Nelbert442/dero-golang-pool/util"
+)
+
+type WebhookProcessor struct {
+	config    *pool.WebhooksConfig
+	client    *http.Client
+	queue     chan *WebhookEvent
+	retryIntv time.Duration
+}
+
+type WebhookEvent struct {
+	Event     string  `json:"event"`
+	Id        string  `json:"id"`
+	Address   string  `json:"address,omitempty"`
+	Ip        string  `json:"ip,omitempty"`
+	Worker    string  `json:"worker,omitempty"`
+	Timestamp int64   `json:"timestamp"`
+	LastShare int64   `json:"lastShare,omitempty"`
+	Height    int64   `json:"height,omitempty"`
+	Hash      string  `json:"hash,omitempty"`
+	Reward    uint64  `json:"reward,omitempty"`
+	Solo      bool    `json:"solo,omitempty"`
+	Expected  float64 `json:"expectedBlocks,omitempty"`
+	Found     int64   `json:"foundBlocks,omitempty"`
+	Chance    float64 `json:"probability,omitempty"`
+	Reason    string  `json:"reason,omitempty"`
+	Balance   uint64  `json:"unlockedBalance,omitempty"`
+	Due       uint64  `json:"due,omitempty"`
+	Sweep     uint64  `json:"sweep,omitempty"`
+	Scope     string  `json:"scope,omitempty"`
+	Rate      float64 `json:"rate,omitempty"`
+	Shares    int64   `json:"shares,omitempty"`
+	url       string
+}
+
+// Number of goroutines delivering queued webhooks
+const webhookWorkers = 4
+
+var WebhooksInfoLogger = logFileOutWebhooks("INFO")
+var WebhooksErrorLogger = logFileOutWebhooks("ERROR")
+
+func NewWebhookProcessor(cfg *pool.WebhooksConfig) *WebhookProcessor {
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil || timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	retryIntv, err := time.ParseDuration(cfg.RetryInterval)
+	if err != nil || retryIntv <= 0 {
+		retryIntv = 5 * time.Second
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = 1024
+	}
+
+	w := &WebhookProcessor{
+		config:    cfg,
+		client:    &http.Client{Timeout: timeout},
+		queue:     make(chan *WebhookEvent, queueSize),
+		retryIntv: retryIntv,
+	}
+	return w
+}
+
+func (w *WebhookProcessor) Start() {
+	WebhooksInfoLogger.Printf("[Webhooks] Starting webhooks with %v workers, retries: %v, retry interval: %v", webhookWorkers, w.config.Retries, w.retryIntv)
+
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for event := range w.queue {
+				w.deliver(event)
+			}
+		}()
+	}
+}
+
+func (w *WebhookProcessor) MinerConnected(miner *Miner, ip string) {
+	if w == nil || w.config.MinerConnectURL == "" {
+		return
+	}
+	w.enqueue(&WebhookEvent{Event: "connect", Id: miner.Id, Address: miner.Address, Ip: ip, Worker: miner.WorkID, url: w.config.MinerConnectURL})
+}
+
+func (w *WebhookProcessor) MinerDisconnected(miner *Miner, ip string) {
+	if w == nil || w.config.MinerDisconnectURL == "" {
+		return
+	}
+	w.enqueue(&WebhookEvent{Event: "disconnect", Id: miner.Id, Address: miner.Address, Ip: ip, Worker: miner.WorkID, url: w.config.MinerDisconnectURL})
+}
+
+func (w *WebhookProcessor) WorkerOffline(miner *Miner) {
+	if w == nil || w.config.WorkerOfflineURL == "" {
+		return
+	}
+	w.enqueue(&WebhookEvent{Event: "offline", Id: miner.Id, Address: miner.Address, Ip: miner.Ip, Worker: miner.WorkID, LastShare: atomic.LoadInt64(&miner.LastShare), url: w.config.WorkerOfflineURL})
+}
+
+func (w *WebhookProcessor) BlockFound(miner *Miner, ip string, height int64, hash string, reward uint64) {
+	if w == nil || w.config.BlockFoundURL == "" {
+		return
+	}
+	w.enqueue(&WebhookEvent{Event: "block", Id: miner.Id, Address: miner.Address, Ip: ip, Worker: miner.WorkID, Height: height, Hash: hash, Reward: reward, Solo: miner.IsSolo, url: w.config.BlockFoundURL})
+}
+
+func (w *WebhookProcessor) Withholding(miner *Miner, expected float64, found int64, probability float64) {
+	if w == nil || w.config.WithholdingURL == "" {
+		return
+	}
+	w.enqueue(&WebhookEvent{Event: "withholding", Id: miner.Id, Address: miner.Address, Ip: miner.Ip, Worker: miner.WorkID, Expected: expected, Found: found, Chance: probability, url: w.config.WithholdingURL})
+}
+
+// Payouts paused [walletPaused], running underfunded [walletUnderfunded] or resumed [walletResumed] by the wallet health check, or the hot wallet balance to sweep [walletSweep]
+func (w *WebhookProcessor) WalletAlert(event string, health *WalletHealth) {
+	if w == nil || w.config.WalletAlertURL == "" {
+		return
+	}
+	w.enqueue(&WebhookEvent{Event: event, Id: "wallet", Reason: health.Reason, Balance: health.UnlockedBalance, Due: health.Due, Sweep: health.Sweep, url: w.config.WalletAlertURL})
+}
+
+// Reject or stale rate of a scope above its threshold [rejectAlarm] or back below it [rejectAlarmCleared], Reason is the kind of rate
+func (w *WebhookProcessor) RejectAlarm(event string, scope *rejectScope, kind string, rate float64, shares int64) {
+	if w == nil || w.config.RejectAlarmURL == "" {
+		return
+	}
+	w.enqueue(&WebhookEvent{Event: event, Id: scope.name, Address: scope.address, Worker: scope.worker, Scope: scope.scope, Reason: kind, Rate: rate, Shares: shares, url: w.config.RejectAlarmURL})
+}
+
+// Queues the event for delivery without ever blocking the caller [stratum hot path]. If the queue is full, the event is dropped
+func (w *WebhookProcessor) enqueue(event *WebhookEvent) {
+	event.Timestamp = util.MakeTimestamp() / 1000
+
+	select {
+	case w.queue <- event:
+	default:
+		WebhooksErrorLogger.Printf("[Webhooks] Queue is full, dropping %s event for %s", event.Event, event.Id)
+	}
+}
+
+func (w *WebhookProcessor) deliver(event *WebhookEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		WebhooksErrorLogger.Printf("[Webhooks] Error serializing %s event for %s: %v", event.Event, event.Id, err)
+		return
+	}
+
+	for attempt := 0; attempt <= w.config.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(w.retryIntv)
+		}
+
+		err = w.post(event.url, payload)
+		if err == nil {
+			return
+		}
+
+		WebhooksErrorLogger.Printf("[Webhooks] Failed to deliver %s event for %s (attempt %v/%v): %v", event.Event, event.Id, attempt+1, w.config.Retries+1, err)
+	}
+}
+
+func (w *WebhookProcessor) post(url string, payload []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %v", resp.Status)
+	}
+	return nil
+}
+
+func logFileOutWebhooks(lType string) *util.Logger {
+	logFileName := util.LogFileName("webhooks", lType)
+	os.Mkdir("logs", 0705)
+	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0705)
+	if err != nil {
+		panic(err)
+	}
+
+	logType := lType + ": "
+	l := log.New(f, logType, log.LstdFlags|log.Lmicroseconds)
+	return util.NewLogger("webhooks", lType, l)
+}
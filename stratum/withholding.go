@@ -0,0 +1,139 @@
+package stratum
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rolling blocks expected and found of each pool miner over window, sampled like the share counters of RejectAlarms. Every check samples the cumulative ExpectedBlocks and
+// Accepts of each miner, the miner is judged on the blocks since the oldest sample within window so an old streak of luck neither hides nor flags it forever
+type Withholding struct {
+	mu      sync.Mutex
+	samples map[string][]WithholdingSample
+	// Miners flagged, by miner id. A miner is flagged once until it is back within expectation
+	flagged map[string]struct{}
+}
+
+// Cumulative blocks expected and found of a miner at a check. Exported as the samples of evicted miners are stored with their stats, see keep
+type WithholdingSample struct {
+	At       int64
+	Expected float64
+	Found    int64
+}
+
+func NewWithholding() *Withholding {
+	return &Withholding{samples: make(map[string][]WithholdingSample), flagged: make(map[string]struct{})}
+}
+
+// Copies the samples of m onto it before its stats are stored by evictMiner, so that a miner leaving for a check is judged against the same baseline once restored
+func (w *Withholding) keep(m *Miner) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	samples := append([]WithholdingSample(nil), w.samples[m.Id]...)
+	w.mu.Unlock()
+
+	m.Lock()
+	m.WithholdingSamples = samples
+	m.Unlock()
+}
+
+// Reloads the samples stored with an evicted miner by keep as it is restored. Samples still held for the miner, evicted and restored between two checks, are newer and kept
+func (w *Withholding) restore(id string, samples []WithholdingSample) {
+	if w == nil || len(samples) == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.samples[id]; !ok {
+		w.samples[id] = samples
+	}
+}
+
+// Flags pool miners which have found anomalously few blocks for the difficulty of the shares they have submitted within window. Each accepted share adds shareDiff/networkDiff
+// to the miner's ExpectedBlocks, blocks found are counted in Accepts, and the chance of finding that few blocks for the expectation is the Poisson cdf. Solo miners are skipped,
+// withholding only costs themselves. Miners no longer present [gone from s.miners] are forgotten, evicted miners carry their samples in storage
+func (s *StratumServer) checkWithholding() {
+	cfg := s.currentConfig().Withholding
+	window, err := time.ParseDuration(cfg.Window)
+	if err != nil || window <= 0 {
+		window = 7 * 24 * time.Hour
+	}
+	now := time.Now().Unix()
+
+	w := s.withholding
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seen := make(map[string]struct{})
+	for _, m := range s.miners.Values() {
+		if m.IsSolo || m.Id == s.donateID {
+			continue
+		}
+		seen[m.Id] = struct{}{}
+
+		m.RLock()
+		current := WithholdingSample{At: now, Expected: m.ExpectedBlocks, Found: atomic.LoadInt64(&m.Accepts)}
+		m.RUnlock()
+
+		// Keep the newest sample at or before the start of the window as the baseline
+		samples := append(w.samples[m.Id], current)
+		cutoff := now - int64(window/time.Second)
+		for len(samples) > 1 && samples[1].At <= cutoff {
+			samples = samples[1:]
+		}
+		w.samples[m.Id] = samples
+
+		base := samples[0]
+		expected := current.Expected - base.Expected
+		found := current.Found - base.Found
+		// Counters restart with the miner, a drop means a new baseline
+		if expected < 0 || found < 0 {
+			w.samples[m.Id] = []WithholdingSample{current}
+			continue
+		}
+
+		// Small miners have too few expected blocks for the probability to mean anything
+		if expected < cfg.MinExpectedBlocks {
+			continue
+		}
+
+		probability := poissonCDF(found, expected)
+		_, flagged := w.flagged[m.Id]
+		if probability >= cfg.Probability {
+			// Re-arm the alert once the miner is back within expectation
+			delete(w.flagged, m.Id)
+			continue
+		}
+
+		if !flagged {
+			w.flagged[m.Id] = struct{}{}
+			StratumErrorLogger.Printf("[Stratum] Possible block withholding by %v@%v: found %v blocks, expected %.2f over the last %v (probability %.6f)", m.Id, m.Ip, found, expected, time.Duration(now-base.At)*time.Second, probability)
+			s.webhooks.Withholding(m, expected, found, probability)
+		}
+	}
+
+	for id := range w.samples {
+		if _, ok := seen[id]; !ok {
+			delete(w.samples, id)
+			delete(w.flagged, id)
+		}
+	}
+}
+
+// Returns the probability of finding at most found blocks when expected are expected, P(X <= found) for X ~ Poisson(expected)
+func poissonCDF(found int64, expected float64) float64 {
+	term := math.Exp(-expected)
+	sum := term
+	for k := int64(1); k <= found; k++ {
+		term *= expected / float64(k)
+		sum += term
+	}
+	if sum > 1 {
+		sum = 1
+	}
+	return sum
+}
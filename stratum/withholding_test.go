@@ -0,0 +1,97 @@
+package stratum
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Nelbert442/dero-golang-pool/pool"
+)
+
+func newWithholdingTestServer() *StratumServer {
+	s := &StratumServer{miners: NewMinersMap(), withholding: NewWithholding()}
+	s.config.Store(&pool.Config{Withholding: pool.WithholdingConfig{Enabled: true, Window: "168h", MinExpectedBlocks: 5, Probability: 0.001}})
+	return s
+}
+
+// Evicts m the way evictMiner does around storage: its samples are kept on it, its stats encoded as stored, and it is removed from s.miners. Returns the stored miner
+func withholdingTestEvict(t *testing.T, s *StratumServer, m *Miner) *Miner {
+	s.withholding.keep(m)
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("marshal miner stats: %v", err)
+	}
+	var stored *Miner
+	if err := json.Unmarshal(encoded, &stored); err != nil {
+		t.Fatalf("unmarshal miner stats: %v", err)
+	}
+	s.miners.Remove(m.Id)
+	return stored
+}
+
+// Restores the stored miner into a miner newly created for its login the way restoreEvictedMiner does, and puts it back in s.miners
+func withholdingTestRestore(s *StratumServer, stored *Miner) *Miner {
+	miner := NewMiner(stored.Id, stored.Address, "", 0, "worker", 0, false, "127.0.0.1")
+	miner.Accepts = stored.Accepts
+	miner.ExpectedBlocks = stored.ExpectedBlocks
+	s.withholding.restore(miner.Id, stored.WithholdingSamples)
+	s.miners.Set(miner.Id, miner)
+	return miner
+}
+
+// A miner finding no blocks is flagged once its expectation within the window is significant
+func TestWithholdingFlagsMinerWithoutBlocks(t *testing.T) {
+	s := newWithholdingTestServer()
+	miner := NewMiner("miner", "address", "", 0, "worker", 0, false, "127.0.0.1")
+	s.miners.Set(miner.Id, miner)
+
+	s.checkWithholding()
+	miner.ExpectedBlocks = 10
+	s.checkWithholding()
+	if _, flagged := s.withholding.flagged[miner.Id]; !flagged {
+		t.Fatalf("miner without blocks over %v expected not flagged", miner.ExpectedBlocks)
+	}
+}
+
+// A withholder evicted and restored between checks is judged against its baseline from before the eviction, not a fresh one taken as it is back
+func TestWithholdingBaselineSurvivesEviction(t *testing.T) {
+	s := newWithholdingTestServer()
+	miner := NewMiner("miner", "address", "", 0, "worker", 0, false, "127.0.0.1")
+	s.miners.Set(miner.Id, miner)
+
+	s.checkWithholding()
+	miner.ExpectedBlocks = 10
+	stored := withholdingTestEvict(t, s, miner)
+
+	// The check while the miner is away forgets it in memory
+	s.checkWithholding()
+	if _, ok := s.withholding.samples[miner.Id]; ok {
+		t.Fatalf("samples of the evicted miner still held in memory")
+	}
+
+	restored := withholdingTestRestore(s, stored)
+	s.checkWithholding()
+	if _, flagged := s.withholding.flagged[restored.Id]; !flagged {
+		t.Fatalf("restored miner without blocks over %v expected not flagged, samples %v", restored.ExpectedBlocks, s.withholding.samples[restored.Id])
+	}
+	if base := s.withholding.samples[restored.Id][0]; base.Expected != 0 {
+		t.Fatalf("restored miner judged from a baseline of %v expected blocks, expected the baseline of 0 from before the eviction", base.Expected)
+	}
+}
+
+// A miner evicted and restored before a check runs keeps the samples still held in memory
+func TestWithholdingRestoreKeepsHeldSamples(t *testing.T) {
+	s := newWithholdingTestServer()
+	miner := NewMiner("miner", "address", "", 0, "worker", 0, false, "127.0.0.1")
+	s.miners.Set(miner.Id, miner)
+
+	s.checkWithholding()
+	miner.ExpectedBlocks = 3
+	s.checkWithholding()
+	stored := withholdingTestEvict(t, s, miner)
+	stored.WithholdingSamples = stored.WithholdingSamples[1:]
+
+	withholdingTestRestore(s, stored)
+	if held := len(s.withholding.samples[miner.Id]); held != 2 {
+		t.Fatalf("%v samples held after the restore, expected the 2 held before the eviction", held)
+	}
+}
@@ -0,0 +1,64 @@
+package stratum
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var errSessionClosed = errors.New("session closed")
+var errWriteQueueFull = errors.New("write queue full")
+
+// Queues a message to the session writer. Sending never blocks, a session whose queue is full is too slow [or dead] to keep up and is disconnected
+func (cs *Session) enqueue(message interface{}) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	// Newline delimited, same as the json.Encoder messages were written with
+	payload = append(payload, '\n')
+
+	cs.sendMu.RLock()
+	defer cs.sendMu.RUnlock()
+	if cs.sendClosed {
+		return errSessionClosed
+	}
+	select {
+	case cs.send <- payload:
+		return nil
+	default:
+		if atomic.CompareAndSwapInt32(&cs.overflowed, 0, 1) {
+			StratumErrorLogger.Printf("[Stratum] Write queue of %s full [%v messages], disconnecting", cs.ip, cap(cs.send))
+			// Closing unblocks the writer and the read loop, which removes the session
+			cs.conn.Close()
+		}
+		return errWriteQueueFull
+	}
+}
+
+// Closes the write queue, the writer closes the connection once the messages queued before are written. Safe to call more than once
+func (cs *Session) closeQueue() {
+	cs.sendMu.Lock()
+	defer cs.sendMu.Unlock()
+	if !cs.sendClosed {
+		cs.sendClosed = true
+		close(cs.send)
+	}
+}
+
+// Single writer of the session connection, started along with its read loop. Each write is bounded by writeTimeout, a failed write closes the connection
+func (cs *Session) writeLoop(writeTimeout time.Duration) {
+	for payload := range cs.send {
+		cs.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := cs.conn.Write(payload); err != nil {
+			HandlersDebugLogger.Printf("[Stratum] Write error to %s: %v", cs.ip, err)
+			cs.conn.Close()
+			// Drain until the read loop closes the queue, so enqueue keeps returning instead of overflowing
+			for range cs.send {
+			}
+			return
+		}
+	}
+	cs.conn.Close()
+}
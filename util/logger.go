@@ -0,0 +1,217 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "unknown"
+	}
+	return logLevelNames[l]
+}
+
+// Parses a level name [debug, info, warn or error], case insensitive
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+}
+
+// Leveled logger of a module. Each message is written to the console and the module log file, as text or as a json object per line, when its level is
+// at or above the level of the module
+type Logger struct {
+	module string
+	level  LogLevel
+	file   *log.Logger
+}
+
+// Log format and levels shared by all loggers, the default level applies to modules without their own level
+var logSettings = struct {
+	sync.RWMutex
+	json    bool
+	level   LogLevel
+	modules map[string]LogLevel
+}{level: LevelInfo, modules: make(map[string]LogLevel)}
+
+// Returns the log file of name for the file logger of level [INFO, WARN, ERROR or DEBUG]: warnings and errors go to logs/<name>Error.log, info and debug to logs/<name>.log
+func LogFileName(name, level string) string {
+	if level == "ERROR" || level == "WARN" {
+		return "logs/" + name + "Error.log"
+	}
+	return "logs/" + name + ".log"
+}
+
+// Returns a logger of module writing messages of level [INFO, WARN, ERROR or DEBUG, as the file loggers are named] to the module log file
+func NewLogger(module, level string, file *log.Logger) *Logger {
+	l, err := ParseLogLevel(level)
+	if err != nil {
+		l = LevelInfo
+	}
+	return &Logger{module: module, level: l, file: file}
+}
+
+func (l *Logger) Printf(format string, v ...interface{}) {
+	if !l.enabled() {
+		return
+	}
+	l.write(fmt.Sprintf(format, v...), nil)
+}
+
+// Writes message with fields given as key, value pairs. In json the fields are fields of the object [prefixed with "field_" if they clash with time, level, module,
+// tag or msg], in text they are appended to the message as key=value
+func (l *Logger) Printw(message string, keysAndValues ...interface{}) {
+	if !l.enabled() {
+		return
+	}
+	fields := make([]logField, 0, len(keysAndValues)/2)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields = append(fields, logField{key: fmt.Sprint(keysAndValues[i]), value: keysAndValues[i+1]})
+	}
+	l.write(message, fields)
+}
+
+// Returns whether messages of the logger are written at the current level of its module
+func (l *Logger) enabled() bool {
+	logSettings.RLock()
+	defer logSettings.RUnlock()
+	level, ok := logSettings.modules[l.module]
+	if !ok {
+		level = logSettings.level
+	}
+	return l.level >= level
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+var logReservedFields = map[string]bool{"time": true, "level": true, "module": true, "tag": true, "msg": true}
+
+func (l *Logger) write(message string, fields []logField) {
+	logSettings.RLock()
+	asJSON := logSettings.json
+	logSettings.RUnlock()
+
+	if !asJSON {
+		for _, field := range fields {
+			message += fmt.Sprintf(" %s=%v", field.key, field.value)
+		}
+		log.Print(message)
+		l.file.Print(message)
+		return
+	}
+
+	// Messages are tagged as "[Tag] message", the tag is split off into its own field
+	entry := map[string]interface{}{"time": time.Now().UTC().Format(time.RFC3339Nano), "level": l.level.String(), "module": l.module, "msg": message}
+	if strings.HasPrefix(message, "[") {
+		if i := strings.Index(message, "] "); i != -1 {
+			entry["tag"], entry["msg"] = message[1:i], message[i+2:]
+		}
+	}
+	for _, field := range fields {
+		key := field.key
+		if logReservedFields[key] {
+			key = "field_" + key
+		}
+		// Errors marshal as {} otherwise
+		if err, ok := field.value.(error); ok {
+			entry[key] = err.Error()
+		} else {
+			entry[key] = field.value
+		}
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		// A field json can not represent, the fields are written as text instead of dropping the message
+		for _, field := range fields {
+			key := field.key
+			if logReservedFields[key] {
+				key = "field_" + key
+			}
+			entry[key] = fmt.Sprint(field.value)
+		}
+		if line, err = json.Marshal(entry); err != nil {
+			return
+		}
+	}
+	line = append(line, '\n')
+	log.Writer().Write(line)
+	l.file.Writer().Write(line)
+}
+
+// Sets the log format ["text" or "json"], the default level and the levels of modules overriding it
+func ConfigureLogging(format, level string, modules map[string]string) error {
+	if format != "" && format != "text" && format != "json" {
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	defaultLevel := LevelInfo
+	if level != "" {
+		var err error
+		if defaultLevel, err = ParseLogLevel(level); err != nil {
+			return err
+		}
+	}
+	moduleLevels := make(map[string]LogLevel)
+	for module, name := range modules {
+		moduleLevel, err := ParseLogLevel(name)
+		if err != nil {
+			return fmt.Errorf("module %v: %v", module, err)
+		}
+		moduleLevels[strings.ToLower(module)] = moduleLevel
+	}
+
+	logSettings.Lock()
+	logSettings.json = format == "json"
+	logSettings.level = defaultLevel
+	logSettings.modules = moduleLevels
+	logSettings.Unlock()
+	return nil
+}
+
+// Sets the level of module at runtime, the default level when module is "". Returns the level set
+func SetLogLevel(module, level string) (LogLevel, error) {
+	l, err := ParseLogLevel(level)
+	if err != nil {
+		return l, err
+	}
+	logSettings.Lock()
+	if module == "" {
+		logSettings.level = l
+	} else {
+		logSettings.modules[strings.ToLower(module)] = l
+	}
+	logSettings.Unlock()
+	return l, nil
+}
+
+// Returns the default level and the levels of the modules overriding it
+func LogLevels() (string, map[string]string) {
+	logSettings.RLock()
+	defer logSettings.RUnlock()
+	modules := make(map[string]string)
+	for module, level := range logSettings.modules {
+		modules[module] = level.String()
+	}
+	return logSettings.level.String(), modules
+}
@@ -0,0 +1,78 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+// Returns a logger of module at level writing its file output to the returned buffer, the console output is discarded for the duration of the test
+func newTestLogger(t *testing.T, module, level string) (*Logger, *bytes.Buffer) {
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		ConfigureLogging("", "", nil)
+	})
+	var file bytes.Buffer
+	return NewLogger(module, level, log.New(&file, level+": ", 0)), &file
+}
+
+// Debug messages [e.g. every unknown method after the first of a connection] are dropped unless debug is enabled for the module or by default
+func TestDebugLoggerGatedOnLevel(t *testing.T) {
+	debug, file := newTestLogger(t, "handlers", "DEBUG")
+	if err := ConfigureLogging("text", "info", nil); err != nil {
+		t.Fatalf("configure logging: %v", err)
+	}
+
+	debug.Printf("[Handlers] Unknown RPC method %q from %s", "spam", "127.0.0.1")
+	debug.Printw("[Handlers] Unknown RPC method", "method", "spam")
+	if file.Len() != 0 {
+		t.Fatalf("debug message written at level info: %q", file.String())
+	}
+
+	// Debug enabled for another module only
+	if _, err := SetLogLevel("api", "debug"); err != nil {
+		t.Fatalf("set log level: %v", err)
+	}
+	debug.Printf("[Handlers] Unknown RPC method %q from %s", "spam", "127.0.0.1")
+	if file.Len() != 0 {
+		t.Fatalf("debug message written with debug enabled for another module: %q", file.String())
+	}
+
+	if _, err := SetLogLevel("handlers", "debug"); err != nil {
+		t.Fatalf("set log level: %v", err)
+	}
+	debug.Printf("[Handlers] Unknown RPC method %q from %s", "spam", "127.0.0.1")
+	if file.Len() == 0 {
+		t.Fatalf("debug message dropped with debug enabled for the module")
+	}
+}
+
+// Messages at or above the level of the module are written, whatever the default level
+func TestLoggerModuleLevelOverridesDefault(t *testing.T) {
+	warn, file := newTestLogger(t, "handlers", "WARN")
+	if err := ConfigureLogging("text", "debug", map[string]string{"Handlers": "error"}); err != nil {
+		t.Fatalf("configure logging: %v", err)
+	}
+	warn.Printf("[Handlers] warning")
+	if file.Len() != 0 {
+		t.Fatalf("warning written with the module at level error: %q", file.String())
+	}
+
+	errLogger, file := newTestLogger(t, "handlers", "ERROR")
+	errLogger.Printf("[Handlers] error")
+	if file.Len() == 0 {
+		t.Fatalf("error dropped with the module at level error")
+	}
+}
+
+// Warnings are written with errors to the error log file of a module, info and debug messages to its log file
+func TestLogFileName(t *testing.T) {
+	for level, expected := range map[string]string{"DEBUG": "logs/handlers.log", "INFO": "logs/handlers.log", "WARN": "logs/handlersError.log", "ERROR": "logs/handlersError.log"} {
+		if name := LogFileName("handlers", level); name != expected {
+			t.Fatalf("%v messages written to %v, expected %v", level, name, expected)
+		}
+	}
+}
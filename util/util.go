@@ -2,6 +2,8 @@ package util
 
 import (
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"math/big"
 	"os"
@@ -32,15 +34,44 @@ func MakeTimestamp() int64 {
 }
 
 func GetTargetHex(diff int64) string {
+	return GetTargetHexEncoded(diff, "uint32")
+}
+
+// Returns the little endian target sent to miners for a given difficulty. "uint64" sends the 8 most significant bytes of the target, anything else the 4 most significant bytes [compact, default]
+// The compact target loses precision at higher difficulties, see GetTargetDifficulty to determine the difficulty a target actually represents
+func GetTargetHexEncoded(diff int64, encoding string) string {
 	padded := make([]byte, 32)
 
 	diffBuff := new(big.Int).Div(Diff1, big.NewInt(diff)).Bytes()
 	copy(padded[32-len(diffBuff):], diffBuff)
-	buff := padded[0:4]
+
+	var buff []byte
+	if encoding == "uint64" {
+		buff = padded[0:8]
+	} else {
+		buff = padded[0:4]
+	}
 	targetHex := hex.EncodeToString(reverse(buff))
 	return targetHex
 }
 
+// Returns the difficulty represented by a little endian target, the reverse of GetTargetHexEncoded
+func GetTargetDifficulty(targetHex string) (int64, bool) {
+	targetBytes, err := hex.DecodeString(targetHex)
+	if err != nil || len(targetBytes) == 0 || len(targetBytes) > 32 {
+		return 0, false
+	}
+
+	padded := make([]byte, 32)
+	copy(padded, reverse(targetBytes))
+
+	target := new(big.Int).SetBytes(padded)
+	if target.Cmp(new(big.Int)) == 0 {
+		return 0, false
+	}
+	return new(big.Int).Div(Diff1, target).Int64(), true
+}
+
 func GetHashDifficulty(hashBytes []byte) (*big.Int, bool) {
 	diff := new(big.Int)
 	diff.SetBytes(reverse(hashBytes))
@@ -56,17 +87,19 @@ func ValidateAddressNonDERO(addy string, poolAddy string) bool {
 	prefix, _ := utf8.DecodeRuneInString(addy)
 	poolPrefix, _ := utf8.DecodeRuneInString(poolAddy)
 	if prefix != poolPrefix {
-		log.Printf("[Util] Address prefix (%v) and pool address prefix (%v) do not match. Invalid address.", prefix, poolPrefix)
 		UtilErrorLogger.Printf("[Util] Address prefix (%v) and pool address prefix (%v) do not match. Invalid address.", prefix, poolPrefix)
 		return false
 	}
 	addyRune := []rune(addy)
 	poolAddyRune := []rune(poolAddy)
+	if len(addyRune) < 2 || len(poolAddyRune) < 2 {
+		UtilErrorLogger.Printf("[Util] Invalid address, address too short.")
+		return false
+	}
 	// Validating only first 2 since usually they match in other coins. Could // TODO in future to properly handle or just skip this portion alltogether
 	poolAddyNetwork := string(poolAddyRune[0:2])
 
 	if string(addyRune[0:2]) != poolAddyNetwork {
-		log.Printf("[Util] Invalid address, pool address and supplied address don't match.")
 		UtilErrorLogger.Printf("[Util] Invalid address, pool address and supplied address don't match.")
 		return false
 	}
@@ -74,34 +107,97 @@ func ValidateAddressNonDERO(addy string, poolAddy string) bool {
 	return true
 }
 
-func ValidateAddress(addy string, poolAddy string) bool {
-	prefix, _ := utf8.DecodeRuneInString(addy)
-	poolPrefix, _ := utf8.DecodeRuneInString(poolAddy)
-	if prefix != poolPrefix {
-		log.Printf("[Util] Address prefix (%v) and pool address prefix (%v) do not match. Invalid address.", prefix, poolPrefix)
-		UtilErrorLogger.Printf("[Util] Address prefix (%v) and pool address prefix (%v) do not match. Invalid address.", prefix, poolPrefix)
-		return false
+// Errors returned by ParseAddress and CheckAddress, to distinguish an address of the other network from one that does not parse
+var ErrAddressWrongNetwork = errors.New("address is for a different network than the pool")
+var ErrAddressMalformed = errors.New("malformed address")
+
+// Error of an address that failed validation. Err is ErrAddressWrongNetwork or ErrAddressMalformed, Reason tells the miner what is wrong with the address
+type AddressError struct {
+	Err    error
+	Reason string
+}
+
+func (e *AddressError) Error() string {
+	return e.Err.Error() + ": " + e.Reason
+}
+
+func (e *AddressError) Unwrap() error {
+	return e.Err
+}
+
+// Decoded DERO address. PaymentID is the hex payment id embedded in an integrated address, PublicKey the hex spend and view keys, the same for an address and its integrated addresses
+type AddressInfo struct {
+	Network    string
+	Integrated bool
+	PaymentID  string
+	PublicKey  string
+}
+
+// Returns the network of a DERO address from its prefix, dERo/dERi for mainnet and dETo/dETi for testnet [i for integrated]. Returns "" if the prefix is not known
+func AddressNetwork(addy string) string {
+	switch {
+	case strings.HasPrefix(addy, "dER"):
+		return "mainnet"
+	case strings.HasPrefix(addy, "dET"):
+		return "testnet"
 	}
-	addyRune := []rune(addy)
-	poolAddyRune := []rune(poolAddy)
-	// Validating only first 3 (dET or dER) since possibly integrated addrs could be dETi or dERi and pool addr could be either dETi, dERi, dETo, dERo [i for integrated]
-	poolAddyNetwork := string(poolAddyRune[0:3])
+	return ""
+}
 
-	if string(addyRune[0:3]) != poolAddyNetwork {
-		log.Printf("[Util] Invalid address, pool address and supplied address don't match testnet(dETo)/mainnet(dERo).")
-		UtilErrorLogger.Printf("[Util] Invalid address, pool address and supplied address don't match testnet(dETo)/mainnet(dERo).")
-		return false
+// Returns the address prefixes of network, for error messages
+func addressPrefixes(network string) string {
+	if network == "testnet" {
+		return "dETo or dETi"
+	}
+	return "dERo or dERi"
+}
+
+// Decodes the address with derosuite and validates it against the pool address network, the network decoded from the address has to match its prefix.
+// Returned errors are an *AddressError wrapping ErrAddressWrongNetwork or ErrAddressMalformed
+func ParseAddress(addy string, poolAddy string) (*AddressInfo, error) {
+	addy = strings.TrimSpace(addy)
+	network := AddressNetwork(addy)
+	poolNetwork := AddressNetwork(poolAddy)
+
+	if network != "" && poolNetwork != "" && network != poolNetwork {
+		UtilErrorLogger.Printf("[Util] Address '%s' is a %s address, pool is on %s.", addy, network, poolNetwork)
+		return nil, &AddressError{Err: ErrAddressWrongNetwork, Reason: fmt.Sprintf("%s address used on a %s pool", network, poolNetwork)}
+	}
+	if network == "" {
+		UtilErrorLogger.Printf("[Util] Address '%s' does not have a known network prefix (dERo/dETo).", addy)
+		return nil, &AddressError{Err: ErrAddressMalformed, Reason: "unknown address prefix, expected " + addressPrefixes(poolNetwork)}
 	}
 
 	// Call NewAddress to confirm address validation from "github.com/deroproject/derosuite/address"
-	_, err := address.NewAddress(strings.TrimSpace(addy))
-	if err != nil {
-		log.Printf("[Util] Address validation failed for '%s': %s", addy, err)
-		UtilErrorLogger.Printf("[Util] Address validation failed for '%s': %s", addy, err)
-		return false
+	addr, err := address.NewAddress(addy)
+	if err != nil || addr == nil {
+		UtilErrorLogger.Printf("[Util] Address validation failed for '%s': %v", addy, err)
+		return nil, &AddressError{Err: ErrAddressMalformed, Reason: fmt.Sprintf("address does not decode, check that it is complete [%v]", err)}
+	}
+	decodedNetwork := "testnet"
+	if addr.IsDERONetwork() {
+		decodedNetwork = "mainnet"
+	}
+	if decodedNetwork != network {
+		UtilErrorLogger.Printf("[Util] Address '%s' has a %s prefix but decodes as a %s address.", addy, network, decodedNetwork)
+		return nil, &AddressError{Err: ErrAddressMalformed, Reason: fmt.Sprintf("%s prefix on a %s address", network, decodedNetwork)}
 	}
 
-	return true
+	info := &AddressInfo{Network: network, Integrated: addr.IsIntegratedAddress(), PublicKey: hex.EncodeToString(addr.SpendKey[:]) + hex.EncodeToString(addr.ViewKey[:])}
+	if info.Integrated {
+		info.PaymentID = hex.EncodeToString(addr.PaymentID)
+	}
+	return info, nil
+}
+
+// Validates the address against the pool address network, then confirms it parses with derosuite. Returned errors wrap ErrAddressWrongNetwork or ErrAddressMalformed
+func CheckAddress(addy string, poolAddy string) error {
+	_, err := ParseAddress(addy, poolAddy)
+	return err
+}
+
+func ValidateAddress(addy string, poolAddy string) bool {
+	return CheckAddress(addy, poolAddy) == nil
 }
 
 func reverse(src []byte) []byte {
@@ -142,13 +238,8 @@ func AstroBWTHash(shareBuff []byte, diff, setDiff big.Int) (bool, bool) {
 	return checkPowHashBig, success
 }
 
-func logFileOutUtil(lType string) *log.Logger {
-	var logFileName string
-	if lType == "ERROR" {
-		logFileName = "logs/utilError.log"
-	} else {
-		logFileName = "logs/util.log"
-	}
+func logFileOutUtil(lType string) *Logger {
+	logFileName := LogFileName("util", lType)
 	os.Mkdir("logs", 0705)
 	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0705)
 	if err != nil {
@@ -157,5 +248,5 @@ func logFileOutUtil(lType string) *log.Logger {
 
 	logType := lType + ": "
 	l := log.New(f, logType, log.LstdFlags|log.Lmicroseconds)
-	return l
+	return NewLogger("util", lType, l)
 }